@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"github.com/cfagiani/cotfs/internal/app/indexer"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"sync"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var progName = filepath.Base(os.Args[0])
@@ -20,28 +25,128 @@ func main() {
 
 	var scanDirectories dirFlag
 	flag.Var(&scanDirectories, "scanDir", "Directory to scan for existing files. Can be repeated.")
+	backfill := flag.Bool("backfill", false,
+		"Fill in the size, modification time, checksum and MIME type of files indexed before they were recorded.")
+	runs := flag.Int("runs", 0, "List the latest runs of the indexer, at most this many, and exit.")
+	keywords := flag.String("keywords", "", "JSON file of keywords and the tags applied to the PDFs and office "+
+		"documents containing them, e.g. {\"invoice\": \"finance/invoice\"}.")
+	dirTags := flag.Int("dirTags", 0, "Tag new files with the names of the directories they are in below the scan "+
+		"directory, at most this many from the top (-1 for all of them).")
+	stopWords := flag.String("stopWords", "",
+		"Comma separated names of directories not made tags with -dirTags, regardless of case.")
+	dateTags := flag.Bool("dateTags", false, "Tag new files with the year and month they were taken (for JPEG photos "+
+		"with EXIF metadata) or last modified, e.g. 2023 and 2023-07.")
+	var excludes dirFlag
+	flag.Var(&excludes, "exclude", "Pattern of the paths under the scan directories to leave out, e.g. node_modules/ "+
+		"or *.tmp, in the syntax of "+indexer.IgnoreFile+" files. Can be repeated.")
+	workers := flag.Int("workers", runtime.NumCPU(),
+		"Number of files indexed at a time, e.g. to read the text of documents, for all the scan directories.")
+	prune := flag.Bool("prune", false,
+		"Delete the records of the files under the scan directories that no longer exist instead of indexing them.")
+	dryRun := flag.Bool("dry-run", false, "With -prune, list the files that would be deleted without deleting them.")
+	tagMap := flag.String("tagmap", "",
+		"JSON file mapping file extensions to tags, merged over the default map, e.g. {\".heic\": [\"media\", \"image\"]}.")
 
 	flag.Usage = usage
 	flag.Parse()
 
-	if scanDirectories == nil || len(scanDirectories) == 0 || flag.NArg() != 1 {
+	if (len(scanDirectories) == 0 && (*prune || (!*backfill && *runs <= 0))) || flag.NArg() != 1 {
 		usage()
 		os.Exit(2)
 	}
 	metadataPath := flag.Arg(0)
+	if *runs > 0 {
+		listRuns(metadataPath, *runs)
+		return
+	}
+
+	options := indexer.Options{DirectoryTagDepth: *dirTags, DateTags: *dateTags, Exclude: excludes,
+		Workers: *workers}
+	if err := indexer.CheckExcludes(excludes); err != nil {
+		log.Fatalf("could not use the exclusions: %v", err)
+	}
+	if *stopWords != "" {
+		options.StopWords = strings.Split(*stopWords, ",")
+	}
+	if *tagMap != "" {
+		var err error
+		if options.TagMap, err = indexer.LoadTagMap(*tagMap); err != nil {
+			log.Fatalf("could not load the tag map: %v", err)
+		}
+	}
+	if *keywords != "" {
+		var err error
+		if options.KeywordRules, err = indexer.LoadKeywordRules(*keywords); err != nil {
+			log.Fatalf("could not load the keyword rules: %v", err)
+		}
+	}
+
+	// interrupting the indexer stops it cleanly, keeping the files indexed so far
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		log.Print("stopping")
+		cancel()
+	}()
+
+	if *prune {
+		pruneDirectories(ctx, scanDirectories, metadataPath, *dryRun)
+		return
+	}
+
+	if len(scanDirectories) > 0 {
+		stats, err := indexer.IndexPathsWithOptions(ctx, scanDirectories, metadataPath, options)
+		if err != nil {
+			log.Printf("could not index all the directories: %v", err)
+		}
+		for i, worker := range stats {
+			log.Printf("worker %d: %d files, %d new in %d batches, busy for %s", i+1, worker.Files, worker.Created,
+				worker.Batches, worker.Busy.Round(time.Millisecond))
+		}
+	}
+	if *backfill {
+		filled, err := indexer.BackfillContext(ctx, metadataPath)
+		if err != nil {
+			fmt.Printf("could not fill in file details: %v", err)
+		}
+		log.Printf("filled in the details of %d files", filled)
+	}
+}
+
+// Prints the latest runs of the indexer, one per line: id, start time, end time ("-" if the run didn't finish) and the
+// directory indexed.
+func listRuns(metadataPath string, limit int) {
+	runs, err := indexer.Runs(metadataPath, limit)
+	if err != nil {
+		log.Fatalf("could not list runs: %v", err)
+	}
+	for _, run := range runs {
+		finished := "-"
+		if !run.Finished.IsZero() {
+			finished = run.Finished.Format(time.RFC3339)
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\n", run.Id, run.Started.Format(time.RFC3339), finished, run.Root)
+	}
+}
 
-	var wg sync.WaitGroup
-	wg.Add(len(scanDirectories))
-	for _, dir := range scanDirectories {
-		go func() {
-			err := indexer.IndexPath(dir, metadataPath)
-			if err != nil {
-				fmt.Printf("could not index directory: %v", err)
-			}
-			wg.Done()
-		}()
+// Prunes the directories one at a time, printing the path of each file deleted (or that would be with dryRun).
+func pruneDirectories(ctx context.Context, dirs []string, metadataPath string, dryRun bool) {
+	for _, dir := range dirs {
+		pruned, err := indexer.PruneContext(ctx, dir, metadataPath, dryRun)
+		for _, file := range pruned {
+			fmt.Println(filepath.Join(file.Path, file.Name))
+		}
+		if err != nil {
+			log.Printf("could not prune %s: %v", dir, err)
+		} else if dryRun {
+			log.Printf("would delete %d missing files under %s", len(pruned), dir)
+		} else {
+			log.Printf("deleted %d missing files under %s", len(pruned), dir)
+		}
 	}
-	wg.Wait()
 }
 
 func usage() {
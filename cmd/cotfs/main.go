@@ -1,13 +1,24 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/cfagiani/cotfs/internal/app/cotfs"
+	"github.com/cfagiani/cotfs/internal/app/indexer"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
 	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var progName = filepath.Base(os.Args[0])
@@ -16,22 +27,271 @@ func main() {
 	log.SetFlags(0)
 	log.SetPrefix(progName + ": ")
 
+	var options cotfs.Options
+	flag.IntVar(&options.BatchSize, "batchSize", 1000,
+		"Directories with more files than this list them in numbered sub-directories of this size. 0 disables.")
+
+	flag.BoolVar(&options.WriteThrough, "writable", false,
+		"Allow files to be opened for writing, modifying the backing files on disk.")
+	flag.BoolVar(&options.Symlinks, "symlinks", false,
+		"Present files as symlinks to their location on disk instead of proxying their content.")
+	flag.BoolVar(&options.RecursiveRemove, "recursiveRmdir", false,
+		"Allow removing tags from the root even if files only have that tag; those files are tagged 'uncategorized'.")
+	flag.BoolVar(&options.HideEmptyTags, "hideEmptyTags", false,
+		"Leave tag directories that would not contain any files out of listings.")
+	flag.BoolVar(&options.CachedAttrs, "cachedAttrs", false,
+		"Report file sizes and times recorded when indexing instead of reading them from disk, for slow or offline disks.")
+	flag.BoolVar(&options.HideDotTags, "hideDotTags", false,
+		"Leave tags whose names start with a dot out of listings; they can still be opened by name.")
+	flag.BoolVar(&options.Hierarchical, "hierarchy", false,
+		"List the sub-tags created with mkdir under each tag instead of all co-occurring tags.")
+	flag.IntVar(&options.MaxDepth, "maxDepth", 0,
+		"Maximum number of tags in a path; directories that deep list only files. 0 is unlimited.")
+	flag.DurationVar(&options.RefreshInterval, "refresh", 5*time.Second,
+		"How often to check the metadata database for changes made by other processes. 0 disables.")
+	flag.BoolVar(&options.Permissions, "permissions", false,
+		"Share the mount with all users, enforcing an owner and mode on each tag and file (set with chmod/chown).")
+	flag.BoolVar(&options.UserViews, "userViews", false,
+		"Share the mount with all users, hiding tags granted to other users (with the grant command) from each user.")
+	flag.StringVar(&options.Inbox, "inbox", "",
+		"Directory to store files copied into the mount in. Copying files in is refused if not set.")
+	flag.BoolVar(&options.Trash, "trash", false,
+		"Move files removed from a tag directory to the .trash tag so they can be restored.")
+	flag.DurationVar(&options.TrashExpiry, "trashExpiry", 30*24*time.Hour,
+		"How long removed files stay in the trash before being purged when mounting. 0 keeps them.")
+	flag.BoolVar(&options.Database.CaseInsensitiveTags, "ignoreCase", false,
+		"Match tag names regardless of case. This is stored in the metadata database and applies to later mounts too.")
+	flag.BoolVar(&options.FinderTags, "finderTags", false,
+		"Replace the macOS Finder tags of files with their tags when these are changed through the mount.")
+	flag.BoolVar(&options.AccessTimes, "atime", false,
+		"Record the times files are opened in the metadata database and report them as their access times.")
+	flag.BoolVar(&options.Database.BackupBeforeMigrate, "backup", false,
+		"Copy the metadata database to <metadataFile>.v<version>-<time>.bak before upgrading its schema.")
+	flag.StringVar(&options.Database.JournalMode, "journalMode", "WAL",
+		"SQLite journal mode of the metadata database. WAL lets other processes read it while the mount writes.")
+	flag.DurationVar(&options.Database.BusyTimeout, "busyTimeout", 10*time.Second,
+		"How long to wait for other processes to release the metadata database before failing.")
+	flag.StringVar(&options.Database.Synchronous, "synchronous", "NORMAL",
+		"When changes to the metadata database are synced to disk: OFF, NORMAL, FULL or EXTRA.")
+	flag.IntVar(&options.Database.MaxOpenConns, "maxConns", 0,
+		"Most connections to the metadata database open at once. Writes take turns on one of them. 0 is unlimited.")
+	flag.IntVar(&options.Database.MaxIdleConns, "idleConns", 0,
+		"Connections to the metadata database kept open between requests. 0 keeps the default of 2.")
+	metricsAddr := flag.String("metricsAddr", "",
+		"Address (e.g. localhost:6060) serving the timings of metadata queries as JSON at /debug/vars. Off if empty.")
+	key := flag.String("key", "",
+		"Key the metadata database is encrypted with (needs a build with -tags sqlcipher). Other users can see it in the "+
+			"process list; -promptKey or the "+db.KeyEnvVar+" environment variable keep it private.")
+	promptKey := flag.Bool("promptKey", false,
+		"Ask for the key the metadata database is encrypted with when mounting, reading it from standard input.")
+	foreignKeys := flag.Bool("foreignKeys", true,
+		"Refuse changes to the metadata database linking files and tags that don't exist.")
+	dryRun := flag.Bool("migrateDryRun", false,
+		"List the schema upgrades mounting would apply to the metadata database, without applying them, and exit.")
+	dirMode := flag.String("dirMode", "0755", "Permission bits of tag directories, in octal.")
+	fileMask := flag.String("fileMask", "0",
+		"Permission bits to remove from the modes of files, in octal (e.g. 0022 hides write access from others).")
+	uid := flag.Int("uid", -1, "Report every tag and file as owned by this user id (the mounting user if only -gid is set).")
+	gid := flag.Int("gid", -1, "Report every tag and file as owned by this group id (the mounting user's if only -uid is set).")
+	rootFiles := flag.String("showRootFiles", "none",
+		"Files to list in the root directory: none, all or single (only files with exactly one tag).")
+	memory := flag.Bool("memory", false,
+		"Keep the metadata database in memory, discarding it on unmount. Only the mount point is passed.")
+	var scanDirectories dirFlag
+	flag.Var(&scanDirectories, "scanDir",
+		"Directory to index when mounting, e.g. to fill in a -memory database. Can be repeated.")
+	flag.StringVar(&options.ConfigFile, "config", "", "JSON file of settings overriding -batchSize, -maxDepth, "+
+		"-hideEmptyTags and -hideDotTags, e.g. {\"batchSize\": 500}. Reloaded on SIGHUP.")
+	flag.StringVar(&options.TagMapFile, "tagmap", "", "JSON file mapping file extensions to tags for the files "+
+		"indexed with -scanDir and the reindex command, e.g. {\".heic\": [\"media\", \"image\"]}. Reloaded on SIGHUP.")
+	proto := flag.String("proto", "9p",
+		"Protocol the serve command exports the tag directories over. Only 9p is supported.")
+	addr := flag.String("addr", "localhost:5640", "Address the serve command listens on.")
+
 	flag.Usage = usage
-	flag.Parse()
+	// the serve command takes the same flags as mounting
+	serving := len(os.Args) > 1 && os.Args[1] == "serve"
+	if serving {
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
-	if flag.NArg() != 2 {
+	if *dryRun && flag.NArg() >= 1 {
+		if err := listPendingMigrations(flag.Arg(0), *key, *promptKey); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	args := flag.Args()
+	if *memory {
+		args = append([]string{db.NewMemoryDatabase()}, args...)
+	}
+	// the metadata file and the mount point, which serving has none of
+	expected := 2
+	if serving {
+		expected = 1
+	}
+	if len(args) != expected {
 		usage()
 		os.Exit(2)
 	}
-	metadataPath := flag.Arg(0)
-	mountpoint := flag.Arg(1)
-	if err := cotfs.Mount(metadataPath, mountpoint, storage.LocalFileStorage{}); err != nil {
+	options.Database.DisableForeignKeys = !*foreignKeys
+	options.Database.Key = *key
+	var err error
+	if *promptKey {
+		if options.Database.Key, err = readKey(args[0]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	options.RootFiles, err = cotfs.ParseRootFileMode(*rootFiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if options.DirMode, err = parseMode(*dirMode); err != nil {
+		log.Fatal(err)
+	}
+	if options.FileModeMask, err = parseMode(*fileMask); err != nil {
+		log.Fatal(err)
+	}
+	if *uid >= 0 || *gid >= 0 {
+		options.OverrideOwner = true
+		options.Uid, options.Gid = uint32(os.Getuid()), uint32(os.Getgid())
+		if *uid >= 0 {
+			options.Uid = uint32(*uid)
+		}
+		if *gid >= 0 {
+			options.Gid = uint32(*gid)
+		}
+	}
+	if options.Inbox != "" {
+		// files are recorded by absolute path
+		if options.Inbox, err = filepath.Abs(options.Inbox); err != nil {
+			log.Fatal(err)
+		}
+	}
+	metadataPath := args[0]
+	if boltstore.IsPath(metadataPath) && len(scanDirectories) > 0 {
+		// bolt files are locked by the process that has them open, so the store is closed again before mounting it
+		indexOptions, err := cotfs.LoadIndexerOptions(options.TagMapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = indexer.IndexPathsWithOptions(context.Background(), scanDirectories, metadataPath, indexOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *memory || len(scanDirectories) > 0 {
+		// a database in memory only lives while a connection to it is open, so the one filling it stays open until
+		// the filesystem is unmounted
+		seedOptions := options.Database
+		seedOptions.Source = db.SourceIndexer
+		database, err := db.OpenWithOptions(metadataPath, seedOptions)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer db.Close(database)
+		indexOptions, err := cotfs.LoadIndexerOptions(options.TagMapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, dir := range scanDirectories {
+			err = indexer.IndexPathIntoStoreWithOptions(context.Background(), db.NewSQLiteStore(database), dir,
+				indexOptions)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if *metricsAddr != "" {
+		// the db package publishes its timings with expvar, which serves them on the default mux
+		go func() {
+			log.Print(http.ListenAndServe(*metricsAddr, nil))
+		}()
+	}
+	if serving {
+		if err := serve(*proto, *addr, metadataPath, options); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	mountpoint := args[1]
+	if err := cotfs.Mount(metadataPath, mountpoint, storage.LocalFileStorage{}, options); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// Serves the tag directories over the protocol passed in to the clients connecting to the address, until the process
+// is stopped.
+func serve(proto string, addr string, metadataPath string, options cotfs.Options) error {
+	if proto != "9p" {
+		return fmt.Errorf("unknown protocol %q, only 9p is supported", proto)
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Serving %s over 9P on %s", metadataPath, listener.Addr())
+	return cotfs.Serve(metadataPath, listener, storage.LocalFileStorage{}, options)
+}
+
+// Prints the schema migrations opening the metadata database would apply, opening it with the key passed in (or the
+// one read from standard input if prompted for) if it is encrypted.
+func listPendingMigrations(metadataPath string, key string, promptKey bool) error {
+	var err error
+	if promptKey {
+		if key, err = readKey(metadataPath); err != nil {
+			return err
+		}
+	}
+	pending, err := db.PendingMigrationsWithOptions(metadataPath, db.OpenOptions{Key: key})
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("%s is up to date\n", metadataPath)
+	}
+	for _, migration := range pending {
+		fmt.Printf("%d: %s\n", migration.Version, migration.Description)
+	}
+	return nil
+}
+
+// Asks for the key of an encrypted metadata database, reading the first line of standard input. The key is echoed
+// if typed on a terminal, so it is best piped in (i.e. from a password manager).
+func readKey(metadataPath string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Key for %s: ", metadataPath)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("could not read the key: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Parses permission bits written in octal.
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+		return 0, fmt.Errorf("invalid mode %s", value)
+	}
+	return os.FileMode(mode), nil
+}
+
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", progName)
 	fmt.Fprintf(os.Stderr, "  %s <metadataFile> <mountPoint>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s -memory [-scanDir <dir>]... <mountPoint>\n", progName)
+	fmt.Fprintf(os.Stderr, "  %s serve [-proto 9p] [-addr <host:port>] <metadataFile>\n", progName)
 	flag.PrintDefaults()
 }
+
+type dirFlag []string
+
+func (i *dirFlag) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *dirFlag) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
@@ -0,0 +1,76 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+)
+
+// Name of the directory in the root of the mount listing every file.
+const allDirName = ".all"
+
+// AllDir is the /.all directory, a flat read-only listing of every file in the metadata database regardless of its
+// tags. Like tag directories, it groups its files into batches when there are too many to list at once.
+type AllDir struct {
+	// a root directory listing every file, which the lookups and listings are delegated to
+	dir *Dir
+}
+
+// Builds the directory listing every file of the mount whose root is passed in.
+func newAllDir(root *Dir) *AllDir {
+	dir := root.childDir(nil, nil, nil)
+	dir.options.RootFiles = RootFilesAll
+	return &AllDir{dir: dir}
+}
+
+var _ fs.Node = (*AllDir)(nil)
+
+func (a *AllDir) Attr(ctx context.Context, attr *fuse.Attr) error {
+	tagAttr(attr, a.dir.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&AllDir{})
+
+// Looks up a file (or its tag sidecar) or a batch of files by name.
+func (a *AllDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	dir, err := a.dir.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	node, err := dir.lookupFile(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		return node, nil
+	}
+	if batch := dir.lookupBatch(ctx, req.Name); batch != nil {
+		return batch, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ = fs.NodeOpener(&AllDir{})
+
+// Opens the directory for listing. With user views enabled, the handle is the view of the directory for the user
+// opening it.
+func (a *AllDir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer func() { err = toErrno(err) }()
+	dir, err := a.dir.forUser(requestContext(ctx), req.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return &AllDir{dir: dir}, nil
+}
+
+var _ = fs.HandleReadDirAller(&AllDir{})
+
+// Lists every file, or the batches holding them if there are too many.
+func (a *AllDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	return a.dir.appendFiles(requestContext(ctx), nil)
+}
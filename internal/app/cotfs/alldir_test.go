@@ -0,0 +1,70 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies /.all lists every file regardless of its tags, in batches when there are too many.
+func TestAllDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	fileCount := 5
+	for i := 0; i < fileCount; i++ {
+		db.CreateFileInPath(metaDb, fmt.Sprintf("file%d", i), "path", []metadata.TagInfo{tags[i%2][0]})
+	}
+	conditions := []struct {
+		batchSize       int
+		expectedEntries int
+		expectedBatch   string
+	}{
+		{0, 2 * fileCount, ""},
+		{10, 2 * fileCount, ""},
+		{2, 3, "0003-0004"},
+	}
+	for _, condition := range conditions {
+		root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+			control: newControlState(), options: Options{BatchSize: condition.batchSize}}
+		node, err := root.Lookup(nil, &fuse.LookupRequest{Name: allDirName}, nil)
+		allDir, ok := node.(*AllDir)
+		if err != nil || !ok {
+			t.Errorf("Expected to find the all directory: %v", err)
+			return
+		}
+		entries, err := allDir.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read the all directory: %v", err)
+		}
+		if len(entries) != condition.expectedEntries {
+			t.Errorf("Expected %d entries with batch size %d but found %d", condition.expectedEntries,
+				condition.batchSize, len(entries))
+		}
+		if len(condition.expectedBatch) > 0 {
+			batch, err := allDir.Lookup(nil, &fuse.LookupRequest{Name: condition.expectedBatch}, nil)
+			if _, ok := batch.(*BatchDir); err != nil || !ok {
+				t.Errorf("Expected %s to resolve to a batch: %v", condition.expectedBatch, err)
+			}
+		}
+		if file, err := allDir.Lookup(nil, &fuse.LookupRequest{Name: "file3"}, nil); err != nil {
+			t.Errorf("Expected to find file3: %v", err)
+		} else if _, ok := file.(*File); !ok {
+			t.Error("Expected file3 to be a file")
+		}
+	}
+}
+
+// Verifies errors querying the files are returned by lookups rather than reported as missing files.
+func TestAllDir_LookupError(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	allDir := newAllDir(root)
+	metaDb.Close()
+	if _, err := allDir.Lookup(nil, &fuse.LookupRequest{Name: "file"}, nil); err == nil || err == fuse.ENOENT {
+		t.Errorf("Expected looking up a file in a closed database to fail but got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package cotfs
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"log"
+	"sync"
+	"time"
+)
+
+// How often access times collected by an accessRecorder are written to the database.
+const accessFlushInterval = 30 * time.Second
+
+// Collects the times files are opened through the mount and writes them to the database in batches so opening a file
+// doesn't wait on a database write.
+type accessRecorder struct {
+	store   db.AccessTimeStore
+	mu      sync.Mutex
+	pending map[int64]time.Time
+}
+
+func newAccessRecorder(store db.AccessTimeStore) *accessRecorder {
+	return &accessRecorder{store: store, pending: make(map[int64]time.Time)}
+}
+
+// Notes that a file was accessed now.
+func (r *accessRecorder) record(fileId int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[fileId] = time.Now()
+}
+
+// Gets the time a file was last accessed, including accesses not written to the database yet. Reports false if the
+// file was never accessed.
+func (r *accessRecorder) accessTime(fileId int64) (time.Time, bool, error) {
+	r.mu.Lock()
+	atime, ok := r.pending[fileId]
+	r.mu.Unlock()
+	if ok {
+		return atime, true, nil
+	}
+	return r.store.GetFileAccessTime(context.Background(), fileId)
+}
+
+// Writes the access times collected so far to the database. If that fails they are kept for the next flush.
+func (r *accessRecorder) flush() error {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[int64]time.Time)
+	r.mu.Unlock()
+	err := r.store.SetFileAccessTimes(context.Background(), pending)
+	if err != nil {
+		r.mu.Lock()
+		for fileId, atime := range pending {
+			if _, ok := r.pending[fileId]; !ok {
+				r.pending[fileId] = atime
+			}
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// Flushes the access times every interval until stop is closed, then flushes them one last time.
+func (r *accessRecorder) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			if err := r.flush(); err != nil {
+				log.Printf("Could not record access times: %s", err)
+			}
+			return
+		case <-ticker.C:
+			if err := r.flush(); err != nil {
+				log.Printf("Could not record access times: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"testing"
+	"time"
+)
+
+// Verifies the times files are opened are reported as their access times and written to the database in batches.
+func TestFile_AccessTimes(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	opened, _ := db.CreateFileInPath(metaDb, "opened", "path1", tags[0])
+	unopened, _ := db.CreateFileInPath(metaDb, "unopened", "path1", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		access: newAccessRecorder(db.NewSQLiteStore(metaDb))}
+	before := time.Now().Add(-time.Second)
+	if _, err := root.fileNode(opened).Open(nil, nil, nil); err != nil {
+		t.Fatalf("Could not open file: %v", err)
+	}
+	if _, ok, _ := db.GetFileAccessTime(metaDb, opened.Id); ok {
+		t.Error("Expected the access time not to be written when the file is opened")
+	}
+	conditions := []struct {
+		file          *File
+		expectedAtime bool
+	}{
+		{root.fileNode(opened), true},
+		{root.fileNode(unopened), false},
+	}
+	for _, condition := range conditions {
+		attr := fuse.Attr{}
+		if err := condition.file.Attr(nil, &attr); err != nil {
+			t.Errorf("Could not get attributes of %s: %v", condition.file.fileInfo.Name, err)
+		}
+		if attr.Atime.After(before) != condition.expectedAtime {
+			t.Errorf("Unexpected access time of %s: %v", condition.file.fileInfo.Name, attr.Atime)
+		}
+	}
+	// stopping the recorder writes the pending access times
+	stop := make(chan struct{})
+	close(stop)
+	root.access.run(time.Hour, stop)
+	if atime, ok, _ := db.GetFileAccessTime(metaDb, opened.Id); !ok || atime.Before(before) {
+		t.Errorf("Expected the access time to be written but got %v %v", atime, ok)
+	}
+	if files, _ := db.GetFilesNotAccessedSince(metaDb, before, ""); len(files) != 1 || files[0].Id != unopened.Id {
+		t.Errorf("Expected only the unopened file to be reported as not accessed but got %v", files)
+	}
+}
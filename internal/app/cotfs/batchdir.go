@@ -0,0 +1,162 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Minimum number of digits used in batch names so they sort correctly (i.e. 0001-1000)
+const minBatchDigits = 4
+
+// BatchDir is a pseudo-directory holding one slice of the files of a tag directory that has too many files to list
+// at once. Files are ordered by name and batches are named by the (1-based) range of positions they hold.
+type BatchDir struct {
+	dir   *Dir
+	first int
+	last  int
+}
+
+var _ fs.Node = (*BatchDir)(nil)
+
+func (b *BatchDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, b.dir.options)
+	return nil
+}
+
+// Reports whether a directory with fileCount files should be split into batches.
+func (d *Dir) isBatched(fileCount int) bool {
+	batchSize := d.settings().BatchSize
+	return batchSize > 0 && fileCount > batchSize
+}
+
+// Resolves a batch name to its pseudo-directory. Returns nil if the name is not one of this directory's batches.
+func (d *Dir) lookupBatch(ctx context.Context, name string) *BatchDir {
+	batchSize := d.settings().BatchSize
+	if batchSize <= 0 || !d.listsFiles() {
+		return nil
+	}
+	bounds := strings.Split(name, "-")
+	if len(bounds) != 2 {
+		return nil
+	}
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil
+	}
+	count, err := d.countFiles(ctx)
+	if err != nil || !d.isBatched(count) {
+		return nil
+	}
+	for _, batch := range batchNames(count, batchSize) {
+		if batch == name {
+			last, _ := strconv.Atoi(bounds[1])
+			return &BatchDir{dir: d, first: first, last: last}
+		}
+	}
+	return nil
+}
+
+// Counts the files in this directory. The database counts them when it can tell which files are listed, so deciding
+// whether to batch a directory doesn't load its files.
+func (d *Dir) countFiles(ctx context.Context) (int, error) {
+	ctx = requestContext(ctx)
+	if d.hasTags() {
+		return d.store.CountFilesMatchingFilter(ctx, d.tagFilter())
+	}
+	if d.options.RootFiles == RootFilesAll {
+		return d.store.CountFilesMatchingFilter(ctx, db.TagFilter{Excluded: d.hidden})
+	}
+	files, err := d.getFiles(ctx, "")
+	return len(files), err
+}
+
+// Builds the names of the batches needed to hold fileCount files.
+func batchNames(fileCount int, batchSize int) []string {
+	digits := len(strconv.Itoa(fileCount))
+	if digits < minBatchDigits {
+		digits = minBatchDigits
+	}
+	var names []string
+	for first := 1; first <= fileCount; first += batchSize {
+		last := first + batchSize - 1
+		if last > fileCount {
+			last = fileCount
+		}
+		names = append(names, fmt.Sprintf("%0*d-%0*d", digits, first, digits, last))
+	}
+	return names
+}
+
+// Lists the files of a directory in the order batches hold them. Tag directories have the database order them.
+func (d *Dir) getSortedFiles(ctx context.Context) ([]metadata.FileInfo, error) {
+	if d.hasTags() {
+		return d.store.GetFilesMatchingFilterOrdered(requestContext(ctx), d.tagFilter(), "", db.ByName)
+	}
+	files, err := d.getFiles(ctx, "")
+	sortFiles(files)
+	return files, err
+}
+
+// Orders files by name (and id, for files sharing a name) so batches are stable between listings.
+func sortFiles(files []metadata.FileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Name == files[j].Name {
+			return files[i].Id < files[j].Id
+		}
+		return files[i].Name < files[j].Name
+	})
+}
+
+var _ = fs.NodeRequestLookuper(&BatchDir{})
+
+// Looks up a file (or its tag sidecar) in the batch.
+func (b *BatchDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	node, err := b.dir.lookupFile(requestContext(ctx), req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if node != nil {
+		return node, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ = fs.HandleReadDirAller(&BatchDir{})
+
+// Lists the files in the batch.
+func (b *BatchDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	files, err := b.dir.getSortedFiles(ctx)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	if b.first > len(files) {
+		return nil, nil
+	}
+	last := b.last
+	if last > len(files) {
+		last = len(files)
+	}
+	// names are disambiguated across the whole directory so they resolve the same way from every batch; each file has
+	// two entries, itself and its tag sidecar
+	entries := appendFileEntries(nil, files, b.dir.options)
+	return entries[2*(b.first-1) : 2*last], nil
+}
+
+var _ = fs.NodeRemover(&BatchDir{})
+
+// Removes the tag of the directory holding the batch from a file.
+func (b *BatchDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if req.Dir {
+		return fuse.EPERM
+	}
+	return toErrno(b.dir.handleFileRm(ctx, req))
+}
@@ -0,0 +1,123 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"strings"
+	"testing"
+)
+
+// Verifies batch names cover every file.
+func TestBatchNames(t *testing.T) {
+	conditions := []struct {
+		fileCount int
+		batchSize int
+		expected  []string
+	}{
+		{0, 10, nil},
+		{10, 10, []string{"0001-0010"}},
+		{25, 10, []string{"0001-0010", "0011-0020", "0021-0025"}},
+		{12345, 10000, []string{"00001-10000", "10001-12345"}},
+	}
+	for _, condition := range conditions {
+		names := batchNames(condition.fileCount, condition.batchSize)
+		if strings.Join(names, ",") != strings.Join(condition.expected, ",") {
+			t.Errorf("Expected batches %v for %d files but got %v", condition.expected, condition.fileCount, names)
+		}
+	}
+}
+
+// Verifies directories over the batch size list their files in pseudo-directories.
+func TestBatchDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	fileCount := 5
+	for i := fileCount - 1; i >= 0; i-- {
+		db.CreateFileInPath(metaDb, fmt.Sprintf("file%d", i), "path", []metadata.TagInfo{tags[0][0]})
+	}
+	dir := &Dir{
+		store:         db.NewSQLiteStore(metaDb),
+		mountPoint:    testMount,
+		path:          tags[0],
+		storageSystem: storageSys,
+		options:       Options{BatchSize: 2},
+	}
+	entries, err := dir.ReadDirAll(nil)
+	if err != nil {
+		t.Errorf("Could not read directory: %v", err)
+	}
+	expectedBatches := []string{"0001-0002", "0003-0004", "0005-0005"}
+	if len(entries) != len(expectedBatches) {
+		t.Errorf("Expected %d batches but found %d entries", len(expectedBatches), len(entries))
+	}
+	for i, batch := range expectedBatches {
+		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: batch}, nil)
+		batchDir, ok := node.(*BatchDir)
+		if err != nil || !ok {
+			t.Errorf("Expected %s to resolve to a batch: %v", batch, err)
+			continue
+		}
+		batchEntries, _ := batchDir.ReadDirAll(nil)
+		var names []string
+		for _, entry := range batchEntries {
+			if !strings.HasSuffix(entry.Name, tagsSuffix) {
+				names = append(names, entry.Name)
+			}
+		}
+		expected := []string{fmt.Sprintf("file%d", i*2)}
+		if i*2+1 < fileCount {
+			expected = append(expected, fmt.Sprintf("file%d", i*2+1))
+		}
+		if strings.Join(names, ",") != strings.Join(expected, ",") {
+			t.Errorf("Expected batch %s to hold %v but found %v", batch, expected, names)
+		}
+		if _, err = batchDir.Lookup(nil, &fuse.LookupRequest{Name: expected[0]}, nil); err != nil {
+			t.Errorf("Could not look up %s in batch %s", expected[0], batch)
+		}
+	}
+	badNames := []string{"0001-0003", "0007-0008", "1-2", "junk"}
+	for _, name := range badNames {
+		if _, err = dir.Lookup(nil, &fuse.LookupRequest{Name: name}, nil); err != fuse.ENOENT {
+			t.Errorf("Expected lookup of %s to give NOENT error", name)
+		}
+	}
+
+	// under the threshold files are listed directly
+	dir.options.BatchSize = fileCount
+	entries, _ = dir.ReadDirAll(nil)
+	if len(entries) != fileCount*2 {
+		t.Errorf("Expected %d files and sidecars but found %d entries", fileCount*2, len(entries))
+	}
+}
+
+// Verifies directories count the same files they list.
+func TestDir_CountFiles(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.CreateFileInPath(metaDb, "countOne", "path1", []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "countTwo", "path2", flatten(tags))
+	conditions := []struct {
+		path []metadata.TagInfo
+		mode RootFileMode
+	}{
+		{nil, RootFilesNone},
+		{nil, RootFilesAll},
+		{nil, RootFilesSingleTag},
+		{tags[0], RootFilesNone},
+		{flatten(tags), RootFilesNone},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: condition.path, storageSystem: storageSys,
+			options: Options{RootFiles: condition.mode}}
+		files, _ := dir.getFiles(nil, "")
+		count, err := dir.countFiles(nil)
+		if err != nil || count != len(files) {
+			t.Errorf("Expected %d files in %v (mode %d) but counted %d: %v", len(files), condition.path,
+				condition.mode, count, err)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package cotfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/app/indexer"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Settings are the options of a mount that can be changed while it is mounted, read from the JSON file set by
+// Options.ConfigFile (i.e. {"batchSize": 500, "hideEmptyTags": true}). Settings left out of the file keep the value
+// given by their flag.
+type Settings struct {
+	BatchSize     *int  `json:"batchSize"`
+	MaxDepth      *int  `json:"maxDepth"`
+	HideEmptyTags *bool `json:"hideEmptyTags"`
+	HideDotTags   *bool `json:"hideDotTags"`
+}
+
+// Reads the settings from a configuration file. Returns an error if the file can't be read, isn't valid JSON or a
+// setting is out of range.
+func LoadSettings(path string) (Settings, error) {
+	var settings Settings
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return settings, err
+	}
+	if err = json.Unmarshal(content, &settings); err != nil {
+		return settings, fmt.Errorf("invalid configuration file %s: %v", path, err)
+	}
+	if settings.BatchSize != nil && *settings.BatchSize < 0 {
+		return settings, fmt.Errorf("invalid configuration file %s: batchSize can't be negative", path)
+	}
+	if settings.MaxDepth != nil && *settings.MaxDepth < 0 {
+		return settings, fmt.Errorf("invalid configuration file %s: maxDepth can't be negative", path)
+	}
+	return settings, nil
+}
+
+// Replaces the options set in the settings.
+func (s Settings) apply(options Options) Options {
+	if s.BatchSize != nil {
+		options.BatchSize = *s.BatchSize
+	}
+	if s.MaxDepth != nil {
+		options.MaxDepth = *s.MaxDepth
+	}
+	if s.HideEmptyTags != nil {
+		options.HideEmptyTags = *s.HideEmptyTags
+	}
+	if s.HideDotTags != nil {
+		options.HideDotTags = *s.HideDotTags
+	}
+	return options
+}
+
+// Loads the tag map of an indexer run from its JSON file, see indexer.LoadTagMap. An empty path keeps the default
+// map.
+func LoadIndexerOptions(tagMapFile string) (indexer.Options, error) {
+	var options indexer.Options
+	if tagMapFile != "" {
+		tagMap, err := indexer.LoadTagMap(tagMapFile)
+		if err != nil {
+			return options, fmt.Errorf("could not load the tag map: %v", err)
+		}
+		options.TagMap = tagMap
+	}
+	return options, nil
+}
+
+// The configuration file of a mount, shared by all its directories, which read the settings last loaded from it on
+// every lookup and listing, along with the tag map of the files indexed by the reindex command. Reloading them
+// doesn't disturb open files.
+type configFile struct {
+	path       string
+	tagMapFile string
+	mu         sync.Mutex
+	settings   Settings
+	indexing   indexer.Options
+}
+
+// Reads the files again, replacing the settings and the tag map. Both are left as they were if either file can't be
+// loaded. Files the mount wasn't given are skipped.
+func (c *configFile) reload() error {
+	if c == nil {
+		return nil
+	}
+	var settings Settings
+	var err error
+	if c.path != "" {
+		if settings, err = LoadSettings(c.path); err != nil {
+			return err
+		}
+	}
+	indexing, err := LoadIndexerOptions(c.tagMapFile)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.settings, c.indexing = settings, indexing
+	return nil
+}
+
+// Returns the options passed in with the settings last loaded. Options are returned as they are by a nil file, i.e.
+// for directories built outside of a mount.
+func (c *configFile) apply(options Options) Options {
+	if c == nil {
+		return options
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.settings.apply(options)
+}
+
+// Returns the options of indexer runs, with the tag map last loaded.
+func (c *configFile) indexerOptions() indexer.Options {
+	if c == nil {
+		return indexer.Options{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.indexing
+}
+
+// Reloads the configuration file and the tag map of the filesystem, see Options.ConfigFile and Options.TagMapFile.
+// The previous settings are kept if either can't be loaded.
+func (f *FS) Reload() error {
+	return f.config.reload()
+}
+
+// Reloads the configuration file whenever the process receives SIGHUP, until the function returned is called.
+func (f *FS) reloadOnHangup() func() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range hangups {
+			if err := f.Reload(); err != nil {
+				log.Printf("Could not reload the configuration: %s", err)
+			} else {
+				log.Print("Reloaded the configuration")
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hangups)
+		close(hangups)
+		<-done
+	}
+}
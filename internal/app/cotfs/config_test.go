@@ -0,0 +1,174 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Verifies settings are read from the configuration file, and invalid files are rejected.
+func TestLoadSettings(t *testing.T) {
+	batchSize, hide := 500, true
+	conditions := []struct {
+		content   string
+		expectErr bool
+		expected  Settings
+	}{
+		{`{}`, false, Settings{}},
+		{`{"batchSize": 500, "hideDotTags": true}`, false, Settings{BatchSize: &batchSize, HideDotTags: &hide}},
+		{`{"batchSize": -1}`, true, Settings{}},
+		{`{"maxDepth": -2}`, true, Settings{}},
+		{`{"batchSize": "many"}`, true, Settings{}},
+		{`not json`, true, Settings{}},
+	}
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	for _, condition := range conditions {
+		ioutil.WriteFile(path, []byte(condition.content), 0644)
+		settings, err := LoadSettings(path)
+		if (err != nil) != condition.expectErr {
+			t.Errorf("Expected an error loading %s: %v but got %v", condition.content, condition.expectErr, err)
+		} else if err == nil && !reflect.DeepEqual(settings, condition.expected) {
+			t.Errorf("Expected %s to load as %+v but got %+v", condition.content, condition.expected, settings)
+		}
+	}
+	if _, err = LoadSettings(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Expected loading a missing file to fail")
+	}
+}
+
+// Verifies the configuration file is reloaded, keeping the previous settings when it is invalid and the flags for
+// settings left out of it.
+func TestFS_Reload(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	filesys := New(Config{Store: db.NewSQLiteStore(metaDb), MountPoint: testMount, Storage: storageSys,
+		Options: Options{BatchSize: 1000, MaxDepth: 2, ConfigFile: path}})
+	conditions := []struct {
+		content       string
+		expectErr     bool
+		expectedBatch int
+		expectedDepth int
+	}{
+		{`{"batchSize": 10}`, false, 10, 2},
+		{`{"batchSize": -10}`, true, 10, 2},
+		{`not json`, true, 10, 2},
+		{`{"maxDepth": 4}`, false, 1000, 4},
+	}
+	for _, condition := range conditions {
+		ioutil.WriteFile(path, []byte(condition.content), 0644)
+		err = filesys.Reload()
+		if (err != nil) != condition.expectErr {
+			t.Errorf("Expected an error reloading %s: %v but got %v", condition.content, condition.expectErr, err)
+		}
+		settings := filesys.root.childDir(nil, nil, nil).settings()
+		if settings.BatchSize != condition.expectedBatch || settings.MaxDepth != condition.expectedDepth {
+			t.Errorf("Expected a batch size of %d and a maximum depth of %d after reloading %s but got %d and %d",
+				condition.expectedBatch, condition.expectedDepth, condition.content, settings.BatchSize,
+				settings.MaxDepth)
+		}
+	}
+}
+
+// Verifies the reload command changes what directories list.
+func TestControlDir_Reload(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	photos, _ := db.AddTag(metaDb, "photos", nil)
+	raw, _ := db.AddTag(metaDb, ".raw", []metadata.TagInfo{photos})
+	db.CreateFileInPath(metaDb, "img.cr2", "path1", []metadata.TagInfo{photos, raw})
+	path := filepath.Join(dir, "config.json")
+	filesys := New(Config{Store: db.NewSQLiteStore(metaDb), MountPoint: testMount, Storage: storageSys,
+		Options: Options{ConfigFile: path}})
+	controlDir := &ControlDir{root: filesys.root}
+	conditions := []struct {
+		content      string
+		expectErr    bool
+		expectedDirs []string
+	}{
+		{`{"hideDotTags": true}`, false, nil},
+		{`{"hideDotTags": "yes"}`, true, nil},
+		{`{"hideDotTags": false}`, false, []string{".raw"}},
+	}
+	for _, condition := range conditions {
+		ioutil.WriteFile(path, []byte(condition.content), 0644)
+		if err = controlDir.execute(context.Background(), 0, "reload"); (err != nil) != condition.expectErr {
+			t.Errorf("Expected an error reloading %s: %v but got %v", condition.content, condition.expectErr, err)
+		}
+		entries, _ := filesys.root.childDir([]metadata.TagInfo{photos}, nil, nil).ReadDirAll(nil)
+		var dirs []string
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				dirs = append(dirs, entry.Name)
+			}
+		}
+		if !reflect.DeepEqual(dirs, condition.expectedDirs) {
+			t.Errorf("Expected %v to be listed after reloading %s but got %v", condition.expectedDirs,
+				condition.content, dirs)
+		}
+	}
+}
+
+// Verifies the reload command reloads the tag map the reindex command tags files with, keeping the previous one when
+// the file is invalid.
+func TestControlDir_ReloadTagMap(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tagMapPath := filepath.Join(dir, "tagmap.json")
+	indexDir := filepath.Join(dir, "index")
+	os.Mkdir(indexDir, 0755)
+	ioutil.WriteFile(filepath.Join(indexDir, "notes.xyz"), []byte(testContent), 0644)
+	filesys := New(Config{Store: db.NewSQLiteStore(metaDb), MountPoint: testMount, Storage: storageSys,
+		Options: Options{TagMapFile: tagMapPath}})
+	controlDir := &ControlDir{root: filesys.root}
+	conditions := []struct {
+		content   string
+		expectErr bool
+	}{
+		{`{".xyz": ["notes"]}`, false},
+		{`{"xyz": ["broken"]}`, true},
+	}
+	for _, condition := range conditions {
+		ioutil.WriteFile(tagMapPath, []byte(condition.content), 0644)
+		if err = controlDir.execute(context.Background(), 0, "reload"); (err != nil) != condition.expectErr {
+			t.Errorf("Expected an error reloading %s: %v but got %v", condition.content, condition.expectErr, err)
+		}
+	}
+	if err = controlDir.execute(context.Background(), 0, "reindex "+indexDir); err != nil {
+		t.Fatalf("Could not reindex: %v", err)
+	}
+	tag, _ := db.FindTag(metaDb, "notes")
+	files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tag}, "")
+	if tag.Id == metadata.UnknownTag.Id || len(files) != 1 || files[0].Name != "notes.xyz" {
+		t.Errorf("Expected the file to be tagged by the tag map last loaded but got %v", files)
+	}
+	if broken, _ := db.FindTag(metaDb, "broken"); broken.Id != metadata.UnknownTag.Id {
+		t.Error("Expected the invalid tag map not to be used")
+	}
+}
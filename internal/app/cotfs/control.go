@@ -0,0 +1,563 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/app/indexer"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Name of the directory in the root of the mount holding the control and status files.
+const controlDirName = ".cotfs"
+
+const (
+	controlFileName = "control"
+	statusFileName  = "status"
+)
+
+// Tracks the activity of the mount reported by the status file.
+type controlState struct {
+	mu          sync.Mutex
+	started     time.Time
+	commands    int
+	lastCommand string
+	lastError   error
+	// the user the mount belongs to, who (along with root) may grant and revoke tags
+	owner uint32
+}
+
+func newControlState() *controlState {
+	return &controlState{started: time.Now(), owner: uint32(os.Getuid())}
+}
+
+// Records the outcome of a command written to the control file.
+func (s *controlState) record(command string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+	s.lastCommand = command
+	s.lastError = err
+}
+
+// ControlDir is the /.cotfs directory. Commands written to its control file (one per line) perform administrative
+// operations on the mount and its status file reports statistics about the mount.
+type ControlDir struct {
+	root *Dir
+}
+
+var _ fs.Node = (*ControlDir)(nil)
+
+func (c *ControlDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, c.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&ControlDir{})
+
+func (c *ControlDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	switch req.Name {
+	case controlFileName:
+		return &ControlFile{dir: c}, nil
+	case statusFileName:
+		return &StatusFile{dir: c}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+var _ = fs.HandleReadDirAller(&ControlDir{})
+
+func (c *ControlDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{
+		{Name: controlFileName, Type: fuse.DT_File},
+		{Name: statusFileName, Type: fuse.DT_File},
+	}, nil
+}
+
+// Runs a single command. Supported commands are:
+//  retag <old> <new>   renames a tag (merging it into <new> if that tag exists)
+//  move <from> <pattern> <to>
+//                      moves the files in the tag path from matching the pattern to the tag path to (i.e. a/2019)
+//  gc                  removes tags without files, associations between tags no file has together and dangling
+//                      records
+//  reassociate         recomputes the associations between tags from the tags of files
+//  check [repair]      checks the integrity of the metadata, fixing dangling records and duplicate files if asked to
+//  orphans [delete]    tags the files left without tags uncategorized, or deletes their records
+//  reindex <path>...   indexes the files under the paths passed in
+//  reload              reloads the configuration file and the tag map, keeping the previous ones if either is invalid
+//  alias <tag> <alias> adds an alternate name for a tag
+//  unalias <alias>     removes an alternate name of a tag
+//  query <name> <pattern> [<expression>]
+//                      saves a query listed under /.queries (use * as the pattern to match any file name)
+//  unquery <name>      deletes a saved query
+//  grant <tag> <uid>   lets a user see a tag, hiding it from users not granted it (root or the owner of the mount only)
+//  revoke <tag> <uid>  withdraws a grant (root or the owner of the mount only)
+//  restore <id>...     puts back the tags removed from files in the trash
+//  purge-trash [<age>] empties the trash of files removed longer ago than age (i.e. 24h), or all of them
+//  flush-cache         drops any cached metadata, i.e. the tags looked up
+//
+// The user id passed in is the one of the user running the command.
+func (c *ControlDir) execute(ctx context.Context, uid uint32, command string) (err error) {
+	defer func() { err = toErrno(err) }()
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil
+	}
+	switch fields[0] {
+	case "retag":
+		err = c.retag(ctx, fields[1:])
+	case "move":
+		err = c.move(ctx, fields[1:])
+	case "gc":
+		err = c.collectGarbage(ctx)
+	case "reassociate":
+		err = c.reassociate(ctx)
+	case "check":
+		err = c.check(ctx, fields[1:])
+	case "orphans":
+		err = c.collectOrphans(ctx, fields[1:])
+	case "reindex":
+		err = c.reindex(ctx, fields[1:])
+	case "reload":
+		err = c.root.config.reload()
+	case "alias":
+		err = c.alias(ctx, fields[1:])
+	case "unalias":
+		if len(fields) != 2 {
+			err = fuse.Errno(syscall.EINVAL)
+		} else {
+			err = c.unalias(ctx, fields[1])
+		}
+	case "query":
+		err = c.saveQuery(ctx, fields[1:])
+	case "unquery":
+		if len(fields) != 2 {
+			err = fuse.Errno(syscall.EINVAL)
+		} else {
+			err = c.deleteQuery(ctx, fields[1])
+		}
+	case "grant":
+		err = c.grant(ctx, uid, fields[1:], db.ACLStore.GrantTag)
+	case "revoke":
+		err = c.grant(ctx, uid, fields[1:], db.ACLStore.RevokeTag)
+	case "restore":
+		err = c.restore(ctx, fields[1:])
+	case "purge-trash":
+		err = c.purgeTrash(ctx, fields[1:])
+	case "flush-cache":
+		if watched, ok := c.root.store.(db.WatchedStore); ok {
+			watched.FlushCache()
+		}
+	default:
+		err = fuse.Errno(syscall.EINVAL)
+	}
+	c.root.control.record(command, err)
+	return err
+}
+
+func (c *ControlDir) retag(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	tag, err := c.root.store.FindTag(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if tag.Id == metadata.UnknownTag.Id {
+		return fuse.ENOENT
+	}
+	return renameTag(ctx, c.root.store, tag, args[1])
+}
+
+func (c *ControlDir) move(ctx context.Context, args []string) error {
+	if len(args) != 3 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	from, err := c.tagDir(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	to, err := c.tagDir(ctx, args[2])
+	if err != nil {
+		return err
+	}
+	return from.moveFiles(ctx, args[1], to)
+}
+
+// Builds the directory node for a path of tags relative to the root of the mount.
+func (c *ControlDir) tagDir(ctx context.Context, path string) (*Dir, error) {
+	path = strings.Trim(path, string(os.PathSeparator))
+	if path == "" {
+		return c.root, nil
+	}
+	tags, excluded, err := convertPathToTags(ctx, c.root.store, path)
+	if err != nil {
+		return nil, err
+	}
+	return c.root.childDir(tags, nil, excluded), nil
+}
+
+func (c *ControlDir) alias(ctx context.Context, args []string) error {
+	if len(args) != 2 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	aliases, ok := c.root.store.(db.AliasStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	tag, err := c.root.store.FindTag(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if tag.Id == metadata.UnknownTag.Id {
+		return fuse.ENOENT
+	}
+	if err = aliases.AddAlias(ctx, tag, args[1]); err == db.ErrTagExists {
+		return fuse.EEXIST
+	}
+	return err
+}
+
+func (c *ControlDir) unalias(ctx context.Context, alias string) error {
+	aliases, ok := c.root.store.(db.AliasStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return aliases.RemoveAlias(ctx, alias)
+}
+
+// Applies a grant operation to the tag and user id passed in, on behalf of the user (caller) running the command.
+// Only root and the owner of the mount are allowed to.
+func (c *ControlDir) grant(ctx context.Context, caller uint32, args []string,
+	apply func(db.ACLStore, context.Context, metadata.TagInfo, uint32) error) error {
+	if caller != 0 && caller != c.root.control.owner {
+		return fuse.EPERM
+	}
+	acl, ok := c.root.store.(db.ACLStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	if len(args) != 2 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	uid, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	tag, err := c.root.store.FindTag(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if tag.Id == metadata.UnknownTag.Id {
+		return fuse.ENOENT
+	}
+	return apply(acl, ctx, tag, uint32(uid))
+}
+
+func (c *ControlDir) restore(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	trash, ok := c.root.store.(db.TrashStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	for _, id := range ids {
+		fileId, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		if err = trash.RestoreFile(ctx, fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ControlDir) purgeTrash(ctx context.Context, args []string) error {
+	var age time.Duration
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		if age, err = time.ParseDuration(args[0]); err != nil {
+			return fuse.Errno(syscall.EINVAL)
+		}
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	trash, ok := c.root.store.(db.TrashStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	_, err := trash.PurgeTrash(ctx, time.Now().Add(-age))
+	return err
+}
+
+func (c *ControlDir) collectGarbage(ctx context.Context) error {
+	maintenance, ok := c.root.store.(db.MaintenanceStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	report, err := maintenance.CollectGarbage(ctx)
+	if err == nil {
+		log.Printf("Garbage collection removed %d tags, %d tag associations and %d dangling records", report.Tags,
+			report.Associations, report.Dangling)
+	}
+	return err
+}
+
+func (c *ControlDir) reassociate(ctx context.Context) error {
+	maintenance, ok := c.root.store.(db.MaintenanceStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	report, err := maintenance.RebuildTagAssociations(ctx)
+	if err == nil {
+		log.Printf("Rebuilding tag associations added %d and removed %d", report.Added, report.Removed)
+	}
+	return err
+}
+
+func (c *ControlDir) check(ctx context.Context, args []string) error {
+	// files missing from the storage are only reported, the disk holding them may just not be mounted
+	options := db.CheckOptions{Storage: c.root.storageSystem}
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "repair":
+		options.Repair = true
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	maintenance, ok := c.root.store.(db.MaintenanceStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	report, err := maintenance.Check(ctx, options)
+	if err != nil {
+		return err
+	}
+	log.Printf("Check found %d dangling file tags, %d dangling tag associations, %d duplicate files and %d missing "+
+		"files (repaired: %t)", report.DanglingFileTags, report.DanglingAssociations, report.DuplicateFiles,
+		len(report.MissingFiles), report.Repaired)
+	for _, problem := range report.Corruption {
+		log.Printf("Check found a problem with the database file: %s", problem)
+	}
+	for _, file := range report.MissingFiles {
+		log.Printf("Check found %s missing from the storage", filepath.Join(file.Path, file.Name))
+	}
+	return nil
+}
+
+func (c *ControlDir) collectOrphans(ctx context.Context, args []string) error {
+	policy := db.TagOrphans
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "delete":
+		policy = db.DeleteOrphans
+	default:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	maintenance, ok := c.root.store.(db.MaintenanceStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	_, err := maintenance.CollectOrphanFiles(ctx, policy, uncategorizedTag)
+	return err
+}
+
+func (c *ControlDir) saveQuery(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	saved := metadata.SavedQuery{Name: args[0], Expr: strings.Join(args[2:], " ")}
+	if args[1] != "*" {
+		saved.Pattern = args[1]
+	}
+	// refuse to save a query that can't be listed
+	if _, err := parseSavedQuery(saved); err != nil {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	queries, ok := c.root.store.(db.QueryStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return queries.SaveQuery(ctx, saved)
+}
+
+func (c *ControlDir) deleteQuery(ctx context.Context, name string) error {
+	queries, ok := c.root.store.(db.QueryStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return queries.DeleteSavedQuery(ctx, name)
+}
+
+func (c *ControlDir) reindex(ctx context.Context, paths []string) error {
+	if len(paths) == 0 {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	for _, path := range paths {
+		err := indexer.IndexPathIntoStoreWithOptions(ctx, c.root.store, path,
+			c.root.config.indexerOptions())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ControlFile accepts commands; see ControlDir.execute.
+type ControlFile struct {
+	dir *ControlDir
+}
+
+var _ fs.Node = (*ControlFile)(nil)
+
+func (f *ControlFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0200
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&ControlFile{})
+
+// Accepts the truncation sent by the kernel when the file is opened with O_TRUNC (i.e. echo gc > control).
+func (f *ControlFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return f.Attr(ctx, &resp.Attr)
+}
+
+var _ = fs.NodeOpener(&ControlFile{})
+
+func (f *ControlFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	if !req.Flags.IsWriteOnly() {
+		return nil, fuse.EPERM
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &ControlFileHandle{dir: f.dir}, nil
+}
+
+type ControlFileHandle struct {
+	dir *ControlDir
+	buf bytes.Buffer
+}
+
+var _ = fs.HandleWriter(&ControlFileHandle{})
+
+// Buffers the written commands; they are run on flush.
+func (h *ControlFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	h.buf.Write(req.Data)
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ = fs.HandleFlusher(&ControlFileHandle{})
+
+// Runs each buffered command in turn, stopping at the first one that fails.
+func (h *ControlFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	ctx = requestContext(ctx)
+	commands := strings.Split(h.buf.String(), "\n")
+	h.buf.Reset()
+	for _, command := range commands {
+		if err := h.dir.execute(ctx, req.Uid, command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StatusFile reports statistics about the mount.
+type StatusFile struct {
+	dir *ControlDir
+}
+
+var _ fs.Node = (*StatusFile)(nil)
+
+func (f *StatusFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	ctx = requestContext(ctx)
+	content, err := f.content(ctx)
+	if err != nil {
+		return err
+	}
+	a.Mode = 0444
+	a.Size = uint64(len(content))
+	return nil
+}
+
+// Builds the report of the mount statistics.
+func (f *StatusFile) content(ctx context.Context) ([]byte, error) {
+	root := f.dir.root
+	fileCount, _, err := root.store.GetFileTotals(ctx)
+	if err != nil {
+		return nil, err
+	}
+	tagCount, err := root.store.CountTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	state := root.control
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	lastError := "none"
+	if state.lastError != nil {
+		lastError = state.lastError.Error()
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "mount point: %s\n", root.mountPoint)
+	fmt.Fprintf(&buf, "uptime: %s\n", time.Since(state.started).Round(time.Second))
+	fmt.Fprintf(&buf, "files: %d\n", fileCount)
+	fmt.Fprintf(&buf, "tags: %d\n", tagCount)
+	fmt.Fprintf(&buf, "commands: %d\n", state.commands)
+	fmt.Fprintf(&buf, "last command: %s\n", state.lastCommand)
+	fmt.Fprintf(&buf, "last error: %s\n", lastError)
+	// timings of the queries run by this process, to tell which ones make listings slow
+	timings := db.Metrics()
+	operations := make([]string, 0, len(timings))
+	for operation := range timings {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	for _, operation := range operations {
+		stats := timings[operation]
+		fmt.Fprintf(&buf, "%s: %d calls, mean %s, max %s\n", operation, stats.Calls, stats.Mean(), stats.Max)
+	}
+	return buf.Bytes(), nil
+}
+
+var _ = fs.NodeOpener(&StatusFile{})
+
+// Opens a snapshot of the statistics.
+func (f *StatusFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	ctx = requestContext(ctx)
+	if !req.Flags.IsReadOnly() {
+		return nil, fuse.EPERM
+	}
+	content, err := f.content(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp.Flags |= fuse.OpenDirectIO
+	return &StatusFileHandle{data: content}, nil
+}
+
+type StatusFileHandle struct {
+	data []byte
+}
+
+var _ = fs.HandleReader(&StatusFileHandle{})
+
+func (h *StatusFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	resp.Data = sliceForRead(h.data, req)
+	return nil
+}
@@ -0,0 +1,180 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// Verifies the control directory is only exposed in the root of a mount.
+func TestDir_LookupControl(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	node, err := root.Lookup(nil, &fuse.LookupRequest{Name: controlDirName}, nil)
+	if _, ok := node.(*ControlDir); err != nil || !ok {
+		t.Errorf("Expected to find the control directory: %v", err)
+	}
+	entries, _ := root.ReadDirAll(nil)
+	if len(entries) == 0 || entries[0].Name != controlDirName {
+		t.Error("Expected the control directory to be listed in the root")
+	}
+	dir := root.childDir(tags[0], nil, nil)
+	if _, err = dir.Lookup(nil, &fuse.LookupRequest{Name: controlDirName}, nil); err != fuse.ENOENT {
+		t.Errorf("Expected the control directory to only be in the root but got %v", err)
+	}
+}
+
+// Verifies commands written to the control file are run when flushed.
+func TestControlFileHandle_Flush(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 1)
+	db.CreateFileInPath(metaDb, "one", "path1", tags[0])
+	indexDir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create directory to index: %v", err)
+	}
+	defer os.RemoveAll(indexDir)
+	ioutil.WriteFile(filepath.Join(indexDir, "indexed.txt"), []byte(testContent), 0644)
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	controlDir := &ControlDir{root: root}
+	conditions := []struct {
+		command     string
+		expectedErr error
+	}{
+		{"retag " + tags[0][0].Text + " renamed", nil},
+		{"retag notThere other", fuse.ENOENT},
+		{"retag missingArg", fuse.Errno(syscall.EINVAL)},
+		{"move renamed", fuse.Errno(syscall.EINVAL)},
+		{"move notThere * renamed", fuse.ENOENT},
+		{"gc\nflush-cache\n", nil},
+		{"reassociate", nil},
+		{"check\ncheck repair", nil},
+		{"check everything", fuse.Errno(syscall.EINVAL)},
+		{"orphans\norphans delete", nil},
+		{"orphans all", fuse.Errno(syscall.EINVAL)},
+		{"reindex " + indexDir, nil},
+		{"alias renamed nickname", nil},
+		{"alias notThere nickname", fuse.ENOENT},
+		{"alias renamed " + tags[0][0].Text + "x\nunalias " + tags[0][0].Text + "x", nil},
+		{"grant renamed 1000\nrevoke renamed 1000", nil},
+		{"grant renamed someone", fuse.Errno(syscall.EINVAL)},
+		{"restore 1", nil},
+		{"restore someFile", fuse.Errno(syscall.EINVAL)},
+		{"purge-trash\npurge-trash 24h", nil},
+		{"purge-trash soon", fuse.Errno(syscall.EINVAL)},
+		{"bogus", fuse.Errno(syscall.EINVAL)},
+	}
+	for _, condition := range conditions {
+		node, _ := controlDir.Lookup(nil, &fuse.LookupRequest{Name: controlFileName}, nil)
+		handle, err := node.(*ControlFile).Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		if err != nil {
+			t.Errorf("Could not open control file: %v", err)
+			continue
+		}
+		controlHandle := handle.(*ControlFileHandle)
+		controlHandle.Write(nil, &fuse.WriteRequest{Data: []byte(condition.command)}, &fuse.WriteResponse{})
+		if err = controlHandle.Flush(nil, &fuse.FlushRequest{}); err != condition.expectedErr {
+			t.Errorf("Expected %v running %q but got %v", condition.expectedErr, condition.command, err)
+		}
+	}
+	if tag, _ := db.FindTag(metaDb, "renamed"); tag.Id != tags[0][0].Id {
+		t.Error("Expected retag to rename the tag")
+	}
+	if tag, _ := db.FindTag(metaDb, "nickname"); tag.Id != tags[0][0].Id {
+		t.Error("Expected alias to add an alternate name")
+	}
+	// gc removes the tags without files
+	for _, tag := range []metadata.TagInfo{tags[1][0], tags[2][0]} {
+		if found, _ := db.FindTag(metaDb, tag.Text); found.Id != metadata.UnknownTag.Id {
+			t.Errorf("Expected %s to be garbage collected", tag.Text)
+		}
+	}
+	if found, _ := db.FindFileByAbsPath(metaDb, "indexed.txt", indexDir); found.Id == metadata.UnknownFile.Id {
+		t.Error("Expected reindex to add the indexed file")
+	}
+}
+
+// Verifies only root and the owner of the mount may grant and revoke tags.
+func TestControlDir_GrantPermission(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	root.control.owner = 501
+	controlDir := &ControlDir{root: root}
+	grant := "grant " + tags[0][0].Text + " 1000"
+	revoke := "revoke " + tags[0][0].Text + " 1000"
+	conditions := []struct {
+		command     string
+		uid         uint32
+		expectedErr error
+	}{
+		{grant, 1000, fuse.EPERM},
+		{grant, 501, nil},
+		{revoke, 1000, fuse.EPERM},
+		{revoke, 0, nil},
+		{grant, 0, nil},
+	}
+	for _, condition := range conditions {
+		node, _ := controlDir.Lookup(nil, &fuse.LookupRequest{Name: controlFileName}, nil)
+		handle, _ := node.(*ControlFile).Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+		controlHandle := handle.(*ControlFileHandle)
+		controlHandle.Write(nil, &fuse.WriteRequest{Data: []byte(condition.command)}, &fuse.WriteResponse{})
+		flush := &fuse.FlushRequest{}
+		flush.Uid = condition.uid
+		if err := controlHandle.Flush(nil, flush); err != condition.expectedErr {
+			t.Errorf("Expected %v running %q as %d but got %v", condition.expectedErr, condition.command,
+				condition.uid, err)
+		}
+	}
+	if hidden, _ := db.GetHiddenTags(metaDb, 1000); len(hidden) != 0 {
+		t.Errorf("Expected the tag to be granted to 1000 but %v are hidden", hidden)
+	}
+	if hidden, _ := db.GetHiddenTags(metaDb, 1001); len(hidden) != 1 {
+		t.Errorf("Expected the tag to be hidden from 1001 but got %v", hidden)
+	}
+}
+
+// Verifies the status file reports the mount statistics.
+func TestStatusFile_Read(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.CreateFileInPath(metaDb, "one", "path1", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	controlDir := &ControlDir{root: root}
+	controlDir.execute(context.Background(), 0, "bogus")
+	status := &StatusFile{dir: controlDir}
+	if _, err := status.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{}); err == nil {
+		t.Error("Expected the status file to be read-only")
+	}
+	handle, err := status.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatalf("Could not open status file: %v", err)
+	}
+	resp := &fuse.ReadResponse{}
+	handle.(*StatusFileHandle).Read(nil, &fuse.ReadRequest{Size: 4096}, resp)
+	expected := []string{"mount point: " + testMount, "files: 1", "tags: 2", "commands: 1", "last command: bogus"}
+	for _, line := range expected {
+		if !strings.Contains(string(resp.Data), line+"\n") {
+			t.Errorf("Expected status to contain %q but got %q", line, resp.Data)
+		}
+	}
+	if !strings.Contains(string(resp.Data), "\nCreateFileInPath: ") {
+		t.Errorf("Expected status to report the timings of queries but got %q", resp.Data)
+	}
+}
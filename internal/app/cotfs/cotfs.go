@@ -5,166 +5,675 @@ import (
 	"bazil.org/fuse/fs"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
 	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/findertags"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/ninep"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
 	"github.com/cfagiani/cotfs/internal/pkg/storage"
 	"io"
+	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
-// Mounts the filesystem at the path specified and opens a connection to the metadata database
-func Mount(metadataPath string, mountPoint string, storage storage.FileStorage) error {
-	database, err := db.Open(metadataPath)
-
+// Mounts the filesystem at the path specified and opens a connection to the metadata database (or bolt store)
+func Mount(metadataPath string, mountPoint string, storage storage.FileStorage, options Options) error {
+	store, closeStore, err := openStore(metadataPath, options)
 	if err != nil {
 		return err
 	}
-	defer database.Close()
+	defer closeStore()
 
 	// try un-mounting just in case we're already mounted
 	fuse.Unmount(mountPoint)
-	c, err := fuse.Mount(mountPoint,
-		fuse.FSName("cotfs"),
-		fuse.Subtype("cotfs"),
-		fuse.LocalVolume(), //this only impacts Finder on MacOS
-		fuse.VolumeName("Media Filesystem"),
-	)
+	filesys := New(Config{
+		Store:      store,
+		MountPoint: mountPoint,
+		Storage:    storage,
+		Options:    options,
+	})
+	if err = filesys.Reload(); err != nil {
+		return err
+	}
+	config := mountConfig{}
+	if options.Permissions || options.UserViews {
+		// let every user access the mount and have the kernel check their access against the reported attributes, so
+		// other users can't write to the files of the user who mounted it
+		config.allowOther, config.defaultPermissions = true, true
+	}
+	server, err := mount(mountPoint, filesys, config)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
+	defer server.close()
 
-	filesys := &FS{
-		database:      database,
-		mountPoint:    mountPoint,
-		storageSystem: storage,
+	defer filesys.startBackground(func() {
+		invalidateRoot(server, filesys.root)
+	})()
+	return server.serve()
+}
+
+// Serves the filesystem over 9P2000 to the clients connecting to the listener (see package ninep), for machines where
+// FUSE isn't available, until the listener is closed. The files are served read-only, as regular files.
+func Serve(metadataPath string, listener net.Listener, storage storage.FileStorage, options Options) error {
+	if options.Symlinks {
+		return errors.New("9P has no symlinks, files can only be served with their content")
+	}
+	store, closeStore, err := openStore(metadataPath, options)
+	if err != nil {
+		return err
 	}
-	if err := fs.Serve(c, filesys); err != nil {
+	defer closeStore()
+	filesys := New(Config{
+		Store:   store,
+		Storage: storage,
+		Options: options,
+	})
+	if err = filesys.Reload(); err != nil {
 		return err
 	}
+	// clients don't cache what they read, so there is nothing to invalidate
+	defer filesys.startBackground(func() {})()
+	server := &ninep.Server{FS: filesys, Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	return server.Serve(listener)
+}
 
-	// check if the mount process has an error to report
-	<-c.Ready
-	if err := c.MountError; err != nil {
-		return err
+// Opens the metadata store a filesystem is served from: the bolt store the path names (see boltstore.IsPath) or else
+// the SQLite database. Fails if the options enable a feature the store doesn't have. The function returned closes the
+// store.
+func openStore(metadataPath string, options Options) (db.MetadataStore, func(), error) {
+	var store db.MetadataStore
+	var closeStore func()
+	if boltstore.IsPath(metadataPath) {
+		if options.Database.Key != "" {
+			return nil, nil, fmt.Errorf("%s is a bolt store, which can't be encrypted", metadataPath)
+		}
+		// bolt files are locked by the process that has them open, so the indexer waits for the mount to end
+		bolt, err := boltstore.Open(metadataPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		store, closeStore = bolt, func() { bolt.Close() }
+	} else {
+		database, err := openDatabase(metadataPath, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		store, closeStore = db.NewSQLiteStore(database), func() { db.Close(database) }
+	}
+	if err := checkFeatures(store, options); err != nil {
+		closeStore()
+		return nil, nil, fmt.Errorf("%s: %v", metadataPath, err)
+	}
+	return store, closeStore, nil
+}
+
+// Opens the metadata database a filesystem is served from, purging the trash of the files removed before the trash
+// expiry.
+func openDatabase(metadataPath string, options Options) (*sql.DB, error) {
+	if options.Database.Source == "" {
+		options.Database.Source = db.SourceMount
+	}
+	database, err := db.OpenWithOptions(metadataPath, options.Database)
+	if err != nil {
+		return nil, err
+	}
+	if options.Trash && options.TrashExpiry > 0 {
+		if _, err := db.PurgeTrash(database, time.Now().Add(-options.TrashExpiry)); err != nil {
+			db.Close(database)
+			return nil, err
+		}
 	}
+	return database, nil
+}
 
+// Checks the store has the features the options enable, see the optional interfaces of db.MetadataStore. Stores that
+// can't be watched for changes are only refreshed by the mount's own changes, which needs no check.
+func checkFeatures(store db.MetadataStore, options Options) error {
+	_, hierarchy := store.(db.HierarchyStore)
+	_, permissions := store.(db.PermissionStore)
+	_, acl := store.(db.ACLStore)
+	_, trash := store.(db.TrashStore)
+	_, accessTimes := store.(db.AccessTimeStore)
+	features := []struct {
+		name      string
+		enabled   bool
+		supported bool
+	}{
+		{"hierarchical tags", options.Hierarchical, hierarchy},
+		{"permissions", options.Permissions, permissions},
+		{"user views", options.UserViews, acl},
+		{"the trash", options.Trash, trash},
+		{"access times", options.AccessTimes, accessTimes},
+	}
+	for _, feature := range features {
+		if feature.enabled && !feature.supported {
+			return fmt.Errorf("the metadata store doesn't support %s", feature.name)
+		}
+	}
 	return nil
 }
 
+// Starts checking the metadata database for changes made by other processes, dropping the cached metadata and
+// calling changed when there are, recording the times files are accessed, as enabled by the options, and reloading
+// the configuration file on SIGHUP.
+// The function returned stops them all, once the last access times are written.
+func (f *FS) startBackground(changed func()) func() {
+	stops := []func(){f.reloadOnHangup()}
+	if watched, ok := f.store.(db.WatchedStore); ok && f.options.RefreshInterval > 0 {
+		stop := make(chan struct{})
+		watcher := &changeWatcher{store: watched, interval: f.options.RefreshInterval,
+			changed: func() {
+				watched.FlushCache()
+				changed()
+			}}
+		go watcher.run(stop)
+		stops = append(stops, func() { close(stop) })
+	}
+	if f.access != nil {
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			f.access.run(accessFlushInterval, stop)
+			close(done)
+		}()
+		// write the last access times before the database is closed
+		stops = append(stops, func() {
+			close(stop)
+			<-done
+		})
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// Options control the optional behaviors of the filesystem. The zero value disables all of them.
+type Options struct {
+	// directories with more files than this list them in batches of this size (0 disables batching)
+	BatchSize int
+	// which files, if any, are listed in the root directory
+	RootFiles RootFileMode
+	// opening files for writing writes through to the backing file (otherwise the filesystem is read-only)
+	WriteThrough bool
+	// files are presented as symlinks to their location on disk instead of proxying their content
+	Symlinks bool
+	// removing a tag from the root deletes it even if files would be left un-tagged; those files are moved to the
+	// uncategorized tag instead
+	RecursiveRemove bool
+	// tag directories that would not contain any files are left out of listings
+	HideEmptyTags bool
+	// file attributes are reported from the size and modification time recorded in the database when indexing rather
+	// than by the storage, which is only accessed to open files
+	CachedAttrs bool
+	// tags whose names start with a dot (i.e. .trash) are left out of listings but can still be opened by name
+	HideDotTags bool
+	// tag directories list the sub-tags created in them (parent/child) rather than every co-occurring tag
+	Hierarchical bool
+	// permission bits of tag directories (and the synthetic directories), 0755 if not set
+	DirMode os.FileMode
+	// permission bits removed from the modes of files
+	FileModeMask os.FileMode
+	// every tag and file is reported as owned by Uid and Gid rather than by their own owner
+	OverrideOwner bool
+	Uid           uint32
+	Gid           uint32
+	// maximum number of tag components (tags, exclusions and unions) in a path; directories at this depth list only
+	// files (0 is unlimited)
+	MaxDepth int
+	// how often to check the metadata database for changes made by other processes (0 disables)
+	RefreshInterval time.Duration
+	// tags and files have their own owner and mode, set by mkdir, chmod and chown, which the kernel enforces; the
+	// mount is shared with all users
+	Permissions bool
+	// tags granted to some users (see db.GrantTag) and the files carrying them are hidden from all other users
+	UserViews bool
+	// directory on disk that files created in the filesystem (i.e. copied in) are stored in; creating files is not
+	// allowed if empty
+	Inbox string
+	// rm moves files to the trash tag, from which they can be restored, instead of just removing the tag
+	Trash bool
+	// how long files stay in the trash; older ones are purged when mounting (0 keeps them until purged with the
+	// purge-trash command)
+	TrashExpiry time.Duration
+	// the times files are opened are recorded in the database (in batches) and reported as their access times
+	AccessTimes bool
+	// files whose tags are changed through the mount have their macOS Finder tags replaced with their tags
+	FinderTags bool
+	// JSON file of settings overriding the options above (see Settings); reloaded on SIGHUP and with the reload
+	// command
+	ConfigFile string
+	// JSON file of the tag map of the files indexed with the reindex command (see LoadIndexerOptions); reloaded along
+	// with the configuration file
+	TagMapFile string
+	// settings for opening the metadata database (journal mode, locking, syncing, backups before migrating it, tag
+	// names matching regardless of case)
+	Database db.OpenOptions
+}
+
+// Returns the permission bits of directories.
+func (o Options) dirMode() os.FileMode {
+	if o.DirMode == 0 {
+		return 0755
+	}
+	return o.DirMode.Perm()
+}
+
+// Reports the configured owner instead of the node's own, if an owner is configured.
+func (o Options) applyOwner(a *fuse.Attr) {
+	if o.OverrideOwner {
+		a.Uid = o.Uid
+		a.Gid = o.Gid
+	}
+}
+
+// Returns the directory entry type used for managed files.
+func (o Options) fileType() fuse.DirentType {
+	if o.Symlinks {
+		return fuse.DT_Link
+	}
+	return fuse.DT_File
+}
+
+// Selects the files listed in the root directory.
+type RootFileMode int
+
+const (
+	// no files are listed in the root since they would be "untagged"
+	RootFilesNone RootFileMode = iota
+	// every file is listed in the root
+	RootFilesAll
+	// only files with exactly one tag are listed in the root
+	RootFilesSingleTag
+)
+
+// Converts the name of a root file mode (none, all or single) to its value.
+func ParseRootFileMode(name string) (RootFileMode, error) {
+	switch name {
+	case "none", "":
+		return RootFilesNone, nil
+	case "all":
+		return RootFilesAll, nil
+	case "single":
+		return RootFilesSingleTag, nil
+	}
+	return RootFilesNone, fmt.Errorf("unknown root file mode %q", name)
+}
+
+// Config holds everything a filesystem instance needs. Nothing is shared between instances so several filesystems can
+// be served by one process.
+type Config struct {
+	// open metadata store (i.e. db.NewSQLiteStore); the caller remains responsible for closing it. Options needing a
+	// feature the store doesn't implement (see the optional interfaces of db.MetadataStore) have no effect
+	Store db.MetadataStore
+	// absolute path the filesystem is mounted at, used to resolve links to paths within the mount
+	MountPoint string
+	// where the content of the files is read from
+	Storage storage.FileStorage
+	// openers of the storage of files kept elsewhere than on local disk, by scheme (see db.SetFileLocation); files of
+	// schemes without one can't be opened
+	Backends map[string]storage.Opener
+	Options  Options
+}
+
+// Creates a filesystem from its configuration, ready to be served with fs.Serve.
+func New(config Config) *FS {
+	filesys := &FS{
+		store:         config.Store,
+		mountPoint:    config.MountPoint,
+		storageSystem: newSharedStorage(config.Storage),
+		options:       config.Options,
+		control:       newControlState(),
+		config:        &configFile{path: config.Options.ConfigFile, tagMapFile: config.Options.TagMapFile},
+	}
+	filesys.backends = storage.NewBackends(filesys.storageSystem)
+	for scheme, opener := range config.Backends {
+		filesys.backends.Register(scheme, opener)
+	}
+	if times, ok := config.Store.(db.AccessTimeStore); ok && config.Options.AccessTimes {
+		filesys.access = newAccessRecorder(times)
+	}
+	// create the root up front so it is the same node for the kernel and for cache invalidation
+	filesys.root = filesys.newRoot()
+	return filesys
+}
+
 type FS struct {
-	database      *sql.DB
+	store         db.MetadataStore
 	mountPoint    string
 	storageSystem storage.FileStorage
+	backends      *storage.Backends
+	options       Options
+	control       *controlState
+	access        *accessRecorder
+	config        *configFile
+	root          *Dir
 }
 
 var _ fs.FS = (*FS)(nil)
 
 func (f *FS) Root() (fs.Node, error) {
-	n := &Dir{
-		database:      f.database,
+	if f.root != nil {
+		return f.root, nil
+	}
+	return f.newRoot(), nil
+}
+
+func (f *FS) newRoot() *Dir {
+	return &Dir{
+		store:         f.store,
 		storageSystem: f.storageSystem,
+		backends:      f.backends,
 		mountPoint:    f.mountPoint,
+		options:       f.options,
+		control:       f.control,
+		access:        f.access,
+		config:        f.config,
+	}
+}
+
+var _ fs.FSStatfser = (*FS)(nil)
+
+// Block size reported to statfs callers
+const statfsBlockSize = 4096
+
+// Reports filesystem usage derived from the metadata database. Inodes are the managed files plus the tags (which are
+// presented as directories) and blocks are the aggregate size of the files as recorded when indexing, so the storage
+// isn't reached. The filesystem never reports free space since new content can only be added through the backing
+// storage.
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	fileCount, totalSize, err := f.store.GetFileTotals(ctx)
+	if err != nil {
+		return err
+	}
+	tagCount, err := f.store.CountTags(ctx)
+	if err != nil {
+		return err
 	}
-	return n, nil
+	size := uint64(totalSize)
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = (size + statfsBlockSize - 1) / statfsBlockSize
+	resp.Files = uint64(fileCount + tagCount)
+	resp.Namelen = 255
+	return nil
 }
 
 type Dir struct {
-	database *sql.DB
+	store db.MetadataStore
 	// nil for the root directory
-	path          []metadata.TagInfo
+	path []metadata.TagInfo
+	// groups of tags (i.e. /{beach,mountains}) of which files in this directory must have at least one
+	anyOf [][]metadata.TagInfo
+	// tags that files in this directory must NOT have
+	excluded []metadata.TagInfo
+	// tags the user listing the directory may not see, see forUser
+	hidden        []metadata.TagInfo
 	mountPoint    string
 	storageSystem storage.FileStorage
+	// storage of the files that aren't on local disk, nil if they all are
+	backends *storage.Backends
+	options  Options
+	// only set for the root directory, which exposes the control directory
+	control *controlState
+	// records the times files are opened, nil unless access times are enabled
+	access *accessRecorder
+	// the configuration file whose settings override the options, nil if built outside of a mount
+	config *configFile
 }
 
+// Prefixes that turn a path component into an exclusion (i.e. /photos/!screenshots)
+const exclusionPrefixes = "!-"
+
+// Separator for union path components written without braces (i.e. /beach+mountains)
+const unionSeparator = "+"
+
+// Tag given to files whose only tag is removed recursively
+const uncategorizedTag = "uncategorized"
+
 var _ fs.Node = (*Dir)(nil)
 
-func tagAttr(a *fuse.Attr) {
+// Reports the attributes shared by tag directories and the synthetic directories.
+func tagAttr(a *fuse.Attr, options Options) {
 	a.Size = 0
-	a.Mode = os.ModeDir | 0755
-
+	a.Mode = os.ModeDir | options.dirMode()
+	options.applyOwner(a)
 }
 
-func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+// Reports the directory attributes. Counting the sub-directories (the co-incident tags) would take a query on every
+// stat, so the link count is always 1, which tools walking the tree (i.e. find) take as an unknown number of them.
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	a.Nlink = 1
+	tagAttr(a, d.options)
 	if d.path == nil {
 		// root directory
-		a.Mode = os.ModeDir | 0755
 		return nil
 	}
-	tagAttr(a)
+	if permissions, ok := d.store.(db.PermissionStore); ok && d.options.Permissions {
+		// the directory is the tag at the end of the path
+		perm, ok, err := permissions.GetTagPermissions(ctx, d.path[len(d.path)-1])
+		if err != nil {
+			return err
+		}
+		if ok {
+			applyPermissions(a, perm)
+		}
+	}
+	d.options.applyOwner(a)
+	return nil
+}
+
+var _ = fs.NodeSetattrer(&Dir{})
+
+// Responds to chmod and chown by recording the new owner or mode of the tag at the end of the path when permissions are
+// enabled. Other changes are ignored.
+func (d *Dir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if err := d.Attr(ctx, &resp.Attr); err != nil {
+		return err
+	}
+	if !d.options.Permissions || !changesPermissions(req) {
+		return nil
+	}
+	if len(d.path) == 0 {
+		return fuse.EPERM
+	}
+	permissions, ok := d.store.(db.PermissionStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	perm := updatedPermissions(resp.Attr, req)
+	if err := permissions.SetTagPermissions(ctx, d.path[len(d.path)-1], perm); err != nil {
+		return err
+	}
+	applyPermissions(&resp.Attr, perm)
+	return nil
+}
+
+// Reports whether a setattr request changes the owner or mode.
+func changesPermissions(req *fuse.SetattrRequest) bool {
+	return req.Valid.Mode() || req.Valid.Uid() || req.Valid.Gid()
+}
+
+// Combines the current attributes with the owner and mode changed by a setattr request.
+func updatedPermissions(current fuse.Attr, req *fuse.SetattrRequest) metadata.Permissions {
+	perm := metadata.Permissions{Uid: current.Uid, Gid: current.Gid, Mode: current.Mode.Perm()}
+	if req.Valid.Mode() {
+		perm.Mode = req.Mode.Perm()
+	}
+	if req.Valid.Uid() {
+		perm.Uid = req.Uid
+	}
+	if req.Valid.Gid() {
+		perm.Gid = req.Gid
+	}
+	return perm
+}
+
+// Replaces the owner and permission bits of the attributes, keeping the file type.
+func applyPermissions(a *fuse.Attr, perm metadata.Permissions) {
+	a.Uid = perm.Uid
+	a.Gid = perm.Gid
+	a.Mode = a.Mode&^os.ModePerm | perm.Mode.Perm()
+}
+
+// LinkedDir is the node returned for a directory linked in from outside the filesystem. The kernel expects the new
+// entry to be a symlink; once the entry expires the name resolves to the tag named after the directory instead.
+type LinkedDir struct {
+	target string
+}
+
+var _ fs.Node = (*LinkedDir)(nil)
+
+func (l *LinkedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeSymlink | 0777
+	a.Size = uint64(len(l.target))
 	return nil
 }
 
+var _ = fs.NodeReadlinker(&LinkedDir{})
+
+// Returns the directory that was linked.
+func (l *LinkedDir) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	return l.target, nil
+}
+
 var _ = fs.NodeSymlinker(&Dir{})
 
 // Responds to symlink calls by adding the tags corresponding to the destination to the file specified by the target
 // If the target of the link resides outside the cotfs file system, a new File database entry will be created pointing
 // to the underlying file.
-func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fs.Node, error) {
+func (d *Dir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (_ fs.Node, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
 	//no links in the root
 	if d.path == nil {
 		return nil, fuse.EPERM
 	}
 	absDirPath, fileName := convertToAbsolutePath(d.path, req.Target, d.mountPoint)
 	if strings.Index(absDirPath, d.mountPoint) == 0 {
-		return d.handleWithinFSLink(absDirPath, fileName)
+		return d.handleWithinFSLink(ctx, absDirPath, fileName)
 	} else {
 		// target is a real file outside our filesystem.
-		return d.handleCrossDeviceLink(absDirPath, fileName)
+		return d.handleCrossDeviceLink(ctx, absDirPath, fileName)
 	}
 }
 
 // Handles linking to a file that resides outside this cotfs file system. This function will find or create a new file
 // record (only 1 file record per absolute path is permitted) and apply the tags from the destination directory to the
-// file record.
-func (d *Dir) handleCrossDeviceLink(absDirPath string, fileName string) (fs.Node, error) {
+// file record. Directories are imported recursively; see handleCrossDeviceDirLink.
+func (d *Dir) handleCrossDeviceLink(ctx context.Context, absDirPath string, fileName string) (fs.Node, error) {
 	// first make sure it is a file
 	fi, err := d.storageSystem.Stat(fmt.Sprintf("%s%c%s", absDirPath, os.PathSeparator, fileName))
 	if err != nil {
 		return nil, err
 	}
 	if fi.Mode().IsDir() {
-		// TODO: if target is a directory, recursively traverse it and add all the files,
-		//  treating Intermediate subdirs as tags; for now, just return error
-		return nil, fuse.EPERM
+		return d.handleCrossDeviceDirLink(ctx, absDirPath, fileName)
 	}
+	info, err := importFile(ctx, d.store, fileName, absDirPath, fi, d.path)
+	if err == nil {
+		syncFinderTags(ctx, d.store, d.options, info)
+	}
+	file := d.fileNode(info)
+	file.newSymlink = true
+	return file, err
+}
+
+// Finds or creates the record of a file outside this cotfs file system and applies the tags passed in to it.
+func importFile(ctx context.Context, store db.MetadataStore, fileName string, absDirPath string, stat os.FileInfo,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
 	// See if the file already exists
-	info, err := db.FindFileByAbsPath(d.database, fileName, absDirPath)
+	info, err := store.FindFileByAbsPath(ctx, fileName, absDirPath)
 	if err != nil {
-		return nil, err
+		return metadata.UnknownFile, err
 	}
 	if info.Id == metadata.UnknownFile.Id {
-		// create the file record; we use the existing file name regardless of what the link specified
-		info, err = db.CreateFileInPath(d.database, fileName, absDirPath, d.path)
+		// create the file record; we use the existing file name regardless of what the link specified. Another process
+		// may have recorded it since, in which case the record is just tagged
+		info, err = store.UpsertFile(ctx, fileName, absDirPath, tags)
 		if err != nil {
-			return nil, err
+			return metadata.UnknownFile, err
 		}
+		err = store.SetFileStat(ctx, info.Id, stat.Size(), stat.ModTime())
 	} else {
 		// file already exists, just need to tag it
-		err = db.TagFile(d.database, info.Id, d.path)
+		err = store.TagFile(ctx, info.Id, tags)
+	}
+	if err != nil {
+		return info, err
+	}
+	return info, findertags.Import(ctx, store, info)
+}
+
+// Handles linking to a directory that resides outside this cotfs file system by importing every regular file under it.
+// The linked directory and each subdirectory become tags nested under the tags of the destination directory, so a file
+// at <dir>/a/b/file gets the destination's tags plus dir, a and b.
+func (d *Dir) handleCrossDeviceDirLink(ctx context.Context, absDirPath string, dirName string) (fs.Node, error) {
+	target := filepath.Join(absDirPath, dirName)
+	// tags to apply to the files in each directory visited so far
+	dirTags := map[string][]metadata.TagInfo{filepath.Dir(target): d.path}
+	err := filepath.Walk(target, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		parentTags := dirTags[filepath.Dir(path)]
+		if info.IsDir() {
+			tag, err := d.store.AddTag(ctx, info.Name(), parentTags)
+			if err != nil {
+				return err
+			}
+			dirTags[path] = append(append([]metadata.TagInfo{}, parentTags...), tag)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := importFile(ctx, d.store, info.Name(), filepath.Dir(path), info, parentTags)
+		if err != nil {
+			return err
+		}
+		syncFinderTags(ctx, d.store, d.options, file)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &File{fileInfo: info, storage: d.storageSystem, newSymlink: true}, err
+	return &LinkedDir{target: target}, nil
 }
 
 // Handles creation of a link to a file that is already under management by cotfs by looking up the tags that correspond
 // to the absoluteDirPath and applying the tags from the destination directory to the file.
 // An error is returned if any of the tags in the path don't exist or the file doesn't exist.
-func (d *Dir) handleWithinFSLink(absDirPath string, fileName string) (fs.Node, error) {
+func (d *Dir) handleWithinFSLink(ctx context.Context, absDirPath string, fileName string) (fs.Node, error) {
 	// if we're within our mount point, then strip it off and convert to a set of TagInfos
 	noMountPath := strings.Replace(absDirPath, d.mountPoint, "", 1)
 	if strings.IndexRune(noMountPath, os.PathSeparator) == 0 {
 		noMountPath = noMountPath[1:]
 	}
-	path, err := convertPathToTags(d.database, noMountPath)
+	path, excluded, err := convertPathToTags(ctx, d.store, noMountPath)
 	if err != nil {
 		return nil, err
 	}
 	// now make sure the file exists
-	files, err := db.GetFilesWithTags(d.database, path, fileName)
+	files, err := d.store.GetFilesMatchingFilter(ctx, db.TagFilter{Tags: path, Excluded: excluded}, fileName)
 	if err != nil {
 		return nil, err
 	}
@@ -176,38 +685,53 @@ func (d *Dir) handleWithinFSLink(absDirPath string, fileName string) (fs.Node, e
 		return nil, fuse.EPERM
 	}
 	// apply destination tags to the file
-	err = db.TagFile(d.database, files[0].Id, d.path)
+	err = d.store.TagFile(ctx, files[0].Id, d.path)
 	if err != nil {
 		return nil, err
 	}
-	return &File{fileInfo: files[0], storage: d.storageSystem, newSymlink: true}, nil
+	syncFinderTags(ctx, d.store, d.options, files[0])
+	file := d.fileNode(files[0])
+	file.newSymlink = true
+	return file, nil
 }
 
-// Converts an absolute directory path to an array of tag info objects
-func convertPathToTags(database *sql.DB, dirPath string) ([]metadata.TagInfo, error) {
+// Converts an absolute directory path to an array of tag info objects along with any excluded (! or - prefixed) tags
+func convertPathToTags(ctx context.Context, store db.MetadataStore, dirPath string) ([]metadata.TagInfo,
+	[]metadata.TagInfo, error) {
 	tokens := strings.Split(dirPath, string(os.PathSeparator))
 	//build up a "path" array
-	tags := make([]metadata.TagInfo, len(tokens))
-	for i, tag := range tokens {
+	var tags []metadata.TagInfo
+	var excluded []metadata.TagInfo
+	for _, tag := range tokens {
 		var tagInfo metadata.TagInfo
 		var err error
-		if i == 0 {
+		isExclusion := false
+		if len(tags) == 0 {
 			// if at the root, just lookup the tag
-			tagInfo, err = db.GetTag(database, tag)
+			tagInfo, err = store.FindTag(ctx, tag)
 		} else {
 			// otherwise, look for co-incident tag
-			tagInfo, err = db.GetCoincidentTag(database, tag, tags[i-1].Text)
+			tagInfo, err = store.GetCoincidentTag(ctx, tag, tags[len(tags)-1].Text)
+			if err == nil && tagInfo.Id == metadata.UnknownTag.Id && len(tag) > 1 &&
+				strings.IndexByte(exclusionPrefixes, tag[0]) >= 0 {
+				isExclusion = true
+				tagInfo, err = store.FindTag(ctx, tag[1:])
+			}
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if tagInfo.Id == metadata.UnknownTag.Id {
 			// not found return error
-			return nil, fuse.ENOENT
+			return nil, nil, fuse.ENOENT
+		}
+		if isExclusion {
+			excluded = append(excluded, tagInfo)
+		} else {
+			tags = append(tags, tagInfo)
 		}
-		tags[i] = tagInfo
 	}
-	return tags, nil
+	return tags, excluded, nil
 }
 
 // Converts a path string to an absolute path, treating the path parameter as the current working directory (used when
@@ -255,7 +779,9 @@ var _ = fs.NodeLinker(&Dir{})
 
 // Respond to hard link requests by applying the tags corresponding to the destination directory to the file.
 // We only support linking to files and do not allow links in the root (as that would be an untagged file).
-func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.Node, error) {
+func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (_ fs.Node, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
 	//no links in the root
 	if d.path == nil {
 		return nil, fuse.EPERM
@@ -265,7 +791,7 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 	case *Dir:
 		return nil, fuse.EPERM
 	case *File:
-		err := db.TagFile(d.database, node.fileInfo.Id, d.path)
+		err := d.store.TagFile(ctx, node.fileInfo.Id, d.path)
 		if err != nil {
 			return nil, err
 		}
@@ -275,224 +801,1354 @@ func (d *Dir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (fs.
 
 var _ = fs.NodeMkdirer(&Dir{})
 
-// Respond to mkdir calls by creating a tag and linking it to the tags in the current path.
-func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
-	tag, err := db.AddTag(d.database, req.Name, d.path)
+// Respond to mkdir calls by creating a tag and linking it to the tags in the current path. In hierarchical mode the
+// new tag also becomes a sub-tag of the current directory's tag. When permissions are enabled, a new tag is owned by
+// the user creating it.
+func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (_ fs.Node, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	existing, err := d.store.FindTag(ctx, req.Name)
 	if err != nil {
 		return nil, err
 	}
-	return &Dir{
-		database:      d.database,
-		path:          appendIfNotFound(d.path, tag),
-		storageSystem: d.storageSystem,
-		mountPoint:    d.mountPoint,
-	}, nil
-}
-
-// Respond to rm by removing a tag (for removing directories) or un-tagging a file
-func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	if req.Dir {
-		return d.handleTagRm(req)
-	} else {
-		return d.handleFileRm(req)
+	tag, err := d.store.AddTag(ctx, req.Name, d.path)
+	if err != nil {
+		return nil, err
+	}
+	if permissions, ok := d.store.(db.PermissionStore); ok && d.options.Permissions &&
+		existing.Id == metadata.UnknownTag.Id {
+		perm := metadata.Permissions{Uid: req.Uid, Gid: req.Gid, Mode: req.Mode.Perm() &^ req.Umask}
+		if err = permissions.SetTagPermissions(ctx, tag, perm); err != nil {
+			return nil, err
+		}
+	}
+	if hierarchy, ok := d.store.(db.HierarchyStore); ok && d.options.Hierarchical && len(d.path) > 0 {
+		err = hierarchy.SetTagParent(ctx, d.path[len(d.path)-1], tag)
+		if err == db.ErrTagCycle {
+			return nil, fuse.Errno(syscall.EINVAL)
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
+	return d.childDir(appendIfNotFound(d.path, tag), d.anyOf, d.excluded), nil
 }
 
-// Disassociates a tag with its parent tag or, if at the root, removes the tag entirely. Removals will be rejected
-// if the removal would leave any file un-tagged.
-func (d *Dir) handleTagRm(req *fuse.RemoveRequest) error {
-	// first get metadata corresponding to tag
-	var dirTag metadata.TagInfo
-	var err error
-	if d.path != nil {
-		dirTag, err = db.GetCoincidentTag(d.database, req.Name, d.path[0].Text)
-	} else {
-		dirTag, err = db.GetTag(d.database, req.Name)
-	}
+var _ = fs.NodeCreater(&Dir{})
 
-	if err != nil {
-		return err
+// Responds to file creation (i.e. cp into a tag directory) by creating the file in the inbox directory on disk and
+// tagging it with the tags in the current path. Fails if no inbox is configured or in the root, where the file would
+// have no tags.
+func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (_ fs.Node,
+	_ fs.Handle, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if d.options.Inbox == "" || d.path == nil {
+		return nil, nil, fuse.EPERM
 	}
-	if dirTag.Id == metadata.UnknownTag.Id {
-		return fuse.ENOENT
+	if strings.ContainsRune(req.Name, os.PathSeparator) {
+		return nil, nil, fuse.Errno(syscall.EINVAL)
+	}
+	flags := int(req.Flags&(fuse.OpenAccessModeMask|fuse.OpenSync)) | os.O_CREATE | os.O_EXCL
+	dirPath := d.options.Inbox
+	w, err := d.storageSystem.OpenFile(filepath.Join(dirPath, req.Name), flags, req.Mode.Perm()&^req.Umask)
+	// keep the requested name by putting files that clash with one already in the inbox into numbered subdirectories
+	for i := 1; os.IsExist(err); i++ {
+		dirPath = filepath.Join(d.options.Inbox, strconv.Itoa(i))
+		if err = d.storageSystem.MkdirAll(dirPath, 0755); err != nil {
+			return nil, nil, err
+		}
+		w, err = d.storageSystem.OpenFile(filepath.Join(dirPath, req.Name), flags, req.Mode.Perm()&^req.Umask)
 	}
-	// if any files have ONLY this tag, refuse to remove because "not empty"
-	count, err := db.GetFileCountWithSingleTag(d.database, dirTag)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if count > 0 {
-		return fuse.Errno(syscall.ENOTEMPTY)
+	stat, err := w.Stat()
+	if err != nil {
+		_ = w.Close()
+		return nil, nil, err
 	}
-
-	// remove tag from files with this particular set of tags (essentially pushing them "up" a directory)
-	err = db.UntagFiles(d.database, appendIfNotFound(d.path, dirTag))
+	info, err := importFile(ctx, d.store, req.Name, dirPath, stat, d.path)
 	if err != nil {
-		return err
+		// don't leave a file in the inbox that no tag directory shows
+		_ = w.Close()
+		_ = d.storageSystem.Remove(filepath.Join(dirPath, req.Name))
+		return nil, nil, err
 	}
-	// remove tag_assoc record for parent if there is one
-	if d.path != nil && len(d.path) > 0 {
-		db.UnassociateTag(d.database, d.path[len(d.path)-1], dirTag)
+	if permissions, ok := d.store.(db.PermissionStore); ok && d.options.Permissions {
+		perm := metadata.Permissions{Uid: req.Uid, Gid: req.Gid, Mode: req.Mode.Perm() &^ req.Umask}
+		err = permissions.SetFilePermissions(ctx, info.Id, perm)
 	}
-	// if no more files with tag present, remove tag
-	count, err = db.CountFilesWithTag(d.database, dirTag)
 	if err != nil {
-		return err
+		// nor a record of a file the permissions couldn't be set on, deleted even if the request's context is done
+		_ = w.Close()
+		_, _ = d.store.DeleteFiles(context.Background(), []int64{info.Id})
+		_ = d.storageSystem.Remove(filepath.Join(dirPath, req.Name))
+		return nil, nil, err
 	}
-	if count == 0 {
-		return db.DeleteTag(d.database, dirTag)
+	file := d.fileNode(info)
+	return file, &FileHandle{r: w, writable: true, file: file}, nil
+}
+
+// Creates a directory node for a sub-path of this directory.
+func (d *Dir) childDir(path []metadata.TagInfo, anyOf [][]metadata.TagInfo, excluded []metadata.TagInfo) *Dir {
+	return &Dir{
+		store:         d.store,
+		path:          path,
+		anyOf:         anyOf,
+		excluded:      excluded,
+		hidden:        d.hidden,
+		storageSystem: d.storageSystem,
+		backends:      d.backends,
+		mountPoint:    d.mountPoint,
+		options:       d.options,
+		access:        d.access,
+		config:        d.config,
 	}
+}
 
-	return fuse.Errno(syscall.ENOTEMPTY)
+// Reports whether this directory is as deep as paths may go, in which case it has no sub-directories.
+func (d *Dir) atMaxDepth() bool {
+	maxDepth := d.settings().MaxDepth
+	return maxDepth > 0 && len(d.path)+len(d.anyOf)+len(d.excluded) >= maxDepth
 }
 
-// Removes a tag from a file.
-func (d *Dir) handleFileRm(req *fuse.RemoveRequest) error {
-	// if we're in the root, we can't have a file so return noent
-	if d.path == nil {
-		return fuse.ENOENT
+// Returns the options of this directory with the settings last loaded from the configuration file.
+func (d *Dir) settings() Options {
+	return d.config.apply(d.options)
+}
+
+// Returns the view of this directory for a user, hiding the tags (and the files carrying them) the user was not granted
+// when user views are enabled. Root sees everything.
+func (d *Dir) forUser(ctx context.Context, uid uint32) (*Dir, error) {
+	if !d.options.UserViews {
+		return d, nil
 	}
-	//if it's a file, just unlink from this tag
-	files, err := db.GetFilesWithTags(d.database, d.path, req.Name)
-	if err != nil {
-		return err
+	view := *d
+	view.hidden = nil
+	if uid == 0 {
+		return &view, nil
 	}
-	if files == nil || len(files) == 0 {
-		return fuse.ENOENT
+	acl, ok := d.store.(db.ACLStore)
+	if !ok {
+		return nil, fuse.ENOTSUP
 	}
-	for _, file := range files {
-		err := db.UntagFile(d.database, file.Id, d.path[len(d.path)-1].Id)
-		if err != nil {
-			return err
-		}
+	hidden, err := acl.GetHiddenTags(ctx, uid)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	view.hidden = hidden
+	return &view, nil
 }
 
-var _ = fs.NodeRequestLookuper(&Dir{})
-
-// Looks up a single name within a directory. Names can be either a co-incident tag or a file.
-func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+// Returns the view of this directory for the user making a lookup, see forUser. With user views enabled, the kernel
+// shares cached entries between users so it is told to ask again for the entry looked up every time.
+func (d *Dir) lookupView(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (*Dir, error) {
+	if !d.options.UserViews {
+		return d, nil
+	}
+	if resp != nil {
+		resp.EntryValid = 0
+		resp.Attr.Valid = 0
+	}
+	return d.forUser(ctx, req.Uid)
+}
 
-	var err error
-	var foundTag metadata.TagInfo
-	if d.path == nil || len(d.path) == 0 {
-		foundTag, err = db.FindTag(d.database, req.Name)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		//now we need to see if the name corresponds to a directory. We have to hit the db for that
-		//doesn't matter which tag we use to check for co-incidence so just pick the first
-		foundTag, err = db.GetCoincidentTag(d.database, req.Name, d.path[0].Text)
-		if err != nil {
-			return nil, err
-		}
+// Reports whether a file carries a tag hidden from the user of this view, see forUser.
+func (d *Dir) hides(ctx context.Context, file metadata.FileInfo) (bool, error) {
+	if len(d.hidden) == 0 {
+		return false, nil
 	}
-	if foundTag.Id != metadata.UnknownTag.Id {
-		//since we don't allow file listing in the root, we know this must be a directory
-		return &Dir{
-			database:      d.database,
-			path:          appendIfNotFound(d.path, foundTag),
-			storageSystem: d.storageSystem,
-			mountPoint:    d.mountPoint,
-		}, nil
+	tags, err := d.store.GetTagsForFile(ctx, file.Id)
+	if err != nil {
+		return false, err
 	}
-	info, _ := db.GetFilesWithTags(d.database, d.path, req.Name)
-	if info != nil && len(info) > 0 {
-		return &File{
-			fileInfo: info[0],
-			storage:  d.storageSystem,
-		}, nil
+	for _, tag := range tags {
+		if tagInPath(d.hidden, tag) {
+			return true, nil
+		}
 	}
-	return nil, fuse.ENOENT
-
+	return false, nil
 }
 
-var _ = fs.HandleReadDirAller(&Dir{})
+// Reports whether this is the root directory of the mount, which also holds the virtual directories.
+func (d *Dir) isMountRoot() bool {
+	return d.control != nil
+}
 
-// Lists all contents of a directory
-func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+// Reports whether this directory selects files by tag. Only the root (and exclusions applied to it) do not.
+func (d *Dir) hasTags() bool {
+	return len(d.path) > 0 || len(d.anyOf) > 0
+}
 
-	var res []fuse.Dirent
+// Describes the files in this directory.
+func (d *Dir) tagFilter() db.TagFilter {
+	excluded := d.excluded
+	if len(d.hidden) > 0 {
+		excluded = append(append([]metadata.TagInfo{}, d.excluded...), d.hidden...)
+	}
+	return db.TagFilter{Tags: d.path, AnyOf: d.anyOf, Excluded: excluded}
+}
 
-	tags, err := db.GetCoincidentTags(d.database, d.path, "")
+// Lists the tags that are sub-directories of this directory, leaving out those without files and hidden tags if enabled.
+// Tags already in the path are never offered again so the tree has no cycles, and directories at the maximum depth have
+// none.
+func (d *Dir) childTags(ctx context.Context) ([]metadata.TagInfo, error) {
+	ctx = requestContext(ctx)
+	if d.atMaxDepth() {
+		return nil, nil
+	}
+	var tags []metadata.TagInfo
+	var err error
+	if hierarchy, ok := d.store.(db.HierarchyStore); ok && d.options.Hierarchical && len(d.anyOf) == 0 {
+		tags, err = subTags(ctx, hierarchy, d.path)
+	} else {
+		tags, err = d.store.GetCoincidentTagsForFilter(ctx, d.tagFilter(), "")
+	}
 	if err != nil {
 		return nil, err
 	}
+	settings := d.settings()
+	var visible []metadata.TagInfo
 	for _, tag := range tags {
-		res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: tag.Text})
+		if !tagInPath(d.hidden, tag) && !tagInPath(d.path, tag) && !tagInPath(d.excluded, tag) &&
+			!(settings.HideDotTags && strings.HasPrefix(tag.Text, ".")) {
+			visible = append(visible, tag)
+		}
 	}
-
-	// TODO: batch files in pseudo-directory if too many to list
-	// for now, only list files if not in the root
-	if d.path != nil && len(d.path) > 0 {
-		files, fileError := db.GetFilesWithTags(d.database, d.path, "")
-		if fileError != nil {
-			return nil, fileError
+	tags = visible
+	if !settings.HideEmptyTags {
+		return tags, nil
+	}
+	var nonEmpty []metadata.TagInfo
+	for _, tag := range tags {
+		filter := d.tagFilter()
+		filter.Tags = append(append([]metadata.TagInfo{}, d.path...), tag)
+		count, err := d.store.CountFilesMatchingFilter(ctx, filter)
+		if err != nil {
+			return nil, err
 		}
-		for _, file := range files {
-			res = append(res, fuse.Dirent{Name: file.Name, Type: fuse.DT_File})
+		if count > 0 {
+			nonEmpty = append(nonEmpty, tag)
 		}
 	}
-	return res, nil
+	return nonEmpty, nil
 }
 
-type File struct {
-	fileInfo   metadata.FileInfo
-	storage    storage.FileStorage
-	newSymlink bool
+// Lists the sub-tags of the last tag in the path, or the tags without a parent at the root.
+func subTags(ctx context.Context, hierarchy db.HierarchyStore, path []metadata.TagInfo) ([]metadata.TagInfo, error) {
+	if len(path) == 0 {
+		return hierarchy.GetRootTags(ctx)
+	}
+	return hierarchy.GetChildTags(ctx, path[len(path)-1])
 }
 
-var _ fs.Node = (*File)(nil)
+// Reports whether this directory lists files. Files are only listed in the root if enabled by the options.
+func (d *Dir) listsFiles() bool {
+	return d.hasTags() || d.options.RootFiles != RootFilesNone
+}
 
-func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
+// Lists the files in this directory, optionally filtered by name.
+func (d *Dir) getFiles(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	ctx = requestContext(ctx)
+	if !d.hasTags() {
+		switch d.options.RootFiles {
+		case RootFilesAll:
+			return d.store.GetFilesMatchingFilter(ctx, db.TagFilter{Excluded: d.hidden}, name)
+		case RootFilesSingleTag:
+			return d.store.GetFilesWithSingleTag(ctx, name)
+		}
+		return nil, nil
+	}
+	return d.store.GetFilesMatchingFilter(ctx, d.tagFilter(), name)
+}
+
+// Returns a function listing the files in this directory, for resolving file names.
+func (d *Dir) fileFinder(ctx context.Context) func(string) ([]metadata.FileInfo, error) {
+	return func(name string) ([]metadata.FileInfo, error) {
+		return d.getFiles(ctx, name)
+	}
+}
+
+// Returns the context of a request. It is only missing when a node is called directly rather than by the fuse server.
+func requestContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// Resolves a union path component such as {beach,mountains} or beach+mountains to its tags. Returns nil if the name
+// isn't a union of at least two existing tags.
+func (d *Dir) findUnionTags(ctx context.Context, name string) ([]metadata.TagInfo, error) {
+	var names []string
+	if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+		names = strings.Split(name[1:len(name)-1], ",")
+	} else {
+		names = strings.Split(name, unionSeparator)
+	}
+	if len(names) < 2 {
+		return nil, nil
+	}
+	var tags []metadata.TagInfo
+	for _, tagName := range names {
+		tag, err := d.store.FindTag(ctx, strings.TrimSpace(tagName))
+		if err != nil {
+			return nil, err
+		}
+		if tag.Id == metadata.UnknownTag.Id {
+			return nil, nil
+		}
+		tags = appendIfNotFound(tags, tag)
+	}
+	return tags, nil
+}
 
-	stat, err := os.Stat(fmt.Sprintf("%s%c%s", f.fileInfo.Path, os.PathSeparator, f.fileInfo.Name))
+// Respond to rm by removing a tag (for removing directories) or un-tagging a file
+func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if req.Dir {
+		return d.handleTagRm(ctx, req)
+	} else {
+		return d.handleFileRm(ctx, req)
+	}
+}
+
+// Disassociates a tag with its parent tag or, if at the root, removes the tag entirely. Removals will be rejected
+// if the removal would leave any file un-tagged unless recursive removal is enabled, in which case removing a tag from
+// the root moves those files to the uncategorized tag.
+func (d *Dir) handleTagRm(ctx context.Context, req *fuse.RemoveRequest) error {
+	// first get metadata corresponding to tag
+	dirTag, err := d.findChildTag(ctx, req.Name)
 	if err != nil {
 		return err
 	}
+	if dirTag.Id == metadata.UnknownTag.Id {
+		return fuse.ENOENT
+	}
+	if d.options.RecursiveRemove && len(d.path) == 0 && dirTag.Text != uncategorizedTag {
+		return d.store.DeleteTagRecursive(ctx, dirTag, uncategorizedTag)
+	}
+	// if any files have ONLY this tag, refuse to remove because "not empty"
+	count, err := d.store.GetFileCountWithSingleTag(ctx, dirTag)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fuse.Errno(syscall.ENOTEMPTY)
+	}
 
-	a.Size = uint64(stat.Size())
-	if f.newSymlink {
-		//  if we don't do this, we'll get an error from ln saying illegal argument when we link a file
-		a.Mode = stat.Mode() | os.ModeSymlink
+	// remove tag from files with this particular set of tags (essentially pushing them "up" a directory)
+	err = d.store.UntagFiles(ctx, appendIfNotFound(d.path, dirTag))
+	if err != nil {
+		return err
+	}
+	// remove tag_assoc record (and the hierarchy link) for parent if there is one
+	if d.path != nil && len(d.path) > 0 {
+		if err = d.store.UnassociateTag(ctx, d.path[len(d.path)-1], dirTag); err != nil {
+			return err
+		}
+		if hierarchy, ok := d.store.(db.HierarchyStore); ok && d.options.Hierarchical {
+			if err = hierarchy.RemoveTagParent(ctx, d.path[len(d.path)-1], dirTag); err != nil {
+				return err
+			}
+		}
+	}
+	// if no more files with tag present, remove tag
+	count, err = d.store.CountFilesWithTag(ctx, dirTag)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return d.store.DeleteTag(ctx, dirTag)
+	}
+
+	return fuse.Errno(syscall.ENOTEMPTY)
+}
+
+// Removes a tag from a file.
+func (d *Dir) handleFileRm(ctx context.Context, req *fuse.RemoveRequest) error {
+	// if we're in the root, we can't have a file so return noent
+	if d.path == nil {
+		return fuse.ENOENT
+	}
+	//if it's a file, just unlink from this tag
+	var files []metadata.FileInfo
+	var err error
+	if strings.Index(req.Name, "*") >= 0 {
+		// wildcards unlink every matching file
+		files, err = d.getFiles(ctx, req.Name)
 	} else {
-		a.Mode = stat.Mode()
+		var file metadata.FileInfo
+		file, err = resolveFile(req.Name, d.fileFinder(ctx))
+		if file.Id != metadata.UnknownFile.Id {
+			files = append(files, file)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fuse.ENOENT
+	}
+	untag := d.store.UntagFile
+	if trash, ok := d.store.(db.TrashStore); ok && d.options.Trash {
+		untag = trash.TrashFileTag
+	}
+	for _, file := range files {
+		err := untag(ctx, file.Id, d.path[len(d.path)-1].Id)
+		if err != nil {
+			return err
+		}
 	}
-	a.Mtime = stat.ModTime()
-	a.Ctime = getCreateTime(stat)
-	a.Crtime = a.Ctime
+	syncFinderTags(ctx, d.store, d.options, files...)
+	return nil
+}
 
+// Resolves a name within this directory to a tag. At the root any tag matches; otherwise the tag must co-occur with
+// the tags in the path (or be a sub-tag of the last one in hierarchical mode). Returns metadata.UnknownTag if there is
+// no such tag.
+func (d *Dir) findChildTag(ctx context.Context, name string) (metadata.TagInfo, error) {
+	if d.path == nil || len(d.path) == 0 {
+		return d.store.FindTag(ctx, name)
+	}
+	if hierarchy, ok := d.store.(db.HierarchyStore); ok && d.options.Hierarchical {
+		return hierarchy.GetChildTag(ctx, d.path[len(d.path)-1], name)
+	}
+	//doesn't matter which tag we use to check for co-incidence so just pick the first
+	return d.store.GetCoincidentTag(ctx, name, d.path[0].Text)
+}
+
+var _ = fs.NodeRenamer(&Dir{})
+
+// Respond to mv by renaming a tag. If a tag with the new name already exists, the old tag is merged into it. Tags can
+// only be renamed in place (the destination directory must be the same as the source). Files can't be renamed but can
+// be moved to another tag directory, which retags them (see moveFiles).
+func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	destination, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EPERM
+	}
+	if !samePath(d.path, destination.path) {
+		if req.OldName != req.NewName {
+			return fuse.EPERM
+		}
+		return d.moveFiles(ctx, req.OldName, destination)
+	}
+	tag, err := d.findChildTag(ctx, req.OldName)
+	if err != nil {
+		return err
+	}
+	if tag.Id == metadata.UnknownTag.Id {
+		if len(d.path) > 0 {
+			file, err := resolveFile(req.OldName, d.fileFinder(ctx))
+			if err != nil {
+				return err
+			}
+			if file.Id != metadata.UnknownFile.Id {
+				// file names come from the underlying filesystem so we don't support changing them
+				return fuse.EPERM
+			}
+		}
+		return fuse.ENOENT
+	}
+	if req.OldName == req.NewName {
+		return nil
+	}
+	return renameTag(ctx, d.store, tag, req.NewName)
+}
+
+// Moves the file with the name passed in (or every file matching it if it contains wildcards) to the destination
+// directory. The tags of this directory that aren't in the destination's path are removed from the files and the tags
+// of the destination applied, in one transaction.
+func (d *Dir) moveFiles(ctx context.Context, name string, destination *Dir) error {
+	if len(d.path) == 0 || len(destination.path) == 0 {
+		// files in the root have no tags to take away and files moved to it would have none left
+		return fuse.EPERM
+	}
+	var files []metadata.FileInfo
+	var err error
+	if strings.Index(name, "*") >= 0 {
+		files, err = d.getFiles(ctx, name)
+	} else {
+		var file metadata.FileInfo
+		file, err = resolveFile(name, d.fileFinder(ctx))
+		if file.Id != metadata.UnknownFile.Id {
+			files = append(files, file)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		tag, err := d.findChildTag(ctx, name)
+		if err != nil {
+			return err
+		}
+		if tag.Id != metadata.UnknownTag.Id {
+			// tags can only be renamed in place
+			return fuse.EPERM
+		}
+		return fuse.ENOENT
+	}
+	var removed []metadata.TagInfo
+	for _, tag := range d.path {
+		if !tagInPath(destination.path, tag) {
+			removed = append(removed, tag)
+		}
+	}
+	fileIds := make([]int64, len(files))
+	for i, file := range files {
+		fileIds[i] = file.Id
+	}
+	if err = d.store.RetagFiles(ctx, fileIds, removed, destination.path); err != nil {
+		return err
+	}
+	syncFinderTags(ctx, d.store, d.options, files...)
 	return nil
 }
 
-var _ = fs.NodeOpener(&File{})
+// Renames a tag, merging it into the existing tag if one already has the new name.
+func renameTag(ctx context.Context, store db.MetadataStore, tag metadata.TagInfo, newName string) error {
+	existingTag, err := store.RenameTag(ctx, tag, newName)
+	if err == db.ErrTagExists {
+		return store.MergeTags(ctx, tag, existingTag)
+	}
+	return err
+}
+
+var _ = fs.NodeFsyncer(&Dir{})
+
+// Tag directories only exist in the metadata database, which commits every change as it is made, so there is nothing
+// to sync.
+func (d *Dir) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	return nil
+}
+
+// Names of the synthetic directories in the root of the mount, in the order they are listed.
+var rootDirNames = []string{controlDirName, savedQueriesDirName, dateDirName, allDirName, untaggedDirName,
+	favoritesDirName, idDirName}
+
+// Reports whether the store backs a directory of the root: saved queries, dates and favorites need the features of the
+// store they list (see the optional interfaces of db.MetadataStore) and aren't shown without them.
+func (d *Dir) backsRootDir(name string) bool {
+	var ok bool
+	switch name {
+	case savedQueriesDirName:
+		_, ok = d.store.(db.QueryStore)
+	case dateDirName:
+		_, ok = d.store.(db.DateStore)
+	case favoritesDirName:
+		_, ok = d.store.(db.RatingStore)
+	default:
+		ok = true
+	}
+	return ok
+}
+
+var _ = fs.NodeRequestLookuper(&Dir{})
+
+// Looks up a single name within a directory. Names can be either a co-incident tag or a file.
+func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if d, err = d.lookupView(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	if d.isMountRoot() && d.backsRootDir(req.Name) {
+		switch req.Name {
+		case controlDirName:
+			return &ControlDir{root: d}, nil
+		case savedQueriesDirName:
+			return &SavedQueriesDir{root: d}, nil
+		case dateDirName:
+			return &DateDir{root: d}, nil
+		case allDirName:
+			return newAllDir(d), nil
+		case untaggedDirName:
+			return &UntaggedDir{root: d}, nil
+		case favoritesDirName:
+			return &FavoritesDir{root: d}, nil
+		case idDirName:
+			return &IdDir{root: d}, nil
+		}
+	}
+
+	if !d.atMaxDepth() {
+		foundTag, err := d.findChildTag(ctx, req.Name)
+		if err != nil {
+			return nil, err
+		}
+		// tags already in the path (or excluded by it) are not sub-directories, which keeps the tree free of cycles
+		if tagInPath(d.hidden, foundTag) || tagInPath(d.path, foundTag) || tagInPath(d.excluded, foundTag) {
+			return nil, fuse.ENOENT
+		}
+		if foundTag.Id != metadata.UnknownTag.Id {
+			//since we don't allow file listing in the root, we know this must be a directory
+			return d.childDir(appendIfNotFound(d.path, foundTag), d.anyOf, d.excluded), nil
+		}
+	}
+	// a tag prefixed with ! or - excludes files with that tag (only within a tag directory)
+	if d.hasTags() && !d.atMaxDepth() && len(req.Name) > 1 && strings.IndexByte(exclusionPrefixes, req.Name[0]) >= 0 {
+		excludedTag, err := d.store.FindTag(ctx, req.Name[1:])
+		if err != nil {
+			return nil, err
+		}
+		if excludedTag.Id != metadata.UnknownTag.Id {
+			return d.childDir(d.path, d.anyOf, appendIfNotFound(d.excluded, excludedTag)), nil
+		}
+	}
+	fileNode, err := d.lookupFile(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if fileNode != nil {
+		return fileNode, nil
+	}
+	// large directories group their files into batches
+	if batch := d.lookupBatch(ctx, req.Name); batch != nil {
+		return batch, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if d.atMaxDepth() {
+		return nil, fuse.ENOENT
+	}
+	// or it may list several tags of which files must have any one
+	unionTags, err := d.findUnionTags(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if unionTags != nil {
+		anyOf := append(append([][]metadata.TagInfo{}, d.anyOf...), unionTags)
+		return d.childDir(d.path, anyOf, d.excluded), nil
+	}
+	// lastly, the name may be a boolean tag expression
+	if _, ok := d.store.(db.QueryStore); ok && query.IsQuery(req.Name) {
+		if queryDir := newQueryDir(d, req.Name); queryDir != nil {
+			return queryDir, nil
+		}
+	}
+	return nil, fuse.ENOENT
+
+}
+
+// Looks up a file, or the tag sidecar of a file, by name within this directory. Returns nil if not found, or an
+// error if the files could not be queried.
+func (d *Dir) lookupFile(ctx context.Context, name string) (fs.Node, error) {
+	info, err := resolveFile(name, d.fileFinder(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if info.Id != metadata.UnknownFile.Id {
+		return d.fileNode(info), nil
+	}
+	// if it isn't a real file, it may be the tag sidecar of one
+	if d.listsFiles() && strings.HasSuffix(name, tagsSuffix) {
+		info, err = resolveFile(strings.TrimSuffix(name, tagsSuffix), d.fileFinder(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if info.Id != metadata.UnknownFile.Id {
+			return &TagsFile{file: d.fileNode(info)}, nil
+		}
+	}
+	return nil, nil
+}
+
+var _ = fs.NodeOpener(&Dir{})
+
+// Opens the directory for listing. With user views enabled, the handle is the view of the directory for the user
+// opening it.
+func (d *Dir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	return d.forUser(ctx, req.Uid)
+}
+
+var _ = fs.HandleReadDirAller(&Dir{})
+
+// Lists all contents of a directory
+func (d *Dir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+
+	var res []fuse.Dirent
+
+	if d.isMountRoot() {
+		for _, name := range rootDirNames {
+			if d.backsRootDir(name) {
+				res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: name})
+			}
+		}
+	}
+	tags, err := d.childTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range tags {
+		res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: tag.Text})
+	}
 
-func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	// only list files if not in the root (unless enabled)
+	if d.listsFiles() {
+		res, err = d.appendFiles(ctx, res)
+		return res, err
+	}
+	return res, nil
+}
 
-	r, err := f.storage.Open(fmt.Sprintf("%s%c%s", f.fileInfo.Path, os.PathSeparator, f.fileInfo.Name))
+// Appends the files in this directory to the entries passed in, or the batches holding them if there are too many.
+func (d *Dir) appendFiles(ctx context.Context, res []fuse.Dirent) ([]fuse.Dirent, error) {
+	if batchSize := d.settings().BatchSize; batchSize > 0 {
+		count, err := d.countFiles(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if d.isBatched(count) {
+			// too many to list, group them in pseudo-directories instead
+			for _, batch := range batchNames(count, batchSize) {
+				res = append(res, fuse.Dirent{Name: batch, Type: fuse.DT_Dir})
+			}
+			return res, nil
+		}
+	}
+	files, err := d.getFiles(ctx, "")
 	if err != nil {
 		return nil, err
 	}
+	return appendFileEntries(res, files, d.options), nil
+}
+
+// Builds the node for a file listed in this directory.
+func (d *Dir) fileNode(info metadata.FileInfo) *File {
+	return &File{
+		fileInfo: info,
+		store:    d.store,
+		storage:  d.storageSystem,
+		backends: d.backends,
+		options:  d.options,
+		access:   d.access,
+	}
+}
+
+// Adds directory entries for the files and their tag sidecars.
+func appendFileEntries(res []fuse.Dirent, files []metadata.FileInfo, options Options) []fuse.Dirent {
+	for _, name := range fileNames(files) {
+		res = append(res, fuse.Dirent{Name: name, Type: options.fileType()})
+		res = append(res, fuse.Dirent{Name: name + tagsSuffix, Type: fuse.DT_File})
+	}
+	return res
+}
+
+// Returns the names the files are listed under. Files sharing a name are told apart by adding the file id to the
+// name (i.e. IMG_0001 (42).jpg).
+func fileNames(files []metadata.FileInfo) []string {
+	counts := make(map[string]int)
+	for _, file := range files {
+		counts[file.Name]++
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		if counts[file.Name] > 1 {
+			names[i] = nameWithId(file)
+		} else {
+			names[i] = file.Name
+		}
+	}
+	return names
+}
+
+// Adds the file id to the name of the file, ahead of its extension.
+func nameWithId(file metadata.FileInfo) string {
+	ext := filepath.Ext(file.Name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(file.Name, ext), file.Id, ext)
+}
+
+// Splits a name produced by nameWithId into the original name and the file id. Returns false if the name does not
+// contain an id.
+func splitNameId(name string) (string, int64, bool) {
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	start := strings.LastIndex(stem, " (")
+	if start < 0 || !strings.HasSuffix(stem, ")") {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(stem[start+2:len(stem)-1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return stem[:start] + ext, id, true
+}
+
+// Resolves a listed file name to its record using find to look up files by their real name. Names shared by several
+// files only resolve in the form returned by fileNames. Returns metadata.UnknownFile if there is no such file.
+func resolveFile(name string, find func(string) ([]metadata.FileInfo, error)) (metadata.FileInfo, error) {
+	files, err := find(name)
+	if err != nil {
+		return metadata.UnknownFile, err
+	}
+	if len(files) == 1 {
+		return files[0], nil
+	}
+	if original, id, ok := splitNameId(name); ok {
+		files, err = find(original)
+		if err != nil {
+			return metadata.UnknownFile, err
+		}
+		for _, file := range files {
+			if file.Id == id {
+				return file, nil
+			}
+		}
+	}
+	return metadata.UnknownFile, nil
+}
+
+// Name of the extended attribute used to manage the tags of a file.
+const tagsXattr = "user.cotfs.tags"
+
+// Name of the read-only extended attribute holding the location of a file on disk.
+const sourceXattr = "user.cotfs.source"
+
+// Name of the extended attribute holding the rating of a file, from 1 to db.MaxRating.
+const ratingXattr = "user.cotfs.rating"
+
+// Prefix of the names of the extended attributes holding the key=value attributes of a file (i.e.
+// user.cotfs.attr.year).
+const attrXattrPrefix = "user.cotfs.attr."
+
+type File struct {
+	fileInfo metadata.FileInfo
+	store    db.MetadataStore
+	storage  storage.FileStorage
+	// storage of the files that aren't on local disk, nil if they all are
+	backends   *storage.Backends
+	options    Options
+	newSymlink bool
+	// records the times the file is opened, nil unless access times are enabled
+	access *accessRecorder
+}
+
+var _ fs.Node = (*File)(nil)
+
+// Returns the location of the file on disk, or within its bucket for files kept elsewhere.
+func (f *File) absolutePath() string {
+	return fmt.Sprintf("%s%c%s", f.fileInfo.Path, os.PathSeparator, f.fileInfo.Name)
+}
+
+// Returns the storage the file is kept in. The location of the file is only looked up if storage other than local disk
+// is configured.
+func (f *File) backend(ctx context.Context) (storage.FileStorage, error) {
+	locations, ok := f.store.(db.LocationStore)
+	if f.backends == nil || !f.backends.Remote() || !ok {
+		return f.storage, nil
+	}
+	location, err := locations.GetFileLocation(ctx, f.fileInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := f.backends.For(location)
+	if err == storage.ErrUnsupportedScheme {
+		log.Printf("No storage for %s, kept in %s", f.fileInfo.Name, location.Scheme)
+		return nil, fuse.Errno(syscall.ENXIO)
+	}
+	return backend, err
+}
+
+func (f *File) Attr(ctx context.Context, a *fuse.Attr) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+
+	if f.options.Symlinks {
+		// the link's size is the length of its target, which isn't stat'ed: listing links shouldn't wait on the storage
+		a.Size = uint64(len(f.absolutePath()))
+		a.Mode = os.ModeSymlink | 0777
+	} else {
+		stat, err := f.stat(ctx)
+		if err != nil {
+			return err
+		}
+		a.Size = uint64(stat.Size())
+		if f.newSymlink {
+			//  if we don't do this, we'll get an error from ln saying illegal argument when we link a file
+			a.Mode = stat.Mode() | os.ModeSymlink
+		} else {
+			a.Mode = stat.Mode()
+		}
+		a.Mtime = stat.ModTime()
+		a.Ctime = getCreateTime(stat)
+		a.Crtime = a.Ctime
+	}
+	// each tag is a path the file can be reached by, analogous to a hard link
+	tagCount, err := f.store.GetTagCountForFile(ctx, f.fileInfo.Id)
+	if err != nil {
+		return err
+	}
+	a.Nlink = uint32(tagCount)
+	if f.access != nil {
+		atime, ok, err := f.access.accessTime(f.fileInfo.Id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			a.Atime = atime
+		}
+	}
+	if permissions, ok := f.store.(db.PermissionStore); ok && f.options.Permissions && !f.options.Symlinks {
+		perm, ok, err := permissions.GetFilePermissions(ctx, f.fileInfo.Id)
+		if err != nil {
+			return err
+		}
+		if ok {
+			applyPermissions(a, perm)
+		}
+	}
+	if !f.options.Symlinks {
+		a.Mode &^= f.options.FileModeMask.Perm()
+	}
+	f.options.applyOwner(a)
+	return nil
+}
+
+// Stats the backing file. With cached attributes, the size and modification time recorded in the database are reported
+// instead, if there are any, so listings don't wait on slow or offline storage. Files without them get them recorded
+// the first time they are stat'ed.
+func (f *File) stat(ctx context.Context) (os.FileInfo, error) {
+	if !f.options.CachedAttrs {
+		backend, err := f.backend(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return backend.Stat(f.absolutePath())
+	}
+	size, modTime, ok, err := f.store.GetFileStat(ctx, f.fileInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return cachedStat{name: f.fileInfo.Name, size: size, modTime: modTime}, nil
+	}
+	backend, err := f.backend(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := backend.Stat(f.absolutePath())
+	if err != nil {
+		return nil, err
+	}
+	if err = f.store.SetFileStat(ctx, f.fileInfo.Id, stat.Size(), stat.ModTime()); err != nil {
+		log.Printf("Could not record the size and modification time of %s: %s", f.fileInfo.Name, err)
+	}
+	return stat, nil
+}
+
+// Records the size and modification time of the backing file, open as file, when attributes are cached.
+func (f *File) recordStat(ctx context.Context, file storage.File) error {
+	if !f.options.CachedAttrs {
+		return nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return f.store.SetFileStat(ctx, f.fileInfo.Id, stat.Size(), stat.ModTime())
+}
+
+// cachedStat describes a file by the attributes recorded in the database.
+type cachedStat struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (c cachedStat) Name() string       { return c.name }
+func (c cachedStat) Size() int64        { return c.size }
+func (c cachedStat) Mode() os.FileMode  { return 0644 }
+func (c cachedStat) ModTime() time.Time { return c.modTime }
+func (c cachedStat) IsDir() bool        { return false }
+func (c cachedStat) Sys() interface{}   { return nil }
+
+var _ = fs.NodeGetxattrer(&File{})
+
+// Reports the comma separated tags of the file as the user.cotfs.tags attribute, its location on disk as
+// user.cotfs.source, its rating as user.cotfs.rating and each of its key=value attributes as a user.cotfs.attr.<key>
+// attribute.
+func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if req.Name == tagsXattr {
+		tags, err := f.store.GetTagsForFile(ctx, f.fileInfo.Id)
+		if err != nil {
+			return err
+		}
+		names := make([]string, len(tags))
+		for i, tag := range tags {
+			names[i] = tag.Text
+		}
+		resp.Xattr = []byte(strings.Join(names, ","))
+		return nil
+	}
+	if req.Name == ratingXattr {
+		rating, err := f.rating(ctx)
+		if err != nil {
+			return err
+		}
+		if rating == 0 {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(strconv.Itoa(rating))
+		return nil
+	}
+	if strings.HasPrefix(req.Name, attrXattrPrefix) {
+		attributes, err := f.attributes(ctx)
+		if err != nil {
+			return err
+		}
+		value, ok := attributes[strings.TrimPrefix(req.Name, attrXattrPrefix)]
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		resp.Xattr = []byte(value)
+		return nil
+	}
+	if req.Name != sourceXattr {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(f.absolutePath())
+	return nil
+}
+
+// Gets the rating of the file, 0 if it has none or the store doesn't keep ratings.
+func (f *File) rating(ctx context.Context) (int, error) {
+	ratings, ok := f.store.(db.RatingStore)
+	if !ok {
+		return 0, nil
+	}
+	return ratings.GetFileRating(ctx, f.fileInfo.Id)
+}
+
+// Gets the key=value attributes of the file, none if the store doesn't keep them.
+func (f *File) attributes(ctx context.Context) (map[string]string, error) {
+	attributes, ok := f.store.(db.AttributeStore)
+	if !ok {
+		return nil, nil
+	}
+	return attributes.GetFileAttributes(ctx, f.fileInfo.Id)
+}
+
+var _ = fs.NodeListxattrer(&File{})
+
+// Lists the readable extended attributes.
+func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	resp.Append(tagsXattr, sourceXattr)
+	rating, err := f.rating(ctx)
+	if err != nil {
+		return err
+	}
+	if rating > 0 {
+		resp.Append(ratingXattr)
+	}
+	attributes, err := f.attributes(ctx)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		resp.Append(attrXattrPrefix + key)
+	}
+	return nil
+}
+
+var _ = fs.NodeSetxattrer(&File{})
+
+// Replaces the tags on the file with the comma or newline separated list of tag names written to the user.cotfs.tags
+// attribute. Tags that don't exist yet are created. An empty list is rejected since it would leave the file un-tagged.
+// Writing a user.cotfs.attr.<key> attribute sets the key=value attribute of the file, and writing user.cotfs.rating its
+// rating (0 clearing it).
+func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if req.Name == sourceXattr {
+		return fuse.EPERM
+	}
+	if req.Name == ratingXattr {
+		ratings, ok := f.store.(db.RatingStore)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		rating, err := strconv.Atoi(strings.TrimSpace(string(req.Xattr)))
+		if err == nil {
+			err = ratings.SetFileRating(ctx, f.fileInfo.Id, rating)
+		}
+		if _, ok := err.(*strconv.NumError); ok || err == db.ErrInvalidRating {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		return err
+	}
+	if strings.HasPrefix(req.Name, attrXattrPrefix) {
+		attributes, ok := f.store.(db.AttributeStore)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		err = attributes.SetFileAttribute(ctx, f.fileInfo.Id, strings.TrimPrefix(req.Name, attrXattrPrefix),
+			string(req.Xattr))
+		if err == db.ErrInvalidAttribute {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		return err
+	}
+	if req.Name != tagsXattr {
+		return fuse.ENOTSUP
+	}
+	return f.setTags(ctx, parseTagList(string(req.Xattr)))
+}
+
+// Replaces the tags on the file with the named tags, creating any that don't exist.
+func (f *File) setTags(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return fuse.EPERM
+	}
+	tags := make([]metadata.TagInfo, len(names))
+	for i, name := range names {
+		if strings.ContainsRune(name, os.PathSeparator) {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		// associate each tag with the ones before it so every pair co-occurs
+		tag, err := f.store.AddTag(ctx, name, tags[:i])
+		if err != nil {
+			return err
+		}
+		tags[i] = tag
+	}
+	if err := f.store.SetFileTags(ctx, f.fileInfo.Id, tags); err != nil {
+		return err
+	}
+	syncFinderTags(ctx, f.store, f.options, f.fileInfo)
+	return nil
+}
+
+// Replaces the Finder tags of files whose tags were changed through the mount with their tags, if enabled. The
+// changes are already in the database so failures are only logged.
+func syncFinderTags(ctx context.Context, store db.MetadataStore, options Options, files ...metadata.FileInfo) {
+	if !options.FinderTags {
+		return
+	}
+	for _, file := range files {
+		if err := findertags.Export(ctx, store, file); err != nil {
+			log.Printf("Could not update the Finder tags of %s: %s", file.Name, err)
+		}
+	}
+}
+
+var _ = fs.NodeRemovexattrer(&File{})
+
+// Removing the user.cotfs.tags attribute would leave the file un-tagged so it is not permitted, and user.cotfs.source is
+// read-only. Removing a user.cotfs.attr.<key> attribute removes the key=value attribute of the file, and removing
+// user.cotfs.rating clears its rating.
+func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if req.Name == ratingXattr {
+		ratings, ok := f.store.(db.RatingStore)
+		if !ok {
+			return fuse.ErrNoXattr
+		}
+		return ratings.SetFileRating(ctx, f.fileInfo.Id, 0)
+	}
+	if strings.HasPrefix(req.Name, attrXattrPrefix) {
+		key := strings.TrimPrefix(req.Name, attrXattrPrefix)
+		attributes, err := f.attributes(ctx)
+		if err != nil {
+			return err
+		}
+		if _, ok := attributes[key]; !ok {
+			return fuse.ErrNoXattr
+		}
+		return f.store.(db.AttributeStore).RemoveFileAttribute(ctx, f.fileInfo.Id, key)
+	}
+	if req.Name != tagsXattr && req.Name != sourceXattr {
+		return fuse.ErrNoXattr
+	}
+	return fuse.EPERM
+}
+
+var _ = fs.NodeOpener(&File{})
+
+// Opens the backing file. Files can only be opened for writing when write-through is enabled.
+func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle, err error) {
+	defer func() { err = toErrno(err) }()
+	path := f.absolutePath()
+	backend, err := f.backend(requestContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if req != nil && !req.Flags.IsReadOnly() {
+		if !f.options.WriteThrough {
+			return nil, fuse.Errno(syscall.EROFS)
+		}
+		// append is left out since the kernel supplies the offset of every write
+		flags := req.Flags & (fuse.OpenAccessModeMask | fuse.OpenTruncate | fuse.OpenSync)
+		w, err := backend.OpenFile(path, int(flags), 0)
+		if err != nil {
+			return nil, err
+		}
+		f.recordAccess()
+		return &FileHandle{r: w, writable: true, file: f}, nil
+	}
+	r, err := backend.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f.recordAccess()
 	return &FileHandle{r: r}, nil
 }
 
+// Notes that the file was opened if access times are enabled.
+func (f *File) recordAccess() {
+	if f.access != nil {
+		f.access.record(f.fileInfo.Id)
+	}
+}
+
+var _ = fs.NodeSetattrer(&File{})
+
+// Truncates the backing file when its size is changed and write-through is enabled. Other attribute changes are
+// ignored since the attributes always reflect the backing file.
+func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if req.Valid.Size() {
+		if !f.options.WriteThrough {
+			return fuse.Errno(syscall.EROFS)
+		}
+		backend, err := f.backend(ctx)
+		if err != nil {
+			return err
+		}
+		w, err := backend.OpenFile(f.absolutePath(), os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = w.Truncate(int64(req.Size))
+		if err == nil {
+			err = f.recordStat(ctx, w)
+		}
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if f.options.Permissions && changesPermissions(req) {
+		permissions, ok := f.store.(db.PermissionStore)
+		if !ok {
+			return fuse.ENOTSUP
+		}
+		current := fuse.Attr{}
+		if err := f.Attr(ctx, &current); err != nil {
+			return err
+		}
+		err = permissions.SetFilePermissions(ctx, f.fileInfo.Id, updatedPermissions(current, req))
+		if err != nil {
+			return err
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+var _ = fs.NodeFsyncer(&File{})
+
+// Syncs the backing file to disk. The kernel routes fsync to the node rather than the handle, so the file is re-opened
+// to sync it; syncing any descriptor of a file commits all of its data. Read-only mounts have nothing to sync.
+func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	if !f.options.WriteThrough {
+		return nil
+	}
+	backend, err := f.backend(requestContext(ctx))
+	if err != nil {
+		return err
+	}
+	w, err := backend.OpenFile(f.absolutePath(), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	err = w.Sync()
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 type FileHandle struct {
 	r storage.File
+	// true if the backing file was opened for writing
+	writable bool
+	// the file opened for writing, whose recorded attributes are refreshed on release
+	file *File
 }
 
 var _ fs.Handle = (*FileHandle)(nil)
 
 var _ fs.HandleReleaser = (*FileHandle)(nil)
 
-func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	return fh.r.Close()
+func (fh *FileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	var statErr error
+	if fh.file != nil {
+		statErr = fh.file.recordStat(ctx, fh.r)
+	}
+	if err = fh.r.Close(); err != nil {
+		return err
+	}
+	return statErr
+}
+
+var _ = fs.HandleWriter(&FileHandle{})
+
+// Writes the data directly to the backing file at the requested offset.
+func (fh *FileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	if !fh.writable {
+		return fuse.EPERM
+	}
+	n, err := fh.r.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return err
+}
+
+var _ = fs.HandleFlusher(&FileHandle{})
+
+// Commits anything written through the handle to the backing storage so errors are reported when the file is closed.
+func (fh *FileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	if !fh.writable {
+		return nil
+	}
+	return fh.r.Sync()
 }
 
 var _ = fs.NodeReadlinker(&File{})
 
-func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+// Resolves the link to the location of the file on disk when presenting files as symlinks.
+func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (_ string, err error) {
+	defer func() { err = toErrno(err) }()
+	if f.options.Symlinks {
+		return f.absolutePath(), nil
+	}
 	// we convert any cached symlinks back to regular nodes
 	// TODO this works except where you try to open the linked file right after linking; fix that limitation
 	f.newSymlink = false
@@ -501,18 +2157,16 @@ func (f *File) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string,
 
 var _ = fs.HandleReader(&FileHandle{})
 
-func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
-	// We don't actually enforce Offset to match where previous read
-	// ended. Maybe we should, but that would mean'd we need to track
-	// it. The kernel *should* do it for us, based on the
-	// fuse.OpenNonSeekable flag.
+func (fh *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) (err error) {
+	defer func() { err = toErrno(err) }()
+	// Reads are positioned at the requested offset so random access (mmap, seeking, concurrent readers sharing the
+	// handle) works without tracking where the previous read ended.
 	//
-	// One exception to the above is if we fail to fully populate a
-	// page cache page; a read into page cache is always page aligned.
-	// Make sure we never serve a partial read, to avoid that.
+	// A read into page cache is always page aligned, so we never serve a partial read unless we hit the end of the
+	// file; ReadAt only returns fewer bytes than requested along with an error.
 	buf := make([]byte, req.Size)
-	n, err := io.ReadFull(fh.r, buf)
-	if err == io.ErrUnexpectedEOF || err == io.EOF {
+	n, err := fh.r.ReadAt(buf, req.Offset)
+	if err == io.EOF {
 		err = nil
 	}
 	resp.Data = buf[:n]
@@ -527,3 +2181,45 @@ func appendIfNotFound(tags []metadata.TagInfo, newTag metadata.TagInfo) []metada
 	}
 	return append(tags, newTag)
 }
+
+// Checks whether two tag paths contain the same tags, regardless of order.
+func samePath(a []metadata.TagInfo, b []metadata.TagInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, tag := range a {
+		found := false
+		for _, other := range b {
+			if tag.Id == other.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Splits a comma or newline separated list of tag names, dropping blanks and duplicates.
+func parseTagList(value string) []string {
+	var names []string
+	for _, name := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		duplicate := false
+		for _, existing := range names {
+			if existing == name {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -3,13 +3,24 @@ package cotfs
 import (
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
 	"github.com/cfagiani/cotfs/internal/pkg/db"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
 	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -31,7 +42,7 @@ func TestFS_Root(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
 	fs := &FS{
-		database:      metaDb,
+		store:         db.NewSQLiteStore(metaDb),
 		storageSystem: storageSys,
 		mountPoint:    testMount,
 	}
@@ -57,6 +68,182 @@ func TestFS_Root(t *testing.T) {
 	}
 }
 
+// Verifies filesystems created from a configuration keep their own state and serve a single root.
+func TestNew(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	conditions := []struct {
+		mountPoint string
+		options    Options
+	}{
+		{testMount, Options{}},
+		{testMount + "2", Options{BatchSize: 10}},
+	}
+	var roots []*Dir
+	for _, condition := range conditions {
+		filesys := New(Config{Store: db.NewSQLiteStore(metaDb), MountPoint: condition.mountPoint, Storage: storageSys,
+			Options: condition.options})
+		first, _ := filesys.Root()
+		second, _ := filesys.Root()
+		if first != second {
+			t.Error("Expected the same root node to be returned every time")
+		}
+		root := first.(*Dir)
+		if root.mountPoint != condition.mountPoint || root.options != condition.options || !root.isMountRoot() {
+			t.Errorf("Configuration not pushed down into root node for %s", condition.mountPoint)
+		}
+		roots = append(roots, root)
+	}
+	if roots[0].control == roots[1].control {
+		t.Error("Expected each filesystem to track its own status")
+	}
+}
+
+// Verifies the tag directories are served over 9P, and files can't be served as symlinks.
+func TestServe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metadataPath := filepath.Join(dir, "meta.db")
+	database, err := db.Open(metadataPath)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	tag, _ := db.AddTag(database, "photos", nil)
+	db.CreateFileInPath(database, "beach.jpg", dir, []metadata.TagInfo{tag})
+	db.Close(database)
+	ioutil.WriteFile(filepath.Join(dir, "beach.jpg"), []byte(testContent), 0644)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	if err = Serve(metadataPath, listener, storage.LocalFileStorage{}, Options{Symlinks: true}); err == nil {
+		t.Error("Expected serving symlinks to fail")
+	}
+	served := make(chan error)
+	go func() {
+		served <- Serve(metadataPath, listener, storage.LocalFileStorage{}, Options{})
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	defer conn.Close()
+	conditions := []struct {
+		request      []interface{}
+		expectedType uint8
+	}{
+		// Tversion, Tattach and Twalk, each answered with its reply (one more) or Rerror (107)
+		{[]interface{}{uint8(100), uint32(8192), "9P2000"}, 101},
+		{[]interface{}{uint8(104), uint32(1), ^uint32(0), "someone", ""}, 105},
+		{[]interface{}{uint8(110), uint32(1), uint32(2), uint16(2), "photos", "beach.jpg"}, 111},
+		{[]interface{}{uint8(110), uint32(1), uint32(3), uint16(1), "missing"}, 107},
+	}
+	for _, condition := range conditions {
+		if typ := send9P(t, conn, condition.request...); typ != condition.expectedType {
+			t.Errorf("Expected reply %d to %v but got %d", condition.expectedType, condition.request, typ)
+		}
+	}
+	listener.Close()
+	if err = <-served; err == nil {
+		t.Error("Expected serving to stop once the listener is closed")
+	}
+}
+
+// Sends a 9P message made of the fields passed in, the type first, and returns the type of the reply.
+func send9P(t *testing.T, conn net.Conn, fields ...interface{}) uint8 {
+	var msg bytes.Buffer
+	for _, field := range fields {
+		if text, ok := field.(string); ok {
+			binary.Write(&msg, binary.LittleEndian, uint16(len(text)))
+			msg.WriteString(text)
+		} else {
+			binary.Write(&msg, binary.LittleEndian, field)
+		}
+		if msg.Len() == 1 {
+			// the tag follows the type
+			binary.Write(&msg, binary.LittleEndian, uint16(1))
+		}
+	}
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(msg.Len()+4))
+	if _, err := conn.Write(append(size, msg.Bytes()...)); err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	if _, err := io.ReadFull(conn, size); err != nil {
+		t.Fatalf("Could not read reply: %v", err)
+	}
+	reply := make([]byte, binary.LittleEndian.Uint32(size)-4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Could not read reply: %v", err)
+	}
+	return reply[0]
+}
+
+// Verifies statfs reports the managed files, tags and their aggregate size.
+func TestFS_Statfs(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	one, _ := db.CreateFileInPath(metaDb, "one", "path1", flatten(tags))
+	two, _ := db.CreateFileInPath(metaDb, "two", "path2", tags[0])
+	for _, file := range []metadata.FileInfo{one, two} {
+		db.SetFileStat(metaDb, file.Id, int64(len(testContent)), time.Now())
+	}
+	// files without a recorded size are counted but do not contribute to the size, without reaching the storage
+	db.CreateFileInPath(metaDb, "ERROR", "path3", tags[0])
+	fs := &FS{store: db.NewSQLiteStore(metaDb), storageSystem: storageSys, mountPoint: testMount}
+	resp := &fuse.StatfsResponse{}
+	err := fs.Statfs(nil, &fuse.StatfsRequest{}, resp)
+	if err != nil {
+		t.Errorf("Could not get filesystem stats: %v", err)
+	}
+	if resp.Files != 5 {
+		t.Errorf("Expected 5 inodes but got %d", resp.Files)
+	}
+	if resp.Blocks != 1 {
+		t.Errorf("Expected the %d bytes of content to take 1 block but got %d", 2*len(testContent), resp.Blocks)
+	}
+	if resp.Bfree != 0 || resp.Ffree != 0 {
+		t.Error("Expected no free space to be reported")
+	}
+}
+
+// Verifies operations whose request was interrupted give up with EINTR.
+func TestDir_Interrupted(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.CreateFileInPath(metaDb, "one", "path1", flatten(tags))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0], storageSystem: storageSys}
+	if _, err := dir.ReadDirAll(ctx); err != fuse.Errno(syscall.EINTR) {
+		t.Errorf("Expected listing to be interrupted but got %v", err)
+	}
+	if _, err := dir.Lookup(ctx, &fuse.LookupRequest{Name: "missing"}, nil); err != fuse.Errno(syscall.EINTR) {
+		t.Errorf("Expected lookup to be interrupted but got %v", err)
+	}
+	// directories only query their attributes when permissions are enabled
+	permDir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0], storageSystem: storageSys,
+		options: Options{Permissions: true}}
+	if err := permDir.Attr(ctx, &fuse.Attr{}); err != fuse.Errno(syscall.EINTR) {
+		t.Errorf("Expected attr to be interrupted but got %v", err)
+	}
+	// the synthetic directories running their own queries are interrupted too
+	listers := []fs.HandleReadDirAller{
+		newQueryDir(dir, "tag1-0 | !tag0-0"),
+		&UntaggedDir{root: dir},
+	}
+	for _, lister := range listers {
+		if _, err := lister.ReadDirAll(ctx); err != fuse.Errno(syscall.EINTR) {
+			t.Errorf("Expected listing %T to be interrupted but got %v", lister, err)
+		}
+	}
+}
+
 // Verifies readDirAll returns a list of directory contents.
 func TestDir_ReadDirAll(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
@@ -81,7 +268,7 @@ func TestDir_ReadDirAll(t *testing.T) {
 	for _, condition := range conditions {
 		// create the Directory
 		dir := &Dir{
-			database:      metaDb,
+			store:         db.NewSQLiteStore(metaDb),
 			mountPoint:    testMount,
 			path:          condition.path,
 			storageSystem: storageSys,
@@ -92,6 +279,7 @@ func TestDir_ReadDirAll(t *testing.T) {
 		} else {
 			fileCount := 0
 			dirCount := 0
+			sidecarCount := 0
 			for _, entry := range entries {
 				if entry.Type == fuse.DT_Dir {
 					dirCount++
@@ -99,6 +287,11 @@ func TestDir_ReadDirAll(t *testing.T) {
 					if !containsDir(entry, condition.expectedDirs) {
 						t.Errorf("Found unexpected directory %s", entry.Name)
 					}
+				} else if strings.HasSuffix(entry.Name, tagsSuffix) {
+					sidecarCount++
+					if !containsFile(fuse.Dirent{Name: strings.TrimSuffix(entry.Name, tagsSuffix)}, condition.expectedFiles) {
+						t.Errorf("Found tag sidecar %s for unexpected file", entry.Name)
+					}
 				} else {
 					fileCount++
 					if !containsFile(entry, condition.expectedFiles) {
@@ -109,6 +302,9 @@ func TestDir_ReadDirAll(t *testing.T) {
 			if fileCount != len(condition.expectedFiles) {
 				t.Errorf("Expected %d files but found %d", len(condition.expectedFiles), fileCount)
 			}
+			if sidecarCount != fileCount {
+				t.Errorf("Expected a tag sidecar for each of the %d files but found %d", fileCount, sidecarCount)
+			}
 			if dirCount != len(condition.expectedDirs) {
 				t.Errorf("Expected %d dirs but found %d", len(condition.expectedDirs), dirCount)
 			}
@@ -116,271 +312,1810 @@ func TestDir_ReadDirAll(t *testing.T) {
 	}
 }
 
-// Verifies we can lookup directory entries by name.
-func TestDir_Lookup(t *testing.T) {
+// Verifies we can lookup directory entries by name.
+func TestDir_Lookup(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 3)
+	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][1]})
+	conditions := []struct {
+		name         string
+		path         []metadata.TagInfo
+		expectedNode fs.Node
+	}{
+		{file1.Name, []metadata.TagInfo{tags[0][1]}, &File{fileInfo: file1}},
+		{file1.Name, nil, nil},
+		{file1.Name, []metadata.TagInfo{tags[0][1], tags[1][1], tags[2][1]}, nil},
+		{"notThere", []metadata.TagInfo{tags[0][1]}, nil},
+		{tags[1][1].Text, []metadata.TagInfo{tags[0][1]}, &Dir{path: []metadata.TagInfo{tags[0][1], tags[1][1]}}},
+		{file1.Name + tagsSuffix, []metadata.TagInfo{tags[0][1]}, &TagsFile{file: &File{fileInfo: file1}}},
+		{file1.Name + tagsSuffix, nil, nil},
+		{"notThere" + tagsSuffix, []metadata.TagInfo{tags[0][1]}, nil},
+	}
+
+	for _, condition := range conditions {
+		// create the Directory
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
+
+		if condition.expectedNode == nil {
+			if node != nil || err != fuse.ENOENT {
+				t.Errorf("Expected lookup of %s to give NOENT error", condition.name)
+			}
+		} else {
+			if sidecar, ok := node.(*TagsFile); ok {
+				expectedSidecar, ok := condition.expectedNode.(*TagsFile)
+				if !ok {
+					t.Error("Got a tag sidecar node but didn't expect one")
+				} else if sidecar.file.fileInfo.Id != expectedSidecar.file.fileInfo.Id || sidecar.file.store == nil {
+					t.Errorf("Expected tag sidecar for %s", expectedSidecar.file.fileInfo.Name)
+				}
+				continue
+			}
+			file, ok := node.(*File)
+			if ok {
+				//verify the required fields get populated
+				if file.storage == nil {
+					t.Error("Storage member of file struct was nil")
+				}
+				//if it's a file, check the file matches the info
+				expectedFile, ok := condition.expectedNode.(*File)
+				if !ok {
+					t.Error("Got a file node but didn't expect one")
+				}
+				if expectedFile.fileInfo.Name != file.fileInfo.Name {
+					t.Errorf("Expected lookup to find %s but got %s", expectedFile.fileInfo.Name, file.fileInfo.Name)
+				}
+			} else {
+				dir, ok := node.(*Dir)
+				if ok {
+					if dir.storageSystem == nil || dir.store == nil || dir.path == nil {
+						t.Error("Dir structure contained nil fields")
+					}
+					if dir.mountPoint != testMount {
+						t.Errorf("Expected dir to have %s as mountPoint but found %s", testMount, dir.mountPoint)
+					}
+					expectedDir, ok := condition.expectedNode.(*Dir)
+					if !ok {
+						t.Error("Got a dir node but didn't expect one")
+					}
+					if len(dir.path) != len(expectedDir.path) {
+						t.Errorf("Expected dir to have path of length %d but found %d", len(expectedDir.path), len(dir.path))
+					} else {
+						for _, expectedTag := range expectedDir.path {
+							found := false
+							for _, foundTag := range dir.path {
+								if foundTag.Id == expectedTag.Id {
+									found = true
+									break
+								}
+							}
+							if !found {
+								t.Errorf("The tag %s was missing in the dir path", expectedTag.Text)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// Verifies ! and - prefixed names exclude tags from a directory.
+func TestDir_LookupExclusion(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 1)
+	both, _ := db.CreateFileInPath(metaDb, "both", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	first, _ := db.CreateFileInPath(metaDb, "first", "path2", []metadata.TagInfo{tags[0][0]})
+	dir := &Dir{
+		store:         db.NewSQLiteStore(metaDb),
+		mountPoint:    testMount,
+		path:          []metadata.TagInfo{tags[0][0]},
+		storageSystem: storageSys,
+	}
+	for _, prefix := range []string{"!", "-"} {
+		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: prefix + tags[1][0].Text}, nil)
+		excludedDir, ok := node.(*Dir)
+		if err != nil || !ok {
+			t.Errorf("Expected %s%s to resolve to a directory: %v", prefix, tags[1][0].Text, err)
+			continue
+		}
+		if len(excludedDir.path) != 1 || len(excludedDir.excluded) != 1 || excludedDir.excluded[0].Id != tags[1][0].Id {
+			t.Error("Expected exclusion directory to keep the path and exclude the tag")
+		}
+		entries, _ := excludedDir.ReadDirAll(nil)
+		foundDir := false
+		for _, entry := range entries {
+			if entry.Name == both.Name || entry.Name == tags[1][0].Text {
+				t.Errorf("Found excluded entry %s", entry.Name)
+			}
+			if entry.Name == tags[2][0].Text {
+				foundDir = true
+			}
+		}
+		if !foundDir {
+			t.Errorf("Expected to find %s in exclusion directory", tags[2][0].Text)
+		}
+		fileNode, err := excludedDir.Lookup(nil, &fuse.LookupRequest{Name: first.Name}, nil)
+		if err != nil || fileNode.(*File).fileInfo.Id != first.Id {
+			t.Errorf("Expected to find %s in exclusion directory", first.Name)
+		}
+		_, err = excludedDir.Lookup(nil, &fuse.LookupRequest{Name: both.Name}, nil)
+		if err != fuse.ENOENT {
+			t.Errorf("Expected %s to be hidden by the exclusion", both.Name)
+		}
+		// navigating further keeps the exclusion
+		node, err = excludedDir.Lookup(nil, &fuse.LookupRequest{Name: tags[2][0].Text}, nil)
+		if err != nil || len(node.(*Dir).excluded) != 1 {
+			t.Error("Expected sub-directories to keep the exclusion")
+		}
+	}
+	// exclusions of unknown tags and in the root are not directories
+	_, err := dir.Lookup(nil, &fuse.LookupRequest{Name: "-notThere"}, nil)
+	if err != fuse.ENOENT {
+		t.Error("Expected excluding an unknown tag to give NOENT error")
+	}
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	_, err = root.Lookup(nil, &fuse.LookupRequest{Name: "-" + tags[1][0].Text}, nil)
+	if err != fuse.ENOENT {
+		t.Error("Expected exclusions in the root to give NOENT error")
+	}
+}
+
+// Verifies aliases resolve to the directory of their tag while only the canonical name is listed.
+func TestDir_LookupAlias(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.AddAlias(metaDb, tags[1][0], "alias")
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	conditions := []struct {
+		dir *Dir
+	}{
+		{root},
+		{root.childDir(tags[0], nil, nil)},
+	}
+	for _, condition := range conditions {
+		node, err := condition.dir.Lookup(nil, &fuse.LookupRequest{Name: "alias"}, nil)
+		if err != nil {
+			t.Errorf("Could not look up alias: %v", err)
+			continue
+		}
+		path := node.(*Dir).path
+		if path[len(path)-1].Id != tags[1][0].Id {
+			t.Errorf("Expected alias to resolve to %s", tags[1][0].Text)
+		}
+		entries, _ := condition.dir.ReadDirAll(nil)
+		for _, entry := range entries {
+			if entry.Name == "alias" {
+				t.Error("Expected only the canonical name to be listed")
+			}
+		}
+	}
+}
+
+// Verifies {a,b} and a+b names list files with any of the tags.
+func TestDir_LookupUnion(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 1)
+	first, _ := db.CreateFileInPath(metaDb, "first", "path1", []metadata.TagInfo{tags[0][0]})
+	second, _ := db.CreateFileInPath(metaDb, "second", "path2", []metadata.TagInfo{tags[1][0]})
+	db.CreateFileInPath(metaDb, "third", "path3", []metadata.TagInfo{tags[2][0]})
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	names := []string{
+		fmt.Sprintf("{%s,%s}", tags[0][0].Text, tags[1][0].Text),
+		fmt.Sprintf("%s+%s", tags[0][0].Text, tags[1][0].Text),
+	}
+	for _, name := range names {
+		node, err := root.Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+		unionDir, ok := node.(*Dir)
+		if err != nil || !ok {
+			t.Errorf("Expected %s to resolve to a directory: %v", name, err)
+			continue
+		}
+		entries, _ := unionDir.ReadDirAll(nil)
+		fileCount := 0
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_File && !strings.HasSuffix(entry.Name, tagsSuffix) {
+				fileCount++
+				if !containsFile(entry, []metadata.FileInfo{first, second}) {
+					t.Errorf("Found unexpected file %s in %s", entry.Name, name)
+				}
+			}
+		}
+		if fileCount != 2 {
+			t.Errorf("Expected 2 files in %s but found %d", name, fileCount)
+		}
+		fileNode, err := unionDir.Lookup(nil, &fuse.LookupRequest{Name: second.Name}, nil)
+		if err != nil || fileNode.(*File).fileInfo.Id != second.Id {
+			t.Errorf("Expected to find %s in %s", second.Name, name)
+		}
+		// tags co-occurring with either side can be used to narrow the union
+		node, err = unionDir.Lookup(nil, &fuse.LookupRequest{Name: tags[2][0].Text}, nil)
+		if err != nil || len(node.(*Dir).anyOf) != 1 || len(node.(*Dir).path) != 1 {
+			t.Error("Expected sub-directories to keep the union")
+		}
+	}
+	badNames := []string{"{notThere,other}", fmt.Sprintf("%s+notThere", tags[0][0].Text), "{}", "{single}"}
+	for _, name := range badNames {
+		_, err := root.Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+		if err != fuse.ENOENT {
+			t.Errorf("Expected lookup of %s to give NOENT error", name)
+		}
+	}
+}
+
+// Verifies tag directories without files are only listed when empty tags are not hidden.
+func TestDir_ReadDirAllHideEmptyTags(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 1)
+	db.CreateFileInPath(metaDb, "one", "path1", tags[0])
+	db.CreateFileInPath(metaDb, "two", "path2", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	conditions := []struct {
+		path         []metadata.TagInfo
+		hideEmpty    bool
+		expectedDirs int
+	}{
+		{nil, false, 3},
+		{nil, true, 2},
+		{tags[0], false, 2},
+		{tags[0], true, 1},
+		{[]metadata.TagInfo{tags[0][0], tags[1][0]}, true, 0},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: condition.path, storageSystem: storageSys,
+			options: Options{HideEmptyTags: condition.hideEmpty}}
+		entries, err := dir.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read directory: %v", err)
+			continue
+		}
+		dirCount := 0
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				dirCount++
+			}
+		}
+		if dirCount != condition.expectedDirs {
+			t.Errorf("Expected %d dirs but found %d", condition.expectedDirs, dirCount)
+		}
+	}
+}
+
+// Verifies files are only listed in the root directory when enabled by the options.
+func TestDir_ReadDirAllRootFiles(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.CreateFileInPath(metaDb, "one", "path1", []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "two", "path2", flatten(tags))
+	conditions := []struct {
+		mode          RootFileMode
+		expectedFiles int
+	}{
+		{RootFilesNone, 0},
+		{RootFilesAll, 2},
+		{RootFilesSingleTag, 1},
+	}
+	for _, condition := range conditions {
+		root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+			options: Options{RootFiles: condition.mode}}
+		entries, err := root.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read directory: %v", err)
+			continue
+		}
+		fileCount := 0
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_File && !strings.HasSuffix(entry.Name, tagsSuffix) {
+				fileCount++
+			}
+		}
+		if fileCount != condition.expectedFiles {
+			t.Errorf("Expected %d files in the root but found %d", condition.expectedFiles, fileCount)
+		}
+		_, err = root.Lookup(nil, &fuse.LookupRequest{Name: "one"}, nil)
+		if (err == nil) != (condition.expectedFiles > 0) {
+			t.Errorf("Unexpected result looking up a root file with mode %d: %v", condition.mode, err)
+		}
+	}
+}
+
+// Verifies bolt stores are opened for paths naming them, refusing the options that need features they don't have.
+func TestOpenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	boltPath := filepath.Join(dir, "meta.bolt")
+	conditions := []struct {
+		path        string
+		options     Options
+		expectBolt  bool
+		expectedErr bool
+	}{
+		{boltPath, Options{}, true, false},
+		{boltPath, Options{Symlinks: true, BatchSize: 100}, true, false},
+		{boltPath, Options{Permissions: true}, false, true},
+		{boltPath, Options{Trash: true}, false, true},
+		{boltPath, Options{RefreshInterval: time.Second}, true, false},
+		{boltPath, Options{Database: db.OpenOptions{Key: "secret"}}, false, true},
+		{filepath.Join(dir, "meta.db"), Options{Permissions: true, Trash: true}, false, false},
+	}
+	for _, condition := range conditions {
+		store, closeStore, err := openStore(condition.path, condition.options)
+		if (err != nil) != condition.expectedErr {
+			t.Errorf("Unexpected result opening %s with %+v: %v", condition.path, condition.options, err)
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := store.(*boltstore.Store); ok != condition.expectBolt {
+			t.Errorf("Expected %s to be a bolt store (%t) but got %T", condition.path, condition.expectBolt, store)
+		}
+		closeStore()
+	}
+}
+
+// Verifies a bolt store is browsed by tag, without the root directories it can't back.
+func TestDir_BoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := boltstore.Open(filepath.Join(dir, "meta.bolt"))
+	if err != nil {
+		t.Fatalf("Could not open store: %v", err)
+	}
+	defer store.Close()
+	ctx := context.Background()
+	tags, _ := store.AddTags(ctx, []string{"photos", "2019"}, nil)
+	store.CreateFileInPath(ctx, "beach.jpg", "/p", tags)
+	store.CreateFileInPath(ctx, "cat.jpg", "/p", tags[:1])
+	root := New(Config{Store: store, MountPoint: testMount, Storage: MockFileStorage{}}).root
+	conditions := []struct {
+		path     []string
+		expected []string
+	}{
+		{nil, []string{allDirName, controlDirName, idDirName, untaggedDirName, "2019", "photos"}},
+		{[]string{"photos"}, []string{"2019", "beach.jpg", "cat.jpg"}},
+		{[]string{"photos", "2019"}, []string{"beach.jpg"}},
+		{[]string{"photos", "!2019"}, []string{"cat.jpg"}},
+	}
+	for _, condition := range conditions {
+		var node fs.Node = root
+		for _, name := range condition.path {
+			if node, err = node.(fs.NodeRequestLookuper).Lookup(ctx, &fuse.LookupRequest{Name: name},
+				&fuse.LookupResponse{}); err != nil {
+				t.Fatalf("Could not look up %v: %v", condition.path, err)
+			}
+		}
+		entries, err := node.(fs.HandleReadDirAller).ReadDirAll(ctx)
+		var names []string
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name, tagsSuffix) {
+				names = append(names, entry.Name)
+			}
+		}
+		sort.Strings(names)
+		if err != nil || !reflect.DeepEqual(names, condition.expected) {
+			t.Errorf("Expected %v in %v but got %v (%v)", condition.expected, condition.path, names, err)
+		}
+	}
+	if _, err = root.Lookup(ctx, &fuse.LookupRequest{Name: dateDirName}, &fuse.LookupResponse{}); err != fuse.ENOENT {
+		t.Errorf("Expected %s to be missing but got %v", dateDirName, err)
+	}
+}
+
+// Verifies root file modes are parsed from their names.
+func TestParseRootFileMode(t *testing.T) {
+	conditions := []struct {
+		name        string
+		expected    RootFileMode
+		shouldError bool
+	}{
+		{"", RootFilesNone, false},
+		{"none", RootFilesNone, false},
+		{"all", RootFilesAll, false},
+		{"single", RootFilesSingleTag, false},
+		{"some", RootFilesNone, true},
+	}
+	for _, condition := range conditions {
+		mode, err := ParseRootFileMode(condition.name)
+		if (err != nil) != condition.shouldError {
+			t.Errorf("Unexpected error state parsing %s: %v", condition.name, err)
+		} else if mode != condition.expected {
+			t.Errorf("Expected mode %d for %s but got %d", condition.expected, condition.name, mode)
+		}
+	}
+}
+
+// Verifies mkdir creates tags
+func TestDir_Mkdir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	conditions := []struct {
+		name string
+		path []metadata.TagInfo
+	}{
+		{"topLevelTag", nil},
+		{"nestedTag", tags[0]},
+		{tags[0][0].Text, tags[0]},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+		node, err := dir.Mkdir(nil, &fuse.MkdirRequest{Name: condition.name})
+		if err != nil {
+			t.Errorf("Could not mkdir: %v", err)
+		} else {
+			dirNode, ok := node.(*Dir)
+			if !ok {
+				t.Error("Could not convert returned node to Dir")
+			} else {
+				if dirNode.mountPoint != testMount || dirNode.store == nil || dirNode.storageSystem == nil {
+					t.Error("Required fields of dir not populated")
+				}
+				// path should contain the name we created
+				found := false
+				for _, tag := range dirNode.path {
+					if tag.Text == condition.name {
+						found = true
+						break
+					}
+				}
+				if !found {
+					t.Errorf("Dir returned from mkdir should include %s", condition.name)
+				}
+			}
+		}
+	}
+}
+
+// Verifies the lookup/mkdir sequence issued by mkdir -p creates a navigable chain, including when an intermediate tag
+// already exists but is not associated with the rest of the path.
+func TestDir_MkdirNested(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	db.AddTag(metaDb, "b", nil)
+	names := []string{"a", "b", "c"}
+	var dir fs.Node = &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	for _, name := range names {
+		node, err := dir.(*Dir).Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+		if err == fuse.ENOENT {
+			node, err = dir.(*Dir).Mkdir(nil, &fuse.MkdirRequest{Name: name})
+		}
+		if err != nil {
+			t.Errorf("Could not create %s: %v", name, err)
+			return
+		}
+		dir = node
+	}
+	// every prefix of the chain can now be navigated from the root
+	dir = &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	for _, name := range names {
+		node, err := dir.(*Dir).Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+		if err != nil {
+			t.Errorf("Could not look up %s: %v", name, err)
+			return
+		}
+		dir = node
+	}
+	if len(dir.(*Dir).path) != len(names) {
+		t.Errorf("Expected a path of %d tags but got %d", len(names), len(dir.(*Dir).path))
+	}
+}
+
+// Verifies that in hierarchical mode mkdir creates sub-tags that are only listed under their parent.
+func TestDir_MkdirHierarchical(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	options := Options{Hierarchical: true}
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys, options: options}
+	photos, err := root.Mkdir(nil, &fuse.MkdirRequest{Name: "photos"})
+	if err != nil {
+		t.Errorf("Could not create photos: %v", err)
+		return
+	}
+	if _, err = photos.(*Dir).Mkdir(nil, &fuse.MkdirRequest{Name: "2019"}); err != nil {
+		t.Errorf("Could not create 2019: %v", err)
+		return
+	}
+	year, _ := db.FindTag(metaDb, "2019")
+	conditions := []struct {
+		dir          *Dir
+		expectedDirs []string
+	}{
+		{root, []string{"photos"}},
+		{photos.(*Dir), []string{"2019"}},
+		{root.childDir([]metadata.TagInfo{year}, nil, nil), nil},
+	}
+	for _, condition := range conditions {
+		entries, err := condition.dir.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read directory: %v", err)
+			continue
+		}
+		var dirs []string
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				dirs = append(dirs, entry.Name)
+			}
+		}
+		if len(dirs) != len(condition.expectedDirs) {
+			t.Errorf("Expected dirs %v but found %v", condition.expectedDirs, dirs)
+			continue
+		}
+		for i := range dirs {
+			if dirs[i] != condition.expectedDirs[i] {
+				t.Errorf("Expected dirs %v but found %v", condition.expectedDirs, dirs)
+			}
+		}
+	}
+	if _, err = root.Lookup(nil, &fuse.LookupRequest{Name: "2019"}, nil); err != nil {
+		t.Errorf("Expected sub-tag to be reachable from the root but got %v", err)
+	}
+	yearDir := root.childDir([]metadata.TagInfo{year}, nil, nil)
+	if _, err = yearDir.Lookup(nil, &fuse.LookupRequest{Name: "photos"}, nil); err != fuse.ENOENT {
+		t.Errorf("Expected parent not to be found under its child but got %v", err)
+	}
+}
+
+// Verifies remove handles tags correctly
+func TestDir_RemoveTag(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 3)
+	db.CreateFileInPath(metaDb, "singleTagFile", "path1", []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "multiTagFile", "path2", []metadata.TagInfo{tags[0][0], tags[1][1]})
+	conditions := []struct {
+		path           []metadata.TagInfo
+		name           string
+		expectedResult error
+	}{
+		{nil, tags[0][0].Text, fuse.Errno(syscall.ENOTEMPTY)},
+		{nil, tags[0][1].Text, nil},
+		{[]metadata.TagInfo{tags[0][2]}, tags[1][2].Text, nil},
+		{[]metadata.TagInfo{tags[0][2]}, "not there", fuse.ENOENT},
+		{nil, "still not there", fuse.ENOENT},
+		{nil, tags[1][1].Text, nil},
+	}
+	var deletedTags []string
+	for _, condition := range conditions {
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+		result := dir.Remove(nil, &fuse.RemoveRequest{Name: condition.name, Dir: true})
+		if result == nil {
+			deletedTags = append(deletedTags, condition.name)
+		}
+		if result != condition.expectedResult {
+			t.Errorf("Unexpected result when attempting to remove %s", condition.name)
+		}
+	}
+	remainingTags, _ := db.GetAllTags(metaDb)
+	for _, tag := range remainingTags {
+		for _, name := range deletedTags {
+			if tag.Text == name {
+				t.Errorf("Expected tag %s to have been deleted, but it abides.", name)
+			}
+		}
+	}
+}
+
+// Verifies tags can be removed from the root when recursive removal is enabled, moving orphaned files to the
+// uncategorized tag.
+func TestDir_RemoveTagRecursive(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	single, _ := db.CreateFileInPath(metaDb, "singleTagFile", "path1", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		options: Options{RecursiveRemove: true}}
+	err := root.Remove(nil, &fuse.RemoveRequest{Name: tags[0][0].Text, Dir: true})
+	if err != nil {
+		t.Errorf("Could not remove tag: %v", err)
+	}
+	if tag, _ := db.FindTag(metaDb, tags[0][0].Text); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected tag to be deleted")
+	}
+	fileTags, _ := db.GetTagsForFile(metaDb, single.Id)
+	if len(fileTags) != 1 || fileTags[0].Text != uncategorizedTag {
+		t.Errorf("Expected file to be moved to %s but it has %v", uncategorizedTag, fileTags)
+	}
+	// the uncategorized tag itself can't be removed while it holds orphaned files
+	err = root.Remove(nil, &fuse.RemoveRequest{Name: uncategorizedTag, Dir: true})
+	if err != fuse.Errno(syscall.ENOTEMPTY) {
+		t.Errorf("Expected removing %s to be refused but got %v", uncategorizedTag, err)
+	}
+}
+
+func TestDir_RemoveFile(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 3)
+	file1, _ := db.CreateFileInPath(metaDb, "singleTagFile", "path1", []metadata.TagInfo{tags[0][0]})
+	file2, _ := db.CreateFileInPath(metaDb, "multiTagFile", "path2", []metadata.TagInfo{tags[0][0], tags[1][1]})
+	fileCount := 3
+	nameBase := "baseFile"
+	for i := 0; i < fileCount; i++ {
+		db.CreateFileInPath(metaDb, fmt.Sprintf("%s%d", nameBase, i), fmt.Sprintf("pathx%d", i), []metadata.TagInfo{tags[0][0]})
+	}
+	conditions := []struct {
+		path           []metadata.TagInfo
+		name           string
+		expectedResult error
+	}{
+		{nil, file1.Name, fuse.ENOENT},
+		{[]metadata.TagInfo{tags[0][0]}, file1.Name, nil},
+		{[]metadata.TagInfo{tags[1][1]}, "notThere", fuse.ENOENT},
+		{[]metadata.TagInfo{tags[0][0]}, file2.Name, nil},
+		{[]metadata.TagInfo{tags[1][1]}, file2.Name, nil},
+		{[]metadata.TagInfo{tags[0][0]}, fmt.Sprintf("%s*", nameBase), nil},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+		result := dir.Remove(nil, &fuse.RemoveRequest{Name: condition.name, Dir: false})
+		if result != condition.expectedResult {
+			t.Errorf("Unexpected result when attempting to remove %s", condition.name)
+		}
+	}
+	// we should have removed everything; verify that we did
+	for i := 0; i < len(tags); i++ {
+		for j := 0; j < len(tags[i]); j++ {
+			files, err := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[i][j]}, "")
+			if err != nil {
+				t.Errorf("Error while looking for files with tag %s: %v", tags[i][j].Text, err)
+			} else {
+				if files != nil && len(files) > 0 {
+					t.Errorf("Expected tag %s to have 0 files. Found %d", tags[i][j].Text, len(files))
+				}
+			}
+
+		}
+	}
+}
+
+// Verifies tags in the path are not offered again and directories at the maximum depth have no sub-directories.
+func TestDir_NoCycles(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	photos, _ := db.AddTag(metaDb, "photos", nil)
+	year, _ := db.AddTag(metaDb, "2019", []metadata.TagInfo{photos})
+	beach, _ := db.AddTag(metaDb, "beach", []metadata.TagInfo{photos, year})
+	db.CreateFileInPath(metaDb, "sand.jpg", "path1", []metadata.TagInfo{photos, year, beach})
+	conditions := []struct {
+		path         []metadata.TagInfo
+		maxDepth     int
+		expectedDirs []string
+	}{
+		{[]metadata.TagInfo{photos}, 0, []string{"2019", "beach"}},
+		{[]metadata.TagInfo{photos, year}, 0, []string{"beach"}},
+		{[]metadata.TagInfo{photos, year, beach}, 0, nil},
+		{[]metadata.TagInfo{photos}, 2, []string{"2019", "beach"}},
+		{[]metadata.TagInfo{photos, year}, 2, nil},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: condition.path, storageSystem: storageSys,
+			options: Options{MaxDepth: condition.maxDepth}}
+		entries, _ := dir.ReadDirAll(nil)
+		var dirs []string
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				dirs = append(dirs, entry.Name)
+			}
+		}
+		if !reflect.DeepEqual(dirs, condition.expectedDirs) {
+			t.Errorf("Expected %v under %v but got %v", condition.expectedDirs, condition.path, dirs)
+		}
+		for _, name := range []string{"photos", "2019", "beach"} {
+			_, err := dir.Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+			expected := false
+			for _, dirName := range condition.expectedDirs {
+				expected = expected || dirName == name
+			}
+			if (err == nil) != expected {
+				t.Errorf("Expected lookup of %s under %v to succeed %v but got %v", name, condition.path, expected, err)
+			}
+		}
+		if _, err := dir.Lookup(nil, &fuse.LookupRequest{Name: "sand.jpg"}, nil); err != nil {
+			t.Errorf("Expected files to be found under %v but got %v", condition.path, err)
+		}
+	}
+}
+
+// Verifies dot-prefixed tags are left out of listings but still found by name when hidden.
+func TestDir_HideDotTags(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	photos, _ := db.AddTag(metaDb, "photos", nil)
+	raw, _ := db.AddTag(metaDb, ".raw", []metadata.TagInfo{photos})
+	db.CreateFileInPath(metaDb, "img.cr2", "path1", []metadata.TagInfo{photos, raw})
+	conditions := []struct {
+		hide         bool
+		expectedDirs []string
+	}{
+		{false, []string{".raw"}},
+		{true, nil},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: []metadata.TagInfo{photos},
+			storageSystem: storageSys, options: Options{HideDotTags: condition.hide}}
+		entries, _ := dir.ReadDirAll(nil)
+		var dirs []string
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				dirs = append(dirs, entry.Name)
+			}
+		}
+		if !reflect.DeepEqual(dirs, condition.expectedDirs) {
+			t.Errorf("Expected %v to be listed but got %v", condition.expectedDirs, dirs)
+		}
+		if _, err := dir.Lookup(nil, &fuse.LookupRequest{Name: ".raw"}, nil); err != nil {
+			t.Errorf("Expected .raw to be found by name but got %v", err)
+		}
+	}
+}
+
+// Verifies rm moves files to the trash when the trash is enabled.
+func TestDir_RemoveToTrash(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	file, _ := db.CreateFileInPath(metaDb, "removed", "path1", tags[0])
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0], storageSystem: storageSys,
+		options: Options{Trash: true}}
+	if err := dir.Remove(nil, &fuse.RemoveRequest{Name: file.Name}); err != nil {
+		t.Errorf("Could not remove %s: %v", file.Name, err)
+	}
+	trash, _ := db.FindTag(metaDb, db.TrashTag)
+	conditions := []struct {
+		tag           metadata.TagInfo
+		expectedFiles int
+	}{
+		{tags[0][0], 0},
+		{trash, 1},
+	}
+	for _, condition := range conditions {
+		files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{condition.tag}, "")
+		if len(files) != condition.expectedFiles {
+			t.Errorf("Expected %d files tagged %s but got %d", condition.expectedFiles, condition.tag.Text, len(files))
+		}
+	}
+	db.RestoreFile(metaDb, file.Id)
+	if files, _ := db.GetFilesWithTags(metaDb, tags[0], ""); len(files) != 1 {
+		t.Error("Expected the file to be restored")
+	}
+}
+
+// Verifies files sharing a name are listed, looked up and removed by their disambiguated names.
+func TestDir_DuplicateNames(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	first, _ := db.CreateFileInPath(metaDb, "IMG_0001.jpg", "path1", tags[0])
+	second, _ := db.CreateFileInPath(metaDb, "IMG_0001.jpg", "path2", tags[0])
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0], storageSystem: storageSys}
+	entries, _ := dir.ReadDirAll(nil)
+	var names []string
+	for _, entry := range entries {
+		if entry.Type == fuse.DT_File && !strings.HasSuffix(entry.Name, tagsSuffix) {
+			names = append(names, entry.Name)
+		}
+	}
+	expected := []string{fmt.Sprintf("IMG_0001 (%d).jpg", first.Id), fmt.Sprintf("IMG_0001 (%d).jpg", second.Id)}
+	if len(names) != 2 || names[0] != expected[0] || names[1] != expected[1] {
+		t.Errorf("Expected files to be listed as %v but got %v", expected, names)
+	}
+	conditions := []struct {
+		name       string
+		expectedId int64
+	}{
+		{expected[0], first.Id},
+		{expected[1], second.Id},
+		{expected[1] + tagsSuffix, second.Id},
+		{first.Name, metadata.UnknownFile.Id},
+		{"IMG_0001 (999).jpg", metadata.UnknownFile.Id},
+	}
+	for _, condition := range conditions {
+		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
+		var id = metadata.UnknownFile.Id
+		switch n := node.(type) {
+		case *File:
+			id = n.fileInfo.Id
+		case *TagsFile:
+			id = n.file.fileInfo.Id
+		}
+		if id != condition.expectedId {
+			t.Errorf("Expected %s to resolve to %d but got %d (%v)", condition.name, condition.expectedId, id, err)
+		}
+	}
+	if err := dir.Remove(nil, &fuse.RemoveRequest{Name: expected[1]}); err != nil {
+		t.Errorf("Could not remove %s: %v", expected[1], err)
+	}
+	files, _ := db.GetFilesWithTags(metaDb, tags[0], "")
+	if len(files) != 1 || files[0].Id != first.Id {
+		t.Errorf("Expected only file %d to keep the tag", first.Id)
+	}
+}
+
+// Verifies ids are split back out of disambiguated names.
+func TestSplitNameId(t *testing.T) {
+	conditions := []struct {
+		name        string
+		original    string
+		id          int64
+		expectSplit bool
+	}{
+		{"IMG_0001 (42).jpg", "IMG_0001.jpg", 42, true},
+		{"archive.tar (7).gz", "archive.tar.gz", 7, true},
+		{"README (3)", "README", 3, true},
+		{"IMG_0001.jpg", "", 0, false},
+		{"notes (draft).txt", "", 0, false},
+	}
+	for _, condition := range conditions {
+		original, id, ok := splitNameId(condition.name)
+		if ok != condition.expectSplit || original != condition.original || id != condition.id {
+			t.Errorf("Unexpected split of %s: %s, %d, %v", condition.name, original, id, ok)
+		}
+		if ok && nameWithId(metadata.FileInfo{Id: id, Name: original}) != condition.name {
+			t.Errorf("Expected %s to round trip", condition.name)
+		}
+	}
+}
+
+// Verifies mv renames tags and merges into existing ones.
+func TestDir_Rename(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 3)
+	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][1], tags[1][1]})
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	nested := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		path: []metadata.TagInfo{tags[0][1]}}
+	conditions := []struct {
+		dir           *Dir
+		newDir        fs.Node
+		oldName       string
+		newName       string
+		expectedError error
+	}{
+		{root, root, tags[0][0].Text, "renamedTop", nil},
+		{nested, nested, tags[1][1].Text, "renamedNested", nil},
+		{root, root, "notThere", "stillNotThere", fuse.ENOENT},
+		{nested, nested, file1.Name, "newFileName", fuse.EPERM},
+		{root, nested, tags[0][2].Text, "moved", fuse.EPERM},
+		{root, root, tags[2][2].Text, tags[2][1].Text, nil},
+	}
+	for _, condition := range conditions {
+		err := condition.dir.Rename(nil, &fuse.RenameRequest{OldName: condition.oldName, NewName: condition.newName},
+			condition.newDir)
+		if err != condition.expectedError {
+			t.Errorf("Unexpected result renaming %s to %s: %v", condition.oldName, condition.newName, err)
+		}
+		if err == nil {
+			tag, _ := db.GetTag(metaDb, condition.newName)
+			if tag.Id == metadata.UnknownTag.Id {
+				t.Errorf("Expected to find tag %s after rename", condition.newName)
+			}
+			tag, _ = db.GetTag(metaDb, condition.oldName)
+			if tag.Id != metadata.UnknownTag.Id {
+				t.Errorf("Expected tag %s to be gone after rename", condition.oldName)
+			}
+		}
+	}
+	// the file should still be reachable through the renamed tag
+	files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{{Text: "renamedNested"}}, "")
+	if len(files) != 1 || files[0].Id != file1.Id {
+		t.Error("Expected file to follow the renamed tag")
+	}
+}
+
+// Verifies mv to another tag directory retags files, including every file matching a wildcard.
+func TestDir_RenameMovesFiles(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 2)
+	for _, name := range []string{"IMG_1", "IMG_2", "IMG_3", "other"} {
+		db.CreateFileInPath(metaDb, name, "path1", []metadata.TagInfo{tags[0][0]})
+	}
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys}
+	source := root.childDir([]metadata.TagInfo{tags[0][0]}, nil, nil)
+	destination := root.childDir([]metadata.TagInfo{tags[0][1]}, nil, nil)
+	conditions := []struct {
+		newDir        fs.Node
+		oldName       string
+		newName       string
+		expectedError error
+	}{
+		{destination, "IMG_1", "IMG_1", nil},
+		{destination, "IMG_*", "IMG_*", nil},
+		{destination, "other", "renamed", fuse.EPERM},
+		{destination, "missing", "missing", fuse.ENOENT},
+		{destination, tags[1][0].Text, tags[1][0].Text, fuse.EPERM},
+		{root, "other", "other", fuse.EPERM},
+	}
+	for _, condition := range conditions {
+		err := source.Rename(nil, &fuse.RenameRequest{OldName: condition.oldName, NewName: condition.newName},
+			condition.newDir)
+		if err != condition.expectedError {
+			t.Errorf("Unexpected result moving %s: %v", condition.oldName, err)
+		}
+	}
+	if files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[0][1]}, ""); len(files) != 3 {
+		t.Errorf("Expected the 3 moved files in the destination but found %d", len(files))
+	}
+	files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[0][0]}, "")
+	if len(files) != 1 || files[0].Name != "other" {
+		t.Errorf("Expected only the file not moved to remain in the source but found %v", files)
+	}
+}
+
+// Verifies we can symlink within the filesystem
+func TestDir_Symlink(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 3)
+	file1, _ := db.CreateFileInPath(metaDb, "singleTagFile", fmt.Sprintf("%cblah", os.PathSeparator), []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "singleTagFile2", "path2", []metadata.TagInfo{tags[0][0]})
+	conditions := []struct {
+		path          []metadata.TagInfo
+		target        string
+		expectedName  string
+		expectedError error
+	}{
+		{nil, fmt.Sprintf("%s%c%s%c%s", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), "", fuse.EPERM},
+		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%c%s*", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), "", fuse.EPERM},
+		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%c%s", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), file1.Name, nil},
+		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%cnotThere", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator), "", fuse.ENOENT},
+		{[]metadata.TagInfo{tags[0][2]}, fmt.Sprintf("%s%c%s", file1.Path, os.PathSeparator, file1.Name), file1.Name, nil},
+		{[]metadata.TagInfo{tags[0][2]}, fmt.Sprintf("%croot%cSomeFile", os.PathSeparator, os.PathSeparator), "SomeFile", nil},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+
+		node, err := dir.Symlink(nil, &fuse.SymlinkRequest{Target: condition.target})
+		if condition.expectedError != nil && condition.expectedError != err {
+			t.Errorf("Unexpected error during link %v", err)
+		} else if condition.expectedError == nil {
+			fileNode, ok := node.(*File)
+			if !ok {
+				t.Error("Symlink should return a file")
+			}
+			if fileNode.fileInfo.Name != condition.expectedName {
+				t.Errorf("Expceted file to be named %s but found %s", condition.expectedName, fileNode.fileInfo.Name)
+			}
+		}
+	}
+}
+
+// Verifies linking a directory from outside the filesystem imports the files under it, tagged with its subdirectories.
+func TestDir_SymlinkDirectory(t *testing.T) {
+	metaDb, _ := getMockFixtures(t)
+	defer metaDb.Close()
+	base, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(base)
+	target := filepath.Join(base, "photos")
+	os.MkdirAll(filepath.Join(target, "beach", "2019"), 0755)
+	for _, name := range []string{"top.jpg", filepath.Join("beach", "sand.jpg"), filepath.Join("beach", "2019", "wave.jpg")} {
+		ioutil.WriteFile(filepath.Join(target, name), []byte(testContent), 0644)
+	}
+	tags := createTags(metaDb, 1, 1)
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0],
+		storageSystem: storage.LocalFileStorage{}}
+	node, err := dir.Symlink(nil, &fuse.SymlinkRequest{Target: target})
+	if err != nil {
+		t.Errorf("Could not link directory: %v", err)
+		return
+	}
+	if link, _ := node.(fs.NodeReadlinker).Readlink(nil, nil); link != target {
+		t.Errorf("Expected link to %s but got %s", target, link)
+	}
+	conditions := []struct {
+		tags          []string
+		expectedFiles int
+	}{
+		{[]string{"photos"}, 3},
+		{[]string{"photos", "beach"}, 2},
+		{[]string{"photos", "beach", "2019"}, 1},
+		{[]string{"beach", "2019"}, 1},
+	}
+	for _, condition := range conditions {
+		path := append([]metadata.TagInfo{}, tags[0]...)
+		for _, name := range condition.tags {
+			tag, _ := db.FindTag(metaDb, name)
+			path = append(path, tag)
+		}
+		files, _ := db.GetFilesWithTags(metaDb, path, "")
+		if len(files) != condition.expectedFiles {
+			t.Errorf("Expected %d files tagged %v but got %d", condition.expectedFiles, condition.tags, len(files))
+		}
+	}
+}
+
+// Verifies files created in a tag directory are stored in the inbox and tagged with the directory's tags.
+func TestDir_Create(t *testing.T) {
+	metaDb, _ := getMockFixtures(t)
+	defer metaDb.Close()
+	inbox, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create directory: %v", err)
+		return
+	}
+	defer os.RemoveAll(inbox)
+	tags := createTags(metaDb, 1, 1)
+	conditions := []struct {
+		path          []metadata.TagInfo
+		inbox         string
+		name          string
+		canceled      bool
+		expectedPath  string
+		expectedError error
+	}{
+		{tags[0], "", "new.txt", false, "", fuse.EPERM},
+		{nil, inbox, "new.txt", false, "", fuse.EPERM},
+		{tags[0], inbox, "new.txt", false, inbox, nil},
+		{tags[0], inbox, "new.txt", false, filepath.Join(inbox, "1"), nil},
+		// the file isn't left in the inbox when it can't be recorded
+		{tags[0], inbox, "unrecorded.txt", true, "", fuse.Errno(syscall.EINTR)},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: condition.path,
+			storageSystem: storage.LocalFileStorage{}, options: Options{Inbox: condition.inbox}}
+		req := &fuse.CreateRequest{Name: condition.name, Flags: fuse.OpenWriteOnly, Mode: 0644}
+		ctx, cancel := context.WithCancel(context.Background())
+		if condition.canceled {
+			cancel()
+		}
+		node, handle, err := dir.Create(ctx, req, &fuse.CreateResponse{})
+		cancel()
+		if err != condition.expectedError {
+			t.Errorf("Expected error %v but got %v", condition.expectedError, err)
+			continue
+		}
+		if err != nil {
+			if _, statErr := os.Stat(filepath.Join(inbox, condition.name)); !os.IsNotExist(statErr) {
+				t.Errorf("Expected %s not to be left in the inbox but got %v", condition.name, statErr)
+			}
+			continue
+		}
+		file := node.(*File)
+		if file.fileInfo.Path != condition.expectedPath {
+			t.Errorf("Expected file in %s but was in %s", condition.expectedPath, file.fileInfo.Path)
+		}
+		writeReq := &fuse.WriteRequest{Data: []byte(testContent)}
+		if err = handle.(fs.HandleWriter).Write(nil, writeReq, &fuse.WriteResponse{}); err != nil {
+			t.Errorf("Could not write file: %v", err)
+		}
+		handle.(fs.HandleReleaser).Release(nil, nil)
+		if content, _ := ioutil.ReadFile(file.absolutePath()); string(content) != testContent {
+			t.Errorf("Expected file to contain %s but got %s", testContent, content)
+		}
+		if files, _ := db.GetFilesWithTags(metaDb, condition.path, condition.name); len(files) == 0 {
+			t.Errorf("Expected the created file to be tagged %v", condition.path)
+		}
+	}
+}
+
+// Verifies neither the file nor its record are left behind when the permissions of a created file can't be set.
+func TestDir_CreatePermissionsFailed(t *testing.T) {
+	metaDb, _ := getMockFixtures(t)
+	defer metaDb.Close()
+	inbox, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create directory: %v", err)
+	}
+	defer os.RemoveAll(inbox)
+	tags := createTags(metaDb, 1, 1)
+	_, err = metaDb.Exec("CREATE TRIGGER refuse_mode BEFORE UPDATE OF mode ON file_md BEGIN " +
+		"SELECT RAISE(ABORT, 'refused'); END")
+	if err != nil {
+		t.Fatalf("Could not create trigger: %v", err)
+	}
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, path: tags[0],
+		storageSystem: storage.LocalFileStorage{}, options: Options{Inbox: inbox, Permissions: true}}
+	req := &fuse.CreateRequest{Name: "new.txt", Flags: fuse.OpenWriteOnly, Mode: 0644}
+	if _, _, err = dir.Create(context.Background(), req, &fuse.CreateResponse{}); err == nil {
+		t.Fatal("Expected creating the file to fail")
+	}
+	if _, err = os.Stat(filepath.Join(inbox, req.Name)); !os.IsNotExist(err) {
+		t.Errorf("Expected %s not to be left in the inbox but got %v", req.Name, err)
+	}
+	if files, _ := db.GetFilesWithTags(metaDb, tags[0], req.Name); len(files) != 0 {
+		t.Errorf("Expected no record of %s to be left but got %v", req.Name, files)
+	}
+}
+
+// Verifies writing the tags attribute replaces the tags on a file.
+func TestFile_Setxattr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	file := &File{fileInfo: file1, store: db.NewSQLiteStore(metaDb), storage: storageSys}
+	conditions := []struct {
+		name          string
+		value         string
+		expectedError error
+		expectedTags  []string
+	}{
+		{tagsXattr, fmt.Sprintf("%s, newTag\nnewTag", tags[0][0].Text), nil, []string{tags[0][0].Text, "newTag"}},
+		{tagsXattr, "", fuse.EPERM, []string{tags[0][0].Text, "newTag"}},
+		{tagsXattr, fmt.Sprintf("bad%cname", os.PathSeparator), fuse.Errno(syscall.EINVAL), []string{tags[0][0].Text, "newTag"}},
+		{"user.other", "whatever", fuse.ENOTSUP, []string{tags[0][0].Text, "newTag"}},
+	}
+	for _, condition := range conditions {
+		err := file.Setxattr(nil, &fuse.SetxattrRequest{Name: condition.name, Xattr: []byte(condition.value)})
+		if err != condition.expectedError {
+			t.Errorf("Unexpected result setting %s to %q: %v", condition.name, condition.value, err)
+		}
+		var expectedTags []metadata.TagInfo
+		for _, name := range condition.expectedTags {
+			expectedTags = append(expectedTags, metadata.TagInfo{Text: name})
+		}
+		files, _ := db.GetFilesWithTags(metaDb, expectedTags, file1.Name)
+		if len(files) != 1 {
+			t.Errorf("Expected file to be tagged with %v", condition.expectedTags)
+		}
+	}
+	// the removed tag should no longer apply and the new tag should co-occur with the kept one
+	files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[1][0]}, "")
+	if len(files) != 0 {
+		t.Errorf("Expected tag %s to be removed from the file", tags[1][0].Text)
+	}
+	coincident, _ := db.GetCoincidentTag(metaDb, "newTag", tags[0][0].Text)
+	if coincident.Id == metadata.UnknownTag.Id {
+		t.Error("Expected new tag to co-occur with existing tag")
+	}
+	if err := file.Removexattr(nil, &fuse.RemovexattrRequest{Name: tagsXattr}); err != fuse.EPERM {
+		t.Errorf("Expected removing the tags attribute to be rejected but got %v", err)
+	}
+}
+
+// Verifies attributes are reported from the database when cached attributes are enabled.
+func TestFile_CachedAttrs(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	// the mock storage fails to stat these files as if the disk were offline
+	recorded, _ := db.CreateFileInPath(metaDb, "recorded", "ERROR", tags[0])
+	unrecorded, _ := db.CreateFileInPath(metaDb, "unrecorded", "ERROR", tags[0])
+	modTime := time.Unix(1563100000, 0)
+	db.SetFileStat(metaDb, recorded.Id, 1234, modTime)
+	conditions := []struct {
+		info         metadata.FileInfo
+		cached       bool
+		shouldError  bool
+		expectedSize uint64
+	}{
+		{recorded, true, false, 1234},
+		{recorded, false, true, 0},
+		{unrecorded, true, true, 0},
+	}
+	for _, condition := range conditions {
+		file := &File{fileInfo: condition.info, store: db.NewSQLiteStore(metaDb), storage: storageSys,
+			options: Options{CachedAttrs: condition.cached}}
+		attr := fuse.Attr{}
+		err := file.Attr(nil, &attr)
+		if (err != nil) != condition.shouldError {
+			t.Errorf("Expected error %v for %s but got %v", condition.shouldError, condition.info.Name, err)
+		}
+		if err == nil && (attr.Size != condition.expectedSize || !attr.Mtime.Equal(modTime)) {
+			t.Errorf("Expected size %d modified %v but got %d %v", condition.expectedSize, modTime, attr.Size,
+				attr.Mtime)
+		}
+	}
+}
+
+// Verifies the tags of a file are reported as an attribute, and its location on disk as a read-only one.
+func TestFile_Getxattr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	info, _ := db.CreateFileInPath(metaDb, "movie.mkv", filepath.Join("videos", "2019"), tags[0])
+	file := &File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys}
+	conditions := []struct {
+		name          string
+		expectedValue string
+		expectedError error
+	}{
+		{sourceXattr, filepath.Join("videos", "2019", "movie.mkv"), nil},
+		{tagsXattr, tags[0][0].Text, nil},
+		{"user.other", "", fuse.ErrNoXattr},
+	}
+	for _, condition := range conditions {
+		resp := &fuse.GetxattrResponse{}
+		err := file.Getxattr(nil, &fuse.GetxattrRequest{Name: condition.name}, resp)
+		if err != condition.expectedError || string(resp.Xattr) != condition.expectedValue {
+			t.Errorf("Expected %s to be %q (%v) but got %q (%v)", condition.name, condition.expectedValue,
+				condition.expectedError, resp.Xattr, err)
+		}
+	}
+	list := &fuse.ListxattrResponse{}
+	file.Listxattr(nil, &fuse.ListxattrRequest{}, list)
+	if expected := tagsXattr + "\x00" + sourceXattr + "\x00"; string(list.Xattr) != expected {
+		t.Errorf("Expected %q to be listed but got %q", expected, list.Xattr)
+	}
+	if err := file.Setxattr(nil, &fuse.SetxattrRequest{Name: sourceXattr, Xattr: []byte("elsewhere")}); err != fuse.EPERM {
+		t.Errorf("Expected setting the source attribute to be rejected but got %v", err)
+	}
+	if err := file.Removexattr(nil, &fuse.RemovexattrRequest{Name: sourceXattr}); err != fuse.EPERM {
+		t.Errorf("Expected removing the source attribute to be rejected but got %v", err)
+	}
+}
+
+// Verifies the rating of a file can be set, read, listed and cleared as an extended attribute.
+func TestFile_RatingXattr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	info, _ := db.CreateFileInPath(metaDb, "song.mp3", "music", tags[0])
+	file := &File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys}
+	conditions := []struct {
+		value       string
+		expectedErr error
+		expected    string
+	}{
+		{"4", nil, "4"},
+		{"6", fuse.Errno(syscall.EINVAL), "4"},
+		{"great", fuse.Errno(syscall.EINVAL), "4"},
+		{"5\n", nil, "5"},
+		{"0", nil, ""},
+	}
+	for _, condition := range conditions {
+		err := file.Setxattr(nil, &fuse.SetxattrRequest{Name: ratingXattr, Xattr: []byte(condition.value)})
+		if err != condition.expectedErr {
+			t.Errorf("Expected %v rating %q but got %v", condition.expectedErr, condition.value, err)
+		}
+		resp := &fuse.GetxattrResponse{}
+		file.Getxattr(nil, &fuse.GetxattrRequest{Name: ratingXattr}, resp)
+		if string(resp.Xattr) != condition.expected {
+			t.Errorf("Expected rating %q after %q but got %q", condition.expected, condition.value, resp.Xattr)
+		}
+	}
+	file.Setxattr(nil, &fuse.SetxattrRequest{Name: ratingXattr, Xattr: []byte("3")})
+	list := &fuse.ListxattrResponse{}
+	file.Listxattr(nil, &fuse.ListxattrRequest{}, list)
+	if expected := tagsXattr + "\x00" + sourceXattr + "\x00" + ratingXattr + "\x00"; string(list.Xattr) != expected {
+		t.Errorf("Expected %q to be listed but got %q", expected, list.Xattr)
+	}
+	if err := file.Removexattr(nil, &fuse.RemovexattrRequest{Name: ratingXattr}); err != nil {
+		t.Errorf("Could not clear the rating: %v", err)
+	}
+	err := file.Getxattr(nil, &fuse.GetxattrRequest{Name: ratingXattr}, &fuse.GetxattrResponse{})
+	if err != fuse.ErrNoXattr {
+		t.Errorf("Expected the rating to be cleared but got %v", err)
+	}
+}
+
+// Verifies the key=value attributes of a file can be set, read, listed and removed as extended attributes.
+func TestFile_AttributeXattrs(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	info, _ := db.CreateFileInPath(metaDb, "photo.jpg", "photos", tags[0])
+	file := &File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys}
+	conditions := []struct {
+		name        string
+		value       string
+		expectedErr error
+	}{
+		{attrXattrPrefix + "year", "2019", nil},
+		{attrXattrPrefix + "camera", "Nikon", nil},
+		{attrXattrPrefix + "year", "2020", nil},
+		{attrXattrPrefix + "a=b", "c", fuse.Errno(syscall.EINVAL)},
+		{attrXattrPrefix, "empty", fuse.Errno(syscall.EINVAL)},
+	}
+	for _, condition := range conditions {
+		err := file.Setxattr(nil, &fuse.SetxattrRequest{Name: condition.name, Xattr: []byte(condition.value)})
+		if err != condition.expectedErr {
+			t.Errorf("Expected %v setting %s but got %v", condition.expectedErr, condition.name, err)
+		}
+	}
+	resp := &fuse.GetxattrResponse{}
+	if err := file.Getxattr(nil, &fuse.GetxattrRequest{Name: attrXattrPrefix + "year"}, resp); err != nil ||
+		string(resp.Xattr) != "2020" {
+		t.Errorf("Expected the year to be replaced but got %q (%v)", resp.Xattr, err)
+	}
+	list := &fuse.ListxattrResponse{}
+	file.Listxattr(nil, &fuse.ListxattrRequest{}, list)
+	expected := tagsXattr + "\x00" + sourceXattr + "\x00" + attrXattrPrefix + "camera\x00" + attrXattrPrefix + "year\x00"
+	if string(list.Xattr) != expected {
+		t.Errorf("Expected %q to be listed but got %q", expected, list.Xattr)
+	}
+	if err := file.Removexattr(nil, &fuse.RemovexattrRequest{Name: attrXattrPrefix + "camera"}); err != nil {
+		t.Errorf("Could not remove attribute: %v", err)
+	}
+	if err := file.Removexattr(nil, &fuse.RemovexattrRequest{Name: attrXattrPrefix + "camera"}); err != fuse.ErrNoXattr {
+		t.Errorf("Expected the attribute to be gone but got %v", err)
+	}
+	if err := file.Getxattr(nil, &fuse.GetxattrRequest{Name: attrXattrPrefix + "camera"},
+		&fuse.GetxattrResponse{}); err != fuse.ErrNoXattr {
+		t.Errorf("Expected the removed attribute to be gone but got %v", err)
+	}
+}
+
+// Verifies tag lists are split on commas and newlines without blanks or duplicates.
+func TestParseTagList(t *testing.T) {
+	conditions := []struct {
+		value    string
+		expected []string
+	}{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a,b\nc", []string{"a", "b", "c"}},
+		{" a , ,a,\n b ", []string{"a", "b"}},
+	}
+	for _, condition := range conditions {
+		result := parseTagList(condition.value)
+		if len(result) != len(condition.expected) {
+			t.Errorf("Expected %d tags from %q but got %d", len(condition.expected), condition.value, len(result))
+			continue
+		}
+		for i, name := range result {
+			if name != condition.expected[i] {
+				t.Errorf("Expected tag %d of %q to be %s but got %s", i, condition.value, condition.expected[i], name)
+			}
+		}
+	}
+}
+
+// Verifies file attributes are read through the storage system.
+func TestFile_Attr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	twoTagFile, _ := db.CreateFileInPath(metaDb, "someName", "somePath", flatten(tags))
+	conditions := []struct {
+		file          *File
+		expectedLinks uint32
+		shouldError   bool
+	}{
+		{&File{fileInfo: twoTagFile, store: db.NewSQLiteStore(metaDb), storage: storageSys}, 2, false},
+		{&File{fileInfo: twoTagFile, store: db.NewSQLiteStore(metaDb), storage: storageSys, newSymlink: true}, 2, false},
+		{&File{fileInfo: metadata.FileInfo{Name: "thisWillERROR"}, store: db.NewSQLiteStore(metaDb), storage: storageSys},
+			0, true},
+	}
+	for _, condition := range conditions {
+		attr := &fuse.Attr{}
+		err := condition.file.Attr(nil, attr)
+		if (err != nil) != condition.shouldError {
+			t.Errorf("Unexpected error state getting attributes of %s: %v", condition.file.fileInfo.Name, err)
+		} else if err == nil {
+			if attr.Size != uint64(len(testContent)) {
+				t.Errorf("Expected size %d but got %d", len(testContent), attr.Size)
+			}
+			if condition.file.newSymlink != (attr.Mode&os.ModeSymlink != 0) {
+				t.Errorf("Unexpected mode %v for %s", attr.Mode, condition.file.fileInfo.Name)
+			}
+			if attr.Nlink != condition.expectedLinks {
+				t.Errorf("Expected %d links but got %d", condition.expectedLinks, attr.Nlink)
+			}
+		}
+	}
+}
+
+// Verifies files are presented as symlinks to their location on disk when enabled.
+func TestFile_Symlinks(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	info, _ := db.CreateFileInPath(metaDb, "someName", "somePath", tags[0])
+	target := fmt.Sprintf("%s%c%s", info.Path, os.PathSeparator, info.Name)
+	file := &File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys, options: Options{Symlinks: true}}
+	// the target isn't stat'ed, so a link to a file the storage fails to stat still has attributes
+	unreachable, _ := db.CreateFileInPath(metaDb, "ERROR", "somePath", tags[0])
+	for _, linked := range []*File{file, {fileInfo: unreachable, store: db.NewSQLiteStore(metaDb), storage: storageSys,
+		options: Options{Symlinks: true}}} {
+		attr := &fuse.Attr{}
+		target := fmt.Sprintf("%s%c%s", linked.fileInfo.Path, os.PathSeparator, linked.fileInfo.Name)
+		if err := linked.Attr(nil, attr); err != nil {
+			t.Errorf("Could not get attributes of %s: %v", linked.fileInfo.Name, err)
+		} else if attr.Mode&os.ModeSymlink == 0 || attr.Size != uint64(len(target)) || attr.Nlink != 1 {
+			t.Errorf("Expected a symlink of size %d with a link but got mode %v, size %d and %d links", len(target),
+				attr.Mode, attr.Size, attr.Nlink)
+		}
+	}
+	link, err := file.Readlink(nil, &fuse.ReadlinkRequest{})
+	if err != nil || link != target {
+		t.Errorf("Expected link to %s but got %s: %v", target, link, err)
+	}
+	dir := &Dir{store: db.NewSQLiteStore(metaDb), path: tags[0], storageSystem: storageSys,
+		options: Options{Symlinks: true}}
+	entries, _ := dir.ReadDirAll(nil)
+	for _, entry := range entries {
+		if entry.Name == info.Name && entry.Type != fuse.DT_Link {
+			t.Errorf("Expected %s to be listed as a link", entry.Name)
+		}
+	}
+}
+
+// Verifies directories report a link count of 1 whatever their sub-directories, without querying them.
+func TestDir_Attr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 2)
+	paths := [][]metadata.TagInfo{
+		nil,
+		{tags[0][0]},
+		{tags[0][0], tags[1][0]},
+		{tags[0][0], tags[1][0], tags[2][0]},
+	}
+	// the sub-directories aren't counted, so the attributes don't need the database
+	metaDb.Close()
+	for _, path := range paths {
+		dir := &Dir{store: db.NewSQLiteStore(metaDb), path: path, storageSystem: storageSys}
+		attr := &fuse.Attr{}
+		if err := dir.Attr(nil, attr); err != nil {
+			t.Errorf("Could not get directory attributes: %v", err)
+		} else if attr.Nlink != 1 {
+			t.Errorf("Expected 1 link but got %d", attr.Nlink)
+		} else if !attr.Mode.IsDir() {
+			t.Error("Expected a directory mode")
+		}
+	}
+}
+
+// Verifies files can only be opened for writing when write-through is enabled.
+func TestFile_OpenForWrite(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	conditions := []struct {
+		flags        fuse.OpenFlags
+		writeThrough bool
+		expectedErr  error
+	}{
+		{fuse.OpenReadOnly, false, nil},
+		{fuse.OpenWriteOnly, false, fuse.Errno(syscall.EROFS)},
+		{fuse.OpenReadWrite, false, fuse.Errno(syscall.EROFS)},
+		{fuse.OpenWriteOnly, true, nil},
+		{fuse.OpenReadWrite | fuse.OpenTruncate, true, nil},
+	}
+	for _, condition := range conditions {
+		file := &File{
+			fileInfo: metadata.FileInfo{Name: "someName", Path: "somePath"},
+			storage:  storageSys,
+			options:  Options{WriteThrough: condition.writeThrough},
+		}
+		handle, err := file.Open(nil, &fuse.OpenRequest{Flags: condition.flags}, &fuse.OpenResponse{})
+		if err != condition.expectedErr {
+			t.Errorf("Expected error %v opening with flags %v but got %v", condition.expectedErr, condition.flags, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		resp := &fuse.WriteResponse{}
+		err = handle.(*FileHandle).Write(nil, &fuse.WriteRequest{Data: []byte(testContent), Offset: 2}, resp)
+		if condition.flags.IsReadOnly() {
+			if err == nil {
+				t.Error("Expected write to a read-only handle to fail")
+			}
+		} else if err != nil || resp.Size != len(testContent) {
+			t.Errorf("Expected to write %d bytes but wrote %d: %v", len(testContent), resp.Size, err)
+		} else if err = handle.(*FileHandle).Flush(nil, &fuse.FlushRequest{}); err != nil {
+			t.Errorf("Could not flush file: %v", err)
+		}
+	}
+}
+
+// Verifies files can only be truncated when write-through is enabled.
+func TestFile_Setattr(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	conditions := []struct {
+		valid        fuse.SetattrValid
+		writeThrough bool
+		expectedErr  error
+	}{
+		{fuse.SetattrMtime, false, nil},
+		{fuse.SetattrSize, false, fuse.Errno(syscall.EROFS)},
+		{fuse.SetattrSize, true, nil},
+	}
+	for _, condition := range conditions {
+		file := &File{
+			fileInfo: metadata.FileInfo{Name: "someName", Path: "somePath"},
+			store:    db.NewSQLiteStore(metaDb),
+			storage:  storageSys,
+			options:  Options{WriteThrough: condition.writeThrough},
+		}
+		resp := &fuse.SetattrResponse{}
+		err := file.Setattr(nil, &fuse.SetattrRequest{Valid: condition.valid}, resp)
+		if err != condition.expectedErr {
+			t.Errorf("Expected error %v setting attributes %v but got %v", condition.expectedErr, condition.valid, err)
+		} else if err == nil && resp.Attr.Size != uint64(len(testContent)) {
+			t.Error("Expected the attributes of the file to be returned")
+		}
+	}
+}
+
+// Verifies that with permissions enabled new tags are owned by their creator and chmod/chown are recorded.
+func TestPermissions(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
-	tags := createTags(metaDb, 3, 3)
-	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][1]})
+	options := Options{Permissions: true}
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys, options: options}
+	mkdir := &fuse.MkdirRequest{Name: "private", Mode: os.ModeDir | 0777, Umask: 0027}
+	mkdir.Uid = 1000
+	mkdir.Gid = 100
+	node, err := root.Mkdir(nil, mkdir)
+	if err != nil {
+		t.Errorf("Could not create tag: %v", err)
+		return
+	}
+	dir := node.(*Dir)
+	file, _ := db.CreateFileInPath(metaDb, "someName", "somePath", dir.path)
+	fileNode := dir.fileNode(file)
 	conditions := []struct {
-		name         string
-		path         []metadata.TagInfo
-		expectedNode fs.Node
+		node         fs.NodeSetattrer
+		req          *fuse.SetattrRequest
+		expectedMode os.FileMode
+		expectedUid  uint32
+		expectedGid  uint32
 	}{
-		{file1.Name, []metadata.TagInfo{tags[0][1]}, &File{fileInfo: file1}},
-		{file1.Name, nil, nil},
-		{file1.Name, []metadata.TagInfo{tags[0][1], tags[1][1], tags[2][1]}, nil},
-		{"notThere", []metadata.TagInfo{tags[0][1]}, nil},
-		{tags[1][1].Text, []metadata.TagInfo{tags[0][1]}, &Dir{path: []metadata.TagInfo{tags[0][1], tags[1][1]}}},
+		{dir, &fuse.SetattrRequest{}, os.ModeDir | 0750, 1000, 100},
+		{dir, &fuse.SetattrRequest{Valid: fuse.SetattrMode, Mode: 0700}, os.ModeDir | 0700, 1000, 100},
+		{dir, &fuse.SetattrRequest{Valid: fuse.SetattrUid | fuse.SetattrGid, Uid: 1001, Gid: 101},
+			os.ModeDir | 0700, 1001, 101},
+		{fileNode, &fuse.SetattrRequest{Valid: fuse.SetattrMode | fuse.SetattrUid, Mode: 0600, Uid: 1001},
+			0600, 1001, 0},
 	}
-
 	for _, condition := range conditions {
-		// create the Directory
-		dir := &Dir{
-			database:      metaDb,
-			mountPoint:    testMount,
-			path:          condition.path,
-			storageSystem: storageSys,
+		resp := &fuse.SetattrResponse{}
+		if err := condition.node.Setattr(nil, condition.req, resp); err != nil {
+			t.Errorf("Could not set attributes: %v", err)
+			continue
 		}
-		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
-
-		if condition.expectedNode == nil {
-			if node != nil || err != fuse.ENOENT {
-				t.Errorf("Expected lookup of %s to give NOENT error", condition.name)
-			}
-		} else {
-			file, ok := node.(*File)
-			if ok {
-				//verify the required fields get populated
-				if file.storage == nil {
-					t.Error("Storage member of file struct was nil")
-				}
-				//if it's a file, check the file matches the info
-				expectedFile, ok := condition.expectedNode.(*File)
-				if !ok {
-					t.Error("Got a file node but didn't expect one")
-				}
-				if expectedFile.fileInfo.Name != file.fileInfo.Name {
-					t.Errorf("Expected lookup to find %s but got %s", expectedFile.fileInfo.Name, file.fileInfo.Name)
-				}
-			} else {
-				dir, ok := node.(*Dir)
-				if ok {
-					if dir.storageSystem == nil || dir.database == nil || dir.path == nil {
-						t.Error("Dir structure contained nil fields")
-					}
-					if dir.mountPoint != testMount {
-						t.Errorf("Expected dir to have %s as mountPoint but found %s", testMount, dir.mountPoint)
-					}
-					expectedDir, ok := condition.expectedNode.(*Dir)
-					if !ok {
-						t.Error("Got a dir node but didn't expect one")
-					}
-					if len(dir.path) != len(expectedDir.path) {
-						t.Errorf("Expected dir to have path of length %d but found %d", len(expectedDir.path), len(dir.path))
-					} else {
-						for _, expectedTag := range expectedDir.path {
-							found := false
-							for _, foundTag := range dir.path {
-								if foundTag.Id == expectedTag.Id {
-									found = true
-									break
-								}
-							}
-							if !found {
-								t.Errorf("The tag %s was missing in the dir path", expectedTag.Text)
-							}
-						}
-					}
-				}
+		attr := fuse.Attr{}
+		condition.node.(fs.Node).Attr(nil, &attr)
+		for _, a := range []fuse.Attr{resp.Attr, attr} {
+			if a.Mode != condition.expectedMode || a.Uid != condition.expectedUid || a.Gid != condition.expectedGid {
+				t.Errorf("Expected %v %d:%d but got %v %d:%d", condition.expectedMode, condition.expectedUid,
+					condition.expectedGid, a.Mode, a.Uid, a.Gid)
 			}
 		}
 	}
+	// without permissions enabled the stored owner and mode are ignored
+	plain := root.childDir(dir.path, nil, nil)
+	plain.options = Options{}
+	attr := fuse.Attr{}
+	if plain.Attr(nil, &attr); attr.Mode != os.ModeDir|0755 || attr.Uid != 0 {
+		t.Errorf("Expected the default attributes but got %v %d", attr.Mode, attr.Uid)
+	}
 }
 
-// Verifies mkdir creates tags
-func TestDir_Mkdir(t *testing.T) {
+// Verifies tags granted to some users, and the files carrying them, are hidden from other users.
+func TestUserViews(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
-	tags := createTags(metaDb, 1, 1)
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		options: Options{UserViews: true}}
+	shared, _ := db.AddTag(metaDb, "shared", nil)
+	secret, _ := db.AddTag(metaDb, "secret", []metadata.TagInfo{shared})
+	db.CreateFileInPath(metaDb, "public.txt", "somePath", []metadata.TagInfo{shared})
+	db.CreateFileInPath(metaDb, "private.txt", "somePath", []metadata.TagInfo{shared, secret})
+	if err := db.GrantTag(metaDb, secret, 1000); err != nil {
+		t.Errorf("Could not grant tag: %v", err)
+		return
+	}
 	conditions := []struct {
-		name string
-		path []metadata.TagInfo
+		uid           uint32
+		expectSecret  bool
+		expectedFiles int
 	}{
-		{"topLevelTag", nil},
-		{"nestedTag", tags[0]},
-		{tags[0][0].Text, tags[0]},
+		{0, true, 2},
+		{1000, true, 2},
+		{1001, false, 1},
 	}
 	for _, condition := range conditions {
-		dir := &Dir{
-			database:      metaDb,
-			mountPoint:    testMount,
-			path:          condition.path,
-			storageSystem: storageSys,
+		lookup := &fuse.LookupRequest{Name: "secret"}
+		lookup.Uid = condition.uid
+		if _, err := root.Lookup(nil, lookup, &fuse.LookupResponse{}); (err == nil) != condition.expectSecret {
+			t.Errorf("Expected secret to be found %v for %d but got %v", condition.expectSecret, condition.uid, err)
 		}
-		node, err := dir.Mkdir(nil, &fuse.MkdirRequest{Name: condition.name})
+		lookup = &fuse.LookupRequest{Name: "shared"}
+		lookup.Uid = condition.uid
+		node, err := root.Lookup(nil, lookup, &fuse.LookupResponse{})
 		if err != nil {
-			t.Errorf("Could not mkdir: %v", err)
-		} else {
-			dirNode, ok := node.(*Dir)
-			if !ok {
-				t.Error("Could not convert returned node to Dir")
-			} else {
-				if dirNode.mountPoint != testMount || dirNode.database == nil || dirNode.storageSystem == nil {
-					t.Error("Required fields of dir not populated")
-				}
-				// path should contain the name we created
-				found := false
-				for _, tag := range dirNode.path {
-					if tag.Text == condition.name {
-						found = true
-						break
-					}
-				}
-				if !found {
-					t.Errorf("Dir returned from mkdir should include %s", condition.name)
-				}
+			t.Errorf("Could not look up shared: %v", err)
+			continue
+		}
+		open := &fuse.OpenRequest{Dir: true}
+		open.Uid = condition.uid
+		handle, _ := node.(*Dir).Open(nil, open, &fuse.OpenResponse{})
+		entries, _ := handle.(fs.HandleReadDirAller).ReadDirAll(nil)
+		files, foundSecret := 0, false
+		for _, entry := range entries {
+			if entry.Type == fuse.DT_Dir {
+				foundSecret = foundSecret || entry.Name == "secret"
+			} else if !strings.HasSuffix(entry.Name, ".tags") {
+				files++
 			}
 		}
+		if foundSecret != condition.expectSecret || files != condition.expectedFiles {
+			t.Errorf("Expected secret listed %v with %d files for %d but got %v with %d", condition.expectSecret,
+				condition.expectedFiles, condition.uid, foundSecret, files)
+		}
 	}
 }
 
-// Verifies remove handles tags correctly
-func TestDir_RemoveTag(t *testing.T) {
+// Verifies the files carrying tags hidden from a user are left out of the virtual directories too.
+func TestUserViewsVirtualDirs(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
-	tags := createTags(metaDb, 3, 3)
-	db.CreateFileInPath(metaDb, "singleTagFile", "path1", []metadata.TagInfo{tags[0][0]})
-	db.CreateFileInPath(metaDb, "multiTagFile", "path2", []metadata.TagInfo{tags[0][0], tags[1][1]})
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState(), options: Options{UserViews: true}}
+	shared, _ := db.AddTag(metaDb, "shared", nil)
+	secret, _ := db.AddTag(metaDb, "secret", []metadata.TagInfo{shared})
+	uncategorized, _ := db.AddTag(metaDb, uncategorizedTag, nil)
+	public, _ := db.CreateFileInPath(metaDb, "public.txt", "somePath", []metadata.TagInfo{shared})
+	private, _ := db.CreateFileInPath(metaDb, "private.txt", "somePath", []metadata.TagInfo{shared, secret})
+	db.CreateFileInPath(metaDb, "draft.txt", "somePath", []metadata.TagInfo{uncategorized})
+	for _, file := range []metadata.FileInfo{public, private} {
+		db.SetFavorite(metaDb, file.Id, true)
+		db.SetFileModTime(metaDb, file.Id, time.Date(2023, 7, 14, 12, 0, 0, 0, time.Local))
+	}
+	db.SaveQuery(metaDb, metadata.SavedQuery{Name: "text", Pattern: "*.txt"})
+	for _, tag := range []metadata.TagInfo{secret, uncategorized} {
+		if err := db.GrantTag(metaDb, tag, 1000); err != nil {
+			t.Fatalf("Could not grant tag: %v", err)
+		}
+	}
 	conditions := []struct {
-		path           []metadata.TagInfo
-		name           string
-		expectedResult error
+		path     []string
+		uid      uint32
+		expected []string
 	}{
-		{nil, tags[0][0].Text, fuse.Errno(syscall.ENOTEMPTY)},
-		{nil, tags[0][1].Text, nil},
-		{[]metadata.TagInfo{tags[0][2]}, tags[1][2].Text, nil},
-		{[]metadata.TagInfo{tags[0][2]}, "not there", fuse.ENOENT},
-		{nil, "still not there", fuse.ENOENT},
-		{nil, tags[1][1].Text, nil},
+		{[]string{untaggedDirName}, 1000, []string{"draft.txt"}},
+		{[]string{untaggedDirName}, 1001, nil},
+		{[]string{favoritesDirName}, 1000, []string{"private.txt", "public.txt"}},
+		{[]string{favoritesDirName}, 1001, []string{"public.txt"}},
+		{[]string{dateDirName, "2023", "07", "14"}, 1000, []string{"private.txt", "public.txt"}},
+		{[]string{dateDirName, "2023", "07", "14"}, 1001, []string{"public.txt"}},
+		{[]string{savedQueriesDirName, "text"}, 1000, []string{"draft.txt", "private.txt", "public.txt"}},
+		{[]string{savedQueriesDirName, "text"}, 1001, []string{"public.txt"}},
+		{[]string{allDirName}, 1001, []string{"public.txt"}},
 	}
-	var deletedTags []string
 	for _, condition := range conditions {
-		dir := &Dir{
-			database:      metaDb,
-			mountPoint:    testMount,
-			path:          condition.path,
-			storageSystem: storageSys,
+		var node fs.Node = root
+		for _, name := range condition.path {
+			lookup := &fuse.LookupRequest{Name: name}
+			lookup.Uid = condition.uid
+			var err error
+			if node, err = node.(fs.NodeRequestLookuper).Lookup(nil, lookup, &fuse.LookupResponse{}); err != nil {
+				t.Fatalf("Could not look up %s of %v for %d: %v", name, condition.path, condition.uid, err)
+			}
 		}
-		result := dir.Remove(nil, &fuse.RemoveRequest{Name: condition.name, Dir: true})
-		if result == nil {
-			deletedTags = append(deletedTags, condition.name)
+		var handle fs.Handle = node
+		if opener, ok := node.(fs.NodeOpener); ok {
+			open := &fuse.OpenRequest{Dir: true}
+			open.Uid = condition.uid
+			handle, _ = opener.Open(nil, open, &fuse.OpenResponse{})
 		}
-		if result != condition.expectedResult {
-			t.Errorf("Unexpected result when attempting to remove %s", condition.name)
+		entries, err := handle.(fs.HandleReadDirAller).ReadDirAll(nil)
+		var names []string
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name, tagsSuffix) {
+				names = append(names, entry.Name)
+			}
 		}
-	}
-	remainingTags, _ := db.GetAllTags(metaDb)
-	for _, tag := range remainingTags {
-		for _, name := range deletedTags {
-			if tag.Text == name {
-				t.Errorf("Expected tag %s to have been deleted, but it abides.", name)
+		sort.Strings(names)
+		if err != nil || !reflect.DeepEqual(names, condition.expected) {
+			t.Errorf("Expected %v in %v for %d but got %v (%v)", condition.expected, condition.path, condition.uid,
+				names, err)
+		}
+		for _, name := range []string{"private.txt", "draft.txt"} {
+			lookup := &fuse.LookupRequest{Name: name}
+			lookup.Uid = condition.uid
+			_, err = node.(fs.NodeRequestLookuper).Lookup(nil, lookup, &fuse.LookupResponse{})
+			listed := sort.SearchStrings(names, name) < len(names) && names[sort.SearchStrings(names, name)] == name
+			if (err == nil) != listed {
+				t.Errorf("Expected %s to be found in %v for %d: %v but got %v", name, condition.path,
+					condition.uid, listed, err)
 			}
 		}
 	}
+	// files are looked up by id regardless of their tags, unless they are hidden
+	for _, uid := range []uint32{1000, 1001} {
+		ids, _ := root.Lookup(nil, &fuse.LookupRequest{Name: idDirName}, &fuse.LookupResponse{})
+		lookup := &fuse.LookupRequest{Name: strconv.FormatInt(private.Id, 10)}
+		lookup.Uid = uid
+		if _, err := ids.(*IdDir).Lookup(nil, lookup, &fuse.LookupResponse{}); (err == nil) != (uid == 1000) {
+			t.Errorf("Expected private.txt to be found by id for %d: %v but got %v", uid, uid == 1000, err)
+		}
+		lookup.Name = strconv.FormatInt(public.Id, 10)
+		if _, err := ids.(*IdDir).Lookup(nil, lookup, &fuse.LookupResponse{}); err != nil {
+			t.Errorf("Expected public.txt to be found by id for %d but got %v", uid, err)
+		}
+	}
 }
 
-func TestDir_RemoveFile(t *testing.T) {
+// Verifies the configured directory mode, file mode mask and owner are reported.
+func TestOwnershipMapping(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
-	tags := createTags(metaDb, 3, 3)
-	file1, _ := db.CreateFileInPath(metaDb, "singleTagFile", "path1", []metadata.TagInfo{tags[0][0]})
-	file2, _ := db.CreateFileInPath(metaDb, "multiTagFile", "path2", []metadata.TagInfo{tags[0][0], tags[1][1]})
-	fileCount := 3
-	nameBase := "baseFile"
-	for i := 0; i < fileCount; i++ {
-		db.CreateFileInPath(metaDb, fmt.Sprintf("%s%d", nameBase, i), fmt.Sprintf("pathx%d", i), []metadata.TagInfo{tags[0][0]})
-	}
+	tags := createTags(metaDb, 1, 1)
+	info, _ := db.CreateFileInPath(metaDb, "someName", "somePath", tags[0])
+	mapped := Options{DirMode: 0750, FileModeMask: 0055, OverrideOwner: true, Uid: 1000, Gid: 100}
 	conditions := []struct {
-		path           []metadata.TagInfo
-		name           string
-		expectedResult error
+		node         fs.Node
+		expectedMode os.FileMode
+		expectedUid  uint32
+		expectedGid  uint32
 	}{
-		{nil, file1.Name, fuse.ENOENT},
-		{[]metadata.TagInfo{tags[0][0]}, file1.Name, nil},
-		{[]metadata.TagInfo{tags[1][1]}, "notThere", fuse.ENOENT},
-		{[]metadata.TagInfo{tags[0][0]}, file2.Name, nil},
-		{[]metadata.TagInfo{tags[1][1]}, file2.Name, nil},
-		{[]metadata.TagInfo{tags[0][0]}, fmt.Sprintf("%s*", nameBase), nil},
+		{&Dir{store: db.NewSQLiteStore(metaDb), path: tags[0], storageSystem: storageSys}, os.ModeDir | 0755, 0, 0},
+		{&Dir{store: db.NewSQLiteStore(metaDb), path: tags[0], storageSystem: storageSys, options: mapped},
+			os.ModeDir | 0750, 1000, 100},
+		{&Dir{store: db.NewSQLiteStore(metaDb), storageSystem: storageSys, options: mapped}, os.ModeDir | 0750, 1000, 100},
+		{&QueryDir{store: db.NewSQLiteStore(metaDb), options: mapped}, os.ModeDir | 0750, 1000, 100},
+		{&File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys}, 0755, 0, 0},
+		{&File{fileInfo: info, store: db.NewSQLiteStore(metaDb), storage: storageSys, options: mapped}, 0700, 1000, 100},
 	}
 	for _, condition := range conditions {
-		dir := &Dir{
-			database:      metaDb,
-			mountPoint:    testMount,
-			path:          condition.path,
-			storageSystem: storageSys,
-		}
-		result := dir.Remove(nil, &fuse.RemoveRequest{Name: condition.name, Dir: false})
-		if result != condition.expectedResult {
-			t.Errorf("Unexpected result when attempting to remove %s", condition.name)
+		attr := fuse.Attr{}
+		if err := condition.node.Attr(nil, &attr); err != nil {
+			t.Errorf("Could not get attributes: %v", err)
 		}
-	}
-	// we should have removed everything; verify that we did
-	for i := 0; i < len(tags); i++ {
-		for j := 0; j < len(tags[i]); j++ {
-			files, err := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[i][j]}, "")
-			if err != nil {
-				t.Errorf("Error while looking for files with tag %s: %v", tags[i][j].Text, err)
-			} else {
-				if files != nil && len(files) > 0 {
-					t.Errorf("Expected tag %s to have 0 files. Found %d", tags[i][j].Text, len(files))
-				}
-			}
-
+		if attr.Mode != condition.expectedMode || attr.Uid != condition.expectedUid || attr.Gid != condition.expectedGid {
+			t.Errorf("Expected %v %d:%d but got %v %d:%d", condition.expectedMode, condition.expectedUid,
+				condition.expectedGid, attr.Mode, attr.Uid, attr.Gid)
 		}
 	}
 }
 
-// Verifies we can symlink within the filesystem
-func TestDir_Symlink(t *testing.T) {
+// Verifies fsync succeeds on files and directories and propagates storage errors when write-through is enabled.
+func TestFsync(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
-	tags := createTags(metaDb, 3, 3)
-	file1, _ := db.CreateFileInPath(metaDb, "singleTagFile", fmt.Sprintf("%cblah", os.PathSeparator), []metadata.TagInfo{tags[0][0]})
-	db.CreateFileInPath(metaDb, "singleTagFile2", "path2", []metadata.TagInfo{tags[0][0]})
 	conditions := []struct {
-		path          []metadata.TagInfo
-		target        string
-		expectedName  string
-		expectedError error
+		node        fs.NodeFsyncer
+		shouldError bool
 	}{
-		{nil, fmt.Sprintf("%s%c%s%c%s", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), "", fuse.EPERM},
-		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%c%s*", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), "", fuse.EPERM},
-		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%c%s", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator, file1.Name), file1.Name, nil},
-		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%s%c%s%cnotThere", testMount, os.PathSeparator, tags[0][0].Text, os.PathSeparator), "", fuse.ENOENT},
-		{[]metadata.TagInfo{tags[0][1]}, fmt.Sprintf("%croot%csomeDIR", os.PathSeparator, os.PathSeparator), "", fuse.EPERM},
-		{[]metadata.TagInfo{tags[0][2]}, fmt.Sprintf("%s%c%s", file1.Path, os.PathSeparator, file1.Name), file1.Name, nil},
-		{[]metadata.TagInfo{tags[0][2]}, fmt.Sprintf("%croot%cSomeFile", os.PathSeparator, os.PathSeparator), "SomeFile", nil},
+		{&Dir{store: db.NewSQLiteStore(metaDb), storageSystem: storageSys}, false},
+		{&File{fileInfo: metadata.FileInfo{Name: "someName"}, storage: storageSys}, false},
+		{&File{fileInfo: metadata.FileInfo{Name: "someName"}, storage: storageSys,
+			options: Options{WriteThrough: true}}, false},
+		{&File{fileInfo: metadata.FileInfo{Name: "thisWillERROR"}, storage: storageSys}, false},
+		{&File{fileInfo: metadata.FileInfo{Name: "thisWillERROR"}, storage: storageSys,
+			options: Options{WriteThrough: true}}, true},
+		{&TagsFile{file: &File{fileInfo: metadata.FileInfo{Name: "someName"}}}, false},
 	}
 	for _, condition := range conditions {
-		dir := &Dir{
-			database:      metaDb,
-			mountPoint:    testMount,
-			path:          condition.path,
-			storageSystem: storageSys,
-		}
-
-		node, err := dir.Symlink(nil, &fuse.SymlinkRequest{Target: condition.target})
-		if condition.expectedError != nil && condition.expectedError != err {
-			t.Errorf("Unexpected error during link %v", err)
-		} else if condition.expectedError == nil {
-			fileNode, ok := node.(*File)
-			if !ok {
-				t.Error("Symlink should return a file")
-			}
-			if fileNode.fileInfo.Name != condition.expectedName {
-				t.Errorf("Expceted file to be named %s but found %s", condition.expectedName, fileNode.fileInfo.Name)
-			}
+		err := condition.node.Fsync(nil, &fuse.FsyncRequest{})
+		if (err != nil) != condition.shouldError {
+			t.Errorf("Unexpected error state syncing %T: %v", condition.node, err)
 		}
 	}
 }
@@ -412,6 +2147,50 @@ func TestFile_Open(t *testing.T) {
 	}
 }
 
+// Verifies files kept elsewhere than on local disk are opened through the storage registered for their scheme.
+func TestFile_OpenBackends(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	var opened []string
+	filesys := New(Config{Store: db.NewSQLiteStore(metaDb), MountPoint: testMount, Storage: storageSys,
+		Backends: map[string]storage.Opener{"s3": func(location metadata.Location) (storage.FileStorage, error) {
+			return bucketStorage{bucket: location.Bucket, opened: &opened}, nil
+		}}})
+	conditions := []struct {
+		name        string
+		location    metadata.Location
+		expectedErr error
+		expected    string
+	}{
+		{"local.jpg", metadata.Location{}, nil, ""},
+		{"remote.jpg", metadata.Location{Scheme: "s3", Bucket: "photos"}, nil, "photos:/pics/remote.jpg"},
+		{"drive.jpg", metadata.Location{Scheme: "gdrive"}, fuse.Errno(syscall.ENXIO), ""},
+	}
+	for _, condition := range conditions {
+		info, _ := db.CreateFileInPath(metaDb, condition.name, "/pics", tags[0])
+		db.SetFileLocation(metaDb, info.Id, condition.location)
+		opened = nil
+		_, err := filesys.root.fileNode(info).Open(context.Background(), nil, nil)
+		if err != condition.expectedErr || strings.Join(opened, ",") != condition.expected {
+			t.Errorf("Expected %s to be opened from %q with %v but got %v from %q", condition.name,
+				condition.expected, condition.expectedErr, err, opened)
+		}
+	}
+}
+
+// Mock storage of a bucket recording the files opened in it.
+type bucketStorage struct {
+	MockFileStorage
+	bucket string
+	opened *[]string
+}
+
+func (b bucketStorage) Open(name string) (storage.File, error) {
+	*b.opened = append(*b.opened, b.bucket+":"+name)
+	return b.MockFileStorage.Open(name)
+}
+
 func TestFileHandle_Read(t *testing.T) {
 	metaDb, storageSys := getMockFixtures(t)
 	defer metaDb.Close()
@@ -419,23 +2198,35 @@ func TestFileHandle_Read(t *testing.T) {
 		fileInfo: metadata.FileInfo{Name: "someName", Path: "somePath"},
 		storage:  storageSys,
 	}
-	sizesToRead := []int{1, 5, 10, len(testContent), len(testContent) + 10}
+	conditions := []struct {
+		offset   int64
+		size     int
+		expected string
+	}{
+		{0, 1, testContent[:1]},
+		{0, 5, testContent[:5]},
+		{0, 10, testContent[:10]},
+		{0, len(testContent), testContent},
+		{0, len(testContent) + 10, testContent},
+		{5, 3, testContent[5:8]},
+		{5, len(testContent), testContent[5:]},
+		{int64(len(testContent)), 10, ""},
+		{int64(len(testContent)) + 10, 10, ""},
+	}
 
-	for _, size := range sizesToRead {
-		fh, _ := fileInfo.Open(nil, nil, nil)
-		fileHandle := fh.(*FileHandle)
+	fh, _ := fileInfo.Open(nil, nil, nil)
+	fileHandle := fh.(*FileHandle)
+	for _, condition := range conditions {
 		response := &fuse.ReadResponse{}
-		err := fileHandle.Read(nil, &fuse.ReadRequest{Size: size}, response)
+		err := fileHandle.Read(nil, &fuse.ReadRequest{Offset: condition.offset, Size: condition.size}, response)
 		if err != nil {
 			t.Errorf("Unexpected error reading file: %v", err)
 		}
 
-		if len(response.Data) != size {
-			t.Errorf("Expected data read to be %d bytes but was %d", size, len(response.Data))
+		if string(response.Data) != condition.expected {
+			t.Errorf("Expected to read %q at offset %d but got %q", condition.expected, condition.offset, response.Data)
 		}
-
 	}
-
 }
 
 // Verifies hard-linking works within the filesystem
@@ -456,7 +2247,7 @@ func TestDir_Link(t *testing.T) {
 	}
 	for _, condition := range conditions {
 		dir := &Dir{
-			database:      metaDb,
+			store:         db.NewSQLiteStore(metaDb),
 			mountPoint:    testMount,
 			path:          condition.path,
 			storageSystem: storageSys,
@@ -585,8 +2376,8 @@ func containsFile(entry fuse.Dirent, files []metadata.FileInfo) bool {
 	if files == nil {
 		return false
 	}
-	for _, node := range files {
-		if node.Name == entry.Name {
+	for _, name := range fileNames(files) {
+		if name == entry.Name {
 			return true
 		}
 	}
@@ -646,6 +2437,14 @@ func (MockFileStorage) Open(name string) (storage.File, error) {
 	}
 }
 
+func (s MockFileStorage) OpenFile(name string, flag int, perm os.FileMode) (storage.File, error) {
+	return s.Open(name)
+}
+
+func (MockFileStorage) MkdirAll(path string, perm os.FileMode) error { return nil }
+
+func (MockFileStorage) Remove(name string) error { return nil }
+
 func (MockFileStorage) Stat(name string) (os.FileInfo, error) {
 	if strings.Index(name, "ERROR") >= 0 {
 		return nil, errors.New("Generated error")
@@ -672,6 +2471,24 @@ func (MockFile) Read(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+func (MockFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(testContent)) {
+		return 0, io.EOF
+	}
+	n = copy(p, testContent[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (MockFile) WriteAt(p []byte, off int64) (n int, err error) {
+	return len(p), nil
+}
+
+func (MockFile) Truncate(size int64) error { return nil }
+func (MockFile) Sync() error               { return nil }
+
 // FileInfo methods
 func (MockFile) Size() int64 {
 	return int64(len(testContent))
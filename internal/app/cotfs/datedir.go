@@ -0,0 +1,130 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Name of the directory in the root of the mount listing files by date.
+const dateDirName = "by-date"
+
+// Number of date levels (year, month and day) above the files.
+const dateLevels = 3
+
+// DateDir is a read-only directory in the /by-date tree, which buckets files by their modification time into year,
+// month and day directories (e.g. /by-date/2023/07/14). Only the day directories list files.
+type DateDir struct {
+	root *Dir
+	// the year, month and day selected by the path, outermost first
+	date []string
+}
+
+var _ fs.Node = (*DateDir)(nil)
+
+func (d *DateDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, d.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&DateDir{})
+
+// Looks up the next date level or, within a day, a file by name.
+func (d *DateDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	root, err := d.root.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	d = &DateDir{root: root, date: d.date}
+	if len(d.date) < dateLevels {
+		dates, err := d.getDates(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, date := range dates {
+			if date == req.Name {
+				return &DateDir{root: d.root, date: append(append([]string{}, d.date...), date)}, nil
+			}
+		}
+		return nil, fuse.ENOENT
+	}
+	file, err := resolveFile(req.Name, d.fileFinder(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return nil, fuse.ENOENT
+	}
+	return d.root.fileNode(file), nil
+}
+
+var _ = fs.NodeOpener(&DateDir{})
+
+// Opens the directory for listing. With user views enabled, the handle is the view of the directory for the user
+// opening it.
+func (d *DateDir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	root, err := d.root.forUser(requestContext(ctx), req.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return &DateDir{root: root, date: d.date}, nil
+}
+
+var _ = fs.HandleReadDirAller(&DateDir{})
+
+// Lists the next date level or, within a day, the files modified that day.
+func (d *DateDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	var res []fuse.Dirent
+	if len(d.date) < dateLevels {
+		dates, err := d.getDates(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, date := range dates {
+			res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: date})
+		}
+		return res, nil
+	}
+	files, err := d.getFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range fileNames(files) {
+		res = append(res, fuse.Dirent{Name: name, Type: d.root.options.fileType()})
+	}
+	return res, nil
+}
+
+// Lists the dates of the next level below this directory. Stores that can't bucket files by date list none.
+func (d *DateDir) getDates(ctx context.Context) ([]string, error) {
+	dates, ok := d.root.store.(db.DateStore)
+	if !ok {
+		return nil, nil
+	}
+	return dates.GetFileDatesExcluding(ctx, d.date, d.root.hidden)
+}
+
+// Lists the files modified on the day of this directory that the user may see, optionally filtered by name.
+func (d *DateDir) getFiles(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	dates, ok := d.root.store.(db.DateStore)
+	if !ok {
+		return nil, nil
+	}
+	return dates.GetFilesByDateExcluding(ctx, d.date, d.root.hidden, name)
+}
+
+// Returns a function listing the files of the day, for resolving file names.
+func (d *DateDir) fileFinder(ctx context.Context) func(string) ([]metadata.FileInfo, error) {
+	return func(name string) ([]metadata.FileInfo, error) {
+		return d.getFiles(ctx, name)
+	}
+}
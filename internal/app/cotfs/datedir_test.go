@@ -0,0 +1,76 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"testing"
+	"time"
+)
+
+// Verifies the by-date tree lists years, months and days down to the files modified on each day.
+func TestDateDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	first, _ := db.CreateFileInPath(metaDb, "first", "path1", nil)
+	second, _ := db.CreateFileInPath(metaDb, "second", "path2", nil)
+	db.SetFileModTime(metaDb, first.Id, time.Date(2023, 7, 14, 12, 0, 0, 0, time.Local))
+	db.SetFileModTime(metaDb, second.Id, time.Date(2023, 8, 2, 12, 0, 0, 0, time.Local))
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	conditions := []struct {
+		path            []string
+		expectedEntries []string
+	}{
+		{[]string{dateDirName}, []string{"2023"}},
+		{[]string{dateDirName, "2023"}, []string{"07", "08"}},
+		{[]string{dateDirName, "2023", "07"}, []string{"14"}},
+		{[]string{dateDirName, "2023", "07", "14"}, []string{"first"}},
+		{[]string{dateDirName, "2023", "08", "02"}, []string{"second"}},
+	}
+	for _, condition := range conditions {
+		var node interface{} = root
+		for _, name := range condition.path {
+			var err error
+			switch dir := node.(type) {
+			case *Dir:
+				node, err = dir.Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+			case *DateDir:
+				node, err = dir.Lookup(nil, &fuse.LookupRequest{Name: name}, nil)
+			}
+			if err != nil {
+				t.Errorf("Could not look up %s in %v: %v", name, condition.path, err)
+				break
+			}
+		}
+		dateDir, ok := node.(*DateDir)
+		if !ok {
+			t.Errorf("Expected %v to be a date directory", condition.path)
+			continue
+		}
+		entries, err := dateDir.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read %v: %v", condition.path, err)
+		}
+		if len(entries) != len(condition.expectedEntries) {
+			t.Errorf("Expected %v in %v but found %v", condition.expectedEntries, condition.path, entries)
+			continue
+		}
+		for i, entry := range entries {
+			if entry.Name != condition.expectedEntries[i] {
+				t.Errorf("Expected %v in %v but found %v", condition.expectedEntries, condition.path, entries)
+			}
+		}
+	}
+	day := &DateDir{root: root, date: []string{"2023", "07", "14"}}
+	node, err := day.Lookup(nil, &fuse.LookupRequest{Name: "first"}, nil)
+	if file, ok := node.(*File); err != nil || !ok || file.fileInfo.Id != first.Id {
+		t.Errorf("Expected to find the file modified that day: %v", err)
+	}
+	if _, err := day.Lookup(nil, &fuse.LookupRequest{Name: "second"}, nil); err != fuse.ENOENT {
+		t.Errorf("Expected a file modified another day not to be found but got %v", err)
+	}
+	month := &DateDir{root: root, date: []string{"2023"}}
+	if _, err := month.Lookup(nil, &fuse.LookupRequest{Name: "09"}, nil); err != fuse.ENOENT {
+		t.Errorf("Expected a month without files not to be found but got %v", err)
+	}
+}
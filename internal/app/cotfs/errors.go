@@ -0,0 +1,61 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// SQLite error messages and the errno reported for them.
+var sqliteErrnos = []struct {
+	message string
+	errno   syscall.Errno
+}{
+	{"database is locked", syscall.EBUSY},
+	{"database table is locked", syscall.EBUSY},
+	{"constraint failed", syscall.EEXIST},
+	{"readonly database", syscall.EROFS},
+	{"database or disk is full", syscall.ENOSPC},
+}
+
+// Translates the errors of the metadata database and the backing storage into the errno reported to the kernel.
+// Errors that already carry an errno are returned as they are and unknown errors are left for the fuse library to
+// report as EIO.
+func toErrno(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(fuse.ErrorNumber); ok {
+		return err
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		if errno, ok := pathErr.Err.(syscall.Errno); ok {
+			// the storage reports the errno of the failed system call
+			return fuse.Errno(errno)
+		}
+	}
+	switch {
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		// the request was interrupted
+		return fuse.Errno(syscall.EINTR)
+	case err == db.ErrTagExists:
+		return fuse.EEXIST
+	case err == db.ErrTagCycle:
+		return fuse.Errno(syscall.EINVAL)
+	case os.IsNotExist(err):
+		return fuse.ENOENT
+	case os.IsExist(err):
+		return fuse.EEXIST
+	case os.IsPermission(err):
+		return fuse.Errno(syscall.EACCES)
+	}
+	for _, sqliteErrno := range sqliteErrnos {
+		if strings.Contains(err.Error(), sqliteErrno.message) {
+			return fuse.Errno(sqliteErrno.errno)
+		}
+	}
+	return err
+}
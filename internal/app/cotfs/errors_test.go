@@ -0,0 +1,42 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"errors"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"os"
+	"syscall"
+	"testing"
+)
+
+// Verifies database and storage errors are reported with a matching errno.
+func TestToErrno(t *testing.T) {
+	_, notFound := os.Stat("/notThere/really")
+	conditions := []struct {
+		err      error
+		expected error
+	}{
+		{nil, nil},
+		{fuse.ENOENT, fuse.ENOENT},
+		{fuse.Errno(syscall.EROFS), fuse.Errno(syscall.EROFS)},
+		{context.Canceled, fuse.Errno(syscall.EINTR)},
+		{db.ErrTagExists, fuse.EEXIST},
+		{db.ErrTagCycle, fuse.Errno(syscall.EINVAL)},
+		{notFound, fuse.ENOENT},
+		{&os.PathError{Op: "open", Path: "file", Err: syscall.EACCES}, fuse.Errno(syscall.EACCES)},
+		{os.ErrPermission, fuse.Errno(syscall.EACCES)},
+		{errors.New("database is locked"), fuse.Errno(syscall.EBUSY)},
+		{errors.New("UNIQUE constraint failed: tag.txt"), fuse.Errno(syscall.EEXIST)},
+		{errors.New("attempt to write a readonly database"), fuse.Errno(syscall.EROFS)},
+	}
+	for _, condition := range conditions {
+		if err := toErrno(condition.err); err != condition.expected {
+			t.Errorf("Expected %v to be reported as %v but got %v", condition.err, condition.expected, err)
+		}
+	}
+	unknown := errors.New("something else")
+	if err := toErrno(unknown); err != unknown {
+		t.Errorf("Expected unknown errors to be returned as they are but got %v", err)
+	}
+}
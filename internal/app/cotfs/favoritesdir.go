@@ -0,0 +1,140 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Name of the directory in the root of the mount listing the favorite files.
+const favoritesDirName = ".favorites"
+
+// FavoritesDir is the /.favorites directory, listing the files marked as favorites whatever their tags. Linking (ln) a
+// file into it marks the file as a favorite and removing (rm) one from it unmarks it; neither changes its tags.
+type FavoritesDir struct {
+	root *Dir
+}
+
+var _ fs.Node = (*FavoritesDir)(nil)
+
+func (f *FavoritesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, f.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&FavoritesDir{})
+
+// Looks up a favorite file by name.
+func (f *FavoritesDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	root, err := f.root.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	f = &FavoritesDir{root: root}
+	file, err := resolveFile(req.Name, f.fileFinder(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return nil, fuse.ENOENT
+	}
+	return f.root.fileNode(file), nil
+}
+
+var _ = fs.NodeOpener(&FavoritesDir{})
+
+// Opens the directory for listing. With user views enabled, the handle is the view of the directory for the user
+// opening it.
+func (f *FavoritesDir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	root, err := f.root.forUser(requestContext(ctx), req.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return &FavoritesDir{root: root}, nil
+}
+
+var _ = fs.HandleReadDirAller(&FavoritesDir{})
+
+// Lists the favorite files.
+func (f *FavoritesDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	files, err := f.getFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var res []fuse.Dirent
+	for _, name := range fileNames(files) {
+		res = append(res, fuse.Dirent{Name: name, Type: f.root.options.fileType()})
+	}
+	return res, nil
+}
+
+var _ = fs.NodeLinker(&FavoritesDir{})
+
+// Respond to ln by marking the file as a favorite. The file keeps its name regardless of the name of the link.
+func (f *FavoritesDir) Link(ctx context.Context, req *fuse.LinkRequest, old fs.Node) (_ fs.Node, err error) {
+	defer func() { err = toErrno(err) }()
+	file, ok := old.(*File)
+	if !ok {
+		return nil, fuse.EPERM
+	}
+	ratings, ok := f.root.store.(db.RatingStore)
+	if !ok {
+		return nil, fuse.ENOTSUP
+	}
+	if err = ratings.SetFavorite(requestContext(ctx), file.fileInfo.Id, true); err != nil {
+		return nil, err
+	}
+	return old, nil
+}
+
+var _ = fs.NodeRemover(&FavoritesDir{})
+
+// Respond to rm by no longer marking the file as a favorite.
+func (f *FavoritesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	if req.Dir {
+		return fuse.EPERM
+	}
+	ctx = requestContext(ctx)
+	root, err := f.root.forUser(ctx, req.Uid)
+	if err != nil {
+		return err
+	}
+	f = &FavoritesDir{root: root}
+	file, err := resolveFile(req.Name, f.fileFinder(ctx))
+	if err != nil {
+		return err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return fuse.ENOENT
+	}
+	ratings, ok := f.root.store.(db.RatingStore)
+	if !ok {
+		return fuse.ENOTSUP
+	}
+	return ratings.SetFavorite(ctx, file.Id, false)
+}
+
+// Lists the favorite files the user may see, optionally filtered by name. Stores without ratings list none.
+func (f *FavoritesDir) getFiles(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	ratings, ok := f.root.store.(db.RatingStore)
+	if !ok {
+		return nil, nil
+	}
+	return ratings.GetFavoriteFilesExcluding(requestContext(ctx), f.root.hidden, name)
+}
+
+// Returns a function listing the favorite files, for resolving file names.
+func (f *FavoritesDir) fileFinder(ctx context.Context) func(string) ([]metadata.FileInfo, error) {
+	return func(name string) ([]metadata.FileInfo, error) {
+		return f.getFiles(ctx, name)
+	}
+}
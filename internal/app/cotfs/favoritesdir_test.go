@@ -0,0 +1,57 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"testing"
+)
+
+// Verifies /.favorites lists the files linked into it until they are removed from it, leaving their tags alone.
+func TestFavoritesDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	first, _ := db.CreateFileInPath(metaDb, "first", "path1", tags[0])
+	second, _ := db.CreateFileInPath(metaDb, "second", "path2", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	node, err := root.Lookup(nil, &fuse.LookupRequest{Name: favoritesDirName}, nil)
+	favorites, ok := node.(*FavoritesDir)
+	if err != nil || !ok {
+		t.Errorf("Expected to find the favorites directory: %v", err)
+		return
+	}
+	conditions := []struct {
+		link        *File
+		remove      string
+		expectedErr error
+		expected    int
+	}{
+		{link: root.fileNode(first), expected: 1},
+		{link: root.fileNode(second), expected: 2},
+		{remove: "first", expected: 1},
+		{remove: "first", expectedErr: fuse.ENOENT, expected: 1},
+	}
+	for i, condition := range conditions {
+		if condition.link != nil {
+			_, err = favorites.Link(nil, &fuse.LinkRequest{NewName: "any"}, condition.link)
+		} else {
+			err = favorites.Remove(nil, &fuse.RemoveRequest{Name: condition.remove})
+		}
+		if err != condition.expectedErr {
+			t.Errorf("Expected %v for condition %d but got %v", condition.expectedErr, i, err)
+		}
+		if entries, _ := favorites.ReadDirAll(nil); len(entries) != condition.expected {
+			t.Errorf("Expected %d favorites after condition %d but found %v", condition.expected, i, entries)
+		}
+	}
+	if _, err = favorites.Lookup(nil, &fuse.LookupRequest{Name: "second"}, nil); err != nil {
+		t.Errorf("Expected to look up the favorite file but got %v", err)
+	}
+	if _, err = favorites.Link(nil, &fuse.LinkRequest{NewName: "dir"}, root); err != fuse.EPERM {
+		t.Errorf("Expected linking a directory to be rejected but got %v", err)
+	}
+	if files, _ := db.GetFilesWithTags(metaDb, tags[0], ""); len(files) != 2 {
+		t.Errorf("Expected the files to keep their tags but found %v", files)
+	}
+}
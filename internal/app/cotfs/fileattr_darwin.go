@@ -7,6 +7,10 @@ import (
 )
 
 func getCreateTime(stat os.FileInfo) time.Time {
-	sysStat := stat.Sys().(*syscall.Stat_t)
+	// storage systems other than the local disk may not expose the underlying stat structure
+	sysStat, ok := stat.Sys().(*syscall.Stat_t)
+	if !ok {
+		return stat.ModTime()
+	}
 	return time.Unix(int64(sysStat.Ctimespec.Sec), int64(sysStat.Ctimespec.Nsec))
 }
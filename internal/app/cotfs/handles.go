@@ -0,0 +1,75 @@
+package cotfs
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"sync"
+)
+
+// sharedStorage wraps a storage system so concurrent read-only opens of the same file share a single open file, which
+// is closed once the last handle to it is. Media players and thumbnailers tend to open the same file many times at once.
+// The shared files must be read with ReadAt since they share one offset; opens for writing are not shared.
+type sharedStorage struct {
+	storage.FileStorage
+	mu sync.Mutex
+	// open files by absolute path
+	files map[string]*sharedFile
+}
+
+type sharedFile struct {
+	storage.File
+	refs int
+}
+
+func newSharedStorage(backing storage.FileStorage) *sharedStorage {
+	return &sharedStorage{FileStorage: backing, files: make(map[string]*sharedFile)}
+}
+
+// Returns a handle to the open file if there is one, opening the file otherwise.
+func (s *sharedStorage) Open(name string) (storage.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shared, ok := s.files[name]
+	if !ok {
+		file, err := s.FileStorage.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedFile{File: file}
+		s.files[name] = shared
+	}
+	shared.refs++
+	return &sharedHandle{File: shared.File, storage: s, name: name}, nil
+}
+
+// Counts the number of distinct files open.
+func (s *sharedStorage) openFiles() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// sharedHandle is one reference to a shared file.
+type sharedHandle struct {
+	storage.File
+	storage *sharedStorage
+	name    string
+	// guarded by storage.mu
+	closed bool
+}
+
+// Drops the reference, closing the file if it was the last one. Closing a handle more than once has no effect.
+func (h *sharedHandle) Close() error {
+	s := h.storage
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	shared := s.files[h.name]
+	if shared.refs--; shared.refs > 0 {
+		return nil
+	}
+	delete(s.files, h.name)
+	return shared.File.Close()
+}
@@ -0,0 +1,65 @@
+package cotfs
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"testing"
+)
+
+// Verifies concurrent opens of a file share one open file, closed with the last handle.
+func TestSharedStorage(t *testing.T) {
+	backing := &countingStorage{}
+	shared := newSharedStorage(backing)
+	var handles []storage.File
+	for _, name := range []string{"one", "one", "two", "one"} {
+		handle, err := shared.Open(name)
+		if err != nil {
+			t.Fatalf("Could not open %s: %v", name, err)
+		}
+		handles = append(handles, handle)
+	}
+	if backing.opened != 2 || shared.openFiles() != 2 {
+		t.Errorf("Expected 2 files to be opened but %d were (%d shared)", backing.opened, shared.openFiles())
+	}
+	conditions := []struct {
+		handle         int
+		expectedOpen   int
+		expectedClosed int
+	}{
+		{0, 2, 0},
+		{0, 2, 0},
+		{2, 1, 1},
+		{1, 1, 1},
+		{3, 0, 2},
+	}
+	for _, condition := range conditions {
+		if err := handles[condition.handle].Close(); err != nil {
+			t.Errorf("Could not close handle %d: %v", condition.handle, err)
+		}
+		if shared.openFiles() != condition.expectedOpen || backing.closed != condition.expectedClosed {
+			t.Errorf("Expected %d open and %d closed after closing handle %d but got %d and %d",
+				condition.expectedOpen, condition.expectedClosed, condition.handle, shared.openFiles(), backing.closed)
+		}
+	}
+}
+
+// Storage counting the files opened and closed.
+type countingStorage struct {
+	MockFileStorage
+	opened int
+	closed int
+}
+
+type countingFile struct {
+	MockFile
+	storage *countingStorage
+}
+
+func (s *countingStorage) Open(name string) (storage.File, error) {
+	s.opened++
+	return countingFile{MockFile: MockFile{name: name}, storage: s}, nil
+}
+
+func (f countingFile) Close() error {
+	f.storage.closed++
+	return nil
+}
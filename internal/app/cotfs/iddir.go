@@ -0,0 +1,63 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"strconv"
+)
+
+// Name of the directory in the root of the mount resolving file ids.
+const idDirName = ".id"
+
+// IdDir is the /.id directory, in which a file can be looked up by its id (e.g. /.id/1234) regardless of its tags. This
+// gives other tools a stable path to a file. Files are not listed since there may be too many of them.
+type IdDir struct {
+	root *Dir
+}
+
+var _ fs.Node = (*IdDir)(nil)
+
+func (i *IdDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, i.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&IdDir{})
+
+// Looks up a file by id. Files carrying a tag hidden from the user are not found.
+func (i *IdDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	id, err := strconv.ParseInt(req.Name, 10, 64)
+	if err != nil || strconv.FormatInt(id, 10) != req.Name {
+		return nil, fuse.ENOENT
+	}
+	root, err := i.root.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	file, err := root.store.GetFile(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return nil, fuse.ENOENT
+	}
+	if hidden, err := root.hides(ctx, file); err != nil || hidden {
+		if err == nil {
+			err = fuse.ENOENT
+		}
+		return nil, err
+	}
+	return root.fileNode(file), nil
+}
+
+var _ = fs.HandleReadDirAller(&IdDir{})
+
+// Lists nothing; files can only be looked up directly.
+func (i *IdDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return nil, nil
+}
@@ -0,0 +1,46 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"testing"
+)
+
+// Verifies files can be looked up by id under /.id.
+func TestIdDir_Lookup(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	file, _ := db.CreateFileInPath(metaDb, "one", "path1", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	node, err := root.Lookup(nil, &fuse.LookupRequest{Name: idDirName}, nil)
+	idDir, ok := node.(*IdDir)
+	if err != nil || !ok {
+		t.Errorf("Expected to find the id directory: %v", err)
+		return
+	}
+	conditions := []struct {
+		name       string
+		expectFile bool
+	}{
+		{fmt.Sprintf("%d", file.Id), true},
+		{fmt.Sprintf("%d", file.Id+1), false},
+		{fmt.Sprintf("0%d", file.Id), false},
+		{"one", false},
+		{"-1", false},
+	}
+	for _, condition := range conditions {
+		node, err := idDir.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
+		if !condition.expectFile {
+			if err != fuse.ENOENT {
+				t.Errorf("Expected lookup of %s to give NOENT error but got %v", condition.name, err)
+			}
+			continue
+		}
+		if found, ok := node.(*File); err != nil || !ok || found.fileInfo.Id != file.Id {
+			t.Errorf("Expected %s to resolve to file %d: %v", condition.name, file.Id, err)
+		}
+	}
+}
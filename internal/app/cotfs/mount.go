@@ -0,0 +1,29 @@
+package cotfs
+
+import (
+	"bazil.org/fuse/fs"
+)
+
+// How the filesystem is mounted, whichever FUSE library serves it.
+type mountConfig struct {
+	// users other than the one mounting the filesystem can access it
+	allowOther bool
+	// the kernel checks access against the reported attributes
+	defaultPermissions bool
+}
+
+// Drops what the kernel cached of nodes, so changes made outside the filesystem show up.
+type invalidator interface {
+	InvalidateNodeData(node fs.Node) error
+	InvalidateEntry(parent fs.Node, name string) error
+}
+
+// A mounted filesystem. By default it is served by bazil.org/fuse; building with the gofuse tag serves it with
+// hanwen/go-fuse instead (see mount_bazil.go and mount_gofuse.go).
+type mountedFS interface {
+	invalidator
+	// serves requests until the filesystem is unmounted
+	serve() error
+	// releases the mount once it is no longer served
+	close() error
+}
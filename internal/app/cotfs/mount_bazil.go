@@ -0,0 +1,49 @@
+// +build !gofuse
+
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// A filesystem served by bazil.org/fuse.
+type bazilMount struct {
+	*fs.Server
+	conn    *fuse.Conn
+	filesys *FS
+}
+
+// Mounts the filesystem with bazil.org/fuse.
+func mount(mountPoint string, filesys *FS, config mountConfig) (mountedFS, error) {
+	mountOptions := []fuse.MountOption{
+		fuse.FSName("cotfs"),
+		fuse.Subtype("cotfs"),
+		fuse.LocalVolume(), //this only impacts Finder on MacOS
+		fuse.VolumeName("Media Filesystem"),
+	}
+	if config.allowOther {
+		mountOptions = append(mountOptions, fuse.AllowOther())
+	}
+	if config.defaultPermissions {
+		mountOptions = append(mountOptions, fuse.DefaultPermissions())
+	}
+	c, err := fuse.Mount(mountPoint, mountOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &bazilMount{Server: fs.New(c, nil), conn: c, filesys: filesys}, nil
+}
+
+func (m *bazilMount) serve() error {
+	if err := m.Serve(m.filesys); err != nil {
+		return err
+	}
+	// check if the mount process has an error to report
+	<-m.conn.Ready
+	return m.conn.MountError
+}
+
+func (m *bazilMount) close() error {
+	return m.conn.Close()
+}
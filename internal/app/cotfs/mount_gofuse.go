@@ -0,0 +1,41 @@
+// +build gofuse
+
+package cotfs
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/gofuse"
+	raw "github.com/hanwen/go-fuse/fuse"
+	"runtime"
+)
+
+// A filesystem served by hanwen/go-fuse.
+type goFuseMount struct {
+	*gofuse.Server
+}
+
+// Mounts the filesystem with hanwen/go-fuse.
+func mount(mountPoint string, filesys *FS, config mountConfig) (mountedFS, error) {
+	options := &raw.MountOptions{FsName: "cotfs", Name: "cotfs", AllowOther: config.allowOther}
+	if config.defaultPermissions {
+		options.Options = append(options.Options, "default_permissions")
+	}
+	if runtime.GOOS == "darwin" {
+		// the same volume options bazil.org/fuse passes; these only impact Finder
+		options.Options = append(options.Options, "local", "volname=Media Filesystem")
+	}
+	server, err := gofuse.Mount(mountPoint, filesys, options)
+	if err != nil {
+		return nil, err
+	}
+	return &goFuseMount{Server: server}, nil
+}
+
+func (m *goFuseMount) serve() error {
+	m.Serve()
+	return nil
+}
+
+// Does nothing: go-fuse releases the mount once it is unmounted.
+func (m *goFuseMount) close() error {
+	return nil
+}
@@ -0,0 +1,133 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"github.com/cfagiani/cotfs/internal/pkg/storage"
+)
+
+// QueryDir is a synthetic, read-only directory listing the files that match a boolean tag expression. It is created
+// on demand when a name containing query operators is looked up and is never stored in the database.
+type QueryDir struct {
+	store         db.MetadataStore
+	expr          query.Expr
+	pattern       string
+	storageSystem storage.FileStorage
+	backends      *storage.Backends
+	options       Options
+	access        *accessRecorder
+}
+
+var _ fs.Node = (*QueryDir)(nil)
+
+func (q *QueryDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, q.options)
+	return nil
+}
+
+// Builds a query directory for the expression in name, scoped to the tags in the directory's path. Returns nil if name is not a valid
+// expression.
+func newQueryDir(d *Dir, name string) *QueryDir {
+	expr, err := query.Parse(name)
+	if err != nil {
+		return nil
+	}
+	for _, group := range d.anyOf {
+		var union query.Expr
+		for _, tag := range group {
+			if union == nil {
+				union = query.Tag{Name: tag.Text}
+			} else {
+				union = query.Or{Left: union, Right: query.Tag{Name: tag.Text}}
+			}
+		}
+		expr = query.And{Left: union, Right: expr}
+	}
+	expr = excludeTags(expr, d.tagFilter().Excluded)
+	for _, tag := range d.path {
+		expr = query.And{Left: query.Tag{Name: tag.Text}, Right: expr}
+	}
+	return &QueryDir{
+		store:         d.store,
+		expr:          expr,
+		storageSystem: d.storageSystem,
+		backends:      d.backends,
+		options:       d.options,
+		access:        d.access,
+	}
+}
+
+// Narrows a query to the files that have none of the tags. A nil query matches every file.
+func excludeTags(expr query.Expr, tags []metadata.TagInfo) query.Expr {
+	for _, tag := range tags {
+		var excluded query.Expr = query.Not{Expr: query.Tag{Name: tag.Text}}
+		if expr != nil {
+			excluded = query.And{Left: excluded, Right: expr}
+		}
+		expr = excluded
+	}
+	return expr
+}
+
+var _ = fs.NodeRequestLookuper(&QueryDir{})
+
+// Looks up a file matching the query by name.
+func (q *QueryDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	file, err := resolveFile(req.Name, q.fileFinder(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return nil, fuse.ENOENT
+	}
+	return q.fileNode(file), nil
+}
+
+var _ = fs.HandleReadDirAller(&QueryDir{})
+
+// Lists the files matching the query.
+func (q *QueryDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	files, err := q.getFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var res []fuse.Dirent
+	for _, name := range fileNames(files) {
+		res = append(res, fuse.Dirent{Name: name, Type: q.options.fileType()})
+	}
+	return res, nil
+}
+
+// Lists the files matching the query, optionally filtered by name. Stores that can't evaluate queries list none.
+func (q *QueryDir) getFiles(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	queries, ok := q.store.(db.QueryStore)
+	if !ok {
+		return nil, nil
+	}
+	return queries.GetFilesMatchingQuery(requestContext(ctx), q.expr, q.pattern, name)
+}
+
+// Returns a function listing the files matching the query, for resolving file names.
+func (q *QueryDir) fileFinder(ctx context.Context) func(string) ([]metadata.FileInfo, error) {
+	return func(name string) ([]metadata.FileInfo, error) {
+		return q.getFiles(ctx, name)
+	}
+}
+
+func (q *QueryDir) fileNode(info metadata.FileInfo) *File {
+	return &File{
+		fileInfo: info,
+		store:    q.store,
+		storage:  q.storageSystem,
+		backends: q.backends,
+		options:  q.options,
+		access:   q.access,
+	}
+}
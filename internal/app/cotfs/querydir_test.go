@@ -0,0 +1,71 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies query expressions resolve to query directories listing the matching files.
+func TestQueryDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 3, 1)
+	file1, _ := db.CreateFileInPath(metaDb, "both", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	file2, _ := db.CreateFileInPath(metaDb, "first", "path2", []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "last", "path3", []metadata.TagInfo{tags[2][0]})
+	conditions := []struct {
+		path          []metadata.TagInfo
+		name          string
+		expectedFiles []metadata.FileInfo
+		expectDir     bool
+	}{
+		{nil, tags[0][0].Text + " & !" + tags[1][0].Text, []metadata.FileInfo{file2}, true},
+		{nil, tags[0][0].Text + "|" + tags[1][0].Text, []metadata.FileInfo{file1, file2}, true},
+		{[]metadata.TagInfo{tags[1][0]}, "(!" + tags[2][0].Text + ")", []metadata.FileInfo{file1}, true},
+		{nil, "(unbalanced", nil, false},
+	}
+	for _, condition := range conditions {
+		dir := &Dir{
+			store:         db.NewSQLiteStore(metaDb),
+			mountPoint:    testMount,
+			path:          condition.path,
+			storageSystem: storageSys,
+		}
+		node, err := dir.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
+		if !condition.expectDir {
+			if err != fuse.ENOENT {
+				t.Errorf("Expected lookup of %s to give NOENT error", condition.name)
+			}
+			continue
+		}
+		queryDir, ok := node.(*QueryDir)
+		if err != nil || !ok {
+			t.Errorf("Expected %s to resolve to a query directory: %v", condition.name, err)
+			continue
+		}
+		entries, err := queryDir.ReadDirAll(nil)
+		if err != nil {
+			t.Errorf("Could not read query directory: %v", err)
+		}
+		if len(entries) != len(condition.expectedFiles) {
+			t.Errorf("Expected %d files for %s but found %d", len(condition.expectedFiles), condition.name, len(entries))
+		}
+		for _, entry := range entries {
+			if !containsFile(entry, condition.expectedFiles) {
+				t.Errorf("Found unexpected file %s for %s", entry.Name, condition.name)
+			}
+		}
+		for _, file := range condition.expectedFiles {
+			fileNode, err := queryDir.Lookup(nil, &fuse.LookupRequest{Name: file.Name}, nil)
+			if err != nil || fileNode.(*File).fileInfo.Id != file.Id {
+				t.Errorf("Could not look up %s in %s", file.Name, condition.name)
+			}
+		}
+		_, err = queryDir.Lookup(nil, &fuse.LookupRequest{Name: "notThere"}, nil)
+		if err != fuse.ENOENT {
+			t.Error("Expected lookup of missing file in query directory to give NOENT error")
+		}
+	}
+}
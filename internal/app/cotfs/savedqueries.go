@@ -0,0 +1,120 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"syscall"
+)
+
+// Name of the directory in the root of the mount listing the saved queries.
+const savedQueriesDirName = ".queries"
+
+// SavedQueriesDir is the /.queries directory. Each saved query is listed as a query directory with the files currently
+// matching it. Queries are saved with the query command of the control file and deleted with rmdir.
+type SavedQueriesDir struct {
+	root *Dir
+}
+
+var _ fs.Node = (*SavedQueriesDir)(nil)
+
+func (s *SavedQueriesDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, s.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&SavedQueriesDir{})
+
+// Looks up a saved query by name.
+func (s *SavedQueriesDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	root, err := s.root.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	queries, ok := root.store.(db.QueryStore)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	saved, err := queries.GetSavedQuery(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if saved.Name == metadata.UnknownQuery.Name {
+		return nil, fuse.ENOENT
+	}
+	expr, err := parseSavedQuery(saved)
+	if err != nil {
+		return nil, err
+	}
+	// files carrying tags hidden from the user are left out like in tag directories
+	return &QueryDir{
+		store:         root.store,
+		expr:          excludeTags(expr, root.hidden),
+		pattern:       saved.Pattern,
+		storageSystem: root.storageSystem,
+		backends:      root.backends,
+		options:       root.options,
+		access:        root.access,
+	}, nil
+}
+
+var _ = fs.HandleReadDirAller(&SavedQueriesDir{})
+
+// Lists the saved queries.
+func (s *SavedQueriesDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	store, ok := s.root.store.(db.QueryStore)
+	if !ok {
+		return nil, nil
+	}
+	queries, err := store.GetSavedQueries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var res []fuse.Dirent
+	for _, saved := range queries {
+		res = append(res, fuse.Dirent{Type: fuse.DT_Dir, Name: saved.Name})
+	}
+	return res, nil
+}
+
+var _ = fs.NodeRemover(&SavedQueriesDir{})
+
+// Respond to rmdir by deleting the saved query.
+func (s *SavedQueriesDir) Remove(ctx context.Context, req *fuse.RemoveRequest) (err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	if !req.Dir {
+		return fuse.ENOENT
+	}
+	queries, ok := s.root.store.(db.QueryStore)
+	if !ok {
+		return fuse.ENOENT
+	}
+	saved, err := queries.GetSavedQuery(ctx, req.Name)
+	if err != nil {
+		return err
+	}
+	if saved.Name == metadata.UnknownQuery.Name {
+		return fuse.ENOENT
+	}
+	return queries.DeleteSavedQuery(ctx, saved.Name)
+}
+
+// Parses the tag expression of a saved query. Queries with only a name pattern have a nil expression.
+func parseSavedQuery(saved metadata.SavedQuery) (query.Expr, error) {
+	if len(saved.Expr) == 0 {
+		if len(saved.Pattern) == 0 {
+			return nil, fuse.Errno(syscall.EINVAL)
+		}
+		return nil, nil
+	}
+	return query.Parse(saved.Expr)
+}
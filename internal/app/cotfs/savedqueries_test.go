@@ -0,0 +1,77 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"syscall"
+	"testing"
+)
+
+// Verifies queries saved through the control directory are listed as live directories under /.queries.
+func TestSavedQueriesDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	db.CreateFileInPath(metaDb, "both.jpg", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	db.CreateFileInPath(metaDb, "first.jpg", "path2", []metadata.TagInfo{tags[0][0]})
+	db.CreateFileInPath(metaDb, "first.png", "path3", []metadata.TagInfo{tags[0][0]})
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	control := &ControlDir{root: root}
+	node, err := root.Lookup(nil, &fuse.LookupRequest{Name: savedQueriesDirName}, nil)
+	queries, ok := node.(*SavedQueriesDir)
+	if err != nil || !ok {
+		t.Errorf("Expected to find the saved queries directory: %v", err)
+		return
+	}
+	conditions := []struct {
+		command       string
+		name          string
+		expectedErr   error
+		expectedFiles int
+	}{
+		{"query only * " + tags[0][0].Text + " & !" + tags[1][0].Text, "only", nil, 2},
+		{"query jpegs *.jpg", "jpegs", nil, 2},
+		{"query firstjpegs *.jpg " + tags[0][0].Text + " & !" + tags[1][0].Text, "firstjpegs", nil, 1},
+		{"query bad * (unbalanced", "bad", fuse.Errno(syscall.EINVAL), 0},
+		{"query empty *", "empty", fuse.Errno(syscall.EINVAL), 0},
+	}
+	for _, condition := range conditions {
+		if err := control.execute(context.Background(), 0, condition.command); err != condition.expectedErr {
+			t.Errorf("Expected %v running %s but got %v", condition.expectedErr, condition.command, err)
+		}
+		node, err := queries.Lookup(nil, &fuse.LookupRequest{Name: condition.name}, nil)
+		if condition.expectedErr != nil {
+			if err != fuse.ENOENT {
+				t.Errorf("Expected %s not to be saved but got %v", condition.name, err)
+			}
+			continue
+		}
+		queryDir, ok := node.(*QueryDir)
+		if err != nil || !ok {
+			t.Errorf("Expected %s to resolve to a query directory: %v", condition.name, err)
+			continue
+		}
+		if entries, _ := queryDir.ReadDirAll(nil); len(entries) != condition.expectedFiles {
+			t.Errorf("Expected %d files for %s but found %d", condition.expectedFiles, condition.name, len(entries))
+		}
+	}
+	entries, _ := queries.ReadDirAll(nil)
+	if len(entries) != 3 || entries[0].Name != "firstjpegs" {
+		t.Errorf("Unexpected saved queries %v", entries)
+	}
+	if err = queries.Remove(nil, &fuse.RemoveRequest{Name: "jpegs", Dir: true}); err != nil {
+		t.Errorf("Could not remove saved query: %v", err)
+	}
+	if err = queries.Remove(nil, &fuse.RemoveRequest{Name: "jpegs", Dir: true}); err != fuse.ENOENT {
+		t.Errorf("Expected removing a missing query to give NOENT but got %v", err)
+	}
+	if err = control.execute(context.Background(), 0, "unquery only"); err != nil {
+		t.Errorf("Could not delete saved query: %v", err)
+	}
+	if entries, _ = queries.ReadDirAll(nil); len(entries) != 1 {
+		t.Errorf("Expected 1 saved query to remain but found %d", len(entries))
+	}
+}
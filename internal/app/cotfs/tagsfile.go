@@ -0,0 +1,132 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bytes"
+	"context"
+)
+
+// Suffix appended to a file name to get the name of its tag sidecar.
+const tagsSuffix = ".tags"
+
+// TagsFile is a virtual file that sits next to every file in a tag directory. Its content is the list of tags applied
+// to the file, one per line, and writing a new list to it replaces the tags on the file.
+type TagsFile struct {
+	file *File
+}
+
+var _ fs.Node = (*TagsFile)(nil)
+
+func (t *TagsFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	ctx = requestContext(ctx)
+	content, err := t.content(ctx)
+	if err != nil {
+		return err
+	}
+	a.Mode = 0644
+	a.Size = uint64(len(content))
+	return nil
+}
+
+// Builds the newline-separated list of tags on the file.
+func (t *TagsFile) content(ctx context.Context) ([]byte, error) {
+	tags, err := t.file.store.GetTagsForFile(ctx, t.file.fileInfo.Id)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	for _, tag := range tags {
+		buf.WriteString(tag.Text)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+var _ = fs.NodeSetattrer(&TagsFile{})
+
+// Accepts truncation (sent by the kernel before a file is overwritten) but otherwise ignores attribute changes; the
+// tags are only updated once the new content is flushed.
+func (t *TagsFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	return t.Attr(ctx, &resp.Attr)
+}
+
+var _ = fs.NodeFsyncer(&TagsFile{})
+
+// Editors commonly sync before closing; the written tags are applied on flush so there is nothing to sync here.
+func (t *TagsFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	return nil
+}
+
+var _ = fs.NodeOpener(&TagsFile{})
+
+// Opens the sidecar. The current tag list is snapshotted when opened for reading; write-only or truncating opens start
+// out empty since the written content replaces the tag list.
+func (t *TagsFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	ctx = requestContext(ctx)
+	handle := &TagsFileHandle{file: t.file}
+	if !req.Flags.IsWriteOnly() && req.Flags&fuse.OpenTruncate == 0 {
+		content, err := t.content(ctx)
+		if err != nil {
+			return nil, err
+		}
+		handle.data = content
+	}
+	// the size of the content changes with the tags so don't let the kernel cache it
+	resp.Flags |= fuse.OpenDirectIO
+	return handle, nil
+}
+
+type TagsFileHandle struct {
+	file  *File
+	data  []byte
+	dirty bool
+}
+
+var _ fs.Handle = (*TagsFileHandle)(nil)
+
+var _ = fs.HandleReader(&TagsFileHandle{})
+
+func (h *TagsFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	resp.Data = sliceForRead(h.data, req)
+	return nil
+}
+
+// Returns the part of an in-memory file's content covered by a read request.
+func sliceForRead(data []byte, req *fuse.ReadRequest) []byte {
+	if req.Offset >= int64(len(data)) {
+		return nil
+	}
+	end := req.Offset + int64(req.Size)
+	if end > int64(len(data)) {
+		end = int64(len(data))
+	}
+	return data[req.Offset:end]
+}
+
+var _ = fs.HandleWriter(&TagsFileHandle{})
+
+// Buffers written content; it is applied to the file's tags on flush.
+func (h *TagsFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	end := req.Offset + int64(len(req.Data))
+	if end > int64(len(h.data)) {
+		grown := make([]byte, end)
+		copy(grown, h.data)
+		h.data = grown
+	}
+	copy(h.data[req.Offset:], req.Data)
+	h.dirty = true
+	resp.Size = len(req.Data)
+	return nil
+}
+
+var _ = fs.HandleFlusher(&TagsFileHandle{})
+
+func (h *TagsFileHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	ctx = requestContext(ctx)
+	if !h.dirty {
+		return nil
+	}
+	h.dirty = false
+	return h.file.setTags(ctx, parseTagList(string(h.data)))
+}
@@ -0,0 +1,97 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies the sidecar lists the tags of its file.
+func TestTagsFile_Read(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	sidecar := &TagsFile{file: &File{fileInfo: file1, store: db.NewSQLiteStore(metaDb), storage: storageSys}}
+	expected := tags[0][0].Text + "\n" + tags[1][0].Text + "\n"
+
+	attr := &fuse.Attr{}
+	err := sidecar.Attr(nil, attr)
+	if err != nil {
+		t.Errorf("Could not get sidecar attributes: %v", err)
+	}
+	if attr.Size != uint64(len(expected)) {
+		t.Errorf("Expected sidecar size to be %d but was %d", len(expected), attr.Size)
+	}
+
+	handle, err := sidecar.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Errorf("Could not open sidecar: %v", err)
+	}
+	sizesToRead := []int{1, len(expected), len(expected) + 10}
+	for _, size := range sizesToRead {
+		response := &fuse.ReadResponse{}
+		err = handle.(*TagsFileHandle).Read(nil, &fuse.ReadRequest{Size: size}, response)
+		if err != nil {
+			t.Errorf("Unexpected error reading sidecar: %v", err)
+		}
+		expectedData := expected
+		if size < len(expected) {
+			expectedData = expected[:size]
+		}
+		if string(response.Data) != expectedData {
+			t.Errorf("Unexpected sidecar content %q reading %d bytes", response.Data, size)
+		}
+	}
+	response := &fuse.ReadResponse{}
+	handle.(*TagsFileHandle).Read(nil, &fuse.ReadRequest{Offset: int64(len(expected)), Size: 10}, response)
+	if len(response.Data) != 0 {
+		t.Error("Expected reading past the end to return no data")
+	}
+}
+
+// Verifies writing to the sidecar replaces the tags of its file once flushed.
+func TestTagsFileHandle_Write(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 2, 1)
+	file1, _ := db.CreateFileInPath(metaDb, "fileInPath", "path1", []metadata.TagInfo{tags[0][0], tags[1][0]})
+	sidecar := &TagsFile{file: &File{fileInfo: file1, store: db.NewSQLiteStore(metaDb), storage: storageSys}}
+
+	handle, err := sidecar.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Errorf("Could not open sidecar: %v", err)
+	}
+	fh := handle.(*TagsFileHandle)
+	writes := []string{tags[1][0].Text, "\nbrand", "New\n"}
+	offset := int64(0)
+	for _, data := range writes {
+		response := &fuse.WriteResponse{}
+		err = fh.Write(nil, &fuse.WriteRequest{Offset: offset, Data: []byte(data)}, response)
+		if err != nil || response.Size != len(data) {
+			t.Errorf("Could not write %q to sidecar: %v", data, err)
+		}
+		offset += int64(len(data))
+	}
+	// nothing changes until the handle is flushed
+	files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{tags[0][0]}, "")
+	if len(files) != 1 {
+		t.Error("Tags should not change before flush")
+	}
+	err = fh.Flush(nil, &fuse.FlushRequest{})
+	if err != nil {
+		t.Errorf("Could not flush sidecar: %v", err)
+	}
+	fileTags, _ := db.GetTagsForFile(metaDb, file1.Id)
+	if len(fileTags) != 2 || fileTags[0].Text != "brandNew" || fileTags[1].Text != tags[1][0].Text {
+		t.Errorf("Unexpected tags after writing sidecar: %v", fileTags)
+	}
+
+	// an empty tag list is rejected
+	handle, _ = sidecar.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenWriteOnly}, &fuse.OpenResponse{})
+	handle.(*TagsFileHandle).Write(nil, &fuse.WriteRequest{Data: []byte("\n")}, &fuse.WriteResponse{})
+	if err = handle.(*TagsFileHandle).Flush(nil, &fuse.FlushRequest{}); err != fuse.EPERM {
+		t.Errorf("Expected EPERM when clearing all tags but got %v", err)
+	}
+}
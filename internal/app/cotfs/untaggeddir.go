@@ -0,0 +1,132 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Name of the directory in the root of the mount listing the files that still need tags.
+const untaggedDirName = ".untagged"
+
+// UntaggedDir is the /.untagged directory, listing the files that have no tag other than uncategorized so they can be
+// triaged. Linking (ln) or moving (mv) one of them into a tag directory tags the file; moving it also removes the
+// uncategorized tag.
+type UntaggedDir struct {
+	root *Dir
+}
+
+var _ fs.Node = (*UntaggedDir)(nil)
+
+func (u *UntaggedDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	tagAttr(a, u.root.options)
+	return nil
+}
+
+var _ = fs.NodeRequestLookuper(&UntaggedDir{})
+
+// Looks up an untagged file by name.
+func (u *UntaggedDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (_ fs.Node,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	ctx = requestContext(ctx)
+	root, err := u.root.lookupView(ctx, req, resp)
+	if err != nil {
+		return nil, err
+	}
+	u = &UntaggedDir{root: root}
+	file, err := resolveFile(req.Name, u.fileFinder(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return nil, fuse.ENOENT
+	}
+	return u.root.fileNode(file), nil
+}
+
+var _ = fs.NodeOpener(&UntaggedDir{})
+
+// Opens the directory for listing. With user views enabled, the handle is the view of the directory for the user
+// opening it.
+func (u *UntaggedDir) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (_ fs.Handle,
+	err error) {
+	defer func() { err = toErrno(err) }()
+	root, err := u.root.forUser(requestContext(ctx), req.Uid)
+	if err != nil {
+		return nil, err
+	}
+	return &UntaggedDir{root: root}, nil
+}
+
+var _ = fs.HandleReadDirAller(&UntaggedDir{})
+
+// Lists the untagged files.
+func (u *UntaggedDir) ReadDirAll(ctx context.Context) (_ []fuse.Dirent, err error) {
+	defer func() { err = toErrno(err) }()
+	files, err := u.getFiles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	var res []fuse.Dirent
+	for _, name := range fileNames(files) {
+		res = append(res, fuse.Dirent{Name: name, Type: u.root.options.fileType()})
+	}
+	return res, nil
+}
+
+var _ = fs.NodeRenamer(&UntaggedDir{})
+
+// Respond to mv by tagging the file with the tags of the destination directory and removing the uncategorized tag.
+// The file keeps its name regardless of the name it is moved to.
+func (u *UntaggedDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	ctx = requestContext(ctx)
+	dest, ok := newDir.(*Dir)
+	if !ok || len(dest.path) == 0 {
+		return fuse.EPERM
+	}
+	root, err := u.root.forUser(ctx, req.Uid)
+	if err != nil {
+		return err
+	}
+	u = &UntaggedDir{root: root}
+	file, err := resolveFile(req.OldName, u.fileFinder(ctx))
+	if err != nil {
+		return err
+	}
+	if file.Id == metadata.UnknownFile.Id {
+		return fuse.ENOENT
+	}
+	if err = u.root.store.TagFile(ctx, file.Id, dest.path); err != nil {
+		return err
+	}
+	uncategorized, err := u.root.store.FindTag(ctx, uncategorizedTag)
+	if err != nil || uncategorized.Id == metadata.UnknownTag.Id || tagInPath(dest.path, uncategorized) {
+		return err
+	}
+	return u.root.store.UntagFile(ctx, file.Id, uncategorized.Id)
+}
+
+// Lists the untagged files the user may see, optionally filtered by name.
+func (u *UntaggedDir) getFiles(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	return u.root.store.GetUntaggedFilesExcluding(requestContext(ctx), uncategorizedTag, u.root.hidden,
+		name)
+}
+
+// Returns a function listing the untagged files, for resolving file names.
+func (u *UntaggedDir) fileFinder(ctx context.Context) func(string) ([]metadata.FileInfo, error) {
+	return func(name string) ([]metadata.FileInfo, error) {
+		return u.getFiles(ctx, name)
+	}
+}
+
+// Reports whether the tag is one of the tags in the path.
+func tagInPath(path []metadata.TagInfo, tag metadata.TagInfo) bool {
+	for _, t := range path {
+		if t.Id == tag.Id {
+			return true
+		}
+	}
+	return false
+}
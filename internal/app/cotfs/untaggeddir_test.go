@@ -0,0 +1,56 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies /.untagged lists files needing tags and that moving them into a tag directory categorizes them.
+func TestUntaggedDir(t *testing.T) {
+	metaDb, storageSys := getMockFixtures(t)
+	defer metaDb.Close()
+	tags := createTags(metaDb, 1, 1)
+	uncategorized, _ := db.AddTag(metaDb, uncategorizedTag, nil)
+	db.CreateFileInPath(metaDb, "none", "path1", nil)
+	db.CreateFileInPath(metaDb, "fallback", "path2", []metadata.TagInfo{uncategorized})
+	db.CreateFileInPath(metaDb, "tagged", "path3", tags[0])
+	root := &Dir{store: db.NewSQLiteStore(metaDb), mountPoint: testMount, storageSystem: storageSys,
+		control: newControlState()}
+	node, err := root.Lookup(nil, &fuse.LookupRequest{Name: untaggedDirName}, nil)
+	untagged, ok := node.(*UntaggedDir)
+	if err != nil || !ok {
+		t.Errorf("Expected to find the untagged directory: %v", err)
+		return
+	}
+	if entries, _ := untagged.ReadDirAll(nil); len(entries) != 2 {
+		t.Errorf("Expected 2 untagged files but found %v", entries)
+	}
+	dest := root.childDir(tags[0], nil, nil)
+	conditions := []struct {
+		name        string
+		newDir      *Dir
+		expectedErr error
+		remaining   int
+	}{
+		{"fallback", root, fuse.EPERM, 2},
+		{"tagged", dest, fuse.ENOENT, 2},
+		{"fallback", dest, nil, 1},
+		{"none", dest, nil, 0},
+	}
+	for _, condition := range conditions {
+		err := untagged.Rename(nil, &fuse.RenameRequest{OldName: condition.name, NewName: condition.name},
+			condition.newDir)
+		if err != condition.expectedErr {
+			t.Errorf("Expected %v moving %s but got %v", condition.expectedErr, condition.name, err)
+		}
+		if entries, _ := untagged.ReadDirAll(nil); len(entries) != condition.remaining {
+			t.Errorf("Expected %d untagged files after moving %s but found %d", condition.remaining, condition.name,
+				len(entries))
+		}
+	}
+	if files, _ := db.GetFilesWithTags(metaDb, []metadata.TagInfo{uncategorized}, ""); len(files) != 0 {
+		t.Errorf("Expected moved files to lose the %s tag but found %v", uncategorizedTag, files)
+	}
+}
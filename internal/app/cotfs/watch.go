@@ -0,0 +1,60 @@
+package cotfs
+
+import (
+	"bazil.org/fuse"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"log"
+	"time"
+)
+
+// Polls the metadata database for changes made outside the mount (e.g. by the indexer) so the kernel's caches and the
+// tag lookups cached by the db package can be invalidated.
+type changeWatcher struct {
+	store    db.WatchedStore
+	interval time.Duration
+	// called whenever a change is detected
+	changed func()
+}
+
+// Checks for changes every interval until stop is closed.
+func (w *changeWatcher) run(stop <-chan struct{}) {
+	detector, err := w.store.NewChangeDetector()
+	if err != nil {
+		log.Printf("Could not watch the metadata database for changes: %s", err)
+		return
+	}
+	defer detector.Close()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := detector.Changed()
+			if err != nil {
+				log.Printf("Could not check the metadata database for changes: %s", err)
+			} else if changed {
+				w.changed()
+			}
+		}
+	}
+}
+
+// Drops the kernel's cached listing of the root directory and the entries in it, so files and tags added or removed
+// by other processes show up. Deeper directories are refreshed once their cached entries expire.
+func invalidateRoot(server invalidator, root *Dir) {
+	if err := server.InvalidateNodeData(root); err != nil && err != fuse.ErrNotCached {
+		log.Printf("Could not invalidate the root directory: %s", err)
+	}
+	entries, err := root.ReadDirAll(nil)
+	if err != nil {
+		log.Printf("Could not list the root directory: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		if err := server.InvalidateEntry(root, entry.Name); err != nil && err != fuse.ErrNotCached {
+			log.Printf("Could not invalidate %s: %s", entry.Name, err)
+		}
+	}
+}
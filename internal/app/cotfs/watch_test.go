@@ -0,0 +1,47 @@
+package cotfs
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Verifies the watcher reports changes made to the database by another process.
+func TestChangeWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "watch.db")
+	metaDb, err := db.Open(filename)
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer metaDb.Close()
+	changes := make(chan bool, 10)
+	watcher := &changeWatcher{store: db.NewSQLiteStore(metaDb), interval: 10 * time.Millisecond,
+		changed: func() { changes <- true }}
+	stop := make(chan struct{})
+	defer close(stop)
+	go watcher.run(stop)
+	// give the watcher time to record the initial state
+	time.Sleep(50 * time.Millisecond)
+	other, err := db.Open(filename)
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer other.Close()
+	db.AddTag(other, "new", nil)
+	select {
+	case <-changes:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the change to be detected")
+	}
+}
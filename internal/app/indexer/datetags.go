@@ -0,0 +1,54 @@
+package indexer
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Tags files with the year and month they date from, e.g. 2023 and 2023-07, the month being associated with the year
+// so the months of a year are listed in its directory. Looked up once per month.
+type dateTags struct {
+	store db.MetadataStore
+	// tags of the months seen so far, by month
+	cache map[string][]metadata.TagInfo
+}
+
+func newDateTags(store db.MetadataStore) *dateTags {
+	return &dateTags{store: store, cache: make(map[string][]metadata.TagInfo)}
+}
+
+// Returns the tags of the month a file dates from, adding the ones missing from the store.
+func (d *dateTags) forFile(ctx context.Context, path string, info os.FileInfo) []metadata.TagInfo {
+	month := fileDate(path, info).Format("2006-01")
+	if tags, ok := d.cache[month]; ok {
+		return tags
+	}
+	var tags []metadata.TagInfo
+	for _, name := range []string{month[:4], month} {
+		tag, err := d.store.AddTag(ctx, name, tags)
+		if err != nil {
+			log.Printf("Could not add the date tag %s: %s", name, err)
+			return nil
+		}
+		tags = append(tags, tag)
+	}
+	d.cache[month] = tags
+	return tags
+}
+
+// Returns when a file dates from: when a JPEG photo was taken according to its EXIF metadata, or when the file was
+// last modified otherwise.
+func fileDate(path string, info os.FileInfo) time.Time {
+	if extension := strings.ToLower(filepath.Ext(path)); extension == ".jpg" || extension == ".jpeg" {
+		if date, ok := exifDate(path); ok {
+			return date
+		}
+	}
+	return info.ModTime()
+}
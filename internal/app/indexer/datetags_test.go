@@ -0,0 +1,52 @@
+package indexer
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Verifies indexing with date tags tags new files with the month they were taken or last modified.
+func TestIndexPathIntoStoreWithDateTags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	modified := time.Date(2021, time.March, 3, 12, 0, 0, 0, time.Local)
+	conditions := []struct {
+		name         string
+		content      []byte
+		expectedTags []string
+	}{
+		{"taken.jpg", jpegWithExif(binary.LittleEndian, "2023:07:14 10:22:01", ""),
+			[]string{"media", "image", "2023", "2023-07"}},
+		{"plain.jpg", []byte("no exif"), []string{"media", "image", "2021", "2021-03"}},
+		{"notes.txt", []byte("notes"), []string{"document", "2021", "2021-03"}},
+	}
+	for _, condition := range conditions {
+		path := filepath.Join(dir, condition.name)
+		if err = ioutil.WriteFile(path, condition.content, 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", condition.name, err)
+		}
+		os.Chtimes(path, modified, modified)
+	}
+	store := newMemoryStore()
+	if err = IndexPathIntoStoreWithOptions(context.Background(), store, dir, Options{DateTags: true}); err != nil {
+		t.Fatalf("Could not index %s: %v", dir, err)
+	}
+	for _, condition := range conditions {
+		var tags []string
+		for _, tag := range store.fileTags[store.files[condition.name].Id] {
+			tags = append(tags, tag.Text)
+		}
+		if !reflect.DeepEqual(tags, condition.expectedTags) {
+			t.Errorf("Expected %s to be tagged %v but got %v", condition.name, condition.expectedTags, tags)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package indexer
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Number of files looked up at a time when filling in missing details.
+const backfillBatchSize = 100
+
+// Number of bytes at the start of a file used to detect its MIME type when its extension doesn't tell it.
+const sniffLength = 512
+
+// Records the details of a file in the store, reporting whether they were. The content is only read again if the file
+// changed since its details were last recorded, or if they never were.
+func recordDetails(ctx context.Context, store db.MetadataStore, fileId int64, path string, info os.FileInfo) (bool,
+	error) {
+	recorded, _, err := store.GetFileDetails(ctx, fileId)
+	if err != nil {
+		return false, err
+	}
+	if recorded.Checksum != "" && recorded.MimeType != "" && recorded.Size == info.Size() &&
+		recorded.ModTime.Unix() == info.ModTime().Unix() {
+		return false, nil
+	}
+	details, err := readDetails(path, info)
+	if err != nil {
+		return false, err
+	}
+	return true, store.SetFileDetails(ctx, fileId, details)
+}
+
+// Reads a file to work out its checksum and MIME type. The MIME type comes from the extension of the file if it is a
+// known one, from its first bytes otherwise.
+func readDetails(path string, info os.FileInfo) (metadata.FileDetails, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return metadata.FileDetails{}, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return metadata.FileDetails{}, err
+	}
+	head = head[:n]
+	hash.Write(head)
+	if _, err = io.Copy(hash, file); err != nil {
+		return metadata.FileDetails{}, err
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(path))
+	if mimeType == "" {
+		mimeType = http.DetectContentType(head)
+	}
+	// parameters such as the charset aren't worth filtering on
+	mimeType = strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	return metadata.FileDetails{Size: info.Size(), ModTime: info.ModTime(), Checksum: hex.EncodeToString(hash.Sum(nil)),
+		MimeType: mimeType}, nil
+}
+
+// Fills in the details of the files of a metadata database that are missing any, e.g. because they were indexed before
+// the details were recorded. Files that can't be read are logged and left as they are. Returns the number of files
+// filled in.
+func Backfill(metadataPath string) (int, error) {
+	return BackfillContext(context.Background(), metadataPath)
+}
+
+// Same as Backfill but stops, returning the context's error, once the context is done.
+func BackfillContext(ctx context.Context, metadataPath string) (int, error) {
+	if boltstore.IsPath(metadataPath) {
+		return 0, fmt.Errorf("%s is a bolt store, which records the details of files as they are indexed", metadataPath)
+	}
+	unlock, err := db.LockExclusive(metadataPath)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	database, err := db.OpenWithOptions(metadataPath, db.OpenOptions{Source: db.SourceIndexer})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close(database)
+	return backfillInto(ctx, database)
+}
+
+// Fills in the details of the files of an open metadata database that are missing any; see Backfill.
+func backfillInto(ctx context.Context, database *sql.DB) (int, error) {
+	store := db.NewSQLiteStore(database)
+	filled := 0
+	var lastId int64
+	for {
+		files, err := db.GetFilesMissingDetailsContext(ctx, database, lastId, backfillBatchSize)
+		if err != nil || len(files) == 0 {
+			return filled, err
+		}
+		for _, file := range files {
+			lastId = file.Id
+			path := filepath.Join(file.Path, file.Name)
+			info, err := os.Stat(path)
+			if err == nil {
+				_, err = recordDetails(ctx, store, file.Id, path, info)
+			}
+			if ctx.Err() != nil {
+				return filled, ctx.Err()
+			}
+			if err != nil {
+				log.Printf("Could not fill in the details of %s: %s", path, err)
+				continue
+			}
+			filled++
+		}
+	}
+}
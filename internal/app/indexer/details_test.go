@@ -0,0 +1,79 @@
+package indexer
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies the checksum and MIME type of files are worked out from their content.
+func TestReadDetails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		name             string
+		content          []byte
+		expectedChecksum string
+		expectedMimeType string
+	}{
+		{"empty", nil, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "text/plain"},
+		{"one", []byte("file one\n"), "198cef2c92e80b728ae28c9978e64381fa18d9b31adf2068ca63b1d53153cf95", "text/plain"},
+		// the extension wins over the content
+		{"page.html", []byte("file one\n"), "198cef2c92e80b728ae28c9978e64381fa18d9b31adf2068ca63b1d53153cf95",
+			"text/html"},
+		{"image", []byte("\x89PNG\x0d\x0a\x1a\x0a"), "4c4b6a3be1314ab86138bef4314dde022e600960d8689a2c8f8631802d20dab6",
+			"image/png"},
+	}
+	for _, condition := range conditions {
+		path := filepath.Join(dir, condition.name)
+		if err = ioutil.WriteFile(path, condition.content, 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+		info, _ := os.Stat(path)
+		details, err := readDetails(path, info)
+		if err != nil {
+			t.Errorf("Could not read the details of %s: %v", condition.name, err)
+			continue
+		}
+		if details.Checksum != condition.expectedChecksum || details.MimeType != condition.expectedMimeType {
+			t.Errorf("Expected %s %s for %s but got %s %s", condition.expectedChecksum, condition.expectedMimeType,
+				condition.name, details.Checksum, details.MimeType)
+		}
+		if details.Size != int64(len(condition.content)) || !details.ModTime.Equal(info.ModTime()) {
+			t.Errorf("Expected the size and modification time of %s to be recorded but got %v", condition.name,
+				details)
+		}
+	}
+}
+
+// Verifies files indexed before their details were recorded get them filled in, and unreadable ones are skipped.
+func TestBackfill(t *testing.T) {
+	database := getDb(t)
+	defer database.Close()
+	one := filepath.Join(getTestDataDirectory(), "one.txt")
+	tags, _ := db.AddTags(database, []string{"backfill"}, nil)
+	existing, _ := db.CreateFileInPath(database, filepath.Base(one), filepath.Dir(one), tags)
+	missing, _ := db.CreateFileInPath(database, "missing.txt", getTestDataDirectory(), tags)
+	filled, err := backfillInto(context.Background(), database)
+	if err != nil || filled != 1 {
+		t.Errorf("Expected one file to be filled in but got %d (%v)", filled, err)
+	}
+	details, _, _ := db.GetFileDetails(database, existing.Id)
+	if details.Checksum != "198cef2c92e80b728ae28c9978e64381fa18d9b31adf2068ca63b1d53153cf95" ||
+		details.MimeType != "text/plain" || details.Size != 9 {
+		t.Errorf("Expected the details of %s to be filled in but got %v", one, details)
+	}
+	if details, _, _ = db.GetFileDetails(database, missing.Id); details.Checksum != "" {
+		t.Errorf("Expected the missing file to be left as it was but got %v", details)
+	}
+	// nothing is left to fill in but the missing file
+	if filled, err = backfillInto(context.Background(), database); err != nil || filled != 0 {
+		t.Errorf("Expected nothing to be filled in but got %d (%v)", filled, err)
+	}
+}
@@ -0,0 +1,73 @@
+package indexer
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Turns the directories files are in below the directory indexed into tags, e.g. indexing ~ tags
+// ~/photos/2019/italy/IMG.jpg photos, 2019 and italy. The tags of a directory are associated with each other like the
+// directories of the mount, and looked up once per directory.
+type directoryTags struct {
+	store db.MetadataStore
+	root  string
+	// number of directories from the top made tags, all of them if negative
+	depth int
+	// lower case names of the directories left out
+	stopWords map[string]bool
+	// tags of the directories seen so far, by directory
+	cache map[string][]metadata.TagInfo
+}
+
+func newDirectoryTags(store db.MetadataStore, root string, depth int, stopWords []string) *directoryTags {
+	tags := &directoryTags{store: store, root: root, depth: depth, stopWords: make(map[string]bool),
+		cache: make(map[string][]metadata.TagInfo)}
+	for _, word := range stopWords {
+		tags.stopWords[strings.ToLower(word)] = true
+	}
+	return tags
+}
+
+// Returns the tags of the directories a file is in, adding the ones missing from the store.
+func (d *directoryTags) forFile(ctx context.Context, path string) []metadata.TagInfo {
+	dir := filepath.Dir(path)
+	if tags, ok := d.cache[dir]; ok {
+		return tags
+	}
+	var tags []metadata.TagInfo
+	for _, name := range d.names(dir) {
+		tag, err := d.store.AddTag(ctx, name, tags)
+		if err != nil {
+			log.Printf("Could not add the tag of directory %s: %s", name, err)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	d.cache[dir] = tags
+	return tags
+}
+
+// Returns the names of the directories below the root down to dir that become tags: up to depth of them from the top,
+// leaving out stop words, hidden directories (whose names are kept for the mount's own directories, like .trash) and
+// names that can't be tags.
+func (d *directoryTags) names(dir string) []string {
+	relative, err := filepath.Rel(d.root, dir)
+	if err != nil || relative == "." || strings.HasPrefix(relative, "..") {
+		return nil
+	}
+	components := strings.Split(relative, string(filepath.Separator))
+	if d.depth >= 0 && len(components) > d.depth {
+		components = components[:d.depth]
+	}
+	var names []string
+	for _, name := range components {
+		if !d.stopWords[strings.ToLower(name)] && !strings.HasPrefix(name, ".") && validTagName(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
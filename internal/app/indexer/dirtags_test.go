@@ -0,0 +1,61 @@
+package indexer
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Verifies the directories below the root become tags down to the depth, leaving out stop words and hidden ones.
+func TestDirectoryTagNames(t *testing.T) {
+	root := filepath.FromSlash("/home/user")
+	conditions := []struct {
+		dir       string
+		depth     int
+		stopWords []string
+		expected  []string
+	}{
+		{"photos/2019/italy", -1, nil, []string{"photos", "2019", "italy"}},
+		{"photos/2019/italy", 2, nil, []string{"photos", "2019"}},
+		{"photos/2019/italy", 1, nil, []string{"photos"}},
+		{"photos/Misc/italy", -1, []string{"misc"}, []string{"photos", "italy"}},
+		{"photos/.thumbnails", -1, nil, []string{"photos"}},
+		{"", -1, nil, nil},
+		{"../other", -1, nil, nil},
+	}
+	for _, condition := range conditions {
+		tags := newDirectoryTags(nil, root, condition.depth, condition.stopWords)
+		names := tags.names(filepath.Join(root, filepath.FromSlash(condition.dir)))
+		if !reflect.DeepEqual(names, condition.expected) {
+			t.Errorf("Expected %v for %s at depth %d but got %v", condition.expected, condition.dir, condition.depth,
+				names)
+		}
+	}
+}
+
+// Verifies indexing with directory tags tags new files with their directories.
+func TestIndexPathIntoStoreWithDirectoryTags(t *testing.T) {
+	store := newMemoryStore()
+	options := Options{DirectoryTagDepth: -1, StopWords: []string{"SUBDIR2"}}
+	if err := IndexPathIntoStoreWithOptions(context.Background(), store, getTestDataDirectory(), options); err != nil {
+		t.Fatalf("Could not index %s: %v", getTestDataDirectory(), err)
+	}
+	conditions := []struct {
+		name         string
+		expectedTags []string
+	}{
+		{"one.txt", []string{"document"}},
+		{"four.md", []string{"document", "subdir1"}},
+		{"three.txt", []string{"document", "subdir1"}},
+	}
+	for _, condition := range conditions {
+		var tags []string
+		for _, tag := range store.fileTags[store.files[condition.name].Id] {
+			tags = append(tags, tag.Text)
+		}
+		if !reflect.DeepEqual(tags, condition.expectedTags) {
+			t.Errorf("Expected %s to be tagged %v but got %v", condition.name, condition.expectedTags, tags)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package indexer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// TIFF tags of the IFDs read for the date a photo was taken.
+const (
+	exifDateTime         = 0x0132
+	exifIfdPointer       = 0x8769
+	exifDateTimeOriginal = 0x9003
+)
+
+// Layout of the dates recorded in EXIF, in the camera's local time.
+const exifDateLayout = "2006:01:02 15:04:05"
+
+// Reads the date a JPEG photo was taken from its EXIF metadata: when the picture was taken if recorded, when the image
+// was last changed otherwise. Reports false for other files and photos without a date.
+func exifDate(path string) (time.Time, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, false
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	var marker [2]byte
+	if _, err = io.ReadFull(reader, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return time.Time{}, false
+	}
+	// the EXIF metadata is in an APP1 segment ahead of the image data
+	for {
+		var header [4]byte
+		if _, err = io.ReadFull(reader, header[:]); err != nil || header[0] != 0xFF || header[1] == 0xDA {
+			return time.Time{}, false
+		}
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return time.Time{}, false
+		}
+		segment := make([]byte, length)
+		if _, err = io.ReadFull(reader, segment); err != nil {
+			return time.Time{}, false
+		}
+		if header[1] == 0xE1 && strings.HasPrefix(string(segment), "Exif\x00\x00") {
+			return tiffDate(segment[6:])
+		}
+	}
+}
+
+// Reads the date from the TIFF structure holding the EXIF metadata, see exifDate.
+func tiffDate(tiff []byte) (time.Time, bool) {
+	if len(tiff) < 8 {
+		return time.Time{}, false
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return time.Time{}, false
+	}
+	ifd0 := readIfd(tiff, order, order.Uint32(tiff[4:]))
+	if exif, ok := ifd0[exifIfdPointer]; ok && len(exif) == 4 {
+		if date, ok := parseExifDate(readIfd(tiff, order, order.Uint32(exif))[exifDateTimeOriginal]); ok {
+			return date, true
+		}
+	}
+	return parseExifDate(ifd0[exifDateTime])
+}
+
+// Reads the entries of an IFD holding ASCII strings or a single LONG, the only ones exifDate needs, by tag. The bytes
+// of each value are returned as they are.
+func readIfd(tiff []byte, order binary.ByteOrder, offset uint32) map[uint16][]byte {
+	entries := make(map[uint16][]byte)
+	if int64(offset)+2 > int64(len(tiff)) {
+		return entries
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < count; i++ {
+		start := int(offset) + 2 + i*12
+		if start+12 > len(tiff) {
+			break
+		}
+		entry := tiff[start : start+12]
+		tag, kind, size := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+		switch {
+		// ASCII, inline up to 4 bytes and at an offset otherwise
+		case kind == 2 && size <= 4:
+			entries[tag] = entry[8 : 8+size]
+		case kind == 2:
+			at := order.Uint32(entry[8:])
+			if int64(at)+int64(size) <= int64(len(tiff)) {
+				entries[tag] = tiff[at : at+size]
+			}
+		// LONG
+		case kind == 4 && size == 1:
+			entries[tag] = entry[8:12]
+		}
+	}
+	return entries
+}
+
+// Parses an EXIF date, which may be missing or blank when the camera didn't know it.
+func parseExifDate(value []byte) (time.Time, bool) {
+	date, err := time.ParseInLocation(exifDateLayout, strings.TrimRight(string(value), "\x00 "), time.Local)
+	return date, err == nil
+}
@@ -0,0 +1,86 @@
+package indexer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies the date photos were taken is read from their EXIF metadata in either byte order.
+func TestExifDate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		content      []byte
+		expectedDate string
+	}{
+		{jpegWithExif(binary.LittleEndian, "2023:07:14 10:22:01", "2024:01:02 03:04:05"), "2023-07-14 10:22:01"},
+		{jpegWithExif(binary.BigEndian, "2023:07:14 10:22:01", ""), "2023-07-14 10:22:01"},
+		{jpegWithExif(binary.BigEndian, "", "2024:01:02 03:04:05"), "2024-01-02 03:04:05"},
+		{jpegWithExif(binary.LittleEndian, "    :  :     :  :  ", ""), ""},
+		{[]byte{0xFF, 0xD8, 0xFF, 0xDA, 0, 2}, ""},
+		{[]byte("not a photo"), ""},
+	}
+	for i, condition := range conditions {
+		path := filepath.Join(dir, "photo.jpg")
+		if err = ioutil.WriteFile(path, condition.content, 0644); err != nil {
+			t.Fatalf("Could not write photo: %v", err)
+		}
+		date, ok := exifDate(path)
+		if ok != (condition.expectedDate != "") ||
+			(ok && date.Format("2006-01-02 15:04:05") != condition.expectedDate) {
+			t.Errorf("Expected %q for condition %d but got %v (%v)", condition.expectedDate, i, date, ok)
+		}
+	}
+}
+
+// Builds a JPEG with an APP0 segment and an APP1 segment of EXIF metadata holding the dates passed in, left out if
+// empty: original, when the picture was taken, and modified, when the image was last changed.
+func jpegWithExif(order binary.ByteOrder, original string, modified string) []byte {
+	// the header, IFD0 with the date modified and a pointer to the EXIF IFD, the EXIF IFD, then the strings
+	tiff := make([]byte, 8+2+2*12+4+2+12+4)
+	var values []byte
+	addString := func(value string) uint32 {
+		at := uint32(len(tiff) + len(values))
+		values = append(values, value...)
+		values = append(values, 0)
+		return at
+	}
+	writeEntry := func(at int, tag uint16, kind uint16, count uint32, value uint32) {
+		order.PutUint16(tiff[at:], tag)
+		order.PutUint16(tiff[at+2:], kind)
+		order.PutUint32(tiff[at+4:], count)
+		order.PutUint32(tiff[at+8:], value)
+	}
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	exifIfd := 8 + 2 + 2*12 + 4
+	order.PutUint16(tiff[8:], 2)
+	if modified != "" {
+		writeEntry(10, exifDateTime, 2, uint32(len(modified)+1), addString(modified))
+	}
+	writeEntry(22, exifIfdPointer, 4, 1, uint32(exifIfd))
+	order.PutUint16(tiff[exifIfd:], 1)
+	if original != "" {
+		writeEntry(exifIfd+2, exifDateTimeOriginal, 2, uint32(len(original)+1), addString(original))
+	}
+	segment := append([]byte("Exif\x00\x00"), append(tiff, values...)...)
+	var jpeg bytes.Buffer
+	jpeg.Write([]byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 7, 'J', 'F', 'I', 'F', 0})
+	jpeg.Write([]byte{0xFF, 0xE1})
+	binary.Write(&jpeg, binary.BigEndian, uint16(len(segment)+2))
+	jpeg.Write(segment)
+	jpeg.Write([]byte{0xFF, 0xDA, 0, 2})
+	return jpeg.Bytes()
+}
@@ -0,0 +1,197 @@
+package indexer
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Largest file text is extracted from; bigger ones are left alone rather than read into memory.
+const maxExtractedFileSize = 64 << 20
+
+// Most text extracted from a file, enough for the keywords of any sensible document.
+const maxExtractedText = 1 << 20
+
+// Extracts the text of a document.
+type textExtractor func(path string) (string, error)
+
+// Extractors of the text of documents, by lower case extension. Office documents are zip files of XML parts; the
+// parts holding their text are listed by pattern.
+var textExtractors = map[string]textExtractor{
+	".pdf":  extractPdfText,
+	".docx": zippedXmlText("word/document.xml", "word/header*.xml", "word/footer*.xml"),
+	".pptx": zippedXmlText("ppt/slides/slide*.xml"),
+	".xlsx": zippedXmlText("xl/sharedStrings.xml"),
+	".odt":  zippedXmlText("content.xml"),
+	".odp":  zippedXmlText("content.xml"),
+	".ods":  zippedXmlText("content.xml"),
+}
+
+// Extracts the text of a document if its extension is one of textExtractors, reporting false otherwise or if it is
+// larger than maxExtractedFileSize. Only the first maxExtractedText bytes of the text are returned.
+func extractText(path string, info os.FileInfo) (string, bool, error) {
+	extract, ok := textExtractors[strings.ToLower(filepath.Ext(path))]
+	if !ok || info.Size() > maxExtractedFileSize {
+		return "", false, nil
+	}
+	text, err := extract(path)
+	if err != nil {
+		return "", false, err
+	}
+	if len(text) > maxExtractedText {
+		text = text[:maxExtractedText]
+	}
+	return text, true, nil
+}
+
+// Returns an extractor reading the character data of the XML parts of a zip file matching the patterns, in the order
+// of the patterns.
+func zippedXmlText(patterns ...string) textExtractor {
+	return func(filename string) (string, error) {
+		archive, err := zip.OpenReader(filename)
+		if err != nil {
+			return "", err
+		}
+		defer archive.Close()
+		var text bytes.Buffer
+		for _, pattern := range patterns {
+			for _, part := range archive.File {
+				if matched, _ := path.Match(pattern, part.Name); !matched {
+					continue
+				}
+				if err = appendXmlText(&text, part); err != nil {
+					return "", err
+				}
+				if text.Len() > maxExtractedText {
+					return text.String(), nil
+				}
+			}
+		}
+		return text.String(), nil
+	}
+}
+
+// Appends the character data of an XML part of a zip file to the text, separating the elements by spaces so words in
+// adjacent paragraphs or cells don't run together.
+func appendXmlText(text *bytes.Buffer, part *zip.File) error {
+	reader, err := part.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	decoder := xml.NewDecoder(reader)
+	for text.Len() <= maxExtractedText {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch token := token.(type) {
+		case xml.CharData:
+			text.Write(token)
+		case xml.EndElement:
+			text.WriteByte(' ')
+		}
+	}
+	return nil
+}
+
+// Extracts the literal strings shown by the content streams of a PDF. Streams are inflated if they are compressed
+// (FlateDecode, by far the most common filter) and read as they are otherwise. Text drawn with fonts that map glyphs to
+// other codes (hex strings) isn't readable this way, and scanned documents have no text at all until OCRed.
+func extractPdfText(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var text bytes.Buffer
+	for len(content) > 0 && text.Len() <= maxExtractedText {
+		start := bytes.Index(content, []byte("stream"))
+		if start < 0 {
+			break
+		}
+		content = content[start+len("stream"):]
+		// the keyword is followed by CRLF or LF
+		content = bytes.TrimPrefix(bytes.TrimPrefix(content, []byte("\r")), []byte("\n"))
+		end := bytes.Index(content, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := content[:end]
+		content = content[end+len("endstream"):]
+		if reader, err := zlib.NewReader(bytes.NewReader(stream)); err == nil {
+			if inflated, err := ioutil.ReadAll(reader); err == nil {
+				stream = inflated
+			}
+		}
+		appendPdfStrings(&text, stream)
+	}
+	return text.String(), nil
+}
+
+// Appends the literal strings, i.e. (Hello world), of a content stream to the text, undoing the escapes in them. Each
+// string is followed by a space, except within arrays, i.e. [(Hel) -20 (lo)] TJ, which split words to kern them.
+func appendPdfStrings(text *bytes.Buffer, stream []byte) {
+	inArray := false
+	for i := 0; i < len(stream); i++ {
+		switch stream[i] {
+		case '[':
+			inArray = true
+			continue
+		case ']':
+			inArray = false
+			text.WriteByte(' ')
+			continue
+		case '(':
+		default:
+			continue
+		}
+		depth := 1
+		for i++; i < len(stream) && depth > 0; i++ {
+			switch c := stream[i]; c {
+			case '\\':
+				if i+1 < len(stream) {
+					i++
+					switch escaped := stream[i]; {
+					case escaped == 'n' || escaped == 'r' || escaped == 't':
+						text.WriteByte(' ')
+					case escaped >= '0' && escaped <= '7':
+						// up to three octal digits
+						code := escaped - '0'
+						for digits := 1; digits < 3 && i+1 < len(stream) && stream[i+1] >= '0' &&
+							stream[i+1] <= '7'; digits++ {
+							i++
+							code = code*8 + stream[i] - '0'
+						}
+						text.WriteByte(code)
+					default:
+						text.WriteByte(escaped)
+					}
+				}
+			case '(':
+				depth++
+				text.WriteByte(c)
+			case ')':
+				depth--
+				if depth > 0 {
+					text.WriteByte(c)
+				}
+			default:
+				text.WriteByte(c)
+			}
+		}
+		if !inArray {
+			text.WriteByte(' ')
+		}
+		i--
+	}
+}
@@ -0,0 +1,101 @@
+package indexer
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Verifies the text of PDFs and office documents is extracted and other files are left alone.
+func TestExtractText(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		name  string
+		write func(path string) error
+		// words expected in the text, none if the text isn't expected to be extracted
+		expectedWords []string
+	}{
+		{"plain.pdf", func(path string) error { return writePdf(path, "BT (Invoice \\(paid\\)) Tj ET", false) },
+			[]string{"Invoice (paid)"}},
+		{"kerned.pdf", func(path string) error { return writePdf(path, "BT [(Inv) -20 (oice)] TJ (\\124otal) Tj ET", true) },
+			[]string{"Invoice", "Total"}},
+		{"letter.docx", func(path string) error {
+			return writeZip(path, map[string]string{"word/document.xml": "<w:document xmlns:w=\"w\"><w:p>" +
+				"<w:r><w:t>Bank</w:t></w:r></w:p><w:p><w:r><w:t>statement</w:t></w:r></w:p></w:document>",
+				"word/styles.xml": "<styles>ignored</styles>"})
+		}, []string{"Bank statement"}},
+		{"sheet.ods", func(path string) error {
+			return writeZip(path, map[string]string{"content.xml": "<doc><cell>Receipt</cell></doc>"})
+		}, []string{"Receipt"}},
+		{"notes.txt", func(path string) error { return ioutil.WriteFile(path, []byte("invoice"), 0644) }, nil},
+	}
+	for _, condition := range conditions {
+		path := filepath.Join(dir, condition.name)
+		if err = condition.write(path); err != nil {
+			t.Fatalf("Could not write %s: %v", condition.name, err)
+		}
+		info, _ := os.Stat(path)
+		text, ok, err := extractText(path, info)
+		if err != nil || ok != (condition.expectedWords != nil) {
+			t.Errorf("Unexpected extraction from %s: %v (%v)", condition.name, ok, err)
+		}
+		for _, words := range condition.expectedWords {
+			if !strings.Contains(normalizeWords(text), normalizeWords(words)) {
+				t.Errorf("Expected the text of %s to contain %q but got %q", condition.name, words, text)
+			}
+		}
+	}
+	// documents that aren't what their extension says fail
+	broken := filepath.Join(dir, "broken.docx")
+	ioutil.WriteFile(broken, []byte("not a zip"), 0644)
+	info, _ := os.Stat(broken)
+	if _, _, err = extractText(broken, info); err == nil {
+		t.Error("Expected extracting the text of a broken document to fail")
+	}
+}
+
+// Writes a PDF with a single content stream, compressed if asked to.
+func writePdf(path string, content string, compress bool) error {
+	stream := []byte(content)
+	filter := ""
+	if compress {
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(stream)
+		writer.Close()
+		stream, filter = compressed.Bytes(), " /Filter /FlateDecode"
+	}
+	pdf := fmt.Sprintf("%%PDF-1.4\n1 0 obj\n<< /Length %d%s >>\nstream\n%s\nendstream\nendobj\n%%%%EOF\n", len(stream),
+		filter, stream)
+	return ioutil.WriteFile(path, []byte(pdf), 0644)
+}
+
+// Writes a zip file of the parts passed in, by name.
+func writeZip(path string, parts map[string]string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for name, content := range parts {
+		part, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = part.Write([]byte(content)); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,189 @@
+package indexer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Name of the files listing the paths the indexer leaves out of the directory they are in, with the syntax of
+// .gitignore files.
+const IgnoreFile = ".cotfsignore"
+
+// A line of an ignore file, or an exclude pattern.
+type ignoreRule struct {
+	pattern *regexp.Regexp
+	// re-includes the paths matched, i.e. !important.log
+	negate bool
+	// only matches directories, i.e. cache/
+	dirOnly bool
+}
+
+// Tells which paths of a walk to leave out: the ones matching the exclude patterns or the rules of the ignore files of
+// the directories they are in. As with .gitignore files, the rules of deeper directories win over the ones above and,
+// within a file, later lines over earlier ones; exclude patterns come before all ignore files. Nothing in an ignored
+// directory is looked at, so its paths can't be re-included.
+type ignoreMatcher struct {
+	root     string
+	excludes []ignoreRule
+	// rules of the ignore files read so far, by the directory they are in
+	rules map[string][]ignoreRule
+}
+
+// Creates a matcher for a walk of root with exclude patterns, in the syntax of the lines of ignore files and relative
+// to root. Returns an error naming the first pattern that is invalid.
+func newIgnoreMatcher(root string, excludes []string) (*ignoreMatcher, error) {
+	matcher := &ignoreMatcher{root: filepath.Clean(root), rules: make(map[string][]ignoreRule)}
+	for _, exclude := range excludes {
+		rule, ok, err := parseIgnoreRule(exclude)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %v", exclude, err)
+		}
+		if ok {
+			matcher.excludes = append(matcher.excludes, rule)
+		}
+	}
+	return matcher, nil
+}
+
+// Checks exclude patterns are valid, returning an error naming the first one that isn't.
+func CheckExcludes(excludes []string) error {
+	_, err := newIgnoreMatcher("", excludes)
+	return err
+}
+
+// Reads the ignore file of a directory of the walk, if it has one, so its rules apply to the paths under it. Lines
+// that aren't valid patterns are skipped.
+func (m *ignoreMatcher) readDir(dir string) error {
+	file, err := os.Open(filepath.Join(dir, IgnoreFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var rules []ignoreRule
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok, err := parseIgnoreRule(scanner.Text()); ok && err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	m.rules[filepath.Clean(dir)] = rules
+	return scanner.Err()
+}
+
+// Reports whether a path of the walk is left out. The root itself never is, and ignore files always are.
+func (m *ignoreMatcher) ignored(path string, isDir bool) bool {
+	path = filepath.Clean(path)
+	if path == m.root {
+		return false
+	}
+	if !isDir && filepath.Base(path) == IgnoreFile {
+		return true
+	}
+	ignored := m.match(m.excludes, m.root, path, isDir, false)
+	// the directories from the root down to the one the path is in
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == m.root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		ignored = m.match(m.rules[dirs[i]], dirs[i], path, isDir, ignored)
+	}
+	return ignored
+}
+
+// Applies rules relative to a directory to a path, returning whether the path is ignored given whether it was before.
+func (m *ignoreMatcher) match(rules []ignoreRule, dir string, path string, isDir bool, ignored bool) bool {
+	if len(rules) == 0 {
+		return ignored
+	}
+	relative, err := filepath.Rel(dir, path)
+	if err != nil {
+		return ignored
+	}
+	relative = filepath.ToSlash(relative)
+	for _, rule := range rules {
+		if (!rule.dirOnly || isDir) && rule.pattern.MatchString(relative) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// Parses a line of an ignore file, reporting false for blank lines and comments. Patterns with a slash other than at
+// the end are relative to the directory of the file, others match names at any depth below it; * and ? match within a
+// name and ** across directories.
+func parseIgnoreRule(line string) (ignoreRule, bool, error) {
+	var rule ignoreRule
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false, nil
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false, nil
+	}
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	expression := "^"
+	if !anchored {
+		expression += "(?:.*/)?"
+	}
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case strings.HasPrefix(line[i:], "**/"):
+			expression += "(?:.*/)?"
+			i += 2
+		case strings.HasPrefix(line[i:], "/**") && i+3 == len(line):
+			expression += "/.*"
+			i += 2
+		case strings.HasPrefix(line[i:], "**"):
+			expression += ".*"
+			i++
+		case c == '*':
+			expression += "[^/]*"
+		case c == '?':
+			expression += "[^/]"
+		case c == '[':
+			end := strings.IndexByte(line[i+1:], ']')
+			if end < 0 {
+				return rule, false, fmt.Errorf("unterminated [ in %s", line)
+			}
+			class := line[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expression += "[" + class + "]"
+			i += end + 1
+		case c == '\\' && i+1 < len(line):
+			i++
+			expression += regexp.QuoteMeta(line[i : i+1])
+		default:
+			expression += regexp.QuoteMeta(line[i : i+1])
+		}
+	}
+	pattern, err := regexp.Compile(expression + "$")
+	if err != nil {
+		return rule, false, err
+	}
+	rule.pattern = pattern
+	return rule, true, nil
+}
@@ -0,0 +1,111 @@
+package indexer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Verifies paths are matched against exclude patterns and the ignore files of the directories above them.
+func TestIgnoreMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "src", "logs"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, IgnoreFile), []byte("# build output\n*.log\n/build/\ncache/\n"+
+		"docs/**/draft?.md\n\\#notes\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "src", IgnoreFile), []byte("!keep.log\n[abc].tmp\n[!abc].bak\n"), 0644)
+	matcher, err := newIgnoreMatcher(dir, []string{"node_modules/", "*.tmp"})
+	if err != nil {
+		t.Fatalf("Could not create matcher: %v", err)
+	}
+	for _, readDir := range []string{dir, filepath.Join(dir, "src"), filepath.Join(dir, "src", "logs")} {
+		if err = matcher.readDir(readDir); err != nil {
+			t.Fatalf("Could not read the ignore file of %s: %v", readDir, err)
+		}
+	}
+	conditions := []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"", true, false},
+		{IgnoreFile, false, true},
+		{"app.log", false, true},
+		{"src/logs/app.log", false, true},
+		{"src/keep.log", false, false},
+		{"src/logs/keep.log", false, false},
+		{"keep.log", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, false},
+		{"cache", true, true},
+		{"src/cache", true, true},
+		{"cache", false, false},
+		{"node_modules", true, true},
+		{"src/node_modules", true, true},
+		{"x.tmp", false, true},
+		{"docs/draft1.md", false, true},
+		{"docs/2019/07/draft2.md", false, true},
+		{"docs/final.md", false, false},
+		{"#notes", false, true},
+		{"src/a.tmp", false, true},
+		{"src/a.bak", false, false},
+		{"src/d.bak", false, true},
+		{"app.txt", false, false},
+	}
+	for _, condition := range conditions {
+		path := filepath.Join(dir, filepath.FromSlash(condition.path))
+		if ignored := matcher.ignored(path, condition.isDir); ignored != condition.expected {
+			t.Errorf("Expected %s (directory: %v) to be ignored: %v", condition.path, condition.isDir,
+				condition.expected)
+		}
+	}
+	if _, err = newIgnoreMatcher(dir, []string{"[abc"}); err == nil {
+		t.Error("Expected an invalid exclude pattern to fail")
+	}
+	if err = CheckExcludes([]string{"*.tmp", "[abc"}); err == nil {
+		t.Error("Expected checking an invalid exclude pattern to fail")
+	}
+}
+
+// Verifies indexing leaves out the paths excluded or ignored.
+func TestIndexPathIntoStoreWithIgnores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"index.js", "node_modules/lib/lib.js", "photos/IMG.jpg", "photos/IMG.jpg.tmp",
+		"photos/.thumbs/thumb.jpg"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err = ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", name, err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "photos", IgnoreFile), []byte(".thumbs/\n"), 0644)
+	store := newMemoryStore()
+	options := Options{Exclude: []string{"node_modules/", "*.tmp"}}
+	if err = IndexPathIntoStoreWithOptions(context.Background(), store, dir, options); err != nil {
+		t.Fatalf("Could not index %s: %v", dir, err)
+	}
+	var indexed []string
+	for _, file := range store.files {
+		relative, _ := filepath.Rel(dir, filepath.Join(file.Path, file.Name))
+		indexed = append(indexed, filepath.ToSlash(relative))
+	}
+	sort.Strings(indexed)
+	if len(indexed) != 2 || indexed[0] != "index.js" || indexed[1] != "photos/IMG.jpg" {
+		t.Errorf("Expected index.js and photos/IMG.jpg to be indexed but got %v", indexed)
+	}
+	options.Exclude = []string{"[a"}
+	if err = IndexPathIntoStoreWithOptions(context.Background(), store, dir, options); err == nil {
+		t.Error("Expected indexing with an invalid exclude pattern to fail")
+	}
+}
@@ -1,18 +1,68 @@
 package indexer
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
 	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/findertags"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 var defaultTag = "uncategorized"
 
-//TODO: externalize into configuration file
+// Number of new files added to the metadata database at a time.
+const createBatchSize = 500
+
+// Settings for indexing. The zero value indexes files as IndexPath does.
+type Options struct {
+	// tags applied to files by their lower case extension (with the dot), those of extensionToTagMap if nil; see
+	// LoadTagMap
+	TagMap map[string][]string
+	// tags applied to documents whose text contains the keywords, by keyword, none if nil; see LoadKeywordRules
+	KeywordRules map[string][]string
+	// number of directories, from the top, of the path of a file below the directory indexed that become tags of the
+	// file, none if 0 and all of them if negative
+	DirectoryTagDepth int
+	// names of directories not made tags, regardless of case
+	StopWords []string
+	// tags files with the year and month they date from (i.e. 2023 and 2023-07), see fileDate
+	DateTags bool
+	// patterns of the paths left out, relative to the directory indexed, in the syntax of the lines of IgnoreFile
+	Exclude []string
+	// number of files indexed at a time, each by a worker of its own, 1 if not positive
+	Workers int
+}
+
+// Returns the number of workers indexing files, see Options.Workers.
+func (o Options) workers() int {
+	if o.Workers < 1 {
+		return 1
+	}
+	return o.Workers
+}
+
+// The tags a run applies to the files it indexes. Shared by the workers of the run.
+type tagInference struct {
+	// guards the tags looked up as files are found, see forNewFile
+	mutex sync.Mutex
+	// tags applied by extension, see initTagCache
+	extensions map[string][]metadata.TagInfo
+	// tags applied to documents by the keywords in their text, none if nil
+	keywords map[string][]metadata.TagInfo
+	// tags applied by the directories files are in, none if nil
+	directories *directoryTags
+	// tags applied by the dates of files, none if nil
+	dates *dateTags
+}
+
+// Tags applied to files by their extension unless a tag map overrides them, see LoadTagMap.
 var extensionToTagMap = map[string][]string{
 	".jpg":     {"media", "image"},
 	".jpeg":    {"media", "image"},
@@ -75,54 +125,249 @@ var extensionToTagMap = map[string][]string{
 	".js":      {"code", "javascript", "web"},
 }
 
-// Indexes a single path and adds any files found to the filesystem metadata database.
+// Indexes a single path and adds any files found to the filesystem metadata database, or to a bolt store if the path
+// names one (see boltstore.IsPath). Only one process indexes into the same database at a time; others wait for it to
+// finish.
 func IndexPath(pathToIndex string, metadataPath string) error {
-	database, err := db.Open(metadataPath)
+	return IndexPathContext(context.Background(), pathToIndex, metadataPath)
+}
+
+// Same as IndexPath but stops, returning the context's error, once the context is done.
+func IndexPathContext(ctx context.Context, pathToIndex string, metadataPath string) error {
+	return IndexPathWithOptions(ctx, pathToIndex, metadataPath, Options{})
+}
+
+// Same as IndexPathContext but indexes the files as set by the options.
+func IndexPathWithOptions(ctx context.Context, pathToIndex string, metadataPath string, options Options) error {
+	return withStore(metadataPath, func(store db.MetadataStore) error {
+		return IndexPathIntoStoreWithOptions(ctx, store, pathToIndex, options)
+	})
+}
+
+// Same as IndexPathWithOptions but indexes several paths in turn, opening the metadata database once. Returns what
+// each worker did over all the paths, see IndexPathsIntoStoreWithOptions.
+func IndexPathsWithOptions(ctx context.Context, pathsToIndex []string, metadataPath string,
+	options Options) ([]WorkerStats, error) {
+	var stats []WorkerStats
+	err := withStore(metadataPath, func(store db.MetadataStore) error {
+		var err error
+		stats, err = IndexPathsIntoStoreWithOptions(ctx, store, pathsToIndex, options)
+		return err
+	})
+	return stats, err
+}
+
+// Opens the store of a metadata path, see IndexPath, for the duration of a function.
+func withStore(metadataPath string, do func(store db.MetadataStore) error) error {
+	if boltstore.IsPath(metadataPath) {
+		// bolt files are locked by the process that has them open
+		store, err := boltstore.Open(metadataPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		return do(store)
+	}
+	unlock, err := db.LockExclusive(metadataPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	database, err := db.OpenWithOptions(metadataPath, db.OpenOptions{Source: db.SourceIndexer})
+	if err != nil {
+		return err
+	}
+	defer db.Close(database)
+	return do(db.NewSQLiteStore(database))
+}
+
+// Lists the latest runs of the indexer recorded in a metadata database, at most limit of them (all of them if limit is
+// 0). Bolt stores aren't supported as they can't be queried.
+func Runs(metadataPath string, limit int) ([]metadata.IndexRun, error) {
+	if boltstore.IsPath(metadataPath) {
+		return nil, fmt.Errorf("%s is a bolt store, whose runs can't be listed", metadataPath)
+	}
+	database, err := db.OpenWithOptions(metadataPath, db.OpenOptions{Source: db.SourceIndexer})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close(database)
+	return db.GetIndexRuns(database, limit)
+}
+
+// Indexes a single path and adds any files found to an already open metadata database.
+func IndexPathInto(database *sql.DB, pathToIndex string) error {
+	return IndexPathIntoContext(context.Background(), database, pathToIndex)
+}
+
+// Same as IndexPathInto but stops, returning the context's error, once the context is done.
+func IndexPathIntoContext(ctx context.Context, database *sql.DB, pathToIndex string) error {
+	return IndexPathIntoStore(ctx, db.NewSQLiteStore(database), pathToIndex)
+}
+
+// Indexes a single path and adds any files found to a metadata store. Stops, returning the context's error, once the
+// context is done. The pass is recorded as an indexer run, with the files it added or found changed, so they can be
+// told apart from the ones of other runs; the run is only recorded as finished if the whole path was indexed.
+func IndexPathIntoStore(ctx context.Context, store db.MetadataStore, pathToIndex string) error {
+	return IndexPathIntoStoreWithOptions(ctx, store, pathToIndex, Options{})
+}
+
+// Same as IndexPathIntoStore but indexes the files as set by the options.
+func IndexPathIntoStoreWithOptions(ctx context.Context, store db.MetadataStore, pathToIndex string,
+	options Options) error {
+	return indexPathIntoStore(ctx, store, pathToIndex, options, make([]WorkerStats, options.workers()))
+}
+
+// Same as IndexPathIntoStoreWithOptions but indexes several paths in turn, each in a run of its own, returning what
+// each worker did over all of them. A path that can't be indexed doesn't stop the others: the error of the first one
+// is returned once they are done, unless the context is done first.
+func IndexPathsIntoStoreWithOptions(ctx context.Context, store db.MetadataStore, pathsToIndex []string,
+	options Options) ([]WorkerStats, error) {
+	stats := make([]WorkerStats, options.workers())
+	var firstErr error
+	for _, pathToIndex := range pathsToIndex {
+		err := indexPathIntoStore(ctx, store, pathToIndex, options, stats)
+		if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+		if err != nil {
+			log.Printf("Could not index %s: %s", pathToIndex, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return stats, firstErr
+}
+
+// Indexes a path in a run of its own, adding what each worker did to its stats.
+func indexPathIntoStore(ctx context.Context, store db.MetadataStore, pathToIndex string, options Options,
+	stats []WorkerStats) error {
+	tagMap := options.TagMap
+	if tagMap == nil {
+		tagMap = extensionToTagMap
+	}
+	inference := &tagInference{extensions: initTagCache(ctx, store, tagMap)}
+	if options.KeywordRules != nil {
+		inference.keywords = resolveTags(ctx, store, options.KeywordRules)
+	}
+	ignores, err := newIgnoreMatcher(pathToIndex, options.Exclude)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.Abs(pathToIndex)
+	if err != nil {
+		return err
+	}
+	if options.DirectoryTagDepth != 0 {
+		inference.directories = newDirectoryTags(store, pathToIndex, options.DirectoryTagDepth, options.StopWords)
+	}
+	if options.DateTags {
+		inference.dates = newDateTags(store)
+	}
+	run, err := store.StartIndexRun(ctx, root)
 	if err != nil {
 		return err
 	}
-	defer database.Close()
-	tagCache := initTagCache(database, extensionToTagMap)
 	//TODO if we support other types of paths (i.e. google, s3, etc) figure out the scheme and call right func here
-	return indexLocalDirectory(database, pathToIndex, tagCache)
+	if err = indexLocalDirectory(ctx, store, run.Id, pathToIndex, inference, ignores, stats); err != nil {
+		return err
+	}
+	return store.FinishIndexRun(ctx, run.Id)
 }
 
-// Indexes a single local directory (recursively). Any files discovered will be added to the metadata database.
-func indexLocalDirectory(database *sql.DB, pathToIndex string, tagCache map[string][]metadata.TagInfo) error {
-	return filepath.Walk(pathToIndex, func(path string, info os.FileInfo, err error) error {
-		// we only care about files for now
-		if info.IsDir() {
-			//TODO maybe create tags for some of the subdirs?
-			return nil
+// Indexes a single local directory (recursively) as part of an indexer run. Any files discovered, other than the ones
+// ignored, will be added to the metadata database: the walk of the directory hands them to a worker per stats, which
+// adds what it did to its stats.
+func indexLocalDirectory(ctx context.Context, store db.MetadataStore, runId int64, pathToIndex string,
+	inference *tagInference, ignores *ignoreMatcher, stats []WorkerStats) error {
+	files := make(chan walkedFile, len(stats))
+	var wg sync.WaitGroup
+	wg.Add(len(stats))
+	for i := range stats {
+		worker := &indexWorker{store: store, runId: runId, inference: inference, stats: &stats[i]}
+		go func() {
+			defer wg.Done()
+			worker.run(ctx, files)
+		}()
+	}
+	err := walkFiles(ctx, pathToIndex, ignores, files)
+	close(files)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Records what is known about a file in the store: its details, the tags applied to it in Finder and, if the run
+// created it or found it changed, the run and the tags of the keywords found in its text.
+func indexFile(ctx context.Context, store db.MetadataStore, runId int64, file metadata.FileInfo, path string,
+	info os.FileInfo, created bool, inference *tagInference) {
+	// refresh the details even for known files so re-indexing picks up changes
+	changed, err := recordDetails(ctx, store, file.Id, path, info)
+	if err != nil {
+		log.Printf("Could not record the details of %s: %s", path, err)
+	}
+	if created || changed {
+		if err = store.SetFileIndexRun(ctx, file.Id, runId, created); err != nil {
+			log.Printf("Could not record the indexer run of %s: %s", path, err)
 		}
-		// first see if the file is already in the database
-		existingFile, _ := db.FindFileByAbsPath(database, filepath.Base(path), filepath.Dir(path))
-		if existingFile.Id == metadata.UnknownFile.Id {
-			// get count of files with that name
-			tags := inferTagsFromFile(path, tagCache)
-			_, err := db.CreateFileInPath(database, filepath.Base(path), filepath.Dir(path), tags)
-			if err != nil {
-				log.Printf("Could not add file %s", err)
+		if inference.keywords != nil {
+			if err = tagByKeywords(ctx, store, file, path, info, inference.keywords); err != nil {
+				log.Printf("Could not tag %s by its keywords: %s", path, err)
 			}
 		}
-		return nil
-	})
+	}
+	// tags applied in Finder (macOS only) become tags of the file
+	if err := findertags.Import(ctx, store, file); err != nil {
+		log.Printf("Could not import the Finder tags of %s: %s", path, err)
+	}
+}
+
+// Returns the tags applied to a file when it is first indexed.
+func (t *tagInference) forNewFile(ctx context.Context, path string, info os.FileInfo) []metadata.TagInfo {
+	tags := inferTagsFromFile(path, t.extensions)
+	if t.directories == nil && t.dates == nil {
+		return tags
+	}
+	// the tags of the extension are shared by all its files
+	tags = append([]metadata.TagInfo(nil), tags...)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.directories != nil {
+		tags = append(tags, t.directories.forFile(ctx, path)...)
+	}
+	if t.dates != nil {
+		tags = append(tags, t.dates.forFile(ctx, path, info)...)
+	}
+	return tags
+}
+
+// Converts the tag names in the tagsToMap map to TagInfo objects by looking them up in the store, along with the
+// default tag.
+func initTagCache(ctx context.Context, store db.MetadataStore,
+	tagsToMap map[string][]string) map[string][]metadata.TagInfo {
+	tagCache := resolveTags(ctx, store, tagsToMap)
+	defaultInfo, _ := store.AddTag(ctx, defaultTag, nil)
+	tagCache[defaultTag] = []metadata.TagInfo{defaultInfo}
+	return tagCache
 }
 
-// Converts the tag names in the tagsToMap map to TagInfo objects by looking them up in the DB.
-func initTagCache(database *sql.DB, tagsToMap map[string][]string) map[string][]metadata.TagInfo {
-	tagCache := make(map[string][]metadata.TagInfo)
+// Converts the tag names in the map to TagInfo objects, adding the tags missing from the store. The tags of each key
+// are associated with each other.
+func resolveTags(ctx context.Context, store db.MetadataStore,
+	tagsToMap map[string][]string) map[string][]metadata.TagInfo {
+	resolved := make(map[string][]metadata.TagInfo)
 	for key, val := range tagsToMap {
 		tags := make([]metadata.TagInfo, len(val))
 		for i, tagName := range val {
 			// db already supports returning existing tag if it already exists so we can just call Add blindly
-			tags[i], _ = db.AddTag(database, tagName, tags)
+			tags[i], _ = store.AddTag(ctx, tagName, tags[:i])
 		}
-		tagCache[key] = tags
+		resolved[key] = tags
 	}
-	defaultInfo, _ := db.AddTag(database, defaultTag, nil)
-	tagCache[defaultTag] = []metadata.TagInfo{defaultInfo}
-	return tagCache
+	return resolved
 }
 
 // Infers tags to attribute to a file based on its name/path. Uses the tagCache passed in to map file extensions to
@@ -1,14 +1,18 @@
 package indexer
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
 	"github.com/cfagiani/cotfs/internal/pkg/db"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 )
 
 // Verifies we can index a local directory correctly.
@@ -17,10 +21,12 @@ func TestIndexLocalDirectory(t *testing.T) {
 	defer database.Close()
 
 	// load the tags we'll use
-	tagCache := initTagCache(database, map[string][]string{
+	tagCache := initTagCache(context.Background(), db.NewSQLiteStore(database), map[string][]string{
 		".txt": {"text"},
 	})
-	err := indexLocalDirectory(database, getTestDataDirectory(), tagCache)
+	ignores, _ := newIgnoreMatcher(getTestDataDirectory(), nil)
+	err := indexLocalDirectory(context.Background(), db.NewSQLiteStore(database), 1, getTestDataDirectory(),
+		&tagInference{extensions: tagCache}, ignores, make([]WorkerStats, 1))
 	if err != nil {
 		t.Errorf("Could not index %s is that the right directory? %v", getTestDataDirectory(), err)
 	}
@@ -39,6 +45,9 @@ func TestIndexLocalDirectory(t *testing.T) {
 				len(condition.expectedFiles), condition.tag.Text, len(files))
 		} else {
 			for _, file := range files {
+				if _, _, ok, _ := db.GetFileStat(database, file.Id); !ok {
+					t.Errorf("Expected the size of %s to be recorded", file.Name)
+				}
 				found := false
 				for _, expectedFile := range condition.expectedFiles {
 					if expectedFile == file.Name {
@@ -52,6 +61,133 @@ func TestIndexLocalDirectory(t *testing.T) {
 			}
 		}
 	}
+	// the modification time of every file is recorded
+	years, _ := db.GetFileDates(database, nil)
+	if len(years) == 0 {
+		t.Error("Expected the modification times of indexed files to be recorded")
+	}
+}
+
+// Verifies indexing works against any metadata store.
+func TestIndexPathIntoStore(t *testing.T) {
+	store := newMemoryStore()
+	if err := IndexPathIntoStore(context.Background(), store, getTestDataDirectory()); err != nil {
+		t.Errorf("Could not index %s: %v", getTestDataDirectory(), err)
+	}
+	conditions := []struct {
+		name         string
+		expectedTags int
+	}{
+		{"one.txt", 1},
+		{"four.md", 1},
+	}
+	for _, condition := range conditions {
+		file, ok := store.files[condition.name]
+		if !ok {
+			t.Errorf("Expected %s to be indexed", condition.name)
+			continue
+		}
+		if len(store.fileTags[file.Id]) != condition.expectedTags {
+			t.Errorf("Expected %d tags on %s but got %v", condition.expectedTags, condition.name,
+				store.fileTags[file.Id])
+		}
+		if details := store.details[file.Id]; details.Checksum == "" || details.MimeType == "" {
+			t.Errorf("Expected the details of %s to be recorded but got %v", condition.name, details)
+		}
+	}
+	// indexing again finds the files already in the store
+	count := len(store.files)
+	IndexPathIntoStore(context.Background(), store, getTestDataDirectory())
+	if len(store.files) != count {
+		t.Errorf("Expected re-indexing not to add files but there are %d instead of %d", len(store.files), count)
+	}
+	// both runs are recorded, but the files unchanged since the first one are left to it
+	if len(store.runs) != 2 || store.runs[0].Root != getTestDataDirectory() || store.runs[1].Finished.IsZero() {
+		t.Errorf("Expected 2 finished runs over %s but got %v", getTestDataDirectory(), store.runs)
+	}
+	for _, file := range store.files {
+		if store.createdRuns[file.Id] != 1 || store.updatedRuns[file.Id] != 1 {
+			t.Errorf("Expected %s to be created and updated by the first run but got %d and %d", file.Name,
+				store.createdRuns[file.Id], store.updatedRuns[file.Id])
+		}
+	}
+}
+
+// Verifies metadata paths naming a bolt store are indexed into one.
+func TestIndexPathIntoBolt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metadataPath := filepath.Join(dir, "meta.bolt")
+	if err = IndexPath(getTestDataDirectory(), metadataPath); err != nil {
+		t.Fatalf("Could not index %s: %v", getTestDataDirectory(), err)
+	}
+	store, err := boltstore.Open(metadataPath)
+	if err != nil {
+		t.Fatalf("Could not open store: %v", err)
+	}
+	defer store.Close()
+	file, _ := store.FindFileByAbsPath(context.Background(), "three.txt",
+		filepath.Join(getTestDataDirectory(), "subdir1", "subdir2"))
+	tags, _ := store.GetTagsForFile(context.Background(), file.Id)
+	if len(tags) != 1 || tags[0].Text != "document" {
+		t.Errorf("Expected three.txt to be indexed with the document tag but found %v with %v", file, tags)
+	}
+	if _, err = Backfill(metadataPath); err == nil {
+		t.Error("Expected backfilling a bolt store to be refused")
+	}
+	if _, err = Runs(metadataPath, 0); err == nil {
+		t.Error("Expected listing the runs of a bolt store to be refused")
+	}
+}
+
+// Verifies each pass over a directory is listed as a run of the indexer.
+func TestRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	metadataPath := filepath.Join(dir, "meta.db")
+	for i := 0; i < 2; i++ {
+		if err = IndexPath(getTestDataDirectory(), metadataPath); err != nil {
+			t.Fatalf("Could not index %s: %v", getTestDataDirectory(), err)
+		}
+	}
+	runs, err := Runs(metadataPath, 0)
+	if err != nil || len(runs) != 2 || runs[0].Id != 2 || runs[0].Root != getTestDataDirectory() ||
+		runs[0].Finished.IsZero() {
+		t.Errorf("Expected 2 finished runs over %s but got %v (%v)", getTestDataDirectory(), runs, err)
+	}
+	database, err := db.Open(metadataPath)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close(database)
+	created, _ := db.GetFilesCreatedInRun(database, runs[1].Id, "")
+	updated, _ := db.GetFilesUpdatedInRun(database, runs[0].Id, "")
+	if len(created) != 4 || len(updated) != 0 {
+		t.Errorf("Expected the first run to create the 4 files and the second to change none but got %v and %v",
+			created, updated)
+	}
+}
+
+// Verifies indexing stops once its context is cancelled.
+func TestIndexPathIntoStoreCancelled(t *testing.T) {
+	store := newMemoryStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := IndexPathIntoStore(ctx, store, getTestDataDirectory()); err != context.Canceled {
+		t.Errorf("Expected indexing to be cancelled but got %v", err)
+	}
+	if len(store.files) != 0 {
+		t.Errorf("Expected no files to be indexed but got %d", len(store.files))
+	}
+	if len(store.runs) != 0 {
+		t.Errorf("Expected no run to be recorded but got %v", store.runs)
+	}
 }
 
 // Verifies we get the right tags based on file extension
@@ -94,7 +230,7 @@ func TestInitTagCache(t *testing.T) {
 		"two":   {"a", "b"},
 		"three": {"d", "e", "f"},
 	}
-	cachedTags := initTagCache(database, tagsToMap)
+	cachedTags := initTagCache(context.Background(), db.NewSQLiteStore(database), tagsToMap)
 	// now ensure we got what we expected
 	for key, val := range tagsToMap {
 		if len(val) != len(cachedTags[key]) {
@@ -136,3 +272,110 @@ func getTestDataDirectory() string {
 	return filepath.Clean(fmt.Sprintf("%s%c..%c..%c..%ctest%cdata%cindexer", testDir, os.PathSeparator,
 		os.PathSeparator, os.PathSeparator, os.PathSeparator, os.PathSeparator, os.PathSeparator))
 }
+
+// Minimal in-memory metadata store keyed by file name.
+type memoryStore struct {
+	// the methods the indexer doesn't use (those browsing and changing tags for the mount) panic if called
+	db.MetadataStore
+	tags     []metadata.TagInfo
+	files    map[string]metadata.FileInfo
+	fileTags map[int64][]metadata.TagInfo
+	details  map[int64]metadata.FileDetails
+	runs     []metadata.IndexRun
+	// ids of the runs that created and last updated each file
+	createdRuns map[int64]int64
+	updatedRuns map[int64]int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{files: make(map[string]metadata.FileInfo), fileTags: make(map[int64][]metadata.TagInfo),
+		details: make(map[int64]metadata.FileDetails), createdRuns: make(map[int64]int64),
+		updatedRuns: make(map[int64]int64)}
+}
+
+func (m *memoryStore) AddTag(ctx context.Context, name string, tagContext []metadata.TagInfo) (metadata.TagInfo,
+	error) {
+	for _, tag := range m.tags {
+		if tag.Text == name {
+			return tag, nil
+		}
+	}
+	tag := metadata.TagInfo{Id: int64(len(m.tags) + 1), Text: name}
+	m.tags = append(m.tags, tag)
+	return tag, nil
+}
+
+func (m *memoryStore) AddTags(ctx context.Context, names []string, tagContext []metadata.TagInfo) ([]metadata.TagInfo,
+	error) {
+	var tags []metadata.TagInfo
+	for _, name := range names {
+		tag, _ := m.AddTag(ctx, name, tagContext)
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (m *memoryStore) FindFileByAbsPath(ctx context.Context, name string, absPath string) (metadata.FileInfo, error) {
+	if file, ok := m.files[name]; ok && file.Path == absPath {
+		return file, nil
+	}
+	return metadata.UnknownFile, nil
+}
+
+func (m *memoryStore) CreateFileInPath(ctx context.Context, name string, absPath string,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
+	file := metadata.FileInfo{Id: int64(len(m.files) + 1), Name: name, Path: absPath}
+	m.files[name] = file
+	m.fileTags[file.Id] = tags
+	return file, nil
+}
+
+func (m *memoryStore) CreateFiles(ctx context.Context, entries []db.NewFile) ([]metadata.FileInfo, error) {
+	var files []metadata.FileInfo
+	for _, entry := range entries {
+		file, _ := m.CreateFileInPath(ctx, entry.Name, entry.Path, entry.Tags)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (m *memoryStore) GetFileDetails(ctx context.Context, fileId int64) (metadata.FileDetails, bool, error) {
+	details, ok := m.details[fileId]
+	return details, ok, nil
+}
+
+func (m *memoryStore) SetFileDetails(ctx context.Context, fileId int64, details metadata.FileDetails) error {
+	m.details[fileId] = details
+	return nil
+}
+
+func (m *memoryStore) GetTagsForFile(ctx context.Context, fileId int64) ([]metadata.TagInfo, error) {
+	return m.fileTags[fileId], nil
+}
+
+func (m *memoryStore) TagFile(ctx context.Context, fileId int64, tags []metadata.TagInfo) error {
+	m.fileTags[fileId] = append(m.fileTags[fileId], tags...)
+	return nil
+}
+
+func (m *memoryStore) StartIndexRun(ctx context.Context, root string) (metadata.IndexRun, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownIndexRun, err
+	}
+	run := metadata.IndexRun{Id: int64(len(m.runs) + 1), Root: root, Started: time.Now()}
+	m.runs = append(m.runs, run)
+	return run, nil
+}
+
+func (m *memoryStore) FinishIndexRun(ctx context.Context, runId int64) error {
+	m.runs[runId-1].Finished = time.Now()
+	return nil
+}
+
+func (m *memoryStore) SetFileIndexRun(ctx context.Context, fileId int64, runId int64, created bool) error {
+	m.updatedRuns[fileId] = runId
+	if created {
+		m.createdRuns[fileId] = runId
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package indexer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Reads a JSON file of keywords and the tags applied to documents containing them as a path of tags, e.g.
+// {"invoice": "finance/invoice", "bank statement": "finance/bank"}, the tags of a path being associated with each
+// other like the directories of the mount. Keywords are matched as whole words, regardless of case and punctuation.
+// Returns an error naming the first rule that is invalid: an empty keyword, one that differs from another only by case
+// or punctuation, or a path with an empty tag name.
+func LoadKeywordRules(path string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules map[string]string
+	if err = json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	keywordRules := make(map[string][]string, len(rules))
+	for keyword, tagPath := range rules {
+		normalized := normalizeWords(keyword)
+		if normalized == "" {
+			return nil, fmt.Errorf("%s: %q is not a keyword", path, keyword)
+		}
+		tags := strings.Split(strings.Trim(tagPath, "/"), "/")
+		for _, tag := range tags {
+			if !validTagName(tag) {
+				return nil, fmt.Errorf("%s: %q, the tags of %q, is not a path of tags such as finance/invoice", path,
+					tagPath, keyword)
+			}
+		}
+		if _, ok := keywordRules[normalized]; ok {
+			return nil, fmt.Errorf("%s: %q is the same keyword as another rule", path, keyword)
+		}
+		keywordRules[normalized] = tags
+	}
+	return keywordRules, nil
+}
+
+// Applies the tags of the keywords found in the text of a document to its file. Files whose text can't be extracted
+// are left alone.
+func tagByKeywords(ctx context.Context, store db.MetadataStore, file metadata.FileInfo, path string, info os.FileInfo,
+	keywordTags map[string][]metadata.TagInfo) error {
+	text, ok, err := extractText(path, info)
+	if err != nil || !ok {
+		return err
+	}
+	tags := matchKeywords(text, keywordTags)
+	if len(tags) == 0 {
+		return nil
+	}
+	return store.TagFile(ctx, file.Id, tags)
+}
+
+// Returns the tags of the keywords found in the text, each once.
+func matchKeywords(text string, keywordTags map[string][]metadata.TagInfo) []metadata.TagInfo {
+	// padded so keywords only match whole words
+	words := " " + normalizeWords(text) + " "
+	var matched []metadata.TagInfo
+	seen := make(map[int64]bool)
+	for keyword, tags := range keywordTags {
+		if !strings.Contains(words, " "+normalizeWords(keyword)+" ") {
+			continue
+		}
+		for _, tag := range tags {
+			if !seen[tag.Id] {
+				seen[tag.Id] = true
+				matched = append(matched, tag)
+			}
+		}
+	}
+	return matched
+}
+
+// Lower cases the words of a text and separates them by single spaces, dropping punctuation.
+func normalizeWords(text string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}), " ")
+}
@@ -0,0 +1,122 @@
+package indexer
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Verifies keyword rules are read as paths of tags by normalized keyword and invalid rules are reported.
+func TestLoadKeywordRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		content       string
+		expected      map[string][]string
+		expectedError string
+	}{
+		{`{"Invoice": "finance/invoice", "Bank  Statement": "/finance/bank/", "tax": "tax"}`,
+			map[string][]string{"invoice": {"finance", "invoice"}, "bank statement": {"finance", "bank"},
+				"tax": {"tax"}}, ""},
+		{`{"!?": "finance"}`, nil, `"!?" is not a keyword`},
+		{`{"invoice": "finance//invoice"}`, nil, "is not a path of tags"},
+		{`{"invoice": ""}`, nil, "is not a path of tags"},
+		{`{"invoice": "finance", "INVOICE": "bills"}`, nil, "is the same keyword as another rule"},
+		{`["invoice"]`, nil, "cannot unmarshal"},
+	}
+	for i, condition := range conditions {
+		path := filepath.Join(dir, "keywords.json")
+		if err = ioutil.WriteFile(path, []byte(condition.content), 0644); err != nil {
+			t.Fatalf("Could not write rules: %v", err)
+		}
+		rules, err := LoadKeywordRules(path)
+		if condition.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), condition.expectedError) {
+				t.Errorf("Expected condition %d to fail with %q but got %v", i, condition.expectedError, err)
+			}
+		} else if err != nil || !reflect.DeepEqual(rules, condition.expected) {
+			t.Errorf("Expected %v for condition %d but got %v (%v)", condition.expected, i, rules, err)
+		}
+	}
+}
+
+// Verifies keywords match whole words regardless of case and punctuation.
+func TestMatchKeywords(t *testing.T) {
+	finance := metadata.TagInfo{Id: 1, Text: "finance"}
+	invoice := metadata.TagInfo{Id: 2, Text: "invoice"}
+	bank := metadata.TagInfo{Id: 3, Text: "bank"}
+	keywordTags := map[string][]metadata.TagInfo{
+		"invoice":        {finance, invoice},
+		"bank statement": {finance, bank},
+	}
+	conditions := []struct {
+		text     string
+		expected []int64
+	}{
+		{"INVOICE #42", []int64{1, 2}},
+		{"Your bank\nstatement, and an invoice.", []int64{1, 2, 3}},
+		{"invoices and bank statements", nil},
+		{"", nil},
+	}
+	for _, condition := range conditions {
+		var ids []int64
+		for _, tag := range matchKeywords(condition.text, keywordTags) {
+			ids = append(ids, tag.Id)
+		}
+		if len(ids) != len(condition.expected) {
+			t.Errorf("Expected tags %v for %q but got %v", condition.expected, condition.text, ids)
+			continue
+		}
+		for _, id := range condition.expected {
+			found := false
+			for _, matched := range ids {
+				found = found || matched == id
+			}
+			if !found {
+				t.Errorf("Expected tags %v for %q but got %v", condition.expected, condition.text, ids)
+			}
+		}
+	}
+}
+
+// Verifies indexing with keyword rules tags the documents containing the keywords.
+func TestIndexPathIntoStoreWithKeywords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	writePdf(filepath.Join(dir, "scan.pdf"), "BT (Invoice for March) Tj ET", true)
+	writeZip(filepath.Join(dir, "letter.docx"), map[string]string{"word/document.xml": "<d>Dear customer</d>"})
+	ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("invoice"), 0644)
+	store := newMemoryStore()
+	options := Options{KeywordRules: map[string][]string{"invoice": {"finance", "invoice"}}}
+	if err = IndexPathIntoStoreWithOptions(context.Background(), store, dir, options); err != nil {
+		t.Fatalf("Could not index %s: %v", dir, err)
+	}
+	conditions := []struct {
+		name         string
+		expectedTags []string
+	}{
+		{"scan.pdf", []string{"document", "finance", "invoice"}},
+		{"letter.docx", []string{"document"}},
+		{"notes.txt", []string{"document"}},
+	}
+	for _, condition := range conditions {
+		var tags []string
+		for _, tag := range store.fileTags[store.files[condition.name].Id] {
+			tags = append(tags, tag.Text)
+		}
+		if !reflect.DeepEqual(tags, condition.expectedTags) {
+			t.Errorf("Expected %s to be tagged %v but got %v", condition.name, condition.expectedTags, tags)
+		}
+	}
+}
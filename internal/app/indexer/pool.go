@@ -0,0 +1,131 @@
+package indexer
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// What a worker of an indexer run did, see Options.Workers.
+type WorkerStats struct {
+	// files looked at, new or not
+	Files int
+	// new files added to the store
+	Created int
+	// batches the new files were added in
+	Batches int
+	// time spent on files, rather than waiting for the walk to find them
+	Busy time.Duration
+}
+
+// A file found by the walk of a directory being indexed.
+type walkedFile struct {
+	path string
+	info os.FileInfo
+}
+
+// Indexes the files the walk finds, one at a time, as part of an indexer run. The new files a worker finds are added a
+// batch at a time; the store serializes the writes of all the workers.
+type indexWorker struct {
+	store     db.MetadataStore
+	runId     int64
+	inference *tagInference
+	stats     *WorkerStats
+	// new files not added yet, along with their details
+	newFiles []db.NewFile
+	newInfos []os.FileInfo
+}
+
+// Indexes files until there are no more, then adds the new files left. Once the context is done, the files still
+// coming are dropped.
+func (w *indexWorker) run(ctx context.Context, files <-chan walkedFile) {
+	for file := range files {
+		if ctx.Err() != nil {
+			continue
+		}
+		started := time.Now()
+		w.index(ctx, file)
+		w.stats.Busy += time.Since(started)
+	}
+	if ctx.Err() == nil {
+		started := time.Now()
+		w.flush(ctx)
+		w.stats.Busy += time.Since(started)
+	}
+}
+
+// Indexes a file right away if it is already in the store, or adds it to the batch of new files otherwise.
+func (w *indexWorker) index(ctx context.Context, file walkedFile) {
+	w.stats.Files++
+	existingFile, _ := w.store.FindFileByAbsPath(ctx, filepath.Base(file.path), filepath.Dir(file.path))
+	if existingFile.Id == metadata.UnknownFile.Id {
+		tags := w.inference.forNewFile(ctx, file.path, file.info)
+		w.newFiles = append(w.newFiles, db.NewFile{Name: filepath.Base(file.path), Path: filepath.Dir(file.path),
+			Tags: tags})
+		w.newInfos = append(w.newInfos, file.info)
+		if len(w.newFiles) == createBatchSize {
+			w.flush(ctx)
+		}
+		return
+	}
+	indexFile(ctx, w.store, w.runId, existingFile, file.path, file.info, false, w.inference)
+}
+
+// Adds the batch of new files to the store and indexes them.
+func (w *indexWorker) flush(ctx context.Context) {
+	if len(w.newFiles) == 0 {
+		return
+	}
+	files, err := w.store.CreateFiles(ctx, w.newFiles)
+	if err != nil {
+		log.Printf("Could not add files %s", err)
+	}
+	w.stats.Batches++
+	w.stats.Created += len(files)
+	for i, file := range files {
+		indexFile(ctx, w.store, w.runId, file, filepath.Join(file.Path, file.Name), w.newInfos[i], true, w.inference)
+	}
+	w.newFiles, w.newInfos = nil, nil
+}
+
+// Walks a local directory (recursively), sending the files found other than the ones ignored. Stops, returning the
+// context's error, once the context is done.
+func walkFiles(ctx context.Context, pathToIndex string, ignores *ignoreMatcher, files chan<- walkedFile) error {
+	return filepath.Walk(pathToIndex, func(path string, info os.FileInfo, err error) error {
+		// files indexed so far stay in the database
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			// the directory indexed can't be read, or a path below it went away or can't be read
+			if path == pathToIndex {
+				return err
+			}
+			log.Printf("Could not read %s: %s", path, err)
+			return nil
+		}
+		if ignores.ignored(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// directories only show up as the tags of the files in them, see directoryTags
+		if info.IsDir() {
+			if err := ignores.readDir(path); err != nil {
+				log.Printf("Could not read the ignore file of %s: %s", path, err)
+			}
+			return nil
+		}
+		select {
+		case files <- walkedFile{path: path, info: info}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies several paths are indexed by a pool of workers, each in a run of its own, with stats adding up to the files
+// found.
+func TestIndexPathsWithWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	photos := filepath.Join(dir, "photos")
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(photos, fmt.Sprintf("album%d", i%3), fmt.Sprintf("IMG_%d.jpg", i))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err = ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", path, err)
+		}
+	}
+	metadataPath := filepath.Join(dir, "meta.db")
+	paths := []string{getTestDataDirectory(), filepath.Join(dir, "missing"), photos}
+	options := Options{Workers: 4, DirectoryTagDepth: 1}
+	conditions := []struct {
+		expectedCreated int
+	}{
+		{24},
+		{0},
+	}
+	for _, condition := range conditions {
+		stats, err := IndexPathsWithOptions(context.Background(), paths, metadataPath, options)
+		if err == nil {
+			t.Error("Expected indexing a missing path to fail")
+		}
+		if len(stats) != options.Workers {
+			t.Fatalf("Expected the stats of %d workers but got %v", options.Workers, stats)
+		}
+		var total WorkerStats
+		for _, worker := range stats {
+			total.Files += worker.Files
+			total.Created += worker.Created
+		}
+		if total.Files != 24 || total.Created != condition.expectedCreated {
+			t.Errorf("Expected 24 files to be looked at and %d created but got %d and %d", condition.expectedCreated,
+				total.Files, total.Created)
+		}
+	}
+	database, err := db.Open(metadataPath)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close(database)
+	runs, _ := db.GetIndexRuns(database, 0)
+	if len(runs) != 6 {
+		t.Errorf("Expected a run per path and pass but got %v", runs)
+	}
+	album, _ := db.GetTag(database, "album1")
+	files, _ := db.GetFilesWithTags(database, []metadata.TagInfo{album}, "")
+	if len(files) != 7 {
+		t.Errorf("Expected the 7 photos of album1 to be tagged with it but got %v", files)
+	}
+}
+
+// Verifies the number of workers defaults to one.
+func TestOptionsWorkers(t *testing.T) {
+	conditions := []struct {
+		workers  int
+		expected int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{8, 8},
+	}
+	for _, condition := range conditions {
+		if workers := (Options{Workers: condition.workers}).workers(); workers != condition.expected {
+			t.Errorf("Expected %d workers for %d but got %d", condition.expected, condition.workers, workers)
+		}
+	}
+}
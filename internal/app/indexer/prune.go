@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/boltstore"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"os"
+	"path/filepath"
+)
+
+// Number of files looked up at a time when pruning.
+const pruneBatchSize = 500
+
+// Deletes the records of the files under a directory that no longer exist on disk, so they stop showing up as broken
+// files in the mount, and returns them. With dryRun set the records are only listed. Nothing is deleted if the
+// directory itself doesn't exist, as happens while the disk holding it isn't mounted.
+func Prune(pathToPrune string, metadataPath string, dryRun bool) ([]metadata.FileInfo, error) {
+	return PruneContext(context.Background(), pathToPrune, metadataPath, dryRun)
+}
+
+// Same as Prune but stops, returning the context's error, once the context is done. The files deleted before then stay
+// deleted.
+func PruneContext(ctx context.Context, pathToPrune string, metadataPath string, dryRun bool) ([]metadata.FileInfo,
+	error) {
+	if boltstore.IsPath(metadataPath) {
+		return nil, fmt.Errorf("%s is a bolt store, whose files can't be pruned", metadataPath)
+	}
+	root, err := filepath.Abs(pathToPrune)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(root); err != nil {
+		return nil, err
+	}
+	unlock, err := db.LockExclusive(metadataPath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	database, err := db.OpenWithOptions(metadataPath, db.OpenOptions{Source: db.SourceIndexer})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close(database)
+	var pruned []metadata.FileInfo
+	var lastId int64
+	for {
+		files, err := db.GetFilesUnderPathContext(ctx, database, root, lastId, pruneBatchSize)
+		if err != nil || len(files) == 0 {
+			return pruned, err
+		}
+		var missing []metadata.FileInfo
+		var missingIds []int64
+		for _, file := range files {
+			lastId = file.Id
+			if _, err = os.Stat(filepath.Join(file.Path, file.Name)); os.IsNotExist(err) {
+				missing = append(missing, file)
+				missingIds = append(missingIds, file.Id)
+			}
+		}
+		if len(missing) > 0 && !dryRun {
+			if _, err = db.DeleteFilesContext(ctx, database, missingIds); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, missing...)
+	}
+}
@@ -0,0 +1,63 @@
+package indexer
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies pruning deletes the records of the files that no longer exist, only lists them on a dry run and leaves
+// everything alone if the directory is gone.
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	scanned := filepath.Join(dir, "scanned")
+	for _, name := range []string{"kept.txt", "gone.txt", filepath.Join("sub", "gone.md")} {
+		os.MkdirAll(filepath.Dir(filepath.Join(scanned, name)), 0755)
+		if err = ioutil.WriteFile(filepath.Join(scanned, name), []byte(name), 0644); err != nil {
+			t.Fatalf("Could not write %s: %v", name, err)
+		}
+	}
+	metadataPath := filepath.Join(dir, "metadata.db")
+	if err = IndexPath(scanned, metadataPath); err != nil {
+		t.Fatalf("Could not index %s: %v", scanned, err)
+	}
+	os.Remove(filepath.Join(scanned, "gone.txt"))
+	os.RemoveAll(filepath.Join(scanned, "sub"))
+	conditions := []struct {
+		path          string
+		dryRun        bool
+		expectedError bool
+		expectedFiles int
+		// files left recorded afterwards
+		expectedLeft int
+	}{
+		{filepath.Join(dir, "unmounted"), false, true, 0, 3},
+		{scanned, true, false, 2, 3},
+		{scanned, false, false, 2, 1},
+		{scanned, false, false, 0, 1},
+	}
+	for i, condition := range conditions {
+		pruned, err := Prune(condition.path, metadataPath, condition.dryRun)
+		if (err != nil) != condition.expectedError || len(pruned) != condition.expectedFiles {
+			t.Errorf("Expected %d files pruned for condition %d but got %v (%v)", condition.expectedFiles, i,
+				pruned, err)
+		}
+		database, err := db.Open(metadataPath)
+		if err != nil {
+			t.Fatalf("Could not open database: %v", err)
+		}
+		if left, _ := db.CountFiles(database); left != condition.expectedLeft {
+			t.Errorf("Expected %d files left after condition %d but got %d", condition.expectedLeft, i, left)
+		}
+		db.Close(database)
+	}
+	if _, err = Prune(scanned, "bolt:"+filepath.Join(dir, "metadata.bolt"), false); err == nil {
+		t.Error("Expected bolt stores not to be pruned")
+	}
+}
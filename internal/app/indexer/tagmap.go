@@ -0,0 +1,60 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Reads a JSON file mapping file extensions to the tags applied to files with them, e.g.
+// {".jpg": ["media", "photo"], ".heic": ["media", "photo"], ".psd": []}, and merges it over the default map. An
+// extension mapped to no tags leaves its files to the default tag. Extensions are matched regardless of case. Returns
+// an error naming the first entry that is invalid: an extension that doesn't start with a dot or contains a path
+// separator, or a tag name that is empty or contains one.
+func LoadTagMap(path string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string][]string
+	if err = json.Unmarshal(content, &overrides); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	tagMap := make(map[string][]string, len(extensionToTagMap)+len(overrides))
+	for extension, tags := range extensionToTagMap {
+		tagMap[extension] = tags
+	}
+	for extension, tags := range overrides {
+		if err = validateTagMapEntry(extension, tags); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		extension = strings.ToLower(extension)
+		if len(tags) == 0 {
+			delete(tagMap, extension)
+		} else {
+			tagMap[extension] = tags
+		}
+	}
+	return tagMap, nil
+}
+
+// Checks an extension and the tags it maps to can be matched against file names and used as directories.
+func validateTagMapEntry(extension string, tags []string) error {
+	if len(extension) < 2 || extension[0] != '.' || strings.ContainsAny(extension[1:], "./"+string(filepath.Separator)) {
+		return fmt.Errorf("%q is not a file extension such as .jpg", extension)
+	}
+	for _, tag := range tags {
+		if !validTagName(tag) {
+			return fmt.Errorf("%q, mapped to %s, is not a valid tag name", tag, extension)
+		}
+	}
+	return nil
+}
+
+// Reports whether a tag name can be a directory of the mount.
+func validTagName(tag string) bool {
+	return strings.TrimSpace(tag) != "" && !strings.ContainsAny(tag, "/"+string(filepath.Separator)) && tag != "." &&
+		tag != ".."
+}
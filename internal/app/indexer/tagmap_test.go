@@ -0,0 +1,88 @@
+package indexer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Verifies tag maps are merged over the default one and invalid entries are reported.
+func TestLoadTagMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		content string
+		// extensions looked up in the map loaded and the tags they are expected to map to, nil if not mapped
+		extensions    []string
+		expectedTags  [][]string
+		expectedError string
+	}{
+		{`{".heic": ["media", "photo"], ".JPG": ["photo"], ".psd": []}`, []string{".heic", ".jpg", ".psd", ".png"},
+			[][]string{{"media", "photo"}, {"photo"}, nil, {"media", "image"}}, ""},
+		{`{}`, []string{".pdf"}, [][]string{{"document"}}, ""},
+		{`{"heic": ["photo"]}`, nil, nil, `"heic" is not a file extension`},
+		{`{".tar.gz": ["archive"]}`, nil, nil, `".tar.gz" is not a file extension`},
+		{`{".heic": ["media/photo"]}`, nil, nil, `"media/photo", mapped to .heic, is not a valid tag name`},
+		{`{".heic": [" "]}`, nil, nil, "is not a valid tag name"},
+		{`{".heic": "photo"}`, nil, nil, "cannot unmarshal"},
+	}
+	for i, condition := range conditions {
+		path := filepath.Join(dir, "tagmap.json")
+		if err = ioutil.WriteFile(path, []byte(condition.content), 0644); err != nil {
+			t.Fatalf("Could not write tag map: %v", err)
+		}
+		tagMap, err := LoadTagMap(path)
+		if condition.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), condition.expectedError) {
+				t.Errorf("Expected condition %d to fail with %q but got %v", i, condition.expectedError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Could not load condition %d: %v", i, err)
+			continue
+		}
+		for j, extension := range condition.extensions {
+			if tags := tagMap[extension]; !reflect.DeepEqual(tags, condition.expectedTags[j]) {
+				t.Errorf("Expected %s to map to %v for condition %d but got %v", extension,
+					condition.expectedTags[j], i, tags)
+			}
+		}
+	}
+	if _, err = LoadTagMap(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing tag map to fail but got %v", err)
+	}
+	// the default map is left alone
+	if tags := extensionToTagMap[".psd"]; len(tags) == 0 {
+		t.Error("Expected loading a tag map not to change the default one")
+	}
+}
+
+// Verifies files are tagged with the tag map of the options.
+func TestIndexPathIntoStoreWithTagMap(t *testing.T) {
+	store := newMemoryStore()
+	options := Options{TagMap: map[string][]string{".md": {"notes"}}}
+	if err := IndexPathIntoStoreWithOptions(context.Background(), store, getTestDataDirectory(), options); err != nil {
+		t.Fatalf("Could not index %s: %v", getTestDataDirectory(), err)
+	}
+	conditions := []struct {
+		name        string
+		expectedTag string
+	}{
+		{"four.md", "notes"},
+		{"one.txt", defaultTag},
+	}
+	for _, condition := range conditions {
+		tags := store.fileTags[store.files[condition.name].Id]
+		if len(tags) != 1 || tags[0].Text != condition.expectedTag {
+			t.Errorf("Expected %s to be tagged %s but got %v", condition.name, condition.expectedTag, tags)
+		}
+	}
+}
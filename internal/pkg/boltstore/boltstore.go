@@ -0,0 +1,419 @@
+// Package boltstore keeps the metadata of files in a bbolt key-value file instead of a SQLite database. It implements
+// db.MetadataStore, so files can be indexed into it and browsed by tag, but none of the optional stores (aliases,
+// permissions, the trash, saved queries and so on). Queries read every file's tags, which suits small collections.
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prefix of metadata paths naming a bbolt file rather than a SQLite database, e.g. bolt:/home/me/cotfs.db.
+const Scheme = "bolt:"
+
+// Extensions of metadata paths naming a bbolt file without the scheme prefix.
+var extensions = []string{".bolt", ".bbolt"}
+
+// Buckets of the store. Ids are 8 bytes, big endian, so they sort by value. Pairs of ids are their concatenation.
+var (
+	// tag id -> name
+	tagsBucket = []byte("tags")
+	// tag name -> id
+	tagNamesBucket = []byte("tag_names")
+	// lower tag id + higher tag id -> nothing, for tags used together
+	tagAssocBucket = []byte("tag_assoc")
+	// file id -> fileRecord as JSON
+	filesBucket = []byte("files")
+	// path + NUL + name -> file id
+	filePathsBucket = []byte("file_paths")
+	// file id + tag id -> nothing
+	fileTagsBucket = []byte("file_tags")
+	// run id -> metadata.IndexRun as JSON
+	indexRunsBucket = []byte("index_runs")
+)
+
+// What is kept about a file.
+type fileRecord struct {
+	Name    string
+	Path    string
+	Details metadata.FileDetails
+	// ids of the indexer runs that created the file and last updated it, 0 if none did
+	CreatedRun int64 `json:",omitempty"`
+	UpdatedRun int64 `json:",omitempty"`
+}
+
+// Store is a MetadataStore kept in a bbolt file.
+type Store struct {
+	db *bolt.DB
+}
+
+var _ db.MetadataStore = (*Store)(nil)
+
+// Reports whether a metadata path names a bbolt file, by its scheme prefix or its extension.
+func IsPath(metadataPath string) bool {
+	if strings.HasPrefix(metadataPath, Scheme) {
+		return true
+	}
+	for _, extension := range extensions {
+		if strings.HasSuffix(metadataPath, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Opens the bbolt file a metadata path names, creating it (and its buckets) if it doesn't exist. Only one process (or
+// Store) can have the file open at a time; others wait for it to be closed.
+func Open(metadataPath string) (*Store, error) {
+	database, err := bolt.Open(strings.TrimPrefix(metadataPath, Scheme), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = database.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{tagsBucket, tagNamesBucket, tagAssocBucket, filesBucket, filePathsBucket,
+			fileTagsBucket, indexRunsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		database.Close()
+		return nil, err
+	}
+	return &Store{db: database}, nil
+}
+
+// Closes the file, letting other processes open it.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) AddTag(ctx context.Context, name string, tagContext []metadata.TagInfo) (metadata.TagInfo, error) {
+	tags, err := s.AddTags(ctx, []string{name}, tagContext)
+	if err != nil {
+		return metadata.UnknownTag, err
+	}
+	return tags[0], nil
+}
+
+func (s *Store) AddTags(ctx context.Context, names []string, tagContext []metadata.TagInfo) ([]metadata.TagInfo,
+	error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var added []metadata.TagInfo
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		added = nil
+		allTags := append([]metadata.TagInfo{}, tagContext...)
+		for _, name := range names {
+			tag, err := findOrAddTag(tx, name)
+			if err != nil {
+				return err
+			}
+			added = append(added, tag)
+			allTags = append(allTags, tag)
+		}
+		assoc := tx.Bucket(tagAssocBucket)
+		for i, tag := range allTags {
+			for _, other := range allTags[i+1:] {
+				if tag.Id == other.Id {
+					continue
+				}
+				low, high := tag.Id, other.Id
+				if low > high {
+					low, high = high, low
+				}
+				if err := assoc.Put(pairKey(low, high), nil); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return added, err
+}
+
+// Looks up a tag by name, adding it if there is none.
+func findOrAddTag(tx *bolt.Tx, name string) (metadata.TagInfo, error) {
+	if tag := findTag(tx, name); tag.Id != metadata.UnknownTag.Id {
+		return tag, nil
+	}
+	tags := tx.Bucket(tagsBucket)
+	sequence, err := tags.NextSequence()
+	if err != nil {
+		return metadata.UnknownTag, err
+	}
+	id := int64(sequence)
+	if err = tags.Put(idKey(id), []byte(name)); err != nil {
+		return metadata.UnknownTag, err
+	}
+	return metadata.TagInfo{Id: id, Text: name}, tx.Bucket(tagNamesBucket).Put([]byte(name), idKey(id))
+}
+
+func (s *Store) FindFileByAbsPath(ctx context.Context, name string, absPath string) (metadata.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownFile, err
+	}
+	file := metadata.UnknownFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if id := tx.Bucket(filePathsBucket).Get(pathKey(name, absPath)); id != nil {
+			file = metadata.FileInfo{Id: idFromKey(id), Name: name, Path: absPath}
+		}
+		return nil
+	})
+	return file, err
+}
+
+// Adds a file tagged with the tags passed in. Fails if a file with the same name and path is already recorded, as
+// db.CreateFileInPath does.
+func (s *Store) CreateFileInPath(ctx context.Context, name string, absPath string,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
+	existing, err := s.FindFileByAbsPath(ctx, name, absPath)
+	if err != nil {
+		return metadata.UnknownFile, err
+	}
+	if existing.Id != metadata.UnknownFile.Id {
+		return metadata.UnknownFile, fmt.Errorf("%s in %s is already recorded", name, absPath)
+	}
+	files, err := s.CreateFiles(ctx, []db.NewFile{{Name: name, Path: absPath, Tags: tags}})
+	if err != nil {
+		return metadata.UnknownFile, err
+	}
+	return files[0], nil
+}
+
+// Adds many files, each tagged with its tags, in one transaction. Files already recorded under the same name and path
+// aren't added again but get the tags of their entries, as with db.CreateFiles.
+func (s *Store) CreateFiles(ctx context.Context, entries []db.NewFile) ([]metadata.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var created []metadata.FileInfo
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		created = nil
+		files := tx.Bucket(filesBucket)
+		paths := tx.Bucket(filePathsBucket)
+		for _, entry := range entries {
+			var id int64
+			if key := paths.Get(pathKey(entry.Name, entry.Path)); key != nil {
+				id = idFromKey(key)
+			} else {
+				sequence, err := files.NextSequence()
+				if err != nil {
+					return err
+				}
+				id = int64(sequence)
+				if err = putFile(files, id, fileRecord{Name: entry.Name, Path: entry.Path}); err != nil {
+					return err
+				}
+				if err = paths.Put(pathKey(entry.Name, entry.Path), idKey(id)); err != nil {
+					return err
+				}
+			}
+			if err := tagFile(tx, id, entry.Tags); err != nil {
+				return err
+			}
+			created = append(created, metadata.FileInfo{Id: id, Name: entry.Name, Path: entry.Path})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *Store) GetFileDetails(ctx context.Context, fileId int64) (metadata.FileDetails, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.FileDetails{}, false, err
+	}
+	var record fileRecord
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		record, found, err = getFile(tx.Bucket(filesBucket), fileId)
+		return err
+	})
+	return record.Details, found, err
+}
+
+func (s *Store) SetFileDetails(ctx context.Context, fileId int64, details metadata.FileDetails) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		record, found, err := getFile(files, fileId)
+		if err != nil || !found {
+			return err
+		}
+		record.Details = details
+		return putFile(files, fileId, record)
+	})
+}
+
+// Lists the tags applied to a file, ordered by name.
+func (s *Store) GetTagsForFile(ctx context.Context, fileId int64) ([]metadata.TagInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var results []metadata.TagInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tags := tx.Bucket(tagsBucket)
+		prefix := idKey(fileId)
+		cursor := tx.Bucket(fileTagsBucket).Cursor()
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			tagId := idFromKey(key[len(prefix):])
+			if name := tags.Get(idKey(tagId)); name != nil {
+				results = append(results, metadata.TagInfo{Id: tagId, Text: string(name)})
+			}
+		}
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Text < results[j].Text
+	})
+	return results, err
+}
+
+// Applies tags to a file. Tags the file already has are left as they are.
+func (s *Store) TagFile(ctx context.Context, fileId int64, tags []metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tagFile(tx, fileId, tags)
+	})
+}
+
+func (s *Store) StartIndexRun(ctx context.Context, root string) (metadata.IndexRun, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownIndexRun, err
+	}
+	run := metadata.IndexRun{Root: root, Started: time.Now()}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(indexRunsBucket)
+		sequence, err := runs.NextSequence()
+		if err != nil {
+			return err
+		}
+		run.Id = int64(sequence)
+		return putRun(runs, run)
+	})
+	if err != nil {
+		return metadata.UnknownIndexRun, err
+	}
+	return run, nil
+}
+
+func (s *Store) FinishIndexRun(ctx context.Context, runId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		runs := tx.Bucket(indexRunsBucket)
+		value := runs.Get(idKey(runId))
+		if value == nil {
+			return nil
+		}
+		var run metadata.IndexRun
+		if err := json.Unmarshal(value, &run); err != nil {
+			return err
+		}
+		run.Finished = time.Now()
+		return putRun(runs, run)
+	})
+}
+
+func (s *Store) SetFileIndexRun(ctx context.Context, fileId int64, runId int64, created bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		record, found, err := getFile(files, fileId)
+		if err != nil || !found {
+			return err
+		}
+		record.UpdatedRun = runId
+		if created {
+			record.CreatedRun = runId
+		}
+		return putFile(files, fileId, record)
+	})
+}
+
+// Writes the record of an indexer run.
+func putRun(runs *bolt.Bucket, run metadata.IndexRun) error {
+	value, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	return runs.Put(idKey(run.Id), value)
+}
+
+// Records the tags of a file.
+func tagFile(tx *bolt.Tx, fileId int64, tags []metadata.TagInfo) error {
+	fileTags := tx.Bucket(fileTagsBucket)
+	for _, tag := range tags {
+		if err := fileTags.Put(pairKey(fileId, tag.Id), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads the record of a file. Reports false if there is none.
+func getFile(files *bolt.Bucket, fileId int64) (fileRecord, bool, error) {
+	var record fileRecord
+	value := files.Get(idKey(fileId))
+	if value == nil {
+		return record, false, nil
+	}
+	return record, true, json.Unmarshal(value, &record)
+}
+
+// Writes the record of a file.
+func putFile(files *bolt.Bucket, fileId int64, record fileRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return files.Put(idKey(fileId), value)
+}
+
+// Returns the key of an id.
+func idKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// Returns the id a key holds.
+func idFromKey(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key))
+}
+
+// Returns the key of a pair of ids.
+func pairKey(first int64, second int64) []byte {
+	return append(idKey(first), idKey(second)...)
+}
+
+// Returns the key of a file's location. Names can't contain NUL so it can't be mistaken for part of one.
+func pathKey(name string, absPath string) []byte {
+	return []byte(absPath + "\x00" + name)
+}
@@ -0,0 +1,336 @@
+package boltstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Verifies bolt stores are told apart from SQLite databases by their path.
+func TestIsPath(t *testing.T) {
+	conditions := []struct {
+		path     string
+		expected bool
+	}{
+		{"bolt:/data/cotfs.db", true},
+		{"/data/cotfs.bolt", true},
+		{"/data/cotfs.bbolt", true},
+		{"/data/cotfs.db", false},
+		{"file::memory:?cache=shared", false},
+	}
+	for _, condition := range conditions {
+		if found := IsPath(condition.path); found != condition.expected {
+			t.Errorf("Expected %t for %s but got %t", condition.expected, condition.path, found)
+		}
+	}
+}
+
+// Verifies tags are added once and associated with the tags they are added with.
+func TestAddTags(t *testing.T) {
+	store, done := getStore(t)
+	defer done()
+	ctx := context.Background()
+	first, err := store.AddTags(ctx, []string{"photos", "2019"}, nil)
+	if err != nil || len(first) != 2 {
+		t.Fatalf("Could not add tags: %v", err)
+	}
+	again, err := store.AddTag(ctx, "photos", first[1:])
+	if err != nil || again != first[0] {
+		t.Errorf("Expected %v to be returned but got %v (%v)", first[0], again, err)
+	}
+	other, _ := store.AddTag(ctx, "beach", first)
+	if other.Id == first[0].Id || other.Id == first[1].Id {
+		t.Errorf("Expected a new tag but got %v", other)
+	}
+	pairs := 0
+	store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(tagAssocBucket).ForEach(func(k, v []byte) error {
+			pairs++
+			return nil
+		})
+	})
+	// photos-2019, beach-photos and beach-2019
+	if pairs != 3 {
+		t.Errorf("Expected 3 associations but found %d", pairs)
+	}
+}
+
+// Verifies files are recorded once, found by their location and keep their tags and details across opens.
+func TestFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := Scheme + filepath.Join(dir, "meta.db")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Could not open store: %v", err)
+	}
+	ctx := context.Background()
+	tags, _ := store.AddTags(ctx, []string{"text", "notes"}, nil)
+	files, err := store.CreateFiles(ctx, []db.NewFile{
+		{Name: "one.txt", Path: "/docs", Tags: tags},
+		{Name: "two.txt", Path: "/docs", Tags: tags[:1]},
+		{Name: "one.txt", Path: "/docs", Tags: tags[1:]},
+	})
+	if err != nil || len(files) != 3 || files[0] != files[2] || files[0].Id == files[1].Id {
+		t.Fatalf("Expected the first file to be recorded once but got %v (%v)", files, err)
+	}
+	if _, err = store.CreateFileInPath(ctx, "two.txt", "/docs", nil); err == nil {
+		t.Error("Expected creating a second record of a file to be refused")
+	}
+	details := metadata.FileDetails{Size: 42, ModTime: time.Unix(1500000000, 0), Checksum: "abc", MimeType: "text/plain"}
+	if err = store.SetFileDetails(ctx, files[1].Id, details); err != nil {
+		t.Errorf("Could not set details: %v", err)
+	}
+	store.Close()
+
+	if store, err = Open(path); err != nil {
+		t.Fatalf("Could not reopen store: %v", err)
+	}
+	defer store.Close()
+	conditions := []struct {
+		name          string
+		path          string
+		expectedId    int64
+		expectedTags  []string
+		expectDetails bool
+	}{
+		{"one.txt", "/docs", files[0].Id, []string{"notes", "text"}, false},
+		{"two.txt", "/docs", files[1].Id, []string{"text"}, true},
+		{"one.txt", "/other", metadata.UnknownFile.Id, nil, false},
+	}
+	for _, condition := range conditions {
+		file, err := store.FindFileByAbsPath(ctx, condition.name, condition.path)
+		if err != nil || file.Id != condition.expectedId {
+			t.Errorf("Expected %s in %s to be %d but got %v (%v)", condition.name, condition.path,
+				condition.expectedId, file, err)
+			continue
+		}
+		fileTags, _ := store.GetTagsForFile(ctx, file.Id)
+		var names []string
+		for _, tag := range fileTags {
+			names = append(names, tag.Text)
+		}
+		if len(names) != len(condition.expectedTags) || (len(names) > 0 && names[0] != condition.expectedTags[0]) {
+			t.Errorf("Expected %s to have tags %v but found %v", condition.name, condition.expectedTags, names)
+		}
+		found, ok, _ := store.GetFileDetails(ctx, file.Id)
+		if ok != (file.Id != metadata.UnknownFile.Id) || (condition.expectDetails &&
+			(found.Size != details.Size || !found.ModTime.Equal(details.ModTime) || found.Checksum != details.Checksum)) {
+			t.Errorf("Expected details %v for %s but got %v (%t)", details, condition.name, found, ok)
+		}
+	}
+}
+
+// Verifies indexer runs are recorded with the files they create and update.
+func TestIndexRuns(t *testing.T) {
+	store, done := getStore(t)
+	defer done()
+	ctx := context.Background()
+	run, err := store.StartIndexRun(ctx, "/docs")
+	if err != nil || run.Id == metadata.UnknownIndexRun.Id {
+		t.Fatalf("Could not start run: %v", err)
+	}
+	file, _ := store.CreateFileInPath(ctx, "one.txt", "/docs", nil)
+	if err = store.SetFileIndexRun(ctx, file.Id, run.Id, true); err != nil {
+		t.Errorf("Could not record the run of the file: %v", err)
+	}
+	if err = store.FinishIndexRun(ctx, run.Id); err != nil {
+		t.Errorf("Could not finish run: %v", err)
+	}
+	next, _ := store.StartIndexRun(ctx, "/docs")
+	store.SetFileIndexRun(ctx, file.Id, next.Id, false)
+	var record fileRecord
+	var finished metadata.IndexRun
+	store.db.View(func(tx *bolt.Tx) error {
+		record, _, _ = getFile(tx.Bucket(filesBucket), file.Id)
+		return json.Unmarshal(tx.Bucket(indexRunsBucket).Get(idKey(run.Id)), &finished)
+	})
+	if next.Id == run.Id || record.CreatedRun != run.Id || record.UpdatedRun != next.Id {
+		t.Errorf("Expected the file to be created by run %d and updated by %d but got %+v", run.Id, next.Id, record)
+	}
+	if finished.Root != "/docs" || finished.Finished.IsZero() {
+		t.Errorf("Expected run %d to be finished but got %+v", run.Id, finished)
+	}
+}
+
+// Verifies files are listed and counted by the tags they must, may and must not have, and by name.
+func TestFilesMatchingFilter(t *testing.T) {
+	store, done := getStore(t)
+	defer done()
+	ctx := context.Background()
+	tags, _ := store.AddTags(ctx, []string{"photos", "2019", "2020", "work"}, nil)
+	photos, y2019, y2020, work := tags[0], tags[1], tags[2], tags[3]
+	store.CreateFiles(ctx, []db.NewFile{
+		{Name: "beach.jpg", Path: "/p", Tags: []metadata.TagInfo{photos, y2019}},
+		{Name: "Office.jpg", Path: "/p", Tags: []metadata.TagInfo{photos, y2020, work}},
+		{Name: "notes.txt", Path: "/p", Tags: []metadata.TagInfo{work}},
+		{Name: "loose.txt", Path: "/p"},
+	})
+	conditions := []struct {
+		filter   db.TagFilter
+		name     string
+		expected []string
+	}{
+		{db.TagFilter{Tags: []metadata.TagInfo{photos}}, "", []string{"beach.jpg", "Office.jpg"}},
+		{db.TagFilter{Tags: []metadata.TagInfo{photos}, Excluded: []metadata.TagInfo{work}}, "",
+			[]string{"beach.jpg"}},
+		{db.TagFilter{AnyOf: [][]metadata.TagInfo{{y2019, y2020}}}, "", []string{"beach.jpg", "Office.jpg"}},
+		{db.TagFilter{Excluded: []metadata.TagInfo{photos}}, "", []string{"notes.txt", "loose.txt"}},
+		{db.TagFilter{Tags: []metadata.TagInfo{photos}}, "*.JPG", []string{"beach.jpg", "Office.jpg"}},
+		{db.TagFilter{Tags: []metadata.TagInfo{photos}}, "re:^O", []string{"Office.jpg"}},
+		{db.TagFilter{Tags: []metadata.TagInfo{{Id: 99, Text: "missing"}}}, "", nil},
+	}
+	for _, condition := range conditions {
+		files, err := store.GetFilesMatchingFilter(ctx, condition.filter, condition.name)
+		if err != nil || fmt.Sprint(fileNames(files)) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v for %+v named %q but got %v (%v)", condition.expected, condition.filter,
+				condition.name, fileNames(files), err)
+		}
+		count, err := store.CountFilesMatchingFilter(ctx, condition.filter)
+		if condition.name == "" && (err != nil || count != len(condition.expected)) {
+			t.Errorf("Expected %d files for %+v but counted %d (%v)", len(condition.expected), condition.filter,
+				count, err)
+		}
+	}
+	single, _ := store.GetFilesWithSingleTag(ctx, "")
+	untagged, _ := store.GetUntaggedFilesExcluding(ctx, "work", nil, "")
+	if fmt.Sprint(fileNames(single)) != "[notes.txt]" || fmt.Sprint(fileNames(untagged)) != "[notes.txt loose.txt]" {
+		t.Errorf("Expected notes.txt to have a single tag and to be untagged with loose.txt but got %v and %v",
+			fileNames(single), fileNames(untagged))
+	}
+	coincident, err := store.GetCoincidentTagsForFilter(ctx, db.TagFilter{Tags: []metadata.TagInfo{photos},
+		Excluded: []metadata.TagInfo{work}}, "")
+	if err != nil || fmt.Sprint(tagNames(coincident)) != "[2019 2020]" {
+		t.Errorf("Expected 2019 and 2020 to co-occur with photos but got %v (%v)", tagNames(coincident), err)
+	}
+}
+
+// Verifies files are listed in each order, with files without details last.
+func TestFilesOrdered(t *testing.T) {
+	store, done := getStore(t)
+	defer done()
+	ctx := context.Background()
+	tag, _ := store.AddTag(ctx, "docs", nil)
+	files, _ := store.CreateFiles(ctx, []db.NewFile{
+		{Name: "b", Path: "/d", Tags: []metadata.TagInfo{tag}},
+		{Name: "c", Path: "/d", Tags: []metadata.TagInfo{tag}},
+		{Name: "a", Path: "/d", Tags: []metadata.TagInfo{tag}},
+	})
+	store.SetFileStat(ctx, files[0].Id, 10, time.Unix(1000, 0))
+	store.SetFileStat(ctx, files[1].Id, 20, time.Unix(500, 0))
+	conditions := []struct {
+		order       db.FileOrder
+		expected    []string
+		expectedErr bool
+	}{
+		{db.ByName, []string{"a", "b", "c"}, false},
+		{db.BySize, []string{"c", "b", "a"}, false},
+		{db.ByModTime, []string{"b", "c", "a"}, false},
+		{db.ById, []string{"b", "c", "a"}, false},
+		{db.FileOrder(42), nil, true},
+	}
+	for _, condition := range conditions {
+		found, err := store.GetFilesMatchingFilterOrdered(ctx, db.TagFilter{Tags: []metadata.TagInfo{tag}}, "",
+			condition.order)
+		if (err != nil) != condition.expectedErr || fmt.Sprint(fileNames(found)) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v in order %d but got %v (%v)", condition.expected, condition.order, fileNames(found),
+				err)
+		}
+	}
+	count, size, err := store.GetFileTotals(ctx)
+	if err != nil || count != 3 || size != 30 {
+		t.Errorf("Expected 3 files of 30 bytes but got %d of %d (%v)", count, size, err)
+	}
+}
+
+// Verifies tags are renamed, merged and deleted along with their files and associations.
+func TestTagChanges(t *testing.T) {
+	store, done := getStore(t)
+	defer done()
+	ctx := context.Background()
+	tags, _ := store.AddTags(ctx, []string{"pics", "photos", "trip"}, nil)
+	pics, photos, trip := tags[0], tags[1], tags[2]
+	only, _ := store.CreateFileInPath(ctx, "only.jpg", "/p", []metadata.TagInfo{pics})
+	both, _ := store.CreateFileInPath(ctx, "both.jpg", "/p", []metadata.TagInfo{pics, trip})
+
+	if existing, err := store.RenameTag(ctx, pics, "photos"); err != db.ErrTagExists || existing != photos {
+		t.Errorf("Expected renaming onto photos to return it but got %v (%v)", existing, err)
+	}
+	renamed, err := store.RenameTag(ctx, trip, "travel")
+	if found, _ := store.FindTag(ctx, "travel"); err != nil || found != renamed || renamed.Id != trip.Id {
+		t.Errorf("Expected trip to be renamed travel but got %v and found %v (%v)", renamed, found, err)
+	}
+	if found, _ := store.FindTag(ctx, "trip"); found.Id != metadata.UnknownTag.Id {
+		t.Errorf("Expected the old name to be gone but found %v", found)
+	}
+	if err = store.MergeTags(ctx, pics, photos); err != nil {
+		t.Fatalf("Could not merge tags: %v", err)
+	}
+	files, _ := store.GetFilesMatchingFilter(ctx, db.TagFilter{Tags: []metadata.TagInfo{photos}}, "")
+	coincident, _ := store.GetCoincidentTag(ctx, "travel", "photos")
+	count, _ := store.CountTags(ctx)
+	if len(files) != 2 || coincident.Id != renamed.Id || count != 2 {
+		t.Errorf("Expected photos to take over the files and associations of pics but got %v, %v and %d tags",
+			files, coincident, count)
+	}
+	if err = store.DeleteTagRecursive(ctx, photos, "uncategorized"); err != nil {
+		t.Fatalf("Could not delete tag: %v", err)
+	}
+	onlyTags, _ := store.GetTagsForFile(ctx, only.Id)
+	bothTags, _ := store.GetTagsForFile(ctx, both.Id)
+	if fmt.Sprint(tagNames(onlyTags)) != "[uncategorized]" || fmt.Sprint(tagNames(bothTags)) != "[travel]" {
+		t.Errorf("Expected only the file left without tags to be uncategorized but got %v and %v",
+			tagNames(onlyTags), tagNames(bothTags))
+	}
+	deleted, err := store.DeleteFiles(ctx, []int64{only.Id, only.Id + 100})
+	if found, _ := store.FindFileByAbsPath(ctx, "only.jpg", "/p"); err != nil || deleted != 1 ||
+		found.Id != metadata.UnknownFile.Id {
+		t.Errorf("Expected one file to be deleted but deleted %d and found %v (%v)", deleted, found, err)
+	}
+}
+
+// Returns the names of files, in order.
+func fileNames(files []metadata.FileInfo) []string {
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+// Returns the names of tags, in order.
+func tagNames(tags []metadata.TagInfo) []string {
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Text)
+	}
+	return names
+}
+
+// Helper opening a store in a temp dir. Returns it with a function closing and removing it.
+func getStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	store, err := Open(filepath.Join(dir, "meta.bolt"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Could not open store: %v", err)
+	}
+	return store, func() {
+		store.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,721 @@
+package boltstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+// A file read from the store, along with its id.
+type storedFile struct {
+	id     int64
+	record fileRecord
+}
+
+func (f storedFile) info() metadata.FileInfo {
+	return metadata.FileInfo{Id: f.id, Name: f.record.Name, Path: f.record.Path}
+}
+
+// Looks up a tag by name. Bolt stores have no aliases, so only names are looked up.
+func (s *Store) FindTag(ctx context.Context, name string) (metadata.TagInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownTag, err
+	}
+	tag := metadata.UnknownTag
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tag = findTag(tx, name)
+		return nil
+	})
+	return tag, err
+}
+
+func (s *Store) GetCoincidentTag(ctx context.Context, name string, other string) (metadata.TagInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownTag, err
+	}
+	tag := metadata.UnknownTag
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found, otherTag := findTag(tx, name), findTag(tx, other)
+		if found.Id == metadata.UnknownTag.Id || otherTag.Id == metadata.UnknownTag.Id {
+			return nil
+		}
+		if tx.Bucket(tagAssocBucket).Get(assocKey(found.Id, otherTag.Id)) != nil {
+			tag = found
+		}
+		return nil
+	})
+	return tag, err
+}
+
+// Lists the tags associated with every tag of the filter and with a tag of each of its groups, leaving out the
+// excluded tags. A filter without tags or groups lists every tag.
+func (s *Store) GetCoincidentTagsForFilter(ctx context.Context, filter db.TagFilter,
+	name string) ([]metadata.TagInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var results []metadata.TagInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		results = nil
+		pairs, err := associations(tx)
+		if err != nil {
+			return err
+		}
+		// nil until the first tag or group narrows it, standing for every tag
+		var candidates map[int64]bool
+		for _, tag := range filter.Tags {
+			candidates = intersect(candidates, pairs[findTag(tx, tag.Text).Id])
+		}
+		for _, group := range filter.AnyOf {
+			union := make(map[int64]bool)
+			for _, tag := range group {
+				for id := range pairs[tag.Id] {
+					union[id] = true
+				}
+			}
+			candidates = intersect(candidates, union)
+		}
+		excluded := make(map[int64]bool)
+		for _, tag := range filter.Excluded {
+			excluded[tag.Id] = true
+		}
+		return tx.Bucket(tagsBucket).ForEach(func(key, value []byte) error {
+			id := idFromKey(key)
+			if (candidates != nil && !candidates[id]) || excluded[id] {
+				return nil
+			}
+			if len(name) > 0 {
+				if matched, err := db.MatchName(name, string(value)); err != nil || !matched {
+					return err
+				}
+			}
+			results = append(results, metadata.TagInfo{Id: id, Text: string(value)})
+			return nil
+		})
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Text < results[j].Text
+	})
+	return results, err
+}
+
+func (s *Store) CountTags(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = tx.Bucket(tagsBucket).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// Renames a tag. If another tag already has the name, that tag is returned with db.ErrTagExists.
+func (s *Store) RenameTag(ctx context.Context, tag metadata.TagInfo, newName string) (metadata.TagInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownTag, err
+	}
+	existing := metadata.UnknownTag
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		existing = findTag(tx, newName)
+		if existing.Id != metadata.UnknownTag.Id && existing.Id != tag.Id {
+			return db.ErrTagExists
+		}
+		tags := tx.Bucket(tagsBucket)
+		names := tx.Bucket(tagNamesBucket)
+		if oldName := tags.Get(idKey(tag.Id)); oldName != nil {
+			if err := names.Delete(append([]byte{}, oldName...)); err != nil {
+				return err
+			}
+		}
+		if err := names.Put([]byte(newName), idKey(tag.Id)); err != nil {
+			return err
+		}
+		return tags.Put(idKey(tag.Id), []byte(newName))
+	})
+	if err == db.ErrTagExists {
+		return existing, err
+	}
+	if err != nil {
+		return metadata.UnknownTag, err
+	}
+	return metadata.TagInfo{Id: tag.Id, Text: newName}, nil
+}
+
+func (s *Store) MergeTags(ctx context.Context, source metadata.TagInfo, target metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if source.Id == target.Id {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, fileId := range filesTagged(tx, source.Id) {
+			if err := fileTags.Put(pairKey(fileId, target.Id), nil); err != nil {
+				return err
+			}
+		}
+		pairs, err := associations(tx)
+		if err != nil {
+			return err
+		}
+		assoc := tx.Bucket(tagAssocBucket)
+		for id := range pairs[source.Id] {
+			if id == target.Id {
+				continue
+			}
+			if err := assoc.Put(assocKey(id, target.Id), nil); err != nil {
+				return err
+			}
+		}
+		return deleteTag(tx, source, true)
+	})
+}
+
+// Deletes a tag along with its associations. Files keep the tag, as with db.DeleteTag.
+func (s *Store) DeleteTag(ctx context.Context, tag metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteTag(tx, tag, false)
+	})
+}
+
+func (s *Store) DeleteTagRecursive(ctx context.Context, tag metadata.TagInfo, fallback string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fallbackTag, err := findOrAddTag(tx, fallback)
+		if err != nil {
+			return err
+		}
+		if fallbackTag.Id == tag.Id {
+			return fmt.Errorf("cannot replace tag %s with itself", tag.Text)
+		}
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, fileId := range filesTagged(tx, tag.Id) {
+			if len(fileTagIds(fileTags, fileId)) > 1 {
+				continue
+			}
+			if err = fileTags.Put(pairKey(fileId, fallbackTag.Id), nil); err != nil {
+				return err
+			}
+		}
+		return deleteTag(tx, tag, true)
+	})
+}
+
+func (s *Store) UnassociateTag(ctx context.Context, tagOne metadata.TagInfo, tagTwo metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tagAssocBucket).Delete(assocKey(tagOne.Id, tagTwo.Id))
+	})
+}
+
+func (s *Store) GetFile(ctx context.Context, fileId int64) (metadata.FileInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return metadata.UnknownFile, err
+	}
+	file := metadata.UnknownFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		record, found, err := getFile(tx.Bucket(filesBucket), fileId)
+		if found {
+			file = storedFile{id: fileId, record: record}.info()
+		}
+		return err
+	})
+	return file, err
+}
+
+func (s *Store) GetFilesMatchingFilter(ctx context.Context, filter db.TagFilter,
+	name string) ([]metadata.FileInfo, error) {
+	return s.GetFilesMatchingFilterOrdered(ctx, filter, name, db.ById)
+}
+
+func (s *Store) GetFilesMatchingFilterOrdered(ctx context.Context, filter db.TagFilter, name string,
+	order db.FileOrder) ([]metadata.FileInfo, error) {
+	less, ok := fileOrders[order]
+	if !ok {
+		return nil, fmt.Errorf("unknown file order %d", order)
+	}
+	files, err := s.selectFiles(ctx, name, func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return filterTest(tx, filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if less != nil {
+		sort.SliceStable(files, func(i, j int) bool {
+			return less(files[i].record, files[j].record)
+		})
+	}
+	return fileInfos(files), nil
+}
+
+func (s *Store) CountFilesMatchingFilter(ctx context.Context, filter db.TagFilter) (int, error) {
+	files, err := s.selectFiles(ctx, "", func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return filterTest(tx, filter)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return len(files), nil
+}
+
+func (s *Store) GetFilesWithSingleTag(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	files, err := s.selectFiles(ctx, name, func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return func(tags map[int64]bool) bool {
+			return len(tags) == 1
+		}
+	})
+	return fileInfos(files), err
+}
+
+func (s *Store) GetFileCountWithSingleTag(ctx context.Context, tag metadata.TagInfo) (int, error) {
+	files, err := s.selectFiles(ctx, "", func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return func(tags map[int64]bool) bool {
+			return len(tags) == 1 && tags[tag.Id]
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	return len(files), nil
+}
+
+func (s *Store) CountFilesWithTag(ctx context.Context, tag metadata.TagInfo) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = len(filesTagged(tx, tag.Id))
+		return nil
+	})
+	return count, err
+}
+
+func (s *Store) GetUntaggedFilesExcluding(ctx context.Context, fallback string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	files, err := s.selectFiles(ctx, name, func(tx *bolt.Tx) func(map[int64]bool) bool {
+		fallbackTag := findTag(tx, fallback)
+		notExcluded := filterTest(tx, db.TagFilter{Excluded: excluded})
+		return func(tags map[int64]bool) bool {
+			for id := range tags {
+				if id != fallbackTag.Id {
+					return false
+				}
+			}
+			return notExcluded(tags)
+		}
+	})
+	return fileInfos(files), err
+}
+
+func (s *Store) GetTagCountForFile(ctx context.Context, fileId int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = len(fileTagIds(tx.Bucket(fileTagsBucket), fileId))
+		return nil
+	})
+	return count, err
+}
+
+func (s *Store) GetFileTotals(ctx context.Context) (int, int64, error) {
+	files, err := s.selectFiles(ctx, "", func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return func(map[int64]bool) bool {
+			return true
+		}
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, file := range files {
+		size += file.record.Details.Size
+	}
+	return len(files), size, nil
+}
+
+// Gets the size and modification time recorded for a file, as part of its details. Reports false if no modification
+// time was recorded.
+func (s *Store) GetFileStat(ctx context.Context, fileId int64) (int64, time.Time, bool, error) {
+	details, found, err := s.GetFileDetails(ctx, fileId)
+	if err != nil || !found || details.ModTime.IsZero() {
+		return 0, time.Time{}, false, err
+	}
+	return details.Size, details.ModTime, true, nil
+}
+
+// Records the size and modification time of a file, leaving the rest of its details as they are.
+func (s *Store) SetFileStat(ctx context.Context, fileId int64, size int64, modTime time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		files := tx.Bucket(filesBucket)
+		record, found, err := getFile(files, fileId)
+		if err != nil || !found {
+			return err
+		}
+		record.Details.Size = size
+		record.Details.ModTime = modTime
+		return putFile(files, fileId, record)
+	})
+}
+
+func (s *Store) UpsertFile(ctx context.Context, name string, absPath string,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
+	files, err := s.CreateFiles(ctx, []db.NewFile{{Name: name, Path: absPath, Tags: tags}})
+	if err != nil {
+		return metadata.UnknownFile, err
+	}
+	return files[0], nil
+}
+
+func (s *Store) SetFileTags(ctx context.Context, fileId int64, tags []metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, tagId := range fileTagIds(fileTags, fileId) {
+			if err := fileTags.Delete(pairKey(fileId, tagId)); err != nil {
+				return err
+			}
+		}
+		return tagFile(tx, fileId, tags)
+	})
+}
+
+func (s *Store) UntagFile(ctx context.Context, fileId int64, tagId int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(fileTagsBucket).Delete(pairKey(fileId, tagId))
+	})
+}
+
+func (s *Store) UntagFiles(ctx context.Context, path []metadata.TagInfo) error {
+	if len(path) == 0 {
+		return nil
+	}
+	files, err := s.selectFiles(ctx, "", func(tx *bolt.Tx) func(map[int64]bool) bool {
+		return filterTest(tx, db.TagFilter{Tags: path})
+	})
+	if err != nil || len(files) == 0 {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, file := range files {
+			if err := fileTags.Delete(pairKey(file.id, path[len(path)-1].Id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) RetagFiles(ctx context.Context, fileIds []int64, removed []metadata.TagInfo,
+	added []metadata.TagInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(fileIds) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, fileId := range fileIds {
+			for _, tag := range removed {
+				if err := fileTags.Delete(pairKey(fileId, tag.Id)); err != nil {
+					return err
+				}
+			}
+			if err := tagFile(tx, fileId, added); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store) DeleteFiles(ctx context.Context, fileIds []int64) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deleted = 0
+		files := tx.Bucket(filesBucket)
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, fileId := range fileIds {
+			for _, tagId := range fileTagIds(fileTags, fileId) {
+				if err := fileTags.Delete(pairKey(fileId, tagId)); err != nil {
+					return err
+				}
+			}
+			record, found, err := getFile(files, fileId)
+			if err != nil {
+				return err
+			}
+			if !found {
+				continue
+			}
+			if err = tx.Bucket(filePathsBucket).Delete(pathKey(record.Name, record.Path)); err != nil {
+				return err
+			}
+			if err = files.Delete(idKey(fileId)); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// Orders of file records, by db.FileOrder. A nil order keeps the files in the order they were added; files with
+// equal keys are ordered by name, like the SQLite database does.
+var fileOrders = map[db.FileOrder]func(first fileRecord, second fileRecord) bool{
+	db.ByName: func(first fileRecord, second fileRecord) bool {
+		return first.Name < second.Name
+	},
+	// largest first, files without a recorded size last
+	db.BySize: func(first fileRecord, second fileRecord) bool {
+		if first.Details.ModTime.IsZero() != second.Details.ModTime.IsZero() {
+			return second.Details.ModTime.IsZero()
+		}
+		if first.Details.Size != second.Details.Size {
+			return first.Details.Size > second.Details.Size
+		}
+		return first.Name < second.Name
+	},
+	// most recently modified first, files without a recorded modification time last
+	db.ByModTime: func(first fileRecord, second fileRecord) bool {
+		if !first.Details.ModTime.Equal(second.Details.ModTime) {
+			return first.Details.ModTime.After(second.Details.ModTime)
+		}
+		return first.Name < second.Name
+	},
+	db.ById: nil,
+}
+
+// Reads the files, in the order they were added, whose tag ids pass the test built for the transaction and whose
+// names match the pattern, if there is one (see db.MatchName).
+func (s *Store) selectFiles(ctx context.Context, name string,
+	test func(tx *bolt.Tx) func(tags map[int64]bool) bool) ([]storedFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var selected []storedFile
+	err := s.db.View(func(tx *bolt.Tx) error {
+		selected = nil
+		tags, err := allFileTags(tx)
+		if err != nil {
+			return err
+		}
+		matches := test(tx)
+		return tx.Bucket(filesBucket).ForEach(func(key, value []byte) error {
+			id := idFromKey(key)
+			if !matches(tags[id]) {
+				return nil
+			}
+			var record fileRecord
+			if err := json.Unmarshal(value, &record); err != nil {
+				return err
+			}
+			if len(name) > 0 {
+				if matched, err := db.MatchName(name, record.Name); err != nil || !matched {
+					return err
+				}
+			}
+			selected = append(selected, storedFile{id: id, record: record})
+			return nil
+		})
+	})
+	return selected, err
+}
+
+// Returns the test of the tag ids of a file selecting the files that match the filter. Tags are matched by name, as
+// the SQLite database does; the filter selects no file if a tag it requires isn't in the store.
+func filterTest(tx *bolt.Tx, filter db.TagFilter) func(tags map[int64]bool) bool {
+	var required, excluded []int64
+	missing := false
+	for _, tag := range filter.Tags {
+		found := findTag(tx, tag.Text)
+		missing = missing || found.Id == metadata.UnknownTag.Id
+		required = append(required, found.Id)
+	}
+	for _, tag := range filter.Excluded {
+		if found := findTag(tx, tag.Text); found.Id != metadata.UnknownTag.Id {
+			excluded = append(excluded, found.Id)
+		}
+	}
+	return func(tags map[int64]bool) bool {
+		if missing {
+			return false
+		}
+		for _, id := range required {
+			if !tags[id] {
+				return false
+			}
+		}
+		for _, group := range filter.AnyOf {
+			tagged := false
+			for _, tag := range group {
+				tagged = tagged || tags[tag.Id]
+			}
+			if !tagged {
+				return false
+			}
+		}
+		for _, id := range excluded {
+			if tags[id] {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Looks up a tag by name. Returns metadata.UnknownTag if there is none.
+func findTag(tx *bolt.Tx, name string) metadata.TagInfo {
+	if id := tx.Bucket(tagNamesBucket).Get([]byte(name)); id != nil {
+		return metadata.TagInfo{Id: idFromKey(id), Text: name}
+	}
+	return metadata.UnknownTag
+}
+
+// Deletes a tag, its name and its associations, and removes it from the files that have it if untag is set.
+func deleteTag(tx *bolt.Tx, tag metadata.TagInfo, untag bool) error {
+	if untag {
+		fileTags := tx.Bucket(fileTagsBucket)
+		for _, fileId := range filesTagged(tx, tag.Id) {
+			if err := fileTags.Delete(pairKey(fileId, tag.Id)); err != nil {
+				return err
+			}
+		}
+	}
+	pairs, err := associations(tx)
+	if err != nil {
+		return err
+	}
+	assoc := tx.Bucket(tagAssocBucket)
+	for id := range pairs[tag.Id] {
+		if err := assoc.Delete(assocKey(tag.Id, id)); err != nil {
+			return err
+		}
+	}
+	tags := tx.Bucket(tagsBucket)
+	if name := tags.Get(idKey(tag.Id)); name != nil {
+		if err := tx.Bucket(tagNamesBucket).Delete(append([]byte{}, name...)); err != nil {
+			return err
+		}
+	}
+	return tags.Delete(idKey(tag.Id))
+}
+
+// Reads the associations between tags, as the set of tag ids associated with each tag id.
+func associations(tx *bolt.Tx) (map[int64]map[int64]bool, error) {
+	pairs := make(map[int64]map[int64]bool)
+	add := func(tag int64, other int64) {
+		if pairs[tag] == nil {
+			pairs[tag] = make(map[int64]bool)
+		}
+		pairs[tag][other] = true
+	}
+	err := tx.Bucket(tagAssocBucket).ForEach(func(key, value []byte) error {
+		low, high := idFromKey(key[:8]), idFromKey(key[8:])
+		add(low, high)
+		add(high, low)
+		return nil
+	})
+	return pairs, err
+}
+
+// Reads the tags of every file, as the set of tag ids by file id.
+func allFileTags(tx *bolt.Tx) (map[int64]map[int64]bool, error) {
+	tags := make(map[int64]map[int64]bool)
+	err := tx.Bucket(fileTagsBucket).ForEach(func(key, value []byte) error {
+		fileId, tagId := idFromKey(key[:8]), idFromKey(key[8:])
+		if tags[fileId] == nil {
+			tags[fileId] = make(map[int64]bool)
+		}
+		tags[fileId][tagId] = true
+		return nil
+	})
+	return tags, err
+}
+
+// Lists the ids of the tags of a file.
+func fileTagIds(fileTags *bolt.Bucket, fileId int64) []int64 {
+	var ids []int64
+	prefix := idKey(fileId)
+	cursor := fileTags.Cursor()
+	for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+		ids = append(ids, idFromKey(key[len(prefix):]))
+	}
+	return ids
+}
+
+// Lists the ids of the files that have a tag.
+func filesTagged(tx *bolt.Tx, tagId int64) []int64 {
+	var ids []int64
+	tag := idKey(tagId)
+	cursor := tx.Bucket(fileTagsBucket).Cursor()
+	for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+		if bytes.Equal(key[8:], tag) {
+			ids = append(ids, idFromKey(key[:8]))
+		}
+	}
+	return ids
+}
+
+// Narrows a set of ids to those also in other. A nil set stands for every id.
+func intersect(ids map[int64]bool, other map[int64]bool) map[int64]bool {
+	narrowed := make(map[int64]bool)
+	for id := range other {
+		if ids == nil || ids[id] {
+			narrowed[id] = true
+		}
+	}
+	return narrowed
+}
+
+// Returns the key of the association between two tags, which has the lower id first.
+func assocKey(tagOne int64, tagTwo int64) []byte {
+	if tagOne > tagTwo {
+		tagOne, tagTwo = tagTwo, tagOne
+	}
+	return pairKey(tagOne, tagTwo)
+}
+
+// Returns the names and locations of files.
+func fileInfos(files []storedFile) []metadata.FileInfo {
+	var infos []metadata.FileInfo
+	for _, file := range files {
+		infos = append(infos, file.info())
+	}
+	return infos
+}
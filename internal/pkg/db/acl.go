@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Lets the user see a tag. Tags nobody was granted are visible to every user; once a tag is granted to a user it is
+// only visible to the users it was granted to.
+func GrantTag(db *sql.DB, tag metadata.TagInfo, uid uint32) error {
+	return GrantTagContext(context.Background(), db, tag, uid)
+}
+
+func GrantTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, uid uint32) error {
+	_, err := execWrite(ctx, db, "INSERT OR IGNORE INTO tag_acl VALUES (?,?)", tag.Id, uid)
+	return err
+}
+
+// Takes back a grant made with GrantTag. Revoking the last grant of a tag makes it visible to every user again.
+func RevokeTag(db *sql.DB, tag metadata.TagInfo, uid uint32) error {
+	return RevokeTagContext(context.Background(), db, tag, uid)
+}
+
+func RevokeTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, uid uint32) error {
+	_, err := execWrite(ctx, db, "DELETE FROM tag_acl WHERE tid = ? AND uid = ?", tag.Id, uid)
+	return err
+}
+
+// Lists the tags the user may not see: those granted to other users but not to this one.
+func GetHiddenTags(db *sql.DB, uid uint32) ([]metadata.TagInfo, error) {
+	return GetHiddenTagsContext(context.Background(), db, uid)
+}
+
+func GetHiddenTagsContext(ctx context.Context, db *sql.DB, uid uint32) ([]metadata.TagInfo, error) {
+	return queryTags(ctx, db, "SELECT id, txt FROM tag WHERE id IN (SELECT tid FROM tag_acl) "+
+		"AND id NOT IN (SELECT tid FROM tag_acl WHERE uid = ?) ORDER BY txt ASC", uid)
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"testing"
+)
+
+// Verifies granted tags are hidden from the users they were not granted to.
+func TestTagAcl(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "acl", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	GrantTag(db, tags[0], 1000)
+	GrantTag(db, tags[0], 1001)
+	GrantTag(db, tags[1], 1001)
+	conditions := []struct {
+		uid            uint32
+		expectedHidden []string
+	}{
+		{1000, []string{tags[1].Text}},
+		{1001, nil},
+		{1002, []string{tags[0].Text, tags[1].Text}},
+	}
+	for _, condition := range conditions {
+		hidden, err := GetHiddenTags(db, condition.uid)
+		if err != nil {
+			t.Errorf("Could not get hidden tags: %v", err)
+		}
+		if len(hidden) != len(condition.expectedHidden) {
+			t.Errorf("Expected %v hidden from %d but got %v", condition.expectedHidden, condition.uid, hidden)
+			continue
+		}
+		for i, tag := range hidden {
+			if tag.Text != condition.expectedHidden[i] {
+				t.Errorf("Expected %v hidden from %d but got %v", condition.expectedHidden, condition.uid, hidden)
+			}
+		}
+	}
+	RevokeTag(db, tags[1], 1001)
+	if hidden, _ := GetHiddenTags(db, 1000); len(hidden) != 0 {
+		t.Errorf("Expected revoking the last grant to make the tag visible but %v are hidden", hidden)
+	}
+	DeleteTag(db, tags[0])
+	if hidden, _ := GetHiddenTags(db, 1002); len(hidden) != 0 {
+		t.Errorf("Expected grants to be deleted with the tag but %v are hidden", hidden)
+	}
+}
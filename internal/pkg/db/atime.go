@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"time"
+)
+
+// Records the times files were last accessed, keyed by file id, in one transaction.
+func SetFileAccessTimes(db *sql.DB, accessed map[int64]time.Time) error {
+	return SetFileAccessTimesContext(context.Background(), db, accessed)
+}
+
+func SetFileAccessTimesContext(ctx context.Context, db *sql.DB, accessed map[int64]time.Time) error {
+	if len(accessed) == 0 {
+		return nil
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for fileId, atime := range accessed {
+			if _, err := tx.ExecContext(ctx, "UPDATE file_md SET atime = ? WHERE id = ?", atime.Unix(),
+				fileId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Gets the time a file was last accessed. Reports false if it was never recorded.
+func GetFileAccessTime(db *sql.DB, fileId int64) (time.Time, bool, error) {
+	return GetFileAccessTimeContext(context.Background(), db, fileId)
+}
+
+func GetFileAccessTimeContext(ctx context.Context, db *sql.DB, fileId int64) (time.Time, bool, error) {
+	var atime sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT atime FROM file_md WHERE id = ?", fileId).Scan(&atime)
+	if err == sql.ErrNoRows {
+		return time.Time{}, false, nil
+	}
+	if err != nil || !atime.Valid {
+		return time.Time{}, false, err
+	}
+	return time.Unix(atime.Int64, 0), true, nil
+}
+
+// Lists the files not accessed since the time passed in, including the files never accessed, optionally filtered by
+// name (if name has a length of > 0). Name can also contain 0 or more wildcards characters (*).
+func GetFilesNotAccessedSince(db *sql.DB, since time.Time, name string) ([]metadata.FileInfo, error) {
+	return GetFilesNotAccessedSinceContext(context.Background(), db, since, name)
+}
+
+func GetFilesNotAccessedSinceContext(ctx context.Context, db *sql.DB, since time.Time,
+	name string) ([]metadata.FileInfo, error) {
+	return queryFilesNamedContext(ctx, db,
+		"SELECT f.id, f.name, f.path FROM file_md f WHERE (f.atime IS NULL OR f.atime < ?)",
+		[]interface{}{since.Unix()}, name)
+}
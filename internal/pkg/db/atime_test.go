@@ -0,0 +1,49 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// Verifies access times are recorded and files can be found by them.
+func TestFileAccessTimes(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "atime", 1)
+	recent, _ := CreateFileInPath(db, "recent", "somePath", tags)
+	old, _ := CreateFileInPath(db, "old", "somePath", tags)
+	never, _ := CreateFileInPath(db, "never", "somePath", tags)
+	now := time.Unix(1563100000, 0)
+	yearAgo := now.AddDate(-1, 0, -1)
+	err := SetFileAccessTimes(db, map[int64]time.Time{recent.Id: now, old.Id: yearAgo})
+	if err != nil {
+		t.Errorf("Could not record access times: %v", err)
+	}
+	conditions := []struct {
+		fileId        int64
+		expectedOk    bool
+		expectedAtime time.Time
+	}{
+		{recent.Id, true, now},
+		{old.Id, true, yearAgo},
+		{never.Id, false, time.Time{}},
+		{-1, false, time.Time{}},
+	}
+	for _, condition := range conditions {
+		atime, ok, err := GetFileAccessTime(db, condition.fileId)
+		if err != nil {
+			t.Errorf("Could not get access time of %d: %v", condition.fileId, err)
+		}
+		if ok != condition.expectedOk || !atime.Equal(condition.expectedAtime) {
+			t.Errorf("Expected %v %v for %d but got %v %v", condition.expectedOk, condition.expectedAtime,
+				condition.fileId, ok, atime)
+		}
+	}
+	files, err := GetFilesNotAccessedSince(db, now.AddDate(-1, 0, 0), "")
+	if err != nil || len(files) != 2 || isFileFound(files, recent) {
+		t.Errorf("Expected the old and never accessed files but got %v %v", files, err)
+	}
+	if files, _ = GetFilesNotAccessedSince(db, now.AddDate(-1, 0, 0), "n*"); len(files) != 1 || files[0].Id != never.Id {
+		t.Errorf("Expected only the never accessed file matching the name but got %v", files)
+	}
+}
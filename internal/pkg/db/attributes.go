@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"strconv"
+	"strings"
+)
+
+// Returned by SetFileAttribute for attribute names that query expressions couldn't compare.
+var ErrInvalidAttribute = errors.New("attribute names must not be empty, contain =, < or > or be " + RatingAttribute)
+
+// Creates the table of key=value attributes of files (i.e. camera=Nikon, year=2019), which can be compared in query
+// expressions where plain tags can't express ranges. Values that are numbers are also kept as numbers so they compare
+// as numbers. Attributes go with their file when it is deleted.
+func createFileAttributes(tx *sql.Tx) error {
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS file_attr(fid INTEGER REFERENCES file_md(id) ON DELETE CASCADE, key text, " +
+			"value text, num REAL, PRIMARY KEY (fid, key));",
+		"CREATE INDEX IF NOT EXISTS file_attr_key_idx ON file_attr(key, num);",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the value of an attribute of a file, replacing any value it had.
+func SetFileAttribute(db *sql.DB, fileId int64, key string, value string) error {
+	return SetFileAttributeContext(context.Background(), db, fileId, key, value)
+}
+
+func SetFileAttributeContext(ctx context.Context, db *sql.DB, fileId int64, key string, value string) error {
+	if key == "" || strings.ContainsAny(key, "=<>") || key == RatingAttribute {
+		return ErrInvalidAttribute
+	}
+	_, err := execWrite(ctx, db, "INSERT INTO file_attr (fid, key, value, num) VALUES (?,?,?,?) "+
+		"ON CONFLICT (fid, key) DO UPDATE SET value = excluded.value, num = excluded.num", fileId, key, value,
+		attributeNumber(value))
+	return err
+}
+
+// Removes an attribute from a file. Removing an attribute the file doesn't have does nothing.
+func RemoveFileAttribute(db *sql.DB, fileId int64, key string) error {
+	return RemoveFileAttributeContext(context.Background(), db, fileId, key)
+}
+
+func RemoveFileAttributeContext(ctx context.Context, db *sql.DB, fileId int64, key string) error {
+	_, err := execWrite(ctx, db, "DELETE FROM file_attr WHERE fid = ? AND key = ?", fileId, key)
+	return err
+}
+
+// Gets the attributes of a file by name. A file without attributes (or that isn't recorded) has an empty map.
+func GetFileAttributes(db *sql.DB, fileId int64) (map[string]string, error) {
+	return GetFileAttributesContext(context.Background(), db, fileId)
+}
+
+func GetFileAttributesContext(ctx context.Context, db *sql.DB, fileId int64) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT key, value FROM file_attr WHERE fid = ?", fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attributes := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err = rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		attributes[key] = value
+	}
+	return attributes, rows.Err()
+}
+
+// Returns the value of an attribute as a number if it is one, nil otherwise.
+func attributeNumber(value string) interface{} {
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return nil
+	}
+	return number
+}
+
+// Translates the comparison of an attribute into a SQL condition on the file_md row aliased as f. Numbers are compared
+// with the values of the attribute that are numbers, anything else with the values as text. The rating attribute
+// compares the rating of files instead, see SetFileRating.
+func attributeToSql(attribute query.Attribute) (string, []interface{}, error) {
+	switch attribute.Op {
+	case "=", "<", "<=", ">", ">=":
+	default:
+		return "", nil, fmt.Errorf("unsupported comparison %s", attribute.Op)
+	}
+	if attribute.Key == RatingAttribute {
+		return ratingToSql(attribute)
+	}
+	column, value := "fa.value", interface{}(attribute.Value)
+	if number := attributeNumber(attribute.Value); number != nil {
+		column, value = "fa.num", number
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM file_attr fa WHERE fa.fid = f.id AND fa.key = ? AND %s %s ?)", column,
+		attribute.Op), []interface{}{attribute.Key, value}, nil
+}
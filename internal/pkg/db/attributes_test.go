@@ -0,0 +1,87 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Verifies attributes are set, replaced and removed, and refused for names query expressions couldn't compare.
+func TestFileAttributes(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	file, _ := CreateFileInPath(db, "attributed.jpg", "attributes", nil)
+	conditions := []struct {
+		key         string
+		value       string
+		expectedErr error
+	}{
+		{"camera", "Nikon", nil},
+		{"year", "2018", nil},
+		{"year", "2019", nil},
+		{"", "empty", ErrInvalidAttribute},
+		{"year>", "2019", ErrInvalidAttribute},
+	}
+	for _, condition := range conditions {
+		if err := SetFileAttribute(db, file.Id, condition.key, condition.value); err != condition.expectedErr {
+			t.Errorf("Expected %v setting %s=%s but got %v", condition.expectedErr, condition.key, condition.value, err)
+		}
+	}
+	attributes, err := GetFileAttributes(db, file.Id)
+	if err != nil || len(attributes) != 2 || attributes["camera"] != "Nikon" || attributes["year"] != "2019" {
+		t.Errorf("Unexpected attributes %v (%v)", attributes, err)
+	}
+	RemoveFileAttribute(db, file.Id, "camera")
+	if attributes, _ = GetFileAttributes(db, file.Id); len(attributes) != 1 {
+		t.Errorf("Expected the camera to be removed but got %v", attributes)
+	}
+}
+
+// Verifies attribute comparisons in query expressions compare numbers as numbers and anything else as text.
+func TestGetFilesMatchingAttributes(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := AddTags(db, []string{"attrPhotos"}, nil)
+	files := []struct {
+		name       string
+		attributes map[string]string
+	}{
+		{"attr2017.jpg", map[string]string{"attrYear": "2017", "attrCamera": "Canon"}},
+		{"attr2019.jpg", map[string]string{"attrYear": "2019", "attrCamera": "Nikon"}},
+		{"attr900.jpg", map[string]string{"attrYear": "900"}},
+		{"attrUnknown.jpg", map[string]string{"attrYear": "unknown"}},
+	}
+	for _, file := range files {
+		created, _ := CreateFileInPath(db, file.name, "attributes", tags)
+		for key, value := range file.attributes {
+			SetFileAttribute(db, created.Id, key, value)
+		}
+	}
+	conditions := []struct {
+		expression string
+		expected   string
+	}{
+		{"attrYear>=2018", "attr2019.jpg"},
+		// as text, 900 would sort after 2017
+		{"attrYear<2018", "attr2017.jpg,attr900.jpg"},
+		{"attrYear=unknown", "attrUnknown.jpg"},
+		{"attrCamera=Nikon | attrYear<=1000", "attr2019.jpg,attr900.jpg"},
+		{"attrPhotos & !attrCamera>=A", "attr900.jpg,attrUnknown.jpg"},
+	}
+	for _, condition := range conditions {
+		expr, err := query.Parse(condition.expression)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", condition.expression, err)
+		}
+		matched, err := GetFilesMatchingQuery(db, expr)
+		var names []string
+		for _, file := range matched {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		if err != nil || strings.Join(names, ",") != condition.expected {
+			t.Errorf("Expected %s to match %s but got %v (%v)", condition.expression, condition.expected, names, err)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ChangeDetector reports whether the database was modified through another connection, e.g. by another process.
+// Changes made through the pool the detector was created from (other than its own connection) are reported as well.
+type ChangeDetector struct {
+	conn    *sql.Conn
+	version int64
+}
+
+// Creates a change detector holding its own connection from the pool, which must be released with Close.
+func NewChangeDetector(db *sql.DB) (*ChangeDetector, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	detector := &ChangeDetector{conn: conn}
+	detector.version, err = detector.dataVersion()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return detector, nil
+}
+
+// Reports whether the database changed since the detector was created or this was last called.
+func (c *ChangeDetector) Changed() (bool, error) {
+	version, err := c.dataVersion()
+	if err != nil {
+		return false, err
+	}
+	changed := version != c.version
+	c.version = version
+	return changed, nil
+}
+
+// Releases the connection of the detector.
+func (c *ChangeDetector) Close() error {
+	return c.conn.Close()
+}
+
+// Reads the counter SQLite increments on the connection whenever another connection commits.
+func (c *ChangeDetector) dataVersion() (int64, error) {
+	var version int64
+	err := c.conn.QueryRowContext(context.Background(), "PRAGMA data_version").Scan(&version)
+	return version, err
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies changes committed through another connection are detected once.
+func TestChangeDetector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "changes.db")
+	mount, err := Open(filename)
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer mount.Close()
+	other, err := Open(filename)
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer other.Close()
+	detector, err := NewChangeDetector(mount)
+	if err != nil {
+		t.Errorf("Could not create change detector: %v", err)
+		return
+	}
+	defer detector.Close()
+	conditions := []struct {
+		tag             string
+		expectedChanged bool
+	}{
+		{"", false},
+		{"first", true},
+		{"", false},
+		{"second", true},
+	}
+	for _, condition := range conditions {
+		if len(condition.tag) > 0 {
+			AddTag(other, condition.tag, nil)
+		}
+		if changed, err := detector.Changed(); err != nil || changed != condition.expectedChanged {
+			t.Errorf("Expected changed to be %v after adding %q but got %v (%v)", condition.expectedChanged,
+				condition.tag, changed, err)
+		}
+	}
+}
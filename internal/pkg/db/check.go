@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"os"
+	"path/filepath"
+)
+
+// Settings for Check. The zero value only reports problems, without looking for missing files.
+type CheckOptions struct {
+	// storage the files are looked up in to find the ones that no longer exist, not looked up if nil
+	Storage storage.FileStorage
+	// fixes the problems found rather than only reporting them
+	Repair bool
+	// when repairing, also deletes the records of files that no longer exist. Left out of Repair as files are also
+	// missing while the disk holding them isn't mounted.
+	RemoveMissing bool
+}
+
+// What Check found. Counts are of the problems found, which are also the ones fixed if Repaired is set.
+type CheckReport struct {
+	// problems SQLite found with the database file itself, which Check can't fix
+	Corruption []string
+	// tags of files referring to files or tags that don't exist
+	DanglingFileTags int
+	// associations between tags referring to tags that don't exist
+	DanglingAssociations int
+	// records of files sharing the name and path of an older record
+	DuplicateFiles int
+	// files whose backing path doesn't exist in the storage
+	MissingFiles []metadata.FileInfo
+	// whether the problems found were fixed; missing files only are if RemoveMissing was set
+	Repaired bool
+}
+
+// Tells whether Check found no problems at all.
+func (r CheckReport) OK() bool {
+	return len(r.Corruption) == 0 && r.DanglingFileTags == 0 && r.DanglingAssociations == 0 &&
+		r.DuplicateFiles == 0 && len(r.MissingFiles) == 0
+}
+
+// Checks the integrity of a metadata database: that SQLite finds nothing wrong with the file, that no tags of files or
+// associations between tags refer to records that don't exist, that no two records are of the same file and, if given a
+// storage, that the files recorded still exist. Problems are fixed, all in one transaction, if asked to repair them;
+// duplicate files are merged into the oldest record as done by the upgrade that made them unique.
+func Check(db *sql.DB, options CheckOptions) (CheckReport, error) {
+	return CheckContext(context.Background(), db, options)
+}
+
+func CheckContext(ctx context.Context, db *sql.DB, options CheckOptions) (CheckReport, error) {
+	var report CheckReport
+	rows, err := db.QueryContext(ctx, "PRAGMA quick_check")
+	if err != nil {
+		return CheckReport{}, err
+	}
+	for rows.Next() {
+		var problem string
+		if err = rows.Scan(&problem); err != nil {
+			rows.Close()
+			return CheckReport{}, err
+		}
+		if problem != "ok" {
+			report.Corruption = append(report.Corruption, problem)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return CheckReport{}, err
+	}
+	if options.Storage != nil {
+		files, err := queryFiles(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f ORDER BY f.id")
+		if err != nil {
+			return CheckReport{}, err
+		}
+		for _, file := range files {
+			if _, err = options.Storage.Stat(filepath.Join(file.Path, file.Name)); os.IsNotExist(err) {
+				report.MissingFiles = append(report.MissingFiles, file)
+			}
+		}
+	}
+	err = inTx(ctx, db, func(tx *sql.Tx) error {
+		checks := []struct {
+			table     string
+			condition string
+			found     *int
+		}{
+			{"file_tags", "fid NOT IN (SELECT id FROM file_md) OR tid NOT IN (SELECT id FROM tag)",
+				&report.DanglingFileTags},
+			{"tag_assoc", "t1 NOT IN (SELECT id FROM tag) OR t2 NOT IN (SELECT id FROM tag)",
+				&report.DanglingAssociations},
+			{"file_md", "id NOT IN (SELECT min(id) FROM file_md GROUP BY name, path)", &report.DuplicateFiles},
+		}
+		for _, check := range checks {
+			found, err := countTx(ctx, tx, "SELECT count(*) FROM "+check.table+" WHERE "+check.condition)
+			if err != nil {
+				return err
+			}
+			*check.found = found
+		}
+		if !options.Repair {
+			return nil
+		}
+		// duplicates are merged rather than deleted so their tags are kept
+		for _, check := range checks[:2] {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+check.table+" WHERE "+check.condition); err != nil {
+				return err
+			}
+		}
+		if report.DuplicateFiles > 0 {
+			if err := dedupFiles(tx); err != nil {
+				return err
+			}
+		}
+		if !options.RemoveMissing {
+			return nil
+		}
+		fileIds := make([]int64, len(report.MissingFiles))
+		for i, file := range report.MissingFiles {
+			fileIds[i] = file.Id
+		}
+		_, err := deleteFiles(ctx, tx, fileIds)
+		return err
+	})
+	if err != nil {
+		return CheckReport{}, err
+	}
+	report.Repaired = options.Repair
+	return report, nil
+}
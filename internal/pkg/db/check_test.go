@@ -0,0 +1,81 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/storage"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies Check reports dangling records, duplicate and missing files, and only fixes them when asked to.
+func TestCheck(t *testing.T) {
+	conditions := []struct {
+		repair        bool
+		removeMissing bool
+		// problems a second check finds
+		expectedDangling  int
+		expectedDuplicate int
+		expectedMissing   int
+		expectedFiles     int
+	}{
+		{false, false, 2, 1, 1, 3},
+		{true, false, 0, 0, 1, 2},
+		{true, true, 0, 0, 0, 1},
+	}
+	for i, condition := range conditions {
+		dir, err := ioutil.TempDir("", "cotfs")
+		if err != nil {
+			t.Fatalf("Could not create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		if err = ioutil.WriteFile(filepath.Join(dir, "present.txt"), nil, 0644); err != nil {
+			t.Fatalf("Could not create file: %v", err)
+		}
+		database, err := OpenWithOptions(filepath.Join(dir, "check.db"), OpenOptions{DisableForeignKeys: true})
+		if err != nil {
+			t.Fatalf("Could not open database: %v", err)
+		}
+		defer Close(database)
+		tags, _ := AddTags(database, []string{"kept", "gone"}, nil)
+		present, _ := CreateFileInPath(database, "present.txt", dir, tags[:1])
+		CreateFileInPath(database, "missing.txt", dir, tags[:1])
+		statements := []struct {
+			query  string
+			params []interface{}
+		}{
+			// duplicates can only be recorded without the index keeping them out
+			{"DROP INDEX file_name_path_idx", nil},
+			{"INSERT INTO file_md (name, path) VALUES (?, ?)", []interface{}{"present.txt", dir}},
+			{"INSERT INTO file_tags (fid, tid) SELECT max(id), ? FROM file_md", []interface{}{tags[0].Id}},
+			{"INSERT OR IGNORE INTO tag_assoc VALUES (?, ?)", []interface{}{tags[0].Id, tags[1].Id}},
+			{"DELETE FROM tag WHERE id = ?", []interface{}{tags[1].Id}},
+			{"INSERT INTO file_tags (fid, tid) VALUES (?, ?)", []interface{}{present.Id + 1000, tags[0].Id}},
+		}
+		for _, statement := range statements {
+			if _, err = database.Exec(statement.query, statement.params...); err != nil {
+				t.Fatalf("Could not run %s: %v", statement.query, err)
+			}
+		}
+
+		options := CheckOptions{Storage: storage.LocalFileStorage{}, Repair: condition.repair,
+			RemoveMissing: condition.removeMissing}
+		report, err := Check(database, options)
+		if err != nil {
+			t.Fatalf("Could not check database: %v", err)
+		}
+		if report.OK() || len(report.Corruption) != 0 || report.DanglingFileTags != 1 ||
+			report.DanglingAssociations != 1 || report.DuplicateFiles != 1 || len(report.MissingFiles) != 1 ||
+			report.MissingFiles[0].Name != "missing.txt" || report.Repaired != condition.repair {
+			t.Errorf("Unexpected report for condition %d: %+v", i, report)
+		}
+		after, err := Check(database, CheckOptions{Storage: storage.LocalFileStorage{}})
+		if err != nil || after.DanglingFileTags+after.DanglingAssociations != condition.expectedDangling ||
+			after.DuplicateFiles != condition.expectedDuplicate || len(after.MissingFiles) != condition.expectedMissing {
+			t.Errorf("Unexpected report after condition %d: %+v (%v)", i, after, err)
+		}
+		if files, _ := countRows(database, "SELECT count(*) FROM file_md"); files != condition.expectedFiles {
+			t.Errorf("Expected %d files after condition %d but got %d", condition.expectedFiles, i, files)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Columns holding tag names, along with their type in the schema.
+var tagNameColumns = []struct {
+	table      string
+	definition string
+}{
+	{"tag", "txt text"},
+	{"tag_alias", "alias text"},
+}
+
+const noCase = " COLLATE NOCASE"
+
+// Makes tag names (and aliases) match regardless of case, or only when their case matches too. Names keep the case
+// they were created with either way. The setting is stored in the database schema, so it applies to every process
+// using the database. Returns ErrTagExists if making names case-insensitive would make two of them the same.
+func SetTagCaseInsensitive(db *sql.DB, insensitive bool) error {
+	return SetTagCaseInsensitiveContext(context.Background(), db, insensitive)
+}
+
+func SetTagCaseInsensitiveContext(ctx context.Context, db *sql.DB, insensitive bool) error {
+	return retryBusy(ctx, func() error {
+		return rebuildTagNames(ctx, db, insensitive)
+	})
+}
+
+// Rebuilds the tables holding tag names with the collation matching the case sensitivity once it is its turn to write,
+// see awaitWrite.
+func rebuildTagNames(ctx context.Context, db *sql.DB, insensitive bool) error {
+	done, err := awaitWrite(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer done()
+	// rebuilding the tag table drops it, which would break the references to it; SQLite only lets foreign keys be
+	// turned off outside of transactions so the rebuild gets a connection of its own
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// lookups that found no tag may find one now and the other way around
+	defer FlushCache(db)
+	var foreignKeys bool
+	if err = conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if foreignKeys {
+		if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+			return err
+		}
+		defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	}
+	// the history triggers look up tag names, and renaming the rebuilt table fails on triggers naming a table that
+	// doesn't exist (the one just dropped) unless ALTER TABLE leaves the rest of the schema alone
+	if _, err = conn.ExecContext(ctx, "PRAGMA legacy_alter_table = ON"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA legacy_alter_table = OFF")
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, column := range tagNameColumns {
+		if err = setCollation(tx, column.table, column.definition, insensitive); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	// the unique index is rebuilt with the collation of the column
+	if _, err = tx.ExecContext(ctx, "CREATE UNIQUE INDEX IF NOT EXISTS tag_idx ON tag(txt)"); err != nil {
+		_ = tx.Rollback()
+		return uniqueToTagExists(err)
+	}
+	return tx.Commit()
+}
+
+// Reports whether tag names match regardless of case; see SetTagCaseInsensitive.
+func IsTagCaseInsensitive(db *sql.DB) (bool, error) {
+	return IsTagCaseInsensitiveContext(context.Background(), db)
+}
+
+func IsTagCaseInsensitiveContext(ctx context.Context, db *sql.DB) (bool, error) {
+	var schema string
+	err := db.QueryRowContext(ctx, "SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'tag'").Scan(&schema)
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(schema, tagNameColumns[0].definition+noCase), nil
+}
+
+// Changes the collation of a column by copying the table into one declared with the new collation since SQLite can't
+// alter columns in place. Does nothing if the column already has the collation.
+func setCollation(tx *sql.Tx, table string, definition string, insensitive bool) error {
+	var schema string
+	err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&schema)
+	if err != nil {
+		return err
+	}
+	current := strings.Contains(schema, definition+noCase)
+	if current == insensitive {
+		return nil
+	}
+	rebuilt := table + "_rebuilt"
+	if insensitive {
+		schema = strings.Replace(schema, definition, definition+noCase, 1)
+	} else {
+		schema = strings.Replace(schema, definition+noCase, definition, 1)
+	}
+	// the name may be quoted once the table has been renamed so the whole header is replaced
+	schema = "CREATE TABLE " + rebuilt + schema[strings.Index(schema, "("):]
+	for _, statement := range []string{
+		schema,
+		"INSERT INTO " + rebuilt + " SELECT * FROM " + table,
+		"DROP TABLE " + table,
+		"ALTER TABLE " + rebuilt + " RENAME TO " + table,
+	} {
+		if _, err = tx.Exec(statement); err != nil {
+			return uniqueToTagExists(err)
+		}
+	}
+	return nil
+}
+
+// Reports names that are no longer unique under the new collation as ErrTagExists.
+func uniqueToTagExists(err error) error {
+	if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+		return ErrTagExists
+	}
+	return err
+}
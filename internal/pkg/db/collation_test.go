@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+	"time"
+)
+
+// Verifies tag names match regardless of case once enabled, keeping the case they were created with.
+func TestSetTagCaseInsensitive(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	photos, _ := AddTag(db, "photos", nil)
+	AddAlias(db, photos, "Pics")
+	holidays, _ := AddTag(db, "holidays", []metadata.TagInfo{photos})
+	file, _ := CreateFileInPath(db, "photo.jpg", "somePath", []metadata.TagInfo{photos, holidays})
+	if err := SetTagCaseInsensitive(db, true); err != nil {
+		t.Errorf("Could not make tags case-insensitive: %v", err)
+		return
+	}
+	// rebuilding the tag table must neither drop the files' tags nor leave foreign keys off
+	if tags, _ := GetTagsForFile(db, file.Id); len(tags) != 2 || tags[1].Id != photos.Id {
+		t.Errorf("Expected the file to keep its tag but found %v", tags)
+	}
+	if err := TagFile(db, file.Id, []metadata.TagInfo{{Id: 999, Text: "missing"}}); err == nil {
+		t.Error("Expected foreign keys to still be checked")
+	}
+	if insensitive, _ := IsTagCaseInsensitive(db); !insensitive {
+		t.Error("Expected tags to be case-insensitive")
+	}
+	conditions := []struct {
+		name       string
+		expectedId int64
+	}{
+		{"photos", photos.Id},
+		{"Photos", photos.Id},
+		{"PHOTOS", photos.Id},
+		{"pics", photos.Id},
+		{"videos", -1},
+	}
+	for _, condition := range conditions {
+		tag, err := FindTag(db, condition.name)
+		if err != nil || tag.Id != condition.expectedId {
+			t.Errorf("Expected %s to find tag %d but got %v (%v)", condition.name, condition.expectedId, tag, err)
+		}
+		if tag.Id == photos.Id && tag.Text != "photos" {
+			t.Errorf("Expected the tag to keep its case but got %s", tag.Text)
+		}
+	}
+	// co-occurrences and file listings are looked up by name too
+	if tag, err := GetCoincidentTag(db, "PICS", "Holidays"); err != nil || tag.Id != photos.Id {
+		t.Errorf("Expected PICS to co-occur with Holidays but got %v (%v)", tag, err)
+	}
+	if files, err := GetFilesWithTags(db, []metadata.TagInfo{{Text: "PHOTOS"}}, ""); err != nil || len(files) != 1 {
+		t.Errorf("Expected the file to be found with PHOTOS but got %v (%v)", files, err)
+	}
+	if added, _ := AddTag(db, "Photos", nil); added.Id != photos.Id {
+		t.Errorf("Expected adding Photos to return the existing tag but got %v", added)
+	}
+	if err := SetTagCaseInsensitive(db, false); err != nil {
+		t.Errorf("Could not make tags case-sensitive: %v", err)
+	}
+	AddTag(db, "Photos", nil)
+	if err := SetTagCaseInsensitive(db, true); err != ErrTagExists {
+		t.Errorf("Expected clashing names to be refused but got %v", err)
+	}
+	if tag, _ := FindTag(db, "PHOTOS"); tag.Id != -1 {
+		t.Errorf("Expected tags to stay case-sensitive after a failed change but found %v", tag)
+	}
+}
+
+// Verifies changing the collation waits for its turn to write, giving up once the context is done.
+func TestSetTagCaseInsensitiveContext_AwaitsWrite(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	done, err := awaitWrite(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Could not get the turn to write: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = SetTagCaseInsensitiveContext(ctx, db, true); err != context.DeadlineExceeded {
+		t.Errorf("Expected the change to wait for the other write but got %v", err)
+	}
+	done()
+	if err = SetTagCaseInsensitiveContext(context.Background(), db, true); err != nil {
+		t.Errorf("Could not make tags case-insensitive: %v", err)
+	}
+}
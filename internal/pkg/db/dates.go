@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"strings"
+	"time"
+)
+
+// Formats of the year, month and day date levels, each including the levels above it.
+var dateFormats = []string{"%Y", "%Y/%m", "%Y/%m/%d"}
+
+// Converts the mtime column of file_md (aliased as f) to a date in the local time zone using the format passed in.
+func dateColumn(format string) string {
+	return fmt.Sprintf("strftime('%s', f.mtime, 'unixepoch', 'localtime')", format)
+}
+
+// Records the modification time of a file.
+func SetFileModTime(db *sql.DB, fileId int64, modTime time.Time) error {
+	return SetFileModTimeContext(context.Background(), db, fileId, modTime)
+}
+
+func SetFileModTimeContext(ctx context.Context, db *sql.DB, fileId int64, modTime time.Time) error {
+	_, err := execWrite(ctx, db, "UPDATE file_md SET mtime = ? WHERE id = ?", modTime.Unix(), fileId)
+	return err
+}
+
+// Lists the distinct values of the next date level (year, month or day) of the files modified within the date passed
+// in. The date holds the levels above the one listed so an empty date lists the years, a year lists its months and so
+// on. Files without a modification time are left out.
+func GetFileDates(db *sql.DB, date []string) ([]string, error) {
+	return GetFileDatesContext(context.Background(), db, date)
+}
+
+func GetFileDatesContext(ctx context.Context, db *sql.DB, date []string) ([]string, error) {
+	return GetFileDatesExcludingContext(ctx, db, date, nil)
+}
+
+// Same as GetFileDates but leaves out the files that have any of the excluded tags.
+func GetFileDatesExcluding(db *sql.DB, date []string, excluded []metadata.TagInfo) ([]string, error) {
+	return GetFileDatesExcludingContext(context.Background(), db, date, excluded)
+}
+
+func GetFileDatesExcludingContext(ctx context.Context, db *sql.DB, date []string,
+	excluded []metadata.TagInfo) ([]string, error) {
+	if len(date) >= len(dateFormats) {
+		return nil, nil
+	}
+	query := fmt.Sprintf("SELECT DISTINCT %s AS d FROM file_md f WHERE f.mtime IS NOT NULL",
+		dateColumn(dateFormats[len(date)]))
+	var params []interface{}
+	if len(date) > 0 {
+		query += fmt.Sprintf(" AND %s = ?", dateColumn(dateFormats[len(date)-1]))
+		params = append(params, strings.Join(date, "/"))
+	}
+	query, params = excludingFiles(query, params, excluded)
+	rows, err := db.QueryContext(ctx, query+" ORDER BY d ASC", params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []string
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, value[strings.LastIndex(value, "/")+1:])
+	}
+	return results, nil
+}
+
+// Lists the files modified within the date (year, month and/or day) passed in, optionally filtered by name (if name
+// has a length of > 0). Name can also contain 0 or more wildcards characters (*).
+func GetFilesByDate(db *sql.DB, date []string, name string) ([]metadata.FileInfo, error) {
+	return GetFilesByDateContext(context.Background(), db, date, name)
+}
+
+func GetFilesByDateContext(ctx context.Context, db *sql.DB, date []string, name string) ([]metadata.FileInfo, error) {
+	return GetFilesByDateExcludingContext(ctx, db, date, nil, name)
+}
+
+// Same as GetFilesByDate but leaves out the files that have any of the excluded tags.
+func GetFilesByDateExcluding(db *sql.DB, date []string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFilesByDateExcludingContext(context.Background(), db, date, excluded, name)
+}
+
+func GetFilesByDateExcludingContext(ctx context.Context, db *sql.DB, date []string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	if len(date) == 0 || len(date) > len(dateFormats) {
+		return nil, nil
+	}
+	query, params := excludingFiles(fmt.Sprintf("SELECT f.id, f.name, f.path FROM file_md f WHERE %s = ?",
+		dateColumn(dateFormats[len(date)-1])), []interface{}{strings.Join(date, "/")}, excluded)
+	return queryFilesNamedContext(ctx, db, query, params, name)
+}
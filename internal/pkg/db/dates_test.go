@@ -0,0 +1,64 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+// Verifies files are bucketed by the year, month and day they were modified.
+func TestGetFileDates(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	modTimes := []time.Time{
+		time.Date(2023, 7, 14, 12, 0, 0, 0, time.Local),
+		time.Date(2023, 7, 14, 18, 0, 0, 0, time.Local),
+		time.Date(2023, 8, 1, 9, 0, 0, 0, time.Local),
+		time.Date(2019, 1, 31, 9, 0, 0, 0, time.Local),
+	}
+	for i, modTime := range modTimes {
+		file, err := CreateFileInPath(db, modTime.Format("file-2006-01-02-15"), "path", nil)
+		if err != nil {
+			t.Errorf("Could not create file %d: %v", i, err)
+		}
+		SetFileModTime(db, file.Id, modTime)
+	}
+	// files without a modification time are not bucketed
+	CreateFileInPath(db, "undated", "path", nil)
+	conditions := []struct {
+		date          []string
+		expectedDates []string
+		expectedFiles int
+	}{
+		{nil, []string{"2019", "2023"}, 0},
+		{[]string{"2023"}, []string{"07", "08"}, 3},
+		{[]string{"2023", "07"}, []string{"14"}, 2},
+		{[]string{"2023", "07", "14"}, nil, 2},
+		{[]string{"2019", "01", "31"}, nil, 1},
+		{[]string{"2020"}, nil, 0},
+	}
+	for _, condition := range conditions {
+		dates, err := GetFileDates(db, condition.date)
+		if err != nil {
+			t.Errorf("Could not get dates within %v: %v", condition.date, err)
+		}
+		if len(dates) != len(condition.expectedDates) {
+			t.Errorf("Expected dates %v within %v but got %v", condition.expectedDates, condition.date, dates)
+		} else {
+			for i := range dates {
+				if dates[i] != condition.expectedDates[i] {
+					t.Errorf("Expected dates %v within %v but got %v", condition.expectedDates, condition.date, dates)
+				}
+			}
+		}
+		files, _ := GetFilesByDate(db, condition.date, "")
+		if len(files) != condition.expectedFiles {
+			t.Errorf("Expected %d files within %v but got %d", condition.expectedFiles, condition.date, len(files))
+		}
+	}
+	if files, _ := GetFilesByDate(db, []string{"2023"}, "*-14-*"); len(files) != 2 {
+		t.Errorf("Expected the name to filter dated files but got %v", files)
+	}
+	if files, _ := GetFilesByDate(db, nil, ""); len(files) != 0 {
+		t.Errorf("Expected no files without a date but got %v", files)
+	}
+}
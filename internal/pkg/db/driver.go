@@ -0,0 +1,132 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Prefix of name patterns that are regular expressions (in Go's syntax) rather than names with wildcards, e.g.
+// re:^IMG_[0-9]{4}\.jpe?g$.
+const RegexpPrefix = "re:"
+
+// Most regular expressions kept compiled for the REGEXP function.
+const maxCachedRegexps = 100
+
+// Regular expressions compiled for the REGEXP function by pattern, since SQLite calls it once per row.
+var regexpCache = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// Trigger stamping the changes recorded through a connection with the source of the connection. It is a temporary
+// trigger so it only exists for the connections of the program that created it; changes made by other programs, such
+// as the sqlite3 shell, are recorded without a source.
+const sourceTrigger = "CREATE TEMP TRIGGER IF NOT EXISTS history_source AFTER INSERT ON main.history " +
+	"WHEN new.source IS NULL BEGIN UPDATE history SET source = '%s' WHERE id = new.id; END"
+
+// Names of the drivers registered for each source, see driverName.
+var drivers = struct {
+	sync.Mutex
+	names map[string]string
+}{names: make(map[string]string)}
+
+// Returns the name of a SQLite driver whose connections have the REGEXP function and record the source passed in (if
+// any) with the changes they make, registering it the first time it is needed since database/sql has no other way of
+// setting up every connection of a pool. Connections to databases without the history table (i.e. not migrated yet)
+// don't record the source.
+func driverName(source string) string {
+	drivers.Lock()
+	defer drivers.Unlock()
+	name, ok := drivers.names[source]
+	if ok {
+		return name
+	}
+	name = fmt.Sprintf("sqlite3_cotfs_%d", len(drivers.names))
+	setUp := ""
+	if source != "" {
+		setUp = fmt.Sprintf(sourceTrigger, strings.Replace(source, "'", "''", -1))
+	}
+	sql.Register(name, newDriver(setUp))
+	drivers.names[source] = name
+	return name
+}
+
+// Runs the statement setting up a new connection, if there is one, with the function passed in. Databases that aren't
+// migrated yet don't have the tables the statement refers to, and are left alone.
+func setUpConnection(setUp string, exec func(statement string) error) error {
+	if setUp == "" {
+		return nil
+	}
+	err := exec(setUp)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return nil
+	}
+	return err
+}
+
+// Implements the REGEXP operator: X REGEXP Y calls regexp(Y, X) and is true if X contains a match of the regular
+// expression Y.
+func matchRegexp(pattern string, value string) (bool, error) {
+	regexpCache.Lock()
+	re, ok := regexpCache.compiled[pattern]
+	regexpCache.Unlock()
+	if !ok {
+		var err error
+		if re, err = regexp.Compile(pattern); err != nil {
+			return false, err
+		}
+		regexpCache.Lock()
+		if len(regexpCache.compiled) >= maxCachedRegexps {
+			regexpCache.compiled = make(map[string]*regexp.Regexp)
+		}
+		regexpCache.compiled[pattern] = re
+		regexpCache.Unlock()
+	}
+	return re.MatchString(value), nil
+}
+
+// Builds the condition matching a column against a name pattern, and its parameter. The pattern is either a name,
+// a name where * matches any characters or a regular expression prefixed with RegexpPrefix.
+func nameCondition(column string, pattern string) (string, interface{}) {
+	if strings.HasPrefix(pattern, RegexpPrefix) {
+		return column + " REGEXP ?", strings.TrimPrefix(pattern, RegexpPrefix)
+	}
+	if strings.Contains(pattern, "*") {
+		return column + " LIKE ?", strings.Replace(pattern, "*", "%", -1)
+	}
+	return column + " = ?", pattern
+}
+
+// Reports whether a name matches a pattern as the condition built by nameCondition would, for stores that match names
+// without SQL. As with LIKE, wildcards match without regard to the (ASCII) case of the letters.
+func MatchName(pattern string, name string) (bool, error) {
+	if strings.HasPrefix(pattern, RegexpPrefix) {
+		return matchRegexp(strings.TrimPrefix(pattern, RegexpPrefix), name)
+	}
+	if !strings.Contains(pattern, "*") {
+		return name == pattern, nil
+	}
+	// LIKE also treats % and _ as wildcards
+	var expr bytes.Buffer
+	expr.WriteString("(?s)^")
+	for _, r := range pattern {
+		switch {
+		case r == '*' || r == '%':
+			expr.WriteString(".*")
+		case r == '_':
+			expr.WriteString(".")
+		case r < utf8.RuneSelf && unicode.IsLetter(r):
+			expr.WriteString("[" + string(unicode.ToLower(r)) + string(unicode.ToUpper(r)) + "]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return matchRegexp(expr.String(), name)
+}
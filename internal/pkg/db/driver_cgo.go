@@ -0,0 +1,44 @@
+//go:build !purego && !sqlcipher
+// +build !purego,!sqlcipher
+
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Name the SQLite driver is registered under by its package.
+const sqliteDriver = "sqlite3"
+
+// Returns a driver built on mattn/go-sqlite3, which needs cgo, whose connections have the REGEXP function and run the
+// setUp statement (if any) once connected; see driverName.
+func newDriver(setUp string) driver.Driver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("regexp", matchRegexp, true); err != nil {
+				return err
+			}
+			return setUpConnection(setUp, func(statement string) error {
+				_, err := conn.Exec(statement, nil)
+				return err
+			})
+		},
+	}
+}
+
+// Returns the parameters of a data source name setting up connections with the settings passed in.
+func driverParams(journalMode string, busyTimeoutMillis int64, synchronous string, foreignKeys bool) string {
+	return fmt.Sprintf("_journal_mode=%s&_busy_timeout=%d&_synchronous=%s&_foreign_keys=%t", journalMode,
+		busyTimeoutMillis, synchronous, foreignKeys)
+}
+
+// Whether the driver can open encrypted databases.
+const encryptionSupported = false
+
+// Returns the parameters of a data source name opening a database encrypted with the key passed in; plain SQLite
+// doesn't encrypt databases.
+func driverKeyParams(key string) (string, error) {
+	return "", ErrEncryptionUnsupported
+}
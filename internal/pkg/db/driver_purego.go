@@ -0,0 +1,98 @@
+//go:build purego
+// +build purego
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"modernc.org/sqlite"
+)
+
+// Name the SQLite driver is registered under by its package.
+const sqliteDriver = "sqlite"
+
+// Driver registered by modernc.org/sqlite, which the drivers returned by newDriver open connections with.
+var baseDriver driver.Driver
+
+func init() {
+	// opening a pool doesn't connect, it only looks up the driver
+	pool, err := sql.Open(sqliteDriver, "")
+	if err != nil {
+		panic(err)
+	}
+	baseDriver = pool.Driver()
+	pool.Close()
+	// functions are registered for every connection of the driver rather than per connection
+	err = sqlite.RegisterDeterministicScalarFunction("regexp", 2,
+		func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			pattern, ok := args[0].(string)
+			value, valueOk := args[1].(string)
+			if !ok || !valueOk {
+				// NULL never matches
+				return nil, nil
+			}
+			matched, err := matchRegexp(pattern, value)
+			if err != nil || !matched {
+				return int64(0), err
+			}
+			return int64(1), nil
+		})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// A driver running a statement on each connection it opens.
+type setUpDriver struct {
+	setUp string
+}
+
+// Returns a driver built on modernc.org/sqlite, which is pure Go so programs using it can be built without cgo (i.e.
+// cross-compiled), whose connections have the REGEXP function and run the setUp statement (if any) once connected;
+// see driverName.
+func newDriver(setUp string) driver.Driver {
+	return setUpDriver{setUp: setUp}
+}
+
+func (d setUpDriver) Open(name string) (driver.Conn, error) {
+	conn, err := baseDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	err = setUpConnection(d.setUp, func(statement string) error {
+		execer, ok := conn.(driver.ExecerContext)
+		if !ok {
+			return fmt.Errorf("%T can't run statements", conn)
+		}
+		_, err := execer.ExecContext(context.Background(), statement, nil)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Returns the parameters of a data source name setting up connections with the settings passed in. The busy timeout
+// comes first so it applies while the others wait for locks.
+func driverParams(journalMode string, busyTimeoutMillis int64, synchronous string, foreignKeys bool) string {
+	foreignKeysOn := 0
+	if foreignKeys {
+		foreignKeysOn = 1
+	}
+	return fmt.Sprintf("_pragma=busy_timeout(%d)&_pragma=journal_mode(%s)&_pragma=synchronous(%s)"+
+		"&_pragma=foreign_keys(%d)", busyTimeoutMillis, journalMode, synchronous, foreignKeysOn)
+}
+
+// Whether the driver can open encrypted databases.
+const encryptionSupported = false
+
+// Returns the parameters of a data source name opening a database encrypted with the key passed in; plain SQLite
+// doesn't encrypt databases.
+func driverKeyParams(key string) (string, error) {
+	return "", ErrEncryptionUnsupported
+}
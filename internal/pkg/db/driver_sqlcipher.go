@@ -0,0 +1,48 @@
+//go:build sqlcipher && !purego
+// +build sqlcipher,!purego
+
+package db
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"github.com/mutecomm/go-sqlcipher/v4"
+	"net/url"
+	"strings"
+)
+
+// Name the SQLite driver is registered under by its package.
+const sqliteDriver = "sqlite3"
+
+// Returns a driver built on mutecomm/go-sqlcipher, a fork of mattn/go-sqlite3 bundling SQLCipher so databases can be
+// encrypted, whose connections have the REGEXP function and run the setUp statement (if any) once connected; see
+// driverName.
+func newDriver(setUp string) driver.Driver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			if err := conn.RegisterFunc("regexp", matchRegexp, true); err != nil {
+				return err
+			}
+			return setUpConnection(setUp, func(statement string) error {
+				_, err := conn.Exec(statement, nil)
+				return err
+			})
+		},
+	}
+}
+
+// Returns the parameters of a data source name setting up connections with the settings passed in.
+func driverParams(journalMode string, busyTimeoutMillis int64, synchronous string, foreignKeys bool) string {
+	return fmt.Sprintf("_journal_mode=%s&_busy_timeout=%d&_synchronous=%s&_foreign_keys=%t", journalMode,
+		busyTimeoutMillis, synchronous, foreignKeys)
+}
+
+// Whether the driver can open encrypted databases.
+const encryptionSupported = true
+
+// Returns the parameters of a data source name opening a database encrypted with the key passed in. The driver sets
+// the key, before anything else, with PRAGMA key so the key is quoted as an SQL string; SQLCipher derives the
+// encryption key from it.
+func driverKeyParams(key string) (string, error) {
+	return "_pragma_key=" + url.QueryEscape("'"+strings.Replace(key, "'", "''", -1)+"'"), nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+)
+
+// Verifies names prefixed with re: are matched as regular expressions by file and tag queries.
+func TestRegexpNames(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "regexTag", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	for _, name := range []string{"regexFile1.jpg", "regexFile22.jpg", "regexFile3.png"} {
+		CreateFileInPath(db, name, "regexPath", tags)
+	}
+	conditions := []struct {
+		name          string
+		expectedFiles int
+		expectedTags  int
+		expectedErr   bool
+	}{
+		{"re:^regexFile[0-9]\\.jpg$", 1, 0, false},
+		{"re:\\.jpg$", 2, 0, false},
+		{"re:^regexTag[12]$", 0, 2, false},
+		{"re:(?i)^REGEX", 3, 2, false},
+		{"re:^regexFile3", 1, 0, false},
+		// not a regular expression without the prefix
+		{"regexFile[0-9]\\.jpg", 0, 0, false},
+		{"re:(", 0, 0, true},
+	}
+	for _, condition := range conditions {
+		files, err := GetFilesWithTags(db, tags, condition.name)
+		if (err != nil) != condition.expectedErr || len(files) != condition.expectedFiles {
+			t.Errorf("Expected %d files named %q but got %v (%v)", condition.expectedFiles, condition.name, files,
+				err)
+		}
+		coincident, err := GetCoincidentTags(db, tags[:1], condition.name)
+		if (err != nil) != condition.expectedErr || len(coincident) != condition.expectedTags {
+			t.Errorf("Expected %d tags named %q but got %v (%v)", condition.expectedTags, condition.name, coincident,
+				err)
+		}
+	}
+}
+
+// Verifies the conditions built for each kind of name pattern.
+func TestNameCondition(t *testing.T) {
+	conditions := []struct {
+		pattern           string
+		expectedCondition string
+		expectedParam     string
+	}{
+		{"photo.jpg", "f.name = ?", "photo.jpg"},
+		{"*.jpg", "f.name LIKE ?", "%.jpg"},
+		{"re:^IMG_.*", "f.name REGEXP ?", "^IMG_.*"},
+	}
+	for _, condition := range conditions {
+		found, param := nameCondition("f.name", condition.pattern)
+		if found != condition.expectedCondition || fmt.Sprint(param) != condition.expectedParam {
+			t.Errorf("Expected %s with %s for %s but got %s with %v", condition.expectedCondition,
+				condition.expectedParam, condition.pattern, found, param)
+		}
+	}
+}
+
+// Verifies names are matched against each kind of pattern as the SQL conditions match them.
+func TestMatchName(t *testing.T) {
+	conditions := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"photo.jpg", "photo.jpg", true},
+		{"photo.jpg", "Photo.jpg", false},
+		{"*.jpg", "beach.JPG", true},
+		{"*.jpg", "beach.jpeg", false},
+		{"IMG_*", "imgX1.jpg", true},
+		{"a+b*", "a+b.txt", true},
+		{"re:^IMG_[0-9]+", "IMG_12.jpg", true},
+		{"re:^IMG_[0-9]+", "img_12.jpg", false},
+	}
+	for _, condition := range conditions {
+		found, err := MatchName(condition.pattern, condition.name)
+		if err != nil || found != condition.expected {
+			t.Errorf("Expected matching %q against %s to be %v but got %v (%v)", condition.name, condition.pattern,
+				condition.expected, found, err)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The metadata of a database as written by Export and read by Import. Tags and files are identified by their text and
+// by their name and path rather than by id, so a dump can be loaded into a database other than the one it came from.
+// Tag hierarchies, aliases, permissions, attributes, saved queries, indexer runs and the history aren't part of it.
+type Dump struct {
+	Tags []string `json:"tags"`
+	// pairs of tags used together, as created by mkdir
+	Associations [][2]string `json:"associations,omitempty"`
+	Files        []DumpFile  `json:"files"`
+}
+
+// A file in a Dump. Details that weren't recorded are left out.
+type DumpFile struct {
+	Name string   `json:"name"`
+	Path string   `json:"path"`
+	Tags []string `json:"tags"`
+	Size int64    `json:"size,omitempty"`
+	// modification time in seconds since the epoch
+	ModTime  int64  `json:"mtime,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	MimeType string `json:"mime,omitempty"`
+	Rating   int    `json:"rating,omitempty"`
+	Favorite bool   `json:"favorite,omitempty"`
+	// where the file is kept if not on local disk, see SetFileLocation
+	Scheme   string `json:"scheme,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// What Import does with the files of a dump that are already in the database.
+type ImportMode int
+
+const (
+	// adds the tags of the dumped file to the ones the file has
+	ImportMerge ImportMode = iota
+	// leaves the file as it is
+	ImportSkipExisting
+	// replaces the tags and details of the file with the dumped ones
+	ImportOverwrite
+)
+
+// Settings for Import. The zero value merges the tags of files already in the database.
+type ImportOptions struct {
+	Mode ImportMode
+}
+
+// What Import changed.
+type ImportReport struct {
+	// tags created
+	Tags int
+	// files added
+	Files int
+	// files already in the database whose tags were merged or overwritten
+	Updated int
+	// files already in the database left as they were
+	Skipped int
+}
+
+// Writes the tags, tag associations and files of a database, with their tags and details, as JSON; see Dump.
+func Export(db *sql.DB, w io.Writer) error {
+	return ExportContext(context.Background(), db, w)
+}
+
+func ExportContext(ctx context.Context, db *sql.DB, w io.Writer) error {
+	var dump Dump
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		dump = Dump{Tags: []string{}, Files: []DumpFile{}}
+		rows, err := tx.QueryContext(ctx, "SELECT txt FROM tag ORDER BY txt")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var text string
+			if err = rows.Scan(&text); err != nil {
+				rows.Close()
+				return err
+			}
+			dump.Tags = append(dump.Tags, text)
+		}
+		rows.Close()
+		rows, err = tx.QueryContext(ctx, "SELECT a.txt, b.txt FROM tag_assoc ta, tag a, tag b "+
+			"WHERE ta.t1 = a.id AND ta.t2 = b.id ORDER BY a.txt, b.txt")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var pair [2]string
+			if err = rows.Scan(&pair[0], &pair[1]); err != nil {
+				rows.Close()
+				return err
+			}
+			dump.Associations = append(dump.Associations, pair)
+		}
+		rows.Close()
+		rows, err = tx.QueryContext(ctx, "SELECT f.id, f.name, f.path, coalesce(f.size, 0), coalesce(f.mtime, 0), "+
+			"coalesce(f.checksum, ''), coalesce(f.mime, ''), coalesce(f.rating, 0), f.favorite IS NOT NULL, "+
+			"coalesce(f.scheme, ''), coalesce(f.bucket, ''), coalesce(f.endpoint, ''), t.txt FROM file_md f "+
+			"LEFT JOIN file_tags ft ON ft.fid = f.id LEFT JOIN tag t ON t.id = ft.tid ORDER BY f.id, t.txt")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		var lastId int64
+		for rows.Next() {
+			var id int64
+			var file DumpFile
+			var tag sql.NullString
+			if err = rows.Scan(&id, &file.Name, &file.Path, &file.Size, &file.ModTime, &file.Checksum, &file.MimeType,
+				&file.Rating, &file.Favorite, &file.Scheme, &file.Bucket, &file.Endpoint, &tag); err != nil {
+				return err
+			}
+			// a file comes once per tag
+			if len(dump.Files) == 0 || id != lastId {
+				file.Tags = []string{}
+				dump.Files = append(dump.Files, file)
+				lastId = id
+			}
+			if tag.Valid {
+				last := &dump.Files[len(dump.Files)-1]
+				last.Tags = append(last.Tags, tag.String)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+// Loads a dump written by Export into a database, all in one transaction. Tags are matched by text (or alias) and
+// created if missing; files are matched by name and path and added if missing. Files already in the database are
+// merged, skipped or overwritten depending on the mode.
+func Import(db *sql.DB, r io.Reader, options ImportOptions) (ImportReport, error) {
+	return ImportContext(context.Background(), db, r, options)
+}
+
+func ImportContext(ctx context.Context, db *sql.DB, r io.Reader, options ImportOptions) (ImportReport, error) {
+	var dump Dump
+	if err := json.NewDecoder(r).Decode(&dump); err != nil {
+		return ImportReport{}, fmt.Errorf("could not read dump: %v", err)
+	}
+	if options.Mode < ImportMerge || options.Mode > ImportOverwrite {
+		return ImportReport{}, fmt.Errorf("unknown import mode %d", options.Mode)
+	}
+	var report ImportReport
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		report = ImportReport{}
+		before, err := countTx(ctx, tx, "SELECT count(*) FROM tag")
+		if err != nil {
+			return err
+		}
+		tagIds := make(map[string]int64)
+		tagId := func(text string) (int64, error) {
+			if id, ok := tagIds[text]; ok {
+				return id, nil
+			}
+			tag, err := findOrInsertTag(ctx, tx, text)
+			tagIds[text] = tag.Id
+			return tag.Id, err
+		}
+		for _, text := range dump.Tags {
+			if _, err = tagId(text); err != nil {
+				return err
+			}
+		}
+		for _, pair := range dump.Associations {
+			first, err := tagId(pair[0])
+			if err != nil {
+				return err
+			}
+			second, err := tagId(pair[1])
+			if err != nil {
+				return err
+			}
+			if first == second {
+				continue
+			}
+			if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO tag_assoc VALUES (?,?)", min(first, second),
+				max(first, second)); err != nil {
+				return err
+			}
+		}
+		for _, file := range dump.Files {
+			var id int64
+			err = tx.QueryRowContext(ctx, "SELECT id FROM file_md WHERE name = ? AND path = ?", file.Name,
+				file.Path).Scan(&id)
+			switch {
+			case err == sql.ErrNoRows:
+				res, err := tx.ExecContext(ctx, "INSERT INTO file_md (name, path) VALUES (?, ?)", file.Name, file.Path)
+				if err != nil {
+					return err
+				}
+				if id, err = res.LastInsertId(); err != nil {
+					return err
+				}
+				report.Files++
+			case err != nil:
+				return err
+			case options.Mode == ImportSkipExisting:
+				report.Skipped++
+				continue
+			default:
+				report.Updated++
+			}
+			if options.Mode == ImportOverwrite {
+				if _, err = tx.ExecContext(ctx, "DELETE FROM file_tags WHERE fid = ?", id); err != nil {
+					return err
+				}
+			}
+			for _, text := range file.Tags {
+				tid, err := tagId(text)
+				if err != nil {
+					return err
+				}
+				if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags (fid, tid) VALUES (?,?)", id,
+					tid); err != nil {
+					return err
+				}
+			}
+			if err = importDetails(ctx, tx, id, file, options.Mode == ImportOverwrite); err != nil {
+				return err
+			}
+		}
+		after, err := countTx(ctx, tx, "SELECT count(*) FROM tag")
+		report.Tags = after - before
+		return err
+	})
+	if err != nil {
+		return ImportReport{}, err
+	}
+	return report, nil
+}
+
+// Records the details of a dumped file. Unless overwriting, only the details the file doesn't have yet are set.
+func importDetails(ctx context.Context, tx *sql.Tx, fileId int64, file DumpFile, overwrite bool) error {
+	columns := []struct {
+		name  string
+		value interface{}
+		set   bool
+	}{
+		{"size", file.Size, file.Size != 0},
+		{"mtime", file.ModTime, file.ModTime != 0},
+		{"checksum", file.Checksum, file.Checksum != ""},
+		{"mime", file.MimeType, file.MimeType != ""},
+		{"rating", file.Rating, file.Rating != 0},
+		{"favorite", 1, file.Favorite},
+		{"scheme", file.Scheme, file.Scheme != ""},
+		{"bucket", file.Bucket, file.Bucket != ""},
+		{"endpoint", file.Endpoint, file.Endpoint != ""},
+	}
+	for _, column := range columns {
+		if !column.set {
+			continue
+		}
+		statement := fmt.Sprintf("UPDATE file_md SET %s = ? WHERE id = ?", column.name)
+		if !overwrite {
+			statement += fmt.Sprintf(" AND %s IS NULL", column.name)
+		}
+		if _, err := tx.ExecContext(ctx, statement, column.value, fileId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs a query counting rows within a transaction.
+func countTx(ctx context.Context, tx *sql.Tx, query string) (int, error) {
+	var count int
+	err := tx.QueryRowContext(ctx, query).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Verifies a dump of one database loads into another, merging, skipping or overwriting the files both have.
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	source, err := Open(filepath.Join(dir, "source.db"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(source)
+	tags, _ := AddTags(source, []string{"photos", "beach"}, nil)
+	shared, _ := CreateFileInPath(source, "shared.jpg", "/pics", tags)
+	SetFileDetails(source, shared.Id, metadata.FileDetails{Size: 10, ModTime: time.Unix(1500000000, 0),
+		Checksum: "abc", MimeType: "image/jpeg"})
+	SetFileRating(source, shared.Id, 4)
+	SetFavorite(source, shared.Id, true)
+	CreateFileInPath(source, "new.jpg", "/pics", tags[1:])
+	CreateFileInPath(source, "untagged.jpg", "/pics", nil)
+	var dump bytes.Buffer
+	if err = Export(source, &dump); err != nil {
+		t.Fatalf("Could not export: %v", err)
+	}
+
+	conditions := []struct {
+		mode           ImportMode
+		expectedReport ImportReport
+		expectedTags   string
+		// merging only fills in the details the file doesn't have
+		expectedSize     int64
+		expectedChecksum string
+		// rating and favorite of shared.jpg
+		expectedRating   int
+		expectedFavorite bool
+	}{
+		{ImportMerge, ImportReport{Tags: 2, Files: 2, Updated: 1}, "beach,mountains,photos", 5, "abc", 4, true},
+		{ImportSkipExisting, ImportReport{Tags: 2, Files: 2, Skipped: 1}, "mountains", 5, "", 0, false},
+		{ImportOverwrite, ImportReport{Tags: 2, Files: 2, Updated: 1}, "beach,photos", 10, "abc", 4, true},
+	}
+	for i, condition := range conditions {
+		target, err := Open(filepath.Join(dir, "target"+string(rune('a'+i))+".db"))
+		if err != nil {
+			t.Fatalf("Could not open database: %v", err)
+		}
+		mountains, _ := AddTag(target, "mountains", nil)
+		existing, _ := CreateFileInPath(target, "shared.jpg", "/pics", []metadata.TagInfo{mountains})
+		SetFileStat(target, existing.Id, 5, time.Unix(1400000000, 0))
+		report, err := Import(target, bytes.NewReader(dump.Bytes()), ImportOptions{Mode: condition.mode})
+		if err != nil || report != condition.expectedReport {
+			t.Errorf("Expected %+v for mode %d but got %+v (%v)", condition.expectedReport, condition.mode, report,
+				err)
+		}
+		if found := fileTagNames(target, existing.Id); found != condition.expectedTags {
+			t.Errorf("Expected tags %s for mode %d but got %s", condition.expectedTags, condition.mode, found)
+		}
+		details, _, _ := GetFileDetails(target, existing.Id)
+		if details.Size != condition.expectedSize || details.Checksum != condition.expectedChecksum {
+			t.Errorf("Expected size %d and checksum %q for mode %d but got %+v", condition.expectedSize,
+				condition.expectedChecksum, condition.mode, details)
+		}
+		rating, _ := GetFileRating(target, existing.Id)
+		favorites, _ := GetFavoriteFiles(target, "")
+		if rating != condition.expectedRating || (len(favorites) == 1) != condition.expectedFavorite {
+			t.Errorf("Expected rating %d for mode %d but got %d with favorites %v", condition.expectedRating,
+				condition.mode, rating, favorites)
+		}
+		if added, _ := FindFileByAbsPath(target, "new.jpg", "/pics"); fileTagNames(target, added.Id) != "beach" {
+			t.Errorf("Expected new.jpg to be added with its tag for mode %d", condition.mode)
+		}
+		if count, _ := countRows(target, "SELECT count(*) FROM tag_assoc"); count != 1 {
+			t.Errorf("Expected the association of the dumped tags for mode %d but found %d", condition.mode, count)
+		}
+		Close(target)
+	}
+}
+
+// Verifies dumps that can't be read are refused without changing the database.
+func TestImportInvalid(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	conditions := []struct {
+		dump string
+		mode ImportMode
+	}{
+		{"not json", ImportMerge},
+		{`{"tags": ["importInvalid"]}`, ImportMode(7)},
+	}
+	for _, condition := range conditions {
+		if _, err := Import(db, strings.NewReader(condition.dump), ImportOptions{Mode: condition.mode}); err == nil {
+			t.Errorf("Expected importing %q with mode %d to fail", condition.dump, condition.mode)
+		}
+	}
+	if tag, _ := FindTag(db, "importInvalid"); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected nothing to be imported")
+	}
+}
+
+
+// Helper listing the names of the tags of a file, joined by commas.
+func fileTagNames(db *sql.DB, fileId int64) string {
+	tags, _ := GetTagsForFile(db, fileId)
+	return strings.Join(tagNames(tags), ",")
+}
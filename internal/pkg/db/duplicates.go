@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Lists the files whose content has the checksum passed in (see SetFileDetails), ordered by path and name.
+func FindFilesByHash(db *sql.DB, checksum string) ([]metadata.FileInfo, error) {
+	return FindFilesByHashContext(context.Background(), db, checksum)
+}
+
+func FindFilesByHashContext(ctx context.Context, db *sql.DB, checksum string) ([]metadata.FileInfo, error) {
+	return queryFiles(ctx, db,
+		"SELECT id, name, path FROM file_md WHERE checksum = ? ORDER BY path ASC, name ASC, id ASC", checksum)
+}
+
+// Lists the groups of files with the same content, i.e. sharing a checksum. Each group has at least two files, ordered
+// by path and name, and groups are ordered by checksum. Files without a recorded checksum are left out.
+func ListDuplicateGroups(db *sql.DB) ([][]metadata.FileInfo, error) {
+	return ListDuplicateGroupsContext(context.Background(), db)
+}
+
+func ListDuplicateGroupsContext(ctx context.Context, db *sql.DB) ([][]metadata.FileInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT checksum, id, name, path FROM file_md WHERE checksum IN "+
+		"(SELECT checksum FROM file_md WHERE checksum IS NOT NULL GROUP BY checksum HAVING count(*) > 1) "+
+		"ORDER BY checksum ASC, path ASC, name ASC, id ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups [][]metadata.FileInfo
+	previous := ""
+	for rows.Next() {
+		var checksum string
+		info := metadata.FileInfo{}
+		if err = rows.Scan(&checksum, &info.Id, &info.Name, &info.Path); err != nil {
+			return nil, err
+		}
+		if len(groups) == 0 || checksum != previous {
+			groups = append(groups, nil)
+			previous = checksum
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], info)
+	}
+	return groups, rows.Err()
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+	"time"
+)
+
+// Verifies files are found by checksum and grouped with the other files sharing it.
+func TestDuplicates(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "duplicates", 1)
+	checksums := []string{"dupA", "dupB", "dupA", "unique", "dupB", "dupA", ""}
+	var files []metadata.FileInfo
+	for i, checksum := range checksums {
+		file, _ := CreateFileInPath(db, fmt.Sprintf("dupFile%d", i), "dupPath", tags)
+		if checksum != "" {
+			SetFileDetails(db, file.Id, metadata.FileDetails{Size: 1, ModTime: time.Unix(0, 0), Checksum: checksum,
+				MimeType: "text/plain"})
+		}
+		files = append(files, file)
+	}
+	conditions := []struct {
+		checksum string
+		expected []metadata.FileInfo
+	}{
+		{"dupA", []metadata.FileInfo{files[0], files[2], files[5]}},
+		{"unique", []metadata.FileInfo{files[3]}},
+		{"missing", nil},
+	}
+	for _, condition := range conditions {
+		found, err := FindFilesByHash(db, condition.checksum)
+		if err != nil || fmt.Sprint(found) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v for %s but got %v (%v)", condition.expected, condition.checksum, found, err)
+		}
+	}
+	groups, err := ListDuplicateGroups(db)
+	expected := [][]metadata.FileInfo{{files[0], files[2], files[5]}, {files[1], files[4]}}
+	if err != nil || fmt.Sprint(groups) != fmt.Sprint(expected) {
+		t.Errorf("Expected duplicate groups %v but got %v (%v)", expected, groups, err)
+	}
+}
@@ -1,40 +1,217 @@
+// Package db keeps the metadata of files and tags in a SQLite database. Most functions have a variant named with a
+// Context suffix (i.e. GetAllTagsContext for GetAllTags) taking the context of the request it runs for, which does
+// the same but gives up, returning the context's error, once the context is done; the variant without one runs with
+// context.Background.
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
-	_ "github.com/mattn/go-sqlite3"
 	"log"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
-var ddl = []string{
-	"CREATE TABLE IF NOT EXISTS tag(id INTEGER PRIMARY KEY, txt text);",
-	"CREATE TABLE IF NOT EXISTS file_md(id INTEGER PRIMARY KEY, name text, path text);",
-	"CREATE TABLE IF NOT EXISTS file_tags(fid INTEGER, tid INTEGER, PRIMARY KEY (fid,tid));",
-	"CREATE TABLE IF NOT EXISTS tag_assoc(t1 INTEGER, t2 INTEGER, PRIMARY KEY (t1,t2));",
-	"CREATE UNIQUE INDEX IF NOT EXISTS tag_idx ON tag(txt);"}
+// Returned by RenameTag when a different tag already uses the requested name.
+var ErrTagExists = errors.New("tag already exists")
 
-//Opens the database and creates the schema if it is not present.
+// Returned by SetTagParent when the child is already an ancestor of the parent.
+var ErrTagCycle = errors.New("tag would be its own ancestor")
+
+// Returned when opening a database with a key by a program built without SQLCipher, see OpenOptions.Key.
+var ErrEncryptionUnsupported = errors.New("encrypted metadata databases need cotfs to be built with -tags sqlcipher")
+
+// Describes a set of files by the tags they must and must not have.
+type TagFilter struct {
+	// files must have ALL of these tags
+	Tags []metadata.TagInfo
+	// files must have at least one of the tags in each of these groups
+	AnyOf [][]metadata.TagInfo
+	// files must have NONE of these tags
+	Excluded []metadata.TagInfo
+}
+
+// Settings for opening a database. The zero value has the settings letting several processes (mounts and the indexer)
+// share the database.
+type OpenOptions struct {
+	// copy the database before applying migrations to it, see backupDatabase
+	BackupBeforeMigrate bool
+	// journal mode of the database; WAL (write-ahead logging, the default) lets readers and the writer work at the
+	// same time
+	JournalMode string
+	// how long to wait for locks held by other connections before failing with SQLITE_BUSY; 10 seconds if 0
+	BusyTimeout time.Duration
+	// when writes are synced to disk: OFF, NORMAL (the default, which can only lose the latest changes on power loss
+	// with write-ahead logging), FULL or EXTRA
+	Synchronous string
+	// leave the references from file_tags and tag_assoc to files and tags unchecked
+	DisableForeignKeys bool
+	// make tag names match regardless of case, see SetTagCaseInsensitive; as the setting is stored in the database,
+	// leaving this unset doesn't make them case-sensitive again
+	CaseInsensitiveTags bool
+	// program recorded in the history as the source of the changes made through the database, usually one of
+	// SourceMount, SourceIndexer or SourceCLI; changes are recorded without a source if empty
+	Source string
+	// key the database is encrypted with, taken from the KeyEnvVar environment variable if empty. New databases are
+	// encrypted with it. Only programs built with SQLCipher (-tags sqlcipher) can open encrypted databases; others
+	// fail with ErrEncryptionUnsupported if there is a key.
+	Key string
+	// most connections the pool opens at once, unlimited if 0. Writes made through the pool take turns on one
+	// connection at a time whatever its size (see awaitWrite), so this bounds the reads running alongside them.
+	MaxOpenConns int
+	// connections kept open between uses rather than closed, database/sql's default (2) if 0
+	MaxIdleConns int
+}
+
+// Environment variable holding the key of encrypted databases, so every program opening them (i.e. the indexer) can
+// be given it without passing it on the command line.
+const KeyEnvVar = "COTFS_KEY"
+
+var journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+
+var synchronousModes = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+
+// Returns the connection settings of the options as parameters of the SQLite driver.
+func (o OpenOptions) connectionParams() (string, error) {
+	journalMode, err := optionValue("journal mode", o.JournalMode, "WAL", journalModes)
+	if err != nil {
+		return "", err
+	}
+	synchronous, err := optionValue("synchronous mode", o.Synchronous, "NORMAL", synchronousModes)
+	if err != nil {
+		return "", err
+	}
+	busyTimeout := o.BusyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = 10 * time.Second
+	}
+	params := driverParams(journalMode, busyTimeout.Nanoseconds()/int64(time.Millisecond), synchronous,
+		!o.DisableForeignKeys)
+	keyParams, err := o.keyParams()
+	if err != nil || keyParams == "" {
+		return params, err
+	}
+	return params + "&" + keyParams, nil
+}
+
+// Returns the parameters of the SQLite driver opening a database encrypted with the key of the options, or with the
+// one in the KeyEnvVar environment variable if the options have none. Returns no parameters without a key.
+func (o OpenOptions) keyParams() (string, error) {
+	key := o.Key
+	if key == "" {
+		key = os.Getenv(KeyEnvVar)
+	}
+	if key == "" {
+		return "", nil
+	}
+	return driverKeyParams(key)
+}
+
+// Returns the upper-cased value of an option if it is one of the values allowed, the default if it is empty.
+func optionValue(option string, value string, defaultValue string, allowed []string) (string, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	value = strings.ToUpper(value)
+	for _, candidate := range allowed {
+		if value == candidate {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %s, expected one of %s", option, value, strings.Join(allowed, ", "))
+}
+
+// Number of memory databases named, see NewMemoryDatabase.
+var memoryDatabases uint64
+
+// Returns the name of a new database kept in memory rather than in a file, for passing to Open. Every pool opened on
+// the name shares the database, which is discarded once they are all closed; each name is unique, so separate
+// callers never share one.
+func NewMemoryDatabase() string {
+	return fmt.Sprintf("file:cotfs-memory-%d?mode=memory&cache=shared", atomic.AddUint64(&memoryDatabases, 1))
+}
+
+// Opens the database and creates the schema if it is not present. The database should be closed with Close.
 func Open(filename string) (*sql.DB, error) {
-	db, err := sql.Open("sqlite3", filename)
+	return OpenWithOptions(filename, OpenOptions{})
+}
+
+// Opens the database, creating the schema if it is not present and applying any migrations it doesn't have yet.
+func OpenWithOptions(filename string, options OpenOptions) (*sql.DB, error) {
+	params, err := options.connectionParams()
+	if err != nil {
+		return nil, err
+	}
+	dataSource := withParams(filename, params)
+	db, err := sql.Open(driverName(""), dataSource)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for i := 0; i < len(ddl); i++ {
-		_, err = db.Exec(ddl[i])
-		if err != nil {
-			log.Printf("%q: %s\n", err, ddl[i])
+	if err = migrate(db, filename, options.BackupBeforeMigrate); err != nil {
+		Close(db)
+		return nil, err
+	}
+	if err = setUpFileSearch(db); err != nil {
+		Close(db)
+		return nil, err
+	}
+	if options.CaseInsensitiveTags {
+		if err = SetTagCaseInsensitive(db, true); err != nil {
+			Close(db)
 			return nil, err
 		}
 	}
-	return db, nil
+	if options.Source == "" {
+		options.configurePool(db)
+		return db, nil
+	}
+	// connections only record their source if the history table existed when they were made, so the database is
+	// used through a new pool now that it is migrated; pinging it keeps in-memory databases alive once db is closed
+	recording, err := sql.Open(driverName(options.Source), dataSource)
+	if err != nil {
+		Close(db)
+		return nil, err
+	}
+	err = recording.Ping()
+	Close(db)
+	if err != nil {
+		Close(recording)
+		return nil, err
+	}
+	options.configurePool(recording)
+	return recording, nil
+}
+
+// Returns the data source name of a database with the driver parameters passed in added to the ones it has.
+func withParams(filename string, params string) string {
+	if strings.Contains(filename, "?") {
+		return filename + "&" + params
+	}
+	return filename + "?" + params
+}
+
+// Sizes the pool of connections to a database as set by the options.
+func (o OpenOptions) configurePool(db *sql.DB) {
+	if o.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(o.MaxOpenConns)
+	}
+	if o.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(o.MaxIdleConns)
+	}
 }
 
-//Lists all tags in the database.
+// Lists all tags in the database.
 func GetAllTags(db *sql.DB) ([]metadata.TagInfo, error) {
-	rows, err := db.Query("select id, txt from tag order by txt DESC")
+	return GetAllTagsContext(context.Background(), db)
+}
+
+func GetAllTagsContext(ctx context.Context, db *sql.DB) ([]metadata.TagInfo, error) {
+	rows, err := db.QueryContext(ctx, "select id, txt from tag order by txt DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -53,134 +230,503 @@ func GetAllTags(db *sql.DB) ([]metadata.TagInfo, error) {
 
 // Removes the assoc record between the two tags
 func UnassociateTag(db *sql.DB, tagOne metadata.TagInfo, tagTwo metadata.TagInfo) error {
-	_, err := db.Exec("DELETE FROM tag_assoc where t1 = ? and t2 = ?", min(tagOne.Id, tagTwo.Id), max(tagOne.Id, tagTwo.Id))
+	return UnassociateTagContext(context.Background(), db, tagOne, tagTwo)
+}
+
+func UnassociateTagContext(ctx context.Context, db *sql.DB, tagOne metadata.TagInfo, tagTwo metadata.TagInfo) error {
+	_, err := execWrite(ctx, db, "DELETE FROM tag_assoc where t1 = ? and t2 = ?", min(tagOne.Id, tagTwo.Id),
+		max(tagOne.Id, tagTwo.Id))
 	return err
 }
 
 // Deletes a tag from the tag and tag_assoc table
 func DeleteTag(db *sql.DB, tag metadata.TagInfo) error {
-	tx, err := db.Begin()
-	if err != nil {
+	return DeleteTagContext(context.Background(), db, tag)
+}
+
+func DeleteTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		statements := []string{
+			"DELETE FROM tag_assoc WHERE t1 = ?1 OR t2 = ?1",
+			"DELETE FROM tag_alias WHERE tid = ?1",
+			"DELETE FROM tag_parent WHERE parent = ?1 OR child = ?1",
+			"DELETE FROM tag_acl WHERE tid = ?1",
+			"DELETE FROM trash WHERE tid = ?1",
+			"DELETE FROM tag WHERE id = ?1",
+		}
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement, tag.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Deletes a tag along with its associations, removing it from every file. Files that only had this tag are tagged
+// with the fallback tag (created if needed) instead so they are not left un-tagged.
+func DeleteTagRecursive(db *sql.DB, tag metadata.TagInfo, fallback string) error {
+	return DeleteTagRecursiveContext(context.Background(), db, tag, fallback)
+}
+
+func DeleteTagRecursiveContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, fallback string) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		fallbackTag, err := findOrInsertTag(ctx, tx, fallback)
+		if err != nil {
+			return err
+		}
+		if fallbackTag.Id == tag.Id {
+			return fmt.Errorf("cannot replace tag %s with itself", tag.Text)
+		}
+		statements := []struct {
+			query  string
+			params []interface{}
+		}{
+			{"INSERT OR IGNORE INTO file_tags SELECT fid, ? FROM file_tags WHERE tid = ? AND fid IN " +
+				"(SELECT fid FROM file_tags GROUP BY fid HAVING count(*) = 1)",
+				[]interface{}{fallbackTag.Id, tag.Id}},
+			{"DELETE FROM file_tags WHERE tid = ?",
+				[]interface{}{tag.Id}},
+			{"DELETE FROM tag_assoc WHERE t1 = ? OR t2 = ?",
+				[]interface{}{tag.Id, tag.Id}},
+			{"DELETE FROM tag_alias WHERE tid = ?",
+				[]interface{}{tag.Id}},
+			{"DELETE FROM tag_parent WHERE parent = ? OR child = ?",
+				[]interface{}{tag.Id, tag.Id}},
+			{"DELETE FROM tag_acl WHERE tid = ?",
+				[]interface{}{tag.Id}},
+			{"DELETE FROM trash WHERE tid = ?",
+				[]interface{}{tag.Id}},
+			{"DELETE FROM tag WHERE id = ?",
+				[]interface{}{tag.Id}},
+		}
+		for _, statement := range statements {
+			if _, err = tx.ExecContext(ctx, statement.query, statement.params...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// What CollectGarbage removed.
+type GarbageReport struct {
+	// tags not applied to any file
+	Tags int
+	// associations between tags that no file has together
+	Associations int
+	// links, aliases, grants and the like referring to files or tags that no longer exist
+	Dangling int
+}
+
+// Removes tags that are not applied to any file, associations between tags that no file has together and any records
+// left dangling by deleted files or tags. Returns a report of what was removed.
+func CollectGarbage(db *sql.DB) (GarbageReport, error) {
+	return CollectGarbageContext(context.Background(), db)
+}
+
+func CollectGarbageContext(ctx context.Context, db *sql.DB) (GarbageReport, error) {
+	var report GarbageReport
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		report = GarbageReport{}
+		// tags removed from files by rm are kept while the files are in the trash so they can be restored
+		applied := "WITH applied(fid, tid) AS (SELECT fid, tid FROM file_tags UNION SELECT fid, tid FROM trash) "
+		statements := []struct {
+			query   string
+			removed *int
+		}{
+			{"DELETE FROM file_tags WHERE fid NOT IN (SELECT id FROM file_md) OR tid NOT IN (SELECT id FROM tag)",
+				&report.Dangling},
+			{"DELETE FROM trash WHERE fid NOT IN (SELECT id FROM file_md) OR tid NOT IN (SELECT id FROM tag)",
+				&report.Dangling},
+			// associations reference the tags so they go first
+			{applied + "DELETE FROM tag_assoc WHERE NOT EXISTS (SELECT 1 FROM applied a, applied b " +
+				"WHERE a.tid = tag_assoc.t1 AND b.tid = tag_assoc.t2 AND a.fid = b.fid)",
+				&report.Associations},
+			{applied + "DELETE FROM tag WHERE id NOT IN (SELECT tid FROM applied) " +
+				"AND id NOT IN (SELECT t1 FROM tag_assoc) AND id NOT IN (SELECT t2 FROM tag_assoc)",
+				&report.Tags},
+			{"DELETE FROM tag_alias WHERE tid NOT IN (SELECT id FROM tag)",
+				&report.Dangling},
+			{"DELETE FROM tag_parent WHERE parent NOT IN (SELECT id FROM tag) OR child NOT IN (SELECT id FROM tag)",
+				&report.Dangling},
+			{"DELETE FROM tag_acl WHERE tid NOT IN (SELECT id FROM tag)",
+				&report.Dangling},
+			{"DELETE FROM file_attr WHERE fid NOT IN (SELECT id FROM file_md)",
+				&report.Dangling},
+		}
+		for _, statement := range statements {
+			res, err := tx.ExecContext(ctx, statement.query)
+			if err != nil {
+				return err
+			}
+			removed, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			*statement.removed += int(removed)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// What RebuildTagAssociations changed.
+type AssociationReport struct {
+	// pairs of tags some file has together that weren't associated
+	Added int
+	// associations between tags that no file has together
+	Removed int
+}
+
+// Recomputes the associations between tags from the tags of files, in bulk, for when they drifted (i.e. after files
+// were untagged or tagged by other tools). Every pair of tags a file has, or had before being moved to the trash, is
+// associated and every other association removed, including the ones mkdir made for tags no file has yet. Returns
+// what changed.
+func RebuildTagAssociations(db *sql.DB) (AssociationReport, error) {
+	return RebuildTagAssociationsContext(context.Background(), db)
+}
+
+func RebuildTagAssociationsContext(ctx context.Context, db *sql.DB) (AssociationReport, error) {
+	var report AssociationReport
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		report = AssociationReport{}
+		// associations are stored with the lower id first
+		pairs := "WITH applied(fid, tid) AS (SELECT fid, tid FROM file_tags UNION SELECT fid, tid FROM trash), " +
+			"pairs(t1, t2) AS (SELECT DISTINCT a.tid, b.tid FROM applied a, applied b " +
+			"WHERE a.fid = b.fid AND a.tid < b.tid) "
+		statements := []struct {
+			query   string
+			changed *int
+		}{
+			{pairs + "DELETE FROM tag_assoc WHERE NOT EXISTS (SELECT 1 FROM pairs p " +
+				"WHERE p.t1 = tag_assoc.t1 AND p.t2 = tag_assoc.t2)", &report.Removed},
+			{pairs + "INSERT OR IGNORE INTO tag_assoc SELECT t1, t2 FROM pairs", &report.Added},
+		}
+		for _, statement := range statements {
+			res, err := tx.ExecContext(ctx, statement.query)
+			if err != nil {
+				return err
+			}
+			changed, err := res.RowsAffected()
+			if err != nil {
+				return err
+			}
+			*statement.changed = int(changed)
+		}
+		return nil
+	})
+	return report, err
+}
+
+// Changes the text of an existing tag in place, keeping its files and co-occurrences. If another tag already has the
+// new text as its name or an alias, that tag is returned with ErrTagExists and nothing is changed so the caller can
+// decide whether to merge the two tags instead.
+func RenameTag(db *sql.DB, tag metadata.TagInfo, newText string) (metadata.TagInfo, error) {
+	return RenameTagContext(context.Background(), db, tag, newText)
+}
+
+func RenameTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, newText string) (metadata.TagInfo, error) {
+	existingTag := metadata.UnknownTag
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		// looked up in the transaction so a tag another process adds with the name meanwhile isn't missed
+		existingTag = metadata.UnknownTag
+		err := tx.QueryRowContext(ctx, "SELECT id, txt FROM tag WHERE "+tagNameCondition, newText, newText).
+			Scan(&existingTag.Id, &existingTag.Text)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if existingTag.Id != metadata.UnknownTag.Id && existingTag.Id != tag.Id {
+			return ErrTagExists
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE tag SET txt = ? WHERE id = ?", newText, tag.Id); err != nil {
+			return uniqueToTagExists(err)
+		}
+		// the new name may have been an alias of the tag, which is now redundant
+		_, err = tx.ExecContext(ctx, "DELETE FROM tag_alias WHERE alias = ?", newText)
 		return err
+	})
+	if err == ErrTagExists {
+		return existingTag, err
 	}
-	_, err = db.Exec("DELETE FROM TAG_ASSOC WHERE t1 = ? or t2 = ?", tag.Id, tag.Id)
 	if err != nil {
-		_ = tx.Rollback()
-		return err
+		return metadata.UnknownTag, err
 	}
-	_, err = db.Exec("DELETE FROM TAG WHERE id = ?", tag.Id)
-	return tx.Commit()
+	return metadata.TagInfo{Id: tag.Id, Text: newText}, nil
+}
+
+// Folds the source tag into the target tag: every file and co-occurrence of the source is transferred to the target
+// and the source tag is deleted.
+func MergeTags(db *sql.DB, source metadata.TagInfo, target metadata.TagInfo) error {
+	return MergeTagsContext(context.Background(), db, source, target)
+}
+
+func MergeTagsContext(ctx context.Context, db *sql.DB, source metadata.TagInfo, target metadata.TagInfo) error {
+	if source.Id == target.Id {
+		return nil
+	}
+	statements := []struct {
+		query  string
+		params []interface{}
+	}{
+		{"INSERT OR IGNORE INTO file_tags SELECT fid, ? FROM file_tags WHERE tid = ?",
+			[]interface{}{target.Id, source.Id}},
+		{"DELETE FROM file_tags WHERE tid = ?",
+			[]interface{}{source.Id}},
+		// keep the t1 < t2 invariant and drop the pair that would associate the target with itself
+		{"INSERT OR IGNORE INTO tag_assoc SELECT min(t2, ?), max(t2, ?) FROM tag_assoc WHERE t1 = ? AND t2 != ? " +
+			"UNION SELECT min(t1, ?), max(t1, ?) FROM tag_assoc WHERE t2 = ? AND t1 != ?",
+			[]interface{}{target.Id, target.Id, source.Id, target.Id, target.Id, target.Id, source.Id, target.Id}},
+		{"DELETE FROM tag_assoc WHERE t1 = ? OR t2 = ?",
+			[]interface{}{source.Id, source.Id}},
+		{"UPDATE tag_alias SET tid = ? WHERE tid = ?",
+			[]interface{}{target.Id, source.Id}},
+		// the target takes over the place of the source in the hierarchy, without becoming its own parent
+		{"INSERT OR IGNORE INTO tag_parent SELECT ?, child FROM tag_parent WHERE parent = ? AND child != ? " +
+			"UNION SELECT parent, ? FROM tag_parent WHERE child = ? AND parent != ?",
+			[]interface{}{target.Id, source.Id, target.Id, target.Id, source.Id, target.Id}},
+		{"DELETE FROM tag_parent WHERE parent = ? OR child = ?",
+			[]interface{}{source.Id, source.Id}},
+		{"INSERT OR IGNORE INTO tag_acl SELECT ?, uid FROM tag_acl WHERE tid = ?",
+			[]interface{}{target.Id, source.Id}},
+		{"DELETE FROM tag_acl WHERE tid = ?",
+			[]interface{}{source.Id}},
+		{"INSERT OR IGNORE INTO trash SELECT fid, ?, deleted FROM trash WHERE tid = ?",
+			[]interface{}{target.Id, source.Id}},
+		{"DELETE FROM trash WHERE tid = ?",
+			[]interface{}{source.Id}},
+		{"DELETE FROM tag WHERE id = ?",
+			[]interface{}{source.Id}},
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement.query, statement.params...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // Adds a tag to the database and updates the co-occurrence table.
 // If the tag already exists, only the co-occurrence table will be updated.
 // Returns id of tag
 func AddTag(db *sql.DB, newTag string, tagContext []metadata.TagInfo) (metadata.TagInfo, error) {
-	existingTag, err := FindTag(db, newTag)
+	return AddTagContext(context.Background(), db, newTag, tagContext)
+}
+
+func AddTagContext(ctx context.Context, db *sql.DB, newTag string,
+	tagContext []metadata.TagInfo) (metadata.TagInfo, error) {
+	tags, err := AddTagsContext(ctx, db, []string{newTag}, tagContext)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
-	tx, err := db.Begin()
+	return tags[0], nil
+}
 
+// Adds a chain of tags (i.e. the directories created by mkdir -p a/b/c) in a single transaction. Each tag is created if
+// it does not exist yet and every tag in the chain and the context is associated with every other one, including
+// context tags that were not associated before, so a failure never leaves partial associations behind.
+func AddTags(db *sql.DB, newTags []string, tagContext []metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return AddTagsContext(context.Background(), db, newTags, tagContext)
+}
+
+func AddTagsContext(ctx context.Context, db *sql.DB, newTags []string,
+	tagContext []metadata.TagInfo) ([]metadata.TagInfo, error) {
+	defer observe("AddTags", time.Now())
+	var added []metadata.TagInfo
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		allTags := append([]metadata.TagInfo{}, tagContext...)
+		added = nil
+		for _, newTag := range newTags {
+			tag, err := findOrInsertTag(ctx, tx, newTag)
+			if err != nil {
+				return err
+			}
+			added = append(added, tag)
+			allTags = append(allTags, tag)
+		}
+		//now update co-incidence table
+		//we enforce that t1 < t2 and ignore conflicts so we don't have to do checking on rows
+		for i, tag := range allTags {
+			for _, other := range allTags[i+1:] {
+				if tag.Id == other.Id {
+					continue
+				}
+				_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO tag_assoc VALUES (?,?)", min(tag.Id, other.Id),
+					max(tag.Id, other.Id))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// Gets a tag by name within a transaction, inserting it if it does not exist.
+func findOrInsertTag(ctx context.Context, tx *sql.Tx, text string) (metadata.TagInfo, error) {
+	tag := metadata.TagInfo{Text: text}
+	err := tx.QueryRowContext(ctx, "SELECT id, txt FROM tag WHERE "+tagNameCondition, text, text).Scan(&tag.Id,
+		&tag.Text)
+	if err == nil {
+		return tag, nil
+	}
+	if err != sql.ErrNoRows {
+		return metadata.UnknownTag, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO tag (txt) VALUES(?)", text)
+	if err != nil {
+		return metadata.UnknownTag, err
+	}
+	tag.Id, err = res.LastInsertId()
 	if err != nil {
-		_ = tx.Rollback()
 		return metadata.UnknownTag, err
+	}
+	return tag, nil
+}
+
+// Condition matching the tag table (aliased as tag) against a name that is either the tag's text or one of its aliases.
+// Takes the name twice as parameters.
+const tagNameCondition = "(tag.txt = ? OR tag.id IN (SELECT tid FROM tag_alias WHERE alias = ?))"
 
+// Adds an alternate name for a tag. Both names then resolve to the tag but only its text is listed. Returns
+// ErrTagExists if the alias is already the name (or an alias) of a different tag.
+func AddAlias(db *sql.DB, tag metadata.TagInfo, alias string) error {
+	return AddAliasContext(context.Background(), db, tag, alias)
+}
+
+func AddAliasContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, alias string) error {
+	existingTag, err := FindTagContext(ctx, db, alias)
+	if err != nil {
+		return err
 	}
-	if existingTag.Id < 0 {
-		//tag does not exist, need to insert
-		res, err := db.Exec("INSERT INTO tag (txt) VALUES(?)", newTag)
-		if err != nil {
-			_ = tx.Rollback()
-			return metadata.UnknownTag, err
-		}
-		newId, err := res.LastInsertId()
-		if err != nil {
-			_ = tx.Rollback()
-			return metadata.UnknownTag, err
-		}
-		existingTag = metadata.TagInfo{Id: newId, Text: newTag}
+	if existingTag.Id == tag.Id {
+		return nil
 	}
-	//now update co-incidence table
-	//we enforce that t1 < t2 and ignore conflicts so we don't have to do checking on rows
-	if tagContext != nil {
-		for _, tag := range tagContext {
-			_, err = db.Exec("INSERT OR IGNORE INTO tag_assoc VALUES (?,?)",
-				min(tag.Id, existingTag.Id), max(tag.Id, existingTag.Id))
-			if err != nil {
-				_ = tx.Rollback()
-				return existingTag, err
-			}
-		}
+	if existingTag.Id != metadata.UnknownTag.Id {
+		return ErrTagExists
 	}
-	err = tx.Commit()
+	_, err = execWrite(ctx, db, "INSERT INTO tag_alias (alias, tid) VALUES (?, ?)", alias, tag.Id)
+	return err
+}
+
+// Removes an alternate name of a tag.
+func RemoveAlias(db *sql.DB, alias string) error {
+	return RemoveAliasContext(context.Background(), db, alias)
+}
+
+func RemoveAliasContext(ctx context.Context, db *sql.DB, alias string) error {
+	_, err := execWrite(ctx, db, "DELETE FROM tag_alias WHERE alias = ?", alias)
+	return err
+}
+
+// Lists the alternate names of a tag.
+func GetAliases(db *sql.DB, tag metadata.TagInfo) ([]string, error) {
+	return GetAliasesContext(context.Background(), db, tag)
+}
+
+func GetAliasesContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo) ([]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT alias FROM tag_alias WHERE tid = ? ORDER BY alias", tag.Id)
 	if err != nil {
-		return existingTag, err
+		return nil, err
 	}
-	return existingTag, nil
+	defer rows.Close()
+	var aliases []string
+	for rows.Next() {
+		var alias string
+		if err = rows.Scan(&alias); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias)
+	}
+	return aliases, nil
 }
 
-// Gets the id of a tag by name. If no tag exists, returns metadata.UnknownTag
+// Gets the id of a tag by name or alias. If no tag exists, returns metadata.UnknownTag
 func FindTag(db *sql.DB, tag string) (metadata.TagInfo, error) {
-	query := "select id, txt from tag where tag.txt = ?"
-	stmt, err := db.Prepare(query)
+	return FindTagContext(context.Background(), db, tag)
+}
+
+func FindTagContext(ctx context.Context, db *sql.DB, tag string) (metadata.TagInfo, error) {
+	defer observe("FindTag", time.Now())
+	key := tagKey{tag: tag}
+	info, ok, generation := cachedTag(db, key)
+	if ok {
+		return info, nil
+	}
+	query := "select id, txt from tag where " + tagNameCondition
+	stmt, release, err := prepareCached(ctx, db, query)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(tag)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, tag, tag)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
 	defer rows.Close()
+	info = metadata.UnknownTag
 	if rows.Next() {
-		info := metadata.TagInfo{}
-		err := rows.Scan(&info.Id, &info.Text)
-		if err != nil {
+		if err = rows.Scan(&info.Id, &info.Text); err != nil {
 			return metadata.UnknownTag, err
-		} else {
-			return info, nil
 		}
-	} else {
-		return metadata.UnknownTag, nil
 	}
+	cacheTag(db, key, info, generation)
+	return info, nil
 }
 
-// Returns tag record for tagOne if it is co-incident with tagTwo.
+// Returns tag record for tagOne (a tag name or alias) if it is co-incident with tagTwo.
 func GetCoincidentTag(db *sql.DB, tagOne string, tagTwo string) (metadata.TagInfo, error) {
-	query := "select id, txt from tag where tag.txt = ? and tag.id in " +
+	return GetCoincidentTagContext(context.Background(), db, tagOne, tagTwo)
+}
+
+func GetCoincidentTagContext(ctx context.Context, db *sql.DB, tagOne string, tagTwo string) (metadata.TagInfo, error) {
+	defer observe("GetCoincidentTag", time.Now())
+	key := tagKey{tag: tagOne, other: tagTwo, pair: true}
+	tagInfo, ok, generation := cachedTag(db, key)
+	if ok {
+		return tagInfo, nil
+	}
+	query := "select id, txt from tag where " + tagNameCondition + " and tag.id in " +
 		" (select ta.t1 from tag_assoc ta, tag tt where tt.txt = ? and tt.id = ta.t2 " +
 		" UNION select ta.t2 from tag_assoc ta, tag tt where tt.txt = ? and tt.id = ta.t1 )"
-	stmt, err := db.Prepare(query)
+	stmt, release, err := prepareCached(ctx, db, query)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(tagOne, tagTwo, tagTwo)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, tagOne, tagOne, tagTwo, tagTwo)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
 	defer rows.Close()
+	tagInfo = metadata.UnknownTag
 	if rows.Next() {
-		var tagInfo = metadata.TagInfo{}
-		err = rows.Scan(&tagInfo.Id, &tagInfo.Text)
-		if err != nil {
+		if err = rows.Scan(&tagInfo.Id, &tagInfo.Text); err != nil {
 			return metadata.UnknownTag, err
 		}
-		return tagInfo, nil
-	} else {
-		return metadata.UnknownTag, nil
 	}
+	cacheTag(db, key, tagInfo, generation)
+	return tagInfo, nil
 }
 
-// Looks up a single tag in the database by name (text)
+// Looks up a single tag in the database by name (text) or alias
 func GetTag(db *sql.DB, name string) (metadata.TagInfo, error) {
-	stmt, err := db.Prepare("select id, txt from tag where txt = ?")
+	return GetTagContext(context.Background(), db, name)
+}
+
+func GetTagContext(ctx context.Context, db *sql.DB, name string) (metadata.TagInfo, error) {
+	stmt, release, err := prepareCached(ctx, db, "select id, txt from tag where "+tagNameCondition)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(name)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, name, name)
 	if err != nil {
 		return metadata.UnknownTag, err
 	}
@@ -199,44 +745,45 @@ func GetTag(db *sql.DB, name string) (metadata.TagInfo, error) {
 
 // Lists all the tags that co-occur with ALL the tags passed in, optionally filtered by name
 func GetCoincidentTags(db *sql.DB, tags []metadata.TagInfo, name string) ([]metadata.TagInfo, error) {
-	if tags == nil || len(tags) == 0 {
-		return GetAllTags(db)
-	}
-	// need this because of the way go handles variadic parameters with the empty interface
-	paramSize := len(tags) * 2
-	if len(name) > 0 {
-		paramSize++
-	}
-	var params = make([]interface{}, paramSize)
-	j := 0
-	query := "SELECT DISTINCT ot.Id, ot.txt FROM tag ot WHERE ot.id in ("
-	for i := 0; i < len(tags); i++ {
-		if i > 0 {
-			query += " INTERSECT "
-		}
-		query += " select * from ( select ta.t1 from tag_assoc ta, tag t where t.id = ta.t2 and t.txt = ? UNION select ta.t2 from tag_assoc ta, tag t where t.id = ta.t1 and t.txt = ? )"
-		params[j] = tags[i].Text
-		j += 1
-		params[j] = tags[i].Text
-		j += 1
-	}
-	query += ") "
-	if len(name) > 0 {
-		operator := " = "
-		if strings.Index(name, "*") >= 0 {
-			operator = " LIKE "
-		}
-		params[paramSize-1] = strings.Replace(name, "*", "%", -1)
-		query += fmt.Sprintf(" AND ot.txt %s ?", operator)
-	}
-	query += " ORDER BY ot.txt ASC"
+	return GetCoincidentTagsContext(context.Background(), db, tags, name)
+}
+
+func GetCoincidentTagsContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo,
+	name string) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsExcludingContext(ctx, db, tags, nil, name)
+}
+
+// Lists all the tags that co-occur with ALL the tags passed in, leaving out the excluded tags, optionally filtered by
+// name
+func GetCoincidentTagsExcluding(db *sql.DB, tags []metadata.TagInfo, excluded []metadata.TagInfo,
+	name string) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsExcludingContext(context.Background(), db, tags, excluded, name)
+}
+
+func GetCoincidentTagsExcludingContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo,
+	excluded []metadata.TagInfo, name string) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsForFilterContext(ctx, db, TagFilter{Tags: tags, Excluded: excluded}, name)
+}
 
-	stmt, err := db.Prepare(query)
+// Lists all the tags that co-occur with ALL the tags of the filter and with at least one tag of each of its AnyOf
+// groups, leaving out the excluded tags, optionally filtered by name
+func GetCoincidentTagsForFilter(db *sql.DB, filter TagFilter, name string) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsForFilterContext(context.Background(), db, filter, name)
+}
+
+func GetCoincidentTagsForFilterContext(ctx context.Context, db *sql.DB, filter TagFilter,
+	name string) ([]metadata.TagInfo, error) {
+	defer observe("GetCoincidentTagsForFilter", time.Now())
+	// without required tags every tag is a candidate, still subject to the exclusions and the name
+	conditions, params := coincidentTagConditions(filter, name)
+	query := "SELECT DISTINCT ot.Id, ot.txt FROM tag ot" + whereClause(conditions) + " ORDER BY ot.txt ASC"
+
+	stmt, release, err := prepareCached(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(params...)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -250,69 +797,218 @@ func GetCoincidentTags(db *sql.DB, tags []metadata.TagInfo, name string) ([]meta
 		}
 		results = append(results, info)
 	}
-	return results, nil
+	return results, rows.Err()
 }
 
 // Applies all the tags passed in to a file, if they don't already exist
 func TagFile(db *sql.DB, fileId int64, tags []metadata.TagInfo) error {
+	return TagFileContext(context.Background(), db, fileId, tags)
+}
+
+func TagFileContext(ctx context.Context, db *sql.DB, fileId int64, tags []metadata.TagInfo) error {
+	defer observe("TagFile", time.Now())
 	if tags == nil || len(tags) == 0 {
 		return nil
 	}
-	tx, err := db.Begin()
-	if err != nil {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, tag := range tags {
+			if _, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags VALUES(?,?)", fileId,
+				tag.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Applies the tags to each of the files passed in, all in one transaction. Tags a file already has are left as they
+// are.
+func TagFiles(db *sql.DB, fileIds []int64, tags []metadata.TagInfo) error {
+	return TagFilesContext(context.Background(), db, fileIds, tags)
+}
+
+func TagFilesContext(ctx context.Context, db *sql.DB, fileIds []int64, tags []metadata.TagInfo) error {
+	defer observe("TagFiles", time.Now())
+	if len(fileIds) == 0 || len(tags) == 0 {
+		return nil
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		return insertFileTags(ctx, tx, fileIds, tags)
+	})
+}
+
+// Most rows inserted by one statement. SQLite builds before 3.32 take at most 999 parameters per statement.
+const maxInsertRows = 400
+
+// Applies every tag passed in to every file passed in, a few hundred links per statement rather than one, ignoring
+// links that already exist.
+func insertFileTags(ctx context.Context, tx *sql.Tx, fileIds []int64, tags []metadata.TagInfo) error {
+	var params []interface{}
+	insert := func() error {
+		_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags (fid, tid) VALUES "+
+			strings.TrimSuffix(strings.Repeat("(?,?),", len(params)/2), ","), params...)
+		params = params[:0]
 		return err
 	}
-	for _, tag := range tags {
-		_, err = db.Exec("INSERT OR IGNORE INTO file_tags VALUES(?,?)", fileId, tag.Id)
+	for _, fileId := range fileIds {
+		for _, tag := range tags {
+			params = append(params, fileId, tag.Id)
+			if len(params) == 2*maxInsertRows {
+				if err := insert(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(params) == 0 {
+		return nil
+	}
+	return insert()
+}
+
+// Lists the tags applied to a file, ordered by name, in a single query. A file that isn't recorded has no tags.
+func GetTagsForFile(db *sql.DB, fileId int64) ([]metadata.TagInfo, error) {
+	return GetTagsForFileContext(context.Background(), db, fileId)
+}
+
+func GetTagsForFileContext(ctx context.Context, db *sql.DB, fileId int64) ([]metadata.TagInfo, error) {
+	defer observe("GetTagsForFile", time.Now())
+	stmt, release, err := prepareCached(ctx, db,
+		"SELECT t.id, t.txt FROM tag t, file_tags ft WHERE ft.tid = t.id AND ft.fid = ? ORDER BY t.txt ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rows, err := stmt.QueryContext(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.TagInfo
+	for rows.Next() {
+		var tag = metadata.TagInfo{}
+		err = rows.Scan(&tag.Id, &tag.Text)
 		if err != nil {
-			_ = tx.Rollback()
-			return err
+			return nil, err
 		}
+		results = append(results, tag)
 	}
-	return tx.Commit()
+	return results, nil
+}
+
+// Replaces the set of tags applied to a file with the tags passed in. Tags the file has that are not in the list are
+// removed.
+func SetFileTags(db *sql.DB, fileId int64, tags []metadata.TagInfo) error {
+	return SetFileTagsContext(context.Background(), db, fileId, tags)
+}
+
+func SetFileTagsContext(ctx context.Context, db *sql.DB, fileId int64, tags []metadata.TagInfo) error {
+	params := append([]interface{}{fileId}, tagIds(tags)...)
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM file_tags WHERE fid = ? AND tid NOT IN (%s)",
+			placeholders(len(tags))),
+			params...)
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			if _, err = tx.ExecContext(ctx, "INSERT OR IGNORE INTO file_tags VALUES(?,?)", fileId, tag.Id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
-// Removes a tag from a file identified by file id
+// Removes a tag from a file identified by file id. A file left without tags keeps its record; see CollectOrphanFiles.
 func UntagFile(db *sql.DB, fileId int64, tagId int64) error {
-	_, err := db.Exec("DELETE FROM file_tags WHERE fid = ? AND tid = ?", fileId, tagId)
-	// TODO: should we remove the File record if it has no more tags?
+	return UntagFileContext(context.Background(), db, fileId, tagId)
+}
+
+func UntagFileContext(ctx context.Context, db *sql.DB, fileId int64, tagId int64) error {
+	_, err := execWrite(ctx, db, "DELETE FROM file_tags WHERE fid = ? AND tid = ?", fileId, tagId)
 	return err
 }
 
 // Removes the tag corresponding to the last entry in the path passed in from all files in that path.
 func UntagFiles(db *sql.DB, path []metadata.TagInfo) error {
-	files, err := GetFilesWithTags(db, path, "")
+	return UntagFilesContext(context.Background(), db, path)
+}
+
+func UntagFilesContext(ctx context.Context, db *sql.DB, path []metadata.TagInfo) error {
+	files, err := GetFilesWithTagsContext(ctx, db, path, "")
 	if err != nil {
 		return err
 	}
-	if files != nil && len(files) > 0 {
-		tx, err := db.Begin()
-		if err != nil {
-			_ = tx.Rollback()
-			return err
-
-		}
+	if files == nil || len(files) == 0 {
+		return nil
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
 		for _, file := range files {
-			_, err := db.Exec("DELETE FROM FILE_TAGS WHERE FID = ? AND TID = ?", file.Id, path[len(path)-1].Id)
+			_, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE fid = ? AND tid = ?", file.Id,
+				path[len(path)-1].Id)
 			if err != nil {
-				_ = tx.Rollback()
 				return err
 			}
 		}
-		return tx.Commit()
+		return nil
+	})
+}
+
+// Removes the tags in removed from each of the files passed in and applies the tags in added to them, all in one
+// transaction.
+func RetagFiles(db *sql.DB, fileIds []int64, removed []metadata.TagInfo, added []metadata.TagInfo) error {
+	return RetagFilesContext(context.Background(), db, fileIds, removed, added)
+}
+
+func RetagFilesContext(ctx context.Context, db *sql.DB, fileIds []int64, removed []metadata.TagInfo,
+	added []metadata.TagInfo) error {
+	if len(fileIds) == 0 {
+		return nil
 	}
-	return nil
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, fileId := range fileIds {
+			if len(removed) > 0 {
+				params := append([]interface{}{fileId}, tagIds(removed)...)
+				_, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM file_tags WHERE fid = ? AND tid IN (%s)",
+					placeholders(len(removed))), params...)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return insertFileTags(ctx, tx, fileIds, added)
+	})
+}
+
+// Looks up a file by its id. Returns UnknownFile if not found.
+func GetFile(db *sql.DB, fileId int64) (metadata.FileInfo, error) {
+	return GetFileContext(context.Background(), db, fileId)
+}
+
+func GetFileContext(ctx context.Context, db *sql.DB, fileId int64) (metadata.FileInfo, error) {
+	files, err := queryFilesNamedContext(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f WHERE f.id = ?",
+		[]interface{}{fileId}, "")
+	if err != nil || len(files) == 0 {
+		return metadata.UnknownFile, err
+	}
+	return files[0], nil
 }
 
 // Looks up a file using the name and absolute path in the underlying filesystem (not the tag path). Returns UnknownFile
 // if not found.
 func FindFileByAbsPath(db *sql.DB, name string, absPath string) (metadata.FileInfo, error) {
-	stmt, err := db.Prepare("SELECT id, name, path FROM file_md WHERE name = ? AND path = ?")
+	return FindFileByAbsPathContext(context.Background(), db, name, absPath)
+}
+
+func FindFileByAbsPathContext(ctx context.Context, db *sql.DB, name string, absPath string) (metadata.FileInfo, error) {
+	defer observe("FindFileByAbsPath", time.Now())
+	stmt, release, err := prepareCached(ctx, db, "SELECT id, name, path FROM file_md WHERE name = ? AND path = ?")
 	if err != nil {
 		return metadata.UnknownFile, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(name, absPath)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, name, absPath)
 	if err != nil {
 		return metadata.UnknownFile, err
 	}
@@ -329,41 +1025,141 @@ func FindFileByAbsPath(db *sql.DB, name string, absPath string) (metadata.FileIn
 }
 
 // Creates a file record using the name and absolute path passed in and tags it with all the tags in the tagPath array.
+// Fails if a file with the same name and path is already recorded; see UpsertFile.
 func CreateFileInPath(db *sql.DB, name string, absPath string, tagPath []metadata.TagInfo) (metadata.FileInfo, error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return metadata.UnknownFile, err
-	}
-	res, err := db.Exec("INSERT INTO file_md (NAME, PATH) VALUES (?, ?)", name, absPath)
+	return CreateFileInPathContext(context.Background(), db, name, absPath, tagPath)
+}
+
+func CreateFileInPathContext(ctx context.Context, db *sql.DB, name string, absPath string,
+	tagPath []metadata.TagInfo) (metadata.FileInfo, error) {
+	defer observe("CreateFileInPath", time.Now())
+	var fileInfo metadata.FileInfo
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "INSERT INTO file_md (name, path) VALUES (?, ?)", name, absPath)
+		if err != nil {
+			return err
+		}
+		newId, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		// now tag it
+		for _, tag := range tagPath {
+			if _, err = tx.ExecContext(ctx, "INSERT INTO file_tags (fid, tid) VALUES (?,?)", newId,
+				tag.Id); err != nil {
+				return err
+			}
+		}
+		fileInfo = metadata.FileInfo{Id: newId, Path: absPath, Name: name}
+		return nil
+	})
 	if err != nil {
-		_ = tx.Rollback()
 		return metadata.UnknownFile, err
 	}
-	newId, err := res.LastInsertId()
+	return fileInfo, nil
+}
+
+// Records a file using the name and absolute path passed in unless it already is, and tags it with all the tags in the
+// tagPath array (on top of any it already has). Unlike CreateFileInPath, it can't create a second record for a file.
+func UpsertFile(db *sql.DB, name string, absPath string, tagPath []metadata.TagInfo) (metadata.FileInfo, error) {
+	return UpsertFileContext(context.Background(), db, name, absPath, tagPath)
+}
+
+func UpsertFileContext(ctx context.Context, db *sql.DB, name string, absPath string,
+	tagPath []metadata.TagInfo) (metadata.FileInfo, error) {
+	files, err := CreateFilesContext(ctx, db, []NewFile{{Name: name, Path: absPath, Tags: tagPath}})
 	if err != nil {
-		_ = tx.Rollback()
 		return metadata.UnknownFile, err
 	}
-	fileInfo := metadata.FileInfo{Id: newId, Path: absPath, Name: name}
-	// now tag it
-	for _, tag := range tagPath {
-		_, err := db.Exec("INSERT INTO FILE_TAGS (fid, tid) VALUES (?,?)", newId, tag.Id)
+	return files[0], nil
+}
+
+// A file to add with CreateFiles.
+type NewFile struct {
+	Name string
+	// directory on disk holding the file
+	Path string
+	Tags []metadata.TagInfo
+}
+
+// Number of files CreateFiles adds per transaction.
+const createBatchSize = 500
+
+// Adds many files, each tagged with its tags, a few hundred per transaction rather than one transaction per file.
+// Files already recorded under the same name and path aren't added again but get the tags of their entries, so
+// processes racing to add the same files don't duplicate them. Returns the files in the order of the entries. If a
+// transaction fails the files added by the ones before it are returned along with the error.
+func CreateFiles(db *sql.DB, entries []NewFile) ([]metadata.FileInfo, error) {
+	return CreateFilesContext(context.Background(), db, entries)
+}
+
+func CreateFilesContext(ctx context.Context, db *sql.DB, entries []NewFile) ([]metadata.FileInfo, error) {
+	defer observe("CreateFiles", time.Now())
+	var created []metadata.FileInfo
+	for start := 0; start < len(entries); start += createBatchSize {
+		end := start + createBatchSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+		batch := entries[start:end]
+		var files []metadata.FileInfo
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			files = nil
+			insertFile, err := tx.PrepareContext(ctx,
+				"INSERT INTO file_md (name, path) VALUES (?, ?) ON CONFLICT (name, path) DO NOTHING")
+			if err != nil {
+				return err
+			}
+			defer insertFile.Close()
+			findFile, err := tx.PrepareContext(ctx, "SELECT id FROM file_md WHERE name = ? AND path = ?")
+			if err != nil {
+				return err
+			}
+			defer findFile.Close()
+			insertTag, err := tx.PrepareContext(ctx, "INSERT OR IGNORE INTO file_tags (fid, tid) VALUES (?,?)")
+			if err != nil {
+				return err
+			}
+			defer insertTag.Close()
+			for _, entry := range batch {
+				if _, err = insertFile.ExecContext(ctx, entry.Name, entry.Path); err != nil {
+					return err
+				}
+				// the id of the record whether it was just added or already there
+				var id int64
+				if err = findFile.QueryRowContext(ctx, entry.Name, entry.Path).Scan(&id); err != nil {
+					return err
+				}
+				for _, tag := range entry.Tags {
+					if _, err = insertTag.ExecContext(ctx, id, tag.Id); err != nil {
+						return err
+					}
+				}
+				files = append(files, metadata.FileInfo{Id: id, Path: entry.Path, Name: entry.Name})
+			}
+			return nil
+		})
 		if err != nil {
-			_ = tx.Rollback()
-			return metadata.UnknownFile, err
+			return created, err
 		}
+		created = append(created, files...)
 	}
-	return fileInfo, tx.Commit()
+	return created, nil
 }
 
 // Gets files tagged with only the tag specified.
 func GetFileCountWithSingleTag(db *sql.DB, tag metadata.TagInfo) (int, error) {
-	stmt, err := db.Prepare("select count(*) from (select 1 from file_tags where fid in (select fid from file_tags where tid = ?) group by fid having count(*)  = 1)")
+	return GetFileCountWithSingleTagContext(context.Background(), db, tag)
+}
+
+func GetFileCountWithSingleTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo) (int, error) {
+	stmt, err := db.PrepareContext(ctx,
+		"select count(*) from (select 1 from file_tags where fid in (select fid from file_tags where tid = ?) group by fid having count(*)  = 1)")
 	if err != nil {
 		return -1, err
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query(tag.Id)
+	rows, err := stmt.QueryContext(ctx, tag.Id)
 	if err != nil {
 		return -1, err
 	}
@@ -376,14 +1172,86 @@ func GetFileCountWithSingleTag(db *sql.DB, tag metadata.TagInfo) (int, error) {
 	return 0, nil
 }
 
+// Lists the files that have exactly one tag, optionally filtered by name (if name has a length of > 0). Name can also
+// contain 0 or more wildcards characters (*).
+func GetFilesWithSingleTag(db *sql.DB, name string) ([]metadata.FileInfo, error) {
+	return GetFilesWithSingleTagContext(context.Background(), db, name)
+}
+
+func GetFilesWithSingleTagContext(ctx context.Context, db *sql.DB, name string) ([]metadata.FileInfo, error) {
+	return queryFilesNamedContext(ctx, db,
+		"SELECT f.id, f.name, f.path FROM file_md f WHERE (SELECT count(*) FROM file_tags ft WHERE ft.fid = f.id) = 1",
+		nil, name)
+}
+
+// Gets files without any tag other than the fallback tag passed in (i.e. files never categorized and files left
+// without tags by untagging).
+func GetUntaggedFiles(db *sql.DB, fallback string, name string) ([]metadata.FileInfo, error) {
+	return GetUntaggedFilesContext(context.Background(), db, fallback, name)
+}
+
+func GetUntaggedFilesContext(ctx context.Context, db *sql.DB, fallback string,
+	name string) ([]metadata.FileInfo, error) {
+	return GetUntaggedFilesExcludingContext(ctx, db, fallback, nil, name)
+}
+
+// Same as GetUntaggedFiles but leaves out the files that have any of the excluded tags.
+func GetUntaggedFilesExcluding(db *sql.DB, fallback string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetUntaggedFilesExcludingContext(context.Background(), db, fallback, excluded, name)
+}
+
+func GetUntaggedFilesExcludingContext(ctx context.Context, db *sql.DB, fallback string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	query, params := excludingFiles("SELECT f.id, f.name, f.path FROM file_md f WHERE NOT EXISTS "+
+		"(SELECT 1 FROM file_tags ft, tag WHERE ft.fid = f.id AND ft.tid = tag.id AND tag.txt != ?)",
+		[]interface{}{fallback}, excluded)
+	return queryFilesNamedContext(ctx, db, query, params, name)
+}
+
+// Runs a query selecting the id, name and path of files from file_md (aliased as f), optionally filtered by name (if
+// name has a length of > 0). Name can also contain 0 or more wildcards characters (*).
+func queryFilesNamedContext(ctx context.Context, db *sql.DB, query string, params []interface{},
+	name string) ([]metadata.FileInfo, error) {
+	if len(name) > 0 {
+		condition, param := nameCondition("f.name", name)
+		query += " AND " + condition
+		params = append(params, param)
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.FileInfo
+	for rows.Next() {
+		info := metadata.FileInfo{}
+		err = rows.Scan(&info.Id, &info.Name, &info.Path)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, info)
+	}
+	return results, rows.Err()
+}
+
 // Counts number of files tagged with the tag passed in.
 func CountFilesWithTag(db *sql.DB, tag metadata.TagInfo) (int, error) {
-	stmt, err := db.Prepare("SELECT count(*) FROM file_tags WHERE tid = ?")
+	return CountFilesWithTagContext(context.Background(), db, tag)
+}
+
+func CountFilesWithTagContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo) (int, error) {
+	stmt, err := db.PrepareContext(ctx, "SELECT count(*) FROM file_tags WHERE tid = ?")
 	if err != nil {
 		return -1, err
 	}
 	defer stmt.Close()
-	rows, err := stmt.Query(tag.Id)
+	rows, err := stmt.QueryContext(ctx, tag.Id)
 	if err != nil {
 		return -1, err
 	}
@@ -400,38 +1268,127 @@ func CountFilesWithTag(db *sql.DB, tag metadata.TagInfo) (int, error) {
 	}
 }
 
+// Counts the number of files managed by the filesystem.
+func CountFiles(db *sql.DB) (int, error) {
+	return CountFilesContext(context.Background(), db)
+}
+
+func CountFilesContext(ctx context.Context, db *sql.DB) (int, error) {
+	return countRowsContext(ctx, db, "SELECT count(*) FROM file_md")
+}
+
+// Counts the number of tags defined in the filesystem.
+func CountTags(db *sql.DB) (int, error) {
+	return CountTagsContext(context.Background(), db)
+}
+
+func CountTagsContext(ctx context.Context, db *sql.DB) (int, error) {
+	return countRowsContext(ctx, db, "SELECT count(*) FROM tag")
+}
+
+// Counts the number of tags applied to the file with the id passed in.
+func GetTagCountForFile(db *sql.DB, fileId int64) (int, error) {
+	return GetTagCountForFileContext(context.Background(), db, fileId)
+}
+
+func GetTagCountForFileContext(ctx context.Context, db *sql.DB, fileId int64) (int, error) {
+	return countRowsContext(ctx, db, "SELECT count(*) FROM file_tags WHERE fid = ?", fileId)
+}
+
+// Runs a query that returns a single count.
+func countRows(db *sql.DB, query string, params ...interface{}) (int, error) {
+	return countRowsContext(context.Background(), db, query, params...)
+}
+
+func countRowsContext(ctx context.Context, db *sql.DB, query string, params ...interface{}) (int, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, query, params...).Scan(&count); err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
 // Lists the files that have ALL the tags passed in, optionally filtered by name (if name has a length of > 0)
 // Name can also contain 0 or more wildcards characters (*).
 func GetFilesWithTags(db *sql.DB, tags []metadata.TagInfo, name string) ([]metadata.FileInfo, error) {
-	//need this because of the way go handles variadic parameters with the empty interface
-	paramLength := len(tags)
-	if len(name) > 0 {
-		paramLength += 1
-	}
-	var params = make([]interface{}, paramLength)
-	query := "SELECT f.id, f.name, f.path from file_md f where EXISTS "
-	for i := 0; i < len(tags); i++ {
-		if i > 0 {
-			query += " AND EXISTS "
-		}
-		query += "(SELECT 1 FROM file_tags ft, tag t WHERE ft.tid = t.id and fid = f.id AND t.txt = ?)"
-		params[i] = tags[i].Text
+	return GetFilesWithTagsContext(context.Background(), db, tags, name)
+}
+
+func GetFilesWithTagsContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFilesWithTagsExcludingContext(ctx, db, tags, nil, name)
+}
+
+// Lists the files that have ALL the tags passed in and NONE of the excluded tags (e.g. tagged beach but not
+// screenshots), optionally filtered by name (if name has a length of > 0). Name can also contain 0 or more wildcards
+// characters (*). Without tags, every file that has none of the excluded tags is listed.
+func GetFilesWithTagsExcluding(db *sql.DB, tags []metadata.TagInfo, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFilesWithTagsExcludingContext(context.Background(), db, tags, excluded, name)
+}
+
+func GetFilesWithTagsExcludingContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo,
+	excluded []metadata.TagInfo, name string) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterContext(ctx, db, TagFilter{Tags: tags, Excluded: excluded}, name)
+}
+
+// Lists the files selected by the filter, optionally filtered by name (if name has a length of > 0). Name can also
+// contain 0 or more wildcards characters (*). An empty filter selects every file.
+func GetFilesMatchingFilter(db *sql.DB, filter TagFilter, name string) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterContext(context.Background(), db, filter, name)
+}
+
+func GetFilesMatchingFilterContext(ctx context.Context, db *sql.DB, filter TagFilter,
+	name string) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesMatchingFilter", time.Now())
+	return queryFilesMatchingFilter(ctx, db, filter, name, "")
+}
+
+// Lists the files that have ALL the tags passed in in the order requested, optionally filtered by name as
+// GetFilesWithTags does.
+func GetFilesWithTagsOrdered(db *sql.DB, tags []metadata.TagInfo, name string,
+	order FileOrder) ([]metadata.FileInfo, error) {
+	return GetFilesWithTagsOrderedContext(context.Background(), db, tags, name, order)
+}
+
+func GetFilesWithTagsOrderedContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo, name string,
+	order FileOrder) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterOrderedContext(ctx, db, TagFilter{Tags: tags}, name, order)
+}
+
+// Lists the files selected by the filter in the order requested, optionally filtered by name as
+// GetFilesMatchingFilter does.
+func GetFilesMatchingFilterOrdered(db *sql.DB, filter TagFilter, name string,
+	order FileOrder) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterOrderedContext(context.Background(), db, filter, name, order)
+}
+
+func GetFilesMatchingFilterOrderedContext(ctx context.Context, db *sql.DB, filter TagFilter, name string,
+	order FileOrder) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesMatchingFilterOrdered", time.Now())
+	clause, ok := fileOrderClauses[order]
+	if !ok {
+		return nil, fmt.Errorf("unknown file order %d", order)
 	}
-	if len(name) > 0 {
-		operator := " = "
-		if strings.Index(name, "*") >= 0 {
-			operator = " LIKE "
-		}
-		params[len(tags)] = strings.Replace(name, "*", "%", -1)
-		query += fmt.Sprintf(" AND f.name %s ?", operator)
+	return queryFilesMatchingFilter(ctx, db, filter, name, clause)
+}
+
+// Runs the query for the files selected by the filter, in the order set by the order clause (if any).
+func queryFilesMatchingFilter(ctx context.Context, db *sql.DB, filter TagFilter, name string,
+	orderClause string) ([]metadata.FileInfo, error) {
+	conditions, params := filterConditions(filter, name)
+	query := "SELECT f.id, f.name, f.path from file_md f"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " AND ")
 	}
+	query += orderClause
 
-	stmt, err := db.Prepare(query)
+	stmt, release, err := prepareCached(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
-	rows, err := stmt.Query(params...)
+	defer release()
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil {
 		return nil, err
 	}
@@ -445,7 +1402,116 @@ func GetFilesWithTags(db *sql.DB, tags []metadata.TagInfo, name string) ([]metad
 		}
 		results = append(results, info)
 	}
-	return results, nil
+	return results, rows.Err()
+}
+
+// Counts the files selected by the filter without loading them.
+func CountFilesMatchingFilter(db *sql.DB, filter TagFilter) (int, error) {
+	return CountFilesMatchingFilterContext(context.Background(), db, filter)
+}
+
+func CountFilesMatchingFilterContext(ctx context.Context, db *sql.DB, filter TagFilter) (int, error) {
+	defer observe("CountFilesMatchingFilter", time.Now())
+	conditions, params := filterConditions(filter, "")
+	query := "SELECT count(*) from file_md f"
+	if len(conditions) > 0 {
+		query += " where " + strings.Join(conditions, " AND ")
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, query, params...).Scan(&count); err != nil {
+		return -1, err
+	}
+	return count, nil
+}
+
+// Builds the where clause conditions (and their parameters) selecting the tags (aliased as ot) that co-occur with the
+// tags of the filter and, if it has a length of > 0, match the name.
+func coincidentTagConditions(filter TagFilter, name string) ([]string, []interface{}) {
+	var params []interface{}
+	var conditions []string
+	// the tags associated with the first tag are the candidates; each of the others then takes a lookup of the pair in
+	// either order through the primary key and tag_assoc_t2_idx, rather than listing all the tags associated with it
+	for i, tag := range filter.Tags {
+		if i == 0 {
+			conditions = append(conditions, "ot.id IN (SELECT ta.t2 FROM tag_assoc ta WHERE ta.t1 = "+
+				"(SELECT id FROM tag WHERE txt = ?) UNION ALL SELECT ta.t1 FROM tag_assoc ta WHERE ta.t2 = "+
+				"(SELECT id FROM tag WHERE txt = ?))")
+			params = append(params, tag.Text)
+		} else {
+			conditions = append(conditions, "EXISTS (SELECT 1 FROM tag t, tag_assoc ta WHERE t.txt = ? AND "+
+				"((ta.t1 = ot.id AND ta.t2 = t.id) OR (ta.t1 = t.id AND ta.t2 = ot.id)))")
+		}
+		params = append(params, tag.Text)
+	}
+	for _, group := range filter.AnyOf {
+		conditions = append(conditions, fmt.Sprintf("ot.id IN (SELECT ta.t1 FROM tag_assoc ta WHERE ta.t2 IN (%s) "+
+			"UNION ALL SELECT ta.t2 FROM tag_assoc ta WHERE ta.t1 IN (%s))", placeholders(len(group)),
+			placeholders(len(group))))
+		params = append(params, tagIds(group)...)
+		params = append(params, tagIds(group)...)
+	}
+	if len(filter.Excluded) > 0 {
+		conditions = append(conditions, fmt.Sprintf("ot.id NOT IN (%s)", placeholders(len(filter.Excluded))))
+		params = append(params, tagIds(filter.Excluded)...)
+	}
+	if len(name) > 0 {
+		condition, param := nameCondition("ot.txt", name)
+		conditions = append(conditions, condition)
+		params = append(params, param)
+	}
+	return conditions, params
+}
+
+// Builds the where clause conditions (and their parameters) selecting the files (aliased as f) that match the filter
+// and, if it has a length of > 0, the name.
+func filterConditions(filter TagFilter, name string) ([]string, []interface{}) {
+	var params []interface{}
+	var conditions []string
+	for _, tag := range filter.Tags {
+		conditions = append(conditions,
+			"EXISTS (SELECT 1 FROM file_tags ft, tag t WHERE ft.tid = t.id and fid = f.id AND t.txt = ?)")
+		params = append(params, tag.Text)
+	}
+	for _, group := range filter.AnyOf {
+		conditions = append(conditions, fmt.Sprintf("EXISTS (SELECT 1 FROM file_tags ft WHERE ft.fid = f.id AND ft.tid IN (%s))",
+			placeholders(len(group))))
+		params = append(params, tagIds(group)...)
+	}
+	for _, tag := range filter.Excluded {
+		conditions = append(conditions,
+			"NOT EXISTS (SELECT 1 FROM file_tags ft, tag t WHERE ft.tid = t.id and fid = f.id AND t.txt = ?)")
+		params = append(params, tag.Text)
+	}
+	if len(name) > 0 {
+		condition, param := nameCondition("f.name", name)
+		conditions = append(conditions, condition)
+		params = append(params, param)
+	}
+	return conditions, params
+}
+
+// Adds the conditions leaving out the files (aliased as f) that have any of the excluded tags, see filterConditions, to
+// a query ending in a where clause.
+func excludingFiles(query string, params []interface{}, excluded []metadata.TagInfo) (string, []interface{}) {
+	conditions, excludedParams := filterConditions(TagFilter{Excluded: excluded}, "")
+	for _, condition := range conditions {
+		query += " AND " + condition
+	}
+	return query, append(params, excludedParams...)
+}
+
+// Builds a comma separated list of count SQL parameter placeholders for use in an IN clause.
+func placeholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", count), ",")
+}
+
+// Extracts the ids of the tags for use as SQL parameters.
+func tagIds(tags []metadata.TagInfo) []interface{} {
+	ids := make([]interface{}, len(tags))
+	for i, tag := range tags {
+		ids[i] = tag.Id
+	}
+	return ids
 }
 
 func min(a int64, b int64) int64 {
@@ -1,14 +1,114 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// Verifies opening a database created before columns were added to its tables adds them.
+func TestOpenAddsColumns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "old.db")
+	old, err := sql.Open(sqliteDriver, filename)
+	if err != nil {
+		t.Errorf("Could not create database: %v", err)
+		return
+	}
+	old.Exec("CREATE TABLE file_md(id INTEGER PRIMARY KEY, name text, path text);")
+	old.Exec("INSERT INTO file_md (name, path) VALUES ('one', 'path')")
+	old.Close()
+	for i := 0; i < 2; i++ {
+		db, err := Open(filename)
+		if err != nil {
+			t.Errorf("Could not open database: %v", err)
+			return
+		}
+		for _, added := range []string{"file_md.mtime", "file_md.uid", "file_md.gid", "file_md.mode", "tag.uid",
+			"tag.gid", "tag.mode", "file_md.size", "file_md.atime", "file_md.checksum", "file_md.mime",
+			"saved_query.created"} {
+			parts := strings.Split(added, ".")
+			count, _ := countRows(db, "SELECT count(*) FROM pragma_table_info('"+parts[0]+"') WHERE name = ?",
+				parts[1])
+			if count != 1 {
+				t.Errorf("Expected column %s to be added", added)
+			}
+		}
+		db.Close()
+	}
+}
+
+// Verifies databases on disk are opened with the connection settings passed in, by default in write-ahead logging mode
+// so other processes can read while one writes.
+func TestOpenWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		options     OpenOptions
+		journalMode string
+		busyTimeout int
+		synchronous int
+		foreignKeys int
+		ignoreCase  bool
+		valid       bool
+	}{
+		{OpenOptions{}, "wal", 10000, 1, 1, false, true},
+		{OpenOptions{JournalMode: "delete", BusyTimeout: 2 * time.Second, Synchronous: "FULL",
+			DisableForeignKeys: true, CaseInsensitiveTags: true}, "delete", 2000, 2, 0, true, true},
+		{OpenOptions{JournalMode: "sideways"}, "", 0, 0, 0, false, false},
+		{OpenOptions{Synchronous: "sometimes"}, "", 0, 0, 0, false, false},
+	}
+	for i, condition := range conditions {
+		db, err := OpenWithOptions(filepath.Join(dir, fmt.Sprintf("%d.db", i)), condition.options)
+		if !condition.valid {
+			if err == nil {
+				t.Errorf("Expected %v to be refused", condition.options)
+				db.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Could not open database with %v: %v", condition.options, err)
+			continue
+		}
+		var journalMode string
+		var busyTimeout, synchronous, foreignKeys int
+		_ = db.QueryRow("PRAGMA journal_mode").Scan(&journalMode)
+		_ = db.QueryRow("PRAGMA busy_timeout").Scan(&busyTimeout)
+		_ = db.QueryRow("PRAGMA synchronous").Scan(&synchronous)
+		_ = db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys)
+		if journalMode != condition.journalMode || busyTimeout != condition.busyTimeout ||
+			synchronous != condition.synchronous || foreignKeys != condition.foreignKeys {
+			t.Errorf("Expected %v to open the database with %s, %d, %d, %d but got %s, %d, %d, %d",
+				condition.options, condition.journalMode, condition.busyTimeout, condition.synchronous,
+				condition.foreignKeys, journalMode, busyTimeout, synchronous, foreignKeys)
+		}
+		if ignoreCase, _ := IsTagCaseInsensitive(db); ignoreCase != condition.ignoreCase {
+			t.Errorf("Expected %v to open the database with case-insensitive tags %v", condition.options,
+				condition.ignoreCase)
+		}
+		db.Close()
+	}
+}
+
 // Validates adding top-level tags work and do not create duplicates
 func TestAddTag(t *testing.T) {
 	db := getDb(t)
@@ -92,6 +192,44 @@ func TestUnassociateTag(t *testing.T) {
 }
 
 // Verifies we can get a single co-incident tag regardless of the order of the lookup.
+// Verifies a chain of tags is created with every tag associated with the others and the context.
+func TestAddTags(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	// existing tags that are not associated with each other
+	a, _ := AddTag(db, "a", nil)
+	b, _ := AddTag(db, "b", nil)
+	tags, err := AddTags(db, []string{"b", "c", "d"}, []metadata.TagInfo{a})
+	if err != nil || len(tags) != 3 {
+		t.Errorf("Could not add tags: %v", err)
+		return
+	}
+	if tags[0].Id != b.Id {
+		t.Errorf("Expected existing tag %d to be reused but got %d", b.Id, tags[0].Id)
+	}
+	conditions := []struct {
+		from string
+		to   string
+	}{
+		{"a", "b"},
+		{"a", "c"},
+		{"a", "d"},
+		{"b", "c"},
+		{"b", "d"},
+		{"c", "d"},
+	}
+	for _, condition := range conditions {
+		foundTag, _ := GetCoincidentTag(db, condition.from, condition.to)
+		if foundTag.Id == metadata.UnknownTag.Id {
+			t.Errorf("Expected %s to be associated with %s", condition.from, condition.to)
+		}
+	}
+	allTags, _ := GetAllTags(db)
+	if len(allTags) != 4 {
+		t.Errorf("Expected 4 tags but found %d", len(allTags))
+	}
+}
+
 func TestGetCoincidentTag(t *testing.T) {
 	db := getDb(t)
 	defer db.Close()
@@ -143,6 +281,266 @@ func TestDeleteTag(t *testing.T) {
 	}
 }
 
+// Verifies deleting a tag recursively removes it from all files and moves orphaned files to the fallback tag.
+func TestDeleteTagRecursive(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 2)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	orphan, _ := CreateFileInPath(db, "orphan", "tmp", tags[:1])
+	both, _ := CreateFileInPath(db, "both", "tmp", tags)
+	err = DeleteTagRecursive(db, tags[0], "fallback")
+	if err != nil {
+		t.Errorf("Could not delete tag: %v", err)
+	}
+	if tag, _ := FindTag(db, tags[0].Text); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected tag to be deleted")
+	}
+	conditions := []struct {
+		file     metadata.FileInfo
+		expected []string
+	}{
+		{orphan, []string{"fallback"}},
+		{both, []string{tags[1].Text}},
+	}
+	for _, condition := range conditions {
+		fileTags, _ := GetTagsForFile(db, condition.file.Id)
+		if len(fileTags) != len(condition.expected) || fileTags[0].Text != condition.expected[0] {
+			t.Errorf("Expected %s to have tags %v but got %v", condition.file.Name, condition.expected, fileTags)
+		}
+	}
+	if coincident, _ := GetCoincidentTags(db, tags[1:], ""); len(coincident) != 0 {
+		t.Errorf("Expected associations to be removed but found %v", coincident)
+	}
+	fallback, _ := FindTag(db, "fallback")
+	if err = DeleteTagRecursive(db, fallback, "fallback"); err == nil {
+		t.Error("Expected an error replacing a tag with itself")
+	}
+}
+
+// Verifies tags without files are removed by garbage collection along with the associations between tags no file has
+// together.
+func TestCollectGarbage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(filepath.Join(dir, "garbage.db"))
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer Close(db)
+	// every tag is associated with the others
+	tags, err := createTags(db, "a", 4)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	CreateFileInPath(db, "file", "tmp", tags[:2])
+	CreateFileInPath(db, "other", "tmp", tags[3:])
+	report, err := CollectGarbage(db)
+	expected := GarbageReport{Tags: 1, Associations: 5}
+	if err != nil || report != expected {
+		t.Errorf("Expected %+v to be removed but got %+v: %v", expected, report, err)
+	}
+	if tag, _ := FindTag(db, tags[2].Text); tag.Id != metadata.UnknownTag.Id {
+		t.Errorf("Expected %s to be removed", tags[2].Text)
+	}
+	if tag, _ := FindTag(db, tags[3].Text); tag.Id != tags[3].Id {
+		t.Errorf("Expected %s to be kept", tags[3].Text)
+	}
+	if coincident, _ := GetCoincidentTags(db, tags[:1], ""); len(coincident) != 1 || coincident[0] != tags[1] {
+		t.Errorf("Expected only the association with %s to remain but found %v", tags[1].Text, coincident)
+	}
+	if report, err = CollectGarbage(db); err != nil || report != (GarbageReport{}) {
+		t.Errorf("Expected nothing left to remove but got %+v: %v", report, err)
+	}
+}
+
+// Verifies associations are recomputed from the tags of files, adding the missing ones and removing the stale ones.
+func TestRebuildTagAssociations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(filepath.Join(dir, "associations.db"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(db)
+	tags, err := createTags(db, "assoc", 4)
+	if err != nil {
+		t.Fatalf("Could not create tags %s", err)
+	}
+	CreateFileInPath(db, "first", "tmp", tags[:2])
+	CreateFileInPath(db, "second", "tmp", tags[1:3])
+	// only the association of the first file's tags survives the drift, next to a stale one
+	for _, statement := range []string{
+		"DELETE FROM tag_assoc",
+		fmt.Sprintf("INSERT INTO tag_assoc VALUES (%d, %d)", tags[0].Id, tags[1].Id),
+		fmt.Sprintf("INSERT INTO tag_assoc VALUES (%d, %d)", tags[0].Id, tags[3].Id),
+	} {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatalf("Could not run %s: %v", statement, err)
+		}
+	}
+	conditions := []struct {
+		expectedReport AssociationReport
+	}{
+		{AssociationReport{Added: 1, Removed: 1}},
+		{AssociationReport{}},
+	}
+	for i, condition := range conditions {
+		report, err := RebuildTagAssociations(db)
+		if err != nil || report != condition.expectedReport {
+			t.Errorf("Expected %+v for rebuild %d but got %+v (%v)", condition.expectedReport, i, report, err)
+		}
+	}
+	if coincident, _ := GetCoincidentTags(db, tags[1:2], ""); len(coincident) != 2 {
+		t.Errorf("Expected %s to be associated with both other tagged tags but got %v", tags[1].Text, coincident)
+	}
+	if coincident, _ := GetCoincidentTags(db, tags[3:], ""); len(coincident) != 0 {
+		t.Errorf("Expected the stale association of %s to be removed but got %v", tags[3].Text, coincident)
+	}
+}
+
+// Verifies aliases resolve to their tag and follow it through merges and deletes.
+func TestAliases(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	conditions := []struct {
+		tag         metadata.TagInfo
+		alias       string
+		expectedErr error
+	}{
+		{tags[0], "first", nil},
+		{tags[0], "premier", nil},
+		{tags[0], tags[0].Text, nil},
+		{tags[1], "first", ErrTagExists},
+		{tags[1], tags[2].Text, ErrTagExists},
+	}
+	for _, condition := range conditions {
+		if err := AddAlias(db, condition.tag, condition.alias); err != condition.expectedErr {
+			t.Errorf("Expected %v aliasing %s as %s but got %v", condition.expectedErr, condition.tag.Text,
+				condition.alias, err)
+		}
+	}
+	aliases, _ := GetAliases(db, tags[0])
+	if len(aliases) != 2 || aliases[0] != "first" || aliases[1] != "premier" {
+		t.Errorf("Unexpected aliases %v", aliases)
+	}
+	if found, _ := FindTag(db, "first"); found.Id != tags[0].Id || found.Text != tags[0].Text {
+		t.Errorf("Expected alias to resolve to %s but got %s", tags[0].Text, found.Text)
+	}
+	if found, _ := GetCoincidentTag(db, "first", tags[1].Text); found.Id != tags[0].Id {
+		t.Error("Expected alias to resolve to a co-incident tag")
+	}
+	if added, _ := AddTag(db, "premier", nil); added.Id != tags[0].Id {
+		t.Error("Expected adding an alias as a tag to return the aliased tag")
+	}
+	RemoveAlias(db, "premier")
+	if found, _ := FindTag(db, "premier"); found.Id != metadata.UnknownTag.Id {
+		t.Error("Expected removed alias to no longer resolve")
+	}
+	MergeTags(db, tags[0], tags[1])
+	if found, _ := FindTag(db, "first"); found.Id != tags[1].Id {
+		t.Error("Expected alias to follow the merged tag")
+	}
+	DeleteTag(db, tags[1])
+	if aliases, _ = GetAliases(db, tags[1]); len(aliases) != 0 {
+		t.Errorf("Expected aliases to be deleted with the tag but found %v", aliases)
+	}
+}
+
+// Verifies renaming a tag keeps its id and refuses to collide with another tag.
+func TestRenameTag(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 2)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	renamed, err := RenameTag(db, tags[0], "renamed")
+	if err != nil {
+		t.Errorf("Could not rename tag: %s", err)
+	}
+	if renamed.Id != tags[0].Id || renamed.Text != "renamed" {
+		t.Errorf("Expected renamed tag to have id %d and text renamed but got %d, %s", tags[0].Id, renamed.Id,
+			renamed.Text)
+	}
+	foundTag, _ := GetTag(db, tags[0].Text)
+	if foundTag.Id != metadata.UnknownTag.Id {
+		t.Errorf("Old tag name %s should no longer resolve", tags[0].Text)
+	}
+	// associations are keyed by id so they should survive the rename
+	foundTag, _ = GetCoincidentTag(db, "renamed", tags[1].Text)
+	if foundTag.Id != tags[0].Id {
+		t.Error("Renamed tag lost its co-incident tags")
+	}
+
+	// renaming onto an existing tag is a conflict
+	existing, err := RenameTag(db, renamed, tags[1].Text)
+	if err != ErrTagExists {
+		t.Errorf("Expected ErrTagExists but got %v", err)
+	}
+	if existing.Id != tags[1].Id {
+		t.Errorf("Expected conflicting tag %d to be returned but got %d", tags[1].Id, existing.Id)
+	}
+	// and so is renaming onto the alias of another tag
+	_ = AddAlias(db, tags[1], "renameAlias")
+	existing, err = RenameTag(db, renamed, "renameAlias")
+	if err != ErrTagExists || existing.Id != tags[1].Id {
+		t.Errorf("Expected ErrTagExists and tag %d but got %v (%v)", tags[1].Id, existing, err)
+	}
+	// renaming to its own name is allowed
+	_, err = RenameTag(db, renamed, renamed.Text)
+	if err != nil {
+		t.Errorf("Renaming a tag to its current name should not fail: %s", err)
+	}
+}
+
+// Verifies merging moves files and associations to the target tag and removes the source.
+func TestMergeTags(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, files, err := createFilesAndTags(db, "myfile", "mypath", 3, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	// tags[0] and tags[1] are on every file, tags[2] only co-occurs
+	err = MergeTags(db, tags[1], tags[2])
+	if err != nil {
+		t.Errorf("Could not merge tags: %s", err)
+	}
+	foundTag, _ := GetTag(db, tags[1].Text)
+	if foundTag.Id != metadata.UnknownTag.Id {
+		t.Errorf("Expected tag %s to be removed by merge", tags[1].Text)
+	}
+	foundFiles, _ := GetFilesWithTags(db, []metadata.TagInfo{tags[0], tags[2]}, "")
+	if len(foundFiles) != len(files) {
+		t.Errorf("Expected %d files to be moved to the merged tag but found %d", len(files), len(foundFiles))
+	}
+	foundTag, _ = GetCoincidentTag(db, tags[2].Text, tags[0].Text)
+	if foundTag.Id != tags[2].Id {
+		t.Error("Expected merged tag to keep co-incidence with remaining tags")
+	}
+	coincident, _ := GetCoincidentTags(db, []metadata.TagInfo{tags[2]}, "")
+	for _, tag := range coincident {
+		if tag.Id == tags[2].Id || tag.Id == tags[1].Id {
+			t.Errorf("Unexpected co-incident tag %s after merge", tag.Text)
+		}
+	}
+}
+
 // Verifies we can list co-incident tags with multiple levels
 func TestGetCoincidentTags(t *testing.T) {
 	db := getDb(t)
@@ -181,6 +579,142 @@ func TestGetCoincidentTags(t *testing.T) {
 	}
 }
 
+// Verifies excluded tags are left out of co-incident tag listings
+func TestGetCoincidentTagsExcluding(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 4)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	coincident, err := GetCoincidentTagsExcluding(db, tags[:1], tags[2:3], "")
+	if err != nil {
+		t.Errorf("Could not list co-incident tags %s", err)
+	}
+	if len(coincident) != 2 {
+		t.Errorf("Expected 2 co-incident tags but found %d", len(coincident))
+	}
+	for _, tag := range coincident {
+		if tag.Id == tags[2].Id {
+			t.Errorf("Excluded tag %s should not be listed", tag.Text)
+		}
+	}
+	coincident, _ = GetCoincidentTagsExcluding(db, tags[:1], tags[2:], "a1")
+	if len(coincident) != 1 || coincident[0].Id != tags[1].Id {
+		t.Error("Expected name filter to apply along with exclusions")
+	}
+}
+
+// Verifies co-incident tags of any-of groups are listed
+func TestGetCoincidentTagsForFilter(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags := make([]metadata.TagInfo, 4)
+	tags[0], _ = AddTag(db, "a0", nil)
+	tags[1], _ = AddTag(db, "a1", nil)
+	tags[2], _ = AddTag(db, "a2", tags[:1])
+	tags[3], _ = AddTag(db, "a3", tags[1:2])
+	conditions := []struct {
+		filter   TagFilter
+		name     string
+		expected []metadata.TagInfo
+	}{
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:2]}}, "", tags[2:]},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:2]}, Excluded: tags[3:]}, "", tags[2:3]},
+		{TagFilter{Tags: tags[:1], AnyOf: [][]metadata.TagInfo{tags[:2]}}, "", tags[2:3]},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:1], tags[1:2]}}, "", nil},
+		// without required tags, every tag but the excluded ones, in name order
+		{TagFilter{}, "", tags},
+		{TagFilter{Excluded: []metadata.TagInfo{tags[1], tags[3]}}, "", []metadata.TagInfo{tags[0], tags[2]}},
+		{TagFilter{Excluded: tags[:1]}, "a3", tags[3:]},
+	}
+	for _, condition := range conditions {
+		coincident, err := GetCoincidentTagsForFilter(db, condition.filter, condition.name)
+		if err != nil {
+			t.Errorf("Could not list co-incident tags %s", err)
+		}
+		if len(coincident) != len(condition.expected) {
+			t.Errorf("Expected %d co-incident tags but found %d", len(condition.expected), len(coincident))
+			continue
+		}
+		for i, tag := range coincident {
+			if tag.Id != condition.expected[i].Id {
+				t.Errorf("Expected tag %s but got %s", condition.expected[i].Text, tag.Text)
+			}
+		}
+	}
+}
+
+// Measures listing the sub-directories of paths of tags in a database of 100k associations between 5k tags, a few of
+// which are used with a large share of the others as tags like "photos" tend to be. Listings should take well under
+// 10ms.
+func BenchmarkGetCoincidentTags(b *testing.B) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		b.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(filepath.Join(dir, "benchmark.db"))
+	if err != nil {
+		b.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(db)
+	tagCount, hubs, associations := 5000, 20, 100000
+	err = inTx(context.Background(), db, func(tx *sql.Tx) error {
+		for i := 0; i < tagCount; i++ {
+			if _, err := tx.Exec("INSERT INTO tag (id, txt) VALUES (?, ?)", i+1, fmt.Sprintf("bench%d", i)); err != nil {
+				return err
+			}
+		}
+		random := rand.New(rand.NewSource(1))
+		for added := 0; added < associations; {
+			first, second := random.Intn(tagCount)+1, random.Intn(tagCount)+1
+			// a third of the associations are with one of the hubs
+			if added%3 == 0 {
+				first = random.Intn(hubs) + 1
+			}
+			if first == second {
+				continue
+			}
+			result, err := tx.Exec("INSERT OR IGNORE INTO tag_assoc VALUES (?, ?)", min(int64(first), int64(second)),
+				max(int64(first), int64(second)))
+			if err != nil {
+				return err
+			}
+			if inserted, _ := result.RowsAffected(); inserted > 0 {
+				added++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		b.Fatalf("Could not create associations: %v", err)
+	}
+	paths := []struct {
+		name string
+		tags []string
+	}{
+		{"hub", []string{"bench0"}},
+		{"two hubs", []string{"bench0", "bench1"}},
+		{"three hubs", []string{"bench0", "bench1", "bench2"}},
+		{"hub and tag", []string{"bench0", "bench4000"}},
+		{"tag", []string{"bench4000"}},
+	}
+	for _, path := range paths {
+		var tags []metadata.TagInfo
+		for _, name := range path.tags {
+			tags = append(tags, metadata.TagInfo{Text: name})
+		}
+		b.Run(path.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := GetCoincidentTags(db, tags, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 // Verifies we can find tag by name
 func TestFindTag(t *testing.T) {
 	db := getDb(t)
@@ -308,6 +842,159 @@ func TestGetFilesWithTags(t *testing.T) {
 	}
 }
 
+// Validates files with excluded tags are left out
+func TestGetFilesWithTagsExcluding(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	fileCount := 5
+	tags, _, err := createFilesAndTags(db, "both", "tmp", fileCount, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	for i := 0; i < fileCount; i++ {
+		_, err = CreateFileInPath(db, fmt.Sprintf("first%d", i), "tmp", tags[:1])
+		if err != nil {
+			t.Errorf("Could not create files for test %s", err)
+		}
+	}
+	conditions := []struct {
+		tags          []metadata.TagInfo
+		excluded      []metadata.TagInfo
+		name          string
+		expectedCount int
+	}{
+		{tags[:1], nil, "", fileCount * 2},
+		{tags[:1], tags[1:2], "", fileCount},
+		{tags[:1], tags[1:2], "both*", 0},
+		{tags[:1], tags[1:2], "first1", 1},
+		{tags[:1], tags[2:], "", fileCount * 2},
+		{tags[:2], tags[:1], "", 0},
+		// without required tags every file lacking the excluded ones is listed
+		{nil, tags[1:2], "first*", fileCount},
+		{nil, tags[:1], "both*", 0},
+	}
+	for _, condition := range conditions {
+		foundFiles, err := GetFilesWithTagsExcluding(db, condition.tags, condition.excluded, condition.name)
+		if err != nil {
+			t.Errorf("Could not list files: %s", err)
+		} else if len(foundFiles) != condition.expectedCount {
+			t.Errorf("Expected to find %d files but got %d", condition.expectedCount, len(foundFiles))
+		}
+	}
+}
+
+// Verifies the context-aware queries give up once their context is done.
+func TestFilterQueriesContext(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _, err := createFilesAndTags(db, "ctxFile", "ctxPath", 3, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	conditions := []struct {
+		ctx         context.Context
+		expectedErr error
+	}{
+		{context.Background(), nil},
+		{cancelled, context.Canceled},
+	}
+	for _, condition := range conditions {
+		filter := TagFilter{Tags: tags[:1]}
+		if _, err := GetFilesMatchingFilterContext(condition.ctx, db, filter, ""); err != condition.expectedErr {
+			t.Errorf("Expected %v listing files but got %v", condition.expectedErr, err)
+		}
+		if _, err := GetCoincidentTagsForFilterContext(condition.ctx, db, filter, ""); err != condition.expectedErr {
+			t.Errorf("Expected %v listing tags but got %v", condition.expectedErr, err)
+		}
+		if _, err := CountFilesMatchingFilterContext(condition.ctx, db, filter); err != condition.expectedErr {
+			t.Errorf("Expected %v counting files but got %v", condition.expectedErr, err)
+		}
+		if _, err := GetFilesWithSingleTagContext(condition.ctx, db, ""); err != condition.expectedErr {
+			t.Errorf("Expected %v listing single tag files but got %v", condition.expectedErr, err)
+		}
+		if _, err := GetUntaggedFilesContext(condition.ctx, db, "uncategorized", ""); err != condition.expectedErr {
+			t.Errorf("Expected %v listing untagged files but got %v", condition.expectedErr, err)
+		}
+		if _, err := GetFilesMatchingQueryContext(condition.ctx, db, nil, ""); err != condition.expectedErr {
+			t.Errorf("Expected %v listing files matching a query but got %v", condition.expectedErr, err)
+		}
+	}
+}
+
+// Validates files are selected by required, any-of and excluded tags
+func TestGetFilesMatchingFilter(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 4)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	// one file per tag plus one with the first two tags
+	for i, tag := range tags {
+		CreateFileInPath(db, fmt.Sprintf("file%d", i), "tmp", []metadata.TagInfo{tag})
+	}
+	CreateFileInPath(db, "both", "tmp", tags[:2])
+	conditions := []struct {
+		filter        TagFilter
+		name          string
+		expectedCount int
+	}{
+		{TagFilter{}, "", 5},
+		{TagFilter{}, "file*", 4},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:2]}}, "", 3},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:2], tags[2:]}}, "", 0},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:3]}, Excluded: tags[1:2]}, "", 2},
+		{TagFilter{Tags: tags[:1], AnyOf: [][]metadata.TagInfo{tags[1:]}}, "", 1},
+		{TagFilter{AnyOf: [][]metadata.TagInfo{tags[:2]}}, "both", 1},
+	}
+	for _, condition := range conditions {
+		foundFiles, err := GetFilesMatchingFilter(db, condition.filter, condition.name)
+		if err != nil {
+			t.Errorf("Could not list files: %s", err)
+		} else if len(foundFiles) != condition.expectedCount {
+			t.Errorf("Expected to find %d files but got %d", condition.expectedCount, len(foundFiles))
+		}
+		if len(condition.name) == 0 {
+			count, err := CountFilesMatchingFilter(db, condition.filter)
+			if err != nil || count != condition.expectedCount {
+				t.Errorf("Expected to count %d files but got %d: %v", condition.expectedCount, count, err)
+			}
+		}
+	}
+}
+
+// Verifies only files with a single tag are listed.
+func TestGetFilesWithSingleTag(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 2)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	CreateFileInPath(db, "file1", "tmp", tags[:1])
+	CreateFileInPath(db, "file2", "tmp", tags[1:])
+	CreateFileInPath(db, "both", "tmp", tags)
+	conditions := []struct {
+		name          string
+		expectedCount int
+	}{
+		{"", 2},
+		{"file*", 2},
+		{"file1", 1},
+		{"both", 0},
+	}
+	for _, condition := range conditions {
+		foundFiles, err := GetFilesWithSingleTag(db, condition.name)
+		if err != nil {
+			t.Errorf("Could not list files: %s", err)
+		} else if len(foundFiles) != condition.expectedCount {
+			t.Errorf("Expected to find %d files but got %d", condition.expectedCount, len(foundFiles))
+		}
+	}
+}
+
 // Validates that tagging a file allows it to be found when listing by tags
 func TestTagFile(t *testing.T) {
 	db := getDb(t)
@@ -350,6 +1037,52 @@ func TestTagFile(t *testing.T) {
 	}
 }
 
+// Verifies we can list the tags on a file.
+func TestGetTagsForFile(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, files, err := createFilesAndTags(db, "myfile", "mypath", 1, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	foundTags, err := GetTagsForFile(db, files[0].Id)
+	if err != nil {
+		t.Errorf("Could not get tags for file: %s", err)
+	}
+	if len(foundTags) != 2 {
+		t.Errorf("Expected 2 tags but found %d", len(foundTags))
+	} else if foundTags[0].Id != tags[0].Id || foundTags[1].Id != tags[1].Id {
+		t.Errorf("Expected tags %s and %s but got %s and %s", tags[0].Text, tags[1].Text, foundTags[0].Text,
+			foundTags[1].Text)
+	}
+	foundTags, err = GetTagsForFile(db, -1)
+	if err != nil || len(foundTags) != 0 {
+		t.Error("Expected no tags for unknown file")
+	}
+}
+
+// Verifies setting the tags of a file adds the new tags and removes the ones not listed.
+func TestSetFileTags(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, files, err := createFilesAndTags(db, "myfile", "mypath", 1, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	err = SetFileTags(db, files[0].Id, tags[1:])
+	if err != nil {
+		t.Errorf("Could not set file tags: %s", err)
+	}
+	foundFiles, _ := GetFilesWithTags(db, tags[1:], "")
+	if !isFileFound(foundFiles, files[0]) {
+		t.Error("Expected file to have the tags that were set")
+	}
+	foundFiles, _ = GetFilesWithTags(db, tags[:1], "")
+	if isFileFound(foundFiles, files[0]) {
+		t.Errorf("Expected tag %s to be removed from file", tags[0].Text)
+	}
+}
+
 // Verifies un-tagging a file removes it from a path.
 func TestUntagFile(t *testing.T) {
 	db := getDb(t)
@@ -401,6 +1134,215 @@ func TestUntagFiles(t *testing.T) {
 	}
 }
 
+// Verifies files can be moved from one set of tags to another.
+func TestRetagFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, files, err := createFilesAndTags(db, "baseName", "xxx", 5, 1)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	moved := []int64{files[0].Id, files[1].Id, files[2].Id}
+	if err = RetagFiles(db, moved, tags[:1], tags[1:]); err != nil {
+		t.Errorf("Could not retag files: %s", err)
+	}
+	if foundFiles, _ := GetFilesWithTags(db, tags[1:], ""); len(foundFiles) != len(moved) {
+		t.Errorf("Expected %d files with the new tags but found %d", len(moved), len(foundFiles))
+	}
+	foundFiles, _ := GetFilesWithTags(db, tags[:1], "")
+	if len(foundFiles) != 2 || isFileFound(foundFiles, files[0]) {
+		t.Errorf("Expected only the files not moved to keep the old tag but found %v", foundFiles)
+	}
+	// nothing to move is not an error
+	if err = RetagFiles(db, nil, tags[:1], tags[1:]); err != nil {
+		t.Errorf("Unexpected error retagging no files: %s", err)
+	}
+}
+
+// Verifies tags are applied to many files at once, including more links than one statement inserts.
+func TestTagFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "bulk", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	var fileIds []int64
+	for i := 0; i < maxInsertRows+50; i++ {
+		file, _ := CreateFileInPath(db, fmt.Sprintf("bulkFile%d", i), "bulkPath", tags[:1])
+		fileIds = append(fileIds, file.Id)
+	}
+	conditions := []struct {
+		fileIds       []int64
+		tags          []metadata.TagInfo
+		expectedFiles int
+	}{
+		{nil, tags[1:], 0},
+		{fileIds, nil, 0},
+		{fileIds[:1], tags[1:], 1},
+		// tags the files already have are ignored
+		{fileIds, tags, len(fileIds)},
+	}
+	for _, condition := range conditions {
+		if err = TagFiles(db, condition.fileIds, condition.tags); err != nil {
+			t.Errorf("Could not tag %d files: %s", len(condition.fileIds), err)
+		}
+		if count, _ := CountFilesWithTags(db, tags, ""); count != condition.expectedFiles {
+			t.Errorf("Expected %d files with every tag after tagging %d files but found %d",
+				condition.expectedFiles, len(condition.fileIds), count)
+		}
+	}
+}
+
+// Verifies many files are added in batches, each with its own tags.
+func TestCreateFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "batch", 2)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	var entries []NewFile
+	for i := 0; i < createBatchSize+10; i++ {
+		entries = append(entries, NewFile{Name: fmt.Sprintf("batchFile%d", i), Path: "batchPath",
+			Tags: tags[:1+i%2]})
+	}
+	files, err := CreateFiles(db, entries)
+	if err != nil || len(files) != len(entries) {
+		t.Errorf("Expected %d files to be added but got %d (%v)", len(entries), len(files), err)
+		return
+	}
+	for i, file := range files {
+		found, _ := FindFileByAbsPath(db, entries[i].Name, entries[i].Path)
+		fileTags, _ := GetTagsForFile(db, file.Id)
+		if found != file || len(fileTags) != len(entries[i].Tags) {
+			t.Errorf("Expected %s to be added as %v with tags %v but found %v with %v", entries[i].Name, file,
+				entries[i].Tags, found, fileTags)
+		}
+	}
+	if count, _ := CountFilesWithTags(db, tags, ""); count != len(entries)/2 {
+		t.Errorf("Expected %d files with both tags but found %d", len(entries)/2, count)
+	}
+	if files, err = CreateFiles(db, nil); err != nil || len(files) != 0 {
+		t.Errorf("Expected nothing to be added but got %v (%v)", files, err)
+	}
+}
+
+// Verifies upserting a file records it once and adds to its tags.
+func TestUpsertFile(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "upsert", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	conditions := []struct {
+		tags         []metadata.TagInfo
+		expectedTags int
+	}{
+		{tags[:1], 1},
+		{tags[:2], 2},
+		{nil, 2},
+		{tags[2:], 3},
+	}
+	var first metadata.FileInfo
+	for i, condition := range conditions {
+		file, err := UpsertFile(db, "upsertFile", "upsertPath", condition.tags)
+		if i == 0 {
+			first = file
+		}
+		fileTags, _ := GetTagsForFile(db, file.Id)
+		if err != nil || file != first || len(fileTags) != condition.expectedTags {
+			t.Errorf("Expected %v with %d tags but got %v with %v (%v)", first, condition.expectedTags, file,
+				fileTags, err)
+		}
+	}
+	if files, _ := CreateFiles(db, []NewFile{{Name: "upsertFile", Path: "upsertPath"}}); len(files) != 1 ||
+		files[0] != first {
+		t.Errorf("Expected adding a recorded file to return it but got %v", files)
+	}
+}
+
+// Verifies a memory database is shared by the pools opened on it and discarded once they are all closed, and that
+// other memory databases are separate.
+func TestNewMemoryDatabase(t *testing.T) {
+	name := NewMemoryDatabase()
+	first, err := Open(name)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	if _, err = AddTag(first, "memoryTag", nil); err != nil {
+		t.Errorf("Could not add tag: %v", err)
+	}
+	other, err := Open(NewMemoryDatabase())
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	if tag, _ := FindTag(other, "memoryTag"); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected another memory database not to share the tag")
+	}
+	Close(other)
+	second, err := OpenWithOptions(name, OpenOptions{Source: SourceMount})
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	if tag, _ := FindTag(second, "memoryTag"); tag.Id == metadata.UnknownTag.Id {
+		t.Error("Expected the tag to be seen through the second pool")
+	}
+	Close(first)
+	Close(second)
+	third, err := Open(name)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(third)
+	if tag, _ := FindTag(third, "memoryTag"); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected the database to be discarded once closed")
+	}
+}
+
+// Verifies an encrypted database can only be opened again with its key, and that builds without SQLCipher refuse keys.
+func TestEncryptedDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "encrypted.db")
+	encrypted, err := OpenWithOptions(filename, OpenOptions{Key: "it's secret"})
+	if !encryptionSupported {
+		if err != ErrEncryptionUnsupported {
+			t.Errorf("Expected opening with a key to be refused but got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	AddTag(encrypted, "secretTag", nil)
+	Close(encrypted)
+	conditions := []struct {
+		key        string
+		expectedOk bool
+	}{
+		{"it's secret", true},
+		{"wrong", false},
+		{"", false},
+	}
+	for _, condition := range conditions {
+		database, err := OpenWithOptions(filename, OpenOptions{Key: condition.key})
+		ok := err == nil
+		if ok {
+			tag, _ := FindTag(database, "secretTag")
+			ok = tag.Id != metadata.UnknownTag.Id
+			Close(database)
+		}
+		if ok != condition.expectedOk {
+			t.Errorf("Expected opening with key %q to succeed: %t but got %v", condition.key, condition.expectedOk, err)
+		}
+	}
+}
+
 // Verifies find by path/name.
 func TestFindFileByAbsPath(t *testing.T) {
 	db := getDb(t)
@@ -471,6 +1413,61 @@ func TestGetFileCountWithSingleTag(t *testing.T) {
 	}
 }
 
+// Validates files can be looked up by id.
+func TestGetFile(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	file, _ := CreateFileInPath(db, "one", "path", nil)
+	conditions := []struct {
+		id       int64
+		expected metadata.FileInfo
+	}{
+		{file.Id, file},
+		{file.Id + 1, metadata.UnknownFile},
+		{-1, metadata.UnknownFile},
+	}
+	for _, condition := range conditions {
+		found, err := GetFile(db, condition.id)
+		if err != nil {
+			t.Errorf("Could not get file %d: %s", condition.id, err)
+		}
+		if found != condition.expected {
+			t.Errorf("Expected %v for id %d but got %v", condition.expected, condition.id, found)
+		}
+	}
+}
+
+// Validates that files without tags, or with only the fallback tag, are found as untagged.
+func TestGetUntaggedFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	fallback, _ := AddTag(db, "uncategorized", nil)
+	other, _ := AddTag(db, "other", nil)
+	CreateFileInPath(db, "none", "path", nil)
+	CreateFileInPath(db, "fallback", "path", []metadata.TagInfo{fallback})
+	CreateFileInPath(db, "both", "path", []metadata.TagInfo{fallback, other})
+	CreateFileInPath(db, "other", "path", []metadata.TagInfo{other})
+	conditions := []struct {
+		name          string
+		expectedCount int
+	}{
+		{"", 2},
+		{"none", 1},
+		{"fall*", 1},
+		{"both", 0},
+	}
+	for _, condition := range conditions {
+		files, err := GetUntaggedFiles(db, fallback.Text, condition.name)
+		if err != nil {
+			t.Errorf("Could not get untagged files: %s", err)
+		}
+		if len(files) != condition.expectedCount {
+			t.Errorf("Expected %d untagged files named %s but found %d", condition.expectedCount, condition.name,
+				len(files))
+		}
+	}
+}
+
 // Validates we can get the right number of files that have a specific tag.
 func TestCountFilesWithTag(t *testing.T) {
 	db := getDb(t)
@@ -506,6 +1503,48 @@ func TestCountFilesWithTag(t *testing.T) {
 }
 
 // Helper to create count files tagged with tagCount tags
+// Verifies the total number of files and tags are counted.
+func TestCountFilesAndTags(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	_, _, err := createFilesAndTags(db, "myfile", "mypath", 3, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	fileCount, err := CountFiles(db)
+	if err != nil || fileCount != 3 {
+		t.Errorf("Expected 3 files but got %d: %v", fileCount, err)
+	}
+	tagCount, err := CountTags(db)
+	if err != nil || tagCount != 3 {
+		t.Errorf("Expected 3 tags but got %d: %v", tagCount, err)
+	}
+}
+
+// Verifies the tags applied to a file are counted.
+func TestGetTagCountForFile(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	conditions := []struct {
+		tagCount int
+	}{
+		{1},
+		{2},
+		{3},
+	}
+	for i, condition := range conditions {
+		_, files, err := createFilesAndTags(db, fmt.Sprintf("file%d-", i), "mypath", 1, condition.tagCount)
+		if err != nil {
+			t.Errorf("Could not create files for test %s", err)
+			continue
+		}
+		count, err := GetTagCountForFile(db, files[0].Id)
+		if err != nil || count != condition.tagCount {
+			t.Errorf("Expected %d tags but got %d: %v", condition.tagCount, count, err)
+		}
+	}
+}
+
 func createFilesAndTags(db *sql.DB, baseName string, path string, fileCount int, tagCount int) ([]metadata.TagInfo, []metadata.FileInfo, error) {
 	tags, err := createTags(db, "a", 3)
 	if err != nil {
@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+)
+
+// Makes child a sub-tag of parent in the tag hierarchy. Unlike co-occurrence the relationship is directional: the
+// child is listed under the parent but not the other way around. A tag can have more than one parent. Returns
+// ErrTagCycle if the child is already an ancestor of the parent.
+func SetTagParent(db *sql.DB, parent metadata.TagInfo, child metadata.TagInfo) error {
+	return SetTagParentContext(context.Background(), db, parent, child)
+}
+
+func SetTagParentContext(ctx context.Context, db *sql.DB, parent metadata.TagInfo, child metadata.TagInfo) error {
+	if parent.Id == child.Id {
+		return ErrTagCycle
+	}
+	ancestors, err := countRowsContext(ctx, db, "WITH RECURSIVE ancestor(id) AS (SELECT ? UNION "+
+		"SELECT tp.parent FROM tag_parent tp, ancestor a WHERE tp.child = a.id) "+
+		"SELECT count(*) FROM ancestor WHERE id = ?", parent.Id, child.Id)
+	if err != nil {
+		return err
+	}
+	if ancestors > 0 {
+		return ErrTagCycle
+	}
+	_, err = execWrite(ctx, db, "INSERT OR IGNORE INTO tag_parent VALUES (?,?)", parent.Id, child.Id)
+	return err
+}
+
+// Removes child from under parent in the tag hierarchy.
+func RemoveTagParent(db *sql.DB, parent metadata.TagInfo, child metadata.TagInfo) error {
+	return RemoveTagParentContext(context.Background(), db, parent, child)
+}
+
+func RemoveTagParentContext(ctx context.Context, db *sql.DB, parent metadata.TagInfo, child metadata.TagInfo) error {
+	_, err := execWrite(ctx, db, "DELETE FROM tag_parent WHERE parent = ? AND child = ?", parent.Id, child.Id)
+	return err
+}
+
+// Lists the tags that are not a sub-tag of any other tag.
+func GetRootTags(db *sql.DB) ([]metadata.TagInfo, error) {
+	return GetRootTagsContext(context.Background(), db)
+}
+
+func GetRootTagsContext(ctx context.Context, db *sql.DB) ([]metadata.TagInfo, error) {
+	return queryTags(ctx, db, "SELECT id, txt FROM tag WHERE id NOT IN (SELECT child FROM tag_parent) ORDER BY txt ASC")
+}
+
+// Lists the sub-tags of the tag passed in.
+func GetChildTags(db *sql.DB, parent metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return GetChildTagsContext(context.Background(), db, parent)
+}
+
+func GetChildTagsContext(ctx context.Context, db *sql.DB, parent metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return queryTags(ctx, db, "SELECT t.id, t.txt FROM tag t, tag_parent tp WHERE tp.child = t.id AND tp.parent = ? "+
+		"ORDER BY t.txt ASC", parent.Id)
+}
+
+// Lists the tags the tag passed in is a sub-tag of.
+func GetParentTags(db *sql.DB, child metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return GetParentTagsContext(context.Background(), db, child)
+}
+
+func GetParentTagsContext(ctx context.Context, db *sql.DB, child metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return queryTags(ctx, db, "SELECT t.id, t.txt FROM tag t, tag_parent tp WHERE tp.parent = t.id AND tp.child = ? "+
+		"ORDER BY t.txt ASC", child.Id)
+}
+
+// Lists the parents of the tag passed in, their parents and so on up to the root tags, nearest first (tags as near
+// ordered by text). A tag reached through several parents is listed once, at its nearest.
+func GetTagAncestors(db *sql.DB, tag metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return GetTagAncestorsContext(context.Background(), db, tag)
+}
+
+func GetTagAncestorsContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo) ([]metadata.TagInfo, error) {
+	// SetTagParent refuses cycles so the recursion ends at the roots
+	return queryTags(ctx, db, "WITH RECURSIVE ancestor(id, depth) AS (SELECT parent, 1 FROM tag_parent WHERE child = ? "+
+		"UNION SELECT tp.parent, a.depth + 1 FROM tag_parent tp, ancestor a WHERE tp.child = a.id) "+
+		"SELECT t.id, t.txt FROM tag t, (SELECT id, min(depth) AS depth FROM ancestor GROUP BY id) a "+
+		"WHERE t.id = a.id ORDER BY a.depth ASC, t.txt ASC", tag.Id)
+}
+
+// Looks up a sub-tag of parent by name or alias. Returns metadata.UnknownTag if parent has no such sub-tag.
+func GetChildTag(db *sql.DB, parent metadata.TagInfo, name string) (metadata.TagInfo, error) {
+	return GetChildTagContext(context.Background(), db, parent, name)
+}
+
+func GetChildTagContext(ctx context.Context, db *sql.DB, parent metadata.TagInfo,
+	name string) (metadata.TagInfo, error) {
+	tags, err := queryTags(ctx, db, "SELECT id, txt FROM tag WHERE "+tagNameCondition+
+		" AND id IN (SELECT child FROM tag_parent WHERE parent = ?)", name, name, parent.Id)
+	if err != nil || len(tags) == 0 {
+		return metadata.UnknownTag, err
+	}
+	return tags[0], nil
+}
+
+// Runs a query selecting the id and text of tags.
+func queryTags(ctx context.Context, db *sql.DB, query string, params ...interface{}) ([]metadata.TagInfo, error) {
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.TagInfo
+	for rows.Next() {
+		var tag = metadata.TagInfo{}
+		err = rows.Scan(&tag.Id, &tag.Text)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, tag)
+	}
+	return results, nil
+}
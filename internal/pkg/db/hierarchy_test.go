@@ -0,0 +1,111 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies parent/child links are directional, reject cycles and are cleaned up with their tags.
+func TestTagParents(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "h", 4)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	conditions := []struct {
+		parent      metadata.TagInfo
+		child       metadata.TagInfo
+		expectedErr error
+	}{
+		{tags[0], tags[1], nil},
+		{tags[1], tags[2], nil},
+		{tags[0], tags[1], nil},
+		{tags[2], tags[0], ErrTagCycle},
+		{tags[3], tags[3], ErrTagCycle},
+	}
+	for _, condition := range conditions {
+		if err := SetTagParent(db, condition.parent, condition.child); err != condition.expectedErr {
+			t.Errorf("Expected %v making %s a parent of %s but got %v", condition.expectedErr,
+				condition.parent.Text, condition.child.Text, err)
+		}
+	}
+	children, _ := GetChildTags(db, tags[0])
+	if len(children) != 1 || children[0].Id != tags[1].Id {
+		t.Errorf("Unexpected children %v", children)
+	}
+	if children, _ = GetChildTags(db, tags[1]); len(children) != 1 || children[0].Id != tags[2].Id {
+		t.Errorf("Unexpected children %v", children)
+	}
+	if children, _ = GetChildTags(db, tags[2]); len(children) != 0 {
+		t.Errorf("Expected the link to be one way but found %v", children)
+	}
+	roots, _ := GetRootTags(db)
+	if len(roots) != 2 || roots[0].Id != tags[0].Id || roots[1].Id != tags[3].Id {
+		t.Errorf("Unexpected root tags %v", roots)
+	}
+	if found, _ := GetChildTag(db, tags[0], tags[1].Text); found.Id != tags[1].Id {
+		t.Errorf("Expected to find child %s", tags[1].Text)
+	}
+	if found, _ := GetChildTag(db, tags[0], tags[2].Text); found.Id != metadata.UnknownTag.Id {
+		t.Error("Expected grandchild not to be a child")
+	}
+	RemoveTagParent(db, tags[1], tags[2])
+	if roots, _ = GetRootTags(db); len(roots) != 3 {
+		t.Errorf("Expected unlinked tag to become a root but found %v", roots)
+	}
+	DeleteTag(db, tags[1])
+	if children, _ = GetChildTags(db, tags[0]); len(children) != 0 {
+		t.Errorf("Expected links to be deleted with the tag but found %v", children)
+	}
+}
+
+// Verifies parents and ancestors are listed nearest first, once each.
+func TestTagAncestors(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "ancestor", 5)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	// 0 > 1 > 2 > 4 and 0 > 3 > 4
+	for _, link := range [][2]int{{0, 1}, {1, 2}, {2, 4}, {0, 3}, {3, 4}} {
+		if err = SetTagParent(db, tags[link[0]], tags[link[1]]); err != nil {
+			t.Errorf("Could not link tags: %v", err)
+		}
+	}
+	conditions := []struct {
+		tag               metadata.TagInfo
+		expectedParents   []metadata.TagInfo
+		expectedAncestors []metadata.TagInfo
+	}{
+		{tags[4], []metadata.TagInfo{tags[2], tags[3]}, []metadata.TagInfo{tags[2], tags[3], tags[0], tags[1]}},
+		{tags[1], []metadata.TagInfo{tags[0]}, []metadata.TagInfo{tags[0]}},
+		{tags[0], nil, nil},
+	}
+	for _, condition := range conditions {
+		parents, err := GetParentTags(db, condition.tag)
+		if err != nil || !sameTags(parents, condition.expectedParents) {
+			t.Errorf("Expected parents %v of %s but got %v (%v)", condition.expectedParents, condition.tag.Text,
+				parents, err)
+		}
+		ancestors, err := GetTagAncestors(db, condition.tag)
+		if err != nil || !sameTags(ancestors, condition.expectedAncestors) {
+			t.Errorf("Expected ancestors %v of %s but got %v (%v)", condition.expectedAncestors, condition.tag.Text,
+				ancestors, err)
+		}
+	}
+}
+
+// Tells whether two lists have the same tags in the same order.
+func sameTags(tags []metadata.TagInfo, expected []metadata.TagInfo) bool {
+	if len(tags) != len(expected) {
+		return false
+	}
+	for i := range tags {
+		if tags[i].Id != expected[i].Id {
+			return false
+		}
+	}
+	return true
+}
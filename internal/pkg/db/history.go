@@ -0,0 +1,103 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"time"
+)
+
+// Programs recorded as the source of changes, see OpenOptions.Source.
+const (
+	SourceMount   = "mount"
+	SourceIndexer = "indexer"
+	SourceCLI     = "cli"
+)
+
+// Actions recorded in the history.
+const (
+	// a file was added
+	HistoryCreate = "create"
+	// a file was removed
+	HistoryDelete = "delete"
+	// a tag was added to a file
+	HistoryTag = "tag"
+	// a tag was removed from a file
+	HistoryUntag = "untag"
+)
+
+// Creates the history table along with the triggers filling it. Changes are recorded by triggers rather than by the
+// functions making them so none are missed, whichever statement (or program) makes them. The name, path and tag text
+// are copied since the file or tag may be gone by the time the history is read.
+func createHistory(tx *sql.Tx) error {
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS history(id INTEGER PRIMARY KEY, time INTEGER, source text, action text, " +
+			"fid INTEGER, name text, path text, tid INTEGER, tag text);",
+		"CREATE INDEX IF NOT EXISTS history_file_idx ON history(fid);",
+		"CREATE INDEX IF NOT EXISTS history_time_idx ON history(time);",
+		"CREATE TRIGGER IF NOT EXISTS history_create AFTER INSERT ON file_md BEGIN " +
+			"INSERT INTO history(time, action, fid, name, path) " +
+			"VALUES (strftime('%s', 'now'), 'create', new.id, new.name, new.path); END",
+		"CREATE TRIGGER IF NOT EXISTS history_delete AFTER DELETE ON file_md BEGIN " +
+			"INSERT INTO history(time, action, fid, name, path) " +
+			"VALUES (strftime('%s', 'now'), 'delete', old.id, old.name, old.path); END",
+		"CREATE TRIGGER IF NOT EXISTS history_tag AFTER INSERT ON file_tags BEGIN " +
+			"INSERT INTO history(time, action, fid, name, path, tid, tag) " +
+			"SELECT strftime('%s', 'now'), 'tag', new.fid, f.name, f.path, new.tid, " +
+			"(SELECT txt FROM tag WHERE id = new.tid) FROM file_md f WHERE f.id = new.fid; END",
+		"CREATE TRIGGER IF NOT EXISTS history_untag AFTER DELETE ON file_tags BEGIN " +
+			"INSERT INTO history(time, action, fid, name, path, tid, tag) " +
+			"SELECT strftime('%s', 'now'), 'untag', old.fid, f.name, f.path, old.tid, " +
+			"(SELECT txt FROM tag WHERE id = old.tid) FROM file_md f WHERE f.id = old.fid; END",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lists the changes made to a file, oldest first.
+func GetFileHistory(db *sql.DB, fileId int64) ([]metadata.HistoryEntry, error) {
+	return GetFileHistoryContext(context.Background(), db, fileId)
+}
+
+func GetFileHistoryContext(ctx context.Context, db *sql.DB, fileId int64) ([]metadata.HistoryEntry, error) {
+	return queryHistory(ctx, db, "WHERE fid = ? ORDER BY id ASC", fileId)
+}
+
+// Lists the changes made since a time (included), oldest first. At most limit changes are returned if it is over 0, so
+// the history can be read in chunks by asking for the changes since the time of the last one read and skipping the
+// ones already read.
+func GetHistory(db *sql.DB, since time.Time, limit int) ([]metadata.HistoryEntry, error) {
+	return GetHistoryContext(context.Background(), db, since, limit)
+}
+
+func GetHistoryContext(ctx context.Context, db *sql.DB, since time.Time, limit int) ([]metadata.HistoryEntry, error) {
+	limitClause, limitParams := Page{Limit: limit}.clause()
+	return queryHistory(ctx, db, "WHERE time >= ? ORDER BY id ASC"+limitClause,
+		append([]interface{}{since.Unix()}, limitParams...)...)
+}
+
+// Runs a query for history entries given the clauses following the FROM clause.
+func queryHistory(ctx context.Context, db *sql.DB, clauses string,
+	params ...interface{}) ([]metadata.HistoryEntry, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, time, coalesce(source, ''), action, fid, name, path, "+
+		"coalesce(tid, 0), coalesce(tag, '') FROM history "+clauses, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.HistoryEntry
+	for rows.Next() {
+		var entry metadata.HistoryEntry
+		var seconds int64
+		if err = rows.Scan(&entry.Id, &seconds, &entry.Source, &entry.Action, &entry.File.Id, &entry.File.Name,
+			&entry.File.Path, &entry.Tag.Id, &entry.Tag.Text); err != nil {
+			return nil, err
+		}
+		entry.Time = time.Unix(seconds, 0)
+		results = append(results, entry)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Verifies changes to files and their tags are recorded along with the source of the connection making them.
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "history.db")
+	indexer, err := OpenWithOptions(filename, OpenOptions{Source: SourceIndexer})
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer Close(indexer)
+	mount, err := OpenWithOptions(filename, OpenOptions{Source: SourceMount})
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer Close(mount)
+	unknown, err := Open(filename)
+	if err != nil {
+		t.Errorf("Could not open database: %v", err)
+		return
+	}
+	defer Close(unknown)
+
+	start := time.Now().Add(-time.Second)
+	tags, _ := AddTags(indexer, []string{"historyOne", "historyTwo"}, nil)
+	file, _ := CreateFileInPath(indexer, "historyFile", "historyPath", tags[:1])
+	other, _ := CreateFileInPath(indexer, "historyOther", "historyPath", nil)
+	TagFile(mount, file.Id, tags[1:])
+	UntagFile(unknown, file.Id, tags[0].Id)
+	// tagging a file with a tag it already has changes nothing
+	TagFile(mount, file.Id, tags[1:])
+	// the entry keeps the name the tag had at the time
+	RenameTag(mount, tags[1], "historyRenamed")
+	UntagFile(mount, file.Id, tags[1].Id)
+
+	conditions := []struct {
+		action string
+		source string
+		tag    metadata.TagInfo
+	}{
+		{HistoryCreate, SourceIndexer, metadata.TagInfo{}},
+		{HistoryTag, SourceIndexer, tags[0]},
+		{HistoryTag, SourceMount, tags[1]},
+		{HistoryUntag, "", tags[0]},
+		{HistoryUntag, SourceMount, metadata.TagInfo{Id: tags[1].Id, Text: "historyRenamed"}},
+	}
+	entries, err := GetFileHistory(mount, file.Id)
+	if err != nil || len(entries) != len(conditions) {
+		t.Errorf("Expected %d entries but got %v (%v)", len(conditions), entries, err)
+		return
+	}
+	for i, condition := range conditions {
+		entry := entries[i]
+		if entry.Action != condition.action || entry.Source != condition.source || entry.Tag != condition.tag ||
+			entry.File != file || entry.Time.Before(start) {
+			t.Errorf("Expected %s by %q of %v to %v but got %v", condition.action, condition.source, condition.tag,
+				file, entry)
+		}
+	}
+
+	all, err := GetHistory(unknown, start, 0)
+	if err != nil || len(all) != len(conditions)+1 || all[2].File != other {
+		t.Errorf("Expected the changes to both files but got %v (%v)", all, err)
+	}
+	limited, err := GetHistory(unknown, start, 2)
+	if err != nil || fmt.Sprint(limited) != fmt.Sprint(all[:2]) {
+		t.Errorf("Expected the first 2 changes but got %v (%v)", limited, err)
+	}
+	later, err := GetHistory(unknown, time.Now().Add(time.Hour), 0)
+	if err != nil || len(later) != 0 {
+		t.Errorf("Expected no changes in the future but got %v (%v)", later, err)
+	}
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"time"
+)
+
+// Records where a file is kept, for files that aren't on local disk. Setting the zero location (or the local scheme)
+// records the file as local again.
+func SetFileLocation(db *sql.DB, fileId int64, location metadata.Location) error {
+	return SetFileLocationContext(context.Background(), db, fileId, location)
+}
+
+func SetFileLocationContext(ctx context.Context, db *sql.DB, fileId int64, location metadata.Location) error {
+	var scheme, bucket, endpoint interface{}
+	if !location.IsLocal() {
+		scheme, bucket, endpoint = location.Scheme, nullIfEmpty(location.Bucket), nullIfEmpty(location.Endpoint)
+	}
+	_, err := execWrite(ctx, db, "UPDATE file_md SET scheme = ?, bucket = ?, endpoint = ? WHERE id = ?", scheme,
+		bucket, endpoint, fileId)
+	return err
+}
+
+// Gets where a file is kept. Files on local disk (and files that aren't recorded) have the zero location.
+func GetFileLocation(db *sql.DB, fileId int64) (metadata.Location, error) {
+	return GetFileLocationContext(context.Background(), db, fileId)
+}
+
+func GetFileLocationContext(ctx context.Context, db *sql.DB, fileId int64) (metadata.Location, error) {
+	defer observe("GetFileLocation", time.Now())
+	var location metadata.Location
+	err := db.QueryRowContext(ctx, "SELECT coalesce(scheme, ''), coalesce(bucket, ''), coalesce(endpoint, '') "+
+		"FROM file_md WHERE id = ?", fileId).Scan(&location.Scheme, &location.Bucket, &location.Endpoint)
+	if err == sql.ErrNoRows {
+		return metadata.Location{}, nil
+	}
+	return location, err
+}
+
+// Gets the files kept in a location, optionally filtered by name (which can contain wildcards). The zero location lists
+// the files on local disk.
+func GetFilesInLocation(db *sql.DB, location metadata.Location, name string) ([]metadata.FileInfo, error) {
+	return GetFilesInLocationContext(context.Background(), db, location, name)
+}
+
+func GetFilesInLocationContext(ctx context.Context, db *sql.DB, location metadata.Location,
+	name string) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesInLocation", time.Now())
+	if location.IsLocal() {
+		return queryFilesNamedContext(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f "+
+			"WHERE coalesce(f.scheme, ?) = ?", []interface{}{metadata.LocalScheme, metadata.LocalScheme}, name)
+	}
+	return queryFilesNamedContext(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f WHERE f.scheme = ? "+
+		"AND coalesce(f.bucket, '') = ? AND coalesce(f.endpoint, '') = ?",
+		[]interface{}{location.Scheme, location.Bucket, location.Endpoint}, name)
+}
+
+// Returns nil for empty strings so they are recorded as NULL.
+func nullIfEmpty(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
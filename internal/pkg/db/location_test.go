@@ -0,0 +1,50 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies the locations of files are recorded and files are listed by location, files without one being local.
+func TestFileLocations(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	s3 := metadata.Location{Scheme: "s3", Bucket: "photos", Endpoint: "s3.example.com"}
+	conditions := []struct {
+		name     string
+		location metadata.Location
+		expected metadata.Location
+	}{
+		{"locationNone.jpg", metadata.Location{}, metadata.Location{}},
+		{"locationFile.jpg", metadata.Location{Scheme: metadata.LocalScheme, Bucket: "ignored"}, metadata.Location{}},
+		{"locationS3.jpg", s3, s3},
+		{"locationDrive.jpg", metadata.Location{Scheme: "gdrive"}, metadata.Location{Scheme: "gdrive"}},
+	}
+	for _, condition := range conditions {
+		file, _ := CreateFileInPath(db, condition.name, "/locations", nil)
+		if err := SetFileLocation(db, file.Id, condition.location); err != nil {
+			t.Errorf("Could not set the location of %s: %v", condition.name, err)
+		}
+		if found, err := GetFileLocation(db, file.Id); err != nil || found != condition.expected {
+			t.Errorf("Expected %s to be kept in %v but got %v (%v)", condition.name, condition.expected, found, err)
+		}
+	}
+	listings := []struct {
+		location metadata.Location
+		expected int
+	}{
+		{metadata.Location{}, 2},
+		{s3, 1},
+		{metadata.Location{Scheme: "s3", Bucket: "photos"}, 0},
+		{metadata.Location{Scheme: "gdrive"}, 1},
+	}
+	for _, listing := range listings {
+		files, err := GetFilesInLocation(db, listing.location, "location*")
+		if err != nil || len(files) != listing.expected {
+			t.Errorf("Expected %d files in %v but got %v (%v)", listing.expected, listing.location, files, err)
+		}
+	}
+	if location, _ := GetFileLocation(db, -1); location != (metadata.Location{}) {
+		t.Errorf("Expected files that aren't recorded to be local but got %v", location)
+	}
+}
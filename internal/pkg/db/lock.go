@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// Takes an exclusive advisory lock on the database file, waiting for any other holder to release it. Processes making
+// many changes at once (such as the indexer) hold it so only one of them writes at a time; SQLite's own locking still
+// protects every other access. The returned function releases the lock.
+func LockExclusive(filename string) (func() error, error) {
+	file, err := os.OpenFile(filename+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() error {
+		syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+		return file.Close()
+	}, nil
+}
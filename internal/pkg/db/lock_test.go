@@ -0,0 +1,50 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Verifies a second holder of the lock waits for the first to release it.
+func TestLockExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "locked.db")
+	unlock, err := LockExclusive(filename)
+	if err != nil {
+		t.Errorf("Could not take the lock: %v", err)
+		return
+	}
+	acquired := make(chan bool)
+	go func() {
+		unlockSecond, err := LockExclusive(filename)
+		if err == nil {
+			unlockSecond()
+		}
+		acquired <- err == nil
+	}()
+	select {
+	case <-acquired:
+		t.Error("Expected the second lock to wait for the first to be released")
+	case <-time.After(100 * time.Millisecond):
+	}
+	unlock()
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Error("Could not take the lock once released")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the second lock to be taken once the first was released")
+	}
+}
@@ -0,0 +1,6 @@
+package db
+
+// Advisory locks are not supported on Windows; SQLite's own locking still protects every access.
+func LockExclusive(filename string) (func() error, error) {
+	return func() error { return nil }, nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets the durations of operations are counted in; slower calls go in a last bucket.
+var LatencyBuckets = []time.Duration{time.Millisecond, 5 * time.Millisecond, 25 * time.Millisecond,
+	100 * time.Millisecond, 500 * time.Millisecond, 2500 * time.Millisecond}
+
+// How often an operation on the database was run and how long it took, to tell which one makes listings slow.
+type OperationStats struct {
+	Calls int64
+	// time spent in all the calls
+	Total time.Duration
+	// time taken by the slowest call
+	Max time.Duration
+	// number of calls that took at most the matching bound of LatencyBuckets, the last counting the slower ones
+	Buckets []int64
+}
+
+// Average time taken by a call, 0 if there were none.
+func (s OperationStats) Mean() time.Duration {
+	if s.Calls == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Calls)
+}
+
+// The stats of an operation, published with expvar.
+type operationMetrics struct {
+	sync.Mutex
+	stats OperationStats
+}
+
+// Writes the stats as JSON, with durations in milliseconds, for expvar.
+func (m *operationMetrics) String() string {
+	stats := m.snapshot()
+	encoded, _ := json.Marshal(struct {
+		Calls   int64   `json:"calls"`
+		TotalMs float64 `json:"total_ms"`
+		MaxMs   float64 `json:"max_ms"`
+		Buckets []int64 `json:"buckets"`
+	}{stats.Calls, milliseconds(stats.Total), milliseconds(stats.Max), stats.Buckets})
+	return string(encoded)
+}
+
+func (m *operationMetrics) snapshot() OperationStats {
+	m.Lock()
+	defer m.Unlock()
+	stats := m.stats
+	stats.Buckets = append([]int64(nil), m.stats.Buckets...)
+	return stats
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Timings of the operations run on databases, by operation (the name of the function without Context), published as
+// the cotfs_db expvar variable so programs serving /debug/vars expose them.
+var metrics = struct {
+	sync.Mutex
+	operations map[string]*operationMetrics
+	published  *expvar.Map
+}{operations: make(map[string]*operationMetrics), published: expvar.NewMap("cotfs_db")}
+
+// Records a call to an operation that started at the time passed in, i.e. defer observe("FindTag", time.Now()).
+func observe(operation string, start time.Time) {
+	elapsed := time.Since(start)
+	metrics.Lock()
+	m, ok := metrics.operations[operation]
+	if !ok {
+		m = &operationMetrics{stats: OperationStats{Buckets: make([]int64, len(LatencyBuckets)+1)}}
+		metrics.operations[operation] = m
+		metrics.published.Set(operation, m)
+	}
+	metrics.Unlock()
+	bucket := sort.Search(len(LatencyBuckets), func(i int) bool { return elapsed <= LatencyBuckets[i] })
+	m.Lock()
+	m.stats.Calls++
+	m.stats.Total += elapsed
+	if elapsed > m.stats.Max {
+		m.stats.Max = elapsed
+	}
+	m.stats.Buckets[bucket]++
+	m.Unlock()
+}
+
+// Returns the timings of the operations run so far in this process, by operation.
+func Metrics() map[string]OperationStats {
+	metrics.Lock()
+	defer metrics.Unlock()
+	snapshot := make(map[string]OperationStats, len(metrics.operations))
+	for operation, m := range metrics.operations {
+		snapshot[operation] = m.snapshot()
+	}
+	return snapshot
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+)
+
+// Verifies the calls to an operation are counted and timed, and published with expvar.
+func TestMetrics(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	AddTag(db, "timedTag", nil)
+	before := Metrics()["FindTag"]
+	calls := 5
+	for i := 0; i < calls; i++ {
+		FindTag(db, "timedTag")
+	}
+	stats := Metrics()["FindTag"]
+	if stats.Calls != before.Calls+int64(calls) || stats.Total < before.Total || stats.Max <= 0 {
+		t.Errorf("Expected %d more timed calls than %+v but got %+v", calls, before, stats)
+	}
+	var bucketed int64
+	for _, count := range stats.Buckets {
+		bucketed += count
+	}
+	if len(stats.Buckets) != len(LatencyBuckets)+1 || bucketed != stats.Calls {
+		t.Errorf("Expected every call to be in one of %d buckets but got %v", len(LatencyBuckets)+1, stats.Buckets)
+	}
+	published := expvar.Get("cotfs_db").(*expvar.Map).Get("FindTag")
+	var decoded struct {
+		Calls int64 `json:"calls"`
+	}
+	if published == nil || json.Unmarshal([]byte(published.String()), &decoded) != nil || decoded.Calls < stats.Calls {
+		t.Errorf("Expected the timings to be published but got %v", published)
+	}
+}
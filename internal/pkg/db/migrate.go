@@ -0,0 +1,285 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// A change to the schema of the metadata database.
+type Migration struct {
+	// position of the change in the list of migrations, starting at 1
+	Version int
+	// what the change does, as reported by PendingMigrations
+	Description string
+	apply       func(tx *sql.Tx) error
+}
+
+// Changes made to the schema, in the order they are applied. Each database records the version of the last one applied
+// to it in the schema_version table and gets the ones after it when opened, so new changes must be appended with the
+// next version. Databases created before versions were recorded are at version 0 and may already have any of the
+// changes, so these must tolerate that.
+var migrations = []Migration{
+	{1, "create the tag and file tables", createTables},
+	// modification time of the file in seconds since the epoch
+	{2, "add file_md.mtime", addColumn("file_md", "mtime", "INTEGER")},
+	// owner and permission bits, see SetPermissions
+	{3, "add file_md.uid", addColumn("file_md", "uid", "INTEGER")},
+	{4, "add file_md.gid", addColumn("file_md", "gid", "INTEGER")},
+	{5, "add file_md.mode", addColumn("file_md", "mode", "INTEGER")},
+	{6, "add tag.uid", addColumn("tag", "uid", "INTEGER")},
+	{7, "add tag.gid", addColumn("tag", "gid", "INTEGER")},
+	{8, "add tag.mode", addColumn("tag", "mode", "INTEGER")},
+	// size of the file in bytes, see SetFileStat
+	{9, "add file_md.size", addColumn("file_md", "size", "INTEGER")},
+	// time the file was last opened through the mount in seconds since the epoch, see SetFileAccessTimes
+	{10, "add file_md.atime", addColumn("file_md", "atime", "INTEGER")},
+	{11, "add foreign keys to file_tags and tag_assoc", addForeignKeys},
+	// SHA-256 of the content in hex and MIME type of the file, see SetFileDetails
+	{12, "add file_md.checksum", addColumn("file_md", "checksum", "TEXT")},
+	{13, "add file_md.mime", addColumn("file_md", "mime", "TEXT")},
+	{14, "index file_md.checksum", createIndex("CREATE INDEX IF NOT EXISTS file_checksum_idx ON file_md(checksum)")},
+	// time the query was first saved in seconds since the epoch, see SaveQuery
+	{15, "add saved_query.created", addColumn("saved_query", "created", "INTEGER")},
+	// log of the changes to files and their tags, see GetHistory
+	{16, "create the history table", createHistory},
+	// one record per file on disk, see UpsertFile
+	{17, "make file_md names unique within their path", dedupFiles},
+	// key=value attributes of files, see SetFileAttribute
+	{18, "create the file_attr table", createFileAttributes},
+	// rating from 1 to MaxRating and favorite flag of the file, see SetFileRating and SetFavorite
+	{19, "add file_md.rating", addColumn("file_md", "rating", "INTEGER")},
+	{20, "add file_md.favorite", addColumn("file_md", "favorite", "INTEGER")},
+	// runs of the indexer and the ones that created and last updated each file, see StartIndexRun
+	{21, "create the index_run table", createIndexRuns},
+	{22, "add file_md.created_run", addColumn("file_md", "created_run", "INTEGER")},
+	{23, "add file_md.updated_run", addColumn("file_md", "updated_run", "INTEGER")},
+	{24, "index file_md.created_run",
+		createIndex("CREATE INDEX IF NOT EXISTS file_created_run_idx ON file_md(created_run)")},
+	{25, "index file_md.updated_run",
+		createIndex("CREATE INDEX IF NOT EXISTS file_updated_run_idx ON file_md(updated_run)")},
+	// where files that aren't on local disk are kept, see SetFileLocation
+	{26, "add file_md.scheme", addColumn("file_md", "scheme", "TEXT")},
+	{27, "add file_md.bucket", addColumn("file_md", "bucket", "TEXT")},
+	{28, "add file_md.endpoint", addColumn("file_md", "endpoint", "TEXT")},
+	// tag_assoc's primary key only finds the tags associated with a tag by its smaller id, this finds them by the larger
+	{29, "index tag_assoc by t2", createIndex("CREATE INDEX IF NOT EXISTS tag_assoc_t2_idx ON tag_assoc(t2, t1)")},
+}
+
+var ddl = []string{
+	"CREATE TABLE IF NOT EXISTS tag(id INTEGER PRIMARY KEY, txt text);",
+	"CREATE TABLE IF NOT EXISTS file_md(id INTEGER PRIMARY KEY, name text, path text);",
+	"CREATE TABLE IF NOT EXISTS file_tags(fid INTEGER, tid INTEGER, PRIMARY KEY (fid,tid));",
+	"CREATE TABLE IF NOT EXISTS tag_assoc(t1 INTEGER, t2 INTEGER, PRIMARY KEY (t1,t2));",
+	"CREATE TABLE IF NOT EXISTS tag_alias(alias text PRIMARY KEY, tid INTEGER);",
+	"CREATE TABLE IF NOT EXISTS tag_parent(parent INTEGER, child INTEGER, PRIMARY KEY (parent,child));",
+	"CREATE TABLE IF NOT EXISTS saved_query(name text PRIMARY KEY, expr text, pattern text);",
+	"CREATE TABLE IF NOT EXISTS tag_acl(tid INTEGER, uid INTEGER, PRIMARY KEY (tid,uid));",
+	"CREATE TABLE IF NOT EXISTS trash(fid INTEGER, tid INTEGER, deleted INTEGER, PRIMARY KEY (fid,tid));",
+	"CREATE UNIQUE INDEX IF NOT EXISTS tag_idx ON tag(txt);"}
+
+// Creates the tables the schema started with.
+func createTables(tx *sql.Tx) error {
+	for _, statement := range ddl {
+		if _, err := tx.Exec(statement); err != nil {
+			log.Printf("%q: %s\n", err, statement)
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns a migration adding a column to a table unless the table already has it.
+func addColumn(table string, column string, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		var count int
+		err := tx.QueryRow(fmt.Sprintf("SELECT count(*) FROM pragma_table_info('%s') WHERE name = ?", table),
+			column).Scan(&count)
+		if err != nil || count > 0 {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+		return err
+	}
+}
+
+// Returns a migration running a statement creating an index.
+func createIndex(statement string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statement)
+		return err
+	}
+}
+
+// Rebuilds the tables linking files and tags with references to the rows they link, since SQLite can't add constraints
+// to existing tables. Links to files or tags that no longer exist are dropped.
+func addForeignKeys(tx *sql.Tx) error {
+	for _, statement := range []string{
+		"CREATE TABLE file_tags_rebuilt(fid INTEGER REFERENCES file_md(id), tid INTEGER REFERENCES tag(id), " +
+			"PRIMARY KEY (fid,tid));",
+		"INSERT INTO file_tags_rebuilt SELECT fid, tid FROM file_tags " +
+			"WHERE fid IN (SELECT id FROM file_md) AND tid IN (SELECT id FROM tag)",
+		"DROP TABLE file_tags",
+		"ALTER TABLE file_tags_rebuilt RENAME TO file_tags",
+		"CREATE TABLE tag_assoc_rebuilt(t1 INTEGER REFERENCES tag(id), t2 INTEGER REFERENCES tag(id), " +
+			"PRIMARY KEY (t1,t2));",
+		"INSERT INTO tag_assoc_rebuilt SELECT t1, t2 FROM tag_assoc " +
+			"WHERE t1 IN (SELECT id FROM tag) AND t2 IN (SELECT id FROM tag)",
+		"DROP TABLE tag_assoc",
+		"ALTER TABLE tag_assoc_rebuilt RENAME TO tag_assoc",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Merges the records of files sharing a name and path into the oldest one, which gets the tags (and trashed tags) of
+// the others, then makes such records unique so there can't be more.
+func dedupFiles(tx *sql.Tx) error {
+	for _, statement := range []string{
+		"CREATE TEMP TABLE file_dups AS SELECT f.id AS id, k.id AS keep FROM file_md f, " +
+			"(SELECT min(id) AS id, name, path FROM file_md GROUP BY name, path HAVING count(*) > 1) k " +
+			"WHERE f.name = k.name AND f.path = k.path AND f.id <> k.id",
+		"INSERT OR IGNORE INTO file_tags (fid, tid) SELECT d.keep, ft.tid FROM file_tags ft, file_dups d " +
+			"WHERE ft.fid = d.id",
+		"INSERT OR IGNORE INTO trash (fid, tid, deleted) SELECT d.keep, t.tid, t.deleted FROM trash t, file_dups d " +
+			"WHERE t.fid = d.id",
+		"DELETE FROM file_tags WHERE fid IN (SELECT id FROM file_dups)",
+		"DELETE FROM trash WHERE fid IN (SELECT id FROM file_dups)",
+		"DELETE FROM file_md WHERE id IN (SELECT id FROM file_dups)",
+		"DROP TABLE file_dups",
+		"CREATE UNIQUE INDEX IF NOT EXISTS file_name_path_idx ON file_md(name, path)",
+	} {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Either a database or a transaction on one.
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Returns the version of the last migration applied to a database, 0 if none were recorded.
+func schemaVersion(db rowQuerier) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT coalesce(max(version), 0) FROM schema_version").Scan(&version)
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Returns the migrations a database at the version passed in doesn't have. Databases migrated by a later version of
+// the code don't get any.
+func migrationsAfter(version int) []Migration {
+	if version >= len(migrations) {
+		return nil
+	}
+	return migrations[version:]
+}
+
+// Lists the migrations opening a database would apply, without changing the database (or creating it if it doesn't
+// exist).
+func PendingMigrations(filename string) ([]Migration, error) {
+	return PendingMigrationsWithOptions(filename, OpenOptions{})
+}
+
+// Same as PendingMigrations but opens the database with the key of the options, so the migrations of encrypted
+// databases can be listed too. The other options are left out since they may change the database.
+func PendingMigrationsWithOptions(filename string, options OpenOptions) ([]Migration, error) {
+	if _, err := os.Stat(databasePath(filename)); os.IsNotExist(err) {
+		return migrations, nil
+	}
+	keyParams, err := options.keyParams()
+	if err != nil {
+		return nil, err
+	}
+	if keyParams != "" {
+		filename = withParams(filename, keyParams)
+	}
+	db, err := sql.Open(driverName(""), filename)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	return migrationsAfter(version), nil
+}
+
+// Applies the migrations a database doesn't have yet, all in one transaction so a failure leaves it as it was. If
+// backup is set, an existing database is first copied next to the file it is in; see backupDatabase.
+func migrate(db *sql.DB, filename string, backup bool) error {
+	version, err := schemaVersion(db)
+	if err != nil || version >= len(migrations) {
+		return err
+	}
+	if backup {
+		if err = backupDatabase(db, filename, version); err != nil {
+			return err
+		}
+	}
+	return inTx(context.Background(), db, func(tx *sql.Tx) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS schema_version(version INTEGER NOT NULL)")
+		if err != nil {
+			return err
+		}
+		// another process may have migrated the database in the meantime
+		version, err := schemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		pending := migrationsAfter(version)
+		if len(pending) == 0 {
+			return nil
+		}
+		for _, migration := range pending {
+			if err = migration.apply(tx); err != nil {
+				return fmt.Errorf("could not %s: %v", migration.Description, err)
+			}
+		}
+		if _, err = tx.Exec("DELETE FROM schema_version"); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO schema_version VALUES (?)", len(migrations))
+		return err
+	})
+}
+
+// Copies a database about to be migrated from the version passed in to <file>.v<version>-<time>.bak. Databases
+// without any tables yet and in-memory databases aren't copied.
+func backupDatabase(db *sql.DB, filename string, version int) error {
+	path := databasePath(filename)
+	if path == "" || strings.Contains(filename, "mode=memory") {
+		return nil
+	}
+	tables, err := countRows(db, "SELECT count(*) FROM sqlite_master WHERE type = 'table'")
+	if err != nil || tables == 0 {
+		return err
+	}
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", path, version, time.Now().Format("20060102150405"))
+	log.Printf("backing up %s to %s before migrating it", path, backupPath)
+	_, err = db.Exec("VACUUM INTO ?", backupPath)
+	return err
+}
+
+// Returns the path of the file a database name passed to Open refers to, without any URI prefix or parameters. Returns
+// an empty string for in-memory databases.
+func databasePath(filename string) string {
+	path := strings.TrimPrefix(strings.SplitN(filename, "?", 2)[0], "file:")
+	if path == "" || path == ":memory:" {
+		return ""
+	}
+	return path
+}
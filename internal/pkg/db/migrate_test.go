@@ -0,0 +1,257 @@
+package db
+
+import (
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies migrations are numbered in the order they are applied.
+func TestMigrationVersions(t *testing.T) {
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("Expected migration %q to have version %d but it has %d", migration.Description, i+1,
+				migration.Version)
+		}
+	}
+}
+
+// Verifies the pending migrations are listed without changing the database and applied when it is opened.
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := createOldDatabase(t, filepath.Join(dir, "old.db"))
+	future := createOldDatabase(t, filepath.Join(dir, "future.db"))
+	futureDb, _ := Open(future)
+	_, _ = futureDb.Exec("UPDATE schema_version SET version = ?", len(migrations)+5)
+	futureDb.Close()
+	conditions := []struct {
+		filename        string
+		pending         int
+		expectedVersion int
+	}{
+		{filepath.Join(dir, "new.db"), len(migrations), len(migrations)},
+		{old, len(migrations), len(migrations)},
+		{future, 0, len(migrations) + 5},
+	}
+	for _, condition := range conditions {
+		pending, err := PendingMigrations(condition.filename)
+		if err != nil || len(pending) != condition.pending {
+			t.Errorf("Expected %d pending migrations for %s but got %d (%v)", condition.pending,
+				condition.filename, len(pending), err)
+		}
+		// listing them must not migrate (or create) the database
+		pending, _ = PendingMigrations(condition.filename)
+		if len(pending) != condition.pending {
+			t.Errorf("Expected listing the migrations of %s to leave them pending", condition.filename)
+		}
+		db, err := Open(condition.filename)
+		if err != nil {
+			t.Errorf("Could not open %s: %v", condition.filename, err)
+			continue
+		}
+		version, err := schemaVersion(db)
+		if err != nil || version != condition.expectedVersion {
+			t.Errorf("Expected %s to be at version %d but got %d (%v)", condition.filename,
+				condition.expectedVersion, version, err)
+		}
+		db.Close()
+		if pending, _ = PendingMigrations(condition.filename); len(pending) != 0 {
+			t.Errorf("Expected no pending migrations for %s after opening it", condition.filename)
+		}
+	}
+}
+
+// Verifies the pending migrations of an encrypted database are listed with its key, and that builds without SQLCipher
+// refuse keys.
+func TestPendingMigrationsEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "encrypted.db")
+	if !encryptionSupported {
+		db, _ := Open(filename)
+		Close(db)
+		if _, err = PendingMigrationsWithOptions(filename, OpenOptions{Key: "secret"}); err != ErrEncryptionUnsupported {
+			t.Errorf("Expected listing with a key to be refused but got %v", err)
+		}
+		return
+	}
+	db, err := OpenWithOptions(filename, OpenOptions{Key: "secret"})
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	Close(db)
+	conditions := []struct {
+		key       string
+		expectErr bool
+	}{
+		{"secret", false},
+		{"wrong", true},
+	}
+	for _, condition := range conditions {
+		pending, err := PendingMigrationsWithOptions(filename, OpenOptions{Key: condition.key})
+		if (err != nil) != condition.expectErr || (err == nil && len(pending) != 0) {
+			t.Errorf("Expected listing with key %q to fail: %t but got %d migrations (%v)", condition.key,
+				condition.expectErr, len(pending), err)
+		}
+	}
+}
+
+// Verifies a database is copied before it is migrated when asked to, and only when there is something to migrate.
+func TestOpenBacksUpBeforeMigrating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := createOldDatabase(t, filepath.Join(dir, "old.db"))
+	for i := 0; i < 2; i++ {
+		db, err := OpenWithOptions(old, OpenOptions{BackupBeforeMigrate: true})
+		if err != nil {
+			t.Fatalf("Could not open database: %v", err)
+		}
+		db.Close()
+	}
+	backups, _ := filepath.Glob(filepath.Join(dir, "old.db.v0-*.bak"))
+	if len(backups) != 1 {
+		t.Fatalf("Expected one backup but found %v", backups)
+	}
+	backup, err := sql.Open(sqliteDriver, backups[0])
+	if err != nil {
+		t.Fatalf("Could not open backup: %v", err)
+	}
+	defer backup.Close()
+	files, err := countRows(backup, "SELECT count(*) FROM file_md")
+	if err != nil || files != 1 {
+		t.Errorf("Expected the backup to have the file of the database but got %d (%v)", files, err)
+	}
+	columns, _ := countRows(backup, "SELECT count(*) FROM pragma_table_info('file_md') WHERE name = 'mtime'")
+	if columns != 0 {
+		t.Errorf("Expected the backup to be taken before migrating")
+	}
+	// new databases have nothing worth keeping
+	db, err := OpenWithOptions(filepath.Join(dir, "new.db"), OpenOptions{BackupBeforeMigrate: true})
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	db.Close()
+	if backups, _ = filepath.Glob(filepath.Join(dir, "new.db.*.bak")); len(backups) != 0 {
+		t.Errorf("Expected no backup of a new database but found %v", backups)
+	}
+}
+
+// Verifies links to missing files and tags are dropped when foreign keys are added, and refused afterwards.
+func TestAddForeignKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := createOldDatabase(t, filepath.Join(dir, "old.db"))
+	oldDb, _ := sql.Open(sqliteDriver, old)
+	for _, statement := range []string{
+		"CREATE TABLE tag(id INTEGER PRIMARY KEY, txt text);",
+		"CREATE TABLE file_tags(fid INTEGER, tid INTEGER, PRIMARY KEY (fid,tid));",
+		"CREATE TABLE tag_assoc(t1 INTEGER, t2 INTEGER, PRIMARY KEY (t1,t2));",
+		"INSERT INTO tag VALUES (1, 'one'), (2, 'two')",
+		"INSERT INTO file_tags VALUES (1, 1), (1, 5), (7, 2)",
+		"INSERT INTO tag_assoc VALUES (1, 2), (0, 1)",
+	} {
+		if _, err = oldDb.Exec(statement); err != nil {
+			t.Fatalf("Could not set up database: %v", err)
+		}
+	}
+	oldDb.Close()
+	db, err := Open(old)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	conditions := []struct {
+		query    string
+		expected int
+	}{
+		{"SELECT count(*) FROM file_tags", 1},
+		{"SELECT count(*) FROM file_tags WHERE fid = 1 AND tid = 1", 1},
+		{"SELECT count(*) FROM tag_assoc", 1},
+		{"SELECT count(*) FROM tag_assoc WHERE t1 = 1 AND t2 = 2", 1},
+	}
+	for _, condition := range conditions {
+		if count, err := countRows(db, condition.query); err != nil || count != condition.expected {
+			t.Errorf("Expected %d for %s but got %d (%v)", condition.expected, condition.query, count, err)
+		}
+	}
+	if err = TagFile(db, 1, []metadata.TagInfo{{Id: 9, Text: "missing"}}); err == nil {
+		t.Error("Expected tagging a file with a missing tag to be refused")
+	}
+}
+
+// Verifies records of the same file are merged into the oldest one, and refused afterwards.
+func TestDedupFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	old := createOldDatabase(t, filepath.Join(dir, "old.db"))
+	oldDb, _ := sql.Open(sqliteDriver, old)
+	for _, statement := range []string{
+		"CREATE TABLE tag(id INTEGER PRIMARY KEY, txt text);",
+		"CREATE TABLE file_tags(fid INTEGER, tid INTEGER, PRIMARY KEY (fid,tid));",
+		"CREATE TABLE trash(fid INTEGER, tid INTEGER, deleted INTEGER, PRIMARY KEY (fid,tid));",
+		"INSERT INTO file_md VALUES (2, 'one', 'path'), (3, 'two', 'path'), (4, 'one', 'other'), (5, 'one', 'path')",
+		"INSERT INTO tag VALUES (1, 'a'), (2, 'b'), (3, 'c')",
+		"INSERT INTO file_tags VALUES (1, 1), (2, 1), (2, 2), (4, 2), (5, 1)",
+		"INSERT INTO trash VALUES (5, 3, 100)",
+	} {
+		if _, err = oldDb.Exec(statement); err != nil {
+			t.Fatalf("Could not set up database: %v", err)
+		}
+	}
+	oldDb.Close()
+	db, err := Open(old)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer db.Close()
+	conditions := []struct {
+		query    string
+		expected int
+	}{
+		{"SELECT count(*) FROM file_md", 3},
+		{"SELECT count(*) FROM file_md WHERE id IN (2, 5)", 0},
+		{"SELECT count(*) FROM file_tags WHERE fid = 1", 2},
+		{"SELECT count(*) FROM file_tags WHERE fid = 4", 1},
+		{"SELECT count(*) FROM file_tags", 3},
+		{"SELECT count(*) FROM trash WHERE fid = 1 AND tid = 3", 1},
+	}
+	for _, condition := range conditions {
+		if count, err := countRows(db, condition.query); err != nil || count != condition.expected {
+			t.Errorf("Expected %d for %s but got %d (%v)", condition.expected, condition.query, count, err)
+		}
+	}
+	if _, err = CreateFileInPath(db, "one", "path", nil); err == nil {
+		t.Error("Expected creating a second record of a file to be refused")
+	}
+}
+
+// Helper creating a database the way it was before versions were recorded, with a single file. Returns its name.
+func createOldDatabase(t *testing.T, filename string) string {
+	old, err := sql.Open(sqliteDriver, filename)
+	if err != nil {
+		t.Fatalf("Could not create database: %v", err)
+	}
+	defer old.Close()
+	_, _ = old.Exec("CREATE TABLE file_md(id INTEGER PRIMARY KEY, name text, path text);")
+	_, _ = old.Exec("INSERT INTO file_md (name, path) VALUES ('one', 'path')")
+	return filename
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// What CollectOrphanFiles does with the files left without tags.
+type OrphanPolicy int
+
+const (
+	// tags them with the fallback tag so they can still be reached through the mount
+	TagOrphans OrphanPolicy = iota
+	// deletes their records, forgetting about the files (which are left in the storage)
+	DeleteOrphans
+)
+
+// Condition selecting the files (aliased as f) that have no tags. Files in the trash have the trash tag so they are
+// never orphaned.
+const orphanCondition = "f.id NOT IN (SELECT fid FROM file_tags)"
+
+// Finds the files left without any tag, e.g. by removing their last tag, and either tags them with the fallback tag
+// (created if needed) or deletes their records depending on the policy. Returns the number of files collected.
+func CollectOrphanFiles(db *sql.DB, policy OrphanPolicy, fallback string) (int, error) {
+	return CollectOrphanFilesContext(context.Background(), db, policy, fallback)
+}
+
+func CollectOrphanFilesContext(ctx context.Context, db *sql.DB, policy OrphanPolicy, fallback string) (int, error) {
+	var collected int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var statement string
+		var params []interface{}
+		switch policy {
+		case TagOrphans:
+			fallbackTag, err := findOrInsertTag(ctx, tx, fallback)
+			if err != nil {
+				return err
+			}
+			statement = "INSERT INTO file_tags (fid, tid) SELECT f.id, ? FROM file_md f WHERE " + orphanCondition
+			params = []interface{}{fallbackTag.Id}
+		case DeleteOrphans:
+			statement = "DELETE FROM file_md WHERE id IN (SELECT f.id FROM file_md f WHERE " + orphanCondition + ")"
+		default:
+			return fmt.Errorf("unknown orphan policy %d", policy)
+		}
+		res, err := tx.ExecContext(ctx, statement, params...)
+		if err != nil {
+			return err
+		}
+		collected, err = res.RowsAffected()
+		return err
+	})
+	return int(collected), err
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies files left without tags are either tagged with the fallback tag or deleted, leaving other files alone.
+func TestCollectOrphanFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Errorf("Could not create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	conditions := []struct {
+		policy           OrphanPolicy
+		expectedFileTags []string
+		expectedErr      bool
+	}{
+		{TagOrphans, []string{"[{1 kept}]", "[{2 fallback}]", "[{2 fallback}]"}, false},
+		{DeleteOrphans, []string{"[{1 kept}]", "[]", "[]"}, false},
+		{OrphanPolicy(42), []string{"[{1 kept}]", "[]", "[]"}, true},
+	}
+	for i, condition := range conditions {
+		db, err := Open(filepath.Join(dir, fmt.Sprintf("%d.db", i)))
+		if err != nil {
+			t.Errorf("Could not open database: %v", err)
+			continue
+		}
+		tags, _ := AddTags(db, []string{"kept"}, nil)
+		kept, _ := CreateFileInPath(db, "kept", "orphanPath", tags)
+		untagged, _ := CreateFileInPath(db, "untagged", "orphanPath", nil)
+		emptied, _ := CreateFileInPath(db, "emptied", "orphanPath", tags)
+		UntagFile(db, emptied.Id, tags[0].Id)
+
+		collected, err := CollectOrphanFiles(db, condition.policy, "fallback")
+		if (err != nil) != condition.expectedErr || (err == nil && collected != 2) {
+			t.Errorf("Expected 2 files collected with policy %d but got %d (%v)", condition.policy, collected, err)
+		}
+		for j, file := range []metadata.FileInfo{kept, untagged, emptied} {
+			fileTags, _ := GetTagsForFile(db, file.Id)
+			if fmt.Sprint(fileTags) != condition.expectedFileTags[j] {
+				t.Errorf("Expected %s to have tags %s with policy %d but got %v", file.Name,
+					condition.expectedFileTags[j], condition.policy, fileTags)
+			}
+		}
+		remaining, _ := CountFilesWithTags(db, nil, "")
+		expectedRemaining := 3
+		if condition.policy == DeleteOrphans {
+			expectedRemaining = 1
+		}
+		if remaining != expectedRemaining {
+			t.Errorf("Expected %d files left with policy %d but got %d", expectedRemaining, condition.policy,
+				remaining)
+		}
+		Close(db)
+	}
+}
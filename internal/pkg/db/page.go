@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"strings"
+	"time"
+)
+
+// A slice of the results of a listing, for paging through result sets too large to load at once. Paged results are
+// ordered (files as set by Order, tags by text) so consecutive pages neither overlap nor skip results.
+type Page struct {
+	// most results to return, 0 for all the results after the offset
+	Limit int
+	// number of results skipped before the first one returned
+	Offset int
+	// order of paged files, by name if not set
+	Order FileOrder
+}
+
+// Orders in which paged files can be listed. Files sharing the value ordered by are ordered by name then id.
+type FileOrder int
+
+const (
+	// by name then id
+	ByName FileOrder = iota
+	// largest first, files without a recorded size last
+	BySize
+	// most recently modified first, files without a recorded modification time last
+	ByModTime
+	// in the order they were added
+	ById
+)
+
+// Columns of file_md (aliased as f) ordering files in each FileOrder.
+var fileOrderClauses = map[FileOrder]string{
+	ByName:    " ORDER BY f.name ASC, f.id ASC",
+	BySize:    " ORDER BY f.size DESC, f.name ASC, f.id ASC",
+	ByModTime: " ORDER BY f.mtime DESC, f.name ASC, f.id ASC",
+	ById:      " ORDER BY f.id ASC",
+}
+
+// Returns the clause selecting the page from ordered results, and its parameters.
+func (p Page) clause() (string, []interface{}) {
+	limit := p.Limit
+	if limit <= 0 {
+		// SQLite only takes an offset after a limit; a negative limit means there is none
+		limit = -1
+	}
+	return " LIMIT ? OFFSET ?", []interface{}{limit, p.Offset}
+}
+
+// Lists a page of the files that have ALL the tags passed in, optionally filtered by name (if name has a length of > 0)
+// Name can also contain 0 or more wildcards characters (*). No tags selects every file.
+func GetFilesWithTagsPage(db *sql.DB, tags []metadata.TagInfo, name string, page Page) ([]metadata.FileInfo, error) {
+	return GetFilesWithTagsPageContext(context.Background(), db, tags, name, page)
+}
+
+func GetFilesWithTagsPageContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo, name string,
+	page Page) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesWithTagsPage", time.Now())
+	conditions, params := filterConditions(TagFilter{Tags: tags}, name)
+	limit, limitParams := page.clause()
+	order, ok := fileOrderClauses[page.Order]
+	if !ok {
+		return nil, fmt.Errorf("unknown file order %d", page.Order)
+	}
+	query := "SELECT f.id, f.name, f.path FROM file_md f" + whereClause(conditions) + order + limit
+	return queryFiles(ctx, db, query, append(params, limitParams...)...)
+}
+
+// Counts the files GetFilesWithTags (and GetFilesWithTagsPage) lists for the same tags and name, without loading them.
+func CountFilesWithTags(db *sql.DB, tags []metadata.TagInfo, name string) (int, error) {
+	return CountFilesWithTagsContext(context.Background(), db, tags, name)
+}
+
+func CountFilesWithTagsContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo, name string) (int, error) {
+	defer observe("CountFilesWithTags", time.Now())
+	conditions, params := filterConditions(TagFilter{Tags: tags}, name)
+	return countRowsContext(ctx, db, "SELECT count(*) FROM file_md f"+whereClause(conditions), params...)
+}
+
+// Lists a page of the tags that co-occur with ALL the tags passed in, optionally filtered by name. No tags selects every
+// tag.
+func GetCoincidentTagsPage(db *sql.DB, tags []metadata.TagInfo, name string, page Page) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsPageContext(context.Background(), db, tags, name, page)
+}
+
+func GetCoincidentTagsPageContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo, name string,
+	page Page) ([]metadata.TagInfo, error) {
+	defer observe("GetCoincidentTagsPage", time.Now())
+	conditions, params := coincidentTagConditions(TagFilter{Tags: tags}, name)
+	limit, limitParams := page.clause()
+	query := "SELECT ot.id, ot.txt FROM tag ot" + whereClause(conditions) + " ORDER BY ot.txt ASC" + limit
+	return queryTags(ctx, db, query, append(params, limitParams...)...)
+}
+
+// Counts the tags GetCoincidentTagsPage pages through.
+func CountCoincidentTags(db *sql.DB, tags []metadata.TagInfo, name string) (int, error) {
+	return CountCoincidentTagsContext(context.Background(), db, tags, name)
+}
+
+func CountCoincidentTagsContext(ctx context.Context, db *sql.DB, tags []metadata.TagInfo, name string) (int, error) {
+	defer observe("CountCoincidentTags", time.Now())
+	conditions, params := coincidentTagConditions(TagFilter{Tags: tags}, name)
+	return countRowsContext(ctx, db, "SELECT count(*) FROM tag ot"+whereClause(conditions), params...)
+}
+
+// Joins conditions into a where clause, which is empty if there are none.
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+	"time"
+)
+
+// Verifies pages of files are ordered by name and together hold every file counted.
+func TestGetFilesWithTagsPage(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "page", 2)
+	if err != nil {
+		t.Fatalf("Could not create tags: %v", err)
+	}
+	// created out of order to check pages are sorted
+	for i := 4; i >= 0; i-- {
+		file, err := CreateFileInPath(db, fmt.Sprintf("pageFile%d", i), "pagePath", tags)
+		if err != nil {
+			t.Fatalf("Could not create file: %v", err)
+		}
+		// the larger files are the older ones, and the last file has neither
+		if i < 4 {
+			SetFileStat(db, file.Id, int64(i), time.Unix(int64(1563100000-i), 0))
+		}
+	}
+	conditions := []struct {
+		name     string
+		page     Page
+		expected []string
+	}{
+		{"", Page{Limit: 2}, []string{"pageFile0", "pageFile1"}},
+		{"", Page{Limit: 2, Offset: 4}, []string{"pageFile4"}},
+		{"", Page{Offset: 3}, []string{"pageFile3", "pageFile4"}},
+		{"", Page{Limit: 2, Offset: 5}, nil},
+		{"pageFile3", Page{Limit: 2}, []string{"pageFile3"}},
+		{"pageFile9", Page{}, nil},
+		{"pageFile*", Page{Limit: 1, Offset: 1}, []string{"pageFile1"}},
+		{"", Page{Limit: 3, Order: BySize}, []string{"pageFile3", "pageFile2", "pageFile1"}},
+		{"", Page{Offset: 3, Order: BySize}, []string{"pageFile0", "pageFile4"}},
+		{"", Page{Limit: 2, Order: ByModTime}, []string{"pageFile0", "pageFile1"}},
+		{"", Page{Offset: 4, Order: ByModTime}, []string{"pageFile4"}},
+		{"", Page{Limit: 2, Order: ById}, []string{"pageFile4", "pageFile3"}},
+	}
+	for _, condition := range conditions {
+		files, err := GetFilesWithTagsPage(db, tags, condition.name, condition.page)
+		if err != nil {
+			t.Errorf("Could not list files: %v", err)
+			continue
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v for %+v named %q but got %v", condition.expected, condition.page, condition.name,
+				names)
+		}
+	}
+	countConditions := []struct {
+		tags     []metadata.TagInfo
+		name     string
+		expected int
+	}{
+		{tags, "", 5},
+		{tags[1:], "", 5},
+		{tags, "pageFile1", 1},
+		{tags, "missing*", 0},
+	}
+	for _, condition := range countConditions {
+		count, err := CountFilesWithTags(db, condition.tags, condition.name)
+		if err != nil || count != condition.expected {
+			t.Errorf("Expected %d files named %q but got %d (%v)", condition.expected, condition.name, count, err)
+		}
+	}
+}
+
+// Verifies files are listed in the order requested.
+func TestGetFilesWithTagsOrdered(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "ordered", 1)
+	if err != nil {
+		t.Fatalf("Could not create tags: %v", err)
+	}
+	// b is the largest and oldest, c has neither size nor modification time
+	for i, name := range []string{"orderedB", "orderedC", "orderedA"} {
+		file, _ := CreateFileInPath(db, name, "orderedPath", tags)
+		if name != "orderedC" {
+			SetFileStat(db, file.Id, int64(10-i), time.Unix(int64(1563100000+i), 0))
+		}
+	}
+	conditions := []struct {
+		order       FileOrder
+		expected    []string
+		expectedErr bool
+	}{
+		{ByName, []string{"orderedA", "orderedB", "orderedC"}, false},
+		{BySize, []string{"orderedB", "orderedA", "orderedC"}, false},
+		{ByModTime, []string{"orderedA", "orderedB", "orderedC"}, false},
+		{ById, []string{"orderedB", "orderedC", "orderedA"}, false},
+		{FileOrder(42), nil, true},
+	}
+	for _, condition := range conditions {
+		files, err := GetFilesWithTagsOrdered(db, tags, "ordered*", condition.order)
+		var names []string
+		for _, file := range files {
+			names = append(names, file.Name)
+		}
+		if (err != nil) != condition.expectedErr || fmt.Sprint(names) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v ordered by %d but got %v (%v)", condition.expected, condition.order, names, err)
+		}
+	}
+}
+
+// Verifies pages of co-occurring tags are ordered by text and together hold every tag counted.
+func TestGetCoincidentTagsPage(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "pageTag", 4)
+	if err != nil {
+		t.Fatalf("Could not create tags: %v", err)
+	}
+	conditions := []struct {
+		tags     []metadata.TagInfo
+		name     string
+		page     Page
+		expected []string
+	}{
+		{tags[:1], "", Page{Limit: 2}, []string{"pageTag1", "pageTag2"}},
+		{tags[:1], "", Page{Limit: 2, Offset: 2}, []string{"pageTag3"}},
+		{tags[:2], "", Page{}, []string{"pageTag2", "pageTag3"}},
+		{tags[:1], "pageTag3", Page{Limit: 1}, []string{"pageTag3"}},
+		{nil, "pageTag*", Page{Limit: 1, Offset: 3}, []string{"pageTag3"}},
+	}
+	for _, condition := range conditions {
+		found, err := GetCoincidentTagsPage(db, condition.tags, condition.name, condition.page)
+		if err != nil {
+			t.Errorf("Could not list tags: %v", err)
+			continue
+		}
+		var names []string
+		for _, tag := range found {
+			names = append(names, tag.Text)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v for %+v but got %v", condition.expected, condition.page, names)
+		}
+	}
+	countConditions := []struct {
+		tags     []metadata.TagInfo
+		name     string
+		expected int
+	}{
+		{tags[:1], "", 3},
+		{tags[:3], "", 1},
+		{nil, "pageTag*", 4},
+	}
+	for _, condition := range countConditions {
+		count, err := CountCoincidentTags(db, condition.tags, condition.name)
+		if err != nil || count != condition.expected {
+			t.Errorf("Expected %d tags for %v but got %d (%v)", condition.expected, condition.tags, count, err)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"os"
+)
+
+// Sets the owner and permission bits of a tag.
+func SetTagPermissions(db *sql.DB, tag metadata.TagInfo, perm metadata.Permissions) error {
+	return SetTagPermissionsContext(context.Background(), db, tag, perm)
+}
+
+func SetTagPermissionsContext(ctx context.Context, db *sql.DB, tag metadata.TagInfo, perm metadata.Permissions) error {
+	return setPermissions(ctx, db, "tag", tag.Id, perm)
+}
+
+// Gets the owner and permission bits of a tag. The boolean is false if none were ever set.
+func GetTagPermissions(db *sql.DB, tag metadata.TagInfo) (metadata.Permissions, bool, error) {
+	return GetTagPermissionsContext(context.Background(), db, tag)
+}
+
+func GetTagPermissionsContext(ctx context.Context, db *sql.DB,
+	tag metadata.TagInfo) (metadata.Permissions, bool, error) {
+	return getPermissions(ctx, db, "tag", tag.Id)
+}
+
+// Sets the owner and permission bits of a file.
+func SetFilePermissions(db *sql.DB, fileId int64, perm metadata.Permissions) error {
+	return SetFilePermissionsContext(context.Background(), db, fileId, perm)
+}
+
+func SetFilePermissionsContext(ctx context.Context, db *sql.DB, fileId int64, perm metadata.Permissions) error {
+	return setPermissions(ctx, db, "file_md", fileId, perm)
+}
+
+// Gets the owner and permission bits of a file. The boolean is false if none were ever set.
+func GetFilePermissions(db *sql.DB, fileId int64) (metadata.Permissions, bool, error) {
+	return GetFilePermissionsContext(context.Background(), db, fileId)
+}
+
+func GetFilePermissionsContext(ctx context.Context, db *sql.DB, fileId int64) (metadata.Permissions, bool, error) {
+	return getPermissions(ctx, db, "file_md", fileId)
+}
+
+func setPermissions(ctx context.Context, db *sql.DB, table string, id int64, perm metadata.Permissions) error {
+	_, err := execWrite(ctx, db, "UPDATE "+table+" SET uid = ?, gid = ?, mode = ? WHERE id = ?", perm.Uid, perm.Gid,
+		uint32(perm.Mode.Perm()), id)
+	return err
+}
+
+func getPermissions(ctx context.Context, db *sql.DB, table string, id int64) (metadata.Permissions, bool, error) {
+	var uid, gid, mode sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT uid, gid, mode FROM "+table+" WHERE id = ?", id).Scan(&uid, &gid, &mode)
+	if err == sql.ErrNoRows || (err == nil && !mode.Valid) {
+		return metadata.Permissions{}, false, nil
+	}
+	if err != nil {
+		return metadata.Permissions{}, false, err
+	}
+	return metadata.Permissions{Uid: uint32(uid.Int64), Gid: uint32(gid.Int64), Mode: os.FileMode(mode.Int64)}, true,
+		nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies permissions are stored per tag and per file and are reported as unset until set.
+func TestPermissions(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, files, err := createFilesAndTags(db, "permFile", "permPath", 1, 2)
+	if err != nil {
+		t.Errorf("Could not create files for test %s", err)
+	}
+	conditions := []struct {
+		perm metadata.Permissions
+	}{
+		{metadata.Permissions{Uid: 1000, Gid: 100, Mode: 0750}},
+		{metadata.Permissions{Uid: 0, Gid: 0, Mode: 0}},
+	}
+	if _, ok, _ := GetTagPermissions(db, tags[0]); ok {
+		t.Error("Expected tag permissions to be unset")
+	}
+	if _, ok, _ := GetFilePermissions(db, files[0].Id); ok {
+		t.Error("Expected file permissions to be unset")
+	}
+	for _, condition := range conditions {
+		SetTagPermissions(db, tags[0], condition.perm)
+		if perm, ok, err := GetTagPermissions(db, tags[0]); !ok || err != nil || perm != condition.perm {
+			t.Errorf("Expected tag permissions %v but got %v (%v)", condition.perm, perm, err)
+		}
+		SetFilePermissions(db, files[0].Id, condition.perm)
+		if perm, ok, err := GetFilePermissions(db, files[0].Id); !ok || err != nil || perm != condition.perm {
+			t.Errorf("Expected file permissions %v but got %v (%v)", condition.perm, perm, err)
+		}
+	}
+	if _, ok, _ := GetTagPermissions(db, tags[1]); ok {
+		t.Error("Expected permissions of another tag to be unset")
+	}
+}
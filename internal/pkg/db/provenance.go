@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"time"
+)
+
+// Creates the table of indexer runs, which the created_run and updated_run columns of file_md refer to so the files a
+// bad run added can be found (and removed) afterwards.
+func createIndexRuns(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS index_run(id INTEGER PRIMARY KEY, root text, started INTEGER, " +
+		"finished INTEGER);")
+	return err
+}
+
+// Records the start of a run of the indexer over a directory, returning the run to record the files it indexes with.
+func StartIndexRun(db *sql.DB, root string) (metadata.IndexRun, error) {
+	return StartIndexRunContext(context.Background(), db, root)
+}
+
+func StartIndexRunContext(ctx context.Context, db *sql.DB, root string) (metadata.IndexRun, error) {
+	run := metadata.IndexRun{Root: root, Started: time.Unix(time.Now().Unix(), 0)}
+	result, err := execWrite(ctx, db, "INSERT INTO index_run (root, started) VALUES (?, ?)", root, run.Started.Unix())
+	if err != nil {
+		return metadata.UnknownIndexRun, err
+	}
+	run.Id, err = result.LastInsertId()
+	if err != nil {
+		return metadata.UnknownIndexRun, err
+	}
+	return run, nil
+}
+
+// Records that a run of the indexer went through its whole directory.
+func FinishIndexRun(db *sql.DB, runId int64) error {
+	return FinishIndexRunContext(context.Background(), db, runId)
+}
+
+func FinishIndexRunContext(ctx context.Context, db *sql.DB, runId int64) error {
+	_, err := execWrite(ctx, db, "UPDATE index_run SET finished = ? WHERE id = ?", time.Now().Unix(), runId)
+	return err
+}
+
+// Records that a run of the indexer updated a file, or created it if created is set.
+func SetFileIndexRun(db *sql.DB, fileId int64, runId int64, created bool) error {
+	return SetFileIndexRunContext(context.Background(), db, fileId, runId, created)
+}
+
+func SetFileIndexRunContext(ctx context.Context, db *sql.DB, fileId int64, runId int64, created bool) error {
+	statement := "UPDATE file_md SET updated_run = ? WHERE id = ?"
+	if created {
+		statement = "UPDATE file_md SET updated_run = ?1, created_run = ?1 WHERE id = ?2"
+	}
+	_, err := execWrite(ctx, db, statement, runId, fileId)
+	return err
+}
+
+// Gets a run of the indexer by id. Returns metadata.UnknownIndexRun if there is none with the id.
+func GetIndexRun(db *sql.DB, runId int64) (metadata.IndexRun, error) {
+	return GetIndexRunContext(context.Background(), db, runId)
+}
+
+func GetIndexRunContext(ctx context.Context, db *sql.DB, runId int64) (metadata.IndexRun, error) {
+	runs, err := queryIndexRuns(ctx, db, "WHERE id = ?", runId)
+	if err != nil || len(runs) == 0 {
+		return metadata.UnknownIndexRun, err
+	}
+	return runs[0], nil
+}
+
+// Lists the runs of the indexer, the latest first, at most limit of them (all of them if limit is 0).
+func GetIndexRuns(db *sql.DB, limit int) ([]metadata.IndexRun, error) {
+	return GetIndexRunsContext(context.Background(), db, limit)
+}
+
+func GetIndexRunsContext(ctx context.Context, db *sql.DB, limit int) ([]metadata.IndexRun, error) {
+	limitClause, limitParams := Page{Limit: limit}.clause()
+	return queryIndexRuns(ctx, db, "ORDER BY id DESC"+limitClause, limitParams...)
+}
+
+// Gets the runs of the indexer that created a file and last updated it, metadata.UnknownIndexRun for either if the file
+// wasn't indexed (i.e. it was linked into the mount) or was last indexed before runs were recorded.
+func GetFileIndexRuns(db *sql.DB, fileId int64) (created metadata.IndexRun, updated metadata.IndexRun, err error) {
+	return GetFileIndexRunsContext(context.Background(), db, fileId)
+}
+
+func GetFileIndexRunsContext(ctx context.Context, db *sql.DB, fileId int64) (created metadata.IndexRun,
+	updated metadata.IndexRun, err error) {
+	var createdId, updatedId sql.NullInt64
+	err = db.QueryRowContext(ctx, "SELECT created_run, updated_run FROM file_md WHERE id = ?", fileId).Scan(&createdId,
+		&updatedId)
+	if err == sql.ErrNoRows {
+		return metadata.UnknownIndexRun, metadata.UnknownIndexRun, nil
+	}
+	if err != nil {
+		return metadata.UnknownIndexRun, metadata.UnknownIndexRun, err
+	}
+	created, updated = metadata.UnknownIndexRun, metadata.UnknownIndexRun
+	if createdId.Valid {
+		if created, err = GetIndexRunContext(ctx, db, createdId.Int64); err != nil {
+			return metadata.UnknownIndexRun, metadata.UnknownIndexRun, err
+		}
+	}
+	if updatedId.Valid {
+		if updated, err = GetIndexRunContext(ctx, db, updatedId.Int64); err != nil {
+			return metadata.UnknownIndexRun, metadata.UnknownIndexRun, err
+		}
+	}
+	return created, updated, nil
+}
+
+// Gets the files a run of the indexer added, optionally filtered by name (which can contain wildcards).
+func GetFilesCreatedInRun(db *sql.DB, runId int64, name string) ([]metadata.FileInfo, error) {
+	return GetFilesCreatedInRunContext(context.Background(), db, runId, name)
+}
+
+func GetFilesCreatedInRunContext(ctx context.Context, db *sql.DB, runId int64,
+	name string) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesCreatedInRun", time.Now())
+	return queryFilesNamedContext(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f WHERE f.created_run = ?",
+		[]interface{}{runId}, name)
+}
+
+// Gets the files a run of the indexer added or found changed, and that no later run did, optionally filtered by name
+// (which can contain wildcards).
+func GetFilesUpdatedInRun(db *sql.DB, runId int64, name string) ([]metadata.FileInfo, error) {
+	return GetFilesUpdatedInRunContext(context.Background(), db, runId, name)
+}
+
+func GetFilesUpdatedInRunContext(ctx context.Context, db *sql.DB, runId int64,
+	name string) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesUpdatedInRun", time.Now())
+	return queryFilesNamedContext(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f WHERE f.updated_run = ?",
+		[]interface{}{runId}, name)
+}
+
+// Runs a query for indexer runs given the clauses following the FROM clause.
+func queryIndexRuns(ctx context.Context, db *sql.DB, clauses string,
+	params ...interface{}) ([]metadata.IndexRun, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, root, started, coalesce(finished, 0) FROM index_run "+clauses,
+		params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.IndexRun
+	for rows.Next() {
+		var run metadata.IndexRun
+		var started, finished int64
+		if err = rows.Scan(&run.Id, &run.Root, &started, &finished); err != nil {
+			return nil, err
+		}
+		run.Started = time.Unix(started, 0)
+		if finished != 0 {
+			run.Finished = time.Unix(finished, 0)
+		}
+		results = append(results, run)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Verifies the runs of the indexer are recorded, along with the files each created and last updated.
+func TestIndexRuns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(filepath.Join(dir, "runs.db"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(db)
+	first, err := StartIndexRun(db, "/photos")
+	if err != nil || first.Id == metadata.UnknownIndexRun.Id {
+		t.Fatalf("Could not start run: %v", err)
+	}
+	old, _ := CreateFileInPath(db, "old.jpg", "/photos", nil)
+	changed, _ := CreateFileInPath(db, "changed.jpg", "/photos", nil)
+	linked, _ := CreateFileInPath(db, "linked.jpg", "/elsewhere", nil)
+	SetFileIndexRun(db, old.Id, first.Id, true)
+	SetFileIndexRun(db, changed.Id, first.Id, true)
+	FinishIndexRun(db, first.Id)
+	second, _ := StartIndexRun(db, "/photos")
+	added, _ := CreateFileInPath(db, "new.jpg", "/photos", nil)
+	SetFileIndexRun(db, added.Id, second.Id, true)
+	SetFileIndexRun(db, changed.Id, second.Id, false)
+
+	runs, err := GetIndexRuns(db, 0)
+	if err != nil || len(runs) != 2 || runs[0].Id != second.Id || runs[1].Root != "/photos" ||
+		runs[1].Finished.IsZero() || !runs[0].Finished.IsZero() || !runs[1].Started.Equal(first.Started) {
+		t.Errorf("Expected the second run to be listed first and unfinished but got %v (%v)", runs, err)
+	}
+	if runs, _ = GetIndexRuns(db, 1); len(runs) != 1 {
+		t.Errorf("Expected the runs to be limited but got %v", runs)
+	}
+	conditions := []struct {
+		runId           int64
+		expectedCreated []string
+		expectedUpdated []string
+	}{
+		{first.Id, []string{"old.jpg", "changed.jpg"}, []string{"old.jpg"}},
+		{second.Id, []string{"new.jpg"}, []string{"changed.jpg", "new.jpg"}},
+		{second.Id + 1, nil, nil},
+	}
+	for _, condition := range conditions {
+		created, err := GetFilesCreatedInRun(db, condition.runId, "")
+		if err != nil || !sameFileNames(created, condition.expectedCreated) {
+			t.Errorf("Expected run %d to create %v but got %v (%v)", condition.runId, condition.expectedCreated,
+				created, err)
+		}
+		updated, err := GetFilesUpdatedInRun(db, condition.runId, "")
+		if err != nil || !sameFileNames(updated, condition.expectedUpdated) {
+			t.Errorf("Expected run %d to update %v but got %v (%v)", condition.runId, condition.expectedUpdated,
+				updated, err)
+		}
+	}
+	fileRuns := []struct {
+		fileId          int64
+		expectedCreated int64
+		expectedUpdated int64
+	}{
+		{changed.Id, first.Id, second.Id},
+		{added.Id, second.Id, second.Id},
+		{linked.Id, metadata.UnknownIndexRun.Id, metadata.UnknownIndexRun.Id},
+	}
+	for _, fileRun := range fileRuns {
+		created, updated, err := GetFileIndexRuns(db, fileRun.fileId)
+		if err != nil || created.Id != fileRun.expectedCreated || updated.Id != fileRun.expectedUpdated {
+			t.Errorf("Expected file %d to be created by run %d and updated by %d but got %v and %v (%v)",
+				fileRun.fileId, fileRun.expectedCreated, fileRun.expectedUpdated, created, updated, err)
+		}
+	}
+	if run, _ := GetIndexRun(db, second.Id+1); run.Id != metadata.UnknownIndexRun.Id {
+		t.Errorf("Expected no run %d but got %v", second.Id+1, run)
+	}
+}
+
+// Reports whether the files have the names passed in, in any order.
+func sameFileNames(files []metadata.FileInfo, names []string) bool {
+	if len(files) != len(names) {
+		return false
+	}
+	counts := make(map[string]int)
+	for _, name := range names {
+		counts[name]++
+	}
+	for _, file := range files {
+		counts[file.Name]--
+		if counts[file.Name] < 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"path/filepath"
+	"strings"
+)
+
+// Lists up to limit files on local disk in the directory passed in or any directory under it, ordered by id and
+// starting after the id passed in. Passing the id of the last file listed pages through them all.
+func GetFilesUnderPath(db *sql.DB, root string, afterId int64, limit int) ([]metadata.FileInfo, error) {
+	return GetFilesUnderPathContext(context.Background(), db, root, afterId, limit)
+}
+
+func GetFilesUnderPathContext(ctx context.Context, db *sql.DB, root string, afterId int64,
+	limit int) ([]metadata.FileInfo, error) {
+	root = filepath.Clean(root)
+	// the paths under the directory sort between the directory followed by the separator and followed by the character
+	// after it, which also leaves out names with % or _ in them that LIKE would need escaping for
+	lower := strings.TrimSuffix(root, string(filepath.Separator)) + string(filepath.Separator)
+	upper := lower[:len(lower)-1] + string(filepath.Separator+1)
+	return queryFiles(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f WHERE f.id > ? AND "+
+		"(f.path = ? OR (f.path >= ? AND f.path < ?)) AND coalesce(f.scheme, ?) = ? ORDER BY f.id ASC LIMIT ?", afterId,
+		root, lower, upper, metadata.LocalScheme, metadata.LocalScheme, limit)
+}
+
+// Deletes the records of files, along with their tags and trash entries, forgetting about the files (which are left in
+// the storage). Returns the number of files deleted.
+func DeleteFiles(db *sql.DB, fileIds []int64) (int, error) {
+	return DeleteFilesContext(context.Background(), db, fileIds)
+}
+
+func DeleteFilesContext(ctx context.Context, db *sql.DB, fileIds []int64) (int, error) {
+	var deleted int
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = deleteFiles(ctx, tx, fileIds)
+		return err
+	})
+	return deleted, err
+}
+
+// Deletes the records of files through a transaction; see DeleteFiles.
+func deleteFiles(ctx context.Context, tx *sql.Tx, fileIds []int64) (int, error) {
+	deleted := 0
+	for _, fileId := range fileIds {
+		for _, statement := range []string{
+			"DELETE FROM file_tags WHERE fid = ?",
+			"DELETE FROM trash WHERE fid = ?",
+		} {
+			if _, err := tx.ExecContext(ctx, statement, fileId); err != nil {
+				return 0, err
+			}
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM file_md WHERE id = ?", fileId)
+		if err != nil {
+			return 0, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		deleted += int(affected)
+	}
+	return deleted, nil
+}
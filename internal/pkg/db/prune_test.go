@@ -0,0 +1,89 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies the local files in a directory and the ones under it are listed a page at a time.
+func TestGetFilesUnderPath(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	for _, path := range []string{"/prune", "/prune/sub", "/prune/sub/deeper", "/prunesibling", "/prune_"} {
+		CreateFileInPath(db, "pruned.txt", path, nil)
+	}
+	remote, _ := CreateFileInPath(db, "remote.txt", "/prune", nil)
+	SetFileLocation(db, remote.Id, metadata.Location{Scheme: "s3", Bucket: "pruned"})
+	conditions := []struct {
+		root     string
+		limit    int
+		expected []string
+	}{
+		{"/prune", 10, []string{"/prune", "/prune/sub", "/prune/sub/deeper"}},
+		{"/prune/", 10, []string{"/prune", "/prune/sub", "/prune/sub/deeper"}},
+		{"/prune/sub", 10, []string{"/prune/sub", "/prune/sub/deeper"}},
+		{"/prune", 2, []string{"/prune", "/prune/sub", "/prune/sub/deeper"}},
+		{"/pru", 10, nil},
+	}
+	for i, condition := range conditions {
+		var paths []string
+		var lastId int64
+		for {
+			files, err := GetFilesUnderPath(db, condition.root, lastId, condition.limit)
+			if err != nil {
+				t.Fatalf("Could not list the files under %s: %v", condition.root, err)
+			}
+			if len(files) > condition.limit {
+				t.Errorf("Expected at most %d files for condition %d but got %d", condition.limit, i, len(files))
+			}
+			if len(files) == 0 {
+				break
+			}
+			for _, file := range files {
+				paths = append(paths, file.Path)
+				lastId = file.Id
+			}
+		}
+		if len(paths) != len(condition.expected) {
+			t.Errorf("Expected %v under %s but got %v", condition.expected, condition.root, paths)
+			continue
+		}
+		for j, path := range paths {
+			if path != condition.expected[j] {
+				t.Errorf("Expected %v under %s but got %v", condition.expected, condition.root, paths)
+				break
+			}
+		}
+	}
+}
+
+// Verifies deleting files drops their tags and trash entries along with them.
+func TestDeleteFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := AddTags(db, []string{"deletedtag", "deletedother"}, nil)
+	kept, _ := CreateFileInPath(db, "kept.txt", "/deleted", tags)
+	deleted, _ := CreateFileInPath(db, "deleted.txt", "/deleted", tags)
+	if err := TrashFileTag(db, deleted.Id, tags[1].Id); err != nil {
+		t.Fatalf("Could not trash tag: %v", err)
+	}
+	count, err := DeleteFiles(db, []int64{deleted.Id, -1})
+	if err != nil || count != 1 {
+		t.Errorf("Expected 1 file deleted but got %d (%v)", count, err)
+	}
+	conditions := []struct {
+		query    string
+		param    interface{}
+		expected int
+	}{
+		{"SELECT count(*) FROM file_md WHERE path = ?", "/deleted", 1},
+		{"SELECT count(*) FROM file_tags WHERE fid = ?", deleted.Id, 0},
+		{"SELECT count(*) FROM trash WHERE fid = ?", deleted.Id, 0},
+		{"SELECT count(*) FROM file_tags WHERE fid = ?", kept.Id, 2},
+	}
+	for _, condition := range conditions {
+		if found, err := countRows(db, condition.query, condition.param); err != nil || found != condition.expected {
+			t.Errorf("Expected %d for %s but got %d (%v)", condition.expected, condition.query, found, err)
+		}
+	}
+}
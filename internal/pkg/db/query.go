@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"time"
+)
+
+// Lists the files matching a boolean tag expression, optionally filtered by name. Each non-empty name further
+// restricts the files and can contain 0 or more wildcards characters (*). A nil expression matches every file.
+func GetFilesMatchingQuery(db *sql.DB, expr query.Expr, names ...string) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingQueryContext(context.Background(), db, expr, names...)
+}
+
+func GetFilesMatchingQueryContext(ctx context.Context, db *sql.DB, expr query.Expr,
+	names ...string) ([]metadata.FileInfo, error) {
+	defer observe("GetFilesMatchingQuery", time.Now())
+	condition, params, err := queryToSql(expr)
+	if err != nil {
+		return nil, err
+	}
+	selectQuery := "SELECT f.id, f.name, f.path FROM file_md f WHERE " + condition
+	for _, name := range names {
+		if len(name) == 0 {
+			continue
+		}
+		condition, param := nameCondition("f.name", name)
+		selectQuery += " AND " + condition
+		params = append(params, param)
+	}
+
+	stmt, err := db.PrepareContext(ctx, selectQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.QueryContext(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.FileInfo
+	for rows.Next() {
+		info := metadata.FileInfo{}
+		err = rows.Scan(&info.Id, &info.Name, &info.Path)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, info)
+	}
+	return results, rows.Err()
+}
+
+// Lists the files that have ALL the tags of at least one of the sets passed in, e.g. (a AND b) OR c, with a single
+// query rather than one per set. Optionally filtered by name as GetFilesMatchingQuery does. An empty set matches every
+// file, and no sets match no file.
+func GetFilesWithAnyTagSet(db *sql.DB, sets [][]metadata.TagInfo, name string) ([]metadata.FileInfo, error) {
+	return GetFilesWithAnyTagSetContext(context.Background(), db, sets, name)
+}
+
+func GetFilesWithAnyTagSetContext(ctx context.Context, db *sql.DB, sets [][]metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	if len(sets) == 0 {
+		return nil, nil
+	}
+	var disjunction query.Expr
+	for _, set := range sets {
+		if len(set) == 0 {
+			return GetFilesMatchingQueryContext(ctx, db, nil, name)
+		}
+		var conjunction query.Expr = query.Tag{Name: set[0].Text}
+		for _, tag := range set[1:] {
+			conjunction = query.And{Left: conjunction, Right: query.Tag{Name: tag.Text}}
+		}
+		if disjunction == nil {
+			disjunction = conjunction
+		} else {
+			disjunction = query.Or{Left: disjunction, Right: conjunction}
+		}
+	}
+	return GetFilesMatchingQueryContext(ctx, db, disjunction, name)
+}
+
+// Translates an expression into a SQL condition on the file_md row aliased as f along with the parameters it needs.
+func queryToSql(expr query.Expr) (string, []interface{}, error) {
+	switch node := expr.(type) {
+	case nil:
+		return "1", nil, nil
+	case query.Tag:
+		return "EXISTS (SELECT 1 FROM file_tags ft, tag WHERE ft.tid = tag.id AND ft.fid = f.id AND " +
+			tagNameCondition + ")", []interface{}{node.Name, node.Name}, nil
+	case query.Attribute:
+		return attributeToSql(node)
+	case query.Not:
+		condition, params, err := queryToSql(node.Expr)
+		if err != nil {
+			return "", nil, err
+		}
+		return fmt.Sprintf("NOT (%s)", condition), params, nil
+	case query.And:
+		return binaryToSql("AND", node.Left, node.Right)
+	case query.Or:
+		return binaryToSql("OR", node.Left, node.Right)
+	}
+	return "", nil, fmt.Errorf("unsupported query expression %v", expr)
+}
+
+func binaryToSql(operator string, left query.Expr, right query.Expr) (string, []interface{}, error) {
+	leftCondition, leftParams, err := queryToSql(left)
+	if err != nil {
+		return "", nil, err
+	}
+	rightCondition, rightParams, err := queryToSql(right)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("(%s %s %s)", leftCondition, operator, rightCondition), append(leftParams, rightParams...), nil
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"testing"
+)
+
+// Verifies boolean tag expressions select the right files.
+func TestGetFilesMatchingQuery(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "a", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	// one file per non-empty combination of the three tags
+	var files []metadata.FileInfo
+	for i := 1; i < 8; i++ {
+		var fileTags []metadata.TagInfo
+		for j := 0; j < 3; j++ {
+			if i&(1<<uint(j)) != 0 {
+				fileTags = append(fileTags, tags[j])
+			}
+		}
+		file, err := CreateFileInPath(db, fmt.Sprintf("file%d", i), "path", fileTags)
+		if err != nil {
+			t.Errorf("Could not create file %s", err)
+		}
+		files = append(files, file)
+	}
+	conditions := []struct {
+		expression    string
+		name          string
+		expectedCount int
+	}{
+		{"a0", "", 4},
+		{"a0 & a1", "", 2},
+		{"a0 & a1 & !a2", "", 1},
+		{"a0 | a1", "", 6},
+		{"!a0", "", 3},
+		{"(a0 | a1) & !a2", "", 3},
+		{"a0 | a1 | a2", "file1*", 1},
+		{"junk", "", 0},
+		{"!junk", "", 7},
+	}
+	for _, condition := range conditions {
+		expr, err := query.Parse(condition.expression)
+		if err != nil {
+			t.Errorf("Could not parse %s: %v", condition.expression, err)
+			continue
+		}
+		foundFiles, err := GetFilesMatchingQuery(db, expr, condition.name)
+		if err != nil {
+			t.Errorf("Could not run query %s: %s", condition.expression, err)
+		} else if len(foundFiles) != condition.expectedCount {
+			t.Errorf("Expected %s to match %d files but got %d", condition.expression, condition.expectedCount,
+				len(foundFiles))
+		}
+	}
+	// without an expression only the names filter the files
+	if foundFiles, _ := GetFilesMatchingQuery(db, nil, "file*", "*7"); len(foundFiles) != 1 {
+		t.Errorf("Expected names to match 1 file but got %d", len(foundFiles))
+	}
+}
+
+// Verifies files having every tag of any of the sets are found.
+func TestGetFilesWithAnyTagSet(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "set", 3)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	// one file per non-empty combination of the three tags
+	for i := 1; i < 8; i++ {
+		var fileTags []metadata.TagInfo
+		for j := 0; j < 3; j++ {
+			if i&(1<<uint(j)) != 0 {
+				fileTags = append(fileTags, tags[j])
+			}
+		}
+		if _, err = CreateFileInPath(db, fmt.Sprintf("setFile%d", i), "path", fileTags); err != nil {
+			t.Errorf("Could not create file %s", err)
+		}
+	}
+	conditions := []struct {
+		sets          [][]metadata.TagInfo
+		name          string
+		expectedCount int
+	}{
+		{nil, "setFile*", 0},
+		{[][]metadata.TagInfo{tags[:1]}, "setFile*", 4},
+		{[][]metadata.TagInfo{tags[:2], tags[2:]}, "setFile*", 5},
+		{[][]metadata.TagInfo{tags[:2], tags[1:]}, "setFile*", 3},
+		{[][]metadata.TagInfo{tags[:1], tags[1:2], tags[2:]}, "setFile7", 1},
+		{[][]metadata.TagInfo{tags[:1], {}}, "setFile*", 7},
+	}
+	for _, condition := range conditions {
+		foundFiles, err := GetFilesWithAnyTagSet(db, condition.sets, condition.name)
+		if err != nil || len(foundFiles) != condition.expectedCount {
+			t.Errorf("Expected %v to match %d files but got %d (%v)", condition.sets, condition.expectedCount,
+				len(foundFiles), err)
+		}
+	}
+}
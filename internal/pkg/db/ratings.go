@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"time"
+)
+
+// Highest rating a file can be given; ratings go from 1 to MaxRating, 0 meaning the file isn't rated.
+const MaxRating = 5
+
+// Name query expressions compare the rating of files by (i.e. rating>=4), which is why it can't name an attribute.
+const RatingAttribute = "rating"
+
+// Returned by SetFileRating for ratings outside 0 to MaxRating.
+var ErrInvalidRating = fmt.Errorf("ratings must be from 0 to %d", MaxRating)
+
+// Sets the rating of a file, replacing any it had. A rating of 0 clears it.
+func SetFileRating(db *sql.DB, fileId int64, rating int) error {
+	return SetFileRatingContext(context.Background(), db, fileId, rating)
+}
+
+func SetFileRatingContext(ctx context.Context, db *sql.DB, fileId int64, rating int) error {
+	if rating < 0 || rating > MaxRating {
+		return ErrInvalidRating
+	}
+	var value interface{}
+	if rating > 0 {
+		value = rating
+	}
+	_, err := execWrite(ctx, db, "UPDATE file_md SET rating = ? WHERE id = ?", value, fileId)
+	return err
+}
+
+// Gets the rating of a file, 0 if it isn't rated (or isn't recorded).
+func GetFileRating(db *sql.DB, fileId int64) (int, error) {
+	return GetFileRatingContext(context.Background(), db, fileId)
+}
+
+func GetFileRatingContext(ctx context.Context, db *sql.DB, fileId int64) (int, error) {
+	defer observe("GetFileRating", time.Now())
+	var rating sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT rating FROM file_md WHERE id = ?", fileId).Scan(&rating)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return int(rating.Int64), err
+}
+
+// Marks a file as a favorite, or no longer one.
+func SetFavorite(db *sql.DB, fileId int64, favorite bool) error {
+	return SetFavoriteContext(context.Background(), db, fileId, favorite)
+}
+
+func SetFavoriteContext(ctx context.Context, db *sql.DB, fileId int64, favorite bool) error {
+	var value interface{}
+	if favorite {
+		value = 1
+	}
+	_, err := execWrite(ctx, db, "UPDATE file_md SET favorite = ? WHERE id = ?", value, fileId)
+	return err
+}
+
+// Gets the files marked as favorites, optionally filtered by name (which can contain wildcards).
+func GetFavoriteFiles(db *sql.DB, name string) ([]metadata.FileInfo, error) {
+	return GetFavoriteFilesContext(context.Background(), db, name)
+}
+
+func GetFavoriteFilesContext(ctx context.Context, db *sql.DB, name string) ([]metadata.FileInfo, error) {
+	return GetFavoriteFilesExcludingContext(ctx, db, nil, name)
+}
+
+// Same as GetFavoriteFiles but leaves out the files that have any of the excluded tags.
+func GetFavoriteFilesExcluding(db *sql.DB, excluded []metadata.TagInfo, name string) ([]metadata.FileInfo, error) {
+	return GetFavoriteFilesExcludingContext(context.Background(), db, excluded, name)
+}
+
+func GetFavoriteFilesExcludingContext(ctx context.Context, db *sql.DB, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	defer observe("GetFavoriteFiles", time.Now())
+	selectQuery, params := excludingFiles("SELECT f.id, f.name, f.path FROM file_md f WHERE f.favorite = 1", nil,
+		excluded)
+	return queryFilesNamedContext(ctx, db, selectQuery, params, name)
+}
+
+// Translates the comparison of the rating of files into a SQL condition on the file_md row aliased as f. Files that
+// aren't rated compare as rated 0 so rating<3 includes them.
+func ratingToSql(attribute query.Attribute) (string, []interface{}, error) {
+	var rating int
+	if _, err := fmt.Sscan(attribute.Value, &rating); err != nil {
+		return "", nil, errors.New("ratings are compared with numbers")
+	}
+	return fmt.Sprintf("ifnull(f.rating, 0) %s ?", attribute.Op), []interface{}{rating}, nil
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Verifies ratings are set, cleared and compared in query expressions, unrated files comparing as rated 0.
+func TestFileRatings(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := AddTags(db, []string{"rated"}, nil)
+	ratings := []struct {
+		name        string
+		rating      int
+		expectedErr error
+	}{
+		{"ratedFive.jpg", 5, nil},
+		{"ratedFour.jpg", 4, nil},
+		{"ratedTwo.jpg", 2, nil},
+		{"ratedNone.jpg", 0, nil},
+		{"ratedTooHigh.jpg", MaxRating + 1, ErrInvalidRating},
+		{"ratedNegative.jpg", -1, ErrInvalidRating},
+	}
+	for _, rating := range ratings {
+		file, _ := CreateFileInPath(db, rating.name, "ratings", tags)
+		if err := SetFileRating(db, file.Id, rating.rating); err != rating.expectedErr {
+			t.Errorf("Expected %v rating %s %d but got %v", rating.expectedErr, rating.name, rating.rating, err)
+		}
+		if found, _ := GetFileRating(db, file.Id); rating.expectedErr == nil && found != rating.rating {
+			t.Errorf("Expected %s to be rated %d but got %d", rating.name, rating.rating, found)
+		}
+	}
+	cleared, _ := FindFileByAbsPath(db, "ratedTwo.jpg", "ratings")
+	SetFileRating(db, cleared.Id, 3)
+	SetFileRating(db, cleared.Id, 0)
+	if found, _ := GetFileRating(db, cleared.Id); found != 0 {
+		t.Errorf("Expected the rating to be cleared but got %d", found)
+	}
+	if err := SetFileAttribute(db, cleared.Id, RatingAttribute, "5"); err != ErrInvalidAttribute {
+		t.Errorf("Expected the rating not to be an attribute but got %v", err)
+	}
+
+	conditions := []struct {
+		expression string
+		expected   string
+	}{
+		{"rating>=4", "ratedFive.jpg,ratedFour.jpg"},
+		{"rated & rating=5", "ratedFive.jpg"},
+		{"rated & rating<1", "ratedNegative.jpg,ratedNone.jpg,ratedTooHigh.jpg,ratedTwo.jpg"},
+	}
+	for _, condition := range conditions {
+		expr, err := query.Parse(condition.expression)
+		if err != nil {
+			t.Fatalf("Could not parse %s: %v", condition.expression, err)
+		}
+		matched, err := GetFilesMatchingQuery(db, expr)
+		var names []string
+		for _, file := range matched {
+			names = append(names, file.Name)
+		}
+		sort.Strings(names)
+		if err != nil || strings.Join(names, ",") != condition.expected {
+			t.Errorf("Expected %s to match %s but got %v (%v)", condition.expression, condition.expected, names, err)
+		}
+	}
+	expr, _ := query.Parse("rating>high")
+	if _, err := GetFilesMatchingQuery(db, expr); err == nil {
+		t.Errorf("Expected comparing the rating with text to fail")
+	}
+}
+
+// Verifies files are listed as favorites until they no longer are.
+func TestFavorites(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	first, _ := CreateFileInPath(db, "favorite1.jpg", "favorites", nil)
+	second, _ := CreateFileInPath(db, "favorite2.jpg", "favorites", nil)
+	CreateFileInPath(db, "other.jpg", "favorites", nil)
+	conditions := []struct {
+		fileId   int64
+		favorite bool
+		expected int
+	}{
+		{first.Id, true, 1},
+		{second.Id, true, 2},
+		{second.Id, true, 2},
+		{first.Id, false, 1},
+	}
+	for i, condition := range conditions {
+		if err := SetFavorite(db, condition.fileId, condition.favorite); err != nil {
+			t.Errorf("Could not set favorite for condition %d: %v", i, err)
+		}
+		if favorites, _ := GetFavoriteFiles(db, ""); len(favorites) != condition.expected {
+			t.Errorf("Expected %d favorites after condition %d but got %v", condition.expected, i, favorites)
+		}
+	}
+	if favorites, _ := GetFavoriteFiles(db, "*2.jpg"); len(favorites) != 1 || favorites[0].Id != second.Id {
+		t.Errorf("Expected the favorites to be filtered by name but got %v", favorites)
+	}
+}
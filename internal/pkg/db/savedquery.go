@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"time"
+)
+
+// Saves a named query, replacing any existing query with the same name. A replaced query keeps the time it was
+// created.
+func SaveQuery(db *sql.DB, saved metadata.SavedQuery) error {
+	return SaveQueryContext(context.Background(), db, saved)
+}
+
+func SaveQueryContext(ctx context.Context, db *sql.DB, saved metadata.SavedQuery) error {
+	_, err := execWrite(ctx, db, "INSERT INTO saved_query (name, expr, pattern, created) VALUES (?,?,?,?) "+
+		"ON CONFLICT(name) DO UPDATE SET expr = excluded.expr, pattern = excluded.pattern", saved.Name, saved.Expr,
+		saved.Pattern, time.Now().Unix())
+	return err
+}
+
+// Deletes a named query. Deleting a query that does not exist is not an error.
+func DeleteSavedQuery(db *sql.DB, name string) error {
+	return DeleteSavedQueryContext(context.Background(), db, name)
+}
+
+func DeleteSavedQueryContext(ctx context.Context, db *sql.DB, name string) error {
+	_, err := execWrite(ctx, db, "DELETE FROM saved_query WHERE name = ?", name)
+	return err
+}
+
+// Looks up a named query. Returns metadata.UnknownQuery if there is no query with that name.
+func GetSavedQuery(db *sql.DB, name string) (metadata.SavedQuery, error) {
+	return GetSavedQueryContext(context.Background(), db, name)
+}
+
+func GetSavedQueryContext(ctx context.Context, db *sql.DB, name string) (metadata.SavedQuery, error) {
+	queries, err := querySavedQueries(ctx, db, "SELECT name, expr, pattern, created FROM saved_query WHERE name = ?", name)
+	if err != nil || len(queries) == 0 {
+		return metadata.UnknownQuery, err
+	}
+	return queries[0], nil
+}
+
+// Lists all the saved queries ordered by name.
+func GetSavedQueries(db *sql.DB) ([]metadata.SavedQuery, error) {
+	return GetSavedQueriesContext(context.Background(), db)
+}
+
+func GetSavedQueriesContext(ctx context.Context, db *sql.DB) ([]metadata.SavedQuery, error) {
+	return querySavedQueries(ctx, db, "SELECT name, expr, pattern, created FROM saved_query ORDER BY name ASC")
+}
+
+// Lists the files matching a saved query: those matching its tag expression (every file if it has none) with a name
+// matching its pattern (if any). Returns the error of parsing the expression if it isn't valid.
+func EvaluateSavedQuery(db *sql.DB, saved metadata.SavedQuery) ([]metadata.FileInfo, error) {
+	return EvaluateSavedQueryContext(context.Background(), db, saved)
+}
+
+func EvaluateSavedQueryContext(ctx context.Context, db *sql.DB, saved metadata.SavedQuery) ([]metadata.FileInfo,
+	error) {
+	var expr query.Expr
+	if len(saved.Expr) > 0 {
+		var err error
+		if expr, err = query.Parse(saved.Expr); err != nil {
+			return nil, err
+		}
+	}
+	return GetFilesMatchingQueryContext(ctx, db, expr, saved.Pattern)
+}
+
+func querySavedQueries(ctx context.Context, db *sql.DB, query string,
+	params ...interface{}) ([]metadata.SavedQuery, error) {
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.SavedQuery
+	for rows.Next() {
+		var saved = metadata.SavedQuery{}
+		var created sql.NullInt64
+		err = rows.Scan(&saved.Name, &saved.Expr, &saved.Pattern, &created)
+		if err != nil {
+			return nil, err
+		}
+		// queries saved before creation times were recorded have none
+		if created.Valid {
+			saved.Created = time.Unix(created.Int64, 0)
+		}
+		results = append(results, saved)
+	}
+	return results, nil
+}
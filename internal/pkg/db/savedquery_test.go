@@ -0,0 +1,75 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+	"time"
+)
+
+// Verifies saved queries can be created, replaced, listed and deleted.
+func TestSavedQueries(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	conditions := []struct {
+		saved metadata.SavedQuery
+	}{
+		{metadata.SavedQuery{Name: "summer", Expr: "vacation & 2019"}},
+		{metadata.SavedQuery{Name: "raw", Pattern: "*.cr2"}},
+		{metadata.SavedQuery{Name: "summer", Expr: "vacation & 2020", Pattern: "*.jpg"}},
+	}
+	created := map[string]time.Time{}
+	for _, condition := range conditions {
+		if err := SaveQuery(db, condition.saved); err != nil {
+			t.Errorf("Could not save query %s: %v", condition.saved.Name, err)
+		}
+		found, _ := GetSavedQuery(db, condition.saved.Name)
+		if found.Created.IsZero() {
+			t.Errorf("Expected the creation time of %s to be recorded", condition.saved.Name)
+		}
+		// replacing a query keeps its creation time
+		if previous, ok := created[found.Name]; ok && !previous.Equal(found.Created) {
+			t.Errorf("Expected %s to keep its creation time %v but got %v", found.Name, previous, found.Created)
+		}
+		created[found.Name] = found.Created
+		found.Created = time.Time{}
+		if found != condition.saved {
+			t.Errorf("Expected %v but found %v", condition.saved, found)
+		}
+	}
+	queries, _ := GetSavedQueries(db)
+	if len(queries) != 2 || queries[0].Name != "raw" || queries[1].Name != "summer" {
+		t.Errorf("Unexpected saved queries %v", queries)
+	}
+	DeleteSavedQuery(db, "summer")
+	if found, _ := GetSavedQuery(db, "summer"); found != metadata.UnknownQuery {
+		t.Errorf("Expected deleted query not to be found but got %v", found)
+	}
+}
+
+// Verifies saved queries select the files matching their expression and pattern.
+func TestEvaluateSavedQuery(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	vacation, _ := AddTag(db, "evalVacation", nil)
+	year, _ := AddTag(db, "eval2019", nil)
+	both, _ := CreateFileInPath(db, "both.jpg", "evalPath", []metadata.TagInfo{vacation, year})
+	vacationOnly, _ := CreateFileInPath(db, "vacation.cr2", "evalPath", []metadata.TagInfo{vacation})
+	conditions := []struct {
+		saved       metadata.SavedQuery
+		expected    []metadata.FileInfo
+		expectedErr bool
+	}{
+		{metadata.SavedQuery{Expr: "evalVacation & eval2019"}, []metadata.FileInfo{both}, false},
+		{metadata.SavedQuery{Expr: "evalVacation", Pattern: "*.cr2"}, []metadata.FileInfo{vacationOnly}, false},
+		{metadata.SavedQuery{Expr: "evalVacation & !eval2019"}, []metadata.FileInfo{vacationOnly}, false},
+		{metadata.SavedQuery{Pattern: "both.jpg"}, []metadata.FileInfo{both}, false},
+		{metadata.SavedQuery{Expr: "evalVacation &"}, nil, true},
+	}
+	for _, condition := range conditions {
+		files, err := EvaluateSavedQuery(db, condition.saved)
+		if (err != nil) != condition.expectedErr || fmt.Sprint(files) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v for %v but got %v (%v)", condition.expected, condition.saved, files, err)
+		}
+	}
+}
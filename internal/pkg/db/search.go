@@ -0,0 +1,165 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"strings"
+	"unicode"
+)
+
+// Full-text modules the file search index can use, best first. FTS5 is only compiled into go-sqlite3 when it is built
+// with the sqlite_fts5 tag; FTS4 always is.
+var searchModules = []string{"fts5", "fts4"}
+
+// Triggers keeping the file search index in sync with file_md. The index holds the name and path of each file under the
+// id of the file.
+var searchTriggers = map[string]string{
+	"file_search_insert": "CREATE TRIGGER file_search_insert AFTER INSERT ON file_md BEGIN " +
+		"INSERT INTO file_search(rowid, name, path) VALUES (new.id, new.name, new.path); END",
+	"file_search_delete": "CREATE TRIGGER file_search_delete AFTER DELETE ON file_md BEGIN " +
+		"DELETE FROM file_search WHERE rowid = old.id; END",
+	"file_search_update": "CREATE TRIGGER file_search_update AFTER UPDATE OF name, path ON file_md BEGIN " +
+		"DELETE FROM file_search WHERE rowid = old.id; " +
+		"INSERT INTO file_search(rowid, name, path) VALUES (new.id, new.name, new.path); END",
+}
+
+// Sets up the full-text index over the names and paths of files, which isn't a migration since the module it uses
+// depends on how the program was built. The index is created with the best module available and filled with the files
+// already recorded. If the module of an existing index isn't available, e.g. because the database was last opened by a
+// build with FTS5, its triggers are dropped so writes to file_md keep working, and they are put back (with the index
+// rebuilt) the next time the database is opened by a build with the module. SearchFiles falls back to matching names
+// and paths with LIKE while there is no usable index.
+func setUpFileSearch(db *sql.DB) error {
+	var definition string
+	err := db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'file_search'").Scan(&definition)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	module := ""
+	if err == sql.ErrNoRows {
+		for _, candidate := range searchModules {
+			if searchModuleAvailable(db, candidate) {
+				module = candidate
+				break
+			}
+		}
+		if module == "" {
+			return nil
+		}
+	} else {
+		for _, candidate := range searchModules {
+			if strings.Contains(strings.ToLower(definition), "using "+candidate) && searchModuleAvailable(db, candidate) {
+				module = candidate
+			}
+		}
+		if module == "" {
+			for name := range searchTriggers {
+				if _, err = db.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	triggers, err := countRows(db,
+		"SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'file_search_%'")
+	if err != nil || triggers == len(searchTriggers) {
+		return err
+	}
+	return inTx(context.Background(), db, func(tx *sql.Tx) error {
+		statements := []string{
+			fmt.Sprintf("CREATE VIRTUAL TABLE IF NOT EXISTS file_search USING %s(name, path)", module),
+			"DELETE FROM file_search",
+			"INSERT INTO file_search(rowid, name, path) SELECT id, name, path FROM file_md",
+		}
+		for name, statement := range searchTriggers {
+			statements = append(statements, "DROP TRIGGER IF EXISTS "+name, statement)
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Reports whether SQLite was compiled with a full-text module.
+func searchModuleAvailable(db *sql.DB, module string) bool {
+	var used bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used(?)", "ENABLE_"+strings.ToUpper(module)).Scan(&used)
+	if err == nil && !used && module == "fts4" {
+		// FTS4 comes with FTS3
+		err = db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS3')").Scan(&used)
+	}
+	return err == nil && used
+}
+
+// Lists the files whose name or path contain words starting with every word of the query, ordered by name. Words are
+// runs of letters and digits, so "invoice 2022 pdf" finds invoice-2022.pdf and 2022/invoice.pdf but not
+// invoice-2021.pdf. An empty query finds nothing.
+func SearchFiles(db *sql.DB, query string) ([]metadata.FileInfo, error) {
+	return SearchFilesContext(context.Background(), db, query)
+}
+
+func SearchFilesContext(ctx context.Context, db *sql.DB, query string) ([]metadata.FileInfo, error) {
+	words := searchWords(query)
+	if len(words) == 0 {
+		return nil, nil
+	}
+	indexed, err := countRowsContext(ctx, db,
+		"SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'file_search_%'")
+	if err != nil {
+		return nil, err
+	}
+	if indexed == 0 {
+		return searchFilesByLike(ctx, db, words)
+	}
+	// words are only letters and digits so they need no quoting, and in lower case they can't be operators such as OR
+	terms := make([]string, len(words))
+	for i, word := range words {
+		terms[i] = strings.ToLower(word) + "*"
+	}
+	return queryFiles(ctx, db, "SELECT f.id, f.name, f.path FROM file_search s, file_md f "+
+		"WHERE s.rowid = f.id AND file_search MATCH ? ORDER BY f.name ASC, f.id ASC", strings.Join(terms, " "))
+}
+
+// Finds the files SearchFiles would without the full-text index, by scanning the names and paths of every file for
+// the words. Unlike the index, words may match within words of the name or path.
+func searchFilesByLike(ctx context.Context, db *sql.DB, words []string) ([]metadata.FileInfo, error) {
+	var conditions []string
+	var params []interface{}
+	for _, word := range words {
+		conditions = append(conditions, "(f.name LIKE ? OR f.path LIKE ?)")
+		params = append(params, "%"+word+"%", "%"+word+"%")
+	}
+	return queryFiles(ctx, db, "SELECT f.id, f.name, f.path FROM file_md f"+whereClause(conditions)+
+		" ORDER BY f.name ASC, f.id ASC", params...)
+}
+
+// Splits a search query into its words: runs of letters and digits.
+func searchWords(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Runs a query selecting the id, name and path of files.
+func queryFiles(ctx context.Context, db *sql.DB, query string, params ...interface{}) ([]metadata.FileInfo, error) {
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []metadata.FileInfo
+	for rows.Next() {
+		info := metadata.FileInfo{}
+		if err = rows.Scan(&info.Id, &info.Name, &info.Path); err != nil {
+			return nil, err
+		}
+		results = append(results, info)
+	}
+	return results, rows.Err()
+}
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Verifies files are found by the words of their name and path, with and without the full-text index.
+func TestSearchFiles(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "search", 1)
+	files := map[string]int64{}
+	for _, file := range []struct{ name, path string }{
+		{"invoice-2022.pdf", "/docs/searchTest"},
+		{"invoice-2021.pdf", "/docs/searchTest"},
+		{"Invoice.pdf", "/docs/searchTest/2022"},
+		{"report 2022.odt", "/docs/searchTest"},
+		{"renamed.txt", "/docs/searchTest"},
+	} {
+		created, err := CreateFileInPath(db, file.name, file.path, tags)
+		if err != nil {
+			t.Fatalf("Could not create file: %v", err)
+		}
+		files[file.name] = created.Id
+	}
+	// the index follows changes to the files
+	if _, err := db.Exec("UPDATE file_md SET name = 'searchable.txt' WHERE id = ?", files["renamed.txt"]); err != nil {
+		t.Fatalf("Could not rename file: %v", err)
+	}
+	conditions := []struct {
+		query    string
+		expected []int64
+	}{
+		{"invoice 2022 pdf", []int64{files["Invoice.pdf"], files["invoice-2022.pdf"]}},
+		{"searchTest 2021", []int64{files["invoice-2021.pdf"]}},
+		{"INVOICE_2021", []int64{files["invoice-2021.pdf"]}},
+		{"searchTest rep", []int64{files["report 2022.odt"]}},
+		{"searchable", []int64{files["renamed.txt"]}},
+		{"renamed", nil},
+		{"invoice or", nil},
+		{"searchTest \"quoted", nil},
+		{" - ", nil},
+	}
+	search := func() {
+		for _, condition := range conditions {
+			found, err := SearchFiles(db, condition.query)
+			var ids []int64
+			for _, file := range found {
+				ids = append(ids, file.Id)
+			}
+			if err != nil || fmt.Sprint(ids) != fmt.Sprint(condition.expected) {
+				t.Errorf("Expected %v for %q but got %v (%v)", condition.expected, condition.query, ids, err)
+			}
+		}
+	}
+	search()
+	// without the index, as when the module it uses isn't available
+	for name := range searchTriggers {
+		_, _ = db.Exec("DROP TRIGGER " + name)
+	}
+	search()
+	// the index is rebuilt when set up again
+	_, _ = db.Exec("DELETE FROM file_tags WHERE fid = ?", files["invoice-2021.pdf"])
+	if _, err := db.Exec("DELETE FROM file_md WHERE id = ?", files["invoice-2021.pdf"]); err != nil {
+		t.Fatalf("Could not delete file: %v", err)
+	}
+	if err := setUpFileSearch(db); err != nil {
+		t.Fatalf("Could not set up search: %v", err)
+	}
+	rows, _ := countRowsContext(context.Background(), db, "SELECT count(*) FROM file_search WHERE rowid = ?",
+		files["invoice-2021.pdf"])
+	if rows != 0 {
+		t.Error("Expected the index to be rebuilt")
+	}
+	conditions[1].expected, conditions[2].expected = nil, nil
+	search()
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"time"
+)
+
+// Records the size and modification time of a file so its attributes can be reported without reaching the storage.
+func SetFileStat(db *sql.DB, fileId int64, size int64, modTime time.Time) error {
+	return SetFileStatContext(context.Background(), db, fileId, size, modTime)
+}
+
+func SetFileStatContext(ctx context.Context, db *sql.DB, fileId int64, size int64, modTime time.Time) error {
+	_, err := execWrite(ctx, db, "UPDATE file_md SET size = ?, mtime = ? WHERE id = ?", size, modTime.Unix(), fileId)
+	return err
+}
+
+// Gets the size and modification time recorded for a file by SetFileStat. Reports false if they were never recorded.
+func GetFileStat(db *sql.DB, fileId int64) (int64, time.Time, bool, error) {
+	return GetFileStatContext(context.Background(), db, fileId)
+}
+
+func GetFileStatContext(ctx context.Context, db *sql.DB, fileId int64) (int64, time.Time, bool, error) {
+	var size, mtime sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT size, mtime FROM file_md WHERE id = ?", fileId).Scan(&size, &mtime)
+	if err == sql.ErrNoRows {
+		return 0, time.Time{}, false, nil
+	}
+	if err != nil || !size.Valid || !mtime.Valid {
+		return 0, time.Time{}, false, err
+	}
+	return size.Int64, time.Unix(mtime.Int64, 0), true, nil
+}
+
+// Counts the files in the filesystem and adds up their sizes as recorded by SetFileStat, without reaching the storage.
+// Files without a recorded size count as empty.
+func GetFileTotals(db *sql.DB) (int, int64, error) {
+	return GetFileTotalsContext(context.Background(), db)
+}
+
+func GetFileTotalsContext(ctx context.Context, db *sql.DB) (int, int64, error) {
+	defer observe("GetFileTotals", time.Now())
+	var count int
+	var size sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT count(*), sum(size) FROM file_md").Scan(&count, &size); err != nil {
+		return 0, 0, err
+	}
+	return count, size.Int64, nil
+}
+
+// Records the size, modification time, checksum and MIME type of a file.
+func SetFileDetails(db *sql.DB, fileId int64, details metadata.FileDetails) error {
+	return SetFileDetailsContext(context.Background(), db, fileId, details)
+}
+
+func SetFileDetailsContext(ctx context.Context, db *sql.DB, fileId int64, details metadata.FileDetails) error {
+	defer observe("SetFileDetails", time.Now())
+	_, err := execWrite(ctx, db, "UPDATE file_md SET size = ?, mtime = ?, checksum = ?, mime = ? WHERE id = ?",
+		details.Size, details.ModTime.Unix(), details.Checksum, details.MimeType, fileId)
+	return err
+}
+
+// Gets what was recorded about the content of a file. Reports false if the file doesn't exist.
+func GetFileDetails(db *sql.DB, fileId int64) (metadata.FileDetails, bool, error) {
+	return GetFileDetailsContext(context.Background(), db, fileId)
+}
+
+func GetFileDetailsContext(ctx context.Context, db *sql.DB, fileId int64) (metadata.FileDetails, bool, error) {
+	defer observe("GetFileDetails", time.Now())
+	var size, mtime sql.NullInt64
+	var checksum, mime sql.NullString
+	err := db.QueryRowContext(ctx, "SELECT size, mtime, checksum, mime FROM file_md WHERE id = ?", fileId).
+		Scan(&size, &mtime, &checksum, &mime)
+	if err == sql.ErrNoRows {
+		return metadata.FileDetails{}, false, nil
+	}
+	if err != nil {
+		return metadata.FileDetails{}, false, err
+	}
+	details := metadata.FileDetails{Size: size.Int64, Checksum: checksum.String, MimeType: mime.String}
+	if mtime.Valid {
+		details.ModTime = time.Unix(mtime.Int64, 0)
+	}
+	return details, true, nil
+}
+
+// Lists up to limit files, ordered by id and starting after the id passed in, missing any of the details recorded by
+// SetFileDetails, e.g. because they were indexed before the details were. Passing the id of the last file listed
+// pages through them all, even if some can't be filled in.
+func GetFilesMissingDetails(db *sql.DB, afterId int64, limit int) ([]metadata.FileInfo, error) {
+	return GetFilesMissingDetailsContext(context.Background(), db, afterId, limit)
+}
+
+func GetFilesMissingDetailsContext(ctx context.Context, db *sql.DB, afterId int64,
+	limit int) ([]metadata.FileInfo, error) {
+	return queryFiles(ctx, db, "SELECT id, name, path FROM file_md WHERE id > ? AND "+
+		"(size IS NULL OR mtime IS NULL OR checksum IS NULL OR mime IS NULL) ORDER BY id ASC LIMIT ?", afterId, limit)
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+	"time"
+)
+
+// Verifies the recorded size and modification time of files are returned.
+func TestFileStat(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "stat", 1)
+	recorded, _ := CreateFileInPath(db, "recorded", "somePath", tags)
+	timeOnly, _ := CreateFileInPath(db, "timeOnly", "somePath", tags)
+	modTime := time.Unix(1563100000, 0)
+	SetFileStat(db, recorded.Id, 1234, modTime)
+	SetFileModTime(db, timeOnly.Id, modTime)
+	conditions := []struct {
+		fileId       int64
+		expectedOk   bool
+		expectedSize int64
+	}{
+		{recorded.Id, true, 1234},
+		{timeOnly.Id, false, 0},
+		{-1, false, 0},
+	}
+	for _, condition := range conditions {
+		size, mtime, ok, err := GetFileStat(db, condition.fileId)
+		if err != nil {
+			t.Errorf("Could not get stat of %d: %v", condition.fileId, err)
+		}
+		if ok != condition.expectedOk || size != condition.expectedSize || (ok && !mtime.Equal(modTime)) {
+			t.Errorf("Expected %v %d for %d but got %v %d %v", condition.expectedOk, condition.expectedSize,
+				condition.fileId, ok, size, mtime)
+		}
+	}
+}
+
+// Verifies the files are counted and their recorded sizes added up, those without one counting as empty.
+func TestGetFileTotals(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	conditions := []struct {
+		name          string
+		size          int64
+		expectedCount int
+		expectedSize  int64
+	}{
+		{"", 0, 0, 0},
+		{"recorded", 1234, 1, 1234},
+		{"unrecorded", -1, 2, 1234},
+		{"another", 100, 3, 1334},
+	}
+	tags, _ := createTags(db, "totals", 1)
+	for _, condition := range conditions {
+		if condition.name != "" {
+			file, _ := CreateFileInPath(db, condition.name, "totalsPath", tags)
+			if condition.size >= 0 {
+				SetFileStat(db, file.Id, condition.size, time.Unix(1563100000, 0))
+			}
+		}
+		count, size, err := GetFileTotals(db)
+		if err != nil || count != condition.expectedCount || size != condition.expectedSize {
+			t.Errorf("Expected %d files of %d bytes after adding %q but got %d of %d (%v)", condition.expectedCount,
+				condition.expectedSize, condition.name, count, size, err)
+		}
+	}
+}
+
+// Verifies the details of files are recorded and files missing any are listed.
+func TestFileDetails(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "details", 1)
+	complete, _ := CreateFileInPath(db, "complete", "detailsPath", tags)
+	statOnly, _ := CreateFileInPath(db, "statOnly", "detailsPath", tags)
+	none, _ := CreateFileInPath(db, "none", "detailsPath", tags)
+	recorded := metadata.FileDetails{Size: 12, ModTime: time.Unix(1563100000, 0), Checksum: "abc", MimeType: "text/plain"}
+	SetFileDetails(db, complete.Id, recorded)
+	SetFileStat(db, statOnly.Id, 12, recorded.ModTime)
+	conditions := []struct {
+		fileId     int64
+		expectedOk bool
+		expected   metadata.FileDetails
+	}{
+		{complete.Id, true, recorded},
+		{statOnly.Id, true, metadata.FileDetails{Size: 12, ModTime: recorded.ModTime}},
+		{none.Id, true, metadata.FileDetails{}},
+		{-1, false, metadata.FileDetails{}},
+	}
+	for _, condition := range conditions {
+		details, ok, err := GetFileDetails(db, condition.fileId)
+		if err != nil || ok != condition.expectedOk || details != condition.expected {
+			t.Errorf("Expected %v %v for %d but got %v %v (%v)", condition.expectedOk, condition.expected,
+				condition.fileId, ok, details, err)
+		}
+	}
+	pageConditions := []struct {
+		afterId  int64
+		limit    int
+		expected []int64
+	}{
+		{complete.Id - 1, 10, []int64{statOnly.Id, none.Id}},
+		{complete.Id - 1, 1, []int64{statOnly.Id}},
+		{statOnly.Id, 10, []int64{none.Id}},
+		{none.Id, 10, nil},
+	}
+	for _, condition := range pageConditions {
+		files, err := GetFilesMissingDetails(db, condition.afterId, condition.limit)
+		var ids []int64
+		for _, file := range files {
+			ids = append(ids, file.Id)
+		}
+		if err != nil || fmt.Sprint(ids) != fmt.Sprint(condition.expected) {
+			t.Errorf("Expected %v after %d but got %v (%v)", condition.expected, condition.afterId, ids, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Most statements cached for one database. Queries past it (e.g. filters with unusual numbers of tags) are prepared on
+// every call as before.
+const maxCachedStatements = 100
+
+// Statements of the lookups run for every FUSE request, by database and query. A prepared statement can be shared by
+// goroutines and database/sql prepares it again on whichever connection of the pool runs it, so each query only needs
+// preparing once per database rather than on every call.
+var statementCache = struct {
+	sync.Mutex
+	statements map[*sql.DB]map[string]*sql.Stmt
+}{statements: make(map[*sql.DB]map[string]*sql.Stmt)}
+
+// Returns a prepared statement for the query, preparing and caching it the first time the query is run against the
+// database. The function returned must be called once the statement is no longer needed; it closes statements that
+// weren't cached.
+func prepareCached(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, func(), error) {
+	statementCache.Lock()
+	stmt, ok := statementCache.statements[db][query]
+	statementCache.Unlock()
+	if ok {
+		return stmt, func() {}, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	statementCache.Lock()
+	defer statementCache.Unlock()
+	cached := statementCache.statements[db]
+	if cached == nil {
+		cached = make(map[string]*sql.Stmt)
+		statementCache.statements[db] = cached
+	}
+	// another goroutine may have prepared the same query in the meantime
+	if existing, ok := cached[query]; ok {
+		stmt.Close()
+		return existing, func() {}, nil
+	}
+	if len(cached) >= maxCachedStatements {
+		return stmt, func() { stmt.Close() }, nil
+	}
+	cached[query] = stmt
+	return stmt, func() {}, nil
+}
+
+// Closes a database along with the statements and tag lookups cached for it and its turns to write. Databases opened
+// with Open should be closed with this rather than their Close method so the statements don't outlive them.
+func Close(db *sql.DB) error {
+	statementCache.Lock()
+	for _, stmt := range statementCache.statements[db] {
+		stmt.Close()
+	}
+	delete(statementCache.statements, db)
+	statementCache.Unlock()
+	forgetWriter(db)
+	forgetTags(db)
+	return db.Close()
+}
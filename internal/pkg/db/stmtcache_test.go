@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Verifies statements are prepared once per database and dropped when it is closed.
+func TestPrepareCached(t *testing.T) {
+	db := getDb(t)
+	first, release, err := prepareCached(context.Background(), db, "SELECT count(*) FROM tag")
+	if err != nil {
+		t.Fatalf("Could not prepare statement: %v", err)
+	}
+	release()
+	second, release, _ := prepareCached(context.Background(), db, "SELECT count(*) FROM tag")
+	release()
+	if first != second {
+		t.Error("Expected the statement to be prepared once")
+	}
+	// statements past the limit still work but aren't kept
+	for i := 0; i < maxCachedStatements; i++ {
+		stmt, release, err := prepareCached(context.Background(), db, fmt.Sprintf("SELECT %d", i))
+		if err != nil {
+			t.Fatalf("Could not prepare statement: %v", err)
+		}
+		var value int
+		if err = stmt.QueryRow().Scan(&value); err != nil || value != i {
+			t.Errorf("Expected %d but got %d (%v)", i, value, err)
+		}
+		release()
+	}
+	if cached := len(statementCache.statements[db]); cached != maxCachedStatements {
+		t.Errorf("Expected %d cached statements but got %d", maxCachedStatements, cached)
+	}
+	if err = Close(db); err != nil {
+		t.Errorf("Could not close database: %v", err)
+	}
+	if _, ok := statementCache.statements[db]; ok {
+		t.Error("Expected the statements of the database to be dropped when it is closed")
+	}
+}
+
+// Compares looking up a tag with its statement cached against preparing it on every call.
+func BenchmarkFindTag(b *testing.B) {
+	db, err := Open("file::memory:?cache=shared")
+	if err != nil {
+		b.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(db)
+	tags, err := createTags(db, "benchmark", 50)
+	if err != nil {
+		b.Fatalf("Could not create tags: %v", err)
+	}
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := FindTag(db, tags[i%len(tags)].Text); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("prepared per call", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			stmt, err := db.Prepare("select id, txt from tag where " + tagNameCondition)
+			if err != nil {
+				b.Fatal(err)
+			}
+			text := tags[i%len(tags)].Text
+			var id int64
+			if err = stmt.QueryRow(text, text).Scan(&id, &text); err != nil {
+				b.Fatal(err)
+			}
+			stmt.Close()
+		}
+	})
+}
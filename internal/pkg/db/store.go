@@ -0,0 +1,551 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"github.com/cfagiani/cotfs/internal/pkg/query"
+	"time"
+)
+
+// MetadataStore holds the tags of files. It covers the operations needed to index files and to browse and tag them
+// through the mount, so both can run against other backends (or mocks) than the SQLite database implemented by the
+// functions of this package. Features not every backend has (permissions, the trash, saved queries and so on) are
+// left to the optional interfaces below, which the mount checks the store for.
+type MetadataStore interface {
+	// Adds a tag associated with the tags in the context, returning the existing tag if there is one with the name.
+	AddTag(ctx context.Context, name string, tagContext []metadata.TagInfo) (metadata.TagInfo, error)
+	// Adds a chain of tags, associating each with the others and the context.
+	AddTags(ctx context.Context, names []string, tagContext []metadata.TagInfo) ([]metadata.TagInfo, error)
+	// Looks up a file by its name and the directory on disk it is in. Returns metadata.UnknownFile if not found.
+	FindFileByAbsPath(ctx context.Context, name string, absPath string) (metadata.FileInfo, error)
+	// Adds a file tagged with the tags passed in.
+	CreateFileInPath(ctx context.Context, name string, absPath string, tags []metadata.TagInfo) (metadata.FileInfo,
+		error)
+	// Adds many files, each tagged with its tags, returning them in the order of the entries.
+	CreateFiles(ctx context.Context, entries []NewFile) ([]metadata.FileInfo, error)
+	// Gets what was recorded about the content of a file. Reports false if the file doesn't exist.
+	GetFileDetails(ctx context.Context, fileId int64) (metadata.FileDetails, bool, error)
+	// Records the size, modification time, checksum and MIME type of a file.
+	SetFileDetails(ctx context.Context, fileId int64, details metadata.FileDetails) error
+	// Lists the tags applied to a file.
+	GetTagsForFile(ctx context.Context, fileId int64) ([]metadata.TagInfo, error)
+	// Applies tags to a file.
+	TagFile(ctx context.Context, fileId int64, tags []metadata.TagInfo) error
+	// Records the start of a run of the indexer over a directory.
+	StartIndexRun(ctx context.Context, root string) (metadata.IndexRun, error)
+	// Records that a run of the indexer went through its whole directory.
+	FinishIndexRun(ctx context.Context, runId int64) error
+	// Records that a run of the indexer updated a file, or created it if created is set.
+	SetFileIndexRun(ctx context.Context, fileId int64, runId int64, created bool) error
+
+	// Looks up a tag by name (or alias, for stores that have them). Returns metadata.UnknownTag if there is none.
+	FindTag(ctx context.Context, name string) (metadata.TagInfo, error)
+	// Looks up the tag with a name if it co-occurs with the tag named other. Returns metadata.UnknownTag if it
+	// doesn't.
+	GetCoincidentTag(ctx context.Context, name string, other string) (metadata.TagInfo, error)
+	// Lists the tags co-occurring with the tags of the filter, ordered by name and optionally filtered by name.
+	GetCoincidentTagsForFilter(ctx context.Context, filter TagFilter, name string) ([]metadata.TagInfo, error)
+	// Counts the tags.
+	CountTags(ctx context.Context) (int, error)
+	// Renames a tag. If another tag already has the name, that tag is returned with ErrTagExists.
+	RenameTag(ctx context.Context, tag metadata.TagInfo, newName string) (metadata.TagInfo, error)
+	// Moves the files and co-occurrences of the source tag to the target tag and deletes the source.
+	MergeTags(ctx context.Context, source metadata.TagInfo, target metadata.TagInfo) error
+	// Deletes a tag along with its associations.
+	DeleteTag(ctx context.Context, tag metadata.TagInfo) error
+	// Deletes a tag and removes it from every file, tagging the files left without tags with the fallback tag.
+	DeleteTagRecursive(ctx context.Context, tag metadata.TagInfo, fallback string) error
+	// Removes the association between two tags.
+	UnassociateTag(ctx context.Context, tagOne metadata.TagInfo, tagTwo metadata.TagInfo) error
+	// Looks up a file by its id. Returns metadata.UnknownFile if not found.
+	GetFile(ctx context.Context, fileId int64) (metadata.FileInfo, error)
+	// Lists the files selected by the filter, optionally filtered by name (see MatchName).
+	GetFilesMatchingFilter(ctx context.Context, filter TagFilter, name string) ([]metadata.FileInfo, error)
+	// Lists the files selected by the filter in the order requested, optionally filtered by name.
+	GetFilesMatchingFilterOrdered(ctx context.Context, filter TagFilter, name string,
+		order FileOrder) ([]metadata.FileInfo, error)
+	// Counts the files selected by the filter.
+	CountFilesMatchingFilter(ctx context.Context, filter TagFilter) (int, error)
+	// Lists the files that have exactly one tag, optionally filtered by name.
+	GetFilesWithSingleTag(ctx context.Context, name string) ([]metadata.FileInfo, error)
+	// Counts the files whose only tag is the tag passed in.
+	GetFileCountWithSingleTag(ctx context.Context, tag metadata.TagInfo) (int, error)
+	// Counts the files tagged with the tag passed in.
+	CountFilesWithTag(ctx context.Context, tag metadata.TagInfo) (int, error)
+	// Lists the files without any tag other than the fallback tag, leaving out those with any of the excluded tags,
+	// optionally filtered by name.
+	GetUntaggedFilesExcluding(ctx context.Context, fallback string, excluded []metadata.TagInfo,
+		name string) ([]metadata.FileInfo, error)
+	// Counts the tags applied to a file.
+	GetTagCountForFile(ctx context.Context, fileId int64) (int, error)
+	// Counts the files and adds up their recorded sizes.
+	GetFileTotals(ctx context.Context) (int, int64, error)
+	// Gets the size and modification time recorded for a file. Reports false if they were never recorded.
+	GetFileStat(ctx context.Context, fileId int64) (int64, time.Time, bool, error)
+	// Records the size and modification time of a file.
+	SetFileStat(ctx context.Context, fileId int64, size int64, modTime time.Time) error
+	// Adds a file tagged with the tags passed in unless it is already recorded, in which case it is tagged with them.
+	UpsertFile(ctx context.Context, name string, absPath string, tags []metadata.TagInfo) (metadata.FileInfo, error)
+	// Replaces the tags of a file with the tags passed in.
+	SetFileTags(ctx context.Context, fileId int64, tags []metadata.TagInfo) error
+	// Removes a tag from a file.
+	UntagFile(ctx context.Context, fileId int64, tagId int64) error
+	// Removes the last tag of the path from the files that have all the tags in it.
+	UntagFiles(ctx context.Context, path []metadata.TagInfo) error
+	// Removes tags from files and applies others to them, all at once.
+	RetagFiles(ctx context.Context, fileIds []int64, removed []metadata.TagInfo, added []metadata.TagInfo) error
+	// Deletes the records of files, returning the number deleted.
+	DeleteFiles(ctx context.Context, fileIds []int64) (int, error)
+}
+
+// HierarchyStore is a MetadataStore that keeps tags in a hierarchy of parent and child tags.
+type HierarchyStore interface {
+	SetTagParent(ctx context.Context, parent metadata.TagInfo, child metadata.TagInfo) error
+	RemoveTagParent(ctx context.Context, parent metadata.TagInfo, child metadata.TagInfo) error
+	GetRootTags(ctx context.Context) ([]metadata.TagInfo, error)
+	GetChildTags(ctx context.Context, parent metadata.TagInfo) ([]metadata.TagInfo, error)
+	GetChildTag(ctx context.Context, parent metadata.TagInfo, name string) (metadata.TagInfo, error)
+}
+
+// AliasStore is a MetadataStore whose tags can have alternate names.
+type AliasStore interface {
+	AddAlias(ctx context.Context, tag metadata.TagInfo, alias string) error
+	RemoveAlias(ctx context.Context, alias string) error
+}
+
+// PermissionStore is a MetadataStore that keeps an owner and mode for tags and files.
+type PermissionStore interface {
+	GetTagPermissions(ctx context.Context, tag metadata.TagInfo) (metadata.Permissions, bool, error)
+	SetTagPermissions(ctx context.Context, tag metadata.TagInfo, perm metadata.Permissions) error
+	GetFilePermissions(ctx context.Context, fileId int64) (metadata.Permissions, bool, error)
+	SetFilePermissions(ctx context.Context, fileId int64, perm metadata.Permissions) error
+}
+
+// ACLStore is a MetadataStore whose tags can be granted to users, hiding them from everyone else.
+type ACLStore interface {
+	GrantTag(ctx context.Context, tag metadata.TagInfo, uid uint32) error
+	RevokeTag(ctx context.Context, tag metadata.TagInfo, uid uint32) error
+	GetHiddenTags(ctx context.Context, uid uint32) ([]metadata.TagInfo, error)
+}
+
+// TrashStore is a MetadataStore that keeps the tags removed from files in a trash they can be restored from.
+type TrashStore interface {
+	TrashFileTag(ctx context.Context, fileId int64, tagId int64) error
+	RestoreFile(ctx context.Context, fileId int64) error
+	PurgeTrash(ctx context.Context, before time.Time) (int, error)
+}
+
+// RatingStore is a MetadataStore that keeps the ratings of files and which of them are favorites.
+type RatingStore interface {
+	GetFileRating(ctx context.Context, fileId int64) (int, error)
+	SetFileRating(ctx context.Context, fileId int64, rating int) error
+	SetFavorite(ctx context.Context, fileId int64, favorite bool) error
+	GetFavoriteFilesExcluding(ctx context.Context, excluded []metadata.TagInfo,
+		name string) ([]metadata.FileInfo, error)
+}
+
+// AttributeStore is a MetadataStore that keeps key=value attributes of files.
+type AttributeStore interface {
+	GetFileAttributes(ctx context.Context, fileId int64) (map[string]string, error)
+	SetFileAttribute(ctx context.Context, fileId int64, key string, value string) error
+	RemoveFileAttribute(ctx context.Context, fileId int64, key string) error
+}
+
+// QueryStore is a MetadataStore that lists the files matching boolean tag expressions and keeps named expressions.
+type QueryStore interface {
+	GetFilesMatchingQuery(ctx context.Context, expr query.Expr, names ...string) ([]metadata.FileInfo, error)
+	GetSavedQuery(ctx context.Context, name string) (metadata.SavedQuery, error)
+	GetSavedQueries(ctx context.Context) ([]metadata.SavedQuery, error)
+	SaveQuery(ctx context.Context, saved metadata.SavedQuery) error
+	DeleteSavedQuery(ctx context.Context, name string) error
+}
+
+// DateStore is a MetadataStore that lists files by the date they were taken or modified.
+type DateStore interface {
+	GetFileDatesExcluding(ctx context.Context, date []string, excluded []metadata.TagInfo) ([]string, error)
+	GetFilesByDateExcluding(ctx context.Context, date []string, excluded []metadata.TagInfo,
+		name string) ([]metadata.FileInfo, error)
+}
+
+// AccessTimeStore is a MetadataStore that keeps the times files were last accessed.
+type AccessTimeStore interface {
+	GetFileAccessTime(ctx context.Context, fileId int64) (time.Time, bool, error)
+	SetFileAccessTimes(ctx context.Context, accessed map[int64]time.Time) error
+}
+
+// LocationStore is a MetadataStore that keeps files elsewhere than on local disk.
+type LocationStore interface {
+	GetFileLocation(ctx context.Context, fileId int64) (metadata.Location, error)
+}
+
+// MaintenanceStore is a MetadataStore that can check itself and clean up what it no longer needs.
+type MaintenanceStore interface {
+	Check(ctx context.Context, options CheckOptions) (CheckReport, error)
+	CollectGarbage(ctx context.Context) (GarbageReport, error)
+	RebuildTagAssociations(ctx context.Context) (AssociationReport, error)
+	CollectOrphanFiles(ctx context.Context, policy OrphanPolicy, fallback string) (int, error)
+}
+
+// WatchedStore is a MetadataStore shared with other processes, whose changes it can detect, that caches tag lookups.
+type WatchedStore interface {
+	NewChangeDetector() (*ChangeDetector, error)
+	FlushCache()
+}
+
+// SQLiteStore is the MetadataStore kept in a database opened with Open. It implements every optional interface.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var (
+	_ MetadataStore    = (*SQLiteStore)(nil)
+	_ HierarchyStore   = (*SQLiteStore)(nil)
+	_ AliasStore       = (*SQLiteStore)(nil)
+	_ PermissionStore  = (*SQLiteStore)(nil)
+	_ ACLStore         = (*SQLiteStore)(nil)
+	_ TrashStore       = (*SQLiteStore)(nil)
+	_ RatingStore      = (*SQLiteStore)(nil)
+	_ AttributeStore   = (*SQLiteStore)(nil)
+	_ QueryStore       = (*SQLiteStore)(nil)
+	_ DateStore        = (*SQLiteStore)(nil)
+	_ AccessTimeStore  = (*SQLiteStore)(nil)
+	_ LocationStore    = (*SQLiteStore)(nil)
+	_ MaintenanceStore = (*SQLiteStore)(nil)
+	_ WatchedStore     = (*SQLiteStore)(nil)
+)
+
+func NewSQLiteStore(database *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: database}
+}
+
+func (s *SQLiteStore) AddTag(ctx context.Context, name string, tagContext []metadata.TagInfo) (metadata.TagInfo,
+	error) {
+	return AddTagContext(ctx, s.db, name, tagContext)
+}
+
+func (s *SQLiteStore) AddTags(ctx context.Context, names []string, tagContext []metadata.TagInfo) ([]metadata.TagInfo,
+	error) {
+	return AddTagsContext(ctx, s.db, names, tagContext)
+}
+
+func (s *SQLiteStore) FindFileByAbsPath(ctx context.Context, name string, absPath string) (metadata.FileInfo, error) {
+	return FindFileByAbsPathContext(ctx, s.db, name, absPath)
+}
+
+func (s *SQLiteStore) CreateFileInPath(ctx context.Context, name string, absPath string,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
+	return CreateFileInPathContext(ctx, s.db, name, absPath, tags)
+}
+
+func (s *SQLiteStore) CreateFiles(ctx context.Context, entries []NewFile) ([]metadata.FileInfo, error) {
+	return CreateFilesContext(ctx, s.db, entries)
+}
+
+func (s *SQLiteStore) GetFileDetails(ctx context.Context, fileId int64) (metadata.FileDetails, bool, error) {
+	return GetFileDetailsContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFileDetails(ctx context.Context, fileId int64, details metadata.FileDetails) error {
+	return SetFileDetailsContext(ctx, s.db, fileId, details)
+}
+
+func (s *SQLiteStore) GetTagsForFile(ctx context.Context, fileId int64) ([]metadata.TagInfo, error) {
+	return GetTagsForFileContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) TagFile(ctx context.Context, fileId int64, tags []metadata.TagInfo) error {
+	return TagFileContext(ctx, s.db, fileId, tags)
+}
+
+func (s *SQLiteStore) StartIndexRun(ctx context.Context, root string) (metadata.IndexRun, error) {
+	return StartIndexRunContext(ctx, s.db, root)
+}
+
+func (s *SQLiteStore) FinishIndexRun(ctx context.Context, runId int64) error {
+	return FinishIndexRunContext(ctx, s.db, runId)
+}
+
+func (s *SQLiteStore) SetFileIndexRun(ctx context.Context, fileId int64, runId int64, created bool) error {
+	return SetFileIndexRunContext(ctx, s.db, fileId, runId, created)
+}
+
+func (s *SQLiteStore) FindTag(ctx context.Context, name string) (metadata.TagInfo, error) {
+	return FindTagContext(ctx, s.db, name)
+}
+
+func (s *SQLiteStore) GetCoincidentTag(ctx context.Context, name string, other string) (metadata.TagInfo, error) {
+	return GetCoincidentTagContext(ctx, s.db, name, other)
+}
+
+func (s *SQLiteStore) GetCoincidentTagsForFilter(ctx context.Context, filter TagFilter,
+	name string) ([]metadata.TagInfo, error) {
+	return GetCoincidentTagsForFilterContext(ctx, s.db, filter, name)
+}
+
+func (s *SQLiteStore) CountTags(ctx context.Context) (int, error) {
+	return CountTagsContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) RenameTag(ctx context.Context, tag metadata.TagInfo, newName string) (metadata.TagInfo, error) {
+	return RenameTagContext(ctx, s.db, tag, newName)
+}
+
+func (s *SQLiteStore) MergeTags(ctx context.Context, source metadata.TagInfo, target metadata.TagInfo) error {
+	return MergeTagsContext(ctx, s.db, source, target)
+}
+
+func (s *SQLiteStore) DeleteTag(ctx context.Context, tag metadata.TagInfo) error {
+	return DeleteTagContext(ctx, s.db, tag)
+}
+
+func (s *SQLiteStore) DeleteTagRecursive(ctx context.Context, tag metadata.TagInfo, fallback string) error {
+	return DeleteTagRecursiveContext(ctx, s.db, tag, fallback)
+}
+
+func (s *SQLiteStore) UnassociateTag(ctx context.Context, tagOne metadata.TagInfo, tagTwo metadata.TagInfo) error {
+	return UnassociateTagContext(ctx, s.db, tagOne, tagTwo)
+}
+
+func (s *SQLiteStore) GetFile(ctx context.Context, fileId int64) (metadata.FileInfo, error) {
+	return GetFileContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) GetFilesMatchingFilter(ctx context.Context, filter TagFilter,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterContext(ctx, s.db, filter, name)
+}
+
+func (s *SQLiteStore) GetFilesMatchingFilterOrdered(ctx context.Context, filter TagFilter, name string,
+	order FileOrder) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingFilterOrderedContext(ctx, s.db, filter, name, order)
+}
+
+func (s *SQLiteStore) CountFilesMatchingFilter(ctx context.Context, filter TagFilter) (int, error) {
+	return CountFilesMatchingFilterContext(ctx, s.db, filter)
+}
+
+func (s *SQLiteStore) GetFilesWithSingleTag(ctx context.Context, name string) ([]metadata.FileInfo, error) {
+	return GetFilesWithSingleTagContext(ctx, s.db, name)
+}
+
+func (s *SQLiteStore) GetFileCountWithSingleTag(ctx context.Context, tag metadata.TagInfo) (int, error) {
+	return GetFileCountWithSingleTagContext(ctx, s.db, tag)
+}
+
+func (s *SQLiteStore) CountFilesWithTag(ctx context.Context, tag metadata.TagInfo) (int, error) {
+	return CountFilesWithTagContext(ctx, s.db, tag)
+}
+
+func (s *SQLiteStore) GetUntaggedFilesExcluding(ctx context.Context, fallback string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetUntaggedFilesExcludingContext(ctx, s.db, fallback, excluded, name)
+}
+
+func (s *SQLiteStore) GetTagCountForFile(ctx context.Context, fileId int64) (int, error) {
+	return GetTagCountForFileContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) GetFileTotals(ctx context.Context) (int, int64, error) {
+	return GetFileTotalsContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) GetFileStat(ctx context.Context, fileId int64) (int64, time.Time, bool, error) {
+	return GetFileStatContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFileStat(ctx context.Context, fileId int64, size int64, modTime time.Time) error {
+	return SetFileStatContext(ctx, s.db, fileId, size, modTime)
+}
+
+func (s *SQLiteStore) UpsertFile(ctx context.Context, name string, absPath string,
+	tags []metadata.TagInfo) (metadata.FileInfo, error) {
+	return UpsertFileContext(ctx, s.db, name, absPath, tags)
+}
+
+func (s *SQLiteStore) SetFileTags(ctx context.Context, fileId int64, tags []metadata.TagInfo) error {
+	return SetFileTagsContext(ctx, s.db, fileId, tags)
+}
+
+func (s *SQLiteStore) UntagFile(ctx context.Context, fileId int64, tagId int64) error {
+	return UntagFileContext(ctx, s.db, fileId, tagId)
+}
+
+func (s *SQLiteStore) UntagFiles(ctx context.Context, path []metadata.TagInfo) error {
+	return UntagFilesContext(ctx, s.db, path)
+}
+
+func (s *SQLiteStore) RetagFiles(ctx context.Context, fileIds []int64, removed []metadata.TagInfo,
+	added []metadata.TagInfo) error {
+	return RetagFilesContext(ctx, s.db, fileIds, removed, added)
+}
+
+func (s *SQLiteStore) DeleteFiles(ctx context.Context, fileIds []int64) (int, error) {
+	return DeleteFilesContext(ctx, s.db, fileIds)
+}
+
+func (s *SQLiteStore) SetTagParent(ctx context.Context, parent metadata.TagInfo, child metadata.TagInfo) error {
+	return SetTagParentContext(ctx, s.db, parent, child)
+}
+
+func (s *SQLiteStore) RemoveTagParent(ctx context.Context, parent metadata.TagInfo, child metadata.TagInfo) error {
+	return RemoveTagParentContext(ctx, s.db, parent, child)
+}
+
+func (s *SQLiteStore) GetRootTags(ctx context.Context) ([]metadata.TagInfo, error) {
+	return GetRootTagsContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) GetChildTags(ctx context.Context, parent metadata.TagInfo) ([]metadata.TagInfo, error) {
+	return GetChildTagsContext(ctx, s.db, parent)
+}
+
+func (s *SQLiteStore) GetChildTag(ctx context.Context, parent metadata.TagInfo, name string) (metadata.TagInfo,
+	error) {
+	return GetChildTagContext(ctx, s.db, parent, name)
+}
+
+func (s *SQLiteStore) AddAlias(ctx context.Context, tag metadata.TagInfo, alias string) error {
+	return AddAliasContext(ctx, s.db, tag, alias)
+}
+
+func (s *SQLiteStore) RemoveAlias(ctx context.Context, alias string) error {
+	return RemoveAliasContext(ctx, s.db, alias)
+}
+
+func (s *SQLiteStore) GetTagPermissions(ctx context.Context, tag metadata.TagInfo) (metadata.Permissions, bool,
+	error) {
+	return GetTagPermissionsContext(ctx, s.db, tag)
+}
+
+func (s *SQLiteStore) SetTagPermissions(ctx context.Context, tag metadata.TagInfo, perm metadata.Permissions) error {
+	return SetTagPermissionsContext(ctx, s.db, tag, perm)
+}
+
+func (s *SQLiteStore) GetFilePermissions(ctx context.Context, fileId int64) (metadata.Permissions, bool, error) {
+	return GetFilePermissionsContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFilePermissions(ctx context.Context, fileId int64, perm metadata.Permissions) error {
+	return SetFilePermissionsContext(ctx, s.db, fileId, perm)
+}
+
+func (s *SQLiteStore) GrantTag(ctx context.Context, tag metadata.TagInfo, uid uint32) error {
+	return GrantTagContext(ctx, s.db, tag, uid)
+}
+
+func (s *SQLiteStore) RevokeTag(ctx context.Context, tag metadata.TagInfo, uid uint32) error {
+	return RevokeTagContext(ctx, s.db, tag, uid)
+}
+
+func (s *SQLiteStore) GetHiddenTags(ctx context.Context, uid uint32) ([]metadata.TagInfo, error) {
+	return GetHiddenTagsContext(ctx, s.db, uid)
+}
+
+func (s *SQLiteStore) TrashFileTag(ctx context.Context, fileId int64, tagId int64) error {
+	return TrashFileTagContext(ctx, s.db, fileId, tagId)
+}
+
+func (s *SQLiteStore) RestoreFile(ctx context.Context, fileId int64) error {
+	return RestoreFileContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) PurgeTrash(ctx context.Context, before time.Time) (int, error) {
+	return PurgeTrashContext(ctx, s.db, before)
+}
+
+func (s *SQLiteStore) GetFileRating(ctx context.Context, fileId int64) (int, error) {
+	return GetFileRatingContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFileRating(ctx context.Context, fileId int64, rating int) error {
+	return SetFileRatingContext(ctx, s.db, fileId, rating)
+}
+
+func (s *SQLiteStore) SetFavorite(ctx context.Context, fileId int64, favorite bool) error {
+	return SetFavoriteContext(ctx, s.db, fileId, favorite)
+}
+
+func (s *SQLiteStore) GetFavoriteFilesExcluding(ctx context.Context, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFavoriteFilesExcludingContext(ctx, s.db, excluded, name)
+}
+
+func (s *SQLiteStore) GetFileAttributes(ctx context.Context, fileId int64) (map[string]string, error) {
+	return GetFileAttributesContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFileAttribute(ctx context.Context, fileId int64, key string, value string) error {
+	return SetFileAttributeContext(ctx, s.db, fileId, key, value)
+}
+
+func (s *SQLiteStore) RemoveFileAttribute(ctx context.Context, fileId int64, key string) error {
+	return RemoveFileAttributeContext(ctx, s.db, fileId, key)
+}
+
+func (s *SQLiteStore) GetFilesMatchingQuery(ctx context.Context, expr query.Expr,
+	names ...string) ([]metadata.FileInfo, error) {
+	return GetFilesMatchingQueryContext(ctx, s.db, expr, names...)
+}
+
+func (s *SQLiteStore) GetSavedQuery(ctx context.Context, name string) (metadata.SavedQuery, error) {
+	return GetSavedQueryContext(ctx, s.db, name)
+}
+
+func (s *SQLiteStore) GetSavedQueries(ctx context.Context) ([]metadata.SavedQuery, error) {
+	return GetSavedQueriesContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) SaveQuery(ctx context.Context, saved metadata.SavedQuery) error {
+	return SaveQueryContext(ctx, s.db, saved)
+}
+
+func (s *SQLiteStore) DeleteSavedQuery(ctx context.Context, name string) error {
+	return DeleteSavedQueryContext(ctx, s.db, name)
+}
+
+func (s *SQLiteStore) GetFileDatesExcluding(ctx context.Context, date []string,
+	excluded []metadata.TagInfo) ([]string, error) {
+	return GetFileDatesExcludingContext(ctx, s.db, date, excluded)
+}
+
+func (s *SQLiteStore) GetFilesByDateExcluding(ctx context.Context, date []string, excluded []metadata.TagInfo,
+	name string) ([]metadata.FileInfo, error) {
+	return GetFilesByDateExcludingContext(ctx, s.db, date, excluded, name)
+}
+
+func (s *SQLiteStore) GetFileAccessTime(ctx context.Context, fileId int64) (time.Time, bool, error) {
+	return GetFileAccessTimeContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) SetFileAccessTimes(ctx context.Context, accessed map[int64]time.Time) error {
+	return SetFileAccessTimesContext(ctx, s.db, accessed)
+}
+
+func (s *SQLiteStore) GetFileLocation(ctx context.Context, fileId int64) (metadata.Location, error) {
+	return GetFileLocationContext(ctx, s.db, fileId)
+}
+
+func (s *SQLiteStore) Check(ctx context.Context, options CheckOptions) (CheckReport, error) {
+	return CheckContext(ctx, s.db, options)
+}
+
+func (s *SQLiteStore) CollectGarbage(ctx context.Context) (GarbageReport, error) {
+	return CollectGarbageContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) RebuildTagAssociations(ctx context.Context) (AssociationReport, error) {
+	return RebuildTagAssociationsContext(ctx, s.db)
+}
+
+func (s *SQLiteStore) CollectOrphanFiles(ctx context.Context, policy OrphanPolicy, fallback string) (int, error) {
+	return CollectOrphanFilesContext(ctx, s.db, policy, fallback)
+}
+
+func (s *SQLiteStore) NewChangeDetector() (*ChangeDetector, error) {
+	return NewChangeDetector(s.db)
+}
+
+func (s *SQLiteStore) FlushCache() {
+	FlushCache(s.db)
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"container/list"
+	"database/sql"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"sync"
+	"time"
+)
+
+// Most tag lookups cached for one database; the least recently used ones are dropped past it.
+const maxCachedTags = 1000
+
+// Time a cached lookup is trusted for. Writes made through this package drop the cache straight away, but changes
+// made by other processes (i.e. the indexer) are only noticed through FlushCache, which mounts not watching the
+// database for changes never call.
+const tagCacheExpiry = 5 * time.Second
+
+// Results of FindTag and GetCoincidentTag, by database. Both run for every component of every path looked up, so
+// answering the repeated ones from memory spares most of the round trips to SQLite. The lookups of a database are all
+// dropped whenever anything is written to it, see execWrite and inTx, which is far rarer than reading.
+var tagCache = struct {
+	sync.Mutex
+	lookups map[*sql.DB]*tagLookups
+}{lookups: make(map[*sql.DB]*tagLookups)}
+
+// A lookup of the tag named (or aliased) tag, co-incident with other if pair is set.
+type tagKey struct {
+	tag   string
+	other string
+	pair  bool
+}
+
+type tagEntry struct {
+	key     tagKey
+	tag     metadata.TagInfo
+	expires time.Time
+}
+
+// The cached lookups of a database, most recently used first.
+type tagLookups struct {
+	entries map[tagKey]*list.Element
+	order   *list.List
+	// incremented whenever the lookups are dropped, so ones read from the database before then aren't cached
+	generation int64
+}
+
+// Returns the cached result of a lookup, if any, along with the generation to pass to cacheTag once the tag is read
+// from the database otherwise.
+func cachedTag(db *sql.DB, key tagKey) (metadata.TagInfo, bool, int64) {
+	tagCache.Lock()
+	defer tagCache.Unlock()
+	lookups := lookupsOf(db)
+	element, ok := lookups.entries[key]
+	if !ok {
+		return metadata.UnknownTag, false, lookups.generation
+	}
+	entry := element.Value.(*tagEntry)
+	if time.Now().After(entry.expires) {
+		lookups.order.Remove(element)
+		delete(lookups.entries, key)
+		return metadata.UnknownTag, false, lookups.generation
+	}
+	lookups.order.MoveToFront(element)
+	return entry.tag, true, lookups.generation
+}
+
+// Caches the result of a lookup read from the database, unless the lookups were dropped since the generation
+// returned by cachedTag as the result may predate the write that dropped them.
+func cacheTag(db *sql.DB, key tagKey, tag metadata.TagInfo, generation int64) {
+	tagCache.Lock()
+	defer tagCache.Unlock()
+	lookups := lookupsOf(db)
+	if lookups.generation != generation {
+		return
+	}
+	entry := &tagEntry{key: key, tag: tag, expires: time.Now().Add(tagCacheExpiry)}
+	if element, ok := lookups.entries[key]; ok {
+		element.Value = entry
+		lookups.order.MoveToFront(element)
+		return
+	}
+	lookups.entries[key] = lookups.order.PushFront(entry)
+	if lookups.order.Len() > maxCachedTags {
+		oldest := lookups.order.Back()
+		lookups.order.Remove(oldest)
+		delete(lookups.entries, oldest.Value.(*tagEntry).key)
+	}
+}
+
+// Drops the tag lookups cached for a database, to be called once something was written to it so later lookups see
+// the change. Mounts call it as well when another process changed the database.
+func FlushCache(db *sql.DB) {
+	tagCache.Lock()
+	defer tagCache.Unlock()
+	lookups := lookupsOf(db)
+	lookups.entries = make(map[tagKey]*list.Element)
+	lookups.order.Init()
+	lookups.generation++
+}
+
+// Returns the cached lookups of a database, which must be called with tagCache locked.
+func lookupsOf(db *sql.DB) *tagLookups {
+	lookups := tagCache.lookups[db]
+	if lookups == nil {
+		lookups = &tagLookups{entries: make(map[tagKey]*list.Element), order: list.New()}
+		tagCache.lookups[db] = lookups
+	}
+	return lookups
+}
+
+// Forgets the cached lookups of a database being closed.
+func forgetTags(db *sql.DB) {
+	tagCache.Lock()
+	delete(tagCache.lookups, db)
+	tagCache.Unlock()
+}
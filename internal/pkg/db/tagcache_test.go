@@ -0,0 +1,82 @@
+package db
+
+import (
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies tag lookups are answered from the cache until something is written to the database or it is flushed.
+func TestTagCache(t *testing.T) {
+	db := getDb(t)
+	defer Close(db)
+	tags, err := AddTags(db, []string{"cachedone", "cachedtwo"}, nil)
+	if err != nil {
+		t.Fatalf("Could not add tags: %v", err)
+	}
+	// renaming the tags behind the package's back, as another process would, leaves the cached lookups alone
+	lookups := []func() (metadata.TagInfo, error){
+		func() (metadata.TagInfo, error) { return FindTag(db, "cachedone") },
+		func() (metadata.TagInfo, error) { return GetCoincidentTag(db, "cachedone", "cachedtwo") },
+	}
+	for i, lookup := range lookups {
+		if tag, err := lookup(); err != nil || tag.Id != tags[0].Id {
+			t.Errorf("Expected lookup %d to find %v but got %v (%v)", i, tags[0], tag, err)
+		}
+	}
+	if _, err = db.Exec("UPDATE tag SET txt = txt || 'renamed'"); err != nil {
+		t.Fatalf("Could not rename tags: %v", err)
+	}
+	for i, lookup := range lookups {
+		if tag, err := lookup(); err != nil || tag.Id != tags[0].Id {
+			t.Errorf("Expected lookup %d to be cached but got %v (%v)", i, tag, err)
+		}
+	}
+	FlushCache(db)
+	for i, lookup := range lookups {
+		if tag, err := lookup(); err != nil || tag.Id != metadata.UnknownTag.Id {
+			t.Errorf("Expected lookup %d to miss once flushed but got %v (%v)", i, tag, err)
+		}
+	}
+	// writes drop the lookups that found nothing as well
+	added, err := AddTag(db, "cachedone", nil)
+	if err != nil {
+		t.Fatalf("Could not add tag: %v", err)
+	}
+	if tag, err := FindTag(db, "cachedone"); err != nil || tag.Id != added.Id {
+		t.Errorf("Expected the tag added to be found but got %v (%v)", tag, err)
+	}
+}
+
+// Verifies the least recently used lookups are dropped past maxCachedTags and lookups read before a flush aren't
+// cached.
+func TestTagCacheLimits(t *testing.T) {
+	db := getDb(t)
+	defer Close(db)
+	for i := 0; i <= maxCachedTags; i++ {
+		_, _, generation := cachedTag(db, tagKey{tag: "limit0"})
+		cacheTag(db, tagKey{tag: fmt.Sprintf("limit%d", i)}, metadata.TagInfo{Id: int64(i)}, generation)
+	}
+	if cached := len(tagCache.lookups[db].entries); cached != maxCachedTags {
+		t.Errorf("Expected %d cached lookups but got %d", maxCachedTags, cached)
+	}
+	conditions := []struct {
+		key      string
+		expected bool
+	}{
+		{"limit0", true},
+		{"limit1", false},
+		{fmt.Sprintf("limit%d", maxCachedTags), true},
+	}
+	for _, condition := range conditions {
+		if _, ok, _ := cachedTag(db, tagKey{tag: condition.key}); ok != condition.expected {
+			t.Errorf("Expected %s to be cached: %v", condition.key, condition.expected)
+		}
+	}
+	_, _, generation := cachedTag(db, tagKey{tag: "stale"})
+	FlushCache(db)
+	cacheTag(db, tagKey{tag: "stale"}, metadata.TagInfo{Id: 1}, generation)
+	if _, ok, _ := cachedTag(db, tagKey{tag: "stale"}); ok {
+		t.Error("Expected a lookup read before the flush not to be cached")
+	}
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Name of the tag files removed from a tag directory are moved to when the trash is enabled.
+const TrashTag = ".trash"
+
+// Removes a tag from a file, remembering when and which tag was removed so it can be put back with RestoreFile, and
+// moves the file to the trash tag. Removing the trash tag itself takes the file out of the trash for good.
+func TrashFileTag(db *sql.DB, fileId int64, tagId int64) error {
+	return TrashFileTagContext(context.Background(), db, fileId, tagId)
+}
+
+func TrashFileTagContext(ctx context.Context, db *sql.DB, fileId int64, tagId int64) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		trash, err := findOrInsertTag(ctx, tx, TrashTag)
+		if err != nil {
+			return err
+		}
+		statements := []struct {
+			query  string
+			params []interface{}
+		}{
+			{"DELETE FROM file_tags WHERE fid = ? AND tid = ?",
+				[]interface{}{fileId, tagId}},
+			{"INSERT OR REPLACE INTO trash VALUES (?,?,?)",
+				[]interface{}{fileId, tagId, time.Now().Unix()}},
+			{"INSERT OR IGNORE INTO file_tags (fid, tid) VALUES (?,?)",
+				[]interface{}{fileId, trash.Id}},
+		}
+		if tagId == trash.Id {
+			statements[1].query, statements[1].params = "DELETE FROM trash WHERE fid = ?", []interface{}{fileId}
+			statements = statements[:2]
+		}
+		for _, statement := range statements {
+			if _, err = tx.ExecContext(ctx, statement.query, statement.params...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Puts back the tags removed from a file by TrashFileTag and takes the file out of the trash.
+func RestoreFile(db *sql.DB, fileId int64) error {
+	return RestoreFileContext(context.Background(), db, fileId)
+}
+
+func RestoreFileContext(ctx context.Context, db *sql.DB, fileId int64) error {
+	statements := []struct {
+		query  string
+		params []interface{}
+	}{
+		{"INSERT OR IGNORE INTO file_tags (fid, tid) SELECT fid, tid FROM trash WHERE fid = ?",
+			[]interface{}{fileId}},
+		{"DELETE FROM trash WHERE fid = ?",
+			[]interface{}{fileId}},
+		{"DELETE FROM file_tags WHERE fid = ? AND tid IN (SELECT id FROM tag WHERE txt = ?)",
+			[]interface{}{fileId, TrashTag}},
+	}
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement.query, statement.params...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Empties the trash of the tags removed up to the time passed in. Files left without removed tags are taken out of
+// the trash. Returns the number of files taken out.
+func PurgeTrash(db *sql.DB, before time.Time) (int, error) {
+	return PurgeTrashContext(context.Background(), db, before)
+}
+
+func PurgeTrashContext(ctx context.Context, db *sql.DB, before time.Time) (int, error) {
+	var purged int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM trash WHERE deleted <= ?", before.Unix()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM file_tags WHERE tid IN (SELECT id FROM tag WHERE txt = ?) "+
+			"AND fid NOT IN (SELECT fid FROM trash)", TrashTag)
+		if err != nil {
+			return err
+		}
+		purged, err = res.RowsAffected()
+		return err
+	})
+	return int(purged), err
+}
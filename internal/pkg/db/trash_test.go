@@ -0,0 +1,65 @@
+package db
+
+import (
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// Verifies removed tags go to the trash and can be restored until the trash is purged.
+func TestTrash(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, err := createTags(db, "trash", 2)
+	if err != nil {
+		t.Errorf("Could not create tags %s", err)
+	}
+	file, _ := CreateFileInPath(db, "trashed", "somePath", tags)
+	conditions := []struct {
+		action       func() error
+		expectedTags []string
+	}{
+		{func() error { return TrashFileTag(db, file.Id, tags[0].Id) }, []string{TrashTag, tags[1].Text}},
+		{func() error {
+			_, err := CollectGarbage(db)
+			return err
+		}, []string{TrashTag, tags[1].Text}},
+		{func() error { return RestoreFile(db, file.Id) }, []string{tags[0].Text, tags[1].Text}},
+		{func() error { return TrashFileTag(db, file.Id, tags[0].Id) }, []string{TrashTag, tags[1].Text}},
+		{func() error {
+			_, err := PurgeTrash(db, time.Now().Add(-time.Hour))
+			return err
+		}, []string{TrashTag, tags[1].Text}},
+		{func() error {
+			_, err := PurgeTrash(db, time.Now().Add(time.Second))
+			return err
+		}, []string{tags[1].Text}},
+		{func() error { return RestoreFile(db, file.Id) }, []string{tags[1].Text}},
+		{func() error { return TrashFileTag(db, file.Id, tags[1].Id) }, []string{TrashTag}},
+		{func() error {
+			trash, _ := FindTag(db, TrashTag)
+			return TrashFileTag(db, file.Id, trash.Id)
+		}, nil},
+		{func() error { return RestoreFile(db, file.Id) }, nil},
+	}
+	for i, condition := range conditions {
+		if err := condition.action(); err != nil {
+			t.Errorf("Step %d failed: %v", i, err)
+		}
+		fileTags, _ := GetTagsForFile(db, file.Id)
+		if names := tagNames(fileTags); !reflect.DeepEqual(names, condition.expectedTags) {
+			t.Errorf("Step %d: expected tags %v but got %v", i, condition.expectedTags, names)
+		}
+	}
+}
+
+func tagNames(tags []metadata.TagInfo) []string {
+	var names []string
+	for _, tag := range tags {
+		names = append(names, tag.Text)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Number of times a write is attempted before a busy database error is given up on.
+const writeAttempts = 5
+
+// Time waited before attempting a busy write again; doubled after every attempt.
+const writeRetryDelay = 50 * time.Millisecond
+
+// Runs fn in a transaction, committing it if fn succeeds and rolling it back otherwise. All the statements run by fn
+// must go through the transaction passed to it. The busy timeout doesn't help a transaction that read the database
+// before another process wrote to it (SQLite fails it straight away rather than let it write on stale data), so
+// transactions failing because the database is busy are attempted again from the start; see retryBusy.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	return retryBusy(ctx, func() error {
+		return runTx(ctx, db, fn)
+	})
+}
+
+// Runs a write, attempting it again while it fails because another process (i.e. the indexer while mounted) holds a
+// lock on the database, so contention shows as a short delay rather than an I/O error. The delay before each attempt
+// is double the previous one; the write is given up on after writeAttempts attempts, or with the context's error once
+// the context is done.
+func retryBusy(ctx context.Context, write func() error) error {
+	delay := writeRetryDelay
+	err := write()
+	for attempt := 2; attempt <= writeAttempts && isBusy(err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		err = write()
+	}
+	return err
+}
+
+// Runs fn in a single transaction once it is its turn to write, dropping the tag lookups cached for the database
+// afterwards; see inTx.
+func runTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	done, err := awaitWrite(ctx, db)
+	if err != nil {
+		return err
+	}
+	defer done()
+	defer FlushCache(db)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Reports whether an error was caused by another connection holding a lock on the database (SQLITE_BUSY) or on one of
+// its tables or its schema (SQLITE_LOCKED).
+func isBusy(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked") ||
+		strings.Contains(message, "database schema is locked")
+}
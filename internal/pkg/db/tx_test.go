@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies a failing transaction undoes the statements it already ran.
+func TestInTxRollsBack(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	failure := errors.New("failed")
+	err := inTx(context.Background(), db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT INTO tag (txt) VALUES (?)", "rolledBack"); err != nil {
+			return err
+		}
+		return failure
+	})
+	if err != failure {
+		t.Errorf("Expected the error of the transaction but got %v", err)
+	}
+	tag, err := FindTag(db, "rolledBack")
+	if err != nil || tag.Id != metadata.UnknownTag.Id {
+		t.Errorf("Expected the insert to be rolled back but found %v (%v)", tag, err)
+	}
+}
+
+// Verifies writes failing part way through leave the database as it was.
+func TestWritesRollBack(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "rollback", 3)
+	file, _ := CreateFileInPath(db, "rollbackFile", "somePath", tags[:1])
+	_ = AddAlias(db, tags[1], "rollbackAlias")
+	// the database refuses the last tag, failing whatever statement touches it
+	refuse := func(trigger string) {
+		_, err := db.Exec(fmt.Sprintf("CREATE TRIGGER refuse %s BEGIN SELECT RAISE(ABORT, 'refused'); END", trigger))
+		if err != nil {
+			t.Fatalf("Could not create trigger: %v", err)
+		}
+	}
+	conditions := []struct {
+		name    string
+		trigger string
+		write   func() error
+		check   func() bool
+	}{
+		{"CreateFileInPath", fmt.Sprintf("BEFORE INSERT ON file_tags WHEN NEW.tid = %d", tags[2].Id),
+			func() error {
+				_, err := CreateFileInPath(db, "partialFile", "somePath", tags)
+				return err
+			},
+			func() bool {
+				found, _ := FindFileByAbsPath(db, "partialFile", "somePath")
+				return found.Id == metadata.UnknownFile.Id
+			}},
+		{"TagFile", fmt.Sprintf("BEFORE INSERT ON file_tags WHEN NEW.tid = %d", tags[2].Id),
+			func() error { return TagFile(db, file.Id, tags[1:]) },
+			func() bool {
+				applied, _ := GetTagsForFile(db, file.Id)
+				return len(applied) == 1
+			}},
+		{"DeleteTag", fmt.Sprintf("BEFORE DELETE ON tag WHEN OLD.id = %d", tags[1].Id),
+			func() error { return DeleteTag(db, tags[1]) },
+			func() bool {
+				aliases, _ := GetAliases(db, tags[1])
+				return len(aliases) == 1
+			}},
+		{"RenameTag", "BEFORE DELETE ON tag_alias",
+			func() error {
+				_, err := RenameTag(db, tags[1], "rollbackAlias")
+				return err
+			},
+			func() bool {
+				tag, _ := FindTag(db, tags[1].Text)
+				return tag.Id == tags[1].Id
+			}},
+	}
+	for _, condition := range conditions {
+		refuse(condition.trigger)
+		if err := condition.write(); err == nil {
+			t.Errorf("Expected %s to fail", condition.name)
+		}
+		if !condition.check() {
+			t.Errorf("Expected %s to be rolled back", condition.name)
+		}
+		_, _ = db.Exec("DROP TRIGGER refuse")
+	}
+}
+
+// Verifies lock errors are told apart from other errors.
+func TestIsBusy(t *testing.T) {
+	conditions := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("database is locked"), true},
+		{errors.New("database table is locked: tag"), true},
+		{errors.New("database schema is locked: main"), true},
+		{errors.New("UNIQUE constraint failed: tag.txt"), false},
+	}
+	for _, condition := range conditions {
+		if isBusy(condition.err) != condition.expected {
+			t.Errorf("Expected isBusy(%v) to be %v", condition.err, condition.expected)
+		}
+	}
+}
+
+// Verifies busy writes are attempted again, up to writeAttempts times, and other failures aren't.
+func TestRetryBusy(t *testing.T) {
+	busy := errors.New("database is locked")
+	failure := errors.New("UNIQUE constraint failed: tag.txt")
+	conditions := []struct {
+		errs             []error
+		expectedErr      error
+		expectedAttempts int
+	}{
+		{[]error{nil}, nil, 1},
+		{[]error{busy, busy, nil}, nil, 3},
+		{[]error{failure}, failure, 1},
+		{[]error{busy, failure}, failure, 2},
+		{[]error{busy, busy, busy, busy, busy, nil}, busy, writeAttempts},
+	}
+	for i, condition := range conditions {
+		attempts := 0
+		err := retryBusy(context.Background(), func() error {
+			attempts++
+			return condition.errs[attempts-1]
+		})
+		if err != condition.expectedErr || attempts != condition.expectedAttempts {
+			t.Errorf("Expected %v after %d attempts for condition %d but got %v after %d", condition.expectedErr,
+				condition.expectedAttempts, i, err, attempts)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := retryBusy(ctx, func() error { return busy }); err != context.Canceled {
+		t.Errorf("Expected a cancelled retry to give up but got %v", err)
+	}
+}
+
+// Verifies reads and writes given a done context fail without touching the database.
+func TestCancelledContext(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	tags, _ := createTags(db, "cancelled", 2)
+	file, _ := CreateFileInPath(db, "cancelledFile", "somePath", tags[:1])
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	conditions := []struct {
+		name string
+		call func() error
+	}{
+		{"FindTagContext", func() error {
+			_, err := FindTagContext(ctx, db, tags[0].Text)
+			return err
+		}},
+		{"AddTagContext", func() error {
+			_, err := AddTagContext(ctx, db, "cancelledTag", nil)
+			return err
+		}},
+		{"TagFileContext", func() error { return TagFileContext(ctx, db, file.Id, tags[1:]) }},
+	}
+	for _, condition := range conditions {
+		if err := condition.call(); err != context.Canceled {
+			t.Errorf("Expected %s to be cancelled but got %v", condition.name, err)
+		}
+	}
+	if tag, _ := FindTag(db, "cancelledTag"); tag.Id != metadata.UnknownTag.Id {
+		t.Error("Expected the tag not to be added")
+	}
+	if applied, _ := GetTagsForFile(db, file.Id); len(applied) != 1 {
+		t.Errorf("Expected the file to keep its single tag but it has %v", applied)
+	}
+}
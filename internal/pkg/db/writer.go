@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+// Turns to write, by database. SQLite lets a single connection write at a time, and a connection that can't get the
+// write lock fails with SQLITE_BUSY once the busy timeout runs out, or straight away if its transaction read the
+// database first. Rather than let concurrent FUSE requests race each other for the lock, the writes made through a pool
+// wait for their turn here instead; the busy timeout then only has to cover other processes.
+var writers = struct {
+	sync.Mutex
+	turns map[*sql.DB]chan struct{}
+}{turns: make(map[*sql.DB]chan struct{})}
+
+// Waits for the turn to write to the database, giving up with the context's error once the context is done. The
+// function returned must be called once the write is over to hand the turn to the next writer.
+func awaitWrite(ctx context.Context, db *sql.DB) (func(), error) {
+	writers.Lock()
+	turn, ok := writers.turns[db]
+	if !ok {
+		turn = make(chan struct{}, 1)
+		writers.turns[db] = turn
+	}
+	writers.Unlock()
+	select {
+	case turn <- struct{}{}:
+		return func() { <-turn }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Runs a statement changing the database once it is its turn to write, see awaitWrite, attempting it again while the
+// database is busy, see retryBusy. The tag lookups cached for the database are dropped once it ran.
+func execWrite(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := retryBusy(ctx, func() error {
+		done, err := awaitWrite(ctx, db)
+		if err != nil {
+			return err
+		}
+		defer done()
+		defer FlushCache(db)
+		result, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// Forgets the turns of a database being closed.
+func forgetWriter(db *sql.DB) {
+	writers.Lock()
+	delete(writers.turns, db)
+	writers.Unlock()
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Verifies concurrent writes through a pool take turns rather than fail on the database being busy, even with a busy
+// timeout too short to wait for each other.
+func TestConcurrentWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cotfs")
+	if err != nil {
+		t.Fatalf("Could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := OpenWithOptions(filepath.Join(dir, "writes.db"), OpenOptions{BusyTimeout: time.Millisecond,
+		MaxOpenConns: 4, MaxIdleConns: 4})
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer Close(database)
+	if stats := database.Stats(); stats.MaxOpenConnections != 4 {
+		t.Errorf("Expected a pool of 4 connections but got %d", stats.MaxOpenConnections)
+	}
+	tags, _ := AddTags(database, []string{"concurrent"}, nil)
+	writers := 200
+	errs := make(chan error, writers*2)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			file, err := CreateFileInPath(database, fmt.Sprintf("file%d", i), dir, tags)
+			if err == nil {
+				err = SetFileStat(database, file.Id, int64(i), time.Now())
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Expected concurrent writes to succeed but got %v", err)
+		}
+	}
+	if files, _ := countRows(database, "SELECT count(*) FROM file_md WHERE size IS NOT NULL"); files != writers {
+		t.Errorf("Expected %d files written but got %d", writers, files)
+	}
+}
+
+// Verifies waiting for the turn to write gives up once the context is done.
+func TestAwaitWriteCancelled(t *testing.T) {
+	db := getDb(t)
+	defer db.Close()
+	done, err := awaitWrite(context.Background(), db)
+	if err != nil {
+		t.Fatalf("Could not get the turn to write: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = awaitWrite(ctx, db); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to time out but got %v", err)
+	}
+	done()
+	if next, err := awaitWrite(context.Background(), db); err != nil {
+		t.Errorf("Expected the turn to be handed over but got %v", err)
+	} else {
+		next()
+	}
+}
@@ -0,0 +1,64 @@
+// Package findertags reads and writes the tags macOS Finder stores on files and keeps them in step with the tags in the
+// metadata database.
+package findertags
+
+import (
+	"context"
+	"github.com/cfagiani/cotfs/internal/pkg/db"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the extended attribute Finder stores the tags of a file in.
+const Attribute = "com.apple.metadata:_kMDItemUserTags"
+
+// Reads the names of the Finder tags of a file on disk. Returns nil if it has none (always the case outside macOS).
+func Read(path string) ([]string, error) {
+	value, err := readAttr(path)
+	if err != nil || len(value) == 0 {
+		return nil, err
+	}
+	return Decode(value)
+}
+
+// Replaces the Finder tags of a file on disk with the names passed in, removing them if there are none.
+func Write(path string, names []string) error {
+	if len(names) == 0 {
+		return writeAttr(path, nil)
+	}
+	return writeAttr(path, Encode(names))
+}
+
+// Applies the Finder tags of a file to its record in the metadata store, creating the tags that don't exist yet.
+func Import(ctx context.Context, store db.MetadataStore, file metadata.FileInfo) error {
+	names, err := Read(filepath.Join(file.Path, file.Name))
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	existing, err := store.GetTagsForFile(ctx, file.Id)
+	if err != nil {
+		return err
+	}
+	tags, err := store.AddTags(ctx, names, existing)
+	if err != nil {
+		return err
+	}
+	return store.TagFile(ctx, file.Id, tags)
+}
+
+// Replaces the Finder tags of a file with the tags of its record in the metadata store. Tags whose names start with a
+// dot (i.e. .trash) are left out.
+func Export(ctx context.Context, store db.MetadataStore, file metadata.FileInfo) error {
+	tags, err := store.GetTagsForFile(ctx, file.Id)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag.Text, ".") {
+			names = append(names, tag.Text)
+		}
+	}
+	return Write(filepath.Join(file.Path, file.Name), names)
+}
@@ -0,0 +1,214 @@
+package findertags
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"unicode/utf16"
+)
+
+// Returned by Decode when the value is not a binary property list holding an array of strings.
+var ErrMalformed = errors.New("malformed Finder tags")
+
+const (
+	plistHeader      = "bplist00"
+	plistTrailerSize = 32
+	// high nibbles of the object markers used by Finder tags
+	markerInt         = 0x10
+	markerASCIIString = 0x50
+	markerUTF16String = 0x60
+	markerArray       = 0xA0
+)
+
+// Decodes the tag names from the value of the Finder tags attribute, a binary property list holding an array of
+// strings. Each string is a tag name, optionally followed by a newline and the number of the tag's color, which is
+// dropped.
+func Decode(data []byte) ([]string, error) {
+	if len(data) < len(plistHeader)+plistTrailerSize || string(data[:len(plistHeader)]) != plistHeader {
+		return nil, ErrMalformed
+	}
+	trailer := data[len(data)-plistTrailerSize:]
+	offsetSize := int(trailer[6])
+	refSize := int(trailer[7])
+	objectCount := binary.BigEndian.Uint64(trailer[8:16])
+	top := binary.BigEndian.Uint64(trailer[16:24])
+	tableOffset := binary.BigEndian.Uint64(trailer[24:32])
+	tableEnd := uint64(len(data) - plistTrailerSize)
+	if offsetSize < 1 || offsetSize > 8 || refSize < 1 || refSize > 8 || top >= objectCount ||
+		objectCount > tableEnd || tableOffset > tableEnd || objectCount*uint64(offsetSize) > tableEnd-tableOffset {
+		return nil, ErrMalformed
+	}
+	objectOffset := func(ref uint64) (int, error) {
+		if ref >= objectCount {
+			return 0, ErrMalformed
+		}
+		start := tableOffset + ref*uint64(offsetSize)
+		offset := readUint(data[start : start+uint64(offsetSize)])
+		if offset < uint64(len(plistHeader)) || offset >= tableOffset {
+			return 0, ErrMalformed
+		}
+		return int(offset), nil
+	}
+	// only the object area may be read by the objects
+	objects := data[:tableOffset]
+	offset, err := objectOffset(top)
+	if err != nil {
+		return nil, err
+	}
+	if objects[offset]&0xF0 != markerArray {
+		return nil, ErrMalformed
+	}
+	count, start, err := objectLength(objects, offset)
+	if err != nil || start+count*refSize > len(objects) {
+		return nil, ErrMalformed
+	}
+	var tags []string
+	for i := 0; i < count; i++ {
+		pos := start + i*refSize
+		offset, err := objectOffset(readUint(objects[pos : pos+refSize]))
+		if err != nil {
+			return nil, err
+		}
+		tag, err := decodeString(objects, offset)
+		if err != nil {
+			return nil, err
+		}
+		if color := strings.LastIndex(tag, "\n"); color >= 0 {
+			tag = tag[:color]
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// Decodes the string object at offset.
+func decodeString(objects []byte, offset int) (string, error) {
+	length, start, err := objectLength(objects, offset)
+	if err != nil {
+		return "", err
+	}
+	switch objects[offset] & 0xF0 {
+	case markerASCIIString:
+		if start+length > len(objects) {
+			return "", ErrMalformed
+		}
+		return string(objects[start : start+length]), nil
+	case markerUTF16String:
+		if start+2*length > len(objects) {
+			return "", ErrMalformed
+		}
+		units := make([]uint16, length)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(objects[start+2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	}
+	return "", ErrMalformed
+}
+
+// Reads the length of the object at offset, which is held in the low nibble of its marker or, if that is 0xF, in the
+// integer object following the marker. Returns the length and the offset of the object's content.
+func objectLength(objects []byte, offset int) (int, int, error) {
+	length := int(objects[offset] & 0x0F)
+	if length != 0x0F {
+		return length, offset + 1, nil
+	}
+	if offset+1 >= len(objects) || objects[offset+1]&0xF0 != markerInt {
+		return 0, 0, ErrMalformed
+	}
+	size := 1 << (objects[offset+1] & 0x0F)
+	start := offset + 2
+	if size > 8 || start+size > len(objects) {
+		return 0, 0, ErrMalformed
+	}
+	value := readUint(objects[start : start+size])
+	if value > uint64(len(objects)) {
+		return 0, 0, ErrMalformed
+	}
+	return int(value), start + size, nil
+}
+
+// Encodes tag names as the value of the Finder tags attribute. Tags are written without a color.
+func Encode(tags []string) []byte {
+	refSize := uintSize(uint64(len(tags)))
+	array := appendMarker(nil, markerArray, len(tags))
+	for i := range tags {
+		array = appendUint(array, uint64(i+1), refSize)
+	}
+	objects := [][]byte{array}
+	for _, tag := range tags {
+		objects = append(objects, encodeString(tag))
+	}
+	data := []byte(plistHeader)
+	offsets := make([]uint64, len(objects))
+	for i, object := range objects {
+		offsets[i] = uint64(len(data))
+		data = append(data, object...)
+	}
+	tableOffset := uint64(len(data))
+	offsetSize := uintSize(tableOffset)
+	for _, offset := range offsets {
+		data = appendUint(data, offset, offsetSize)
+	}
+	data = append(data, 0, 0, 0, 0, 0, 0, byte(offsetSize), byte(refSize))
+	data = appendUint(data, uint64(len(objects)), 8)
+	// the array is the top object
+	data = appendUint(data, 0, 8)
+	return appendUint(data, tableOffset, 8)
+}
+
+// Encodes a string object, as ASCII if possible and as UTF-16 otherwise.
+func encodeString(s string) []byte {
+	for _, r := range s {
+		if r >= 0x80 {
+			units := utf16.Encode([]rune(s))
+			object := appendMarker(nil, markerUTF16String, len(units))
+			for _, unit := range units {
+				object = appendUint(object, uint64(unit), 2)
+			}
+			return object
+		}
+	}
+	return append(appendMarker(nil, markerASCIIString, len(s)), s...)
+}
+
+// Appends the marker of an object, followed by an integer object holding its length if it doesn't fit in the marker.
+func appendMarker(data []byte, marker byte, length int) []byte {
+	if length < 0x0F {
+		return append(data, marker|byte(length))
+	}
+	size := uintSize(uint64(length))
+	data = append(data, marker|0x0F, markerInt|byte(bits.TrailingZeros(uint(size))))
+	return appendUint(data, uint64(length), size)
+}
+
+// Returns the number of bytes (1, 2, 4 or 8) needed to hold the value.
+func uintSize(value uint64) int {
+	switch {
+	case value <= 0xFF:
+		return 1
+	case value <= 0xFFFF:
+		return 2
+	case value <= 0xFFFFFFFF:
+		return 4
+	}
+	return 8
+}
+
+// Appends the value as a big-endian integer of size bytes.
+func appendUint(data []byte, value uint64, size int) []byte {
+	for i := size - 1; i >= 0; i-- {
+		data = append(data, byte(value>>(8*uint(i))))
+	}
+	return data
+}
+
+// Reads a big-endian integer.
+func readUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+package findertags
+
+import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Finder tags Red (with its color), Work and a long non-ASCII name, as written by another property list encoder.
+const finderValue = "62706c6973743030a3010203555265640a3654576f726b6f101700430061006600e90020006c006f006e00670020007400610067" +
+	"0020006e0061006d006500200068006500720065080c12170000000000000101000000000000000400000000000000000000000000000048"
+
+// Verifies tags written by Finder are decoded without their colors.
+func TestDecode(t *testing.T) {
+	data, _ := hex.DecodeString(finderValue)
+	conditions := []struct {
+		data         []byte
+		expectedTags []string
+		expectedErr  error
+	}{
+		{data, []string{"Red", "Work", "Café long tag name here"}, nil},
+		{data[:len(data)-1], nil, ErrMalformed},
+		{[]byte("bplist00"), nil, ErrMalformed},
+		{[]byte("not a property list at all, just some text"), nil, ErrMalformed},
+		{append([]byte{}, data[:len(data)-8]...), nil, ErrMalformed},
+	}
+	for _, condition := range conditions {
+		tags, err := Decode(condition.data)
+		if err != condition.expectedErr || !reflect.DeepEqual(tags, condition.expectedTags) {
+			t.Errorf("Expected %v %v decoding %x but got %v %v", condition.expectedTags, condition.expectedErr,
+				condition.data, tags, err)
+		}
+	}
+}
+
+// Verifies encoded tags decode to the same names.
+func TestEncode(t *testing.T) {
+	var many []string
+	for i := 0; i < 300; i++ {
+		many = append(many, fmt.Sprintf("tag%d", i))
+	}
+	conditions := [][]string{
+		{"Work"},
+		{"Red", "Café", "日本"},
+		{"a tag name longer than fifteen characters"},
+		many,
+	}
+	for _, tags := range conditions {
+		decoded, err := Decode(Encode(tags))
+		if err != nil || !reflect.DeepEqual(decoded, tags) {
+			t.Errorf("Expected %v to round trip but got %v %v", tags, decoded, err)
+		}
+	}
+}
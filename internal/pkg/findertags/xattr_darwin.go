@@ -0,0 +1,64 @@
+package findertags
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Reads the Finder tags attribute of a file. Returns nil if the file has no Finder tags.
+func readAttr(path string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	name, err := syscall.BytePtrFromString(Attribute)
+	if err != nil {
+		return nil, err
+	}
+	// the first call gets the size of the value and the second one reads it
+	size, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(name)), 0, 0, 0, 0)
+	if errno == syscall.ENOATTR {
+		return nil, nil
+	}
+	if errno != 0 {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: errno}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	value := make([]byte, size)
+	size, _, errno = syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)),
+		uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return nil, &os.PathError{Op: "getxattr", Path: path, Err: errno}
+	}
+	return value[:size], nil
+}
+
+// Replaces the Finder tags attribute of a file, removing it if value is empty.
+func writeAttr(path string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	name, err := syscall.BytePtrFromString(Attribute)
+	if err != nil {
+		return err
+	}
+	if len(value) == 0 {
+		_, _, errno := syscall.Syscall(syscall.SYS_REMOVEXATTR, uintptr(unsafe.Pointer(p)),
+			uintptr(unsafe.Pointer(name)), 0)
+		if errno != 0 && errno != syscall.ENOATTR {
+			return &os.PathError{Op: "removexattr", Path: path, Err: errno}
+		}
+		return nil
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(name)),
+		uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "setxattr", Path: path, Err: errno}
+	}
+	return nil
+}
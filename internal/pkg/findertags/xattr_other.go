@@ -0,0 +1,14 @@
+//go:build !darwin
+// +build !darwin
+
+package findertags
+
+// Finder tags only exist on macOS; files elsewhere have none.
+func readAttr(path string) ([]byte, error) {
+	return nil, nil
+}
+
+// Finder tags only exist on macOS so there is nowhere to write them.
+func writeAttr(path string, value []byte) error {
+	return nil
+}
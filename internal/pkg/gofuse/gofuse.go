@@ -0,0 +1,873 @@
+// +build gofuse
+
+// Package gofuse serves a file system built on the bazil.org/fuse/fs node interfaces with hanwen/go-fuse instead of
+// bazil.org/fuse's own server. It translates the requests go-fuse receives from the kernel into calls on the nodes and
+// handles of the file system, keeping track of the nodes the kernel knows by their node ids, and answers directory
+// reads with readdirplus when the kernel asks for it.
+//
+// Like bazil.org/fuse, nodes are told apart by identity, so they must be comparable (i.e. pointers). go-fuse doesn't
+// pass interrupts on, so the contexts the nodes are called with are never cancelled.
+package gofuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	raw "github.com/hanwen/go-fuse/fuse"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long the kernel may cache attributes and entries, unless a node says otherwise; the same as bazil.org/fuse.
+const defaultValid = time.Minute
+
+// Server serves a mounted file system.
+type Server struct {
+	server *raw.Server
+	fs     *rawFS
+}
+
+// Mounts a file system at the mount point passed in, with the go-fuse mount options passed in. Requests are served
+// once Serve is called.
+func Mount(mountPoint string, filesys fs.FS, options *raw.MountOptions) (*Server, error) {
+	rfs, err := newRawFS(filesys)
+	if err != nil {
+		return nil, err
+	}
+	server, err := raw.NewServer(rfs, mountPoint, options)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{server: server, fs: rfs}, nil
+}
+
+// Serves requests until the file system is unmounted.
+func (s *Server) Serve() {
+	s.server.Serve()
+}
+
+// Unmounts the file system. Unmounting one already unmounted does nothing.
+func (s *Server) Unmount() error {
+	return s.server.Unmount()
+}
+
+// Drops the content, or the listing, the kernel cached of a node. Returns fuse.ErrNotCached if the kernel doesn't know
+// the node.
+func (s *Server) InvalidateNodeData(node fs.Node) error {
+	id, ok := s.fs.nodeId(node)
+	if !ok {
+		return fuse.ErrNotCached
+	}
+	return notifyError(s.server.InodeNotify(id, 0, 0))
+}
+
+// Drops the entry the kernel cached of a name in a directory. Returns fuse.ErrNotCached if the kernel doesn't know
+// the directory or the name.
+func (s *Server) InvalidateEntry(parent fs.Node, name string) error {
+	id, ok := s.fs.nodeId(parent)
+	if !ok {
+		return fuse.ErrNotCached
+	}
+	return notifyError(s.server.EntryNotify(id, name))
+}
+
+// Converts the status of a notification to the errors bazil.org/fuse returns.
+func notifyError(status raw.Status) error {
+	switch status {
+	case raw.OK:
+		return nil
+	case raw.ENOENT:
+		return fuse.ErrNotCached
+	}
+	return fuse.Errno(status)
+}
+
+// rawFS answers the requests of the kernel with the nodes of a file system. Requests it has no node interface for
+// (mknod, locks, fallocate) get ENOSYS from the embedded default file system.
+type rawFS struct {
+	raw.RawFileSystem
+	fs fs.FS
+	mu sync.Mutex
+	// the nodes the kernel knows, by node id, and the ids of the nodes
+	nodes  map[uint64]*nodeRef
+	ids    map[fs.Node]uint64
+	nextId uint64
+	// the open handles, by the handle id given to the kernel
+	handles    map[uint64]*handleRef
+	nextHandle uint64
+	// reported as the times of nodes that don't set them
+	started time.Time
+}
+
+// A node the kernel knows.
+type nodeRef struct {
+	node fs.Node
+	// number of times the kernel looked the node up and hasn't forgotten yet
+	lookups uint64
+}
+
+// An open file or directory.
+type handleRef struct {
+	handle fs.Handle
+	mu     sync.Mutex
+	// what ReadAll returned, for handles read that way; read on the first read
+	data []byte
+	read bool
+	// the entries of a directory, listed when it's read from the start
+	entries []fuse.Dirent
+}
+
+func newRawFS(filesys fs.FS) (*rawFS, error) {
+	root, err := filesys.Root()
+	if err != nil {
+		return nil, err
+	}
+	return &rawFS{
+		RawFileSystem: raw.NewDefaultRawFileSystem(),
+		fs:            filesys,
+		nodes:         map[uint64]*nodeRef{raw.FUSE_ROOT_ID: {node: root, lookups: 1}},
+		ids:           map[fs.Node]uint64{root: raw.FUSE_ROOT_ID},
+		nextId:        raw.FUSE_ROOT_ID + 1,
+		handles:       make(map[uint64]*handleRef),
+		nextHandle:    1,
+		started:       time.Now(),
+	}, nil
+}
+
+func (r *rawFS) String() string {
+	return "cotfs"
+}
+
+// Returns the node with the id passed in.
+func (r *rawFS) node(id uint64) (fs.Node, raw.Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref, ok := r.nodes[id]
+	if !ok {
+		return nil, raw.Status(syscall.ESTALE)
+	}
+	return ref.node, raw.OK
+}
+
+// Returns the id of a node the kernel knows.
+func (r *rawFS) nodeId(node fs.Node) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.ids[node]
+	return id, ok
+}
+
+// Counts a lookup of a node, giving it an id if the kernel doesn't know it yet.
+func (r *rawFS) remember(node fs.Node) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.ids[node]; ok {
+		r.nodes[id].lookups++
+		return id
+	}
+	id := r.nextId
+	r.nextId++
+	r.nodes[id] = &nodeRef{node: node, lookups: 1}
+	r.ids[node] = id
+	return id
+}
+
+// Returns the open handle with the id passed in.
+func (r *rawFS) handle(id uint64) (*handleRef, raw.Status) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref, ok := r.handles[id]
+	if !ok {
+		return nil, raw.EBADF
+	}
+	return ref, raw.OK
+}
+
+// Keeps an open handle, returning its id.
+func (r *rawFS) open(handle fs.Handle) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := r.nextHandle
+	r.nextHandle++
+	r.handles[id] = &handleRef{handle: handle}
+	return id
+}
+
+// Drops an open handle, returning it.
+func (r *rawFS) close(id uint64) (fs.Handle, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ref, ok := r.handles[id]
+	delete(r.handles, id)
+	if !ok {
+		return nil, false
+	}
+	return ref.handle, true
+}
+
+// Returns the header of the requests made to the nodes.
+func header(in *raw.InHeader) fuse.Header {
+	return fuse.Header{Node: fuse.NodeID(in.NodeId), Uid: in.Uid, Gid: in.Gid, Pid: in.Pid}
+}
+
+// Converts the error of a node to a status. Errors without an errno are reported as EIO.
+func status(err error) raw.Status {
+	if err == nil {
+		return raw.OK
+	}
+	if errno, ok := err.(fuse.ErrorNumber); ok {
+		return raw.Status(errno.Errno())
+	}
+	return raw.EIO
+}
+
+// Gets the attributes of a node, starting from the defaults bazil.org/fuse reports.
+func (r *rawFS) attr(ctx context.Context, node fs.Node) (fuse.Attr, error) {
+	a := fuse.Attr{Valid: defaultValid, Nlink: 1, Atime: r.started, Mtime: r.started, Ctime: r.started,
+		Crtime: r.started}
+	if getter, ok := node.(fs.NodeGetattrer); ok {
+		resp := &fuse.GetattrResponse{Attr: a}
+		err := getter.Getattr(ctx, &fuse.GetattrRequest{}, resp)
+		return resp.Attr, err
+	}
+	err := node.Attr(ctx, &a)
+	return a, err
+}
+
+// Fills in the entry of a node that was looked up or created, counting the lookup.
+func (r *rawFS) entry(ctx context.Context, node fs.Node, out *raw.EntryOut) raw.Status {
+	a, err := r.attr(ctx, node)
+	if err != nil {
+		return status(err)
+	}
+	id := r.remember(node)
+	out.NodeId = id
+	out.Attr = toAttr(a, id)
+	out.SetEntryTimeout(defaultValid)
+	out.SetAttrTimeout(a.Valid)
+	return raw.OK
+}
+
+// Converts attributes to the ones sent to the kernel. Nodes without an inode number get their node id.
+func toAttr(a fuse.Attr, id uint64) raw.Attr {
+	out := raw.Attr{
+		Ino:       a.Inode,
+		Size:      a.Size,
+		Blocks:    a.Blocks,
+		Atime:     uint64(a.Atime.Unix()),
+		Atimensec: uint32(a.Atime.Nanosecond()),
+		Mtime:     uint64(a.Mtime.Unix()),
+		Mtimensec: uint32(a.Mtime.Nanosecond()),
+		Ctime:     uint64(a.Ctime.Unix()),
+		Ctimensec: uint32(a.Ctime.Nanosecond()),
+		Mode:      unixMode(a.Mode),
+		Nlink:     a.Nlink,
+		Owner:     raw.Owner{Uid: a.Uid, Gid: a.Gid},
+		Rdev:      a.Rdev,
+	}
+	if out.Ino == 0 {
+		out.Ino = id
+	}
+	return out
+}
+
+// Converts a mode to the type and permission bits of a stat.
+func unixMode(mode os.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	switch {
+	case mode&os.ModeDir != 0:
+		bits |= syscall.S_IFDIR
+	case mode&os.ModeSymlink != 0:
+		bits |= syscall.S_IFLNK
+	case mode&os.ModeNamedPipe != 0:
+		bits |= syscall.S_IFIFO
+	case mode&os.ModeSocket != 0:
+		bits |= syscall.S_IFSOCK
+	case mode&os.ModeCharDevice != 0:
+		bits |= syscall.S_IFCHR
+	case mode&os.ModeDevice != 0:
+		bits |= syscall.S_IFBLK
+	default:
+		bits |= syscall.S_IFREG
+	}
+	if mode&os.ModeSetuid != 0 {
+		bits |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= syscall.S_ISVTX
+	}
+	return bits
+}
+
+// Converts the mode of a request to a file mode. Only the permission bits and the type of directories are kept.
+func fileMode(bits uint32) os.FileMode {
+	mode := os.FileMode(bits & 0777)
+	if bits&syscall.S_IFMT == syscall.S_IFDIR {
+		mode |= os.ModeDir
+	}
+	if bits&syscall.S_ISUID != 0 {
+		mode |= os.ModeSetuid
+	}
+	if bits&syscall.S_ISGID != 0 {
+		mode |= os.ModeSetgid
+	}
+	if bits&syscall.S_ISVTX != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// Converts the flags a node opened a handle with to the ones sent to the kernel.
+func openFlags(flags fuse.OpenResponseFlags) uint32 {
+	var out uint32
+	if flags&fuse.OpenDirectIO != 0 {
+		out |= raw.FOPEN_DIRECT_IO
+	}
+	if flags&fuse.OpenKeepCache != 0 {
+		out |= raw.FOPEN_KEEP_CACHE
+	}
+	if flags&fuse.OpenNonSeekable != 0 {
+		out |= raw.FOPEN_NONSEEKABLE
+	}
+	return out
+}
+
+// Looks up a name in a directory node.
+func lookup(ctx context.Context, dir fs.Node, req *fuse.LookupRequest) (fs.Node, error) {
+	switch lookuper := dir.(type) {
+	case fs.NodeRequestLookuper:
+		return lookuper.Lookup(ctx, req, &fuse.LookupResponse{})
+	case fs.NodeStringLookuper:
+		return lookuper.Lookup(ctx, req.Name)
+	}
+	return nil, fuse.ENOENT
+}
+
+func (r *rawFS) Lookup(in *raw.InHeader, name string, out *raw.EntryOut) raw.Status {
+	dir, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	ctx := context.Background()
+	child, err := lookup(ctx, dir, &fuse.LookupRequest{Header: header(in), Name: name})
+	if err != nil {
+		return status(err)
+	}
+	return r.entry(ctx, child, out)
+}
+
+// Drops a node once the kernel has forgotten every lookup of it. The root is never dropped.
+func (r *rawFS) Forget(id uint64, lookups uint64) {
+	r.mu.Lock()
+	ref, ok := r.nodes[id]
+	if !ok || id == raw.FUSE_ROOT_ID {
+		r.mu.Unlock()
+		return
+	}
+	if ref.lookups > lookups {
+		ref.lookups -= lookups
+		r.mu.Unlock()
+		return
+	}
+	delete(r.nodes, id)
+	delete(r.ids, ref.node)
+	r.mu.Unlock()
+	if forgetter, ok := ref.node.(fs.NodeForgetter); ok {
+		forgetter.Forget()
+	}
+}
+
+func (r *rawFS) GetAttr(in *raw.GetAttrIn, out *raw.AttrOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	a, err := r.attr(context.Background(), node)
+	if err != nil {
+		return status(err)
+	}
+	out.Attr = toAttr(a, in.NodeId)
+	out.SetTimeout(a.Valid)
+	return raw.OK
+}
+
+// Changes the attributes of a node that can be changed, replying with the attributes it has afterwards (as
+// bazil.org/fuse does, nodes that can't be changed are left as they are).
+func (r *rawFS) SetAttr(in *raw.SetAttrIn, out *raw.AttrOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	ctx := context.Background()
+	if setter, ok := node.(fs.NodeSetattrer); ok {
+		req := &fuse.SetattrRequest{Header: header(&in.InHeader), Handle: fuse.HandleID(in.Fh), Size: in.Size,
+			Mode: fileMode(in.Mode), Uid: in.Uid, Gid: in.Gid}
+		valid := map[uint32]fuse.SetattrValid{raw.FATTR_MODE: fuse.SetattrMode, raw.FATTR_UID: fuse.SetattrUid,
+			raw.FATTR_GID: fuse.SetattrGid, raw.FATTR_SIZE: fuse.SetattrSize, raw.FATTR_ATIME: fuse.SetattrAtime,
+			raw.FATTR_MTIME: fuse.SetattrMtime, raw.FATTR_FH: fuse.SetattrHandle}
+		for bit, flag := range valid {
+			if in.Valid&bit != 0 {
+				req.Valid |= flag
+			}
+		}
+		req.Atime, _ = in.GetATime()
+		req.Mtime, _ = in.GetMTime()
+		if err := setter.Setattr(ctx, req, &fuse.SetattrResponse{}); err != nil {
+			return status(err)
+		}
+	}
+	a, err := r.attr(ctx, node)
+	if err != nil {
+		return status(err)
+	}
+	out.Attr = toAttr(a, in.NodeId)
+	out.SetTimeout(a.Valid)
+	return raw.OK
+}
+
+func (r *rawFS) Mkdir(in *raw.MkdirIn, name string, out *raw.EntryOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	mkdirer, ok := node.(fs.NodeMkdirer)
+	if !ok {
+		return raw.EPERM
+	}
+	ctx := context.Background()
+	req := &fuse.MkdirRequest{Header: header(&in.InHeader), Name: name, Mode: fileMode(in.Mode) | os.ModeDir,
+		Umask: os.FileMode(in.Umask)}
+	child, err := mkdirer.Mkdir(ctx, req)
+	if err != nil {
+		return status(err)
+	}
+	return r.entry(ctx, child, out)
+}
+
+// Removes a file or a directory from a directory node.
+func (r *rawFS) remove(in *raw.InHeader, name string, dir bool) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	remover, ok := node.(fs.NodeRemover)
+	if !ok {
+		return raw.EPERM
+	}
+	return status(remover.Remove(context.Background(), &fuse.RemoveRequest{Header: header(in), Name: name,
+		Dir: dir}))
+}
+
+func (r *rawFS) Unlink(in *raw.InHeader, name string) raw.Status {
+	return r.remove(in, name, false)
+}
+
+func (r *rawFS) Rmdir(in *raw.InHeader, name string) raw.Status {
+	return r.remove(in, name, true)
+}
+
+func (r *rawFS) Rename(in *raw.RenameIn, oldName string, newName string) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	newDir, code := r.node(in.Newdir)
+	if !code.Ok() {
+		return code
+	}
+	renamer, ok := node.(fs.NodeRenamer)
+	if !ok {
+		return raw.EPERM
+	}
+	req := &fuse.RenameRequest{Header: header(&in.InHeader), NewDir: fuse.NodeID(in.Newdir), OldName: oldName,
+		NewName: newName}
+	return status(renamer.Rename(context.Background(), req, newDir))
+}
+
+func (r *rawFS) Link(in *raw.LinkIn, name string, out *raw.EntryOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	old, code := r.node(in.Oldnodeid)
+	if !code.Ok() {
+		return code
+	}
+	linker, ok := node.(fs.NodeLinker)
+	if !ok {
+		return raw.EPERM
+	}
+	ctx := context.Background()
+	req := &fuse.LinkRequest{Header: header(&in.InHeader), OldNode: fuse.NodeID(in.Oldnodeid), NewName: name}
+	child, err := linker.Link(ctx, req, old)
+	if err != nil {
+		return status(err)
+	}
+	return r.entry(ctx, child, out)
+}
+
+func (r *rawFS) Symlink(in *raw.InHeader, target string, name string, out *raw.EntryOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	symlinker, ok := node.(fs.NodeSymlinker)
+	if !ok {
+		return raw.EPERM
+	}
+	ctx := context.Background()
+	child, err := symlinker.Symlink(ctx, &fuse.SymlinkRequest{Header: header(in), NewName: name, Target: target})
+	if err != nil {
+		return status(err)
+	}
+	return r.entry(ctx, child, out)
+}
+
+func (r *rawFS) Readlink(in *raw.InHeader) ([]byte, raw.Status) {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return nil, code
+	}
+	readlinker, ok := node.(fs.NodeReadlinker)
+	if !ok {
+		return nil, raw.EINVAL
+	}
+	target, err := readlinker.Readlink(context.Background(), &fuse.ReadlinkRequest{Header: header(in)})
+	if err != nil {
+		return nil, status(err)
+	}
+	return []byte(target), raw.OK
+}
+
+// Checks access to a node. Nodes that don't check access allow it.
+func (r *rawFS) Access(in *raw.AccessIn) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	if accesser, ok := node.(fs.NodeAccesser); ok {
+		return status(accesser.Access(context.Background(), &fuse.AccessRequest{Header: header(&in.InHeader),
+			Mask: in.Mask}))
+	}
+	return raw.OK
+}
+
+// Gets the value of an extended attribute of a node.
+func (r *rawFS) getxattr(in *raw.InHeader, name string) ([]byte, raw.Status) {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return nil, code
+	}
+	getter, ok := node.(fs.NodeGetxattrer)
+	if !ok {
+		return nil, raw.ENOSYS
+	}
+	resp := &fuse.GetxattrResponse{}
+	if err := getter.Getxattr(context.Background(), &fuse.GetxattrRequest{Header: header(in), Name: name},
+		resp); err != nil {
+		return nil, status(err)
+	}
+	return resp.Xattr, raw.OK
+}
+
+func (r *rawFS) GetXAttrSize(in *raw.InHeader, name string) (int, raw.Status) {
+	value, code := r.getxattr(in, name)
+	return len(value), code
+}
+
+func (r *rawFS) GetXAttrData(in *raw.InHeader, name string) ([]byte, raw.Status) {
+	return r.getxattr(in, name)
+}
+
+// Lists the names of the extended attributes of a node, each followed by a NUL.
+func (r *rawFS) ListXAttr(in *raw.InHeader) ([]byte, raw.Status) {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return nil, code
+	}
+	lister, ok := node.(fs.NodeListxattrer)
+	if !ok {
+		return nil, raw.OK
+	}
+	resp := &fuse.ListxattrResponse{}
+	if err := lister.Listxattr(context.Background(), &fuse.ListxattrRequest{Header: header(in)}, resp); err != nil {
+		return nil, status(err)
+	}
+	return resp.Xattr, raw.OK
+}
+
+func (r *rawFS) SetXAttr(in *raw.SetXAttrIn, name string, value []byte) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	setter, ok := node.(fs.NodeSetxattrer)
+	if !ok {
+		return raw.ENOSYS
+	}
+	return status(setter.Setxattr(context.Background(), &fuse.SetxattrRequest{Header: header(&in.InHeader),
+		Flags: in.Flags, Name: name, Xattr: value}))
+}
+
+func (r *rawFS) RemoveXAttr(in *raw.InHeader, name string) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	remover, ok := node.(fs.NodeRemovexattrer)
+	if !ok {
+		return raw.ENOSYS
+	}
+	return status(remover.Removexattr(context.Background(), &fuse.RemovexattrRequest{Header: header(in),
+		Name: name}))
+}
+
+func (r *rawFS) Create(in *raw.CreateIn, name string, out *raw.CreateOut) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	creater, ok := node.(fs.NodeCreater)
+	if !ok {
+		return raw.EPERM
+	}
+	ctx := context.Background()
+	req := &fuse.CreateRequest{Header: header(&in.InHeader), Name: name, Flags: fuse.OpenFlags(in.Flags),
+		Mode: fileMode(in.Mode), Umask: createUmask(in)}
+	resp := &fuse.CreateResponse{}
+	child, handle, err := creater.Create(ctx, req, resp)
+	if err != nil {
+		return status(err)
+	}
+	if code = r.entry(ctx, child, &out.EntryOut); !code.Ok() {
+		if releaser, ok := handle.(fs.HandleReleaser); ok {
+			releaser.Release(ctx, &fuse.ReleaseRequest{Header: header(&in.InHeader), Flags: req.Flags})
+		}
+		return code
+	}
+	out.Fh = r.open(handle)
+	out.OpenFlags = openFlags(resp.Flags)
+	return raw.OK
+}
+
+// Opens a file or a directory node. Nodes that can't be opened are their own handle.
+func (r *rawFS) openNode(in *raw.OpenIn, out *raw.OpenOut, dir bool) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	var handle fs.Handle = node
+	resp := &fuse.OpenResponse{}
+	if opener, ok := node.(fs.NodeOpener); ok {
+		req := &fuse.OpenRequest{Header: header(&in.InHeader), Dir: dir, Flags: fuse.OpenFlags(in.Flags)}
+		var err error
+		if handle, err = opener.Open(context.Background(), req, resp); err != nil {
+			return status(err)
+		}
+	}
+	out.Fh = r.open(handle)
+	out.OpenFlags = openFlags(resp.Flags)
+	return raw.OK
+}
+
+func (r *rawFS) Open(in *raw.OpenIn, out *raw.OpenOut) raw.Status {
+	return r.openNode(in, out, false)
+}
+
+func (r *rawFS) OpenDir(in *raw.OpenIn, out *raw.OpenOut) raw.Status {
+	return r.openNode(in, out, true)
+}
+
+// Reads from a handle, with its Read or from what its ReadAll returned.
+func (r *rawFS) Read(in *raw.ReadIn, buf []byte) (raw.ReadResult, raw.Status) {
+	ref, code := r.handle(in.Fh)
+	if !code.Ok() {
+		return nil, code
+	}
+	ctx := context.Background()
+	switch handle := ref.handle.(type) {
+	case fs.HandleReader:
+		req := &fuse.ReadRequest{Header: header(&in.InHeader), Handle: fuse.HandleID(in.Fh), Offset: int64(in.Offset),
+			Size: int(in.Size)}
+		resp := &fuse.ReadResponse{Data: buf[:0]}
+		if err := handle.Read(ctx, req, resp); err != nil {
+			return nil, status(err)
+		}
+		return raw.ReadResultData(resp.Data), raw.OK
+	case fs.HandleReadAller:
+		ref.mu.Lock()
+		defer ref.mu.Unlock()
+		if !ref.read {
+			data, err := handle.ReadAll(ctx)
+			if err != nil {
+				return nil, status(err)
+			}
+			ref.data, ref.read = data, true
+		}
+		if in.Offset >= uint64(len(ref.data)) {
+			return raw.ReadResultData(nil), raw.OK
+		}
+		end := in.Offset + uint64(in.Size)
+		if end > uint64(len(ref.data)) {
+			end = uint64(len(ref.data))
+		}
+		return raw.ReadResultData(ref.data[in.Offset:end]), raw.OK
+	}
+	return nil, raw.EIO
+}
+
+func (r *rawFS) Write(in *raw.WriteIn, data []byte) (uint32, raw.Status) {
+	ref, code := r.handle(in.Fh)
+	if !code.Ok() {
+		return 0, code
+	}
+	writer, ok := ref.handle.(fs.HandleWriter)
+	if !ok {
+		return 0, raw.EIO
+	}
+	req := &fuse.WriteRequest{Header: header(&in.InHeader), Handle: fuse.HandleID(in.Fh), Offset: int64(in.Offset),
+		Data: data}
+	resp := &fuse.WriteResponse{}
+	if err := writer.Write(context.Background(), req, resp); err != nil {
+		return 0, status(err)
+	}
+	return uint32(resp.Size), raw.OK
+}
+
+func (r *rawFS) Flush(in *raw.FlushIn) raw.Status {
+	ref, code := r.handle(in.Fh)
+	if !code.Ok() {
+		return code
+	}
+	if flusher, ok := ref.handle.(fs.HandleFlusher); ok {
+		return status(flusher.Flush(context.Background(), &fuse.FlushRequest{Header: header(&in.InHeader),
+			Handle: fuse.HandleID(in.Fh), LockOwner: in.LockOwner}))
+	}
+	return raw.OK
+}
+
+// Releases a handle once the kernel is done with it. The kernel isn't told whether releasing it failed.
+func (r *rawFS) release(in *raw.ReleaseIn, dir bool) {
+	handle, ok := r.close(in.Fh)
+	if !ok {
+		return
+	}
+	if releaser, ok := handle.(fs.HandleReleaser); ok {
+		releaser.Release(context.Background(), &fuse.ReleaseRequest{Header: header(&in.InHeader), Dir: dir,
+			Handle: fuse.HandleID(in.Fh), Flags: fuse.OpenFlags(in.Flags)})
+	}
+}
+
+func (r *rawFS) Release(in *raw.ReleaseIn) {
+	r.release(in, false)
+}
+
+func (r *rawFS) ReleaseDir(in *raw.ReleaseIn) {
+	r.release(in, true)
+}
+
+// Syncs a file or a directory node. Nodes that can't be synced have nothing to sync.
+func (r *rawFS) fsync(in *raw.FsyncIn, dir bool) raw.Status {
+	node, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	if fsyncer, ok := node.(fs.NodeFsyncer); ok {
+		return status(fsyncer.Fsync(context.Background(), &fuse.FsyncRequest{Header: header(&in.InHeader),
+			Dir: dir, Handle: fuse.HandleID(in.Fh), Flags: in.FsyncFlags}))
+	}
+	return raw.OK
+}
+
+func (r *rawFS) Fsync(in *raw.FsyncIn) raw.Status {
+	return r.fsync(in, false)
+}
+
+func (r *rawFS) FsyncDir(in *raw.FsyncIn) raw.Status {
+	return r.fsync(in, true)
+}
+
+// Returns the entries of an open directory from the offset of a read, listing them when it's read from the start.
+func (r *rawFS) entries(in *raw.ReadIn) ([]fuse.Dirent, raw.Status) {
+	ref, code := r.handle(in.Fh)
+	if !code.Ok() {
+		return nil, code
+	}
+	ref.mu.Lock()
+	defer ref.mu.Unlock()
+	if in.Offset == 0 || ref.entries == nil {
+		lister, ok := ref.handle.(fs.HandleReadDirAller)
+		if !ok {
+			return nil, raw.ENOTDIR
+		}
+		entries, err := lister.ReadDirAll(context.Background())
+		if err != nil {
+			return nil, status(err)
+		}
+		ref.entries = append([]fuse.Dirent{}, entries...)
+	}
+	if in.Offset >= uint64(len(ref.entries)) {
+		return nil, raw.OK
+	}
+	return ref.entries[in.Offset:], raw.OK
+}
+
+// Returns the directory entry of a listed entry.
+func dirEntry(entry fuse.Dirent) raw.DirEntry {
+	return raw.DirEntry{Name: entry.Name, Ino: entry.Inode, Mode: uint32(entry.Type) << 12}
+}
+
+func (r *rawFS) ReadDir(in *raw.ReadIn, out *raw.DirEntryList) raw.Status {
+	entries, code := r.entries(in)
+	for _, entry := range entries {
+		if !out.AddDirEntry(dirEntry(entry)) {
+			break
+		}
+	}
+	return code
+}
+
+// Lists the entries of a directory along with what a lookup of each returns, saving the kernel from looking them up
+// one by one. Entries that can't be looked up are listed without it.
+func (r *rawFS) ReadDirPlus(in *raw.ReadIn, out *raw.DirEntryList) raw.Status {
+	entries, code := r.entries(in)
+	if !code.Ok() || len(entries) == 0 {
+		return code
+	}
+	dir, code := r.node(in.NodeId)
+	if !code.Ok() {
+		return code
+	}
+	ctx := context.Background()
+	for _, entry := range entries {
+		entryOut := out.AddDirLookupEntry(dirEntry(entry))
+		if entryOut == nil {
+			break
+		}
+		*entryOut = raw.EntryOut{}
+		child, err := lookup(ctx, dir, &fuse.LookupRequest{Header: header(&in.InHeader), Name: entry.Name})
+		if err == nil {
+			r.entry(ctx, child, entryOut)
+		}
+	}
+	return raw.OK
+}
+
+func (r *rawFS) StatFs(in *raw.InHeader, out *raw.StatfsOut) raw.Status {
+	statfser, ok := r.fs.(fs.FSStatfser)
+	if !ok {
+		return raw.OK
+	}
+	resp := &fuse.StatfsResponse{}
+	if err := statfser.Statfs(context.Background(), &fuse.StatfsRequest{Header: header(in)}, resp); err != nil {
+		return status(err)
+	}
+	*out = raw.StatfsOut{Blocks: resp.Blocks, Bfree: resp.Bfree, Bavail: resp.Bavail, Files: resp.Files,
+		Ffree: resp.Ffree, Bsize: resp.Bsize, NameLen: resp.Namelen, Frsize: resp.Frsize}
+	return raw.OK
+}
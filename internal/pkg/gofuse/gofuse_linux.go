@@ -0,0 +1,13 @@
+// +build gofuse
+
+package gofuse
+
+import (
+	raw "github.com/hanwen/go-fuse/fuse"
+	"os"
+)
+
+// Returns the umask of the process creating a file.
+func createUmask(in *raw.CreateIn) os.FileMode {
+	return os.FileMode(in.Umask)
+}
@@ -0,0 +1,292 @@
+// +build gofuse
+
+package gofuse
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"encoding/binary"
+	raw "github.com/hanwen/go-fuse/fuse"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+type testFS struct {
+	root *testDir
+}
+
+func (f *testFS) Root() (fs.Node, error) {
+	return f.root, nil
+}
+
+type testDir struct {
+	children map[string]fs.Node
+	names    []string
+}
+
+func (d *testDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (d *testDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if child, ok := d.children[name]; ok {
+		return child, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *testDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var entries []fuse.Dirent
+	for _, name := range d.names {
+		entryType := fuse.DT_File
+		if _, ok := d.children[name].(*testDir); ok {
+			entryType = fuse.DT_Dir
+		}
+		entries = append(entries, fuse.Dirent{Name: name, Type: entryType})
+	}
+	return entries, nil
+}
+
+func (d *testDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if _, ok := d.children[req.Name]; !ok {
+		return fuse.ENOENT
+	}
+	delete(d.children, req.Name)
+	return nil
+}
+
+type testFile struct {
+	data []byte
+	// number of times the file was read
+	reads int
+}
+
+func (f *testFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0644
+	a.Size = uint64(len(f.data))
+	return nil
+}
+
+func (f *testFile) ReadAll(ctx context.Context) ([]byte, error) {
+	f.reads++
+	return f.data, nil
+}
+
+// Returns a file system with a directory holding a file and a subdirectory.
+func newTestFS(t *testing.T) (*rawFS, *testDir) {
+	root := &testDir{children: map[string]fs.Node{
+		"file.txt": &testFile{data: []byte("hello world")},
+		"sub":      &testDir{children: map[string]fs.Node{}},
+	}, names: []string{"file.txt", "sub"}}
+	rfs, err := newRawFS(&testFS{root: root})
+	if err != nil {
+		t.Fatalf("Could not create file system: %v", err)
+	}
+	return rfs, root
+}
+
+// Returns the names and types of the entries written to a zeroed readdir buffer.
+func parseDirents(buf []byte) map[string]uint32 {
+	entries := make(map[string]uint32)
+	for len(buf) >= 24 {
+		nameLen := int(binary.LittleEndian.Uint32(buf[16:]))
+		if nameLen == 0 {
+			break
+		}
+		entries[string(buf[24:24+nameLen])] = binary.LittleEndian.Uint32(buf[20:])
+		buf = buf[(24+nameLen+7)&^7:]
+	}
+	return entries
+}
+
+// Verifies names are looked up in directories and given node ids, with the type of the node in their mode.
+func TestRawFS_Lookup(t *testing.T) {
+	conditions := []struct {
+		name     string
+		expected raw.Status
+		mode     uint32
+	}{
+		{"file.txt", raw.OK, syscall.S_IFREG | 0644},
+		{"sub", raw.OK, syscall.S_IFDIR | 0755},
+		{"missing", raw.ENOENT, 0},
+	}
+	rfs, _ := newTestFS(t)
+	for _, condition := range conditions {
+		out := &raw.EntryOut{}
+		code := rfs.Lookup(&raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, condition.name, out)
+		if code != condition.expected {
+			t.Errorf("Expected looking up %s to return %v but got %v", condition.name, condition.expected, code)
+		} else if code.Ok() && (out.NodeId == raw.FUSE_ROOT_ID || out.Mode != condition.mode) {
+			t.Errorf("Expected %s to get its own node id and mode %o but got %d and %o", condition.name,
+				condition.mode, out.NodeId, out.Mode)
+		}
+	}
+}
+
+// Verifies nodes keep their id until the kernel forgets every lookup of them.
+func TestRawFS_Forget(t *testing.T) {
+	rfs, _ := newTestFS(t)
+	first, second := &raw.EntryOut{}, &raw.EntryOut{}
+	rfs.Lookup(&raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file.txt", first)
+	rfs.Lookup(&raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file.txt", second)
+	if first.NodeId != second.NodeId {
+		t.Errorf("Expected the same node to keep its id but got %d and %d", first.NodeId, second.NodeId)
+	}
+	conditions := []struct {
+		lookups  uint64
+		expected raw.Status
+	}{
+		{1, raw.OK},
+		{1, raw.Status(syscall.ESTALE)},
+	}
+	for _, condition := range conditions {
+		rfs.Forget(first.NodeId, condition.lookups)
+		code := rfs.GetAttr(&raw.GetAttrIn{InHeader: raw.InHeader{NodeId: first.NodeId}}, &raw.AttrOut{})
+		if code != condition.expected {
+			t.Errorf("Expected getting the attributes after forgetting to return %v but got %v", condition.expected,
+				code)
+		}
+	}
+	rfs.Forget(raw.FUSE_ROOT_ID, 1)
+	if _, code := rfs.node(raw.FUSE_ROOT_ID); !code.Ok() {
+		t.Error("Expected the root to never be forgotten")
+	}
+}
+
+// Verifies directories are listed from the offset of each read.
+func TestRawFS_ReadDir(t *testing.T) {
+	conditions := []struct {
+		offset   uint64
+		expected map[string]uint32
+	}{
+		{0, map[string]uint32{"file.txt": syscall.S_IFREG >> 12, "sub": syscall.S_IFDIR >> 12}},
+		{1, map[string]uint32{"sub": syscall.S_IFDIR >> 12}},
+		{2, map[string]uint32{}},
+	}
+	rfs, _ := newTestFS(t)
+	open := &raw.OpenOut{}
+	if code := rfs.OpenDir(&raw.OpenIn{InHeader: raw.InHeader{NodeId: raw.FUSE_ROOT_ID}}, open); !code.Ok() {
+		t.Fatalf("Could not open the root: %v", code)
+	}
+	for _, condition := range conditions {
+		buf := make([]byte, 4096)
+		out := raw.NewDirEntryList(buf, condition.offset)
+		in := &raw.ReadIn{InHeader: raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, Fh: open.Fh, Offset: condition.offset,
+			Size: uint32(len(buf))}
+		if code := rfs.ReadDir(in, out); !code.Ok() {
+			t.Errorf("Could not read the root from %d: %v", condition.offset, code)
+		} else if entries := parseDirents(buf); !reflect.DeepEqual(entries, condition.expected) {
+			t.Errorf("Expected reading from %d to list %v but got %v", condition.offset, condition.expected, entries)
+		}
+	}
+}
+
+// Verifies files without a Read are read from what their ReadAll returned, once per handle.
+func TestRawFS_Read(t *testing.T) {
+	conditions := []struct {
+		offset   uint64
+		size     uint32
+		expected string
+	}{
+		{0, 5, "hello"},
+		{6, 100, "world"},
+		{11, 5, ""},
+		{20, 5, ""},
+	}
+	rfs, root := newTestFS(t)
+	entry := &raw.EntryOut{}
+	rfs.Lookup(&raw.InHeader{NodeId: raw.FUSE_ROOT_ID}, "file.txt", entry)
+	open := &raw.OpenOut{}
+	if code := rfs.Open(&raw.OpenIn{InHeader: raw.InHeader{NodeId: entry.NodeId}}, open); !code.Ok() {
+		t.Fatalf("Could not open the file: %v", code)
+	}
+	for _, condition := range conditions {
+		in := &raw.ReadIn{InHeader: raw.InHeader{NodeId: entry.NodeId}, Fh: open.Fh, Offset: condition.offset,
+			Size: condition.size}
+		result, code := rfs.Read(in, make([]byte, condition.size))
+		if !code.Ok() {
+			t.Errorf("Could not read from %d: %v", condition.offset, code)
+			continue
+		}
+		data, _ := result.Bytes(nil)
+		if string(data) != condition.expected {
+			t.Errorf("Expected reading %d bytes from %d to return %q but got %q", condition.size, condition.offset,
+				condition.expected, data)
+		}
+	}
+	if reads := root.children["file.txt"].(*testFile).reads; reads != 1 {
+		t.Errorf("Expected the file to be read once but it was read %d times", reads)
+	}
+	rfs.Release(&raw.ReleaseIn{InHeader: raw.InHeader{NodeId: entry.NodeId}, Fh: open.Fh})
+	if _, code := rfs.Read(&raw.ReadIn{Fh: open.Fh, Size: 5}, make([]byte, 5)); code != raw.EBADF {
+		t.Errorf("Expected reading a released handle to return EBADF but got %v", code)
+	}
+}
+
+// Verifies removals reach the directory, and requests the nodes can't handle are refused.
+func TestRawFS_Unlink(t *testing.T) {
+	conditions := []struct {
+		node     uint64
+		name     string
+		expected raw.Status
+	}{
+		{raw.FUSE_ROOT_ID, "file.txt", raw.OK},
+		{raw.FUSE_ROOT_ID, "file.txt", raw.ENOENT},
+		{42, "file.txt", raw.Status(syscall.ESTALE)},
+	}
+	rfs, _ := newTestFS(t)
+	for _, condition := range conditions {
+		if code := rfs.Unlink(&raw.InHeader{NodeId: condition.node}, condition.name); code != condition.expected {
+			t.Errorf("Expected removing %s from %d to return %v but got %v", condition.name, condition.node,
+				condition.expected, code)
+		}
+	}
+	if code := rfs.Mkdir(&raw.MkdirIn{InHeader: raw.InHeader{NodeId: raw.FUSE_ROOT_ID}}, "new",
+		&raw.EntryOut{}); code != raw.EPERM {
+		t.Errorf("Expected making a directory the root can't make to return EPERM but got %v", code)
+	}
+}
+
+// Verifies the errors of nodes are converted to their errno, or EIO for errors without one.
+func TestStatus(t *testing.T) {
+	conditions := []struct {
+		err      error
+		expected raw.Status
+	}{
+		{nil, raw.OK},
+		{fuse.ENOENT, raw.ENOENT},
+		{fuse.Errno(syscall.ENOTEMPTY), raw.Status(syscall.ENOTEMPTY)},
+		{os.ErrInvalid, raw.EIO},
+	}
+	for _, condition := range conditions {
+		if code := status(condition.err); code != condition.expected {
+			t.Errorf("Expected %v to be converted to %v but got %v", condition.err, condition.expected, code)
+		}
+	}
+}
+
+// Verifies modes are converted to stat modes and back.
+func TestUnixMode(t *testing.T) {
+	conditions := []struct {
+		mode     os.FileMode
+		expected uint32
+	}{
+		{0644, syscall.S_IFREG | 0644},
+		{os.ModeDir | 0755, syscall.S_IFDIR | 0755},
+		{os.ModeSymlink | 0777, syscall.S_IFLNK | 0777},
+		{os.ModeDir | os.ModeSetgid | 0770, syscall.S_IFDIR | syscall.S_ISGID | 0770},
+	}
+	for _, condition := range conditions {
+		if bits := unixMode(condition.mode); bits != condition.expected {
+			t.Errorf("Expected %v to be converted to %o but got %o", condition.mode, condition.expected, bits)
+		}
+		if condition.mode&os.ModeSymlink == 0 && fileMode(condition.expected) != condition.mode {
+			t.Errorf("Expected %o to be converted back to %v but got %v", condition.expected, condition.mode,
+				fileMode(condition.expected))
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package metadata
 
+import (
+	"os"
+	"time"
+)
+
 type FileInfo struct {
 	Id   int64
 	Name string
@@ -11,6 +16,72 @@ type TagInfo struct {
 	Text string
 }
 
+// A named query stored in the metadata database. Files must match the tag expression (if any) and have a name
+// matching the pattern (if any). Created is set by the database when the query is first saved.
+type SavedQuery struct {
+	Name    string
+	Expr    string
+	Pattern string
+	Created time.Time
+}
+
+// Owner and access mode of a tag or file. Only the permission bits of Mode are used.
+type Permissions struct {
+	Uid  uint32
+	Gid  uint32
+	Mode os.FileMode
+}
+
+// What the indexer records about the content of a file so it can be described without reaching the storage. Checksum
+// is the SHA-256 of the content in hex. Details that were never recorded are left at their zero value.
+type FileDetails struct {
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+	MimeType string
+}
+
+// A change to the tags of a file or to the set of files, as recorded in the history of the metadata database. File and
+// Tag are as they were at the time of the change; Tag is only set for changes to the tags of a file. Source names the
+// program that made the change, empty if it isn't known.
+type HistoryEntry struct {
+	Id     int64
+	Time   time.Time
+	Source string
+	Action string
+	File   FileInfo
+	Tag    TagInfo
+}
+
+// Where a file is kept when it isn't on local disk: Scheme names the kind of storage (i.e. s3, gdrive), Bucket and
+// Endpoint which one of them. The path of such a file is its location within the bucket. The zero value is local disk.
+type Location struct {
+	Scheme   string
+	Bucket   string
+	Endpoint string
+}
+
+// Scheme of the files on local disk, also assumed for files recorded without a scheme.
+const LocalScheme = "file"
+
+// Tells whether the location is local disk.
+func (l Location) IsLocal() bool {
+	return l.Scheme == "" || l.Scheme == LocalScheme
+}
+
+// A pass of the indexer over a directory. Finished is left at its zero value while the run is going on, or if it was
+// interrupted.
+type IndexRun struct {
+	Id       int64
+	Root     string
+	Started  time.Time
+	Finished time.Time
+}
+
 var UnknownTag = TagInfo{Id: -1, Text: ""}
 
 var UnknownFile = FileInfo{Id: -1}
+
+var UnknownQuery = SavedQuery{}
+
+var UnknownIndexRun = IndexRun{Id: -1}
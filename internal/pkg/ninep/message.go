@@ -0,0 +1,206 @@
+package ninep
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Returned when a message is shorter than its fields or longer than the message size agreed on.
+var ErrMalformed = errors.New("malformed 9P message")
+
+// Types of the 9P2000 messages. Each reply (R) is the type of its request (T) plus one.
+const (
+	msgTversion = 100
+	msgRversion = 101
+	msgTauth    = 102
+	msgTattach  = 104
+	msgRattach  = 105
+	msgRerror   = 107
+	msgTflush   = 108
+	msgRflush   = 109
+	msgTwalk    = 110
+	msgRwalk    = 111
+	msgTopen    = 112
+	msgRopen    = 113
+	msgTcreate  = 114
+	msgTread    = 116
+	msgRread    = 117
+	msgTwrite   = 118
+	msgTclunk   = 120
+	msgRclunk   = 121
+	msgTremove  = 122
+	msgTstat    = 124
+	msgRstat    = 125
+	msgTwstat   = 126
+)
+
+const (
+	// version of the protocol spoken
+	version = "9P2000"
+	// largest message the server handles
+	maxMessageSize = 64*1024 + headerSize
+	// size, type and tag of a message
+	headerSize = 4 + 1 + 2
+	// size of the header of a read reply, up to its data
+	readHeaderSize = headerSize + 4
+	// most names walked by a single walk request
+	maxWalkNames = 16
+)
+
+// Bits of the qid type and of the mode in a stat.
+const (
+	qidTypeDir = 0x80
+	modeDir    = 0x80000000
+)
+
+// Modes of an open request.
+const (
+	openRead     = 0
+	openExec     = 3
+	openTruncate = 0x10
+	openRemove   = 0x40
+)
+
+// Identifies a file on the server: the same file (wherever it is walked to) has the same path.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// The fields of a stat used by the server, see stat.
+type dirStat struct {
+	qid    qid
+	mode   uint32
+	atime  uint32
+	mtime  uint32
+	length uint64
+	name   string
+	uid    string
+	gid    string
+}
+
+// Builds a message, appending its fields in order.
+type encoder struct {
+	buf []byte
+}
+
+// Starts a message of the type passed in, replying to the request with the tag passed in.
+func newMessage(typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = append(e.buf, byte(v), byte(v>>8))
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = append(e.buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func (e *encoder) u64(v uint64) {
+	e.u32(uint32(v))
+	e.u32(uint32(v >> 32))
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+// Appends a stat, preceded by its size. Type, dev and muid are left empty.
+func (e *encoder) stat(s dirStat) {
+	start := len(e.buf)
+	e.u16(0)
+	e.u16(0)
+	e.u32(0)
+	e.qid(s.qid)
+	e.u32(s.mode)
+	e.u32(s.atime)
+	e.u32(s.mtime)
+	e.u64(s.length)
+	e.str(s.name)
+	e.str(s.uid)
+	e.str(s.gid)
+	e.str("")
+	binary.LittleEndian.PutUint16(e.buf[start:], uint16(len(e.buf)-start-2))
+}
+
+// Returns the message, its size filled in.
+func (e *encoder) message() []byte {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// Reads the fields of a message in order. Reading past its end sets err, after which every field reads as zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// Takes the next n bytes of the message.
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || len(d.buf) < n {
+		d.err = ErrMalformed
+		return make([]byte, n)
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	return d.next(1)[0]
+}
+
+func (d *decoder) u16() uint16 {
+	return binary.LittleEndian.Uint16(d.next(2))
+}
+
+func (d *decoder) u32() uint32 {
+	return binary.LittleEndian.Uint32(d.next(4))
+}
+
+func (d *decoder) u64() uint64 {
+	return binary.LittleEndian.Uint64(d.next(8))
+}
+
+func (d *decoder) str() string {
+	return string(d.next(int(d.u16())))
+}
+
+// Reads the next message, up to the size passed in, returning its type, its tag and a decoder of its other fields.
+func readMessage(r io.Reader, maxSize uint32) (uint8, uint16, *decoder, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(size[:])
+	if length < headerSize || length > maxSize {
+		return 0, 0, nil, ErrMalformed
+	}
+	body := make([]byte, length-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, 0, nil, err
+	}
+	d := &decoder{buf: body}
+	return d.u8(), d.u16(), d, nil
+}
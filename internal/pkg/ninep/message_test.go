@@ -0,0 +1,69 @@
+package ninep
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Verifies messages are read back with the fields they were built with.
+func TestReadMessage(t *testing.T) {
+	msg := newMessage(msgTwalk, 7)
+	msg.u32(1)
+	msg.u32(2)
+	msg.u16(2)
+	msg.str("docs")
+	msg.str("readme.txt")
+	valid := msg.message()
+	conditions := []struct {
+		data        []byte
+		maxSize     uint32
+		expectedErr error
+	}{
+		{valid, maxMessageSize, nil},
+		{valid, uint32(len(valid) - 1), ErrMalformed},
+		{[]byte{3, 0, 0, 0, msgTwalk, 7, 0}, maxMessageSize, ErrMalformed},
+	}
+	for _, condition := range conditions {
+		typ, tag, d, err := readMessage(bytes.NewReader(condition.data), condition.maxSize)
+		if err != condition.expectedErr {
+			t.Errorf("Expected %v reading %x but got %v", condition.expectedErr, condition.data, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if typ != msgTwalk || tag != 7 {
+			t.Errorf("Expected a walk tagged 7 but got %d tagged %d", typ, tag)
+		}
+		if fid, newFid, count, first, second := d.u32(), d.u32(), d.u16(), d.str(), d.str(); fid != 1 || newFid != 2 ||
+			count != 2 || first != "docs" || second != "readme.txt" || d.err != nil {
+			t.Errorf("Expected the fields the walk was built with but got %d %d %d %s %s (%v)", fid, newFid, count,
+				first, second, d.err)
+		}
+		if d.u8(); d.err != ErrMalformed {
+			t.Errorf("Expected reading past the end of the message to fail but got %v", d.err)
+		}
+	}
+}
+
+// Verifies a stat starts with its size and ends with the (empty) name of the user who last modified the file.
+func TestEncoderStat(t *testing.T) {
+	e := &encoder{}
+	e.stat(dirStat{qid: qid{typ: qidTypeDir, path: 42}, mode: modeDir | 0755, length: 3, name: "docs", uid: "501",
+		gid: "20"})
+	d := &decoder{buf: e.buf}
+	size := d.u16()
+	if int(size) != len(e.buf)-2 {
+		t.Errorf("Expected the stat to be %d bytes but got %d", len(e.buf)-2, size)
+	}
+	d.u16()
+	d.u32()
+	typ, _, path := d.u8(), d.u32(), d.u64()
+	mode, _, _, length := d.u32(), d.u32(), d.u32(), d.u64()
+	name, uid, gid, muid := d.str(), d.str(), d.str(), d.str()
+	if typ != qidTypeDir || path != 42 || mode != modeDir|0755 || length != 3 || name != "docs" || uid != "501" ||
+		gid != "20" || muid != "" || len(d.buf) != 0 || d.err != nil {
+		t.Errorf("Expected the fields of the stat but got %d %d %o %d %s %s %s %q (%v)", typ, path, mode, length,
+			name, uid, gid, muid, d.err)
+	}
+}
@@ -0,0 +1,518 @@
+// Package ninep serves a file system built on the bazil.org/fuse/fs node interfaces over the 9P2000 protocol, so it
+// can be mounted (i.e. with the Linux v9fs client or plan9port's 9pfuse) where FUSE isn't available. The file system
+// is served read-only.
+package ninep
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Returned to requests that would change the file system.
+var errReadOnly = fuse.Errno(syscall.EROFS)
+
+// Server serves a file system to the clients connecting to it.
+type Server struct {
+	// the file system served
+	FS fs.FS
+	// user and group ids the requests made to the nodes of the file system carry, whoever the client is
+	Uid uint32
+	Gid uint32
+}
+
+// Accepts connections, serving each of them until it is closed, until the listener fails (i.e. once it is closed).
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := s.ServeConn(conn); err != nil && err != io.EOF {
+				log.Printf("Stopped serving %s: %s", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Serves the requests made over a connection one at a time, until the connection is closed or a malformed message
+// is read from it. Closes the connection once done.
+func (s *Server) ServeConn(conn io.ReadWriteCloser) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := &connection{server: s, conn: conn, msize: maxMessageSize, fids: make(map[uint32]*fid)}
+	defer c.close(ctx)
+	for {
+		typ, tag, d, err := readMessage(conn, c.msize)
+		if err != nil {
+			return err
+		}
+		reply := c.handle(ctx, typ, tag, d)
+		if _, err = conn.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// The state of a connection to the server.
+type connection struct {
+	server *Server
+	conn   io.ReadWriteCloser
+	// largest message agreed on with the client
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+// A file of the file system a client walked to.
+type fid struct {
+	// the nodes from the root down to the file, along with their names, so .. can be walked back
+	nodes []fs.Node
+	names []string
+	// the handle the file was opened with; nil until opened
+	handle fs.Handle
+	dir    bool
+	// the stats of the entries of a directory, read when a read at offset 0 is made
+	entries []byte
+}
+
+// Returns the node of the file.
+func (f *fid) node() fs.Node {
+	return f.nodes[len(f.nodes)-1]
+}
+
+// Returns the path of the file from the root, which is /.
+func (f *fid) path() string {
+	return "/" + strings.Join(f.names, "/")
+}
+
+// Handles a request, returning the reply.
+func (c *connection) handle(ctx context.Context, typ uint8, tag uint16, d *decoder) []byte {
+	var reply *encoder
+	var err error
+	switch typ {
+	case msgTversion:
+		reply, err = c.version(ctx, tag, d)
+	case msgTauth:
+		err = errors.New("authentication not required")
+	case msgTattach:
+		reply, err = c.attach(ctx, tag, d)
+	case msgTflush:
+		// requests are handled one at a time, so the one flushed already got its reply
+		reply = newMessage(msgRflush, tag)
+	case msgTwalk:
+		reply, err = c.walk(ctx, tag, d)
+	case msgTopen:
+		reply, err = c.open(ctx, tag, d)
+	case msgTread:
+		reply, err = c.read(ctx, tag, d)
+	case msgTclunk:
+		reply, err = c.clunk(ctx, tag, d)
+	case msgTremove:
+		// the fid is clunked even though the file can't be removed
+		if _, err = c.clunk(ctx, tag, d); err == nil {
+			err = errReadOnly
+		}
+	case msgTstat:
+		reply, err = c.stat(ctx, tag, d)
+	case msgTcreate, msgTwrite, msgTwstat:
+		err = errReadOnly
+	default:
+		err = fuse.Errno(syscall.ENOSYS)
+	}
+	if err == nil && d.err != nil {
+		err = d.err
+	}
+	if err != nil {
+		reply = newMessage(msgRerror, tag)
+		reply.str(err.Error())
+	}
+	return reply.message()
+}
+
+// Agrees on the protocol version and the largest message size, starting a new session.
+func (c *connection) version(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	msize, clientVersion := d.u32(), d.str()
+	if msize < readHeaderSize+1 {
+		return nil, ErrMalformed
+	}
+	if msize < c.msize {
+		c.msize = msize
+	}
+	c.clunkAll(ctx)
+	reply := newMessage(msgRversion, tag)
+	reply.u32(c.msize)
+	if strings.HasPrefix(clientVersion, version) {
+		reply.str(version)
+	} else {
+		reply.str("unknown")
+	}
+	return reply, nil
+}
+
+// Binds a fid to the root of the file system.
+func (c *connection) attach(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	fidNum, _, _, _ := d.u32(), d.u32(), d.str(), d.str()
+	if _, exists := c.fids[fidNum]; exists {
+		return nil, errors.New("fid in use")
+	}
+	root, err := c.server.FS.Root()
+	if err != nil {
+		return nil, err
+	}
+	f := &fid{nodes: []fs.Node{root}}
+	q, _, err := c.qid(ctx, f.path(), root)
+	if err != nil {
+		return nil, err
+	}
+	c.fids[fidNum] = f
+	reply := newMessage(msgRattach, tag)
+	reply.qid(q)
+	return reply, nil
+}
+
+// Walks a fid down (or up, with ..) the names passed in, binding the file reached to a new fid. When a name other than
+// the first can't be walked, the fid isn't bound and the qids of the names walked so far are returned.
+func (c *connection) walk(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	fidNum, newFidNum := d.u32(), d.u32()
+	names := make([]string, d.u16())
+	for i := range names {
+		names[i] = d.str()
+	}
+	f, err := c.fid(fidNum)
+	if err != nil {
+		return nil, err
+	}
+	if f.handle != nil {
+		return nil, errors.New("fid is open")
+	}
+	if len(names) > maxWalkNames {
+		return nil, fuse.Errno(syscall.E2BIG)
+	}
+	if _, exists := c.fids[newFidNum]; exists && newFidNum != fidNum {
+		return nil, errors.New("fid in use")
+	}
+	walked := &fid{nodes: f.nodes, names: f.names}
+	var qids []qid
+	for _, name := range names {
+		if walked, err = c.step(ctx, walked, name); err != nil {
+			break
+		}
+		var q qid
+		if q, _, err = c.qid(ctx, walked.path(), walked.node()); err != nil {
+			break
+		}
+		qids = append(qids, q)
+	}
+	if err != nil && len(qids) == 0 {
+		return nil, err
+	}
+	if len(qids) == len(names) {
+		c.fids[newFidNum] = walked
+	}
+	reply := newMessage(msgRwalk, tag)
+	reply.u16(uint16(len(qids)))
+	for _, q := range qids {
+		reply.qid(q)
+	}
+	return reply, nil
+}
+
+// Returns the file a name leads to from the file passed in.
+func (c *connection) step(ctx context.Context, f *fid, name string) (*fid, error) {
+	nodes := f.nodes[:len(f.nodes):len(f.nodes)]
+	names := f.names[:len(f.names):len(f.names)]
+	if name == ".." {
+		if len(names) == 0 {
+			// the parent of the root is the root
+			return f, nil
+		}
+		return &fid{nodes: nodes[:len(nodes)-1], names: names[:len(names)-1]}, nil
+	}
+	child, err := c.lookup(ctx, f.node(), name)
+	if err != nil {
+		return nil, err
+	}
+	return &fid{nodes: append(nodes, child), names: append(names, name)}, nil
+}
+
+// Looks up a name in a directory.
+func (c *connection) lookup(ctx context.Context, dir fs.Node, name string) (fs.Node, error) {
+	switch lookuper := dir.(type) {
+	case fs.NodeRequestLookuper:
+		req := &fuse.LookupRequest{Header: c.header(), Name: name}
+		return lookuper.Lookup(ctx, req, &fuse.LookupResponse{})
+	case fs.NodeStringLookuper:
+		return lookuper.Lookup(ctx, name)
+	}
+	return nil, fuse.ENOENT
+}
+
+// Opens the file of a fid for reading. Opening it for anything else is refused.
+func (c *connection) open(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	fidNum, mode := d.u32(), d.u8()
+	f, err := c.fid(fidNum)
+	if err != nil {
+		return nil, err
+	}
+	if f.handle != nil {
+		return nil, errors.New("fid is open")
+	}
+	if access := mode & 3; (access != openRead && access != openExec) || mode&(openTruncate|openRemove) != 0 {
+		return nil, errReadOnly
+	}
+	q, attr, err := c.qid(ctx, f.path(), f.node())
+	if err != nil {
+		return nil, err
+	}
+	f.dir = attr.Mode.IsDir()
+	f.handle = f.node()
+	if opener, ok := f.node().(fs.NodeOpener); ok {
+		req := &fuse.OpenRequest{Header: c.header(), Dir: f.dir, Flags: fuse.OpenReadOnly}
+		if f.handle, err = opener.Open(ctx, req, &fuse.OpenResponse{}); err != nil {
+			return nil, err
+		}
+	}
+	reply := newMessage(msgRopen, tag)
+	reply.qid(q)
+	reply.u32(c.msize - readHeaderSize)
+	return reply, nil
+}
+
+// Reads the content of an open file, or the stats of the entries of an open directory.
+func (c *connection) read(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	fidNum, offset, count := d.u32(), d.u64(), d.u32()
+	f, err := c.fid(fidNum)
+	if err != nil {
+		return nil, err
+	}
+	if f.handle == nil {
+		return nil, errors.New("fid not open")
+	}
+	if count > c.msize-readHeaderSize {
+		count = c.msize - readHeaderSize
+	}
+	var data []byte
+	if f.dir {
+		data, err = c.readDir(ctx, f, offset, count)
+	} else {
+		data, err = c.readFile(ctx, f, offset, count)
+	}
+	if err != nil {
+		return nil, err
+	}
+	reply := newMessage(msgRread, tag)
+	reply.u32(uint32(len(data)))
+	reply.bytes(data)
+	return reply, nil
+}
+
+// Reads the stats of the entries of a directory that fit in count bytes, from the offset passed in. The entries are
+// listed when read from offset 0; later reads continue where the previous one stopped.
+func (c *connection) readDir(ctx context.Context, f *fid, offset uint64, count uint32) ([]byte, error) {
+	if offset == 0 {
+		lister, ok := f.handle.(fs.HandleReadDirAller)
+		if !ok {
+			return nil, fuse.Errno(syscall.ENOTDIR)
+		}
+		dirents, err := lister.ReadDirAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entries := &encoder{}
+		for _, dirent := range dirents {
+			child, err := c.lookup(ctx, f.node(), dirent.Name)
+			if err != nil {
+				// the entry went away since it was listed
+				continue
+			}
+			stat, err := c.dirStat(ctx, strings.TrimSuffix(f.path(), "/")+"/"+dirent.Name, dirent.Name, child)
+			if err != nil {
+				continue
+			}
+			entries.stat(stat)
+		}
+		f.entries = entries.buf
+	}
+	if offset >= uint64(len(f.entries)) {
+		return nil, nil
+	}
+	// only whole entries are returned
+	entries := f.entries[offset:]
+	end := 0
+	for end+2 <= len(entries) {
+		size := 2 + int(binary.LittleEndian.Uint16(entries[end:]))
+		if end+size > int(count) {
+			break
+		}
+		end += size
+	}
+	if end == 0 && len(entries) > 0 {
+		return nil, fuse.Errno(syscall.EMSGSIZE)
+	}
+	return entries[:end], nil
+}
+
+// Reads up to count bytes of a file from the offset passed in.
+func (c *connection) readFile(ctx context.Context, f *fid, offset uint64, count uint32) ([]byte, error) {
+	switch handle := f.handle.(type) {
+	case fs.HandleReader:
+		req := &fuse.ReadRequest{Header: c.header(), Offset: int64(offset), Size: int(count),
+			FileFlags: fuse.OpenReadOnly}
+		resp := &fuse.ReadResponse{}
+		if err := handle.Read(ctx, req, resp); err != nil {
+			return nil, err
+		}
+		return resp.Data, nil
+	case fs.HandleReadAller:
+		data, err := handle.ReadAll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if offset >= uint64(len(data)) {
+			return nil, nil
+		}
+		data = data[offset:]
+		if uint64(len(data)) > uint64(count) {
+			data = data[:count]
+		}
+		return data, nil
+	}
+	return nil, fuse.Errno(syscall.EIO)
+}
+
+// Forgets a fid, releasing the handle it was opened with.
+func (c *connection) clunk(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	fidNum := d.u32()
+	f, err := c.fid(fidNum)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.fids, fidNum)
+	if err = c.release(ctx, f); err != nil {
+		return nil, err
+	}
+	return newMessage(msgRclunk, tag), nil
+}
+
+// Reports the stat of the file of a fid.
+func (c *connection) stat(ctx context.Context, tag uint16, d *decoder) (*encoder, error) {
+	f, err := c.fid(d.u32())
+	if err != nil {
+		return nil, err
+	}
+	name := "/"
+	if len(f.names) > 0 {
+		name = f.names[len(f.names)-1]
+	}
+	stat, err := c.dirStat(ctx, f.path(), name, f.node())
+	if err != nil {
+		return nil, err
+	}
+	// the stat is preceded by its size, on top of the size it starts with
+	entry := &encoder{}
+	entry.stat(stat)
+	reply := newMessage(msgRstat, tag)
+	reply.u16(uint16(len(entry.buf)))
+	reply.bytes(entry.buf)
+	return reply, nil
+}
+
+// Builds the stat of a node from its attributes.
+func (c *connection) dirStat(ctx context.Context, path string, name string, node fs.Node) (dirStat, error) {
+	q, attr, err := c.qid(ctx, path, node)
+	if err != nil {
+		return dirStat{}, err
+	}
+	mode := uint32(attr.Mode.Perm())
+	if attr.Mode.IsDir() {
+		mode |= modeDir
+	}
+	return dirStat{
+		qid:    q,
+		mode:   mode,
+		atime:  uint32(attr.Atime.Unix()),
+		mtime:  uint32(attr.Mtime.Unix()),
+		length: attr.Size,
+		name:   name,
+		uid:    strconv.FormatUint(uint64(attr.Uid), 10),
+		gid:    strconv.FormatUint(uint64(attr.Gid), 10),
+	}, nil
+}
+
+// Returns the qid of a node, along with its attributes. The path of the qid is the inode of the node, or a hash of
+// the path passed in when it has none. Directories have no version; the version of a file is its modification time.
+func (c *connection) qid(ctx context.Context, path string, node fs.Node) (qid, fuse.Attr, error) {
+	var attr fuse.Attr
+	if err := node.Attr(ctx, &attr); err != nil {
+		return qid{}, attr, err
+	}
+	q := qid{path: attr.Inode}
+	if q.path == 0 {
+		hash := fnv.New64a()
+		io.WriteString(hash, path)
+		q.path = hash.Sum64()
+	}
+	if attr.Mode.IsDir() {
+		q.typ = qidTypeDir
+	} else {
+		q.version = uint32(attr.Mtime.Unix())
+	}
+	return q, attr, nil
+}
+
+// Returns the fid with the number passed in.
+func (c *connection) fid(fidNum uint32) (*fid, error) {
+	f, ok := c.fids[fidNum]
+	if !ok {
+		return nil, errors.New("unknown fid")
+	}
+	return f, nil
+}
+
+// Releases the handle a fid was opened with, if any.
+func (c *connection) release(ctx context.Context, f *fid) error {
+	if f.handle == nil {
+		return nil
+	}
+	if flusher, ok := f.handle.(fs.HandleFlusher); ok {
+		if err := flusher.Flush(ctx, &fuse.FlushRequest{Header: c.header()}); err != nil {
+			return err
+		}
+	}
+	if releaser, ok := f.handle.(fs.HandleReleaser); ok {
+		return releaser.Release(ctx, &fuse.ReleaseRequest{Header: c.header(), Dir: f.dir, Flags: fuse.OpenReadOnly})
+	}
+	return nil
+}
+
+// Forgets every fid, releasing the open ones.
+func (c *connection) clunkAll(ctx context.Context) {
+	for fidNum, f := range c.fids {
+		if err := c.release(ctx, f); err != nil {
+			log.Printf("Could not release %s: %s", f.path(), err)
+		}
+		delete(c.fids, fidNum)
+	}
+}
+
+// Ends the connection, releasing the files still open.
+func (c *connection) close(ctx context.Context) {
+	c.clunkAll(ctx)
+	c.conn.Close()
+}
+
+// Returns the header of the requests made to the nodes of the file system.
+func (c *connection) header() fuse.Header {
+	return fuse.Header{Uid: c.server.Uid, Gid: c.server.Gid, Pid: uint32(os.Getpid())}
+}
@@ -0,0 +1,190 @@
+package ninep
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var readme = "the content of the readme"
+
+// A directory of the file system served in tests.
+type testDir struct {
+	entries map[string]fs.Node
+}
+
+func (d *testDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0755
+	return nil
+}
+
+func (d *testDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	if node, ok := d.entries[req.Name]; ok {
+		return node, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *testDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var dirents []fuse.Dirent
+	for name := range d.entries {
+		dirents = append(dirents, fuse.Dirent{Name: name})
+	}
+	return dirents, nil
+}
+
+// A file of the file system served in tests, released once read.
+type testFile struct {
+	content  string
+	released int
+}
+
+func (f *testFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = 7
+	a.Mode = 0644
+	a.Size = uint64(len(f.content))
+	a.Mtime = time.Unix(1500000000, 0)
+	a.Uid = 501
+	return nil
+}
+
+func (f *testFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(f.content), nil
+}
+
+func (f *testFile) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	f.released++
+	return nil
+}
+
+type testFS struct {
+	root *testDir
+}
+
+func (f *testFS) Root() (fs.Node, error) {
+	return f.root, nil
+}
+
+// Sends a request and reads its reply.
+func roundTrip(t *testing.T, conn net.Conn, request *encoder) (uint8, *decoder) {
+	if _, err := conn.Write(request.message()); err != nil {
+		t.Fatalf("Could not send request: %v", err)
+	}
+	typ, _, d, err := readMessage(conn, maxMessageSize)
+	if err != nil {
+		t.Fatalf("Could not read reply: %v", err)
+	}
+	return typ, d
+}
+
+// Builds a request with the fields passed in, in order.
+func request(typ uint8, fields ...interface{}) *encoder {
+	e := newMessage(typ, 1)
+	for _, field := range fields {
+		switch value := field.(type) {
+		case uint8:
+			e.u8(value)
+		case uint16:
+			e.u16(value)
+		case uint32:
+			e.u32(value)
+		case uint64:
+			e.u64(value)
+		case string:
+			e.str(value)
+		}
+	}
+	return e
+}
+
+// Verifies clients can walk to the files of the file system, read them and list directories, and are refused changes.
+func TestServeConn(t *testing.T) {
+	file := &testFile{content: readme}
+	root := &testDir{entries: map[string]fs.Node{
+		"docs": &testDir{entries: map[string]fs.Node{"readme.txt": file}},
+	}}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go (&Server{FS: &testFS{root: root}}).ServeConn(conn)
+
+	readString := func(d *decoder) interface{} {
+		return string(d.next(int(d.u32())))
+	}
+	walked := func(d *decoder) interface{} {
+		return d.u16()
+	}
+	conditions := []struct {
+		request      *encoder
+		expectedType uint8
+		// reads the part of the reply checked
+		read     func(d *decoder) interface{}
+		expected interface{}
+	}{
+		{request(msgTversion, uint32(8192), "9P2000.L"), msgRversion,
+			func(d *decoder) interface{} { return []interface{}{d.u32(), d.str()} }, []interface{}{uint32(8192), version}},
+		{request(msgTattach, uint32(1), ^uint32(0), "someone", ""), msgRattach,
+			func(d *decoder) interface{} { return d.u8() }, uint8(qidTypeDir)},
+		{request(msgTwalk, uint32(1), uint32(2), uint16(2), "docs", "readme.txt"), msgRwalk, walked, uint16(2)},
+		// a walk failing after the first name returns the qids walked
+		{request(msgTwalk, uint32(1), uint32(3), uint16(2), "docs", "missing"), msgRwalk, walked, uint16(1)},
+		{request(msgTwalk, uint32(3), uint32(4), uint16(0)), msgRerror, nil, nil},
+		{request(msgTwalk, uint32(1), uint32(3), uint16(1), "missing"), msgRerror, nil, nil},
+		{request(msgTopen, uint32(2), uint8(openRead|openTruncate)), msgRerror, nil, nil},
+		{request(msgTopen, uint32(2), uint8(openRead)), msgRopen,
+			func(d *decoder) interface{} { return []interface{}{d.u8(), d.u32(), d.u64()} },
+			[]interface{}{uint8(0), uint32(1500000000), uint64(7)}},
+		{request(msgTread, uint32(2), uint64(0), uint32(8)), msgRread, readString, readme[:8]},
+		{request(msgTread, uint32(2), uint64(8), uint32(8192)), msgRread, readString, readme[8:]},
+		{request(msgTread, uint32(2), uint64(100), uint32(8192)), msgRread, readString, ""},
+		{request(msgTwrite, uint32(2), uint64(0), uint32(0)), msgRerror, nil, nil},
+		{request(msgTstat, uint32(2)), msgRstat, func(d *decoder) interface{} {
+			d.next(2 + 2 + 2 + 4 + 13)
+			mode, _, _, length, name, uid := d.u32(), d.u32(), d.u32(), d.u64(), d.str(), d.str()
+			return []interface{}{mode, length, name, uid}
+		}, []interface{}{uint32(0644), uint64(len(readme)), "readme.txt", "501"}},
+		{request(msgTclunk, uint32(2)), msgRclunk, nil, nil},
+		{request(msgTclunk, uint32(2)), msgRerror, nil, nil},
+		// .. walks back to the parent, up to the root
+		{request(msgTwalk, uint32(1), uint32(2), uint16(4), "docs", "..", "..", "docs"), msgRwalk, walked, uint16(4)},
+		{request(msgTopen, uint32(2), uint8(openRead)), msgRopen, nil, nil},
+		{request(msgTread, uint32(2), uint64(0), uint32(8192)), msgRread, func(d *decoder) interface{} {
+			d.u32()
+			var names []string
+			for len(d.buf) > 0 && d.err == nil {
+				entry := &decoder{buf: d.next(int(d.u16()))}
+				entry.next(2 + 4 + 13 + 4 + 4 + 4 + 8)
+				names = append(names, entry.str())
+			}
+			return names
+		}, []string{"readme.txt"}},
+		{request(msgTcreate, uint32(2), "new.txt", uint32(0644), uint8(1)), msgRerror, nil, nil},
+		{request(msgTremove, uint32(2)), msgRerror, nil, nil},
+		{request(msgTstat, uint32(2)), msgRerror, nil, nil},
+		{request(msgTauth, uint32(5), "someone", ""), msgRerror, nil, nil},
+	}
+	for i, condition := range conditions {
+		typ, d := roundTrip(t, client, condition.request)
+		if typ != condition.expectedType {
+			message := ""
+			if typ == msgRerror {
+				message = d.str()
+			}
+			t.Errorf("Expected reply %d to request %d but got %d %s", condition.expectedType, i, typ, message)
+			continue
+		}
+		if condition.read == nil {
+			continue
+		}
+		if value := condition.read(d); !reflect.DeepEqual(value, condition.expected) {
+			t.Errorf("Expected %v in the reply to request %d but got %v", condition.expected, i, value)
+		}
+	}
+	if file.released != 1 {
+		t.Errorf("Expected the file to be released once when clunked but got %d", file.released)
+	}
+}
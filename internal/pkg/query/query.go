@@ -0,0 +1,179 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Characters with special meaning in a query expression.
+const operators = "&|!()"
+
+// Characters comparing an attribute to a value, see Attribute.
+const comparisons = "=<>"
+
+// Expr is a node in a parsed tag expression.
+type Expr interface {
+	String() string
+}
+
+// Tag matches files that have the named tag.
+type Tag struct {
+	Name string
+}
+
+// Not matches files that do not match the wrapped expression.
+type Not struct {
+	Expr Expr
+}
+
+// And matches files that match both sides.
+type And struct {
+	Left  Expr
+	Right Expr
+}
+
+// Or matches files that match either side.
+type Or struct {
+	Left  Expr
+	Right Expr
+}
+
+// Attribute matches files whose attribute named Key compares to Value with Op, one of =, <, <=, > and >=. Values that
+// are numbers are compared as numbers.
+type Attribute struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+func (t Tag) String() string       { return t.Name }
+func (a Attribute) String() string { return a.Key + a.Op + a.Value }
+func (n Not) String() string       { return fmt.Sprintf("!%s", n.Expr) }
+func (a And) String() string       { return fmt.Sprintf("(%s & %s)", a.Left, a.Right) }
+func (o Or) String() string        { return fmt.Sprintf("(%s | %s)", o.Left, o.Right) }
+
+// Reports whether a name should be treated as a query expression rather than a plain tag or file name.
+func IsQuery(name string) bool {
+	return strings.ContainsAny(name, operators+comparisons)
+}
+
+// Parses a boolean tag expression such as "vacation & 2019 & !work". Supported operators, from highest to lowest
+// precedence, are ! (not), & (and) and | (or); parentheses can be used for grouping. Tag names are trimmed of
+// surrounding whitespace. Names comparing an attribute to a value, such as "year>=2018" or "camera=Nikon", match files
+// by their attributes rather than their tags.
+func Parse(expression string) (Expr, error) {
+	p := &parser{input: expression}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos], p.pos)
+	}
+	return expr, nil
+}
+
+// Recursive descent parser over the expression string.
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// Consumes the operator if it is the next non-space character.
+func (p *parser) accept(op byte) bool {
+	p.skipSpace()
+	if p.pos < len(p.input) && p.input[p.pos] == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept('|') {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept('&') {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = And{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	if p.accept('!') {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Expr: expr}, nil
+	}
+	if p.accept('(') {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(')') {
+			return nil, errors.New("missing closing parenthesis")
+		}
+		return expr, nil
+	}
+	return p.parseTag()
+}
+
+func (p *parser) parseTag() (Expr, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && strings.IndexByte(operators, p.input[p.pos]) < 0 {
+		p.pos++
+	}
+	name := strings.TrimSpace(p.input[start:p.pos])
+	if len(name) == 0 {
+		return nil, fmt.Errorf("expected tag name at position %d", start)
+	}
+	if i := strings.IndexAny(name, comparisons); i >= 0 {
+		return parseAttribute(name, i)
+	}
+	return Tag{Name: name}, nil
+}
+
+// Splits a comparison of an attribute to a value at the comparison starting at index i.
+func parseAttribute(comparison string, i int) (Expr, error) {
+	op := comparison[i : i+1]
+	if op != "=" && i+1 < len(comparison) && comparison[i+1] == '=' {
+		op += "="
+	}
+	attribute := Attribute{Key: strings.TrimSpace(comparison[:i]), Op: op,
+		Value: strings.TrimSpace(comparison[i+len(op):])}
+	if attribute.Key == "" || attribute.Value == "" {
+		return nil, fmt.Errorf("expected an attribute and a value around %s in %q", op, comparison)
+	}
+	return attribute, nil
+}
@@ -0,0 +1,64 @@
+package query
+
+import (
+	"testing"
+)
+
+// Verifies expressions are parsed with the right precedence and grouping.
+func TestParse(t *testing.T) {
+	conditions := []struct {
+		expression string
+		expected   string
+	}{
+		{"vacation", "vacation"},
+		{" new york ", "new york"},
+		{"vacation & 2019 & !work", "((vacation & 2019) & !work)"},
+		{"a | b & c", "(a | (b & c))"},
+		{"(a | b) & c", "((a | b) & c)"},
+		{"!!a", "!!a"},
+		{"!(a|b)", "!(a | b)"},
+		{"year>=2018", "year>=2018"},
+		{"camera = Nikon D750 & year<2020", "(camera=Nikon D750 & year<2020)"},
+		{"!rating=5", "!rating=5"},
+	}
+	for _, condition := range conditions {
+		expr, err := Parse(condition.expression)
+		if err != nil {
+			t.Errorf("Could not parse %q: %v", condition.expression, err)
+		} else if expr.String() != condition.expected {
+			t.Errorf("Expected %q to parse as %s but got %s", condition.expression, condition.expected, expr)
+		}
+	}
+}
+
+// Verifies malformed expressions are rejected.
+func TestParseErrors(t *testing.T) {
+	expressions := []string{"", "a &", "& a", "(a | b", "a)", "a (b)", "!", "a || b", "=x", "year>=", "a & <3"}
+	for _, expression := range expressions {
+		expr, err := Parse(expression)
+		if err == nil {
+			t.Errorf("Expected %q to fail to parse but got %s", expression, expr)
+		}
+	}
+}
+
+// Verifies only names containing operators are treated as queries.
+func TestIsQuery(t *testing.T) {
+	conditions := []struct {
+		name     string
+		expected bool
+	}{
+		{"photos", false},
+		{"new york", false},
+		{"a&b", true},
+		{"!work", true},
+		{"a|b", true},
+		{"photo (1).jpg", true},
+		{"year>=2018", true},
+	}
+	for _, condition := range conditions {
+		if IsQuery(condition.name) != condition.expected {
+			t.Errorf("Expected IsQuery(%q) to be %v", condition.name, condition.expected)
+		}
+	}
+}
@@ -1,22 +1,33 @@
 package storage
 
 import (
+	"errors"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
 	"io"
 	"os"
+	"sync"
 )
 
 // Abstraction over the file storage system.
 type FileStorage interface {
 	Open(name string) (File, error)
+	// Opens a file with the flags (os.O_RDWR, os.O_TRUNC, etc.) passed in, creating it with perm if needed.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
 	Stat(name string) (os.FileInfo, error)
+	// Creates a directory along with any missing parents, doing nothing if it already exists.
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
 }
 
 type File interface {
 	io.Closer
 	io.Reader
-	//io.ReaderAt
+	io.ReaderAt
+	io.WriterAt
 	//io.Seeker
 	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
 }
 
 // LocalFileStorage implements the fileStorage interface using the local OS
@@ -25,5 +36,71 @@ type LocalFileStorage struct{}
 // Opens a local file by delegating to the os.Open function
 func (LocalFileStorage) Open(name string) (File, error) { return os.Open(name) }
 
+// Opens a local file by delegating to the os.OpenFile function
+func (LocalFileStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
 // Stats a local file by delegating to the os.Stat function
 func (LocalFileStorage) Stat(name string) (os.FileInfo, error) { return os.Stat(name) }
+
+// Creates local directories by delegating to the os.MkdirAll function
+func (LocalFileStorage) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+
+// Removes a local file by delegating to the os.Remove function
+func (LocalFileStorage) Remove(name string) error { return os.Remove(name) }
+
+// Returned by Backends.For for locations whose scheme has no storage registered.
+var ErrUnsupportedScheme = errors.New("no storage is registered for the scheme")
+
+// Creates the storage reaching the files of a location of the scheme it was registered for.
+type Opener func(location metadata.Location) (FileStorage, error)
+
+// Backends dispatches files to the storage of their location: local files go to the local storage, others to the
+// storage created by the opener registered for their scheme, which is created once per bucket and endpoint.
+type Backends struct {
+	local   FileStorage
+	mu      sync.Mutex
+	openers map[string]Opener
+	opened  map[metadata.Location]FileStorage
+}
+
+func NewBackends(local FileStorage) *Backends {
+	return &Backends{local: local, openers: make(map[string]Opener), opened: make(map[metadata.Location]FileStorage)}
+}
+
+// Registers the opener of the storage of a scheme, replacing any registered before.
+func (b *Backends) Register(scheme string, opener Opener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openers[scheme] = opener
+}
+
+// Tells whether storage other than local disk is registered, i.e. whether locations need looking up at all.
+func (b *Backends) Remote() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.openers) > 0
+}
+
+// Returns the storage of the files of a location.
+func (b *Backends) For(location metadata.Location) (FileStorage, error) {
+	if location.IsLocal() {
+		return b.local, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if opened, ok := b.opened[location]; ok {
+		return opened, nil
+	}
+	opener, ok := b.openers[location.Scheme]
+	if !ok {
+		return nil, ErrUnsupportedScheme
+	}
+	opened, err := opener(location)
+	if err != nil {
+		return nil, err
+	}
+	b.opened[location] = opened
+	return opened, nil
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"errors"
+	"github.com/cfagiani/cotfs/internal/pkg/metadata"
+	"testing"
+)
+
+// Verifies locations are dispatched to the storage of their scheme, created once per bucket and endpoint.
+func TestBackends(t *testing.T) {
+	local := LocalFileStorage{}
+	backends := NewBackends(local)
+	if backends.Remote() {
+		t.Error("Expected no remote storage before any is registered")
+	}
+	opened := 0
+	backends.Register("s3", func(location metadata.Location) (FileStorage, error) {
+		opened++
+		if location.Bucket == "broken" {
+			return nil, errors.New("no such bucket")
+		}
+		return bucketStorage{bucket: location.Bucket}, nil
+	})
+	conditions := []struct {
+		location       metadata.Location
+		expected       FileStorage
+		expectedErr    bool
+		expectedOpened int
+	}{
+		{metadata.Location{}, local, false, 0},
+		{metadata.Location{Scheme: metadata.LocalScheme}, local, false, 0},
+		{metadata.Location{Scheme: "s3", Bucket: "photos"}, bucketStorage{bucket: "photos"}, false, 1},
+		{metadata.Location{Scheme: "s3", Bucket: "photos"}, bucketStorage{bucket: "photos"}, false, 1},
+		{metadata.Location{Scheme: "s3", Bucket: "music"}, bucketStorage{bucket: "music"}, false, 2},
+		{metadata.Location{Scheme: "s3", Bucket: "broken"}, nil, true, 3},
+		{metadata.Location{Scheme: "gdrive"}, nil, true, 3},
+	}
+	for _, condition := range conditions {
+		found, err := backends.For(condition.location)
+		if found != condition.expected || (err != nil) != condition.expectedErr || opened != condition.expectedOpened {
+			t.Errorf("Expected %v for %v after %d opens but got %v (%v) after %d", condition.expected,
+				condition.location, condition.expectedOpened, found, err, opened)
+		}
+	}
+	if _, err := backends.For(metadata.Location{Scheme: "gdrive"}); err != ErrUnsupportedScheme {
+		t.Errorf("Expected an unsupported scheme but got %v", err)
+	}
+	if !backends.Remote() {
+		t.Error("Expected remote storage to be registered")
+	}
+}
+
+// Storage of a bucket, told apart by the bucket's name.
+type bucketStorage struct {
+	LocalFileStorage
+	bucket string
+}